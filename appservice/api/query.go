@@ -88,13 +88,13 @@ func RetrieveUserProfile(
 	asAPI AppServiceQueryAPI,
 	accountDB accounts.Database,
 ) (*authtypes.Profile, error) {
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return nil, err
 	}
 
 	// Try to query the user from the local database
-	profile, err := accountDB.GetProfileByLocalpart(ctx, localpart)
+	profile, err := accountDB.GetProfileByLocalpart(ctx, localpart, serverName)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	} else if profile != nil {
@@ -114,7 +114,7 @@ func RetrieveUserProfile(
 	}
 
 	// Try to query the user from the local database again
-	profile, err = accountDB.GetProfileByLocalpart(ctx, localpart)
+	profile, err = accountDB.GetProfileByLocalpart(ctx, localpart, serverName)
 	if err != nil {
 		return nil, err
 	}
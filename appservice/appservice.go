@@ -69,7 +69,7 @@ func SetupAppServiceAPIComponent(
 		workerStates[i] = ws
 
 		// Create bot account for this AS if it doesn't already exist
-		if err = generateAppServiceAccount(accountsDB, deviceDB, appservice); err != nil {
+		if err = generateAppServiceAccount(accountsDB, deviceDB, appservice, base.Cfg.Matrix.ServerName); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"appservice": appservice.ID,
 			}).WithError(err).Panicf("failed to generate bot account for appservice")
@@ -116,11 +116,12 @@ func generateAppServiceAccount(
 	accountsDB accounts.Database,
 	deviceDB devices.Database,
 	as config.ApplicationService,
+	serverName gomatrixserverlib.ServerName,
 ) error {
 	ctx := context.Background()
 
 	// Create an account for the application service
-	_, err := accountsDB.CreateAccount(ctx, as.SenderLocalpart, "", as.ID)
+	_, err := accountsDB.CreateAccount(ctx, as.SenderLocalpart, serverName, "", as.ID)
 	if err != nil {
 		if errors.Is(err, internal.ErrUserExists) { // This account already exists
 			return nil
@@ -129,6 +130,6 @@ func generateAppServiceAccount(
 	}
 
 	// Create a dummy device with a dummy token for the application service
-	_, err = deviceDB.CreateDevice(ctx, as.SenderLocalpart, nil, as.ASToken, &as.SenderLocalpart)
+	_, err = deviceDB.CreateDevice(ctx, as.SenderLocalpart, serverName, nil, as.ASToken, &as.SenderLocalpart)
 	return err
 }
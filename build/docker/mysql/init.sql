@@ -5,6 +5,7 @@ CREATE DATABASE 'syncapi';
 CREATE DATABASE 'roomserver';
 CREATE DATABASE 'serverkey';
 CREATE DATABASE 'federationsender';
+CREATE DATABASE 'federationapi';
 CREATE DATABASE 'publicroomsapi';
 CREATE DATABASE 'appservice';
 CREATE DATABASE 'naffka';
@@ -29,6 +29,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -44,8 +45,8 @@ type DeviceDatabase interface {
 
 // AccountDatabase represents an account database.
 type AccountDatabase interface {
-	// Look up the account matching the given localpart.
-	GetAccountByLocalpart(ctx context.Context, localpart string) (*authtypes.Account, error)
+	// Look up the account matching the given localpart and server name.
+	GetAccountByLocalpart(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (*authtypes.Account, error)
 }
 
 // Data contains information required to authenticate a request.
@@ -92,7 +93,7 @@ func VerifyUserFromRequest(
 		}
 
 		userID := req.URL.Query().Get("user_id")
-		localpart, err := userutil.ParseUsernameParam(userID, nil)
+		localpart, serverName, err := userutil.ParseUsernameParam(userID, nil)
 		if err != nil {
 			return nil, &util.JSONResponse{
 				Code: http.StatusBadRequest,
@@ -102,7 +103,7 @@ func VerifyUserFromRequest(
 
 		if localpart != "" { // AS is masquerading as another user
 			// Verify that the user is registered
-			account, err := data.AccountDB.GetAccountByLocalpart(req.Context(), localpart)
+			account, err := data.AccountDB.GetAccountByLocalpart(req.Context(), localpart, serverName)
 			// Verify that account exists & appServiceID matches
 			if err == nil && account.AppServiceID == appService.ID {
 				// Set the userID of dummy device
@@ -14,9 +14,14 @@
 
 package authtypes
 
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
 // Profile represents the profile for a Matrix account.
 type Profile struct {
 	Localpart   string
+	ServerName  gomatrixserverlib.ServerName
 	DisplayName string
 	AvatarURL   string
 }
@@ -30,7 +30,9 @@ const accountsSchema = `
 -- Stores data about accounts.
 CREATE TABLE IF NOT EXISTS account_accounts (
     -- The Matrix user ID localpart for this account
-    localpart TEXT NOT NULL PRIMARY KEY,
+    localpart TEXT NOT NULL,
+    -- The local server name that the account belongs to
+    server_name TEXT NOT NULL,
     -- When this account was first created, as a unix timestamp (ms resolution).
     created_ts BIGINT NOT NULL,
     -- The password hash for this account. Can be NULL if this is a passwordless account.
@@ -40,16 +42,17 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- TODO:
     -- is_guest, is_admin, upgraded_ts, devices, any email reset stuff?
 );
+CREATE UNIQUE INDEX IF NOT EXISTS account_accounts_idx ON account_accounts(localpart, server_name);
 `
 
 const insertAccountSQL = "" +
-	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id) VALUES ($1, $2, $3, $4)"
+	"INSERT INTO account_accounts(localpart, server_name, created_ts, password_hash, appservice_id) VALUES ($1, $2, $3, $4, $5)"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1 AND server_name = $2"
 
 const selectPasswordHashSQL = "" +
-	"SELECT password_hash FROM account_accounts WHERE localpart = $1"
+	"SELECT password_hash FROM account_accounts WHERE localpart = $1 AND server_name = $2"
 
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT COUNT(localpart) FROM account_accounts"
@@ -61,10 +64,9 @@ type accountsStatements struct {
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
-	serverName                    gomatrixserverlib.ServerName
 }
 
-func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerName) (err error) {
+func (s *accountsStatements) prepare(db *sql.DB) (err error) {
 	_, err = db.Exec(accountsSchema)
 	if err != nil {
 		return
@@ -81,7 +83,6 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.selectNewNumericLocalpartStmt, err = db.Prepare(selectNewNumericLocalpartSQL); err != nil {
 		return
 	}
-	s.serverName = server
 	return
 }
 
@@ -89,16 +90,17 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 // this account will be passwordless. Returns an error if this account already exists. Returns the account
 // on success.
 func (s *accountsStatements) insertAccount(
-	ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+	hash, appserviceID string,
 ) (*authtypes.Account, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	stmt := txn.Stmt(s.insertAccountStmt)
 
 	var err error
 	if appserviceID == "" {
-		_, err = stmt.ExecContext(ctx, localpart, createdTimeMS, hash, nil)
+		_, err = stmt.ExecContext(ctx, localpart, serverName, createdTimeMS, hash, nil)
 	} else {
-		_, err = stmt.ExecContext(ctx, localpart, createdTimeMS, hash, appserviceID)
+		_, err = stmt.ExecContext(ctx, localpart, serverName, createdTimeMS, hash, appserviceID)
 	}
 	if err != nil {
 		return nil, err
@@ -106,27 +108,27 @@ func (s *accountsStatements) insertAccount(
 
 	return &authtypes.Account{
 		Localpart:    localpart,
-		UserID:       userutil.MakeUserID(localpart, s.serverName),
-		ServerName:   s.serverName,
+		UserID:       userutil.MakeUserID(localpart, serverName),
+		ServerName:   serverName,
 		AppServiceID: appserviceID,
 	}, nil
 }
 
 func (s *accountsStatements) selectPasswordHash(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (hash string, err error) {
-	err = s.selectPasswordHashStmt.QueryRowContext(ctx, localpart).Scan(&hash)
+	err = s.selectPasswordHashStmt.QueryRowContext(ctx, localpart, serverName).Scan(&hash)
 	return
 }
 
 func (s *accountsStatements) selectAccountByLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (*authtypes.Account, error) {
 	var appserviceIDPtr sql.NullString
 	var acc authtypes.Account
 
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr)
+	err := stmt.QueryRowContext(ctx, localpart, serverName).Scan(&acc.Localpart, &appserviceIDPtr)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
@@ -137,8 +139,8 @@ func (s *accountsStatements) selectAccountByLocalpart(
 		acc.AppServiceID = appserviceIDPtr.String
 	}
 
-	acc.UserID = userutil.MakeUserID(localpart, s.serverName)
-	acc.ServerName = s.serverName
+	acc.UserID = userutil.MakeUserID(localpart, serverName)
+	acc.ServerName = serverName
 
 	return &acc, nil
 }
@@ -32,21 +32,23 @@ CREATE TABLE IF NOT EXISTS account_filter (
 	id SERIAL UNIQUE,
 	-- The localpart of the Matrix user ID associated to this filter
 	localpart TEXT NOT NULL,
+	-- The local server name of the Matrix user ID associated to this filter
+	server_name TEXT NOT NULL,
 
 	PRIMARY KEY(id, localpart)
 );
 
-CREATE INDEX IF NOT EXISTS account_filter_localpart ON account_filter(localpart);
+CREATE INDEX IF NOT EXISTS account_filter_localpart ON account_filter(localpart, server_name);
 `
 
 const selectFilterSQL = "" +
-	"SELECT filter FROM account_filter WHERE localpart = $1 AND id = $2"
+	"SELECT filter FROM account_filter WHERE localpart = $1 AND server_name = $2 AND id = $3"
 
 const selectFilterIDByContentSQL = "" +
-	"SELECT id FROM account_filter WHERE localpart = $1 AND filter = $2"
+	"SELECT id FROM account_filter WHERE localpart = $1 AND server_name = $2 AND filter = $3"
 
 const insertFilterSQL = "" +
-	"INSERT INTO account_filter (filter, localpart) VALUES ($1, $2)"
+	"INSERT INTO account_filter (filter, localpart, server_name) VALUES ($1, $2, $3)"
 
 type filterStatements struct {
 	selectFilterStmt            *sql.Stmt
@@ -72,11 +74,11 @@ func (s *filterStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *filterStatements) selectFilter(
-	ctx context.Context, localpart string, filterID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, filterID string,
 ) (*gomatrixserverlib.Filter, error) {
 	// Retrieve filter from database (stored as canonical JSON)
 	var filterData []byte
-	err := s.selectFilterStmt.QueryRowContext(ctx, localpart, filterID).Scan(&filterData)
+	err := s.selectFilterStmt.QueryRowContext(ctx, localpart, serverName, filterID).Scan(&filterData)
 	if err != nil {
 		return nil, err
 	}
@@ -90,7 +92,8 @@ func (s *filterStatements) selectFilter(
 }
 
 func (s *filterStatements) insertFilter(
-	ctx context.Context, filter *gomatrixserverlib.Filter, localpart string,
+	ctx context.Context, filter *gomatrixserverlib.Filter,
+	localpart string, serverName gomatrixserverlib.ServerName,
 ) (filterID string, err error) {
 	var existingFilterID string
 
@@ -112,7 +115,7 @@ func (s *filterStatements) insertFilter(
 	// same filter and localpart at the same time, however this is not a
 	// problem as both calls will result in the same filterID
 	err = s.selectFilterIDByContentStmt.QueryRowContext(ctx,
-		localpart, filterJSON).Scan(&existingFilterID)
+		localpart, serverName, filterJSON).Scan(&existingFilterID)
 	if err != nil && err != sql.ErrNoRows {
 		return "", err
 	}
@@ -122,7 +125,7 @@ func (s *filterStatements) insertFilter(
 	}
 
 	// Otherwise insert the filter and return the new ID
-	res, err := s.insertFilterStmt.ExecContext(ctx, filterJSON, localpart)
+	res, err := s.insertFilterStmt.ExecContext(ctx, filterJSON, localpart, serverName)
 	if err != nil {
 		return "", err
 	}
@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const membershipSchema = `
@@ -29,13 +30,15 @@ const membershipSchema = `
 CREATE TABLE IF NOT EXISTS account_memberships (
     -- The Matrix user ID localpart for the member
     localpart TEXT NOT NULL,
+    -- The local server name of the member
+    server_name TEXT NOT NULL,
     -- The room this user is a member of
     room_id TEXT NOT NULL,
     -- The ID of the join membership event
     event_id TEXT NOT NULL,
 
     -- A user can only be member of a room once
-    PRIMARY KEY (localpart, room_id)
+    PRIMARY KEY (localpart, server_name, room_id)
 );
 
 -- Use index to process deletion by ID more efficiently
@@ -43,18 +46,18 @@ CREATE UNIQUE INDEX IF NOT EXISTS account_membership_event_id ON account_members
 `
 
 const insertMembershipSQL = `
-	INSERT INTO account_memberships(localpart, room_id, event_id) VALUES ($1, $2, $3)
-	ON CONFLICT (localpart, room_id) DO UPDATE SET event_id = EXCLUDED.event_id
+	INSERT INTO account_memberships(localpart, server_name, room_id, event_id) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (localpart, server_name, room_id) DO UPDATE SET event_id = EXCLUDED.event_id
 `
 
 const selectMembershipsByLocalpartSQL = "" +
-	"SELECT room_id, event_id FROM account_memberships WHERE localpart = $1"
+	"SELECT room_id, event_id FROM account_memberships WHERE localpart = $1 AND server_name = $2"
 
 const selectMembershipInRoomByLocalpartSQL = "" +
-	"SELECT event_id FROM account_memberships WHERE localpart = $1 AND room_id = $2"
+	"SELECT event_id FROM account_memberships WHERE localpart = $1 AND server_name = $2 AND room_id = $3"
 
 const selectRoomIDsByLocalPartSQL = "" +
-	"SELECT room_id FROM account_memberships WHERE localpart = $1"
+	"SELECT room_id FROM account_memberships WHERE localpart = $1 AND server_name = $2"
 
 const deleteMembershipsByEventIDsSQL = "" +
 	"DELETE FROM account_memberships WHERE event_id = ANY($1)"
@@ -91,10 +94,11 @@ func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *membershipStatements) insertMembership(
-	ctx context.Context, txn *sql.Tx, localpart, roomID, eventID string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+	roomID, eventID string,
 ) (err error) {
 	stmt := txn.Stmt(s.insertMembershipStmt)
-	_, err = stmt.ExecContext(ctx, localpart, roomID, eventID)
+	_, err = stmt.ExecContext(ctx, localpart, serverName, roomID, eventID)
 	return
 }
 
@@ -111,20 +115,20 @@ func (s *membershipStatements) deleteMembershipsByEventIDs(
 }
 
 func (s *membershipStatements) selectMembershipInRoomByLocalpart(
-	ctx context.Context, localpart, roomID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, roomID string,
 ) (authtypes.Membership, error) {
 	membership := authtypes.Membership{Localpart: localpart, RoomID: roomID}
 	stmt := s.selectMembershipInRoomByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart, roomID).Scan(&membership.EventID)
+	err := stmt.QueryRowContext(ctx, localpart, serverName, roomID).Scan(&membership.EventID)
 
 	return membership, err
 }
 
 func (s *membershipStatements) selectMembershipsByLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (memberships []authtypes.Membership, err error) {
 	stmt := s.selectMembershipsByLocalpartStmt
-	rows, err := stmt.QueryContext(ctx, localpart)
+	rows, err := stmt.QueryContext(ctx, localpart, serverName)
 	if err != nil {
 		return
 	}
@@ -144,10 +148,10 @@ func (s *membershipStatements) selectMembershipsByLocalpart(
 }
 
 func (s *membershipStatements) selectRoomIDsByLocalPart(
-	ctx context.Context, localPart string,
+	ctx context.Context, localPart string, serverName gomatrixserverlib.ServerName,
 ) ([]string, error) {
 	stmt := s.selectRoomIDsByLocalPartStmt
-	rows, err := stmt.QueryContext(ctx, localPart)
+	rows, err := stmt.QueryContext(ctx, localPart, serverName)
 	if err != nil {
 		return nil, err
 	}
@@ -31,21 +31,23 @@ CREATE TABLE IF NOT EXISTS account_filter (
 	id SERIAL UNIQUE,
 	-- The localpart of the Matrix user ID associated to this filter
 	localpart TEXT NOT NULL,
+	-- The local server name of the Matrix user ID associated to this filter
+	server_name TEXT NOT NULL,
 
 	PRIMARY KEY(id, localpart)
 );
 
-CREATE INDEX IF NOT EXISTS account_filter_localpart ON account_filter(localpart);
+CREATE INDEX IF NOT EXISTS account_filter_localpart ON account_filter(localpart, server_name);
 `
 
 const selectFilterSQL = "" +
-	"SELECT filter FROM account_filter WHERE localpart = $1 AND id = $2"
+	"SELECT filter FROM account_filter WHERE localpart = $1 AND server_name = $2 AND id = $3"
 
 const selectFilterIDByContentSQL = "" +
-	"SELECT id FROM account_filter WHERE localpart = $1 AND filter = $2"
+	"SELECT id FROM account_filter WHERE localpart = $1 AND server_name = $2 AND filter = $3"
 
 const insertFilterSQL = "" +
-	"INSERT INTO account_filter (filter, id, localpart) VALUES ($1, DEFAULT, $2) RETURNING id"
+	"INSERT INTO account_filter (filter, id, localpart, server_name) VALUES ($1, DEFAULT, $2, $3) RETURNING id"
 
 type filterStatements struct {
 	selectFilterStmt            *sql.Stmt
@@ -71,11 +73,11 @@ func (s *filterStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *filterStatements) selectFilter(
-	ctx context.Context, localpart string, filterID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, filterID string,
 ) (*gomatrixserverlib.Filter, error) {
 	// Retrieve filter from database (stored as canonical JSON)
 	var filterData []byte
-	err := s.selectFilterStmt.QueryRowContext(ctx, localpart, filterID).Scan(&filterData)
+	err := s.selectFilterStmt.QueryRowContext(ctx, localpart, serverName, filterID).Scan(&filterData)
 	if err != nil {
 		return nil, err
 	}
@@ -89,7 +91,8 @@ func (s *filterStatements) selectFilter(
 }
 
 func (s *filterStatements) insertFilter(
-	ctx context.Context, filter *gomatrixserverlib.Filter, localpart string,
+	ctx context.Context, filter *gomatrixserverlib.Filter,
+	localpart string, serverName gomatrixserverlib.ServerName,
 ) (filterID string, err error) {
 	var existingFilterID string
 
@@ -111,7 +114,7 @@ func (s *filterStatements) insertFilter(
 	// same filter and localpart at the same time, however this is not a
 	// problem as both calls will result in the same filterID
 	err = s.selectFilterIDByContentStmt.QueryRowContext(ctx,
-		localpart, filterJSON).Scan(&existingFilterID)
+		localpart, serverName, filterJSON).Scan(&existingFilterID)
 	if err != nil && err != sql.ErrNoRows {
 		return "", err
 	}
@@ -121,7 +124,7 @@ func (s *filterStatements) insertFilter(
 	}
 
 	// Otherwise insert the filter and return the new ID
-	err = s.insertFilterStmt.QueryRowContext(ctx, filterJSON, localpart).
+	err = s.insertFilterStmt.QueryRowContext(ctx, filterJSON, localpart, serverName).
 		Scan(&filterID)
 	return
 }
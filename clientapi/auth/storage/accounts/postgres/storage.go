@@ -40,11 +40,11 @@ type Database struct {
 	accountDatas accountDataStatements
 	threepids    threepidStatements
 	filter       filterStatements
-	serverName   gomatrixserverlib.ServerName
+	serverNames  []gomatrixserverlib.ServerName
 }
 
 // NewDatabase creates a new accounts and profiles database
-func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serverName gomatrixserverlib.ServerName) (*Database, error) {
+func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serverNames []gomatrixserverlib.ServerName) (*Database, error) {
 	var db *sql.DB
 	var err error
 	if db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
@@ -55,7 +55,7 @@ func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serv
 		return nil, err
 	}
 	a := accountsStatements{}
-	if err = a.prepare(db, serverName); err != nil {
+	if err = a.prepare(db); err != nil {
 		return nil, err
 	}
 	p := profilesStatements{}
@@ -78,51 +78,53 @@ func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serv
 	if err = f.prepare(db); err != nil {
 		return nil, err
 	}
-	return &Database{db, partitions, a, p, m, ac, t, f, serverName}, nil
+	return &Database{db, partitions, a, p, m, ac, t, f, serverNames}, nil
 }
 
-// GetAccountByPassword returns the account associated with the given localpart and password.
+// GetAccountByPassword returns the account associated with the given localpart, server name and password.
 // Returns sql.ErrNoRows if no account exists which matches the given localpart.
 func (d *Database) GetAccountByPassword(
-	ctx context.Context, localpart, plaintextPassword string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, plaintextPassword string,
 ) (*authtypes.Account, error) {
-	hash, err := d.accounts.selectPasswordHash(ctx, localpart)
+	hash, err := d.accounts.selectPasswordHash(ctx, localpart, serverName)
 	if err != nil {
 		return nil, err
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintextPassword)); err != nil {
 		return nil, err
 	}
-	return d.accounts.selectAccountByLocalpart(ctx, localpart)
+	return d.accounts.selectAccountByLocalpart(ctx, localpart, serverName)
 }
 
-// GetProfileByLocalpart returns the profile associated with the given localpart.
+// GetProfileByLocalpart returns the profile associated with the given localpart and server name.
 // Returns sql.ErrNoRows if no profile exists which matches the given localpart.
 func (d *Database) GetProfileByLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (*authtypes.Profile, error) {
-	return d.profiles.selectProfileByLocalpart(ctx, localpart)
+	return d.profiles.selectProfileByLocalpart(ctx, localpart, serverName)
 }
 
 // SetAvatarURL updates the avatar URL of the profile associated with the given
 // localpart. Returns an error if something went wrong with the SQL query
 func (d *Database) SetAvatarURL(
-	ctx context.Context, localpart string, avatarURL string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, avatarURL string,
 ) error {
-	return d.profiles.setAvatarURL(ctx, localpart, avatarURL)
+	return d.profiles.setAvatarURL(ctx, localpart, serverName, avatarURL)
 }
 
 // SetDisplayName updates the display name of the profile associated with the given
 // localpart. Returns an error if something went wrong with the SQL query
 func (d *Database) SetDisplayName(
-	ctx context.Context, localpart string, displayName string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, displayName string,
 ) error {
-	return d.profiles.setDisplayName(ctx, localpart, displayName)
+	return d.profiles.setDisplayName(ctx, localpart, serverName, displayName)
 }
 
 // CreateGuestAccount makes a new guest account and creates an empty profile
 // for this account.
-func (d *Database) CreateGuestAccount(ctx context.Context) (acc *authtypes.Account, err error) {
+func (d *Database) CreateGuestAccount(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (acc *authtypes.Account, err error) {
 	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
 		var numLocalpart int64
 		numLocalpart, err = d.accounts.selectNewNumericLocalpart(ctx, txn)
@@ -130,27 +132,29 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *authtypes.Accou
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, serverName, "", "")
 		return err
 	})
 	return acc, err
 }
 
-// CreateAccount makes a new account with the given login name and password, and creates an empty profile
+// CreateAccount makes a new account with the given login name, server name and password, and creates an empty profile
 // for this account. If no password is supplied, the account will be a passwordless account. If the
 // account already exists, it will return nil, ErrUserExists.
 func (d *Database) CreateAccount(
-	ctx context.Context, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+	plaintextPassword, appserviceID string,
 ) (acc *authtypes.Account, err error) {
 	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, serverName, plaintextPassword, appserviceID)
 		return err
 	})
 	return
 }
 
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+	plaintextPassword, appserviceID string,
 ) (*authtypes.Account, error) {
 	var err error
 
@@ -162,14 +166,14 @@ func (d *Database) createAccount(
 			return nil, err
 		}
 	}
-	if err := d.profiles.insertProfile(ctx, txn, localpart); err != nil {
+	if err := d.profiles.insertProfile(ctx, txn, localpart, serverName); err != nil {
 		if internal.PostgresIsUniqueConstraintViolationErr(err) {
 			return nil, internal.ErrUserExists
 		}
 		return nil, err
 	}
 
-	if err := d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", `{
+	if err := d.accountDatas.insertAccountData(ctx, txn, localpart, serverName, "", "m.push_rules", `{
 		"global": {
 			"content": [],
 			"override": [],
@@ -180,7 +184,7 @@ func (d *Database) createAccount(
 	}`); err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+	return d.accounts.insertAccount(ctx, txn, localpart, serverName, hash, appserviceID)
 }
 
 // SaveMembership saves the user matching a given localpart as a member of a given
@@ -188,9 +192,10 @@ func (d *Database) createAccount(
 // If a membership already exists between the user and the room, or if the
 // insert fails, returns the SQL error
 func (d *Database) saveMembership(
-	ctx context.Context, txn *sql.Tx, localpart, roomID, eventID string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+	roomID, eventID string,
 ) error {
-	return d.memberships.insertMembership(ctx, txn, localpart, roomID, eventID)
+	return d.memberships.insertMembership(ctx, txn, localpart, serverName, roomID, eventID)
 }
 
 // removeMembershipsByEventIDs removes the memberships corresponding to the
@@ -230,9 +235,9 @@ func (d *Database) UpdateMemberships(
 // if not sql.ErrNoRows is returned.
 // If there was an issue during the retrieval, returns the SQL error
 func (d *Database) GetMembershipInRoomByLocalpart(
-	ctx context.Context, localpart, roomID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, roomID string,
 ) (authtypes.Membership, error) {
-	return d.memberships.selectMembershipInRoomByLocalpart(ctx, localpart, roomID)
+	return d.memberships.selectMembershipInRoomByLocalpart(ctx, localpart, serverName, roomID)
 }
 
 // GetRoomIDsByLocalPart returns an array containing the room ids of all
@@ -240,9 +245,9 @@ func (d *Database) GetMembershipInRoomByLocalpart(
 // If no membership match the given localpart, returns an empty array
 // If there was an issue during the retrieval, returns the SQL error
 func (d *Database) GetRoomIDsByLocalPart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) ([]string, error) {
-	return d.memberships.selectRoomIDsByLocalPart(ctx, localpart)
+	return d.memberships.selectRoomIDsByLocalPart(ctx, localpart, serverName)
 }
 
 // GetMembershipsByLocalpart returns an array containing the memberships for all
@@ -250,9 +255,9 @@ func (d *Database) GetRoomIDsByLocalPart(
 // If no membership match the given localpart, returns an empty array
 // If there was an issue during the retrieval, returns the SQL error
 func (d *Database) GetMembershipsByLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (memberships []authtypes.Membership, err error) {
-	return d.memberships.selectMembershipsByLocalpart(ctx, localpart)
+	return d.memberships.selectMembershipsByLocalpart(ctx, localpart, serverName)
 }
 
 // newMembership saves a new membership in the database.
@@ -268,7 +273,7 @@ func (d *Database) newMembership(
 		}
 
 		// We only want state events from local users
-		if string(serverName) != string(d.serverName) {
+		if !d.isLocalServerName(serverName) {
 			return nil
 		}
 
@@ -281,7 +286,7 @@ func (d *Database) newMembership(
 
 		// Only "join" membership events can be considered as new memberships
 		if membership == gomatrixserverlib.Join {
-			if err := d.saveMembership(ctx, txn, localpart, roomID, eventID); err != nil {
+			if err := d.saveMembership(ctx, txn, localpart, serverName, roomID, eventID); err != nil {
 				return err
 			}
 		}
@@ -295,22 +300,23 @@ func (d *Database) newMembership(
 // update the corresponding row with the new content
 // Returns a SQL error if there was an issue with the insertion/update
 func (d *Database) SaveAccountData(
-	ctx context.Context, localpart, roomID, dataType, content string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+	roomID, dataType, content string,
 ) error {
 	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		return d.accountDatas.insertAccountData(ctx, txn, localpart, roomID, dataType, content)
+		return d.accountDatas.insertAccountData(ctx, txn, localpart, serverName, roomID, dataType, content)
 	})
 }
 
 // GetAccountData returns account data related to a given localpart
 // If no account data could be found, returns an empty arrays
 // Returns an error if there was an issue with the retrieval
-func (d *Database) GetAccountData(ctx context.Context, localpart string) (
+func (d *Database) GetAccountData(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (
 	global []gomatrixserverlib.ClientEvent,
 	rooms map[string][]gomatrixserverlib.ClientEvent,
 	err error,
 ) {
-	return d.accountDatas.selectAccountData(ctx, localpart)
+	return d.accountDatas.selectAccountData(ctx, localpart, serverName)
 }
 
 // GetAccountDataByType returns account data matching a given
@@ -318,10 +324,10 @@ func (d *Database) GetAccountData(ctx context.Context, localpart string) (
 // If no account data could be found, returns nil
 // Returns an error if there was an issue with the retrieval
 func (d *Database) GetAccountDataByType(
-	ctx context.Context, localpart, roomID, dataType string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, roomID, dataType string,
 ) (data *gomatrixserverlib.ClientEvent, err error) {
 	return d.accountDatas.selectAccountDataByType(
-		ctx, localpart, roomID, dataType,
+		ctx, localpart, serverName, roomID, dataType,
 	)
 }
 
@@ -346,10 +352,10 @@ var Err3PIDInUse = errors.New("This third-party identifier is already in use")
 // If the third-party identifier is already part of an association, returns Err3PIDInUse.
 // Returns an error if there was a problem talking to the database.
 func (d *Database) SaveThreePIDAssociation(
-	ctx context.Context, threepid, localpart, medium string,
+	ctx context.Context, threepid, localpart string, serverName gomatrixserverlib.ServerName, medium string,
 ) (err error) {
 	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		user, err := d.threepids.selectLocalpartForThreePID(
+		user, _, err := d.threepids.selectLocalpartForThreePID(
 			ctx, txn, threepid, medium,
 		)
 		if err != nil {
@@ -360,7 +366,7 @@ func (d *Database) SaveThreePIDAssociation(
 			return Err3PIDInUse
 		}
 
-		return d.threepids.insertThreePID(ctx, txn, threepid, medium, localpart)
+		return d.threepids.insertThreePID(ctx, txn, threepid, medium, localpart, serverName)
 	})
 }
 
@@ -374,14 +380,14 @@ func (d *Database) RemoveThreePIDAssociation(
 	return d.threepids.deleteThreePID(ctx, threepid, medium)
 }
 
-// GetLocalpartForThreePID looks up the localpart associated with a given third-party
-// identifier.
-// If no association involves the given third-party idenfitier, returns an empty
-// string.
+// GetLocalpartForThreePID looks up the localpart and server name associated with a
+// given third-party identifier.
+// If no association involves the given third-party idenfitier, returns empty
+// strings.
 // Returns an error if there was a problem talking to the database.
 func (d *Database) GetLocalpartForThreePID(
 	ctx context.Context, threepid string, medium string,
-) (localpart string, err error) {
+) (localpart string, serverName gomatrixserverlib.ServerName, err error) {
 	return d.threepids.selectLocalpartForThreePID(ctx, nil, threepid, medium)
 }
 
@@ -390,34 +396,36 @@ func (d *Database) GetLocalpartForThreePID(
 // If no association is known for this user, returns an empty slice.
 // Returns an error if there was an issue talking to the database.
 func (d *Database) GetThreePIDsForLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (threepids []authtypes.ThreePID, err error) {
-	return d.threepids.selectThreePIDsForLocalpart(ctx, localpart)
+	return d.threepids.selectThreePIDsForLocalpart(ctx, localpart, serverName)
 }
 
 // GetFilter looks up the filter associated with a given local user and filter ID.
 // Returns a filter structure. Otherwise returns an error if no such filter exists
 // or if there was an error talking to the database.
 func (d *Database) GetFilter(
-	ctx context.Context, localpart string, filterID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, filterID string,
 ) (*gomatrixserverlib.Filter, error) {
-	return d.filter.selectFilter(ctx, localpart, filterID)
+	return d.filter.selectFilter(ctx, localpart, serverName, filterID)
 }
 
 // PutFilter puts the passed filter into the database.
 // Returns the filterID as a string. Otherwise returns an error if something
 // goes wrong.
 func (d *Database) PutFilter(
-	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, filter *gomatrixserverlib.Filter,
 ) (string, error) {
-	return d.filter.insertFilter(ctx, filter, localpart)
+	return d.filter.insertFilter(ctx, filter, localpart, serverName)
 }
 
 // CheckAccountAvailability checks if the username/localpart is already present
 // in the database.
 // If the DB returns sql.ErrNoRows the Localpart isn't taken.
-func (d *Database) CheckAccountAvailability(ctx context.Context, localpart string) (bool, error) {
-	_, err := d.accounts.selectAccountByLocalpart(ctx, localpart)
+func (d *Database) CheckAccountAvailability(
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+) (bool, error) {
+	_, err := d.accounts.selectAccountByLocalpart(ctx, localpart, serverName)
 	if err == sql.ErrNoRows {
 		return true, nil
 	}
@@ -427,7 +435,19 @@ func (d *Database) CheckAccountAvailability(ctx context.Context, localpart strin
 // GetAccountByLocalpart returns the account associated with the given localpart.
 // This function assumes the request is authenticated or the account data is used only internally.
 // Returns sql.ErrNoRows if no account exists which matches the given localpart.
-func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
+func (d *Database) GetAccountByLocalpart(
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (*authtypes.Account, error) {
-	return d.accounts.selectAccountByLocalpart(ctx, localpart)
+	return d.accounts.selectAccountByLocalpart(ctx, localpart, serverName)
+}
+
+// isLocalServerName returns true if the server name is one of the local
+// server names that accounts are stored for.
+func (d *Database) isLocalServerName(serverName gomatrixserverlib.ServerName) bool {
+	for _, name := range d.serverNames {
+		if name == serverName {
+			return true
+		}
+	}
+	return false
 }
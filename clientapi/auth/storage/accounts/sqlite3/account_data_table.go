@@ -26,6 +26,8 @@ const accountDataSchema = `
 CREATE TABLE IF NOT EXISTS account_data (
     -- The Matrix user ID localpart for this account
     localpart TEXT NOT NULL,
+    -- The local server name that the account belongs to
+    server_name TEXT NOT NULL,
     -- The room ID for this data (empty string if not specific to a room)
     room_id TEXT,
     -- The account data type
@@ -33,20 +35,20 @@ CREATE TABLE IF NOT EXISTS account_data (
     -- The account data content
     content TEXT NOT NULL,
 
-    PRIMARY KEY(localpart, room_id, type)
+    PRIMARY KEY(localpart, server_name, room_id, type)
 );
 `
 
 const insertAccountDataSQL = `
-	INSERT INTO account_data(localpart, room_id, type, content) VALUES($1, $2, $3, $4)
-	ON CONFLICT (localpart, room_id, type) DO UPDATE SET content = $4
+	INSERT INTO account_data(localpart, server_name, room_id, type, content) VALUES($1, $2, $3, $4, $5)
+	ON CONFLICT (localpart, server_name, room_id, type) DO UPDATE SET content = $5
 `
 
 const selectAccountDataSQL = "" +
-	"SELECT room_id, type, content FROM account_data WHERE localpart = $1"
+	"SELECT room_id, type, content FROM account_data WHERE localpart = $1 AND server_name = $2"
 
 const selectAccountDataByTypeSQL = "" +
-	"SELECT content FROM account_data WHERE localpart = $1 AND room_id = $2 AND type = $3"
+	"SELECT content FROM account_data WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND type = $4"
 
 type accountDataStatements struct {
 	insertAccountDataStmt       *sql.Stmt
@@ -72,20 +74,21 @@ func (s *accountDataStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *accountDataStatements) insertAccountData(
-	ctx context.Context, txn *sql.Tx, localpart, roomID, dataType, content string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+	roomID, dataType, content string,
 ) (err error) {
-	_, err = txn.Stmt(s.insertAccountDataStmt).ExecContext(ctx, localpart, roomID, dataType, content)
+	_, err = txn.Stmt(s.insertAccountDataStmt).ExecContext(ctx, localpart, serverName, roomID, dataType, content)
 	return
 }
 
 func (s *accountDataStatements) selectAccountData(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (
 	global []gomatrixserverlib.ClientEvent,
 	rooms map[string][]gomatrixserverlib.ClientEvent,
 	err error,
 ) {
-	rows, err := s.selectAccountDataStmt.QueryContext(ctx, localpart)
+	rows, err := s.selectAccountDataStmt.QueryContext(ctx, localpart, serverName)
 	if err != nil {
 		return
 	}
@@ -118,12 +121,12 @@ func (s *accountDataStatements) selectAccountData(
 }
 
 func (s *accountDataStatements) selectAccountDataByType(
-	ctx context.Context, localpart, roomID, dataType string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, roomID, dataType string,
 ) (data *gomatrixserverlib.ClientEvent, err error) {
 	stmt := s.selectAccountDataByTypeStmt
 	var content []byte
 
-	if err = stmt.QueryRowContext(ctx, localpart, roomID, dataType).Scan(&content); err != nil {
+	if err = stmt.QueryRowContext(ctx, localpart, serverName, roomID, dataType).Scan(&content); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
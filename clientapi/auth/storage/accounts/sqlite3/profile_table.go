@@ -19,31 +19,35 @@ import (
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const profilesSchema = `
 -- Stores data about accounts profiles.
 CREATE TABLE IF NOT EXISTS account_profiles (
     -- The Matrix user ID localpart for this account
-    localpart TEXT NOT NULL PRIMARY KEY,
+    localpart TEXT NOT NULL,
+    -- The local server name that the account belongs to
+    server_name TEXT NOT NULL,
     -- The display name for this account
     display_name TEXT,
     -- The URL of the avatar for this account
     avatar_url TEXT
 );
+CREATE UNIQUE INDEX IF NOT EXISTS account_profiles_idx ON account_profiles(localpart, server_name);
 `
 
 const insertProfileSQL = "" +
-	"INSERT INTO account_profiles(localpart, display_name, avatar_url) VALUES ($1, $2, $3)"
+	"INSERT INTO account_profiles(localpart, server_name, display_name, avatar_url) VALUES ($1, $2, $3, $4)"
 
 const selectProfileByLocalpartSQL = "" +
-	"SELECT localpart, display_name, avatar_url FROM account_profiles WHERE localpart = $1"
+	"SELECT localpart, server_name, display_name, avatar_url FROM account_profiles WHERE localpart = $1 AND server_name = $2"
 
 const setAvatarURLSQL = "" +
-	"UPDATE account_profiles SET avatar_url = $1 WHERE localpart = $2"
+	"UPDATE account_profiles SET avatar_url = $1 WHERE localpart = $2 AND server_name = $3"
 
 const setDisplayNameSQL = "" +
-	"UPDATE account_profiles SET display_name = $1 WHERE localpart = $2"
+	"UPDATE account_profiles SET display_name = $1 WHERE localpart = $2 AND server_name = $3"
 
 type profilesStatements struct {
 	insertProfileStmt            *sql.Stmt
@@ -73,18 +77,18 @@ func (s *profilesStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *profilesStatements) insertProfile(
-	ctx context.Context, txn *sql.Tx, localpart string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
 ) (err error) {
-	_, err = txn.Stmt(s.insertProfileStmt).ExecContext(ctx, localpart, "", "")
+	_, err = txn.Stmt(s.insertProfileStmt).ExecContext(ctx, localpart, serverName, "", "")
 	return
 }
 
 func (s *profilesStatements) selectProfileByLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (*authtypes.Profile, error) {
 	var profile authtypes.Profile
-	err := s.selectProfileByLocalpartStmt.QueryRowContext(ctx, localpart).Scan(
-		&profile.Localpart, &profile.DisplayName, &profile.AvatarURL,
+	err := s.selectProfileByLocalpartStmt.QueryRowContext(ctx, localpart, serverName).Scan(
+		&profile.Localpart, &profile.ServerName, &profile.DisplayName, &profile.AvatarURL,
 	)
 	if err != nil {
 		return nil, err
@@ -93,15 +97,15 @@ func (s *profilesStatements) selectProfileByLocalpart(
 }
 
 func (s *profilesStatements) setAvatarURL(
-	ctx context.Context, localpart string, avatarURL string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, avatarURL string,
 ) (err error) {
-	_, err = s.setAvatarURLStmt.ExecContext(ctx, avatarURL, localpart)
+	_, err = s.setAvatarURLStmt.ExecContext(ctx, avatarURL, localpart, serverName)
 	return
 }
 
 func (s *profilesStatements) setDisplayName(
-	ctx context.Context, localpart string, displayName string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, displayName string,
 ) (err error) {
-	_, err = s.setDisplayNameStmt.ExecContext(ctx, displayName, localpart)
+	_, err = s.setDisplayNameStmt.ExecContext(ctx, displayName, localpart, serverName)
 	return
 }
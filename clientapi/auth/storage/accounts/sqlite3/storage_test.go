@@ -0,0 +1,72 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestAccountsPerServerName(t *testing.T) {
+	ctx := context.Background()
+	main := gomatrixserverlib.ServerName("kaer.morhen")
+	vhost := gomatrixserverlib.ServerName("vizima")
+	db, err := NewDatabase("file::memory:", []gomatrixserverlib.ServerName{main, vhost})
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+
+	for _, serverName := range []gomatrixserverlib.ServerName{main, vhost} {
+		acc, cerr := db.CreateAccount(ctx, "geralt", serverName, "password-"+string(serverName), "")
+		if cerr != nil {
+			t.Fatalf("CreateAccount on %q: %s", serverName, cerr)
+		}
+		if want := "@geralt:" + string(serverName); acc.UserID != want {
+			t.Fatalf("wanted user ID %q, got %q", want, acc.UserID)
+		}
+		if err = db.SetDisplayName(ctx, "geralt", serverName, "Geralt of "+string(serverName)); err != nil {
+			t.Fatalf("SetDisplayName on %q: %s", serverName, err)
+		}
+	}
+
+	if _, err = db.GetAccountByPassword(ctx, "geralt", vhost, "password-"+string(main)); err == nil {
+		t.Fatalf("wanted the password of %q to be rejected on %q", main, vhost)
+	}
+	acc, err := db.GetAccountByPassword(ctx, "geralt", vhost, "password-"+string(vhost))
+	if err != nil {
+		t.Fatalf("GetAccountByPassword: %s", err)
+	}
+	if acc.ServerName != vhost {
+		t.Fatalf("wanted an account on %q, got %q", vhost, acc.ServerName)
+	}
+
+	profile, err := db.GetProfileByLocalpart(ctx, "geralt", main)
+	if err != nil {
+		t.Fatalf("GetProfileByLocalpart: %s", err)
+	}
+	if want := "Geralt of " + string(main); profile.DisplayName != want {
+		t.Fatalf("wanted display name %q, got %q", want, profile.DisplayName)
+	}
+
+	available, err := db.CheckAccountAvailability(ctx, "geralt", "novigrad")
+	if err != nil {
+		t.Fatalf("CheckAccountAvailability: %s", err)
+	}
+	if !available {
+		t.Fatalf("wanted the localpart to be available on a server name without the account")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const threepidSchema = `
@@ -32,21 +33,23 @@ CREATE TABLE IF NOT EXISTS account_threepid (
 	medium TEXT NOT NULL DEFAULT 'email',
 	-- The localpart of the Matrix user ID associated to this 3PID
 	localpart TEXT NOT NULL,
+	-- The local server name of the Matrix user ID associated to this 3PID
+	server_name TEXT NOT NULL,
 
 	PRIMARY KEY(threepid, medium)
 );
 
-CREATE INDEX IF NOT EXISTS account_threepid_localpart ON account_threepid(localpart);
+CREATE INDEX IF NOT EXISTS account_threepid_localpart ON account_threepid(localpart, server_name);
 `
 
 const selectLocalpartForThreePIDSQL = "" +
-	"SELECT localpart FROM account_threepid WHERE threepid = $1 AND medium = $2"
+	"SELECT localpart, server_name FROM account_threepid WHERE threepid = $1 AND medium = $2"
 
 const selectThreePIDsForLocalpartSQL = "" +
-	"SELECT threepid, medium FROM account_threepid WHERE localpart = $1"
+	"SELECT threepid, medium FROM account_threepid WHERE localpart = $1 AND server_name = $2"
 
 const insertThreePIDSQL = "" +
-	"INSERT INTO account_threepid (threepid, medium, localpart) VALUES ($1, $2, $3)"
+	"INSERT INTO account_threepid (threepid, medium, localpart, server_name) VALUES ($1, $2, $3, $4)"
 
 const deleteThreePIDSQL = "" +
 	"DELETE FROM account_threepid WHERE threepid = $1 AND medium = $2"
@@ -81,19 +84,19 @@ func (s *threepidStatements) prepare(db *sql.DB) (err error) {
 
 func (s *threepidStatements) selectLocalpartForThreePID(
 	ctx context.Context, txn *sql.Tx, threepid string, medium string,
-) (localpart string, err error) {
+) (localpart string, serverName gomatrixserverlib.ServerName, err error) {
 	stmt := internal.TxStmt(txn, s.selectLocalpartForThreePIDStmt)
-	err = stmt.QueryRowContext(ctx, threepid, medium).Scan(&localpart)
+	err = stmt.QueryRowContext(ctx, threepid, medium).Scan(&localpart, &serverName)
 	if err == sql.ErrNoRows {
-		return "", nil
+		return "", "", nil
 	}
 	return
 }
 
 func (s *threepidStatements) selectThreePIDsForLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) (threepids []authtypes.ThreePID, err error) {
-	rows, err := s.selectThreePIDsForLocalpartStmt.QueryContext(ctx, localpart)
+	rows, err := s.selectThreePIDsForLocalpartStmt.QueryContext(ctx, localpart, serverName)
 	if err != nil {
 		return
 	}
@@ -115,10 +118,10 @@ func (s *threepidStatements) selectThreePIDsForLocalpart(
 }
 
 func (s *threepidStatements) insertThreePID(
-	ctx context.Context, txn *sql.Tx, threepid, medium, localpart string,
+	ctx context.Context, txn *sql.Tx, threepid, medium, localpart string, serverName gomatrixserverlib.ServerName,
 ) (err error) {
 	stmt := internal.TxStmt(txn, s.insertThreePIDStmt)
-	_, err = stmt.ExecContext(ctx, threepid, medium, localpart)
+	_, err = stmt.ExecContext(ctx, threepid, medium, localpart, serverName)
 	return
 }
 
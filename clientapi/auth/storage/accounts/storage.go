@@ -28,19 +28,19 @@ import (
 
 // NewDatabase opens a new Postgres or Sqlite database (based on dataSourceName scheme)
 // and sets postgres connection parameters
-func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serverName gomatrixserverlib.ServerName) (Database, error) {
+func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serverNames []gomatrixserverlib.ServerName) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
+		return postgres.NewDatabase(dataSourceName, dbProperties, serverNames)
 	}
 	switch uri.Scheme {
 	case "postgres":
-		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
+		return postgres.NewDatabase(dataSourceName, dbProperties, serverNames)
 	case "mysql":
-		return mysql.NewDatabase(dataSourceName, dbProperties, serverName)
+		return mysql.NewDatabase(dataSourceName, dbProperties, serverNames)
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName, serverName)
+		return sqlite3.NewDatabase(dataSourceName, serverNames)
 	default:
-		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
+		return postgres.NewDatabase(dataSourceName, dbProperties, serverNames)
 	}
 }
@@ -26,7 +26,7 @@ import (
 func NewDatabase(
 	dataSourceName string,
 	dbProperties internal.DbProperties, // nolint:unparam
-	serverName gomatrixserverlib.ServerName,
+	serverNames []gomatrixserverlib.ServerName,
 ) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
@@ -38,7 +38,7 @@ func NewDatabase(
 	case "mysql":
 		return nil, fmt.Errorf("Cannot use mysql implementation")
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName, serverName)
+		return sqlite3.NewDatabase(dataSourceName, serverNames)
 	default:
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	}
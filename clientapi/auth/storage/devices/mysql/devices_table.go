@@ -44,6 +44,8 @@ CREATE TABLE IF NOT EXISTS device_devices (
     -- as it is smaller, makes it clearer that we only manage devices for our own users, and may make
     -- migration to different domain names easier.
     localpart TEXT NOT NULL,
+    -- The local server name of the Matrix user ID for this device.
+    server_name TEXT NOT NULL,
     -- When this devices was first recognised on the network, as a unix timestamp (ms resolution).
     created_ts BIGINT NOT NULL,
     -- The display name, human friendlier than device_id and updatable
@@ -52,36 +54,36 @@ CREATE TABLE IF NOT EXISTS device_devices (
 );
 
 -- Device IDs must be unique for a given user.
-CREATE UNIQUE INDEX IF NOT EXISTS device_localpart_id_idx ON device_devices(localpart, device_id);
+CREATE UNIQUE INDEX IF NOT EXISTS device_localpart_id_idx ON device_devices(localpart, server_name, device_id);
 `
 
 const insertDeviceSQL = "" +
-	"INSERT INTO device_devices (device_id, localpart, access_token, created_ts, display_name, session_id)" +
-	" VALUES ($1, $2, $3, $4, $5, $6)"
+	"INSERT INTO device_devices (device_id, localpart, server_name, access_token, created_ts, display_name, session_id)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)"
 
 const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM device_devices"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, server_name FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
-	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
+	"SELECT display_name FROM device_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
 
 const selectDevicesByLocalpartSQL = "" +
-	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1"
+	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1 AND server_name = $2"
 
 const updateDeviceNameSQL = "" +
-	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
+	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND server_name = $3 AND device_id = $4"
 
 const deleteDeviceSQL = "" +
-	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
+	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2 AND server_name = $3"
 
 const deleteDevicesByLocalpartSQL = "" +
-	"DELETE FROM device_devices WHERE localpart = $1"
+	"DELETE FROM device_devices WHERE localpart = $1 AND server_name = $2"
 
 const deleteDevicesSQL = "" +
-	"DELETE FROM device_devices WHERE localpart = $1 AND device_id = ANY($2)"
+	"DELETE FROM device_devices WHERE localpart = $1 AND server_name = $2 AND device_id = ANY($3)"
 
 type devicesStatements struct {
 	db                           *sql.DB
@@ -94,10 +96,9 @@ type devicesStatements struct {
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	deleteDevicesStmt            *sql.Stmt
-	serverName                   gomatrixserverlib.ServerName
 }
 
-func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerName) (err error) {
+func (s *devicesStatements) prepare(db *sql.DB) (err error) {
 	s = &devicesStatements{}
 	s.db = db
 	_, err = db.Exec(devicesSchema)
@@ -131,7 +132,6 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.deleteDevicesStmt, err = db.Prepare(deleteDevicesSQL); err != nil {
 		return
 	}
-	s.serverName = server
 	return
 }
 
@@ -139,8 +139,8 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 // Returns an error if the user already has a device with the given device ID.
 // Returns the device on success.
 func (s *devicesStatements) insertDevice(
-	ctx context.Context, txn *sql.Tx, id, localpart, accessToken string,
-	displayName *string,
+	ctx context.Context, txn *sql.Tx, id, localpart string, serverName gomatrixserverlib.ServerName,
+	accessToken string, displayName *string,
 ) (*authtypes.Device, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	var sessionID int64
@@ -150,12 +150,12 @@ func (s *devicesStatements) insertDevice(
 		return nil, err
 	}
 	sessionID++
-	if _, err := insertStmt.ExecContext(ctx, id, localpart, accessToken, createdTimeMS, displayName, sessionID); err != nil {
+	if _, err := insertStmt.ExecContext(ctx, id, localpart, serverName, accessToken, createdTimeMS, displayName, sessionID); err != nil {
 		return nil, err
 	}
 	return &authtypes.Device{
 		ID:          id,
-		UserID:      userutil.MakeUserID(localpart, s.serverName),
+		UserID:      userutil.MakeUserID(localpart, serverName),
 		AccessToken: accessToken,
 		SessionID:   sessionID,
 	}, nil
@@ -163,17 +163,17 @@ func (s *devicesStatements) insertDevice(
 
 // deleteDevice removes a single device by id and user localpart.
 func (s *devicesStatements) deleteDevice(
-	ctx context.Context, txn *sql.Tx, id, localpart string,
+	ctx context.Context, txn *sql.Tx, id, localpart string, serverName gomatrixserverlib.ServerName,
 ) error {
 	stmt := internal.TxStmt(txn, s.deleteDeviceStmt)
-	_, err := stmt.ExecContext(ctx, id, localpart)
+	_, err := stmt.ExecContext(ctx, id, localpart, serverName)
 	return err
 }
 
 // deleteDevices removes a single or multiple devices by ids and user localpart.
 // Returns an error if the execution failed.
 func (s *devicesStatements) deleteDevices(
-	ctx context.Context, txn *sql.Tx, localpart string, devices []string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, devices []string,
 ) error {
 	orig := strings.Replace(deleteDevicesSQL, "($1)", internal.QueryVariadic(len(devices)), 1)
 	prep, err := s.db.Prepare(orig)
@@ -181,10 +181,11 @@ func (s *devicesStatements) deleteDevices(
 		return err
 	}
 	stmt := internal.TxStmt(txn, prep)
-	params := make([]interface{}, len(devices)+1)
+	params := make([]interface{}, len(devices)+2)
 	params[0] = localpart
+	params[1] = serverName
 	for i, v := range devices {
-		params[i+1] = v
+		params[i+2] = v
 	}
 	params = append(params, params...)
 	_, err = stmt.ExecContext(ctx, params...)
@@ -194,18 +195,19 @@ func (s *devicesStatements) deleteDevices(
 // deleteDevicesByLocalpart removes all devices for the
 // given user localpart.
 func (s *devicesStatements) deleteDevicesByLocalpart(
-	ctx context.Context, txn *sql.Tx, localpart string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
 ) error {
 	stmt := internal.TxStmt(txn, s.deleteDevicesByLocalpartStmt)
-	_, err := stmt.ExecContext(ctx, localpart)
+	_, err := stmt.ExecContext(ctx, localpart, serverName)
 	return err
 }
 
 func (s *devicesStatements) updateDeviceName(
-	ctx context.Context, txn *sql.Tx, localpart, deviceID string, displayName *string,
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+	deviceID string, displayName *string,
 ) error {
 	stmt := internal.TxStmt(txn, s.updateDeviceNameStmt)
-	_, err := stmt.ExecContext(ctx, displayName, localpart, deviceID)
+	_, err := stmt.ExecContext(ctx, displayName, localpart, serverName, deviceID)
 	return err
 }
 
@@ -214,10 +216,11 @@ func (s *devicesStatements) selectDeviceByToken(
 ) (*authtypes.Device, error) {
 	var dev authtypes.Device
 	var localpart string
+	var serverName gomatrixserverlib.ServerName
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
 	if err == nil {
-		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
 		dev.AccessToken = accessToken
 	}
 	return &dev, err
@@ -226,24 +229,24 @@ func (s *devicesStatements) selectDeviceByToken(
 // selectDeviceByID retrieves a device from the database with the given user
 // localpart and deviceID
 func (s *devicesStatements) selectDeviceByID(
-	ctx context.Context, localpart, deviceID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID string,
 ) (*authtypes.Device, error) {
 	var dev authtypes.Device
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&dev.DisplayName)
+	err := stmt.QueryRowContext(ctx, localpart, serverName, deviceID).Scan(&dev.DisplayName)
 	if err == nil {
 		dev.ID = deviceID
-		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
 	}
 	return &dev, err
 }
 
 func (s *devicesStatements) selectDevicesByLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) ([]authtypes.Device, error) {
 	devices := []authtypes.Device{}
 
-	rows, err := s.selectDevicesByLocalpartStmt.QueryContext(ctx, localpart)
+	rows, err := s.selectDevicesByLocalpartStmt.QueryContext(ctx, localpart, serverName)
 
 	if err != nil {
 		return devices, err
@@ -263,7 +266,7 @@ func (s *devicesStatements) selectDevicesByLocalpart(
 		if displayname.Valid {
 			dev.DisplayName = displayname.String
 		}
-		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
 		devices = append(devices, dev)
 	}
 
@@ -36,14 +36,14 @@ type Database struct {
 }
 
 // NewDatabase creates a new device database
-func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serverName gomatrixserverlib.ServerName) (*Database, error) {
+func NewDatabase(dataSourceName string, dbProperties internal.DbProperties) (*Database, error) {
 	var db *sql.DB
 	var err error
 	if db, err = sqlutil.Open("mysql", dataSourceName, dbProperties); err != nil {
 		return nil, err
 	}
 	d := devicesStatements{}
-	if err = d.prepare(db, serverName); err != nil {
+	if err = d.prepare(db); err != nil {
 		return nil, err
 	}
 	return &Database{db, d}, nil
@@ -60,37 +60,37 @@ func (d *Database) GetDeviceByAccessToken(
 // GetDeviceByID returns the device matching the given ID.
 // Returns sql.ErrNoRows if no matching device was found.
 func (d *Database) GetDeviceByID(
-	ctx context.Context, localpart, deviceID string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID string,
 ) (*authtypes.Device, error) {
-	return d.devices.selectDeviceByID(ctx, localpart, deviceID)
+	return d.devices.selectDeviceByID(ctx, localpart, serverName, deviceID)
 }
 
-// GetDevicesByLocalpart returns the devices matching the given localpart.
+// GetDevicesByLocalpart returns the devices matching the given localpart and server name.
 func (d *Database) GetDevicesByLocalpart(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) ([]authtypes.Device, error) {
-	return d.devices.selectDevicesByLocalpart(ctx, localpart)
+	return d.devices.selectDevicesByLocalpart(ctx, localpart, serverName)
 }
 
-// CreateDevice makes a new device associated with the given user ID localpart.
+// CreateDevice makes a new device associated with the given user ID localpart and server name.
 // If there is already a device with the same device ID for this user, that access token will be revoked
 // and replaced with the given accessToken. If the given accessToken is already in use for another device,
 // an error will be returned.
 // If no device ID is given one is generated.
 // Returns the device on success.
 func (d *Database) CreateDevice(
-	ctx context.Context, localpart string, deviceID *string, accessToken string,
-	displayName *string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+	deviceID *string, accessToken string, displayName *string,
 ) (dev *authtypes.Device, returnErr error) {
 	if deviceID != nil {
 		returnErr = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
 			var err error
 			// Revoke existing tokens for this device
-			if err = d.devices.deleteDevice(ctx, txn, *deviceID, localpart); err != nil {
+			if err = d.devices.deleteDevice(ctx, txn, *deviceID, localpart, serverName); err != nil {
 				return err
 			}
 
-			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName)
+			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, serverName, accessToken, displayName)
 			return err
 		})
 	} else {
@@ -105,7 +105,7 @@ func (d *Database) CreateDevice(
 
 			returnErr = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
 				var err error
-				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName)
+				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, serverName, accessToken, displayName)
 				return err
 			})
 			if returnErr == nil {
@@ -131,10 +131,11 @@ func generateDeviceID() (string, error) {
 // UpdateDevice updates the given device with the display name.
 // Returns SQL error if there are problems and nil on success.
 func (d *Database) UpdateDevice(
-	ctx context.Context, localpart, deviceID string, displayName *string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+	deviceID string, displayName *string,
 ) error {
 	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		return d.devices.updateDeviceName(ctx, txn, localpart, deviceID, displayName)
+		return d.devices.updateDeviceName(ctx, txn, localpart, serverName, deviceID, displayName)
 	})
 }
 
@@ -143,10 +144,10 @@ func (d *Database) UpdateDevice(
 // If the device doesn't exist, it will not return an error
 // If something went wrong during the deletion, it will return the SQL error.
 func (d *Database) RemoveDevice(
-	ctx context.Context, deviceID, localpart string,
+	ctx context.Context, deviceID, localpart string, serverName gomatrixserverlib.ServerName,
 ) error {
 	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart, serverName); err != sql.ErrNoRows {
 			return err
 		}
 		return nil
@@ -158,10 +159,10 @@ func (d *Database) RemoveDevice(
 // If the devices don't exist, it will not return an error
 // If something went wrong during the deletion, it will return the SQL error.
 func (d *Database) RemoveDevices(
-	ctx context.Context, localpart string, devices []string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, devices []string,
 ) error {
 	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevices(ctx, txn, localpart, serverName, devices); err != sql.ErrNoRows {
 			return err
 		}
 		return nil
@@ -172,10 +173,10 @@ func (d *Database) RemoveDevices(
 // database matching the given user ID localpart.
 // If something went wrong during the deletion, it will return the SQL error.
 func (d *Database) RemoveAllDevices(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 ) error {
 	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart, serverName); err != sql.ErrNoRows {
 			return err
 		}
 		return nil
@@ -23,24 +23,23 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices/mysql"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices/sqlite3"
 	"github.com/matrix-org/dendrite/internal"
-	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // NewDatabase opens a new Postgres or Sqlite database (based on dataSourceName scheme)
 // and sets postgres connection parameters
-func NewDatabase(dataSourceName string, dbProperties internal.DbProperties, serverName gomatrixserverlib.ServerName) (Database, error) {
+func NewDatabase(dataSourceName string, dbProperties internal.DbProperties) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
+		return postgres.NewDatabase(dataSourceName, dbProperties)
 	}
 	switch uri.Scheme {
 	case "postgres":
-		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
+		return postgres.NewDatabase(dataSourceName, dbProperties)
 	case "mysql":
-		return mysql.NewDatabase(dataSourceName, dbProperties, serverName)
+		return mysql.NewDatabase(dataSourceName, dbProperties)
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName, serverName)
+		return sqlite3.NewDatabase(dataSourceName)
 	default:
-		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
+		return postgres.NewDatabase(dataSourceName, dbProperties)
 	}
 }
@@ -20,13 +20,11 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices/sqlite3"
 	"github.com/matrix-org/dendrite/internal"
-	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func NewDatabase(
 	dataSourceName string,
 	dbProperties internal.DbProperties, // nolint:unparam
-	serverName gomatrixserverlib.ServerName,
 ) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
@@ -38,7 +36,7 @@ func NewDatabase(
 	case "mysql":
 		return nil, fmt.Errorf("Cannot use mysql implementation")
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName, serverName)
+		return sqlite3.NewDatabase(dataSourceName)
 	default:
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	}
@@ -93,6 +93,12 @@ func UnknownToken(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
 }
 
+// UnknownPos is an error when the client tries to continue a sliding sync
+// connection from a position that the server doesn't know about.
+func UnknownPos(msg string) *MatrixError {
+	return &MatrixError{"M_UNKNOWN_POS", msg}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) *MatrixError {
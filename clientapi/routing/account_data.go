@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
@@ -40,14 +41,14 @@ func GetAccountData(
 		}
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
 	if data, err := accountDB.GetAccountDataByType(
-		req.Context(), localpart, roomID, dataType,
+		req.Context(), localpart, serverName, roomID, dataType,
 	); err == nil {
 		return util.JSONResponse{
 			Code: http.StatusOK,
@@ -73,7 +74,16 @@ func SaveAccountData(
 		}
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	// The server notices account data is only written by the server, as it
+	// decides who sends the notices and which room they are sent to.
+	if strings.HasPrefix(dataType, serverNoticesDataTypePrefix) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot set account data of this type"),
+		}
+	}
+
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
@@ -102,7 +112,7 @@ func SaveAccountData(
 	}
 
 	if err := accountDB.SaveAccountData(
-		req.Context(), localpart, roomID, dataType, string(body),
+		req.Context(), localpart, serverName, roomID, dataType, string(body),
 	); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
 		return jsonerror.InternalServerError()
@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// https://github.com/matrix-org/synapse/blob/v1.14.0/docs/admin_api/shutdown_room.md
+type shutdownRoomRequest struct {
+	NewRoomUserID string `json:"new_room_user_id"`
+	RoomName      string `json:"room_name"`
+	Message       string `json:"message"`
+	Block         bool   `json:"block"`
+	Purge         bool   `json:"purge"`
+}
+
+type shutdownRoomResponse struct {
+	KickedUsers  []string `json:"kicked_users"`
+	LocalAliases []string `json:"local_aliases"`
+	NewRoomID    string   `json:"new_room_id,omitempty"`
+}
+
+// ShutdownRoom implements POST /admin/shutdown_room/{roomID}
+func ShutdownRoom(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	cfg *config.Dendrite,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	if !isServerAdmin(cfg, device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a server admin"),
+		}
+	}
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Room ID must be in the form '!localpart:domain'"),
+		}
+	}
+
+	var r shutdownRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	// The replacement room is created by, and the local aliases are removed
+	// on behalf of, the given user, or the admin if there isn't one.
+	userID := device.UserID
+	if r.NewRoomUserID != "" {
+		_, domain, err := gomatrixserverlib.SplitID('@', r.NewRoomUserID)
+		if err != nil || !cfg.IsAccountServerName(domain) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("'new_room_user_id' must be a local user ID"),
+			}
+		}
+		userID = r.NewRoomUserID
+	}
+
+	shutdownReq := roomserverAPI.PerformRoomShutdownRequest{
+		RoomID:      roomID,
+		UserID:      userID,
+		NewRoomName: r.RoomName,
+		Message:     r.Message,
+		Block:       r.Block,
+		Purge:       r.Purge,
+	}
+	shutdownRes := roomserverAPI.PerformRoomShutdownResponse{}
+	if err := rsAPI.PerformRoomShutdown(req.Context(), &shutdownReq, &shutdownRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformRoomShutdown failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := shutdownRoomResponse{
+		KickedUsers:  shutdownRes.KickedUsers,
+		LocalAliases: shutdownRes.LocalAliases,
+		NewRoomID:    shutdownRes.NewRoomID,
+	}
+	if res.KickedUsers == nil {
+		res.KickedUsers = []string{}
+	}
+	if res.LocalAliases == nil {
+		res.LocalAliases = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+func isServerAdmin(cfg *config.Dendrite, userID string) bool {
+	for _, adminUserID := range cfg.Matrix.AdminUserIDs {
+		if adminUserID == userID {
+			return true
+		}
+	}
+	return false
+}
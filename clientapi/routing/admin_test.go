@@ -0,0 +1,85 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// shutdownRoomserverAPI records the room shutdown requests that it is given.
+type shutdownRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	requests []roomserverAPI.PerformRoomShutdownRequest
+}
+
+func (r *shutdownRoomserverAPI) PerformRoomShutdown(
+	ctx context.Context,
+	req *roomserverAPI.PerformRoomShutdownRequest,
+	res *roomserverAPI.PerformRoomShutdownResponse,
+) error {
+	r.requests = append(r.requests, *req)
+	res.KickedUsers = []string{"@bob:localhost"}
+	return nil
+}
+
+func TestShutdownRoom(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.AdminUserIDs = []string{"@admin:localhost"}
+
+	for _, tc := range []struct {
+		name     string
+		userID   string
+		roomID   string
+		body     string
+		wantCode int
+		wantUser string
+	}{
+		{"not an admin", "@alice:localhost", "!abuse:localhost", `{}`, http.StatusForbidden, ""},
+		{"bad room ID", "@admin:localhost", "abuse", `{}`, http.StatusBadRequest, ""},
+		{"remote new room user", "@admin:localhost", "!abuse:localhost", `{"new_room_user_id":"@bob:remote"}`, http.StatusBadRequest, ""},
+		{"shut down as admin", "@admin:localhost", "!abuse:remote", `{"block":true}`, http.StatusOK, "@admin:localhost"},
+		{"shut down as another user", "@admin:localhost", "!abuse:remote", `{"new_room_user_id":"@notices:localhost"}`, http.StatusOK, "@notices:localhost"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rsAPI := &shutdownRoomserverAPI{}
+			req := httptest.NewRequest(http.MethodPost, "/admin/shutdown_room/"+tc.roomID, strings.NewReader(tc.body))
+			res := ShutdownRoom(req, &authtypes.Device{UserID: tc.userID}, tc.roomID, cfg, rsAPI)
+			if res.Code != tc.wantCode {
+				t.Fatalf("wanted HTTP %d, got %d: %+v", tc.wantCode, res.Code, res.JSON)
+			}
+			if tc.wantUser == "" {
+				if len(rsAPI.requests) != 0 {
+					t.Fatalf("wanted the room not to be shut down, got %+v", rsAPI.requests)
+				}
+				return
+			}
+			if len(rsAPI.requests) != 1 {
+				t.Fatalf("wanted the room to be shut down once, got %+v", rsAPI.requests)
+			}
+			if got := rsAPI.requests[0]; got.RoomID != tc.roomID || got.UserID != tc.wantUser {
+				t.Errorf("wanted room %q to be shut down by %q, got %+v", tc.roomID, tc.wantUser, got)
+			}
+		})
+	}
+}
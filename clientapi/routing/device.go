@@ -48,14 +48,14 @@ func GetDeviceByID(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
 	deviceID string,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
 	ctx := req.Context()
-	dev, err := deviceDB.GetDeviceByID(ctx, localpart, deviceID)
+	dev, err := deviceDB.GetDeviceByID(ctx, localpart, serverName, deviceID)
 	if err == sql.ErrNoRows {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
@@ -79,14 +79,14 @@ func GetDeviceByID(
 func GetDevicesByLocalpart(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
 	ctx := req.Context()
-	deviceList, err := deviceDB.GetDevicesByLocalpart(ctx, localpart)
+	deviceList, err := deviceDB.GetDevicesByLocalpart(ctx, localpart, serverName)
 
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDevicesByLocalpart failed")
@@ -113,14 +113,14 @@ func UpdateDeviceByID(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
 	deviceID string,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
 	ctx := req.Context()
-	dev, err := deviceDB.GetDeviceByID(ctx, localpart, deviceID)
+	dev, err := deviceDB.GetDeviceByID(ctx, localpart, serverName, deviceID)
 	if err == sql.ErrNoRows {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
@@ -147,7 +147,7 @@ func UpdateDeviceByID(
 		return jsonerror.InternalServerError()
 	}
 
-	if err := deviceDB.UpdateDevice(ctx, localpart, deviceID, payload.DisplayName); err != nil {
+	if err := deviceDB.UpdateDevice(ctx, localpart, serverName, deviceID, payload.DisplayName); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.UpdateDevice failed")
 		return jsonerror.InternalServerError()
 	}
@@ -163,7 +163,7 @@ func DeleteDeviceById(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
 	deviceID string,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
@@ -172,7 +172,7 @@ func DeleteDeviceById(
 
 	defer req.Body.Close() // nolint: errcheck
 
-	if err := deviceDB.RemoveDevice(ctx, deviceID, localpart); err != nil {
+	if err := deviceDB.RemoveDevice(ctx, deviceID, localpart, serverName); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevice failed")
 		return jsonerror.InternalServerError()
 	}
@@ -187,7 +187,7 @@ func DeleteDeviceById(
 func DeleteDevices(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
@@ -203,7 +203,7 @@ func DeleteDevices(
 
 	defer req.Body.Close() // nolint: errcheck
 
-	if err := deviceDB.RemoveDevices(ctx, localpart, payload.Devices); err != nil {
+	if err := deviceDB.RemoveDevices(ctx, localpart, serverName, payload.Devices); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevices failed")
 		return jsonerror.InternalServerError()
 	}
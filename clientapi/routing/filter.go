@@ -35,13 +35,13 @@ func GetFilter(
 			JSON: jsonerror.Forbidden("Cannot get filters for other users"),
 		}
 	}
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
-	filter, err := accountDB.GetFilter(req.Context(), localpart, filterID)
+	filter, err := accountDB.GetFilter(req.Context(), localpart, serverName, filterID)
 	if err != nil {
 		//TODO better error handling. This error message is *probably* right,
 		// but if there are obscure db errors, this will also be returned,
@@ -73,7 +73,7 @@ func PutFilter(
 		}
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
@@ -93,7 +93,7 @@ func PutFilter(
 		}
 	}
 
-	filterID, err := accountDB.PutFilter(req.Context(), localpart, &filter)
+	filterID, err := accountDB.PutFilter(req.Context(), localpart, serverName, &filter)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.PutFilter failed")
 		return jsonerror.InternalServerError()
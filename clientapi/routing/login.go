@@ -15,9 +15,9 @@
 package routing
 
 import (
-	"net/http"
-
 	"context"
+	"errors"
+	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -96,7 +97,7 @@ func Login(
 
 			util.GetLogger(req.Context()).WithField("user", r.Identifier.User).Info("Processing login request")
 
-			localpart, err := userutil.ParseUsernameParam(r.Identifier.User, &cfg.Matrix.ServerName)
+			localpart, serverName, err := loginUsername(req, cfg, r.Identifier.User)
 			if err != nil {
 				return util.JSONResponse{
 					Code: http.StatusBadRequest,
@@ -104,7 +105,7 @@ func Login(
 				}
 			}
 
-			acc, err = accountDB.GetAccountByPassword(req.Context(), localpart, r.Password)
+			acc, err = accountDB.GetAccountByPassword(req.Context(), localpart, serverName, r.Password)
 			if err != nil {
 				// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
 				// but that would leak the existence of the user.
@@ -139,7 +140,7 @@ func Login(
 			JSON: loginResponse{
 				UserID:      dev.UserID,
 				AccessToken: dev.AccessToken,
-				HomeServer:  cfg.Matrix.ServerName,
+				HomeServer:  acc.ServerName,
 				DeviceID:    dev.ID,
 			},
 		}
@@ -150,6 +151,25 @@ func Login(
 	}
 }
 
+// loginUsername returns the localpart and server name that the user is
+// logging in as. A bare localpart belongs to the server name the request
+// was addressed to.
+func loginUsername(
+	req *http.Request, cfg *config.Dendrite, username string,
+) (string, gomatrixserverlib.ServerName, error) {
+	localpart, serverName, err := userutil.ParseUsernameParam(username, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if serverName == "" {
+		serverName = internal.LocalServerNameForRequest(cfg, req)
+	}
+	if !cfg.IsAccountServerName(serverName) {
+		return "", "", errors.New("User ID does not belong to this server")
+	}
+	return localpart, serverName, nil
+}
+
 // getDevice returns a new or existing device
 func getDevice(
 	ctx context.Context,
@@ -159,7 +179,7 @@ func getDevice(
 	token string,
 ) (dev *authtypes.Device, err error) {
 	dev, err = deviceDB.CreateDevice(
-		ctx, acc.Localpart, r.DeviceID, token, r.InitialDisplayName,
+		ctx, acc.Localpart, acc.ServerName, r.DeviceID, token, r.InitialDisplayName,
 	)
 	return
 }
@@ -28,13 +28,13 @@ import (
 func Logout(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if err := deviceDB.RemoveDevice(req.Context(), device.ID, localpart); err != nil {
+	if err := deviceDB.RemoveDevice(req.Context(), device.ID, localpart, serverName); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevice failed")
 		return jsonerror.InternalServerError()
 	}
@@ -49,13 +49,13 @@ func Logout(
 func LogoutAll(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if err := deviceDB.RemoveAllDevices(req.Context(), localpart); err != nil {
+	if err := deviceDB.RemoveAllDevices(req.Context(), localpart, serverName); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveAllDevices failed")
 		return jsonerror.InternalServerError()
 	}
@@ -70,12 +70,12 @@ func GetJoinedRooms(
 	device *authtypes.Device,
 	accountsDB accounts.Database,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
-	joinedRooms, err := accountsDB.GetRoomIDsByLocalPart(req.Context(), localpart)
+	joinedRooms, err := accountsDB.GetRoomIDsByLocalPart(req.Context(), localpart, serverName)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountsDB.GetRoomIDsByLocalPart failed")
 		return jsonerror.InternalServerError()
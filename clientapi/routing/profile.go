@@ -117,7 +117,7 @@ func SetAvatarURL(
 		}
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
@@ -131,18 +131,18 @@ func SetAvatarURL(
 		}
 	}
 
-	oldProfile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart)
+	oldProfile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart, serverName)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if err = accountDB.SetAvatarURL(req.Context(), localpart, r.AvatarURL); err != nil {
+	if err = accountDB.SetAvatarURL(req.Context(), localpart, serverName, r.AvatarURL); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAvatarURL failed")
 		return jsonerror.InternalServerError()
 	}
 
-	memberships, err := accountDB.GetMembershipsByLocalpart(req.Context(), localpart)
+	memberships, err := accountDB.GetMembershipsByLocalpart(req.Context(), localpart, serverName)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetMembershipsByLocalpart failed")
 		return jsonerror.InternalServerError()
@@ -150,6 +150,7 @@ func SetAvatarURL(
 
 	newProfile := authtypes.Profile{
 		Localpart:   localpart,
+		ServerName:  serverName,
 		DisplayName: oldProfile.DisplayName,
 		AvatarURL:   r.AvatarURL,
 	}
@@ -239,7 +240,7 @@ func SetDisplayName(
 		}
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
@@ -253,18 +254,18 @@ func SetDisplayName(
 		}
 	}
 
-	oldProfile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart)
+	oldProfile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart, serverName)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if err = accountDB.SetDisplayName(req.Context(), localpart, r.DisplayName); err != nil {
+	if err = accountDB.SetDisplayName(req.Context(), localpart, serverName, r.DisplayName); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetDisplayName failed")
 		return jsonerror.InternalServerError()
 	}
 
-	memberships, err := accountDB.GetMembershipsByLocalpart(req.Context(), localpart)
+	memberships, err := accountDB.GetMembershipsByLocalpart(req.Context(), localpart, serverName)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetMembershipsByLocalpart failed")
 		return jsonerror.InternalServerError()
@@ -272,6 +273,7 @@ func SetDisplayName(
 
 	newProfile := authtypes.Profile{
 		Localpart:   localpart,
+		ServerName:  serverName,
 		DisplayName: r.DisplayName,
 		AvatarURL:   oldProfile.AvatarURL,
 	}
@@ -322,7 +324,7 @@ func getProfile(
 		return nil, err
 	}
 
-	if domain != cfg.Matrix.ServerName {
+	if !cfg.IsLocalServerName(domain) {
 		profile, fedErr := federation.LookupProfile(ctx, domain, userID, "")
 		if fedErr != nil {
 			if x, ok := fedErr.(gomatrix.HTTPError); ok {
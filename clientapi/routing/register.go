@@ -220,6 +220,18 @@ func validateUsername(username string) *util.JSONResponse {
 	return nil
 }
 
+// validateReservedUsername returns an error response if the username is
+// reserved for a user which the server creates itself
+func validateReservedUsername(cfg *config.Dendrite, username string) *util.JSONResponse {
+	if cfg.ServerNotices.Enabled && username == cfg.ServerNotices.LocalPart {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UserInUse("Desired user ID is reserved for server notices."),
+		}
+	}
+	return nil
+}
+
 // validateApplicationServiceUsername returns an error response if the username is invalid for an application service
 func validateApplicationServiceUsername(username string) *util.JSONResponse {
 	if len(username) > maxUsernameLength {
@@ -431,6 +443,9 @@ func validateApplicationService(
 	if err := validateApplicationServiceUsername(username); err != nil {
 		return "", err
 	}
+	if err := validateReservedUsername(cfg, username); err != nil {
+		return "", err
+	}
 
 	// No errors, registration valid
 	return matchedApplicationService.ID, nil
@@ -484,6 +499,9 @@ func Register(
 	if resErr = validateUsername(r.Username); resErr != nil {
 		return *resErr
 	}
+	if resErr = validateReservedUsername(cfg, r.Username); resErr != nil {
+		return *resErr
+	}
 	if resErr = validatePassword(r.Password); resErr != nil {
 		return *resErr
 	}
@@ -516,7 +534,7 @@ func handleGuestRegistration(
 	accountDB accounts.Database,
 	deviceDB devices.Database,
 ) util.JSONResponse {
-	acc, err := accountDB.CreateGuestAccount(req.Context())
+	acc, err := accountDB.CreateGuestAccount(req.Context(), internal.LocalServerNameForRequest(cfg, req))
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -536,7 +554,7 @@ func handleGuestRegistration(
 		}
 	}
 	//we don't allow guests to specify their own device_id
-	dev, err := deviceDB.CreateDevice(req.Context(), acc.Localpart, nil, token, r.InitialDisplayName)
+	dev, err := deviceDB.CreateDevice(req.Context(), acc.Localpart, acc.ServerName, nil, token, r.InitialDisplayName)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -686,7 +704,7 @@ func handleApplicationServiceRegistration(
 	// Don't need to worry about appending to registration stages as
 	// application service registration is entirely separate.
 	return completeRegistration(
-		req.Context(), accountDB, deviceDB, r.Username, "", appserviceID,
+		req.Context(), accountDB, deviceDB, r.Username, cfg.Matrix.ServerName, "", appserviceID,
 		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
 	)
 }
@@ -706,7 +724,8 @@ func checkAndCompleteFlow(
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
 		return completeRegistration(
-			req.Context(), accountDB, deviceDB, r.Username, r.Password, "",
+			req.Context(), accountDB, deviceDB,
+			r.Username, internal.LocalServerNameForRequest(cfg, req), r.Password, "",
 			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
 		)
 	}
@@ -732,6 +751,9 @@ func LegacyRegister(
 	if resErr != nil {
 		return *resErr
 	}
+	if resErr = validateReservedUsername(cfg, r.Username); resErr != nil {
+		return *resErr
+	}
 
 	logger := util.GetLogger(req.Context())
 	logger.WithFields(log.Fields{
@@ -743,6 +765,7 @@ func LegacyRegister(
 		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
 	}
 
+	serverName := internal.LocalServerNameForRequest(cfg, req)
 	switch r.Type {
 	case authtypes.LoginTypeSharedSecret:
 		if cfg.Matrix.RegistrationSharedSecret == "" {
@@ -759,10 +782,10 @@ func LegacyRegister(
 			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
 		}
 
-		return completeRegistration(req.Context(), accountDB, deviceDB, r.Username, r.Password, "", false, nil, nil)
+		return completeRegistration(req.Context(), accountDB, deviceDB, r.Username, serverName, r.Password, "", false, nil, nil)
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
-		return completeRegistration(req.Context(), accountDB, deviceDB, r.Username, r.Password, "", false, nil, nil)
+		return completeRegistration(req.Context(), accountDB, deviceDB, r.Username, serverName, r.Password, "", false, nil, nil)
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
@@ -810,7 +833,8 @@ func completeRegistration(
 	ctx context.Context,
 	accountDB accounts.Database,
 	deviceDB devices.Database,
-	username, password, appserviceID string,
+	username string, serverName gomatrixserverlib.ServerName,
+	password, appserviceID string,
 	inhibitLogin internal.WeakBoolean,
 	displayName, deviceID *string,
 ) util.JSONResponse {
@@ -828,7 +852,7 @@ func completeRegistration(
 		}
 	}
 
-	acc, err := accountDB.CreateAccount(ctx, username, password, appserviceID)
+	acc, err := accountDB.CreateAccount(ctx, username, serverName, password, appserviceID)
 	if err != nil {
 		if errors.Is(err, internal.ErrUserExists) { // user already exists
 			return util.JSONResponse{
@@ -865,7 +889,7 @@ func completeRegistration(
 		}
 	}
 
-	dev, err := deviceDB.CreateDevice(ctx, username, deviceID, token, displayName)
+	dev, err := deviceDB.CreateDevice(ctx, username, serverName, deviceID, token, displayName)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -997,6 +1021,9 @@ func RegisterAvailable(
 	if err := validateUsername(username); err != nil {
 		return *err
 	}
+	if err := validateReservedUsername(cfg, username); err != nil {
+		return *err
+	}
 
 	// Check if this username is reserved by an application service
 	userID := userutil.MakeUserID(username, cfg.Matrix.ServerName)
@@ -1009,7 +1036,9 @@ func RegisterAvailable(
 		}
 	}
 
-	availability, availabilityErr := accountDB.CheckAccountAvailability(req.Context(), username)
+	availability, availabilityErr := accountDB.CheckAccountAvailability(
+		req.Context(), username, internal.LocalServerNameForRequest(cfg, req),
+	)
 	if availabilityErr != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -54,7 +55,7 @@ func GetTags(
 		}
 	}
 
-	_, data, err := obtainSavedTags(req, userID, roomID, accountDB)
+	data, err := obtainSavedTags(req.Context(), userID, roomID, accountDB)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("obtainSavedTags failed")
 		return jsonerror.InternalServerError()
@@ -98,7 +99,7 @@ func PutTag(
 		return *reqErr
 	}
 
-	localpart, data, err := obtainSavedTags(req, userID, roomID, accountDB)
+	data, err := obtainSavedTags(req.Context(), userID, roomID, accountDB)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("obtainSavedTags failed")
 		return jsonerror.InternalServerError()
@@ -114,7 +115,7 @@ func PutTag(
 		tagContent = newTag()
 	}
 	tagContent.Tags[tag] = properties
-	if err = saveTagData(req, localpart, roomID, accountDB, tagContent); err != nil {
+	if err = saveTagData(req.Context(), userID, roomID, accountDB, tagContent); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return jsonerror.InternalServerError()
 	}
@@ -153,7 +154,7 @@ func DeleteTag(
 		}
 	}
 
-	localpart, data, err := obtainSavedTags(req, userID, roomID, accountDB)
+	data, err := obtainSavedTags(req.Context(), userID, roomID, accountDB)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("obtainSavedTags failed")
 		return jsonerror.InternalServerError()
@@ -185,7 +186,7 @@ func DeleteTag(
 			JSON: struct{}{},
 		}
 	}
-	if err = saveTagData(req, localpart, roomID, accountDB, tagContent); err != nil {
+	if err = saveTagData(req.Context(), userID, roomID, accountDB, tagContent); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return jsonerror.InternalServerError()
 	}
@@ -207,35 +208,38 @@ func DeleteTag(
 // obtainSavedTags gets all tags scoped to a userID and roomID
 // from the database
 func obtainSavedTags(
-	req *http.Request,
+	ctx context.Context,
 	userID string,
 	roomID string,
 	accountDB accounts.Database,
-) (string, *gomatrixserverlib.ClientEvent, error) {
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+) (*gomatrixserverlib.ClientEvent, error) {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	data, err := accountDB.GetAccountDataByType(
-		req.Context(), localpart, roomID, "m.tag",
+	return accountDB.GetAccountDataByType(
+		ctx, localpart, serverName, roomID, "m.tag",
 	)
-
-	return localpart, data, err
 }
 
 // saveTagData saves the provided tag data into the database
 func saveTagData(
-	req *http.Request,
-	localpart string,
+	ctx context.Context,
+	userID string,
 	roomID string,
 	accountDB accounts.Database,
 	Tag gomatrix.TagContent,
 ) error {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+
 	newTagData, err := json.Marshal(Tag)
 	if err != nil {
 		return err
 	}
 
-	return accountDB.SaveAccountData(req.Context(), localpart, roomID, "m.tag", string(newTagData))
+	return accountDB.SaveAccountData(ctx, localpart, serverName, roomID, "m.tag", string(newTagData))
 }
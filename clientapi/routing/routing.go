@@ -149,6 +149,30 @@ func Setup(
 				nil, cfg, rsAPI, producer, transactionsCache)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/admin/send_server_notice",
+		internal.MakeAuthAPI("send_server_notice", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return SendServerNotice(req, device, nil, cfg, accountDB, rsAPI, asAPI, producer, syncProducer, nil)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/admin/send_server_notice/{txnID}",
+		internal.MakeAuthAPI("send_server_notice", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			txnID := vars["txnID"]
+			return SendServerNotice(req, device, &txnID, cfg, accountDB, rsAPI, asAPI, producer, syncProducer, transactionsCache)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/admin/shutdown_room/{roomID}",
+		internal.MakeAuthAPI("shutdown_room", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ShutdownRoom(req, device, vars["roomID"], cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
 		internal.MakeAuthAPI("rooms_get_event", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := internal.URLDecodeMapValues(mux.Vars(req))
@@ -44,14 +44,14 @@ func SendTyping(
 		}
 	}
 
-	localpart, err := userutil.ParseUsernameParam(userID, nil)
+	localpart, serverName, err := userutil.ParseUsernameParam(userID, nil)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("userutil.ParseUsernameParam failed")
 		return jsonerror.InternalServerError()
 	}
 
 	// Verify that the user is a member of this room
-	_, err = accountDB.GetMembershipInRoomByLocalpart(req.Context(), localpart, roomID)
+	_, err = accountDB.GetMembershipInRoomByLocalpart(req.Context(), localpart, serverName, roomID)
 	if err == sql.ErrNoRows {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
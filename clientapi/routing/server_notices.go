@@ -0,0 +1,474 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/transactions"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// serverNoticeTag is the room tag which marks a server notices room
+	serverNoticeTag = "m.server_notice"
+	// serverNoticesDataTypePrefix is the prefix of the account data types
+	// used for server notices, which clients aren't allowed to write
+	serverNoticesDataTypePrefix = "org.matrix.dendrite.server_notices"
+	// serverNoticesUserDataType is the system user's account data which marks
+	// the account as having been created by the server
+	serverNoticesUserDataType = serverNoticesDataTypePrefix + "_user"
+	// serverNoticesRoomDataType is the prefix of the system user's account
+	// data which records the notices room of each user
+	serverNoticesRoomDataType = serverNoticesDataTypePrefix + "_room."
+)
+
+var (
+	// serverNoticesUserMutex stops concurrent notices from racing to create
+	// the system user
+	serverNoticesUserMutex sync.Mutex
+	// serverNoticesRoomLocks stops concurrent notices from creating more than
+	// one notices room for the same user
+	serverNoticesRoomLocks = userLocks{locks: make(map[string]*userLock)}
+)
+
+// userLocks is a set of mutexes, one for each user which is currently locked.
+type userLocks struct {
+	mutex sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the mutex of the user, and returns a function which unlocks it.
+func (l *userLocks) lock(userID string) func() {
+	l.mutex.Lock()
+	lock, ok := l.locks[userID]
+	if !ok {
+		lock = &userLock{}
+		l.locks[userID] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, userID)
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// https://github.com/matrix-org/synapse/blob/v1.14.0/docs/admin_api/server_notices.md
+type sendServerNoticeRequest struct {
+	UserID  string                 `json:"user_id"`
+	Content map[string]interface{} `json:"content"`
+}
+
+type serverNoticesRoomContent struct {
+	RoomID string `json:"room_id"`
+}
+
+// SendServerNotice implements:
+//   POST /admin/send_server_notice
+//   PUT /admin/send_server_notice/{txnID}
+func SendServerNotice(
+	req *http.Request,
+	device *authtypes.Device,
+	txnID *string,
+	cfg *config.Dendrite,
+	accountDB accounts.Database,
+	rsAPI api.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+	producer *producers.RoomserverProducer,
+	syncProducer *producers.SyncAPIProducer,
+	txnCache *transactions.Cache,
+) util.JSONResponse {
+	if !cfg.ServerNotices.Enabled {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Server notices are not enabled on this server"),
+		}
+	}
+	if !isServerNoticesAdmin(cfg, device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a server notices admin"),
+		}
+	}
+
+	if txnID != nil {
+		// Try to fetch response from transactionsCache
+		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
+			return *res
+		}
+	}
+
+	var r sendServerNoticeRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if len(r.Content) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'content' must be given"),
+		}
+	}
+	if resErr := checkServerNoticeRecipient(req.Context(), cfg, accountDB, r.UserID); resErr != nil {
+		return *resErr
+	}
+
+	eventID, err := sendServerNotice(
+		req.Context(), r.UserID, r.Content, time.Now(),
+		cfg, accountDB, rsAPI, asAPI, producer, syncProducer,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sendServerNotice failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{eventID},
+	}
+	// Add response to transactionsCache
+	if txnID != nil {
+		txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+	}
+	return res
+}
+
+// checkServerNoticeRecipient checks that userID belongs to an existing local
+// account, as server notices can't be sent to anyone else.
+func checkServerNoticeRecipient(
+	ctx context.Context, cfg *config.Dendrite, accountDB accounts.Database, userID string,
+) *util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("user id must be in the form @localpart:domain"),
+		}
+	}
+	if !cfg.IsAccountServerName(domain) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Server notices can only be sent to local users"),
+		}
+	}
+	if _, err = accountDB.GetAccountByLocalpart(ctx, localpart, domain); err == sql.ErrNoRows {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown user"),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	return nil
+}
+
+func isServerNoticesAdmin(cfg *config.Dendrite, userID string) bool {
+	for _, adminUserID := range cfg.ServerNotices.AdminUserIDs {
+		if adminUserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// sendServerNotice sends a message with the given content from the system
+// user into the notices room of the local user userID, and returns the ID of
+// the new event. The room is created if the user doesn't have one yet, and the
+// user is invited back into it if they have left it. Usage limit alerts are
+// sent in the same way, with an "m.server_notice" msgtype in their content.
+func sendServerNotice(
+	ctx context.Context,
+	userID string,
+	content map[string]interface{},
+	evTime time.Time,
+	cfg *config.Dendrite,
+	accountDB accounts.Database,
+	rsAPI api.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+	producer *producers.RoomserverProducer,
+	syncProducer *producers.SyncAPIProducer,
+) (string, error) {
+	systemDevice, err := serverNoticesDevice(ctx, cfg, accountDB)
+	if err != nil {
+		return "", err
+	}
+
+	roomID, err := serverNoticesRoom(
+		ctx, userID, systemDevice, evTime,
+		cfg, accountDB, rsAPI, asAPI, producer, syncProducer,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: systemDevice.UserID,
+		RoomID: roomID,
+		Type:   "m.room.message",
+	}
+	if err = builder.SetContent(content); err != nil {
+		return "", err
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	e, err := internal.BuildEvent(ctx, &builder, cfg, evTime, rsAPI, &queryRes)
+	if err != nil {
+		return "", err
+	}
+	return producer.SendEvents(
+		ctx,
+		[]gomatrixserverlib.HeaderedEvent{e.Headered(queryRes.RoomVersion)},
+		cfg.Matrix.ServerName,
+		nil,
+	)
+}
+
+// serverNoticesDevice returns a device for the system user which sends the
+// server notices, creating the user's account the first time it is needed.
+// An account with the same localpart which the server didn't create, such as
+// one registered before server notices were enabled, is never used.
+func serverNoticesDevice(
+	ctx context.Context, cfg *config.Dendrite, accountDB accounts.Database,
+) (*authtypes.Device, error) {
+	serverNoticesUserMutex.Lock()
+	defer serverNoticesUserMutex.Unlock()
+
+	localpart, serverName := cfg.ServerNotices.LocalPart, cfg.Matrix.ServerName
+	_, err := accountDB.GetAccountByLocalpart(ctx, localpart, serverName)
+	switch err {
+	case sql.ErrNoRows:
+		// The system user has no password so nobody can log in as them.
+		if _, err = accountDB.CreateAccount(ctx, localpart, serverName, "", ""); err != nil {
+			return nil, err
+		}
+		if err = accountDB.SaveAccountData(ctx, localpart, serverName, "", serverNoticesUserDataType, "{}"); err != nil {
+			return nil, err
+		}
+		if err = accountDB.SetDisplayName(ctx, localpart, serverName, cfg.ServerNotices.DisplayName); err != nil {
+			return nil, err
+		}
+		if cfg.ServerNotices.AvatarURL != "" {
+			if err = accountDB.SetAvatarURL(ctx, localpart, serverName, cfg.ServerNotices.AvatarURL); err != nil {
+				return nil, err
+			}
+		}
+	case nil:
+		data, derr := accountDB.GetAccountDataByType(ctx, localpart, serverName, "", serverNoticesUserDataType)
+		if derr != nil {
+			return nil, derr
+		}
+		if data == nil {
+			return nil, fmt.Errorf("the server notices user %q is an existing account which the server didn't create", localpart)
+		}
+	default:
+		return nil, err
+	}
+	return &authtypes.Device{
+		UserID: fmt.Sprintf("@%s:%s", localpart, serverName),
+	}, nil
+}
+
+// serverNoticesRoom returns the ID of the notices room of userID. It makes
+// sure that the user is either joined to or invited to the room, so that
+// leaving the room never loses it for good.
+func serverNoticesRoom(
+	ctx context.Context,
+	userID string,
+	systemDevice *authtypes.Device,
+	evTime time.Time,
+	cfg *config.Dendrite,
+	accountDB accounts.Database,
+	rsAPI api.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+	producer *producers.RoomserverProducer,
+	syncProducer *producers.SyncAPIProducer,
+) (string, error) {
+	unlock := serverNoticesRoomLocks.lock(userID)
+	defer unlock()
+
+	dataType := serverNoticesRoomDataType + userID
+	data, err := accountDB.GetAccountDataByType(
+		ctx, cfg.ServerNotices.LocalPart, cfg.Matrix.ServerName, "", dataType,
+	)
+	if err != nil {
+		return "", err
+	}
+	if data != nil {
+		var roomContent serverNoticesRoomContent
+		if err = json.Unmarshal(data.Content, &roomContent); err != nil {
+			return "", err
+		}
+		var exists bool
+		exists, err = reinviteToServerNoticesRoom(
+			ctx, userID, roomContent.RoomID, systemDevice, evTime,
+			cfg, accountDB, rsAPI, asAPI, producer, syncProducer,
+		)
+		if err != nil || exists {
+			return roomContent.RoomID, err
+		}
+	}
+
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+	powerLevels := internal.InitialPowerLevelsContent(systemDevice.UserID)
+	// Stop the user from sending anything into the room.
+	powerLevels.UsersDefault = -10
+	r := createRoomRequest{
+		Invite:          []string{userID},
+		Name:            cfg.ServerNotices.RoomName,
+		Preset:          presetPrivateChat,
+		CreationContent: map[string]interface{}{"m.federate": false},
+		InitialState: []fledglingEvent{
+			{"m.room.power_levels", "", powerLevels},
+		},
+	}
+	res := createRoom(ctx, r, systemDevice, cfg, roomID, evTime, producer, accountDB, rsAPI, asAPI)
+	if res.Code != http.StatusOK {
+		return "", fmt.Errorf("failed to create server notices room: %d %v", res.Code, res.JSON)
+	}
+
+	roomData, err := json.Marshal(serverNoticesRoomContent{RoomID: roomID})
+	if err != nil {
+		return "", err
+	}
+	if err = accountDB.SaveAccountData(
+		ctx, cfg.ServerNotices.LocalPart, cfg.Matrix.ServerName, "", dataType, string(roomData),
+	); err != nil {
+		return "", err
+	}
+	return roomID, tagServerNoticesRoom(ctx, userID, roomID, accountDB, syncProducer)
+}
+
+// reinviteToServerNoticesRoom invites userID back into their notices room if
+// they are no longer joined to or invited to it. Returns false if the room
+// doesn't exist, in which case a new one should be made.
+func reinviteToServerNoticesRoom(
+	ctx context.Context,
+	userID, roomID string,
+	systemDevice *authtypes.Device,
+	evTime time.Time,
+	cfg *config.Dendrite,
+	accountDB accounts.Database,
+	rsAPI api.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+	producer *producers.RoomserverProducer,
+	syncProducer *producers.SyncAPIProducer,
+) (bool, error) {
+	queryReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+		},
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &queryReq, &queryRes); err != nil {
+		return false, err
+	}
+	if !queryRes.RoomExists {
+		return false, nil
+	}
+	for _, ev := range queryRes.StateEvents {
+		membership, err := ev.Membership()
+		if err != nil {
+			return true, err
+		}
+		if membership == gomatrixserverlib.Join || membership == gomatrixserverlib.Invite {
+			return true, nil
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user_id": userID,
+		"room_id": roomID,
+	}).Info("Inviting user back into their server notices room")
+
+	inviteEvent, err := buildMembershipEvent(
+		ctx, threepid.MembershipRequest{UserID: userID}, accountDB, systemDevice,
+		gomatrixserverlib.Invite, roomID, false, cfg, evTime, rsAPI, asAPI,
+	)
+	if err != nil {
+		return true, err
+	}
+	if err = producer.SendInvite(
+		ctx, inviteEvent.Headered(queryRes.RoomVersion), nil, cfg.Matrix.ServerName, nil,
+	); err != nil {
+		return true, err
+	}
+	return true, tagServerNoticesRoom(ctx, userID, roomID, accountDB, syncProducer)
+}
+
+// tagServerNoticesRoom adds the m.server_notice tag to the user's notices
+// room, so that clients can tell it apart from other rooms.
+func tagServerNoticesRoom(
+	ctx context.Context,
+	userID, roomID string,
+	accountDB accounts.Database,
+	syncProducer *producers.SyncAPIProducer,
+) error {
+	data, err := obtainSavedTags(ctx, userID, roomID, accountDB)
+	if err != nil {
+		return err
+	}
+
+	tagContent := newTag()
+	if data != nil {
+		if err = json.Unmarshal(data.Content, &tagContent); err != nil {
+			return err
+		}
+		if tagContent.Tags == nil {
+			tagContent.Tags = make(map[string]gomatrix.TagProperties)
+		}
+	}
+	if _, ok := tagContent.Tags[serverNoticeTag]; ok {
+		return nil
+	}
+	tagContent.Tags[serverNoticeTag] = gomatrix.TagProperties{}
+	if err = saveTagData(ctx, userID, roomID, accountDB, tagContent); err != nil {
+		return err
+	}
+	return syncProducer.SendData(userID, roomID, "m.tag")
+}
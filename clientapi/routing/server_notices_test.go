@@ -0,0 +1,345 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts/sqlite3"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// noticesTestRoom is the current state of a room in noticesRoomserverAPI.
+type noticesTestRoom struct {
+	version gomatrixserverlib.RoomVersion
+	state   map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.HeaderedEvent
+	latest  gomatrixserverlib.EventReference
+	depth   int64
+}
+
+// noticesRoomserverAPI keeps track of the current state of the rooms that
+// events are sent into, without checking whether the events are allowed.
+type noticesRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	rooms   map[string]*noticesTestRoom
+	invites int
+}
+
+func (r *noticesRoomserverAPI) addEvent(event gomatrixserverlib.HeaderedEvent) {
+	room, ok := r.rooms[event.RoomID()]
+	if !ok {
+		room = &noticesTestRoom{
+			version: event.RoomVersion,
+			state:   make(map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.HeaderedEvent),
+		}
+		r.rooms[event.RoomID()] = room
+	}
+	if event.StateKey() != nil {
+		room.state[gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}] = event
+	}
+	room.latest = event.EventReference()
+	room.depth = event.Depth()
+}
+
+func (r *noticesRoomserverAPI) InputRoomEvents(
+	ctx context.Context,
+	req *api.InputRoomEventsRequest,
+	res *api.InputRoomEventsResponse,
+) error {
+	for _, input := range req.InputRoomEvents {
+		r.addEvent(input.Event)
+	}
+	for _, input := range req.InputInviteEvents {
+		r.addEvent(input.Event)
+		r.invites++
+	}
+	return nil
+}
+
+func (r *noticesRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	req *api.QueryLatestEventsAndStateRequest,
+	res *api.QueryLatestEventsAndStateResponse,
+) error {
+	room, ok := r.rooms[req.RoomID]
+	if !ok {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = room.version
+	res.LatestEvents = []gomatrixserverlib.EventReference{room.latest}
+	res.Depth = room.depth + 1
+	for _, tuple := range req.StateToFetch {
+		if event, ok := room.state[tuple]; ok {
+			res.StateEvents = append(res.StateEvents, event)
+		}
+	}
+	return nil
+}
+
+func (r *noticesRoomserverAPI) membership(t *testing.T, roomID, userID string) string {
+	t.Helper()
+	event, ok := r.rooms[roomID].state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}]
+	if !ok {
+		return ""
+	}
+	membership, err := event.Membership()
+	if err != nil {
+		t.Fatalf("Membership failed: %s", err)
+	}
+	return membership
+}
+
+// discardProducer is a sarama.SyncProducer which discards the messages.
+type discardProducer struct{}
+
+func (p *discardProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, nil
+}
+
+func (p *discardProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	return nil
+}
+
+func (p *discardProducer) Close() error {
+	return nil
+}
+
+type serverNoticesTest struct {
+	cfg          *config.Dendrite
+	accountDB    *sqlite3.Database
+	rsAPI        *noticesRoomserverAPI
+	producer     *producers.RoomserverProducer
+	syncProducer *producers.SyncAPIProducer
+}
+
+func newServerNoticesTest(t *testing.T) *serverNoticesTest {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+	cfg.Matrix.VirtualHosts = []config.VirtualHost{{ServerName: "vhost.localhost"}}
+	cfg.ServerNotices.Enabled = true
+	cfg.ServerNotices.LocalPart = "notices"
+	cfg.ServerNotices.DisplayName = "Server Notices"
+	cfg.ServerNotices.RoomName = "Server Notices"
+	accountDB, err := sqlite3.NewDatabase("file::memory:", cfg.LocalServerNames())
+	if err != nil {
+		t.Fatalf("sqlite3.NewDatabase failed: %s", err)
+	}
+	rsAPI := &noticesRoomserverAPI{rooms: make(map[string]*noticesTestRoom)}
+	return &serverNoticesTest{
+		cfg:          cfg,
+		accountDB:    accountDB,
+		rsAPI:        rsAPI,
+		producer:     producers.NewRoomserverProducer(rsAPI),
+		syncProducer: &producers.SyncAPIProducer{Producer: &discardProducer{}},
+	}
+}
+
+func (s *serverNoticesTest) noticesRoom(t *testing.T, userID string, systemDevice *authtypes.Device) string {
+	t.Helper()
+	roomID, err := serverNoticesRoom(
+		context.Background(), userID, systemDevice, time.Now(),
+		s.cfg, s.accountDB, s.rsAPI, nil, s.producer, s.syncProducer,
+	)
+	if err != nil {
+		t.Fatalf("serverNoticesRoom failed: %s", err)
+	}
+	return roomID
+}
+
+func (s *serverNoticesTest) hasNoticeTag(t *testing.T, userID, roomID string) bool {
+	t.Helper()
+	data, err := obtainSavedTags(context.Background(), userID, roomID, s.accountDB)
+	if err != nil {
+		t.Fatalf("obtainSavedTags failed: %s", err)
+	}
+	if data == nil {
+		return false
+	}
+	var tags gomatrix.TagContent
+	if err = json.Unmarshal(data.Content, &tags); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	_, ok := tags.Tags[serverNoticeTag]
+	return ok
+}
+
+func TestServerNoticesRoom(t *testing.T) {
+	ctx := context.Background()
+	s := newServerNoticesTest(t)
+	alice := "@alice:localhost"
+	if _, err := s.accountDB.CreateAccount(ctx, "alice", s.cfg.Matrix.ServerName, "password", ""); err != nil {
+		t.Fatalf("CreateAccount failed: %s", err)
+	}
+	systemDevice, err := serverNoticesDevice(ctx, s.cfg, s.accountDB)
+	if err != nil {
+		t.Fatalf("serverNoticesDevice failed: %s", err)
+	}
+
+	// The first notice creates the room, invites the user into it and tags it.
+	roomID := s.noticesRoom(t, alice, systemDevice)
+	if membership := s.rsAPI.membership(t, roomID, alice); membership != gomatrixserverlib.Invite {
+		t.Fatalf("wanted the user to be invited to the notices room, got membership %q", membership)
+	}
+	if !s.hasNoticeTag(t, alice, roomID) {
+		t.Fatalf("wanted the notices room to be tagged")
+	}
+
+	// Later notices reuse the room without inviting the user again.
+	if reused := s.noticesRoom(t, alice, systemDevice); reused != roomID {
+		t.Fatalf("wanted the notices room %q to be reused, got %q", roomID, reused)
+	}
+	if s.rsAPI.invites != 1 {
+		t.Fatalf("wanted the user to be invited once, got %d invites", s.rsAPI.invites)
+	}
+
+	// If the user leaves the room and untags it, they are invited back into
+	// it and it is tagged again.
+	leave := gomatrixserverlib.EventBuilder{
+		Sender:   alice,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &alice,
+	}
+	if err = leave.SetContent(gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Leave}); err != nil {
+		t.Fatalf("SetContent failed: %s", err)
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	leaveEvent, err := internal.BuildEvent(ctx, &leave, s.cfg, time.Now(), s.rsAPI, &queryRes)
+	if err != nil {
+		t.Fatalf("BuildEvent failed: %s", err)
+	}
+	s.rsAPI.addEvent(leaveEvent.Headered(queryRes.RoomVersion))
+	if err = saveTagData(ctx, alice, roomID, s.accountDB, newTag()); err != nil {
+		t.Fatalf("saveTagData failed: %s", err)
+	}
+	if reused := s.noticesRoom(t, alice, systemDevice); reused != roomID {
+		t.Fatalf("wanted the notices room %q to be reused, got %q", roomID, reused)
+	}
+	if membership := s.rsAPI.membership(t, roomID, alice); membership != gomatrixserverlib.Invite {
+		t.Fatalf("wanted the user to be invited back into the notices room, got membership %q", membership)
+	}
+	if s.rsAPI.invites != 2 {
+		t.Fatalf("wanted the user to be invited twice, got %d invites", s.rsAPI.invites)
+	}
+	if !s.hasNoticeTag(t, alice, roomID) {
+		t.Fatalf("wanted the notices room to be tagged again")
+	}
+
+	// If the room is gone, a new one is made.
+	delete(s.rsAPI.rooms, roomID)
+	if created := s.noticesRoom(t, alice, systemDevice); created == roomID {
+		t.Fatalf("wanted a new notices room to be created")
+	}
+}
+
+func TestServerNoticesDevice(t *testing.T) {
+	ctx := context.Background()
+
+	// The system user is created once and then reused.
+	s := newServerNoticesTest(t)
+	for i := 0; i < 2; i++ {
+		device, err := serverNoticesDevice(ctx, s.cfg, s.accountDB)
+		if err != nil {
+			t.Fatalf("serverNoticesDevice failed: %s", err)
+		}
+		if device.UserID != "@notices:localhost" {
+			t.Fatalf("wanted the system user to be @notices:localhost, got %q", device.UserID)
+		}
+	}
+
+	// An account that the server didn't create is never used.
+	s = newServerNoticesTest(t)
+	if _, err := s.accountDB.CreateAccount(ctx, "notices", s.cfg.Matrix.ServerName, "password", ""); err != nil {
+		t.Fatalf("CreateAccount failed: %s", err)
+	}
+	if _, err := serverNoticesDevice(ctx, s.cfg, s.accountDB); err == nil {
+		t.Fatalf("wanted an existing account not to be used as the system user")
+	}
+	if resErr := validateReservedUsername(s.cfg, "notices"); resErr == nil {
+		t.Fatalf("wanted the system user's localpart to be reserved")
+	}
+}
+
+func TestServerNoticeRecipient(t *testing.T) {
+	ctx := context.Background()
+	s := newServerNoticesTest(t)
+	if _, err := s.accountDB.CreateAccount(ctx, "alice", "vhost.localhost", "password", ""); err != nil {
+		t.Fatalf("CreateAccount failed: %s", err)
+	}
+
+	for userID, wantCode := range map[string]int{
+		"@alice:vhost.localhost": 0,
+		"@alice:localhost":       http.StatusNotFound,
+		"@bob:vhost.localhost":   http.StatusNotFound,
+		"@alice:remote.example":  http.StatusBadRequest,
+	} {
+		resErr := checkServerNoticeRecipient(ctx, s.cfg, s.accountDB, userID)
+		switch {
+		case resErr == nil && wantCode != 0:
+			t.Errorf("wanted %q to be rejected with %d", userID, wantCode)
+		case resErr != nil && resErr.Code != wantCode:
+			t.Errorf("wanted %q to get %d, got %d", userID, wantCode, resErr.Code)
+		}
+	}
+}
+
+func TestUserLocks(t *testing.T) {
+	locks := userLocks{locks: make(map[string]*userLock)}
+	unlockAlice := locks.lock("@alice:localhost")
+
+	// Another user isn't blocked by the lock.
+	locks.lock("@bob:localhost")()
+
+	// The same user is blocked until the lock is released.
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("@alice:localhost")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("wanted the second lock to wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockAlice()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("wanted the second lock to be taken once the first was released")
+	}
+	if len(locks.locks) != 0 {
+		t.Fatalf("wanted no locks to be left over, got %d", len(locks.locks))
+	}
+}
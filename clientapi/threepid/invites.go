@@ -216,8 +216,8 @@ func queryIDServerStoreInvite(
 	}
 
 	var profile *authtypes.Profile
-	if serverName == cfg.Matrix.ServerName {
-		profile, err = db.GetProfileByLocalpart(ctx, localpart)
+	if cfg.IsAccountServerName(serverName) {
+		profile, err = db.GetProfileByLocalpart(ctx, localpart, serverName)
 		if err != nil {
 			return nil, err
 		}
@@ -20,27 +20,36 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
-// ParseUsernameParam extracts localpart from usernameParam.
+// ParseUsernameParam extracts localpart and server name from usernameParam.
 // usernameParam can either be a user ID or just the localpart/username.
 // If serverName is passed, it is verified against the domain obtained from usernameParam (if present)
+// and is returned as the server name of a localpart/username. Otherwise the server name of a
+// localpart/username is empty.
 // Returns error in case of invalid usernameParam.
-func ParseUsernameParam(usernameParam string, expectedServerName *gomatrixserverlib.ServerName) (string, error) {
+func ParseUsernameParam(
+	usernameParam string, expectedServerName *gomatrixserverlib.ServerName,
+) (string, gomatrixserverlib.ServerName, error) {
 	localpart := usernameParam
+	var serverName gomatrixserverlib.ServerName
+	if expectedServerName != nil {
+		serverName = *expectedServerName
+	}
 
 	if strings.HasPrefix(usernameParam, "@") {
 		lp, domain, err := gomatrixserverlib.SplitID('@', usernameParam)
 
 		if err != nil {
-			return "", errors.New("Invalid username")
+			return "", "", errors.New("Invalid username")
 		}
 
 		if expectedServerName != nil && domain != *expectedServerName {
-			return "", errors.New("User ID does not belong to this server")
+			return "", "", errors.New("User ID does not belong to this server")
 		}
 
 		localpart = lp
+		serverName = domain
 	}
-	return localpart, nil
+	return localpart, serverName, nil
 }
 
 // MakeUserID generates user ID from localpart & server name
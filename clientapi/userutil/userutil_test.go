@@ -28,7 +28,7 @@ var (
 
 // TestGoodUserID checks that correct localpart is returned for a valid user ID.
 func TestGoodUserID(t *testing.T) {
-	lp, err := ParseUsernameParam(goodUserID, &serverName)
+	lp, domain, err := ParseUsernameParam(goodUserID, &serverName)
 
 	if err != nil {
 		t.Error("User ID Parsing failed for ", goodUserID, " with error: ", err.Error())
@@ -37,11 +37,29 @@ func TestGoodUserID(t *testing.T) {
 	if lp != localpart {
 		t.Error("Incorrect username, returned: ", lp, " should be: ", localpart)
 	}
+
+	if domain != serverName {
+		t.Error("Incorrect server name, returned: ", domain, " should be: ", serverName)
+	}
+}
+
+// TestGoodUserIDWithoutServerName checks that the server name of a valid user ID is
+// returned when no server name is expected.
+func TestGoodUserIDWithoutServerName(t *testing.T) {
+	lp, domain, err := ParseUsernameParam(goodUserID, nil)
+
+	if err != nil {
+		t.Error("User ID Parsing failed for ", goodUserID, " with error: ", err.Error())
+	}
+
+	if lp != localpart || domain != serverName {
+		t.Error("Incorrect user ID, returned: ", lp, domain, " should be: ", localpart, serverName)
+	}
 }
 
 // TestWithLocalpartOnly checks that localpart is returned when usernameParam contains only localpart.
 func TestWithLocalpartOnly(t *testing.T) {
-	lp, err := ParseUsernameParam(localpart, &serverName)
+	lp, domain, err := ParseUsernameParam(localpart, &serverName)
 
 	if err != nil {
 		t.Error("User ID Parsing failed for ", localpart, " with error: ", err.Error())
@@ -50,11 +68,15 @@ func TestWithLocalpartOnly(t *testing.T) {
 	if lp != localpart {
 		t.Error("Incorrect username, returned: ", lp, " should be: ", localpart)
 	}
+
+	if domain != serverName {
+		t.Error("Incorrect server name, returned: ", domain, " should be: ", serverName)
+	}
 }
 
 // TestIncorrectDomain checks for error when there's server name mismatch.
 func TestIncorrectDomain(t *testing.T) {
-	_, err := ParseUsernameParam(goodUserID, &invalidServerName)
+	_, _, err := ParseUsernameParam(goodUserID, &invalidServerName)
 
 	if err == nil {
 		t.Error("Invalid Domain should return an error")
@@ -63,7 +85,7 @@ func TestIncorrectDomain(t *testing.T) {
 
 // TestBadUserID checks that ParseUsernameParam fails for invalid user ID
 func TestBadUserID(t *testing.T) {
-	_, err := ParseUsernameParam(badUserID, &serverName)
+	_, _, err := ParseUsernameParam(badUserID, &serverName)
 
 	if err == nil {
 		t.Error("Illegal User ID should return an error")
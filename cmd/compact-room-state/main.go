@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+)
+
+const usage = `Usage: %s
+
+Rewrites the room state snapshots in a roomserver database so that they are
+stored as deltas against earlier snapshots of the same room, then deletes the
+state blocks which are no longer used. This can reclaim a lot of space in the
+state block table for busy rooms.
+
+The roomserver must NOT be running while this command is running.
+
+Arguments:
+
+`
+
+var database = flag.String("database", "", "The location of the roomserver database, e.g. 'postgres://...', 'mysql://...' or 'file:roomserver.db'.")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *database == "" {
+		flag.Usage()
+		fmt.Println("Missing --database")
+		os.Exit(1)
+	}
+
+	db, err := storage.Open(*database, nil)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	stats, err := state.NewStateResolution(db).CompactStateSnapshots(context.Background())
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println("Compacted room state:")
+	fmt.Printf("rooms               = %d\n", stats.Rooms)
+	fmt.Printf("snapshots           = %d\n", stats.Snapshots)
+	fmt.Printf("rewritten snapshots = %d\n", stats.RewrittenSnapshots)
+	fmt.Printf("deleted blocks      = %d\n", stats.DeletedBlocks)
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/roomserver/storage"
+)
+
+const usage = `Usage: %s
+
+Rewrites the stored JSON of every event in a roomserver database so that it
+is compressed, or so that it is no longer compressed if --decompress is given.
+Events are rewritten in batches, each in its own transaction, so this can be
+interrupted and run again to finish off.
+
+Set database.compress_room_server_events in the dendrite config to match, so
+that new events are stored the same way.
+
+Arguments:
+
+`
+
+var (
+	database   = flag.String("database", "", "The location of the roomserver database, e.g. 'postgres://...', 'mysql://...' or 'file:roomserver.db'.")
+	batchSize  = flag.Int("batch-size", 1000, "The number of events to rewrite in each transaction.")
+	decompress = flag.Bool("decompress", false, "Store the events uncompressed instead.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *database == "" {
+		flag.Usage()
+		fmt.Println("Missing --database")
+		os.Exit(1)
+	}
+
+	db, err := storage.Open(*database, nil)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	stats, err := db.RecompressEventJSON(context.Background(), !*decompress, *batchSize)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println("Rewrote event JSON:")
+	fmt.Printf("events           = %d\n", stats.Events)
+	fmt.Printf("rewritten events = %d\n", stats.Rewritten)
+	fmt.Printf("bytes before     = %d\n", stats.BytesBefore)
+	fmt.Printf("bytes after      = %d\n", stats.BytesAfter)
+}
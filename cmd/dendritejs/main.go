@@ -168,6 +168,7 @@ func main() {
 	cfg.Database.AppService = "file:/idb/dendritejs_appservice.db"
 	cfg.Database.Device = "file:/idb/dendritejs_device.db"
 	cfg.Database.FederationSender = "file:/idb/dendritejs_fedsender.db"
+	cfg.Database.FederationAPI = "file:/idb/dendritejs_fedapi.db"
 	cfg.Database.MediaAPI = "file:/idb/dendritejs_mediaapi.db"
 	cfg.Database.Naffka = "file:/idb/dendritejs_naffka.db"
 	cfg.Database.PublicRoomsAPI = "file:/idb/dendritejs_publicrooms.db"
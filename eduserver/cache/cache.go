@@ -21,7 +21,9 @@ import (
 	"time"
 )
 
-const defaultTypingTimeout = 10 * time.Second
+// DefaultTypingTimeout is how long a user is considered to be typing for if
+// no expiry time is given.
+const DefaultTypingTimeout = 10 * time.Second
 
 // userSet is a map of user IDs to a timer, timer fires at expiry.
 type userSet map[string]*time.Timer
@@ -95,7 +97,7 @@ func (t *EDUCache) GetTypingUsersIfUpdatedAfter(
 
 // AddTypingUser sets an user as typing in a room.
 // expire is the time when the user typing should time out.
-// if expire is nil, defaultTypingTimeout is assumed.
+// if expire is nil, DefaultTypingTimeout is assumed.
 // Returns the latest sync position for typing after update.
 func (t *EDUCache) AddTypingUser(
 	userID, roomID string, expire *time.Time,
@@ -113,17 +115,42 @@ func (t *EDUCache) AddTypingUser(
 	return t.GetLatestSyncPosition()
 }
 
-// AddSendToDeviceMessage increases the sync position for
-// send-to-device updates.
-// Returns the sync position before update, as the caller
-// will use this to record the current stream position
-// at the time that the send-to-device message was sent.
-func (t *EDUCache) AddSendToDeviceMessage() int64 {
+// RestoreRoom restores the typing state of a room at a given sync position,
+// e.g. after a restart. typingUsers maps the IDs of users who are typing in
+// the room to the time at which they should stop typing. The latest sync
+// position is advanced to the room's sync position if it is behind it.
+func (t *EDUCache) RestoreRoom(
+	roomID string, syncPosition int64, typingUsers map[string]time.Time,
+) {
 	t.Lock()
 	defer t.Unlock()
-	latestSyncPosition := t.latestSyncPosition
-	t.latestSyncPosition++
-	return latestSyncPosition
+
+	if syncPosition > t.latestSyncPosition {
+		t.latestSyncPosition = syncPosition
+	}
+	if t.data[roomID] == nil {
+		t.data[roomID] = t.newRoomData()
+	}
+	if syncPosition > t.data[roomID].syncPosition {
+		t.data[roomID].syncPosition = syncPosition
+	}
+
+	for userID, expire := range typingUsers {
+		userID := userID
+		until := time.Until(expire)
+		if until <= 0 {
+			continue
+		}
+		if timer, ok := t.data[roomID].userSet[userID]; ok {
+			timer.Stop()
+		}
+		t.data[roomID].userSet[userID] = time.AfterFunc(until, func() {
+			latestSyncPosition := t.RemoveUser(userID, roomID)
+			if t.timeoutCallback != nil {
+				t.timeoutCallback(userID, roomID, latestSyncPosition)
+			}
+		})
+	}
 }
 
 // addUser with mutex lock & replace the previous timer.
@@ -193,5 +220,5 @@ func getExpireTime(expire *time.Time) time.Time {
 	if expire != nil {
 		return *expire
 	}
-	return time.Now().Add(defaultTypingTimeout)
+	return time.Now().Add(DefaultTypingTimeout)
 }
@@ -40,6 +40,10 @@ func TestEDUCache(t *testing.T) {
 	t.Run("RemoveUser", func(t *testing.T) {
 		testRemoveUser(t, tCache)
 	})
+
+	t.Run("RestoreRoom", func(t *testing.T) {
+		testRestoreRoom(t, tCache)
+	})
 }
 
 func testAddTypingUser(t *testing.T, tCache *EDUCache) { // nolint: unparam
@@ -101,3 +105,26 @@ func testRemoveUser(t *testing.T, tCache *EDUCache) {
 		}
 	}
 }
+
+func testRestoreRoom(t *testing.T, tCache *EDUCache) {
+	future := time.Now().Add(time.Minute)
+	past := time.Now().Add(-time.Minute)
+	position := tCache.GetLatestSyncPosition() + 10
+
+	tCache.RestoreRoom("room5", position, map[string]time.Time{
+		"user1": future,
+		"user2": past,
+	})
+
+	if got := tCache.GetLatestSyncPosition(); got != position {
+		t.Errorf("TypingCache.GetLatestSyncPosition() = %d, want %d", got, position)
+	}
+	if users, updated := tCache.GetTypingUsersIfUpdatedAfter("room5", position-1); !updated {
+		t.Errorf("TypingCache.GetTypingUsersIfUpdatedAfter(room5, %d) should have been updated", position-1)
+	} else if !test.UnsortedStringSliceEqual(users, []string{"user1"}) {
+		t.Errorf("TypingCache.GetTypingUsersIfUpdatedAfter(room5) = %v, want %v", users, []string{"user1"})
+	}
+	if _, updated := tCache.GetTypingUsersIfUpdatedAfter("room5", position); updated {
+		t.Errorf("TypingCache.GetTypingUsersIfUpdatedAfter(room5, %d) shouldn't have been updated", position)
+	}
+}
@@ -40,7 +40,7 @@ func SetupEDUServerComponent(
 		Producer:                     base.KafkaProducer,
 		OutputTypingEventTopic:       string(base.Cfg.Kafka.Topics.OutputTypingEvent),
 		OutputSendToDeviceEventTopic: string(base.Cfg.Kafka.Topics.OutputSendToDeviceEvent),
-		ServerName:                   base.Cfg.Matrix.ServerName,
+		Cfg:                          base.Cfg,
 	}
 
 	inthttp.AddRoutes(inputAPI, base.InternalAPIMux)
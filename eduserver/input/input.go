@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 )
@@ -41,8 +42,8 @@ type EDUServerInputAPI struct {
 	Producer sarama.SyncProducer
 	// device database
 	DeviceDB devices.Database
-	// our server name
-	ServerName gomatrixserverlib.ServerName
+	// our configuration, for our server names
+	Cfg *config.Dendrite
 }
 
 // InputTypingEvent implements api.EDUServerInputAPI
@@ -120,8 +121,8 @@ func (t *EDUServerInputAPI) sendToDeviceEvent(ise *api.InputSendToDeviceEvent) e
 	// device. If the event isn't targeted locally then we can't expand the
 	// wildcard as we don't know about the remote devices, so instead we leave it
 	// as-is, so that the federation sender can send it on with the wildcard intact.
-	if domain == t.ServerName && ise.DeviceID == "*" {
-		devs, err := t.DeviceDB.GetDevicesByLocalpart(context.TODO(), localpart)
+	if t.Cfg.IsLocalServerName(domain) && ise.DeviceID == "*" {
+		devs, err := t.DeviceDB.GetDevicesByLocalpart(context.TODO(), localpart, domain)
 		if err != nil {
 			return err
 		}
@@ -25,7 +25,10 @@ import (
 	// TODO: Are we really wanting to pull in the producer from clientapi
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/federationapi/routing"
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // SetupFederationAPIComponent sets up and registers HTTP handlers for the
@@ -43,9 +46,15 @@ func SetupFederationAPIComponent(
 ) {
 	roomserverProducer := producers.NewRoomserverProducer(rsAPI)
 
+	federationAPIDB, err := storage.NewDatabase(string(base.Cfg.Database.FederationAPI), base.Cfg.DbProperties())
+	if err != nil {
+		logrus.WithError(err).Panic("failed to connect to federation api db")
+	}
+	txnCache := transactions.NewPersistentCache(federationAPIDB, transactions.DefaultRetention)
+
 	routing.Setup(
 		base.PublicAPIMux, base.Cfg, rsAPI, asAPI, roomserverProducer,
 		eduProducer, federationSenderAPI, *keyRing,
-		federation, accountsDB, deviceDB,
+		federation, accountsDB, deviceDB, txnCache, federationAPIDB,
 	)
 }
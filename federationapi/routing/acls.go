@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// isServerBannedFromRoom asks the roomserver whether the server is denied by
+// the m.room.server_acl event in the current state of the room.
+func isServerBannedFromRoom(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI,
+	roomID string, serverName gomatrixserverlib.ServerName,
+) (bool, error) {
+	req := api.QueryServerBannedFromRoomRequest{
+		RoomID:      roomID,
+		ServerNames: []gomatrixserverlib.ServerName{serverName},
+	}
+	res := api.QueryServerBannedFromRoomResponse{}
+	if err := rsAPI.QueryServerBannedFromRoom(ctx, &req, &res); err != nil {
+		return false, err
+	}
+	return len(res.BannedServers) > 0, nil
+}
+
+// checkServerNotBanned returns an error response if the origin of the request
+// is denied by the server ACL of the room.
+func checkServerNotBanned(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI,
+	roomID string, origin gomatrixserverlib.ServerName,
+) *util.JSONResponse {
+	banned, err := isServerBannedFromRoom(ctx, rsAPI, roomID, origin)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryServerBannedFromRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if banned {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Server is banned from the room by the server ACL"),
+		}
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -50,6 +51,9 @@ func Backfill(
 			JSON: jsonerror.MissingArgument("Bad room ID: " + err.Error()),
 		}
 	}
+	if resErr := checkServerNotBanned(httpReq.Context(), rsAPI, roomID, request.Origin()); resErr != nil {
+		return *resErr
+	}
 
 	// Check if all of the required parameters are there.
 	eIDs, exists = httpReq.URL.Query()["v"]
@@ -117,7 +121,7 @@ func Backfill(
 	}
 
 	txn := gomatrixserverlib.Transaction{
-		Origin:         cfg.Matrix.ServerName,
+		Origin:         internal.LocalServerNameForRequest(cfg, httpReq),
 		PDUs:           eventJSONs,
 		OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
 	}
@@ -28,7 +28,7 @@ func GetUserDevices(
 	deviceDB devices.Database,
 	userID string,
 ) util.JSONResponse {
-	localpart, err := userutil.ParseUsernameParam(userID, nil)
+	localpart, serverName, err := userutil.ParseUsernameParam(userID, nil)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -43,7 +43,7 @@ func GetUserDevices(
 		StreamID: 0,
 	}
 
-	devs, err := deviceDB.GetDevicesByLocalpart(req.Context(), localpart)
+	devs, err := deviceDB.GetDevicesByLocalpart(req.Context(), localpart, serverName)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDevicesByLocalPart failed")
 		return jsonerror.InternalServerError()
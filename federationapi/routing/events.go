@@ -37,6 +37,9 @@ func GetEvent(
 	if err != nil {
 		return *err
 	}
+	if err = checkServerNotBanned(ctx, rsAPI, event.RoomID(), request.Origin()); err != nil {
+		return *err
+	}
 
 	return util.JSONResponse{Code: http.StatusOK, JSON: gomatrixserverlib.Transaction{
 		Origin:         origin,
@@ -49,6 +52,8 @@ func GetEvent(
 
 // getEvent returns the requested event,
 // otherwise it returns an error response which can be sent to the client.
+// It doesn't check the server ACL of the event's room, which is up to the
+// caller.
 func getEvent(
 	ctx context.Context,
 	request *gomatrixserverlib.FederationRequest,
@@ -0,0 +1,267 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// How many times an event is retried if processing it fails because of a
+// temporary problem on our side, e.g. the roomserver being unavailable, and
+// how long to wait before the first retry. The wait doubles every time.
+const (
+	inboundEventMaxRetries = 5
+	inboundEventRetryDelay = time.Second
+)
+
+// errInboundQueueFull is returned when a transaction can't be accepted because
+// too many events are already waiting to be processed. The origin will retry
+// the transaction later.
+var errInboundQueueFull = errors.New("too many inbound events are waiting to be processed")
+
+// inboundQueue processes the events from inbound transactions in the
+// background. The events for each room are processed in the order in which
+// they arrived, one room at a time per worker, so that a room that needs us
+// to fetch missing events or state can't hold up the other rooms or the
+// remote server's queue. Events are stored in the database until they have
+// been processed, so that accepted events aren't lost on restart.
+type inboundQueue struct {
+	db storage.Database
+	// workers limits how many rooms are processed at once.
+	workers chan struct{}
+	// maxQueued limits how many events can be waiting to be processed.
+	maxQueued int
+	// processEvent processes a single event from a transaction.
+	processEvent func(t *txnReq, e gomatrixserverlib.Event) error
+	mutex        sync.Mutex // protects the below
+	// queued is the number of events accepted but not processed yet.
+	queued int
+	// rooms holds the tasks waiting to be processed for each room. A room is
+	// present while a goroutine is processing it, even if nothing is waiting.
+	rooms       map[string][]*inboundTask
+	originLocks map[gomatrixserverlib.ServerName]*originLock
+}
+
+// inboundTask is the events for a room from a single transaction, along with
+// the NIDs that they are stored under.
+type inboundTask struct {
+	txn       *txnReq
+	events    []gomatrixserverlib.HeaderedEvent
+	eventNIDs []int64
+}
+
+type originLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newInboundQueue(db storage.Database, maxConcurrentRooms, maxQueuedEvents int) *inboundQueue {
+	return &inboundQueue{
+		db:        db,
+		workers:   make(chan struct{}, maxConcurrentRooms),
+		maxQueued: maxQueuedEvents,
+		processEvent: func(t *txnReq, e gomatrixserverlib.Event) error {
+			return t.processEvent(e, true)
+		},
+		rooms:       make(map[string][]*inboundTask),
+		originLocks: make(map[gomatrixserverlib.ServerName]*originLock),
+	}
+}
+
+// lockOrigin waits until no other transaction from the origin is being
+// handled, so that a retried transaction can't be handled at the same time
+// as the original. The returned function must be called to unlock it.
+func (q *inboundQueue) lockOrigin(origin gomatrixserverlib.ServerName) func() {
+	q.mutex.Lock()
+	lock, ok := q.originLocks[origin]
+	if !ok {
+		lock = &originLock{}
+		q.originLocks[origin] = lock
+	}
+	lock.refs++
+	q.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(q.originLocks, origin)
+		}
+	}
+}
+
+// enqueue stores the events from the transaction and queues them to be
+// processed in the background, after any events already queued for the same
+// rooms. Returns errInboundQueueFull if there isn't room for the events.
+func (q *inboundQueue) enqueue(t *txnReq, events []gomatrixserverlib.HeaderedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	q.mutex.Lock()
+	if q.queued+len(events) > q.maxQueued {
+		q.mutex.Unlock()
+		return errInboundQueueFull
+	}
+	q.queued += len(events)
+	q.mutex.Unlock()
+
+	eventNIDs, err := q.db.StoreInboundEvents(t.context, t.Origin, t.TransactionID, events)
+	if err != nil {
+		q.mutex.Lock()
+		q.queued -= len(events)
+		q.mutex.Unlock()
+		return err
+	}
+	q.add(t, events, eventNIDs)
+	return nil
+}
+
+// restore queues the events which were stored but not processed before we
+// last stopped. The template provides everything except the transaction
+// details, which come from the stored events.
+func (q *inboundQueue) restore(template *txnReq) error {
+	stored, err := q.db.GetInboundEvents(template.context)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(stored); {
+		// Events from the same transaction were stored together.
+		t := template.forBackground()
+		t.Origin = stored[i].Origin
+		t.TransactionID = stored[i].TransactionID
+		var events []gomatrixserverlib.HeaderedEvent
+		var eventNIDs []int64
+		for ; i < len(stored) && stored[i].Origin == t.Origin && stored[i].TransactionID == t.TransactionID; i++ {
+			events = append(events, stored[i].Event)
+			eventNIDs = append(eventNIDs, stored[i].NID)
+		}
+		q.mutex.Lock()
+		q.queued += len(events)
+		q.mutex.Unlock()
+		q.add(t, events, eventNIDs)
+	}
+	if len(stored) > 0 {
+		util.GetLogger(template.context).Infof("Restored %d unprocessed inbound events", len(stored))
+	}
+	return nil
+}
+
+// add queues stored events to be processed, split up by room.
+func (q *inboundQueue) add(t *txnReq, events []gomatrixserverlib.HeaderedEvent, eventNIDs []int64) {
+	var roomIDs []string
+	byRoom := make(map[string]*inboundTask)
+	for i, e := range events {
+		roomID := e.RoomID()
+		task, ok := byRoom[roomID]
+		if !ok {
+			roomIDs = append(roomIDs, roomID)
+			task = &inboundTask{txn: t.forBackground()}
+			byRoom[roomID] = task
+		}
+		task.events = append(task.events, e)
+		task.eventNIDs = append(task.eventNIDs, eventNIDs[i])
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, roomID := range roomIDs {
+		tasks, running := q.rooms[roomID]
+		q.rooms[roomID] = append(tasks, byRoom[roomID])
+		if !running {
+			go q.processRoom(roomID)
+		}
+	}
+}
+
+// processRoom processes the tasks queued for the room in order until there
+// are none left. A worker is only held while a task is being processed, so
+// that a busy room can't starve the others.
+func (q *inboundQueue) processRoom(roomID string) {
+	for {
+		q.mutex.Lock()
+		tasks := q.rooms[roomID]
+		if len(tasks) == 0 {
+			delete(q.rooms, roomID)
+			q.mutex.Unlock()
+			return
+		}
+		task := tasks[0]
+		q.rooms[roomID] = tasks[1:]
+		q.mutex.Unlock()
+
+		q.workers <- struct{}{}
+		q.processTask(task)
+		<-q.workers
+	}
+}
+
+func (q *inboundQueue) processTask(task *inboundTask) {
+	logger := util.GetLogger(task.txn.context).WithField("txn_id", task.txn.TransactionID)
+	for i, e := range task.events {
+		delay := inboundEventRetryDelay
+		for attempt := 0; ; attempt++ {
+			err := q.processEvent(task.txn, e.Unwrap())
+			if err == nil {
+				break
+			}
+			// Errors caused by the event itself won't go away by retrying, so
+			// the event is skipped, as it would have been if the transaction
+			// had been processed synchronously.
+			if !isProcessingErrorFatal(err) || attempt >= inboundEventMaxRetries {
+				logger.WithError(err).WithField("event_id", e.EventID()).Warn("Failed to process incoming federation event, skipping")
+				break
+			}
+			logger.WithError(err).WithField("event_id", e.EventID()).Warnf("Processing failed, retrying in %s", delay)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		// The event won't be tried again, so it no longer needs storing.
+		if err := q.db.DeleteInboundEvent(task.txn.context, task.eventNIDs[i]); err != nil {
+			logger.WithError(err).WithField("event_id", e.EventID()).Error("Failed to delete processed inbound event")
+		}
+		q.mutex.Lock()
+		q.queued--
+		q.mutex.Unlock()
+	}
+}
+
+// forBackground returns a copy of the transaction for processing some of
+// its events in the background. It has its own caches of events, since the
+// rooms in a transaction are processed concurrently, and a context which
+// isn't cancelled when the HTTP request finishes.
+func (t *txnReq) forBackground() *txnReq {
+	return &txnReq{
+		Transaction: t.Transaction,
+		context:     context.Background(),
+		cfg:         t.cfg,
+		rsAPI:       t.rsAPI,
+		producer:    t.producer,
+		eduProducer: t.eduProducer,
+		keys:        t.keys,
+		federation:  t.federation,
+		haveEvents:  make(map[string]*gomatrixserverlib.HeaderedEvent),
+		newEvents:   make(map[string]bool),
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationapi/types"
+	"github.com/matrix-org/dendrite/internal/transactions"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// testTxnStorage is an in-memory transactions.Storage.
+type testTxnStorage struct {
+	sync.Mutex
+	responses map[string]*util.JSONResponse
+}
+
+func (s *testTxnStorage) InsertTransaction(
+	ctx context.Context, scope, txnID string, res *util.JSONResponse, addedAt time.Time,
+) error {
+	s.Lock()
+	defer s.Unlock()
+	s.responses[scope+" "+txnID] = res
+	return nil
+}
+
+func (s *testTxnStorage) SelectTransaction(ctx context.Context, scope, txnID string) (*util.JSONResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.responses[scope+" "+txnID], nil
+}
+
+func (s *testTxnStorage) DeleteTransactionsBefore(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+// testDatabase is an in-memory federation API storage.Database.
+type testDatabase struct {
+	testTxnStorage
+	nextNID int64
+	inbound []types.InboundEvent
+}
+
+func newTestDatabase() *testDatabase {
+	return &testDatabase{
+		testTxnStorage: testTxnStorage{responses: make(map[string]*util.JSONResponse)},
+	}
+}
+
+func (d *testDatabase) StoreInboundEvents(
+	ctx context.Context, origin gomatrixserverlib.ServerName,
+	txnID gomatrixserverlib.TransactionID, events []gomatrixserverlib.HeaderedEvent,
+) ([]int64, error) {
+	d.Lock()
+	defer d.Unlock()
+	eventNIDs := make([]int64, len(events))
+	for i, e := range events {
+		d.nextNID++
+		eventNIDs[i] = d.nextNID
+		d.inbound = append(d.inbound, types.InboundEvent{
+			NID: d.nextNID, Origin: origin, TransactionID: txnID, Event: e,
+		})
+	}
+	return eventNIDs, nil
+}
+
+func (d *testDatabase) GetInboundEvents(ctx context.Context) ([]types.InboundEvent, error) {
+	d.Lock()
+	defer d.Unlock()
+	return append([]types.InboundEvent(nil), d.inbound...), nil
+}
+
+func (d *testDatabase) DeleteInboundEvent(ctx context.Context, eventNID int64) error {
+	d.Lock()
+	defer d.Unlock()
+	for i := range d.inbound {
+		if d.inbound[i].NID == eventNID {
+			d.inbound = append(d.inbound[:i], d.inbound[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (d *testDatabase) inboundCount() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.inbound)
+}
+
+func mustCreateRoomEvent(t *testing.T, roomID string, i int) gomatrixserverlib.HeaderedEvent {
+	eventJSON := fmt.Sprintf(
+		`{"auth_events":[],"content":{},"depth":%d,"event_id":"$%s-%d:kaer.morhen","origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"room_id":%q,"sender":"@userid:kaer.morhen","type":"m.room.message"}`,
+		i, roomID[1:2], i, roomID,
+	)
+	e, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON: %s", err)
+	}
+	return e.Headered(testRoomVersion)
+}
+
+// The purpose of this test is to check that the events for each room are processed in the order in which they
+// arrived, and that no more rooms are processed at once than allowed.
+func TestInboundQueueOrdersEventsPerRoom(t *testing.T) {
+	queue := newInboundQueue(newTestDatabase(), 2, 100)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	processed := map[string][]string{}
+	running, maxRunning := 0, 0
+	queue.processEvent = func(txn *txnReq, e gomatrixserverlib.Event) error {
+		defer wg.Done()
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		running--
+		processed[e.RoomID()] = append(processed[e.RoomID()], e.EventID())
+		mutex.Unlock()
+		return nil
+	}
+
+	roomIDs := []string{"!a:kaer.morhen", "!b:kaer.morhen", "!c:kaer.morhen"}
+	want := map[string][]string{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	for i := 0; i < 4; i++ {
+		var events []gomatrixserverlib.HeaderedEvent
+		for _, roomID := range roomIDs {
+			e := mustCreateRoomEvent(t, roomID, i)
+			events = append(events, e)
+			want[roomID] = append(want[roomID], e.EventID())
+		}
+		wg.Add(len(events))
+		if err := queue.enqueue(txn, events); err != nil {
+			t.Fatalf("enqueue: %s", err)
+		}
+	}
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, roomID := range roomIDs {
+		if fmt.Sprint(processed[roomID]) != fmt.Sprint(want[roomID]) {
+			t.Errorf("room %s: expected events %v, got %v", roomID, want[roomID], processed[roomID])
+		}
+	}
+	if maxRunning > 2 {
+		t.Errorf("expected at most 2 rooms to be processed at once, got %d", maxRunning)
+	}
+}
+
+// The purpose of this test is to check that a transaction is answered before its events are processed, and that a
+// retried transaction gets the same response without its events being processed again.
+func TestTransactionIsProcessedOnce(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				StateEvents:     fromStateTuples(req.StateToFetch, nil),
+			}
+		},
+	}
+	db := newTestDatabase()
+	txnCache := transactions.NewPersistentCache(db, transactions.DefaultRetention)
+	queue := newInboundQueue(db, 1, 100)
+	processed := make(chan string, 2)
+	queue.processEvent = func(txn *txnReq, e gomatrixserverlib.Event) error {
+		err := txn.processEvent(e, true)
+		processed <- e.EventID()
+		return err
+	}
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	txn.queue = queue
+	res := txn.processTransactionOnce(txnCache)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 response, got %d: %v", res.Code, res.JSON)
+	}
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the event to be processed")
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+
+	retry := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	retry.TransactionID = txn.TransactionID
+	retry.queue = queue
+	retryRes := retry.processTransactionOnce(txnCache)
+	if fmt.Sprint(retryRes) != fmt.Sprint(res) {
+		t.Errorf("expected the retried transaction to get the same response, got %+v want %+v", retryRes, res)
+	}
+	select {
+	case eventID := <-processed:
+		t.Errorf("expected the retried transaction not to be processed, but %s was processed again", eventID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// The purpose of this test is to check that events which were accepted but not processed before a restart are
+// processed in order afterwards, and are only deleted once processed.
+func TestInboundQueueRestoresStoredEvents(t *testing.T) {
+	db := newTestDatabase()
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+
+	// The first queue never gets to process anything, as if we stopped.
+	stopped := make(chan struct{})
+	defer close(stopped)
+	first := newInboundQueue(db, 1, 100)
+	first.processEvent = func(txn *txnReq, e gomatrixserverlib.Event) error {
+		<-stopped
+		return nil
+	}
+	var want []string
+	for i := 0; i < 3; i++ {
+		e := mustCreateRoomEvent(t, "!a:kaer.morhen", i)
+		want = append(want, e.EventID())
+		if err := first.enqueue(txn, []gomatrixserverlib.HeaderedEvent{e}); err != nil {
+			t.Fatalf("enqueue: %s", err)
+		}
+	}
+
+	var mutex sync.Mutex
+	var processed []string
+	done := make(chan struct{})
+	second := newInboundQueue(db, 1, 100)
+	second.processEvent = func(txn *txnReq, e gomatrixserverlib.Event) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if txn.Origin != testOrigin {
+			t.Errorf("expected restored event to come from %q, got %q", testOrigin, txn.Origin)
+		}
+		processed = append(processed, e.EventID())
+		if len(processed) == len(want) {
+			close(done)
+		}
+		return nil
+	}
+	if err := second.restore(txn); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the restored events to be processed")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fmt.Sprint(processed) != fmt.Sprint(want) {
+		t.Errorf("expected events %v, got %v", want, processed)
+	}
+	// Events are deleted once processed.
+	for deadline := time.Now().Add(5 * time.Second); db.inboundCount() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := db.inboundCount(); n != 0 {
+		t.Errorf("expected no stored events, got %d", n)
+	}
+}
+
+// The purpose of this test is to check that a transaction is rejected, without storing any of its events, when too
+// many events are waiting to be processed.
+func TestInboundQueueRejectsWhenFull(t *testing.T) {
+	db := newTestDatabase()
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	blocked := make(chan struct{})
+	defer close(blocked)
+	queue := newInboundQueue(db, 1, 2)
+	queue.processEvent = func(txn *txnReq, e gomatrixserverlib.Event) error {
+		<-blocked
+		return nil
+	}
+
+	events := []gomatrixserverlib.HeaderedEvent{
+		mustCreateRoomEvent(t, "!a:kaer.morhen", 0),
+		mustCreateRoomEvent(t, "!b:kaer.morhen", 0),
+	}
+	if err := queue.enqueue(txn, events); err != nil {
+		t.Fatalf("enqueue: %s", err)
+	}
+	err := queue.enqueue(txn, []gomatrixserverlib.HeaderedEvent{mustCreateRoomEvent(t, "!c:kaer.morhen", 0)})
+	if err != errInboundQueueFull {
+		t.Fatalf("expected errInboundQueueFull, got %v", err)
+	}
+	if n := db.inboundCount(); n != len(events) {
+		t.Errorf("expected %d stored events, got %d", len(events), n)
+	}
+}
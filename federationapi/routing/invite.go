@@ -92,10 +92,30 @@ func Invite(
 		}
 	}
 
-	// Sign the event so that other servers will know that we have received the invite.
-	signedEvent := event.Sign(
-		string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
-	)
+	// Check that the invite is for one of our users, and sign it with the key
+	// for their server name so that other servers will know that we have
+	// received the invite.
+	if event.StateKey() == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The invite event must have a state key"),
+		}
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', *event.StateKey())
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The invite event's state key must be a user ID"),
+		}
+	}
+	keyID, privateKey, ok := cfg.SigningIdentityFor(domain)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Domain %q does not match this server", domain)),
+		}
+	}
+	signedEvent := event.Sign(string(domain), keyID, privateKey)
 
 	// Add the invite event to the roomserver.
 	if err = producer.SendInvite(
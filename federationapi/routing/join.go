@@ -38,6 +38,13 @@ func MakeJoin(
 	roomID, userID string,
 	remoteVersions []gomatrixserverlib.RoomVersion,
 ) util.JSONResponse {
+	if resErr := checkRoomNotBlocked(httpReq, rsAPI, roomID); resErr != nil {
+		return *resErr
+	}
+	if resErr := checkServerNotBanned(httpReq.Context(), rsAPI, roomID, request.Origin()); resErr != nil {
+		return *resErr
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
@@ -148,6 +155,13 @@ func SendJoin(
 	keys gomatrixserverlib.KeyRing,
 	roomID, eventID string,
 ) util.JSONResponse {
+	if resErr := checkRoomNotBlocked(httpReq, rsAPI, roomID); resErr != nil {
+		return *resErr
+	}
+	if resErr := checkServerNotBanned(httpReq.Context(), rsAPI, roomID, request.Origin()); resErr != nil {
+		return *resErr
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
@@ -265,14 +279,15 @@ func SendJoin(
 
 	// Send the events to the room server.
 	// We are responsible for notifying other servers that the user has joined
-	// the room, so set SendAsServer to cfg.Matrix.ServerName
+	// the room, so set SendAsServer to the server name that the request was
+	// sent to
 	if !alreadyJoined {
 		_, err = producer.SendEvents(
 			httpReq.Context(),
 			[]gomatrixserverlib.HeaderedEvent{
 				event.Headered(stateAndAuthChainResponse.RoomVersion),
 			},
-			cfg.Matrix.ServerName,
+			internal.LocalServerNameForRequest(cfg, httpReq),
 			nil,
 		)
 		if err != nil {
@@ -293,7 +308,7 @@ func SendJoin(
 		JSON: gomatrixserverlib.RespSendJoin{
 			StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateAndAuthChainResponse.StateEvents),
 			AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateAndAuthChainResponse.AuthChainEvents),
-			Origin:      cfg.Matrix.ServerName,
+			Origin:      internal.LocalServerNameForRequest(cfg, httpReq),
 		},
 	}
 }
@@ -309,3 +324,24 @@ func (e eventsByDepth) Swap(i, j int) {
 func (e eventsByDepth) Less(i, j int) bool {
 	return e[i].Depth() < e[j].Depth()
 }
+
+// checkRoomNotBlocked returns an error response if the room has been blocked
+// by an admin, so that remote servers can't join it through us.
+func checkRoomNotBlocked(
+	httpReq *http.Request, rsAPI api.RoomserverInternalAPI, roomID string,
+) *util.JSONResponse {
+	blockedReq := api.QueryRoomBlockedRequest{RoomID: roomID}
+	blockedRes := api.QueryRoomBlockedResponse{}
+	if err := rsAPI.QueryRoomBlocked(httpReq.Context(), &blockedReq, &blockedRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryRoomBlocked failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if blockedRes.Blocked {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This room has been blocked on this server"),
+		}
+	}
+	return nil
+}
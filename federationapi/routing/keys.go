@@ -16,6 +16,7 @@ package routing
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -25,25 +26,31 @@ import (
 	"golang.org/x/crypto/ed25519"
 )
 
-// LocalKeys returns the local keys for the server.
+// LocalKeys returns the local keys for the given local server name, which is
+// either the main server name or one of the virtual hosts.
 // See https://matrix.org/docs/spec/server_server/unstable.html#publishing-keys
-func LocalKeys(cfg *config.Dendrite) util.JSONResponse {
-	keys, err := localKeys(cfg, time.Now().Add(cfg.Matrix.KeyValidityPeriod))
+func LocalKeys(cfg *config.Dendrite, serverName gomatrixserverlib.ServerName) util.JSONResponse {
+	keys, err := localKeys(cfg, serverName, time.Now().Add(cfg.Matrix.KeyValidityPeriod))
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
 	return util.JSONResponse{Code: http.StatusOK, JSON: keys}
 }
 
-func localKeys(cfg *config.Dendrite, validUntil time.Time) (*gomatrixserverlib.ServerKeys, error) {
+func localKeys(cfg *config.Dendrite, serverName gomatrixserverlib.ServerName, validUntil time.Time) (*gomatrixserverlib.ServerKeys, error) {
 	var keys gomatrixserverlib.ServerKeys
 
-	keys.ServerName = cfg.Matrix.ServerName
+	keyID, privateKey, ok := cfg.SigningIdentityFor(serverName)
+	if !ok {
+		return nil, fmt.Errorf("server name %q is not hosted here", serverName)
+	}
+
+	keys.ServerName = serverName
 
-	publicKey := cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
 
 	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
-		cfg.Matrix.KeyID: {
+		keyID: {
 			Key: gomatrixserverlib.Base64Bytes(publicKey),
 		},
 	}
@@ -58,7 +65,7 @@ func localKeys(cfg *config.Dendrite, validUntil time.Time) (*gomatrixserverlib.S
 	}
 
 	keys.Raw, err = gomatrixserverlib.SignJSON(
-		string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, toSign,
+		string(serverName), keyID, privateKey, toSign,
 	)
 	if err != nil {
 		return nil, err
@@ -193,13 +193,14 @@ func SendLeave(
 
 	// Send the events to the room server.
 	// We are responsible for notifying other servers that the user has left
-	// the room, so set SendAsServer to cfg.Matrix.ServerName
+	// the room, so set SendAsServer to the server name that the request was
+	// sent to
 	_, err = producer.SendEvents(
 		httpReq.Context(),
 		[]gomatrixserverlib.HeaderedEvent{
 			event.Headered(verRes.RoomVersion),
 		},
-		cfg.Matrix.ServerName,
+		internal.LocalServerNameForRequest(cfg, httpReq),
 		nil,
 	)
 	if err != nil {
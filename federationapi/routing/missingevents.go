@@ -37,6 +37,10 @@ func GetMissingEvents(
 	rsAPI api.RoomserverInternalAPI,
 	roomID string,
 ) util.JSONResponse {
+	if resErr := checkServerNotBanned(httpReq.Context(), rsAPI, roomID, request.Origin()); resErr != nil {
+		return *resErr
+	}
+
 	var gme getMissingEventRequest
 	if err := json.Unmarshal(request.Content(), &gme); err != nil {
 		return util.JSONResponse{
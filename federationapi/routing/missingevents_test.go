@@ -0,0 +1,434 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	testAlice = "@alice:kaer.morhen"
+	testBob   = "@bob:kaer.morhen"
+)
+
+// testRoom builds the full history of a room, which a testRemoteServer serves over federation.
+type testRoom struct {
+	t          *testing.T
+	roomID     string
+	key        ed25519.PrivateKey
+	events     map[string]*gomatrixserverlib.HeaderedEvent
+	stateAfter map[string]map[gomatrixserverlib.StateKeyTuple]string // event ID to state event IDs
+	latest     gomatrixserverlib.HeaderedEvent
+}
+
+// newTestRoom creates a room which alice has created and joined, and which anyone can join.
+func newTestRoom(t *testing.T) *testRoom {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %s", err)
+	}
+	r := &testRoom{
+		t:          t,
+		roomID:     "!gaps:kaer.morhen",
+		key:        key,
+		events:     make(map[string]*gomatrixserverlib.HeaderedEvent),
+		stateAfter: make(map[string]map[gomatrixserverlib.StateKeyTuple]string),
+	}
+	emptyStateKey, aliceStateKey := "", testAlice
+	r.addEvent(testAlice, gomatrixserverlib.MRoomCreate, &emptyStateKey, map[string]interface{}{"creator": testAlice})
+	r.addEvent(testAlice, gomatrixserverlib.MRoomMember, &aliceStateKey, map[string]interface{}{"membership": "join"}, r.latest)
+	r.addEvent(testAlice, gomatrixserverlib.MRoomPowerLevels, &emptyStateKey, map[string]interface{}{"users": map[string]int{testAlice: 100}}, r.latest)
+	r.addEvent(testAlice, gomatrixserverlib.MRoomJoinRules, &emptyStateKey, map[string]interface{}{"join_rule": "public"}, r.latest)
+	return r
+}
+
+// stateBefore returns the state after all of the prev events. Where they disagree the deepest event wins, which is
+// good enough as long as the tests don't create conflicts.
+func (r *testRoom) stateBefore(prevEventIDs []string) map[gomatrixserverlib.StateKeyTuple]string {
+	state := make(map[gomatrixserverlib.StateKeyTuple]string)
+	for _, prevEventID := range prevEventIDs {
+		for tuple, eventID := range r.stateAfter[prevEventID] {
+			if existing, ok := state[tuple]; ok && r.events[existing].Depth() > r.events[eventID].Depth() {
+				continue
+			}
+			state[tuple] = eventID
+		}
+	}
+	return state
+}
+
+func (r *testRoom) addEvent(
+	sender, eventType string, stateKey *string, content interface{}, prevs ...gomatrixserverlib.HeaderedEvent,
+) gomatrixserverlib.HeaderedEvent {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   r.roomID,
+		Type:     eventType,
+		StateKey: stateKey,
+		Depth:    1,
+	}
+	if err := builder.SetContent(content); err != nil {
+		r.t.Fatalf("builder.SetContent: %s", err)
+	}
+	prevRefs := []gomatrixserverlib.EventReference{}
+	var prevEventIDs []string
+	for _, prev := range prevs {
+		prevRefs = append(prevRefs, prev.EventReference())
+		prevEventIDs = append(prevEventIDs, prev.EventID())
+		if prev.Depth() >= builder.Depth {
+			builder.Depth = prev.Depth() + 1
+		}
+	}
+	builder.PrevEvents = prevRefs
+	stateBefore := r.stateBefore(prevEventIDs)
+	needed, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+	if err != nil {
+		r.t.Fatalf("StateNeededForEventBuilder: %s", err)
+	}
+	authRefs := []gomatrixserverlib.EventReference{}
+	for _, tuple := range needed.Tuples() {
+		if eventID, ok := stateBefore[tuple]; ok {
+			authRefs = append(authRefs, r.events[eventID].EventReference())
+		}
+	}
+	builder.AuthEvents = authRefs
+	ev, err := builder.Build(time.Now(), testOrigin, "ed25519:auto", r.key, testRoomVersion)
+	if err != nil {
+		r.t.Fatalf("builder.Build: %s", err)
+	}
+	h := ev.Headered(testRoomVersion)
+	r.events[h.EventID()] = &h
+	if stateKey != nil {
+		stateBefore[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: *stateKey}] = h.EventID()
+	}
+	r.stateAfter[h.EventID()] = stateBefore
+	r.latest = h
+	return h
+}
+
+func (r *testRoom) addMessages(n int) (events []gomatrixserverlib.HeaderedEvent) {
+	for i := 0; i < n; i++ {
+		events = append(events, r.addEvent(testAlice, "m.room.message", nil, map[string]interface{}{"body": "hello"}, r.latest))
+	}
+	return
+}
+
+func (r *testRoom) authChain(eventIDs []string) (authEventIDs []string) {
+	seen := make(map[string]bool)
+	queue := append([]string{}, eventIDs...)
+	for len(queue) > 0 {
+		eventID := queue[0]
+		queue = queue[1:]
+		for _, authEventID := range r.events[eventID].AuthEventIDs() {
+			if !seen[authEventID] {
+				seen[authEventID] = true
+				authEventIDs = append(authEventIDs, authEventID)
+				queue = append(queue, authEventID)
+			}
+		}
+	}
+	return
+}
+
+// testRemoteServer answers federation requests about a testRoom, like the remote server would.
+type testRemoteServer struct {
+	room                  *testRoom
+	failMissingEvents     bool
+	missingEventsRequests []gomatrixserverlib.MissingEvents
+	fetchedEventIDs       []string
+}
+
+func (s *testRemoteServer) LookupState(ctx context.Context, _ gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+	res gomatrixserverlib.RespState, err error,
+) {
+	stateIDs, err := s.LookupStateIDs(ctx, testOrigin, roomID, eventID)
+	if err != nil {
+		return
+	}
+	for _, stateEventID := range stateIDs.StateEventIDs {
+		res.StateEvents = append(res.StateEvents, s.room.events[stateEventID].Unwrap())
+	}
+	for _, authEventID := range stateIDs.AuthEventIDs {
+		res.AuthEvents = append(res.AuthEvents, s.room.events[authEventID].Unwrap())
+	}
+	return
+}
+
+func (s *testRemoteServer) LookupStateIDs(ctx context.Context, _ gomatrixserverlib.ServerName, roomID string, eventID string) (
+	res gomatrixserverlib.RespStateIDs, err error,
+) {
+	ev, ok := s.room.events[eventID]
+	if !ok {
+		return res, fmt.Errorf("testRemoteServer: unknown event %s", eventID)
+	}
+	for _, stateEventID := range s.room.stateBefore(ev.PrevEventIDs()) {
+		res.StateEventIDs = append(res.StateEventIDs, stateEventID)
+	}
+	res.AuthEventIDs = s.room.authChain(res.StateEventIDs)
+	return
+}
+
+func (s *testRemoteServer) GetEvent(ctx context.Context, _ gomatrixserverlib.ServerName, eventID string) (
+	res gomatrixserverlib.Transaction, err error,
+) {
+	ev, ok := s.room.events[eventID]
+	if !ok {
+		return res, fmt.Errorf("testRemoteServer: unknown event %s", eventID)
+	}
+	s.fetchedEventIDs = append(s.fetchedEventIDs, eventID)
+	res.PDUs = []json.RawMessage{ev.JSON()}
+	return
+}
+
+// LookupMissingEvents walks back through the prev_events of the latest events until it reaches the earliest events
+// or min_depth, and returns up to limit of the events closest to the latest events.
+func (s *testRemoteServer) LookupMissingEvents(ctx context.Context, _ gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents,
+	roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespMissingEvents, err error) {
+	s.missingEventsRequests = append(s.missingEventsRequests, missing)
+	if s.failMissingEvents {
+		return res, fmt.Errorf("testRemoteServer: /get_missing_events is unavailable")
+	}
+	seen := make(map[string]bool)
+	for _, eventID := range missing.EarliestEvents {
+		seen[eventID] = true
+	}
+	var queue []string
+	for _, eventID := range missing.LatestEvents {
+		queue = append(queue, s.room.events[eventID].PrevEventIDs()...)
+	}
+	var found []gomatrixserverlib.Event
+	for len(queue) > 0 {
+		eventID := queue[0]
+		queue = queue[1:]
+		ev, ok := s.room.events[eventID]
+		if seen[eventID] || !ok || ev.Depth() < int64(missing.MinDepth) {
+			continue
+		}
+		seen[eventID] = true
+		found = append(found, ev.Unwrap())
+		queue = append(queue, ev.PrevEventIDs()...)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Depth() > found[j].Depth()
+	})
+	if len(found) > missing.Limit {
+		found = found[:missing.Limit]
+	}
+	res.Events = found
+	return
+}
+
+// newTestRoomserverForRoom returns a roomserver which has the given events of the room, and the events which are
+// sent to it. It knows the state after all of them apart from outliers, like a real roomserver.
+func newTestRoomserverForRoom(room *testRoom, have ...gomatrixserverlib.HeaderedEvent) *testRoomserverAPI {
+	var rsAPI *testRoomserverAPI
+	hasEvent := func(eventID string, needState bool) bool {
+		for _, ev := range have {
+			if ev.EventID() == eventID {
+				return true
+			}
+		}
+		for _, ire := range rsAPI.inputRoomEvents {
+			if ire.Event.EventID() == eventID && (!needState || ire.Kind != api.KindOutlier) {
+				return true
+			}
+		}
+		return false
+	}
+	latest := have[len(have)-1]
+	rsAPI = &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			res := api.QueryStateAfterEventsResponse{RoomExists: true}
+			for _, prevEventID := range req.PrevEventIDs {
+				if !hasEvent(prevEventID, true) {
+					return res
+				}
+			}
+			res.PrevEventsExist = true
+			for tuple, eventID := range room.stateBefore(req.PrevEventIDs) {
+				wanted := len(req.StateToFetch) == 0
+				for _, wantTuple := range req.StateToFetch {
+					wanted = wanted || wantTuple == tuple
+				}
+				if wanted {
+					res.StateEvents = append(res.StateEvents, *room.events[eventID])
+				}
+			}
+			return res
+		},
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) (res api.QueryEventsByIDResponse) {
+			for _, eventID := range req.EventIDs {
+				if hasEvent(eventID, false) {
+					res.Events = append(res.Events, *room.events[eventID])
+				}
+			}
+			return
+		},
+		queryLatestEventsAndState: func(req *api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse {
+			return api.QueryLatestEventsAndStateResponse{
+				RoomExists:   true,
+				Depth:        latest.Depth(),
+				LatestEvents: []gomatrixserverlib.EventReference{latest.EventReference()},
+			}
+		},
+	}
+	return rsAPI
+}
+
+func eventsUpToDepth(room *testRoom, depth int64) (events []gomatrixserverlib.HeaderedEvent) {
+	for _, ev := range room.events {
+		if ev.Depth() <= depth {
+			events = append(events, *ev)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Depth() < events[j].Depth()
+	})
+	return
+}
+
+func assertStoredWithState(t *testing.T, ire api.InputRoomEvent, wantState ...gomatrixserverlib.HeaderedEvent) {
+	if ire.Kind != api.KindNew || !ire.HasState {
+		t.Errorf("expected event %s to be stored with state, got kind %d has_state %v", ire.Event.EventID(), ire.Kind, ire.HasState)
+	}
+	for _, want := range wantState {
+		found := false
+		for _, stateEventID := range ire.StateEventIDs {
+			found = found || stateEventID == want.EventID()
+		}
+		if !found {
+			t.Errorf("expected the state at event %s to contain %s, got %v", ire.Event.EventID(), want.EventID(), ire.StateEventIDs)
+		}
+	}
+}
+
+func assertFetchedEvents(t *testing.T, got []string, want ...gomatrixserverlib.HeaderedEvent) {
+	var wantIDs []string
+	for _, ev := range want {
+		wantIDs = append(wantIDs, ev.EventID())
+	}
+	sort.Strings(got)
+	sort.Strings(wantIDs)
+	if fmt.Sprint(got) != fmt.Sprint(wantIDs) {
+		t.Errorf("expected /event to be called for %v, got %v", wantIDs, got)
+	}
+}
+
+// The purpose of this test is to check that when the gap is bigger than the /get_missing_events limit, the events
+// which were returned are processed, and the earliest of them is stored with the state from /state_ids, fetching
+// only the events which we don't have.
+func TestGetMissingEventsGapBiggerThanLimit(t *testing.T) {
+	room := newTestRoom(t)
+	room.addMessages(21) // up to depth 25
+	rsAPI := newTestRoomserverForRoom(room, eventsUpToDepth(room, 25)...)
+	room.addMessages(4)
+	topic := room.addEvent(testAlice, "m.room.topic", new(string), map[string]interface{}{"topic": "gaps"}, room.latest)
+	gap := room.addMessages(30) // up to depth 60
+	remote := &testRemoteServer{room: room}
+
+	txn := mustCreateTransaction(rsAPI, remote, []json.RawMessage{room.latest.JSON()})
+	mustProcessTransaction(t, txn, nil)
+
+	if len(remote.missingEventsRequests) != 1 {
+		t.Fatalf("expected 1 call to /get_missing_events, got %d", len(remote.missingEventsRequests))
+	}
+	if req := remote.missingEventsRequests[0]; req.Limit != missingEventsLimit || req.MinDepth != 25-missingEventsMaxDepth {
+		t.Errorf("expected /get_missing_events with limit %d and min_depth %d, got %d and %d", missingEventsLimit, 25-missingEventsMaxDepth, req.Limit, req.MinDepth)
+	}
+	// The last 20 events before the one we were sent are returned, so the earliest of them (depth 40) is missing its
+	// prev_event, and the topic is fetched as part of the state before it.
+	earliest := gap[len(gap)-21]
+	wantEvents := append([]gomatrixserverlib.HeaderedEvent{topic}, gap[len(gap)-21:]...)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, wantEvents)
+	if len(rsAPI.inputRoomEvents) != len(wantEvents) {
+		return
+	}
+	if rsAPI.inputRoomEvents[0].Kind != api.KindOutlier {
+		t.Errorf("expected the topic to be stored as an outlier, got kind %d", rsAPI.inputRoomEvents[0].Kind)
+	}
+	assertStoredWithState(t, rsAPI.inputRoomEvents[1], topic)
+	for _, ire := range rsAPI.inputRoomEvents[2:] {
+		if ire.Kind != api.KindNew || ire.HasState {
+			t.Errorf("expected event %s to be stored without state, got kind %d has_state %v", ire.Event.EventID(), ire.Kind, ire.HasState)
+		}
+	}
+	assertFetchedEvents(t, remote.fetchedEventIDs, topic, *room.events[earliest.PrevEventIDs()[0]])
+}
+
+// The purpose of this test is to check that if /get_missing_events fails then the event is stored with the state
+// before it from /state_ids, rather than being rejected.
+func TestGetMissingEventsFailureFallsBackToStateIDs(t *testing.T) {
+	room := newTestRoom(t)
+	room.addMessages(1)
+	rsAPI := newTestRoomserverForRoom(room, eventsUpToDepth(room, 5)...)
+	topic := room.addEvent(testAlice, "m.room.topic", new(string), map[string]interface{}{"topic": "gaps"}, room.latest)
+	prev := room.addMessages(1)[0]
+	pushed := room.addMessages(1)[0]
+	remote := &testRemoteServer{room: room, failMissingEvents: true}
+
+	txn := mustCreateTransaction(rsAPI, remote, []json.RawMessage{pushed.JSON()})
+	mustProcessTransaction(t, txn, nil)
+
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{topic, pushed})
+	if len(rsAPI.inputRoomEvents) != 2 {
+		return
+	}
+	assertStoredWithState(t, rsAPI.inputRoomEvents[1], topic)
+	assertFetchedEvents(t, remote.fetchedEventIDs, topic, prev)
+}
+
+// The purpose of this test is to check that the state before an event with several prev_events is worked out by
+// resolving the state after each of them: our own state for the ones we have, and /state_ids for the ones we don't.
+func TestStateIsResolvedAcrossPrevEvents(t *testing.T) {
+	room := newTestRoom(t)
+	fork := room.addMessages(1)[0]
+	bobStateKey := testBob
+	bobJoin := room.addEvent(testBob, gomatrixserverlib.MRoomMember, &bobStateKey, map[string]interface{}{"membership": "join"}, fork)
+	rsAPI := newTestRoomserverForRoom(room, append(eventsUpToDepth(room, 5), bobJoin)...)
+	topic := room.addEvent(testAlice, "m.room.topic", new(string), map[string]interface{}{"topic": "gaps"}, fork)
+	pushed := room.addEvent(testAlice, "m.room.message", nil, map[string]interface{}{"body": "merged"}, topic, bobJoin)
+	remote := &testRemoteServer{room: room}
+
+	txn := mustCreateTransaction(rsAPI, remote, []json.RawMessage{pushed.JSON()})
+	mustProcessTransaction(t, txn, nil)
+
+	// /get_missing_events returns the topic, which we can process as normal since we have its prev_event.
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{topic, pushed})
+
+	// If it doesn't then the state after the topic comes from /state_ids instead.
+	rsAPI = newTestRoomserverForRoom(room, append(eventsUpToDepth(room, 5), bobJoin)...)
+	remote = &testRemoteServer{room: room, failMissingEvents: true}
+	txn = mustCreateTransaction(rsAPI, remote, []json.RawMessage{pushed.JSON()})
+	mustProcessTransaction(t, txn, nil)
+
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{topic, pushed})
+	if len(rsAPI.inputRoomEvents) != 2 {
+		return
+	}
+	if rsAPI.inputRoomEvents[0].Kind != api.KindOutlier {
+		t.Errorf("expected the topic to be stored as an outlier, got kind %d", rsAPI.inputRoomEvents[0].Kind)
+	}
+	assertStoredWithState(t, rsAPI.inputRoomEvents[1], topic, bobJoin)
+	assertFetchedEvents(t, remote.fetchedEventIDs, topic)
+}
@@ -53,12 +53,18 @@ func GetProfile(
 		}
 	}
 
-	if domain != cfg.Matrix.ServerName {
+	if !cfg.IsLocalServerName(domain) {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Domain %q does not match this server", domain)),
 		}
 	}
+	if !cfg.IsAccountServerName(domain) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist or does not have a profile"),
+		}
+	}
 
 	profile, err := appserviceAPI.RetrieveUserProfile(httpReq.Context(), userID, asAPI, accountDB)
 	if err != nil {
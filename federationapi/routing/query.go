@@ -52,7 +52,7 @@ func RoomAliasToID(
 
 	var resp gomatrixserverlib.RespDirectory
 
-	if domain == cfg.Matrix.ServerName {
+	if cfg.IsLocalServerName(domain) {
 		queryReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomAlias}
 		var queryRes roomserverAPI.GetRoomIDForAliasResponse
 		if err = rsAPI.GetRoomIDForAlias(httpReq.Context(), &queryReq, &queryRes); err != nil {
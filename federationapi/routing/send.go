@@ -22,7 +22,9 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -40,9 +42,12 @@ func Send(
 	eduProducer *producers.EDUServerProducer,
 	keys gomatrixserverlib.KeyRing,
 	federation *gomatrixserverlib.FederationClient,
+	txnCache *transactions.PersistentCache,
+	inbound *inboundQueue,
 ) util.JSONResponse {
 	t := txnReq{
 		context:     httpReq.Context(),
+		cfg:         cfg,
 		rsAPI:       rsAPI,
 		producer:    producer,
 		eduProducer: eduProducer,
@@ -50,6 +55,7 @@ func Send(
 		federation:  federation,
 		haveEvents:  make(map[string]*gomatrixserverlib.HeaderedEvent),
 		newEvents:   make(map[string]bool),
+		queue:       inbound,
 	}
 
 	var txnEvents struct {
@@ -69,13 +75,41 @@ func Send(
 	t.EDUs = txnEvents.EDUs
 	t.Origin = request.Origin()
 	t.TransactionID = txnID
-	t.Destination = cfg.Matrix.ServerName
+	t.Destination = internal.LocalServerNameForRequest(cfg, httpReq)
 
 	util.GetLogger(httpReq.Context()).Infof("Received transaction %q containing %d PDUs, %d EDUs", txnID, len(t.PDUs), len(t.EDUs))
 
-	resp, err := t.processTransaction()
+	return t.processTransactionOnce(txnCache)
+}
+
+// processTransactionOnce processes the transaction unless it has been
+// processed before, in which case the response from then is returned. This
+// stops a transaction that the origin retries, e.g. because it didn't get
+// our response, from being processed twice.
+func (t *txnReq) processTransactionOnce(txnCache *transactions.PersistentCache) util.JSONResponse {
+	unlock := t.queue.lockOrigin(t.Origin)
+	defer unlock()
+
+	logger := util.GetLogger(t.context).WithField("txn_id", t.TransactionID)
+	res, ok, err := txnCache.FetchTransaction(t.context, string(t.Origin), string(t.TransactionID))
 	if err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("t.processTransaction failed")
+		logger.WithError(err).Error("txnCache.FetchTransaction failed")
+		return util.ErrorResponse(err)
+	}
+	if ok {
+		logger.Info("Transaction was already processed, returning the previous response")
+		return *res
+	}
+
+	resp, err := t.processTransaction()
+	if err == errInboundQueueFull {
+		logger.WithError(err).Warn("Rejecting transaction")
+		return util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	} else if err != nil {
+		logger.WithError(err).Error("t.processTransaction failed")
 		return util.ErrorResponse(err)
 	}
 
@@ -83,15 +117,22 @@ func Send(
 	// Status code 200:
 	// The result of processing the transaction. The server is to use this response
 	// even in the event of one or more PDUs failing to be processed.
-	return util.JSONResponse{
+	res = &util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: resp,
 	}
+	if err = txnCache.AddTransaction(t.context, string(t.Origin), string(t.TransactionID), res); err != nil {
+		// The events have already been accepted, so the worst that can happen
+		// is that they are processed again if the transaction is retried.
+		logger.WithError(err).Error("txnCache.AddTransaction failed")
+	}
+	return *res
 }
 
 type txnReq struct {
 	gomatrixserverlib.Transaction
 	context     context.Context
+	cfg         *config.Dendrite
 	rsAPI       api.RoomserverInternalAPI
 	producer    *producers.RoomserverProducer
 	eduProducer *producers.EDUServerProducer
@@ -102,6 +143,11 @@ type txnReq struct {
 	haveEvents map[string]*gomatrixserverlib.HeaderedEvent
 	// new events which the roomserver does not know about
 	newEvents map[string]bool
+	// whether the origin is denied by the server ACL, by room ID
+	bannedRooms map[string]bool
+	// the queue to process the events in the background with, or nil to
+	// process them before responding
+	queue *inboundQueue
 }
 
 // A subset of FederationClient functionality that txn requires. Useful for testing.
@@ -145,6 +191,18 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 			}
 			continue
 		}
+		if banned, berr := t.isOriginBanned(event.RoomID()); berr != nil {
+			// We can't tell whether the origin may send into the room, so
+			// fail the transaction and let the origin retry it later.
+			return nil, berr
+		} else if banned {
+			berr = fmt.Errorf("server %q is banned from room %q by the server ACL", t.Origin, event.RoomID())
+			util.GetLogger(t.context).WithError(berr).Warnf("Transaction: Rejecting event %q", event.EventID())
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: berr.Error(),
+			}
+			continue
+		}
 		if err = gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys); err != nil {
 			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
@@ -154,6 +212,24 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 		}
 		pdus = append(pdus, event.Headered(verRes.RoomVersion))
 	}
+	if err := t.lookupTypingACLs(); err != nil {
+		return nil, err
+	}
+
+	if t.queue != nil {
+		// The events have passed the checks that the origin can do anything
+		// about, so accept them now and process them in the background. They
+		// are stored before we respond, so they won't be lost if we restart.
+		if err := t.queue.enqueue(t, pdus); err != nil {
+			return nil, err
+		}
+		for _, e := range pdus {
+			results[e.EventID()] = gomatrixserverlib.PDUResult{}
+		}
+		t.processEDUs(t.EDUs)
+		util.GetLogger(t.context).Infof("Queued %d PDUs from transaction %q", len(pdus), t.TransactionID)
+		return &gomatrixserverlib.RespSend{PDUs: results}, nil
+	}
 
 	// Process the events.
 	for _, e := range pdus {
@@ -248,6 +324,46 @@ func (t *txnReq) haveEventIDs() map[string]bool {
 	return result
 }
 
+// isOriginBanned returns whether the server which sent the transaction is
+// denied by the server ACL of the room. The answer is remembered for the rest
+// of the transaction.
+func (t *txnReq) isOriginBanned(roomID string) (bool, error) {
+	if banned, ok := t.bannedRooms[roomID]; ok {
+		return banned, nil
+	}
+	banned, err := isServerBannedFromRoom(t.context, t.rsAPI, roomID, t.Origin)
+	if err != nil {
+		return false, err
+	}
+	if t.bannedRooms == nil {
+		t.bannedRooms = make(map[string]bool)
+	}
+	t.bannedRooms[roomID] = banned
+	return banned, nil
+}
+
+// lookupTypingACLs looks up the server ACLs of the rooms that the typing
+// notifications in the transaction are for, so that a failed lookup fails
+// the transaction before any of it has been accepted.
+func (t *txnReq) lookupTypingACLs() error {
+	for _, e := range t.EDUs {
+		if e.Type != gomatrixserverlib.MTyping {
+			continue
+		}
+		var typingPayload struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := json.Unmarshal(e.Content, &typingPayload); err != nil {
+			// processEDUs will drop and log this one.
+			continue
+		}
+		if _, err := t.isOriginBanned(typingPayload.RoomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 	for _, e := range edus {
 		switch e.Type {
@@ -262,6 +378,11 @@ func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal typing event")
 				continue
 			}
+			// lookupTypingACLs has already looked this up, so it can't fail.
+			if banned, _ := t.isOriginBanned(typingPayload.RoomID); banned {
+				util.GetLogger(t.context).WithField("room_id", typingPayload.RoomID).Warn("Dropping typing event from server denied by the server ACL")
+				continue
+			}
 			if err := t.eduProducer.SendTyping(t.context, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
 				util.GetLogger(t.context).WithError(err).Error("Failed to send typing event to edu server")
 			}
@@ -272,9 +393,25 @@ func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal send-to-device events")
 				continue
 			}
+			// The sender must belong to the server that sent us the
+			// transaction, otherwise a server could impersonate users on
+			// other servers.
+			_, senderDomain, serr := gomatrixserverlib.SplitID('@', directPayload.Sender)
+			if serr != nil || senderDomain != t.Origin {
+				util.GetLogger(t.context).WithError(serr).WithFields(logrus.Fields{
+					"sender": directPayload.Sender,
+					"origin": t.Origin,
+				}).Warn("Dropping send-to-device events from sender that doesn't belong to the origin")
+				continue
+			}
 			for userID, byUser := range directPayload.Messages {
+				_, userDomain, uerr := gomatrixserverlib.SplitID('@', userID)
+				if uerr != nil || !t.cfg.IsLocalServerName(userDomain) {
+					util.GetLogger(t.context).WithError(uerr).WithField("user_id", userID).Warn("Dropping send-to-device events for user that isn't local")
+					continue
+				}
 				for deviceID, message := range byUser {
-					// TODO: check that the user and the device actually exist here
+					// TODO: check that the device actually exists here
 					if err := t.eduProducer.SendToDevice(t.context, directPayload.Sender, userID, deviceID, directPayload.Type, message); err != nil {
 						util.GetLogger(t.context).WithError(err).WithFields(logrus.Fields{
 							"sender":    directPayload.Sender,
@@ -347,6 +484,15 @@ func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserver
 	return gomatrixserverlib.Allowed(e, &authUsingState)
 }
 
+// How many events we ask for with /get_missing_events, and how far back in
+// the room we go, relative to the depth of the latest events that we have.
+// If the gap is bigger than this then the earliest of the missing events
+// become backwards extremities, stored along with the state before them.
+const (
+	missingEventsLimit    = 20
+	missingEventsMaxDepth = 20
+)
+
 func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion, isInboundTxn bool) error {
 	// We are missing the previous events for this events.
 	// This means that there is a gap in our view of the history of the
@@ -363,47 +509,29 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVer
 	// However not all version of synapse support /state_ids so you may
 	// need to fallback to /state.
 
-	// Attempt to fill in the gap using /get_missing_events
-	// This will either:
-	// - fill in the gap completely then process event `e` returning no backwards extremity
-	// - fail to fill in the gap and tell us to terminate the transaction err=not nil
-	// - fail to fill in the gap and tell us to fetch state at the new backwards extremity, and to not terminate the transaction
-	backwardsExtremity, err := t.getMissingEvents(e, roomVersion, isInboundTxn)
-	if err != nil {
-		return err
-	}
-	if backwardsExtremity == nil {
-		// we filled in the gap!
-		return nil
-	}
-
-	// at this point we know we're going to have a gap: we need to work out the room state at the new backwards extremity.
-	// security: we have to do state resolution on the new backwards extremity (TODO: WHY)
-	// Therefore, we cannot just query /state_ids with this event to get the state before. Instead, we need to query
-	// the state AFTER all the prev_events for this event, then mix in our current room state and apply state resolution
-	// to that to get the state before the event.
-	var states []*gomatrixserverlib.RespState
-	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{*backwardsExtremity}).Tuples()
-	for _, prevEventID := range backwardsExtremity.PrevEventIDs() {
-		var prevState *gomatrixserverlib.RespState
-		prevState, err = t.lookupStateAfterEvent(roomVersion, backwardsExtremity.RoomID(), prevEventID, needed)
+	// Attempt to fill in the gap using /get_missing_events. This is only done
+	// for the events which were pushed to us: the missing events themselves are
+	// processed with isInboundTxn=false, so that we don't spider back through
+	// the whole history of the room one request at a time.
+	if isInboundTxn {
+		filled, err := t.getMissingEvents(e, roomVersion)
 		if err != nil {
-			util.GetLogger(t.context).WithError(err).Errorf("Failed to lookup state after prev_event: %s", prevEventID)
 			return err
 		}
-		states = append(states, prevState)
-	}
-	// mix in the current room state
-	currState, err := t.lookupCurrentState(backwardsExtremity)
-	if err != nil {
-		util.GetLogger(t.context).WithError(err).Errorf("Failed to lookup current room state")
-		return err
+		if filled {
+			return nil
+		}
 	}
-	states = append(states, currState)
-	resolvedState, err := t.resolveStatesAndCheck(roomVersion, states, backwardsExtremity)
+
+	// At this point we know we're going to have a gap, and this event will be a
+	// backwards extremity, so we need to work out the room state before it.
+	resolvedState, err := t.resolveStateBeforeEvent(e, roomVersion)
 	if err != nil {
-		util.GetLogger(t.context).WithError(err).Errorf("Failed to resolve state conflicts for event %s", backwardsExtremity.EventID())
-		return err
+		util.GetLogger(t.context).WithError(err).Errorf("Failed to work out the state before event %s", e.EventID())
+		return missingPrevEventsError{
+			eventID: e.EventID(),
+			err:     err,
+		}
 	}
 
 	// pass the event along with the state to the roomserver using a background context so we don't
@@ -411,11 +539,28 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVer
 	return t.producer.SendEventWithState(context.Background(), resolvedState, e.Headered(roomVersion), t.haveEventIDs())
 }
 
+// resolveStateBeforeEvent returns the room state before the event e.
+// security: we can't just ask the remote server for /state_ids at e, as that would let it tell us anything it likes
+// about the state of the room. Instead the state before e is the resolution of the states after each of its
+// prev_events, and we only ask the remote server for the state after the prev_events that we don't have ourselves.
+func (t *txnReq) resolveStateBeforeEvent(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (*gomatrixserverlib.RespState, error) {
+	var states []*gomatrixserverlib.RespState
+	for _, prevEventID := range e.PrevEventIDs() {
+		prevState, err := t.lookupStateAfterEvent(roomVersion, e.RoomID(), prevEventID)
+		if err != nil {
+			util.GetLogger(t.context).WithError(err).Errorf("Failed to lookup state after prev_event: %s", prevEventID)
+			return nil, err
+		}
+		states = append(states, prevState)
+	}
+	return t.resolveStatesAndCheck(roomVersion, states, &e)
+}
+
 // lookupStateAfterEvent returns the room state after `eventID`, which is the state before eventID with the state of `eventID` (if it's a state event)
 // added into the mix.
-func (t *txnReq) lookupStateAfterEvent(roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string, needed []gomatrixserverlib.StateKeyTuple) (*gomatrixserverlib.RespState, error) {
+func (t *txnReq) lookupStateAfterEvent(roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string) (*gomatrixserverlib.RespState, error) {
 	// try doing all this locally before we resort to querying federation
-	respState := t.lookupStateAfterEventLocally(roomID, eventID, needed)
+	respState := t.lookupStateAfterEventLocally(roomID, eventID)
 	if respState != nil {
 		return respState, nil
 	}
@@ -449,12 +594,14 @@ func (t *txnReq) lookupStateAfterEvent(roomVersion gomatrixserverlib.RoomVersion
 	return respState, nil
 }
 
-func (t *txnReq) lookupStateAfterEventLocally(roomID, eventID string, needed []gomatrixserverlib.StateKeyTuple) *gomatrixserverlib.RespState {
+// lookupStateAfterEventLocally returns the full room state after `eventID` from the roomserver, or nil if the
+// roomserver doesn't know the state after it. The whole state is needed rather than just the state needed for auth
+// as it may become the state stored at a backwards extremity.
+func (t *txnReq) lookupStateAfterEventLocally(roomID, eventID string) *gomatrixserverlib.RespState {
 	var res api.QueryStateAfterEventsResponse
 	err := t.rsAPI.QueryStateAfterEvents(t.context, &api.QueryStateAfterEventsRequest{
 		RoomID:       roomID,
 		PrevEventIDs: []string{eventID},
-		StateToFetch: needed,
 	}, &res)
 	if err != nil || !res.PrevEventsExist {
 		util.GetLogger(t.context).WithError(err).Warnf("failed to query state after %s locally", eventID)
@@ -502,23 +649,6 @@ func (t *txnReq) lookupStateAfterEventLocally(roomID, eventID string, needed []g
 	}
 }
 
-func (t *txnReq) lookupCurrentState(newEvent *gomatrixserverlib.Event) (*gomatrixserverlib.RespState, error) {
-	// Ask the roomserver for information about this room
-	queryReq := api.QueryLatestEventsAndStateRequest{
-		RoomID:       newEvent.RoomID(),
-		StateToFetch: gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{*newEvent}).Tuples(),
-	}
-	var queryRes api.QueryLatestEventsAndStateResponse
-	if err := t.rsAPI.QueryLatestEventsAndState(t.context, &queryReq, &queryRes); err != nil {
-		return nil, fmt.Errorf("lookupCurrentState rsAPI.QueryLatestEventsAndState: %w", err)
-	}
-	evs := gomatrixserverlib.UnwrapEventHeaders(queryRes.StateEvents)
-	return &gomatrixserverlib.RespState{
-		StateEvents: evs,
-		AuthEvents:  evs,
-	}, nil
-}
-
 // lookuptStateBeforeEvent returns the room state before the event e, which is just /state_ids and/or /state depending on what
 // the server supports.
 func (t *txnReq) lookupStateBeforeEvent(roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string) (
@@ -569,15 +699,14 @@ retryAllowedState:
 	}, nil
 }
 
-// getMissingEvents returns a nil backwardsExtremity if missing events were fetched and handled, else returns the new backwards extremity which we should
-// begin from. Returns an error only if we should terminate the transaction which initiated /get_missing_events
-// This function recursively calls txnReq.processEvent with the missing events, which will be processed before this function returns.
-// This means that we may recursively call this function, as we spider back up prev_events to the min depth.
-func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion, isInboundTxn bool) (backwardsExtremity *gomatrixserverlib.Event, err error) {
-	if !isInboundTxn {
-		// we've recursed here, so just take a state snapshot please!
-		return &e, nil
-	}
+// getMissingEvents tries to fill in the gap before the event e using /get_missing_events. It returns true if the missing
+// events were fetched and processed, followed by e, or false if the remote server couldn't fill in the gap, in which case
+// we should work out the state before e instead. Returns an error only if we should terminate the transaction which
+// initiated /get_missing_events.
+// If the gap is bigger than we asked for then the earliest missing events will still be missing prev_events of their
+// own. They are processed with isInboundTxn=false, so they are stored along with the state before them rather than
+// sending any more requests to /get_missing_events.
+func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (filled bool, err error) {
 	logger := util.GetLogger(t.context).WithField("event_id", e.EventID()).WithField("room_id", e.RoomID())
 	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
 	// query latest events (our trusted forward extremities)
@@ -588,19 +717,19 @@ func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatri
 	var res api.QueryLatestEventsAndStateResponse
 	if err = t.rsAPI.QueryLatestEventsAndState(t.context, &req, &res); err != nil {
 		logger.WithError(err).Warn("Failed to query latest events")
-		return &e, nil
+		return false, nil
 	}
 	latestEvents := make([]string, len(res.LatestEvents))
 	for i := range res.LatestEvents {
 		latestEvents[i] = res.LatestEvents[i].EventID
 	}
 	// this server just sent us an event for which we do not know its prev_events - ask that server for those prev_events.
-	minDepth := int(res.Depth) - 20
+	minDepth := int(res.Depth) - missingEventsMaxDepth
 	if minDepth < 0 {
 		minDepth = 0
 	}
 	missingResp, err := t.federation.LookupMissingEvents(t.context, t.Origin, e.RoomID(), gomatrixserverlib.MissingEvents{
-		Limit: 20,
+		Limit: missingEventsLimit,
 		// synapse uses the min depth they've ever seen in that room
 		MinDepth: minDepth,
 		// The latest event IDs that the sender already has. These are skipped when retrieving the previous events of latest_events.
@@ -609,63 +738,97 @@ func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatri
 		LatestEvents: []string{e.EventID()},
 	}, roomVersion)
 
-	// security: how we handle failures depends on whether or not this event will become the new forward extremity for the room.
-	// There's 2 scenarios to consider:
-	// - Case A: We got pushed an event and are now fetching missing prev_events. (isInboundTxn=true)
-	// - Case B: We are fetching missing prev_events already and now fetching some more  (isInboundTxn=false)
-	// In Case B, we know for sure that the event we are currently processing will not become the new forward extremity for the room,
-	// as it was called in response to an inbound txn which had it as a prev_event.
-	// In Case A, the event is a forward extremity, and could eventually become the _only_ forward extremity in the room. This is bad
-	// because it means we would trust the state at that event to be the state for the entire room, and allows rooms to be hijacked.
+	// security: if we can't fill in the gap then e will become a backwards extremity, and we will work out the state
+	// before it from the state after its prev_events. This is what synapse does too. It doesn't let the remote server
+	// decide the state of the room, as the roomserver still resolves the state at e against the state at the other
+	// forward extremities of the room.
 	// https://github.com/matrix-org/synapse/pull/3456
 	// https://github.com/matrix-org/synapse/blob/229eb81498b0fe1da81e9b5b333a0285acde9446/synapse/handlers/federation.py#L335
-	// For now, we do not allow Case B, so reject the event.
 	if err != nil {
-		logger.WithError(err).Errorf(
-			"%s pushed us an event but couldn't give us details about prev_events via /get_missing_events - dropping this event until it can",
+		logger.WithError(err).Warnf(
+			"%s pushed us an event but couldn't give us details about prev_events via /get_missing_events - falling back to fetching the state",
 			t.Origin,
 		)
-		return nil, missingPrevEventsError{
-			eventID: e.EventID(),
-			err:     err,
-		}
+		return false, nil
 	}
 	logger.Infof("get_missing_events returned %d events", len(missingResp.Events))
 
 	// topologically sort and sanity check that we are making forward progress
-	newEvents := gomatrixserverlib.ReverseTopologicalOrdering(missingResp.Events, gomatrixserverlib.TopologicalOrderByPrevEvents)
-	shouldHaveSomeEventIDs := e.PrevEventIDs()
-	hasPrevEvent := false
-Event:
-	for _, pe := range shouldHaveSomeEventIDs {
-		for _, ev := range newEvents {
-			if ev.EventID() == pe {
-				hasPrevEvent = true
-				break Event
+	newEvents, err := t.checkMissingEvents(e, missingResp.Events)
+	if err != nil {
+		return false, err
+	}
+	newEvents = gomatrixserverlib.ReverseTopologicalOrdering(newEvents, gomatrixserverlib.TopologicalOrderByPrevEvents)
+	if !containsAnyEvent(newEvents, e.PrevEventIDs()) {
+		logger.Warnf(
+			"%s didn't return any prev_events with IDs %v from /get_missing_events - falling back to fetching the state",
+			t.Origin, e.PrevEventIDs(),
+		)
+		return false, nil
+	}
+	// process the missing events then the event which started this whole thing
+	for _, ev := range newEvents {
+		if err = t.processEvent(ev, false); err != nil {
+			if isProcessingErrorFatal(err) {
+				return false, err
 			}
+			// Any events which refer to this one will now be missing a prev_event, so the
+			// state before them will be fetched instead.
+			logger.WithError(err).Warnf("Failed to process missing event %s, skipping", ev.EventID())
 		}
 	}
-	if !hasPrevEvent {
-		err = fmt.Errorf("called /get_missing_events but server %s didn't return any prev_events with IDs %v", t.Origin, shouldHaveSomeEventIDs)
-		logger.WithError(err).Errorf(
-			"%s pushed us an event but couldn't give us details about prev_events via /get_missing_events - dropping this event until it can",
-			t.Origin,
-		)
-		return nil, missingPrevEventsError{
-			eventID: e.EventID(),
-			err:     err,
+	return true, t.processEvent(e, false)
+}
+
+// checkMissingEvents returns the events from /get_missing_events which we should process. The remote server only
+// knows to stop at our latest events, so it may return events from before them which we already have. Only the
+// events which are in the same room as e, which we don't have, and which are signed by the servers which sent them
+// are kept. Returns an error only if the roomserver couldn't be queried.
+func (t *txnReq) checkMissingEvents(e gomatrixserverlib.Event, events []gomatrixserverlib.Event) ([]gomatrixserverlib.Event, error) {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	var queryRes api.QueryEventsByIDResponse
+	if err := t.rsAPI.QueryEventsByID(t.context, &api.QueryEventsByIDRequest{EventIDs: eventIDs}, &queryRes); err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool, len(queryRes.Events))
+	for _, ev := range queryRes.Events {
+		have[ev.EventID()] = true
+	}
+	var roomEvents []gomatrixserverlib.Event
+	for _, ev := range events {
+		if ev.RoomID() == e.RoomID() && !have[ev.EventID()] {
+			roomEvents = append(roomEvents, ev)
 		}
 	}
-	// process the missing events then the event which started this whole thing
-	for _, ev := range append(newEvents, e) {
-		err := t.processEvent(ev, false)
-		if err != nil {
-			return nil, err
+	sigErrs, err := gomatrixserverlib.VerifyEventSignatures(t.context, roomEvents, t.keys)
+	if err != nil {
+		util.GetLogger(t.context).WithError(err).Warn("Failed to verify the signatures of the missing events")
+		return nil, nil
+	}
+	var verified []gomatrixserverlib.Event
+	for i, serr := range sigErrs {
+		if serr != nil {
+			util.GetLogger(t.context).WithError(serr).Warnf("Dropping missing event %s with bad signatures", roomEvents[i].EventID())
+			continue
 		}
+		verified = append(verified, roomEvents[i])
 	}
+	return verified, nil
+}
 
-	// we processed everything!
-	return nil, nil
+// containsAnyEvent returns true if any of the event IDs are in the list of events.
+func containsAnyEvent(events []gomatrixserverlib.Event, eventIDs []string) bool {
+	for _, eventID := range eventIDs {
+		for _, ev := range events {
+			if ev.EventID() == eventID {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (t *txnReq) lookupMissingStateViaState(roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
@@ -761,8 +924,8 @@ func (t *txnReq) createRespStateFromStateIDs(stateIDs gomatrixserverlib.RespStat
 		respState.AuthEvents[i] = ev.Unwrap()
 	}
 	// We purposefully do not do auth checks on the returned events, as they will still
-	// be processed in the exact same way, just as a 'rejected' event
-	// TODO: Add a field to HeaderedEvent to indicate if the event is rejected.
+	// be processed in the exact same way: the roomserver stores events which fail the
+	// auth checks as rejected, and reports them in QueryEventsByIDResponse.
 	return &respState, nil
 }
 
@@ -780,7 +943,10 @@ func (t *txnReq) lookupEvent(roomVersion gomatrixserverlib.RoomVersion, missingE
 		}
 	}
 	txn, err := t.federation.GetEvent(t.context, t.Origin, missingEventID)
-	if err != nil || len(txn.PDUs) == 0 {
+	if err == nil && len(txn.PDUs) == 0 {
+		err = fmt.Errorf("/event returned no events for event ID %s", missingEventID)
+	}
+	if err != nil {
 		util.GetLogger(t.context).WithError(err).WithField("event_id", missingEventID).Warn("failed to get missing /event for event ID")
 		return nil, err
 	}
@@ -3,6 +3,7 @@ package routing
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -11,6 +12,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -66,6 +68,8 @@ func (t *testNopJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatr
 type testEDUProducer struct {
 	// this producer keeps track of calls to InputTypingEvent
 	invocations []eduAPI.InputTypingEventRequest
+	// and calls to InputSendToDeviceEvent
+	sendToDeviceInvocations []eduAPI.InputSendToDeviceEventRequest
 }
 
 func (p *testEDUProducer) InputTypingEvent(
@@ -82,6 +86,7 @@ func (p *testEDUProducer) InputSendToDeviceEvent(
 	request *eduAPI.InputSendToDeviceEventRequest,
 	response *eduAPI.InputSendToDeviceEventResponse,
 ) error {
+	p.sendToDeviceInvocations = append(p.sendToDeviceInvocations, *request)
 	return nil
 }
 
@@ -90,6 +95,8 @@ type testRoomserverAPI struct {
 	queryStateAfterEvents     func(*api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse
 	queryEventsByID           func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse
 	queryLatestEventsAndState func(*api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse
+	bannedServers             map[gomatrixserverlib.ServerName]bool
+	queryServerBannedErr      error
 }
 
 func (t *testRoomserverAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSenderInternalAPI) {}
@@ -122,6 +129,22 @@ func (t *testRoomserverAPI) PerformLeave(
 	return nil
 }
 
+func (t *testRoomserverAPI) PerformPurgeHistory(
+	ctx context.Context,
+	req *api.PerformPurgeHistoryRequest,
+	res *api.PerformPurgeHistoryResponse,
+) error {
+	return nil
+}
+
+func (t *testRoomserverAPI) PerformRoomShutdown(
+	ctx context.Context,
+	req *api.PerformRoomShutdownRequest,
+	res *api.PerformRoomShutdownResponse,
+) error {
+	return nil
+}
+
 // Query the latest events and state for a room from the room server.
 func (t *testRoomserverAPI) QueryLatestEventsAndState(
 	ctx context.Context,
@@ -159,6 +182,9 @@ func (t *testRoomserverAPI) QueryEventsByID(
 	request *api.QueryEventsByIDRequest,
 	response *api.QueryEventsByIDResponse,
 ) error {
+	if t.queryEventsByID == nil {
+		return nil
+	}
 	res := t.queryEventsByID(request)
 	response.Events = res.Events
 	return nil
@@ -248,6 +274,30 @@ func (t *testRoomserverAPI) QueryRoomVersionForRoom(
 	return nil
 }
 
+func (t *testRoomserverAPI) QueryRoomBlocked(
+	ctx context.Context,
+	request *api.QueryRoomBlockedRequest,
+	response *api.QueryRoomBlockedResponse,
+) error {
+	return nil
+}
+
+func (t *testRoomserverAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *api.QueryServerBannedFromRoomRequest,
+	response *api.QueryServerBannedFromRoomResponse,
+) error {
+	if t.queryServerBannedErr != nil {
+		return t.queryServerBannedErr
+	}
+	for _, serverName := range request.ServerNames {
+		if t.bannedServers[serverName] {
+			response.BannedServers = append(response.BannedServers, serverName)
+		}
+	}
+	return nil
+}
+
 // Set a room alias
 func (t *testRoomserverAPI) SetRoomAlias(
 	ctx context.Context,
@@ -430,6 +480,45 @@ func TestBasicTransaction(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// The purpose of this test is to check that events sent by a server which is denied by the server ACL of the room
+// are rejected and never reach the roomserver.
+func TestTransactionFromBannedServer(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				StateEvents:     fromStateTuples(req.StateToFetch, nil),
+			}
+		},
+		bannedServers: map[gomatrixserverlib.ServerName]bool{
+			testOrigin: true,
+		},
+	}
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	mustProcessTransaction(t, txn, []string{testEvents[len(testEvents)-1].EventID()})
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+// The purpose of this test is to check that the transaction is failed, rather than the event rejected, when we can't
+// tell whether the server which sent it is denied by the server ACL of the room.
+func TestTransactionServerACLLookupFails(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryServerBannedErr: errors.New("roomserver unavailable"),
+	}
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	if _, err := txn.processTransaction(); err == nil {
+		t.Fatalf("wanted txn.processTransaction to fail")
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
 // The purpose of this test is to check that if the event received fails auth checks the transaction is failed.
 func TestTransactionFailAuthChecks(t *testing.T) {
 	rsAPI := &testRoomserverAPI{
@@ -679,3 +768,38 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	mustProcessTransaction(t, txn, nil)
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{eventB, eventC, eventD})
 }
+
+// The purpose of this test is to check that send-to-device messages are only accepted from senders that belong to
+// the origin of the transaction, and only for users that are local to us.
+func TestTransactionDirectToDevice(t *testing.T) {
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduProducer = producers.NewEDUServerProducer(eduProducer)
+	txn.cfg = &config.Dendrite{}
+	txn.cfg.Matrix.ServerName = testDestination
+
+	directToDevice := func(sender string, messages string) gomatrixserverlib.EDU {
+		return gomatrixserverlib.EDU{
+			Type: gomatrixserverlib.MDirectToDevice,
+			Content: gomatrixserverlib.RawJSON(fmt.Sprintf(
+				`{"sender":%q,"type":"m.room_key_request","message_id":"abc","messages":%s}`, sender, messages,
+			)),
+		}
+	}
+	txn.processEDUs([]gomatrixserverlib.EDU{
+		// accepted: the sender belongs to the origin and the user is local
+		directToDevice("@alice:kaer.morhen", `{"@bob:white.orchard":{"DEVICE":{}}}`),
+		// rejected: the sender doesn't belong to the origin
+		directToDevice("@eve:velen", `{"@bob:white.orchard":{"DEVICE":{}}}`),
+		// rejected: the user isn't local
+		directToDevice("@alice:kaer.morhen", `{"@charlie:velen":{"DEVICE":{}}}`),
+	})
+
+	if len(eduProducer.sendToDeviceInvocations) != 1 {
+		t.Fatalf("expected 1 send-to-device message, got %d", len(eduProducer.sendToDeviceInvocations))
+	}
+	got := eduProducer.sendToDeviceInvocations[0].InputSendToDeviceEvent
+	if got.Sender != "@alice:kaer.morhen" || got.UserID != "@bob:white.orchard" || got.DeviceID != "DEVICE" {
+		t.Errorf("unexpected send-to-device message: %+v", got)
+	}
+}
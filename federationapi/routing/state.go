@@ -98,6 +98,10 @@ func getState(
 	roomID string,
 	eventID string,
 ) (*gomatrixserverlib.RespState, *util.JSONResponse) {
+	if resErr := checkServerNotBanned(ctx, rsAPI, roomID, request.Origin()); resErr != nil {
+		return nil, resErr
+	}
+
 	event, resErr := getEvent(ctx, request, rsAPI, eventID)
 	if resErr != nil {
 		return nil, resErr
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -26,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -156,7 +158,7 @@ func ExchangeThirdPartyInvite(
 	}
 
 	// Auth and build the event from what the remote server sent us
-	event, err := buildMembershipEvent(httpReq.Context(), &builder, rsAPI, cfg)
+	event, err := buildMembershipEvent(httpReq.Context(), &builder, rsAPI, cfg, internal.LocalServerNameForRequest(cfg, httpReq))
 	if err == errNotInRoom {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
@@ -181,7 +183,7 @@ func ExchangeThirdPartyInvite(
 		[]gomatrixserverlib.HeaderedEvent{
 			signedEvent.Event.Headered(verRes.RoomVersion),
 		},
-		cfg.Matrix.ServerName,
+		internal.LocalServerNameForRequest(cfg, httpReq),
 		nil,
 	); err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("producer.SendEvents failed")
@@ -215,7 +217,8 @@ func createInviteFrom3PIDInvite(
 		return nil, err
 	}
 
-	if server != cfg.Matrix.ServerName {
+	// Third-party identifiers can only be bound to users who have accounts here.
+	if !cfg.IsAccountServerName(server) {
 		return nil, errNotLocalUser
 	}
 
@@ -245,7 +248,7 @@ func createInviteFrom3PIDInvite(
 		return nil, err
 	}
 
-	event, err := buildMembershipEvent(ctx, builder, rsAPI, cfg)
+	event, err := buildMembershipEvent(ctx, builder, rsAPI, cfg, server)
 	if err == errNotInRoom {
 		return nil, sendToRemoteServer(ctx, inv, federation, cfg, *builder)
 	}
@@ -258,13 +261,13 @@ func createInviteFrom3PIDInvite(
 
 // buildMembershipEvent uses a builder for a m.room.member invite event derived
 // from a third-party invite to auth and build the said event. Returns the said
-// event.
+// event, signed by the given local server name.
 // Returns errNotInRoom if the server is not in the room the invite is for.
 // Returns an error if something failed during the process.
 func buildMembershipEvent(
 	ctx context.Context,
 	builder *gomatrixserverlib.EventBuilder, rsAPI roomserverAPI.RoomserverInternalAPI,
-	cfg *config.Dendrite,
+	cfg *config.Dendrite, serverName gomatrixserverlib.ServerName,
 ) (*gomatrixserverlib.Event, error) {
 	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
 	if err != nil {
@@ -313,9 +316,12 @@ func buildMembershipEvent(
 	}
 	builder.AuthEvents = refs
 
+	keyID, privateKey, ok := cfg.SigningIdentityFor(serverName)
+	if !ok {
+		return nil, fmt.Errorf("server name %q is not hosted here", serverName)
+	}
 	event, err := builder.Build(
-		time.Now(), cfg.Matrix.ServerName, cfg.Matrix.KeyID,
-		cfg.Matrix.PrivateKey, queryRes.RoomVersion,
+		time.Now(), serverName, keyID, privateKey, queryRes.RoomVersion,
 	)
 
 	return &event, err
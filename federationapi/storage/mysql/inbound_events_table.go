@@ -0,0 +1,127 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/federationapi/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const inboundEventsSchema = `
+-- The inbound_events table stores the events from inbound transactions which
+-- we have accepted but not processed yet, so that they aren't lost if we stop
+-- before they are processed. Events are deleted once they have been processed.
+CREATE TABLE IF NOT EXISTS federationapi_inbound_events (
+    -- The event NID, which also gives the order in which events arrived.
+    event_nid BIGINT AUTO_INCREMENT PRIMARY KEY,
+    -- The server that sent the transaction.
+    origin TEXT NOT NULL,
+    -- The transaction ID chosen by the origin.
+    txn_id TEXT NOT NULL,
+    -- The headered JSON of the event.
+    event_json TEXT NOT NULL
+);
+`
+
+const insertInboundEventSQL = "" +
+	"INSERT INTO federationapi_inbound_events (origin, txn_id, event_json)" +
+	" VALUES ($1, $2, $3)"
+
+const selectInboundEventsSQL = "" +
+	"SELECT event_nid, origin, txn_id, event_json FROM federationapi_inbound_events" +
+	" ORDER BY event_nid ASC"
+
+const deleteInboundEventSQL = "" +
+	"DELETE FROM federationapi_inbound_events WHERE event_nid = $1"
+
+type inboundEventsStatements struct {
+	insertInboundEventStmt  *sql.Stmt
+	selectInboundEventsStmt *sql.Stmt
+	deleteInboundEventStmt  *sql.Stmt
+}
+
+func (s *inboundEventsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(inboundEventsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertInboundEventStmt, err = db.Prepare(insertInboundEventSQL); err != nil {
+		return
+	}
+	if s.selectInboundEventsStmt, err = db.Prepare(selectInboundEventsSQL); err != nil {
+		return
+	}
+	if s.deleteInboundEventStmt, err = db.Prepare(deleteInboundEventSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *inboundEventsStatements) insertInboundEvent(
+	ctx context.Context, txn *sql.Tx,
+	origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+	event gomatrixserverlib.HeaderedEvent,
+) (int64, error) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	stmt := internal.TxStmt(txn, s.insertInboundEventStmt)
+	res, err := stmt.ExecContext(ctx, origin, txnID, string(eventJSON))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// selectInboundEvents returns all of the stored events in the order in which
+// they arrived.
+func (s *inboundEventsStatements) selectInboundEvents(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.InboundEvent, error) {
+	stmt := internal.TxStmt(txn, s.selectInboundEventsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectInboundEvents: rows.close() failed")
+
+	var result []types.InboundEvent
+	for rows.Next() {
+		var event types.InboundEvent
+		var eventJSON string
+		if err = rows.Scan(&event.NID, &event.Origin, &event.TransactionID, &eventJSON); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(eventJSON), &event.Event); err != nil {
+			return nil, err
+		}
+		result = append(result, event)
+	}
+	return result, rows.Err()
+}
+
+func (s *inboundEventsStatements) deleteInboundEvent(
+	ctx context.Context, txn *sql.Tx, eventNID int64,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteInboundEventStmt)
+	_, err := stmt.ExecContext(ctx, eventNID)
+	return err
+}
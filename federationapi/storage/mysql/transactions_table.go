@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const transactionsSchema = `
+-- The transactions table stores our responses to the transactions that
+-- remote servers have sent us, so that we can give the same response if
+-- a transaction is retried rather than processing it again.
+CREATE TABLE IF NOT EXISTS federationapi_transactions (
+    -- The server that sent the transaction.
+    origin TEXT NOT NULL,
+    -- The transaction ID chosen by the origin.
+    txn_id TEXT NOT NULL,
+    -- The HTTP status code of our response.
+    code INTEGER NOT NULL,
+    -- The JSON body of our response.
+    response_json TEXT NOT NULL,
+    -- The timestamp in milliseconds when the response was stored.
+    added_at BIGINT NOT NULL,
+    UNIQUE (origin, txn_id)
+);
+
+CREATE INDEX IF NOT EXISTS federationapi_transactions_added_at_idx
+    ON federationapi_transactions (added_at);
+`
+
+const insertTransactionSQL = "" +
+	"INSERT INTO federationapi_transactions (origin, txn_id, code, response_json, added_at)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectTransactionSQL = "" +
+	"SELECT code, response_json FROM federationapi_transactions" +
+	" WHERE origin = $1 AND txn_id = $2"
+
+const deleteTransactionsBeforeSQL = "" +
+	"DELETE FROM federationapi_transactions WHERE added_at < $1"
+
+type transactionsStatements struct {
+	insertTransactionStmt        *sql.Stmt
+	selectTransactionStmt        *sql.Stmt
+	deleteTransactionsBeforeStmt *sql.Stmt
+}
+
+func (s *transactionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(transactionsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertTransactionStmt, err = db.Prepare(insertTransactionSQL); err != nil {
+		return
+	}
+	if s.selectTransactionStmt, err = db.Prepare(selectTransactionSQL); err != nil {
+		return
+	}
+	if s.deleteTransactionsBeforeStmt, err = db.Prepare(deleteTransactionsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *transactionsStatements) insertTransaction(
+	ctx context.Context, txn *sql.Tx,
+	origin, txnID string, res *util.JSONResponse, addedAt time.Time,
+) error {
+	responseJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		return err
+	}
+	stmt := internal.TxStmt(txn, s.insertTransactionStmt)
+	_, err = stmt.ExecContext(
+		ctx, origin, txnID, res.Code, string(responseJSON), gomatrixserverlib.AsTimestamp(addedAt),
+	)
+	return err
+}
+
+// selectTransaction returns the stored response to the transaction, or nil
+// if there isn't one.
+func (s *transactionsStatements) selectTransaction(
+	ctx context.Context, txn *sql.Tx, origin, txnID string,
+) (*util.JSONResponse, error) {
+	var code int
+	var responseJSON string
+	stmt := internal.TxStmt(txn, s.selectTransactionStmt)
+	err := stmt.QueryRowContext(ctx, origin, txnID).Scan(&code, &responseJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &util.JSONResponse{
+		Code: code,
+		JSON: json.RawMessage(responseJSON),
+	}, nil
+}
+
+func (s *transactionsStatements) deleteTransactionsBefore(
+	ctx context.Context, txn *sql.Tx, before time.Time,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteTransactionsBeforeStmt)
+	_, err := stmt.ExecContext(ctx, gomatrixserverlib.AsTimestamp(before))
+	return err
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationapi/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// Database stores information needed by the federation API
+type Database struct {
+	transactionsStatements
+	inboundEventsStatements
+	db *sql.DB
+}
+
+// NewDatabase opens a new database
+func NewDatabase(dataSourceName string, dbProperties internal.DbProperties) (*Database, error) {
+	var result Database
+	var err error
+	if result.db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	if err = result.transactionsStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	if err = result.inboundEventsStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// InsertTransaction implements transactions.Storage
+func (d *Database) InsertTransaction(
+	ctx context.Context, origin, txnID string, res *util.JSONResponse, addedAt time.Time,
+) error {
+	return d.insertTransaction(ctx, nil, origin, txnID, res, addedAt)
+}
+
+// SelectTransaction implements transactions.Storage
+func (d *Database) SelectTransaction(
+	ctx context.Context, origin, txnID string,
+) (*util.JSONResponse, error) {
+	return d.selectTransaction(ctx, nil, origin, txnID)
+}
+
+// DeleteTransactionsBefore implements transactions.Storage
+func (d *Database) DeleteTransactionsBefore(ctx context.Context, before time.Time) error {
+	return d.deleteTransactionsBefore(ctx, nil, before)
+}
+
+// StoreInboundEvents stores the events from a transaction until they have been
+// processed. Returns the NIDs of the stored events, in the same order.
+func (d *Database) StoreInboundEvents(
+	ctx context.Context, origin gomatrixserverlib.ServerName,
+	txnID gomatrixserverlib.TransactionID, events []gomatrixserverlib.HeaderedEvent,
+) (eventNIDs []int64, err error) {
+	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		eventNIDs = make([]int64, len(events))
+		for i := range events {
+			eventNID, ierr := d.insertInboundEvent(ctx, txn, origin, txnID, events[i])
+			if ierr != nil {
+				return ierr
+			}
+			eventNIDs[i] = eventNID
+		}
+		return nil
+	})
+	return
+}
+
+// GetInboundEvents returns the events which haven't been processed yet, in
+// the order in which they arrived.
+func (d *Database) GetInboundEvents(ctx context.Context) ([]types.InboundEvent, error) {
+	return d.selectInboundEvents(ctx, nil)
+}
+
+// DeleteInboundEvent deletes an event once it has been processed.
+func (d *Database) DeleteInboundEvent(ctx context.Context, eventNID int64) error {
+	return d.deleteInboundEvent(ctx, nil, eventNID)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestInboundEvents(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	origin := gomatrixserverlib.ServerName("kaer.morhen")
+	roomVersion := gomatrixserverlib.RoomVersionV1
+
+	var events []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 3; i++ {
+		e, eerr := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+			`{"auth_events":[],"content":{},"depth":%d,"event_id":"$%d:kaer.morhen","origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"room_id":"!room:kaer.morhen","sender":"@userid:kaer.morhen","type":"m.room.message"}`,
+			i, i,
+		)), false, roomVersion)
+		if eerr != nil {
+			t.Fatalf("NewEventFromTrustedJSON: %s", eerr)
+		}
+		events = append(events, e.Headered(roomVersion))
+	}
+
+	eventNIDs, err := db.StoreInboundEvents(ctx, origin, "txn1", events)
+	if err != nil {
+		t.Fatalf("StoreInboundEvents: %s", err)
+	}
+	if len(eventNIDs) != len(events) {
+		t.Fatalf("expected %d event NIDs, got %d", len(events), len(eventNIDs))
+	}
+	if err = db.DeleteInboundEvent(ctx, eventNIDs[1]); err != nil {
+		t.Fatalf("DeleteInboundEvent: %s", err)
+	}
+
+	// The remaining events come back in the order they were stored, with
+	// their room versions.
+	stored, err := db.GetInboundEvents(ctx)
+	if err != nil {
+		t.Fatalf("GetInboundEvents: %s", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 stored events, got %d", len(stored))
+	}
+	for i, want := range []int{0, 2} {
+		got := stored[i]
+		if got.NID != eventNIDs[want] || got.Origin != origin || got.TransactionID != "txn1" {
+			t.Errorf("stored event %d: unexpected %d, %q, %q", i, got.NID, got.Origin, got.TransactionID)
+		}
+		if got.Event.EventID() != events[want].EventID() || got.Event.RoomVersion != roomVersion {
+			t.Errorf("stored event %d: expected %s (%s), got %s (%s)", i,
+				events[want].EventID(), roomVersion, got.Event.EventID(), got.Event.RoomVersion)
+		}
+	}
+}
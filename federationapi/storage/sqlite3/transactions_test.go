@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+func TestTransactions(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	origin := "kaer.morhen"
+	addedAt := time.Now().Add(-time.Hour)
+
+	res, err := db.SelectTransaction(ctx, origin, "txn1")
+	if err != nil {
+		t.Fatalf("SelectTransaction: %s", err)
+	}
+	if res != nil {
+		t.Fatalf("expected no response for an unknown transaction, got %+v", res)
+	}
+
+	first := &util.JSONResponse{Code: http.StatusOK, JSON: map[string]string{"pdus": "first"}}
+	second := &util.JSONResponse{Code: http.StatusOK, JSON: map[string]string{"pdus": "second"}}
+	for _, r := range []*util.JSONResponse{first, second} {
+		if err = db.InsertTransaction(ctx, origin, "txn1", r, addedAt); err != nil {
+			t.Fatalf("InsertTransaction: %s", err)
+		}
+	}
+
+	// The first response stored for a transaction is kept.
+	res, err = db.SelectTransaction(ctx, origin, "txn1")
+	if err != nil {
+		t.Fatalf("SelectTransaction: %s", err)
+	}
+	if res == nil || res.Code != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %+v", res)
+	}
+	if got, _ := res.JSON.(json.RawMessage); string(got) != `{"pdus":"first"}` {
+		t.Errorf("expected the first response, got %s", got)
+	}
+
+	if err = db.DeleteTransactionsBefore(ctx, time.Now()); err != nil {
+		t.Fatalf("DeleteTransactionsBefore: %s", err)
+	}
+	if res, err = db.SelectTransaction(ctx, origin, "txn1"); err != nil || res != nil {
+		t.Errorf("expected the old response to be deleted, got %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// An InboundEvent is an event from an inbound transaction which we have
+// accepted but not processed yet.
+type InboundEvent struct {
+	// The NID of the stored event, used to delete it once processed.
+	NID int64
+	// The server which sent the transaction.
+	Origin gomatrixserverlib.ServerName
+	// The ID of the transaction which the event arrived in.
+	TransactionID gomatrixserverlib.TransactionID
+	// The event itself.
+	Event gomatrixserverlib.HeaderedEvent
+}
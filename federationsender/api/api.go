@@ -49,6 +49,18 @@ type FederationSenderInternalAPI interface {
 		request *PerformServersAliveRequest,
 		response *PerformServersAliveResponse,
 	) error
+	// Clears the backoff and blacklist state of a server and retries sending messages to it.
+	PerformDestinationReset(
+		ctx context.Context,
+		request *PerformDestinationResetRequest,
+		response *PerformDestinationResetResponse,
+	) error
+	// Query the backoff and blacklist state of remote servers.
+	QueryDestinationStatus(
+		ctx context.Context,
+		request *QueryDestinationStatusRequest,
+		response *QueryDestinationStatusResponse,
+	) error
 }
 
 type PerformDirectoryLookupRequest struct {
@@ -88,6 +100,29 @@ type PerformServersAliveRequest struct {
 type PerformServersAliveResponse struct {
 }
 
+// PerformDestinationResetRequest is a request to PerformDestinationReset
+type PerformDestinationResetRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// PerformDestinationResetResponse is a response to PerformDestinationReset
+type PerformDestinationResetResponse struct {
+	// The state of the server after it has been reset.
+	Destination types.DestinationStatus `json:"destination"`
+}
+
+// QueryDestinationStatusRequest is a request to QueryDestinationStatus
+type QueryDestinationStatusRequest struct {
+	// The servers to query. If empty then all servers that we have
+	// stored state for are returned.
+	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+// QueryDestinationStatusResponse is a response to QueryDestinationStatus
+type QueryDestinationStatusResponse struct {
+	Destinations []types.DestinationStatus `json:"destinations"`
+}
+
 // QueryJoinedHostsInRoomRequest is a request to QueryJoinedHostsInRoom
 type QueryJoinedHostsInRoomRequest struct {
 	RoomID string `json:"room_id"`
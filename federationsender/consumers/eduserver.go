@@ -20,18 +20,23 @@ import (
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
 // OutputTypingEventConsumer consumes events that originate in EDU server.
 type OutputTypingEventConsumer struct {
-	consumer   *internal.ContinualConsumer
-	db         storage.Database
-	queues     *queue.OutgoingQueues
-	ServerName gomatrixserverlib.ServerName
+	consumer *internal.ContinualConsumer
+	db       storage.Database
+	queues   *queue.OutgoingQueues
+	rsAPI    roomserverAPI.RoomserverInternalAPI
+	cfg      *config.Dendrite
+	shard    types.Shard
 }
 
 // NewOutputTypingEventConsumer creates a new OutputTypingEventConsumer. Call Start() to begin consuming from EDU servers.
@@ -40,17 +45,21 @@ func NewOutputTypingEventConsumer(
 	kafkaConsumer sarama.Consumer,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) *OutputTypingEventConsumer {
+	shard := shardFromConfig(cfg)
 	consumer := internal.ContinualConsumer{
 		Topic:          string(cfg.Kafka.Topics.OutputTypingEvent),
 		Consumer:       kafkaConsumer,
-		PartitionStore: store,
+		PartitionStore: &shardPartitionStore{store: store, shard: shard},
 	}
 	c := &OutputTypingEventConsumer{
-		consumer:   &consumer,
-		queues:     queues,
-		db:         store,
-		ServerName: cfg.Matrix.ServerName,
+		consumer: &consumer,
+		queues:   queues,
+		db:       store,
+		rsAPI:    rsAPI,
+		cfg:      cfg,
+		shard:    shard,
 	}
 	consumer.ProcessMessage = c.onMessage
 
@@ -79,7 +88,7 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 		log.WithError(err).WithField("user_id", ote.Event.UserID).Error("Failed to extract domain from typing sender")
 		return nil
 	}
-	if typingServerName != t.ServerName {
+	if !t.cfg.IsLocalServerName(typingServerName) {
 		log.WithField("other_server", typingServerName).Info("Suppressing typing notif: originated elsewhere")
 		return nil
 	}
@@ -93,6 +102,11 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 	for i := range joined {
 		names[i] = joined[i].ServerName
 	}
+	names = t.shard.Filter(names)
+	names, err = withoutBannedServers(context.TODO(), t.rsAPI, ote.Event.RoomID, names)
+	if err != nil {
+		return err
+	}
 
 	edu := &gomatrixserverlib.EDU{Type: ote.Event.Type}
 	if edu.Content, err = json.Marshal(map[string]interface{}{
@@ -103,5 +117,111 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 		return err
 	}
 
-	return t.queues.SendEDU(edu, t.ServerName, names)
+	return t.queues.SendEDU(edu, typingServerName, names)
+}
+
+// OutputSendToDeviceEventConsumer consumes send-to-device events that
+// originate in the EDU server and sends the ones destined for remote users
+// over federation.
+type OutputSendToDeviceEventConsumer struct {
+	consumer *internal.ContinualConsumer
+	db       storage.Database
+	queues   *queue.OutgoingQueues
+	cfg      *config.Dendrite
+	shard    types.Shard
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer. Call Start() to begin consuming from EDU servers.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+) *OutputSendToDeviceEventConsumer {
+	shard := shardFromConfig(cfg)
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: &shardPartitionStore{store: store, shard: shard},
+	}
+	c := &OutputSendToDeviceEventConsumer{
+		consumer: &consumer,
+		queues:   queues,
+		db:       store,
+		cfg:      cfg,
+		shard:    shard,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers
+func (t *OutputSendToDeviceEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputSendToDeviceEvent received from the EDU servers.
+// Parses the msg, creates a matrix federation EDU and queues it for the server
+// of the user that the message is for. The EDU is kept in the queue until the
+// remote server has accepted it.
+func (t *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ote api.OutputSendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &ote); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed")
+		return nil
+	}
+
+	// only send send-to-device events which originated from us
+	_, originServerName, err := gomatrixserverlib.SplitID('@', ote.Sender)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ote.Sender).Error("Failed to extract domain from send-to-device sender")
+		return nil
+	}
+	if !t.cfg.IsLocalServerName(originServerName) {
+		log.WithField("other_server", originServerName).Info("Suppressing send-to-device: originated elsewhere")
+		return nil
+	}
+
+	// only send send-to-device events to remote users, since the sync API
+	// delivers the ones for local users
+	_, destServerName, err := gomatrixserverlib.SplitID('@', ote.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ote.UserID).Error("Failed to extract domain from send-to-device destination")
+		return nil
+	}
+	if t.cfg.IsLocalServerName(destServerName) {
+		return nil
+	}
+
+	// Leave the message to the shard that is responsible for the destination.
+	if !t.shard.Owns(destServerName) {
+		return nil
+	}
+
+	edu := &gomatrixserverlib.EDU{Type: gomatrixserverlib.MDirectToDevice}
+	if edu.Content, err = json.Marshal(gomatrixserverlib.ToDeviceMessage{
+		Sender:    ote.Sender,
+		Type:      ote.Type,
+		MessageID: util.RandomString(32),
+		Messages: map[string]map[string]json.RawMessage{
+			ote.UserID: {
+				ote.DeviceID: ote.Content,
+			},
+		},
+	}); err != nil {
+		log.WithError(err).Error("failed to marshal EDU JSON")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"sender":      ote.Sender,
+		"user_id":     ote.UserID,
+		"device_id":   ote.DeviceID,
+		"event_type":  ote.Type,
+		"destination": destServerName,
+	}).Info("Sending send-to-device message via federation")
+
+	return t.queues.SendEDU(edu, originServerName, []gomatrixserverlib.ServerName{destServerName})
 }
@@ -38,6 +38,7 @@ type OutputRoomEventConsumer struct {
 	rsConsumer *internal.ContinualConsumer
 	db         storage.Database
 	queues     *queue.OutgoingQueues
+	shard      types.Shard
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -48,13 +49,15 @@ func NewOutputRoomEventConsumer(
 	store storage.Database,
 	rsAPI api.RoomserverInternalAPI,
 ) *OutputRoomEventConsumer {
+	shard := shardFromConfig(cfg)
 	consumer := internal.ContinualConsumer{
 		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
 		Consumer:       kafkaConsumer,
-		PartitionStore: store,
+		PartitionStore: &shardPartitionStore{store: store, shard: shard},
 	}
 	s := &OutputRoomEventConsumer{
 		cfg:        cfg,
+		shard:      shard,
 		rsConsumer: &consumer,
 		db:         store,
 		queues:     queues,
@@ -175,6 +178,18 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) err
 		return err
 	}
 
+	// Only send the event to the servers that this shard is responsible
+	// for. The other shards will send it to the rest.
+	joinedHostsAtEvent = s.shard.Filter(joinedHostsAtEvent)
+
+	// Don't send the event to servers which are denied by the server ACL.
+	joinedHostsAtEvent, err = withoutBannedServers(
+		context.TODO(), s.rsAPI, ore.Event.RoomID(), joinedHostsAtEvent,
+	)
+	if err != nil {
+		return err
+	}
+
 	// Send the event.
 	return s.queues.SendEvent(
 		&ore.Event, gomatrixserverlib.ServerName(ore.SendAsServer), joinedHostsAtEvent,
@@ -184,7 +199,7 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) err
 // processInvite handles an invite event for sending over federation.
 func (s *OutputRoomEventConsumer) processInvite(oie api.OutputNewInviteEvent) error {
 	// Don't try to reflect and resend invites that didn't originate from us.
-	if s.cfg.Matrix.ServerName != oie.Event.Origin() {
+	if !s.cfg.IsLocalServerName(oie.Event.Origin()) {
 		return nil
 	}
 
@@ -203,7 +218,12 @@ func (s *OutputRoomEventConsumer) processInvite(oie api.OutputNewInviteEvent) er
 		}).Info("failed to split destination from state key")
 		return nil
 	}
-	if s.cfg.Matrix.ServerName == destination {
+	if s.cfg.IsLocalServerName(destination) {
+		return nil
+	}
+
+	// Leave the invite to the shard that is responsible for the destination.
+	if !s.shard.Owns(destination) {
 		return nil
 	}
 
@@ -420,3 +440,36 @@ func missingEventsFrom(events []gomatrixserverlib.Event, required []string) []st
 	}
 	return missing
 }
+
+// withoutBannedServers returns the servers which aren't denied by the
+// m.room.server_acl event in the current state of the room.
+func withoutBannedServers(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI,
+	roomID string, serverNames []gomatrixserverlib.ServerName,
+) ([]gomatrixserverlib.ServerName, error) {
+	if len(serverNames) == 0 {
+		return serverNames, nil
+	}
+	req := api.QueryServerBannedFromRoomRequest{
+		RoomID:      roomID,
+		ServerNames: serverNames,
+	}
+	res := api.QueryServerBannedFromRoomResponse{}
+	if err := rsAPI.QueryServerBannedFromRoom(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+	if len(res.BannedServers) == 0 {
+		return serverNames, nil
+	}
+	banned := make(map[gomatrixserverlib.ServerName]bool, len(res.BannedServers))
+	for _, serverName := range res.BannedServers {
+		banned[serverName] = true
+	}
+	result := make([]gomatrixserverlib.ServerName, 0, len(serverNames))
+	for _, serverName := range serverNames {
+		if !banned[serverName] {
+			result = append(result, serverName)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// shardFromConfig returns the federation sender shard that this instance
+// is configured to be.
+func shardFromConfig(cfg *config.Dendrite) types.Shard {
+	return types.Shard{
+		Index: cfg.FederationSender.ShardIndex,
+		Count: cfg.FederationSender.ShardCount,
+	}
+}
+
+// shardPartitionStore records the partition offsets of a shard separately
+// from those of the other shards that share the database.
+type shardPartitionStore struct {
+	store internal.PartitionStorer
+	shard types.Shard
+}
+
+// PartitionOffsets implements internal.PartitionStorer. A shard which
+// hasn't consumed the topic before starts from where the first shard has
+// reached, rather than from the beginning of the topic.
+func (s *shardPartitionStore) PartitionOffsets(
+	ctx context.Context, topic string,
+) ([]internal.PartitionOffset, error) {
+	offsets, err := s.store.PartitionOffsets(ctx, s.shard.Topic(topic))
+	if err != nil || len(offsets) > 0 {
+		return offsets, err
+	}
+	return s.store.PartitionOffsets(ctx, topic)
+}
+
+// SetPartitionOffset implements internal.PartitionStorer.
+func (s *shardPartitionStore) SetPartitionOffset(
+	ctx context.Context, topic string, partition int32, offset int64,
+) error {
+	return s.store.SetPartitionOffset(ctx, s.shard.Topic(topic), partition, offset)
+}
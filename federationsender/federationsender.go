@@ -46,9 +46,24 @@ func SetupFederationSenderComponent(
 		rsAPI, base.Cfg.Matrix.ServerName, base.Cfg.Matrix.KeyID, base.Cfg.Matrix.PrivateKey,
 	)
 
-	statistics := &types.Statistics{}
+	statistics := &types.Statistics{
+		DB: federationSenderDB,
+	}
+	// Requests from virtual hosts need to be signed with their own keys.
+	virtualHosts := map[gomatrixserverlib.ServerName]*gomatrixserverlib.FederationClient{}
+	for _, vhost := range base.Cfg.Matrix.VirtualHosts {
+		virtualHosts[vhost.ServerName] = base.CreateFederationClientFor(
+			vhost.ServerName, vhost.KeyID, vhost.PrivateKey,
+		)
+	}
+
 	queues := queue.NewOutgoingQueues(
-		base.Cfg.Matrix.ServerName, federation, roomserverProducer, statistics,
+		federationSenderDB, base.Cfg.Matrix.ServerName, federation,
+		virtualHosts, roomserverProducer, statistics,
+		types.Shard{
+			Index: base.Cfg.FederationSender.ShardIndex,
+			Count: base.Cfg.FederationSender.ShardCount,
+		},
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -60,13 +75,20 @@ func SetupFederationSenderComponent(
 	}
 
 	tsConsumer := consumers.NewOutputTypingEventConsumer(
-		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsAPI,
 	)
 	if err := tsConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start typing server consumer")
 	}
 
-	queryAPI := internal.NewFederationSenderInternalAPI(federationSenderDB, base.Cfg, roomserverProducer, federation, keyRing, statistics, queues)
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+	)
+	if err := sendToDeviceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start send-to-device consumer")
+	}
+
+	queryAPI := internal.NewFederationSenderInternalAPI(federationSenderDB, base.Cfg, roomserverProducer, federation, keyRing, statistics, queues, virtualHosts)
 	inthttp.AddRoutes(queryAPI, base.InternalAPIMux)
 
 	return queryAPI
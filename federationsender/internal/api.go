@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"fmt"
+
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/producers"
 	"github.com/matrix-org/dendrite/federationsender/queue"
@@ -20,6 +22,9 @@ type FederationSenderInternalAPI struct {
 	federation *gomatrixserverlib.FederationClient
 	keyRing    *gomatrixserverlib.KeyRing
 	queues     *queue.OutgoingQueues
+	// Federation clients for each configured virtual host, which sign
+	// requests with that server name rather than the main one.
+	virtualHosts map[gomatrixserverlib.ServerName]*gomatrixserverlib.FederationClient
 }
 
 func NewFederationSenderInternalAPI(
@@ -29,14 +34,35 @@ func NewFederationSenderInternalAPI(
 	keyRing *gomatrixserverlib.KeyRing,
 	statistics *types.Statistics,
 	queues *queue.OutgoingQueues,
+	virtualHosts map[gomatrixserverlib.ServerName]*gomatrixserverlib.FederationClient,
 ) *FederationSenderInternalAPI {
 	return &FederationSenderInternalAPI{
-		db:         db,
-		cfg:        cfg,
-		producer:   producer,
-		federation: federation,
-		keyRing:    keyRing,
-		statistics: statistics,
-		queues:     queues,
+		db:           db,
+		cfg:          cfg,
+		producer:     producer,
+		federation:   federation,
+		keyRing:      keyRing,
+		statistics:   statistics,
+		queues:       queues,
+		virtualHosts: virtualHosts,
+	}
+}
+
+// federationFor returns the federation client to use when acting on behalf
+// of the given local user, along with the server name that the user's
+// events must be signed with.
+func (r *FederationSenderInternalAPI) federationFor(
+	userID string,
+) (*gomatrixserverlib.FederationClient, gomatrixserverlib.ServerName, error) {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if domain == r.cfg.Matrix.ServerName {
+		return r.federation, domain, nil
+	}
+	if client, ok := r.virtualHosts[domain]; ok {
+		return client, domain, nil
 	}
+	return nil, "", fmt.Errorf("user %q is not local to this server", userID)
 }
@@ -96,9 +96,17 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	serverName gomatrixserverlib.ServerName,
 	supportedVersions []gomatrixserverlib.RoomVersion,
 ) error {
+	// Joins are requested and signed as the server that the user belongs
+	// to, which may be one of our virtual hosts.
+	federation, origin, err := r.federationFor(userID)
+	if err != nil {
+		return fmt.Errorf("r.federationFor: %w", err)
+	}
+	keyID, privateKey, _ := r.cfg.SigningIdentityFor(origin)
+
 	// Try to perform a make_join using the information supplied in the
 	// request.
-	respMakeJoin, err := r.federation.MakeJoin(
+	respMakeJoin, err := federation.MakeJoin(
 		ctx,
 		serverName,
 		roomID,
@@ -142,9 +150,9 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	// Build the join event.
 	event, err := respMakeJoin.JoinEvent.Build(
 		time.Now(),
-		r.cfg.Matrix.ServerName,
-		r.cfg.Matrix.KeyID,
-		r.cfg.Matrix.PrivateKey,
+		origin,
+		keyID,
+		privateKey,
 		respMakeJoin.RoomVersion,
 	)
 	if err != nil {
@@ -152,7 +160,7 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	}
 
 	// Try to perform a send_join using the newly built event.
-	respSendJoin, err := r.federation.SendJoin(
+	respSendJoin, err := federation.SendJoin(
 		ctx,
 		serverName,
 		event,
@@ -195,12 +203,20 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 	// Deduplicate the server names we were provided.
 	util.SortAndUnique(request.ServerNames)
 
+	// Leaves are requested and signed as the server that the user belongs
+	// to, which may be one of our virtual hosts.
+	federation, origin, err := r.federationFor(request.UserID)
+	if err != nil {
+		return fmt.Errorf("r.federationFor: %w", err)
+	}
+	keyID, privateKey, _ := r.cfg.SigningIdentityFor(origin)
+
 	// Try each server that we were provided until we land on one that
 	// successfully completes the make-leave send-leave dance.
 	for _, serverName := range request.ServerNames {
 		// Try to perform a make_leave using the information supplied in the
 		// request.
-		respMakeLeave, err := r.federation.MakeLeave(
+		respMakeLeave, err := federation.MakeLeave(
 			ctx,
 			serverName,
 			request.RoomID,
@@ -243,9 +259,9 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 		// Build the leave event.
 		event, err := respMakeLeave.LeaveEvent.Build(
 			time.Now(),
-			r.cfg.Matrix.ServerName,
-			r.cfg.Matrix.KeyID,
-			r.cfg.Matrix.PrivateKey,
+			origin,
+			keyID,
+			privateKey,
 			respMakeLeave.RoomVersion,
 		)
 		if err != nil {
@@ -254,7 +270,7 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 		}
 
 		// Try to perform a send_leave using the newly built event.
-		err = r.federation.SendLeave(
+		err = federation.SendLeave(
 			ctx,
 			serverName,
 			event,
@@ -288,3 +304,16 @@ func (r *FederationSenderInternalAPI) PerformServersAlive(
 
 	return nil
 }
+
+// PerformDestinationReset implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformDestinationReset(
+	ctx context.Context,
+	request *api.PerformDestinationResetRequest,
+	response *api.PerformDestinationResetResponse,
+) (err error) {
+	stats := r.statistics.ForServer(request.ServerName)
+	stats.Reset()
+	r.queues.RetryServer(request.ServerName)
+	response.Destination = *stats.Status()
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -37,3 +38,30 @@ func (f *FederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 
 	return
 }
+
+// QueryDestinationStatus implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryDestinationStatus(
+	ctx context.Context,
+	request *api.QueryDestinationStatusRequest,
+	response *api.QueryDestinationStatusResponse,
+) error {
+	serverNames := request.ServerNames
+	if len(serverNames) == 0 {
+		stored, err := f.db.GetAllDestinationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range stored {
+			serverNames = append(serverNames, status.ServerName)
+		}
+	}
+	// The in-memory statistics are authoritative, since they are
+	// restored from the database when first used.
+	response.Destinations = make([]types.DestinationStatus, 0, len(serverNames))
+	for _, serverName := range serverNames {
+		response.Destinations = append(
+			response.Destinations, *f.statistics.ForServer(serverName).Status(),
+		)
+	}
+	return nil
+}
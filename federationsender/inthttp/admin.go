@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inthttp
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// HTTP paths for the admin API. These are registered on the internal API
+// mux, so they are only reachable where the internal APIs are.
+const (
+	FederationSenderAdminDestinationsPath     = "/federationsender/admin/destinations"
+	FederationSenderAdminDestinationPath      = "/federationsender/admin/destinations/{serverName}"
+	FederationSenderAdminDestinationResetPath = "/federationsender/admin/destinations/{serverName}/reset"
+)
+
+// addAdminRoutes adds the handlers which allow server admins to inspect
+// and reset the backoff and blacklist state of remote servers.
+func addAdminRoutes(intAPI api.FederationSenderInternalAPI, internalAPIMux *mux.Router) {
+	internalAPIMux.Handle(FederationSenderAdminDestinationsPath,
+		internal.MakeInternalAPI("AdminDestinations", func(req *http.Request) util.JSONResponse {
+			var response api.QueryDestinationStatusResponse
+			if err := intAPI.QueryDestinationStatus(
+				req.Context(), &api.QueryDestinationStatusRequest{}, &response,
+			); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	).Methods(http.MethodGet)
+	internalAPIMux.Handle(FederationSenderAdminDestinationPath,
+		internal.MakeInternalAPI("AdminDestination", func(req *http.Request) util.JSONResponse {
+			vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			request := api.QueryDestinationStatusRequest{
+				ServerNames: []gomatrixserverlib.ServerName{
+					gomatrixserverlib.ServerName(vars["serverName"]),
+				},
+			}
+			var response api.QueryDestinationStatusResponse
+			if err = intAPI.QueryDestinationStatus(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if len(response.Destinations) == 0 {
+				return util.MessageResponse(http.StatusNotFound, "unknown destination")
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response.Destinations[0]}
+		}),
+	).Methods(http.MethodGet)
+	internalAPIMux.Handle(FederationSenderAdminDestinationResetPath,
+		internal.MakeInternalAPI("AdminDestinationReset", func(req *http.Request) util.JSONResponse {
+			vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			request := api.PerformDestinationResetRequest{
+				ServerName: gomatrixserverlib.ServerName(vars["serverName"]),
+			}
+			var response api.PerformDestinationResetResponse
+			if err = intAPI.PerformDestinationReset(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response.Destination}
+		}),
+	).Methods(http.MethodPost)
+}
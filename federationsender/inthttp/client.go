@@ -14,11 +14,13 @@ import (
 const (
 	FederationSenderQueryJoinedHostsInRoomPath           = "/federationsender/queryJoinedHostsInRoom"
 	FederationSenderQueryJoinedHostServerNamesInRoomPath = "/federationsender/queryJoinedHostServerNamesInRoom"
+	FederationSenderQueryDestinationStatusPath           = "/federationsender/queryDestinationStatus"
 
 	FederationSenderPerformDirectoryLookupRequestPath = "/federationsender/performDirectoryLookup"
 	FederationSenderPerformJoinRequestPath            = "/federationsender/performJoinRequest"
 	FederationSenderPerformLeaveRequestPath           = "/federationsender/performLeaveRequest"
 	FederationSenderPerformServersAlivePath           = "/federationsender/performServersAlive"
+	FederationSenderPerformDestinationResetPath       = "/federationsender/performDestinationReset"
 )
 
 // NewFederationSenderClient creates a FederationSenderInternalAPI implemented by talking to a HTTP POST API.
@@ -60,6 +62,32 @@ func (h *httpFederationSenderInternalAPI) PerformServersAlive(
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// PerformDestinationReset implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) PerformDestinationReset(
+	ctx context.Context,
+	request *api.PerformDestinationResetRequest,
+	response *api.PerformDestinationResetResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDestinationReset")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformDestinationResetPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryDestinationStatus implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryDestinationStatus(
+	ctx context.Context,
+	request *api.QueryDestinationStatusRequest,
+	response *api.QueryDestinationStatusResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDestinationStatus")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryDestinationStatusPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryJoinedHostServerNamesInRoom implements FederationSenderInternalAPI
 func (h *httpFederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	ctx context.Context,
@@ -92,4 +92,31 @@ func AddRoutes(intAPI api.FederationSenderInternalAPI, internalAPIMux *mux.Route
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(FederationSenderPerformDestinationResetPath,
+		internal.MakeInternalAPI("PerformDestinationReset", func(req *http.Request) util.JSONResponse {
+			var request api.PerformDestinationResetRequest
+			var response api.PerformDestinationResetResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := intAPI.PerformDestinationReset(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(FederationSenderQueryDestinationStatusPath,
+		internal.MakeInternalAPI("QueryDestinationStatus", func(req *http.Request) util.JSONResponse {
+			var request api.QueryDestinationStatusRequest
+			var response api.QueryDestinationStatusResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := intAPI.QueryDestinationStatus(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	addAdminRoutes(intAPI, internalAPIMux)
 }
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -29,37 +30,79 @@ import (
 	"go.uber.org/atomic"
 )
 
+// maxPDUsPerTransaction and maxEDUsPerTransaction are the maximum
+// number of PDUs and EDUs that the spec allows in a single transaction.
+// Larger backlogs are sent over several transactions.
+const (
+	maxPDUsPerTransaction = 50
+	maxEDUsPerTransaction = 100
+)
+
+// maxInvitesPerBatch is how many queued invites are read from the
+// database at a time. Each invite is sent in its own request.
+const maxInvitesPerBatch = 50
+
+// storageErrorRetryInterval is how long a queue waits before trying again
+// after failing to read from our own database.
+const storageErrorRetryInterval = time.Second * 5
+
+// storageError wraps an error from our own database when building a
+// transaction. These aren't the destination's fault, so they shouldn't
+// make us back off from or blacklist the destination.
+type storageError struct {
+	err error
+}
+
+func (e storageError) Error() string {
+	return e.err.Error()
+}
+
+// eduTTLs is how long EDUs of each type remain worth sending after they
+// were queued. EDUs that are still queued after this time, e.g. because
+// the destination was backing off, are dropped instead of being sent.
+// EDU types that aren't listed here never expire: in particular device
+// list updates and to-device messages must always be delivered.
+var eduTTLs = map[string]time.Duration{
+	gomatrixserverlib.MTyping: time.Minute,
+	"m.presence":              time.Minute * 15,
+}
+
+// eduExpiry returns the time at which an EDU of the given type queued at
+// the given time expires, or 0 if it never expires.
+func eduExpiry(eduType string, queuedAt time.Time) gomatrixserverlib.Timestamp {
+	ttl, ok := eduTTLs[eduType]
+	if !ok {
+		return 0
+	}
+	return gomatrixserverlib.AsTimestamp(queuedAt.Add(ttl))
+}
+
 // destinationQueue is a queue of events for a single destination.
 // It is responsible for sending the events to the destination and
 // ensures that only one request is in flight to a given destination
 // at a time.
 type destinationQueue struct {
-	rsProducer         *producers.RoomserverProducer           // roomserver producer
-	client             *gomatrixserverlib.FederationClient     // federation client
-	origin             gomatrixserverlib.ServerName            // origin of requests
-	destination        gomatrixserverlib.ServerName            // destination of requests
-	running            atomic.Bool                             // is the queue worker running?
-	backingOff         atomic.Bool                             // true if we're backing off
-	statistics         *types.ServerStatistics                 // statistics about this remote server
-	incomingPDUs       chan *gomatrixserverlib.HeaderedEvent   // PDUs to send
-	incomingEDUs       chan *gomatrixserverlib.EDU             // EDUs to send
-	incomingInvites    chan *gomatrixserverlib.InviteV2Request // invites to send
-	lastTransactionIDs []gomatrixserverlib.TransactionID       // last transaction ID
-	pendingPDUs        []*gomatrixserverlib.HeaderedEvent      // owned by backgroundSend
-	pendingEDUs        []*gomatrixserverlib.EDU                // owned by backgroundSend
-	pendingInvites     []*gomatrixserverlib.InviteV2Request    // owned by backgroundSend
-	retryServerCh      chan bool                               // interrupts backoff
+	db                 storage.Database                                                     // federation sender database
+	rsProducer         *producers.RoomserverProducer                                        // roomserver producer
+	clients            map[gomatrixserverlib.ServerName]*gomatrixserverlib.FederationClient // federation clients by local origin
+	origin             gomatrixserverlib.ServerName                                         // default origin of requests
+	destination        gomatrixserverlib.ServerName                                         // destination of requests
+	running            atomic.Bool                                                          // is the queue worker running?
+	backingOff         atomic.Bool                                                          // true if we're backing off
+	statistics         *types.ServerStatistics                                              // statistics about this remote server
+	notifyPDUs         chan bool                                                            // interrupts idle wait for PDUs
+	notifyEDUs         chan bool                                                            // interrupts idle wait for EDUs
+	notifyInvites      chan bool                                                            // interrupts idle wait for invites
+	lastTransactionIDs []gomatrixserverlib.TransactionID                                    // last transaction ID
+	pendingPDUs        atomic.Int64                                                         // how many PDUs are waiting to be sent
+	pendingEDUs        atomic.Int64                                                         // how many EDUs are waiting to be sent
+	pendingInvites     atomic.Int64                                                         // how many invites are waiting to be sent
+	retryServerCh      chan bool                                                            // interrupts backoff
 }
 
 // retry will clear the blacklist state and attempt to send built up events to the server,
 // resetting and interrupting any backoff timers.
 func (oq *destinationQueue) retry() {
-	// TODO: We don't send all events in the case where the server has been blacklisted as we
-	// drop events instead then. This means we will send the oldest N events (chan size, currently 128)
-	// and then skip ahead a lot which feels non-ideal but equally we can't persist thousands of events
-	// in-memory to maybe-send it one day. Ideally we would just shove these pending events in a database
-	// so we can send a lot of events.
-	//
 	// Interrupt the backoff. If the federation request that happens as a result of this is successful
 	// then the counters will be reset there and the backoff will cancel. If the federation request
 	// fails then we will retry at the current backoff interval, so as to prevent us from spamming
@@ -69,52 +112,90 @@ func (oq *destinationQueue) retry() {
 	if oq.backingOff.CAS(true, false) {
 		oq.retryServerCh <- true
 	}
-	if !oq.running.Load() {
+	// Only restart the worker if there is actually something to send,
+	// since retry() is called whenever we hear from the remote server.
+	if !oq.running.Load() && (oq.pendingPDUs.Load() > 0 || oq.pendingEDUs.Load() > 0 || oq.pendingInvites.Load() > 0) {
 		log.Infof("Restarting queue for %s", oq.destination)
 		go oq.backgroundSend()
 	}
 }
 
-// Send event adds the event to the pending queue for the destination.
-// If the queue is empty then it starts a background goroutine to
-// start sending events to that destination.
-func (oq *destinationQueue) sendEvent(ev *gomatrixserverlib.HeaderedEvent) {
-	if oq.statistics.Blacklisted() {
-		// If the destination is blacklisted then drop the event.
-		return
+// refreshPendingCounts updates the number of pending PDUs, EDUs and
+// invites from the database.
+func (oq *destinationQueue) refreshPendingCounts() {
+	ctx := context.TODO()
+	if count, err := oq.db.GetPendingPDUCount(ctx, oq.destination); err == nil {
+		oq.pendingPDUs.Store(count)
+	} else {
+		log.WithError(err).Errorf("failed to get pending PDU count for %q", oq.destination)
 	}
-	if !oq.running.Load() {
-		go oq.backgroundSend()
+	if count, err := oq.db.GetPendingEDUCount(ctx, oq.destination); err == nil {
+		oq.pendingEDUs.Store(count)
+	} else {
+		log.WithError(err).Errorf("failed to get pending EDU count for %q", oq.destination)
+	}
+	if count, err := oq.db.GetPendingInviteCount(ctx, oq.destination); err == nil {
+		oq.pendingInvites.Store(count)
+	} else {
+		log.WithError(err).Errorf("failed to get pending invite count for %q", oq.destination)
 	}
-	oq.incomingPDUs <- ev
 }
 
-// sendEDU adds the EDU event to the pending queue for the destination.
-// If the queue is empty then it starts a background goroutine to
-// start sending events to that destination.
-func (oq *destinationQueue) sendEDU(ev *gomatrixserverlib.EDU) {
+// wakeQueueIfNeeded will wake up the destination queue if it is
+// not already running. If it is running but it is backing off
+// then we will interrupt the backoff, causing any federation
+// requests to retry.
+func (oq *destinationQueue) wakeQueueIfNeeded() {
+	// If the destination is blacklisted then leave the queued events
+	// in the database. They will be sent when retry() is called.
 	if oq.statistics.Blacklisted() {
-		// If the destination is blacklisted then drop the event.
 		return
 	}
 	if !oq.running.Load() {
 		go oq.backgroundSend()
 	}
-	oq.incomingEDUs <- ev
 }
 
-// sendInvite adds the invite event to the pending queue for the
-// destination. If the queue is empty then it starts a background
-// goroutine to start sending events to that destination.
-func (oq *destinationQueue) sendInvite(ev *gomatrixserverlib.InviteV2Request) {
-	if oq.statistics.Blacklisted() {
-		// If the destination is blacklisted then drop the event.
-		return
+// sendEvent tells the queue that a new event has been queued for the
+// destination in the database. The event will still be sent after a
+// restart or once a blacklisted server is retried. If the queue is not
+// running then it starts a background goroutine to start sending events
+// to that destination.
+func (oq *destinationQueue) sendEvent() {
+	oq.pendingPDUs.Inc()
+	oq.wakeQueueIfNeeded()
+	select {
+	case oq.notifyPDUs <- true:
+	default:
 	}
-	if !oq.running.Load() {
-		go oq.backgroundSend()
+}
+
+// sendEDU tells the queue that a new EDU has been queued for the
+// destination in the database. The EDU will still be sent after a restart
+// or once a blacklisted server is retried, unless it expires first. If the
+// queue is not running then it starts a background goroutine to start
+// sending events to that destination.
+func (oq *destinationQueue) sendEDU() {
+	oq.pendingEDUs.Inc()
+	oq.wakeQueueIfNeeded()
+	select {
+	case oq.notifyEDUs <- true:
+	default:
+	}
+}
+
+// sendInvite tells the queue that a new invite has been queued for the
+// destination in the database. Like events, the invite will still be sent
+// after a restart or once a blacklisted server is retried. If the queue is
+// not running then it starts a background goroutine to start sending events
+// to that destination.
+func (oq *destinationQueue) sendInvite() {
+	oq.pendingInvites.Inc()
+	oq.wakeQueueIfNeeded()
+	select {
+	case oq.notifyInvites <- true:
+	default:
 	}
-	oq.incomingInvites <- ev
 }
 
 // backgroundSend is the worker goroutine for sending events.
@@ -128,58 +209,28 @@ func (oq *destinationQueue) backgroundSend() {
 	defer oq.running.Store(false)
 
 	for {
-		// Wait either for incoming events, or until we hit an
-		// idle timeout.
-		select {
-		case pdu := <-oq.incomingPDUs:
-			// Ordering of PDUs is important so we add them to the end
-			// of the queue and they will all be added to transactions
-			// in order.
-			oq.pendingPDUs = append(oq.pendingPDUs, pdu)
-			// If there are any more things waiting in the channel queue
-			// then read them. This is safe because we guarantee only
-			// having one goroutine per destination queue, so the channel
-			// isn't being consumed anywhere else.
-			for len(oq.incomingPDUs) > 0 {
-				oq.pendingPDUs = append(oq.pendingPDUs, <-oq.incomingPDUs)
-			}
-		case edu := <-oq.incomingEDUs:
-			// Likewise for EDUs, although we should probably not try
-			// too hard with some EDUs (like typing notifications) after
-			// a certain amount of time has passed.
-			// TODO: think about EDU expiry some more
-			oq.pendingEDUs = append(oq.pendingEDUs, edu)
-			// If there are any more things waiting in the channel queue
-			// then read them. This is safe because we guarantee only
-			// having one goroutine per destination queue, so the channel
-			// isn't being consumed anywhere else.
-			for len(oq.incomingEDUs) > 0 {
-				oq.pendingEDUs = append(oq.pendingEDUs, <-oq.incomingEDUs)
-			}
-		case invite := <-oq.incomingInvites:
-			// There's no strict ordering requirement for invites like
-			// there is for transactions, so we put the invite onto the
-			// front of the queue. This means that if an invite that is
-			// stuck failing already, that it won't block our new invite
-			// from being sent.
-			oq.pendingInvites = append(
-				[]*gomatrixserverlib.InviteV2Request{invite},
-				oq.pendingInvites...,
-			)
-			// If there are any more things waiting in the channel queue
-			// then read them. This is safe because we guarantee only
-			// having one goroutine per destination queue, so the channel
-			// isn't being consumed anywhere else.
-			for len(oq.incomingInvites) > 0 {
-				oq.pendingInvites = append(oq.pendingInvites, <-oq.incomingInvites)
+		// If we have nothing to do then wait either for incoming events,
+		// or until we hit an idle timeout.
+		if oq.pendingPDUs.Load() == 0 && oq.pendingEDUs.Load() == 0 && oq.pendingInvites.Load() == 0 {
+			select {
+			case <-oq.notifyPDUs:
+				// New PDUs have been queued in the database. They will
+				// be picked up in order when building the transaction.
+			case <-oq.notifyEDUs:
+				// Likewise for EDUs. EDUs that have expired by the time
+				// we build the transaction are dropped instead of sent.
+			case <-oq.notifyInvites:
+				// Likewise for invites. There's no strict ordering
+				// requirement for invites like there is for transactions,
+				// so the newest invites are sent first. This means that an
+				// invite that is stuck failing won't block a new one.
+			case <-time.After(time.Second * 30):
+				// The worker is idle so stop the goroutine. It'll
+				// get restarted automatically the next time we
+				// get an event.
+				return
 			}
-		case <-time.After(time.Second * 30):
-			// The worker is idle so stop the goroutine. It'll
-			// get restarted automatically the next time we
-			// get an event.
-			return
 		}
-
 		// If we are backing off this server then wait for the
 		// backoff duration to complete first, or until explicitly
 		// told to retry.
@@ -192,86 +243,117 @@ func (oq *destinationQueue) backgroundSend() {
 			oq.backingOff.Store(false)
 		}
 
-		// How many things do we have waiting?
-		numPDUs := len(oq.pendingPDUs)
-		numEDUs := len(oq.pendingEDUs)
-		numInvites := len(oq.pendingInvites)
-
 		// If we have pending PDUs or EDUs then construct a transaction.
-		if numPDUs > 0 || numEDUs > 0 {
+		if oq.pendingPDUs.Load() > 0 || oq.pendingEDUs.Load() > 0 {
 			// Try sending the next transaction and see what happens.
-			transaction, terr := oq.nextTransaction(oq.pendingPDUs, oq.pendingEDUs, oq.statistics.SuccessCount())
-			if terr != nil {
+			transaction, terr := oq.nextTransaction(oq.statistics.SuccessCount())
+			if _, ok := terr.(storageError); ok {
+				// We failed to read from our own database, so try again
+				// shortly without counting it against the destination.
+				time.Sleep(storageErrorRetryInterval)
+				continue
+			} else if terr != nil {
 				// We failed to send the transaction.
 				if giveUp := oq.statistics.Failure(); giveUp {
 					// It's been suggested that we should give up because
 					// the backoff has exceeded a maximum allowable value.
+					// The events stay in the database and will be sent
+					// if the server is retried.
 					return
 				}
 			} else if transaction {
-				// If we successfully sent the transaction then clear out
-				// the pending events and EDUs.
+				// If we successfully sent the transaction then the
+				// events and EDUs have been cleared from the database.
 				oq.statistics.Success()
-				// Reallocate so that the underlying arrays can be GC'd, as
-				// opposed to growing forever.
-				for i := 0; i < numPDUs; i++ {
-					oq.pendingPDUs[i] = nil
-				}
-				for i := 0; i < numEDUs; i++ {
-					oq.pendingEDUs[i] = nil
-				}
-				oq.pendingPDUs = append(
-					[]*gomatrixserverlib.HeaderedEvent{},
-					oq.pendingPDUs[numPDUs:]...,
-				)
-				oq.pendingEDUs = append(
-					[]*gomatrixserverlib.EDU{},
-					oq.pendingEDUs[numEDUs:]...,
-				)
 			}
 		}
 
-		// Try sending the next invite and see what happens.
-		if numInvites > 0 {
-			sent, ierr := oq.nextInvites(oq.pendingInvites)
-			if ierr != nil {
-				// We failed to send the transaction so increase the
+		// Try sending the next invites and see what happens.
+		if oq.pendingInvites.Load() > 0 {
+			sent, ierr := oq.nextInvites()
+			if _, ok := ierr.(storageError); ok {
+				// As above, this isn't the destination's fault.
+				time.Sleep(storageErrorRetryInterval)
+				continue
+			} else if ierr != nil {
+				// We failed to send the invite so increase the
 				// backoff and give it another go shortly.
 				if giveUp := oq.statistics.Failure(); giveUp {
 					// It's been suggested that we should give up because
 					// the backoff has exceeded a maximum allowable value.
+					// The invites stay in the database and will be sent
+					// if the server is retried.
 					return
 				}
 			} else if sent > 0 {
-				// If we successfully sent the invites then clear out
-				// the pending invites.
+				// If we successfully sent the invites then they have
+				// been cleared from the database.
 				oq.statistics.Success()
-				// Reallocate so that the underlying array can be GC'd, as
-				// opposed to growing forever.
-				oq.pendingInvites = append(
-					[]*gomatrixserverlib.InviteV2Request{},
-					oq.pendingInvites[sent:]...,
-				)
 			}
 		}
 	}
 }
 
-// nextTransaction creates a new transaction from the pending event
-// queue and sends it. Returns true if a transaction was sent or
-// false otherwise.
+// nextTransaction creates a new transaction from the oldest PDUs and
+// EDUs queued in the database and sends it. All of the PDUs and EDUs in
+// a transaction are sent from the same local origin. Returns true if a
+// transaction was sent or false otherwise.
 func (oq *destinationQueue) nextTransaction(
-	pendingPDUs []*gomatrixserverlib.HeaderedEvent,
-	pendingEDUs []*gomatrixserverlib.EDU,
 	sentCounter uint32,
 ) (bool, error) {
+	ctx := context.TODO()
+
+	// Drop any EDUs that are no longer worth sending, e.g. typing
+	// notifications that have built up while backing off.
+	expired, err := oq.db.CleanExpiredEDUs(ctx, oq.destination, gomatrixserverlib.AsTimestamp(time.Now()))
+	if err != nil {
+		log.WithError(err).Errorf("failed to clean expired EDUs for %q", oq.destination)
+		return false, storageError{err}
+	}
+	if expired > 0 {
+		log.WithField("server_name", oq.destination).Infof("Dropped %d expired EDUs", expired)
+		oq.pendingEDUs.Sub(expired)
+	}
+
+	origin, err := oq.db.GetNextTransactionOrigin(ctx, oq.destination)
+	if err != nil {
+		log.WithError(err).Errorf("failed to get next transaction origin for %q", oq.destination)
+		return false, storageError{err}
+	}
+
+	pduNIDs, pdus, err := oq.db.GetNextTransactionPDUs(ctx, origin, oq.destination, maxPDUsPerTransaction)
+	if err != nil {
+		log.WithError(err).Errorf("failed to get next transaction PDUs for %q", oq.destination)
+		return false, storageError{err}
+	}
+	eduNIDs, edus, err := oq.db.GetNextTransactionEDUs(ctx, origin, oq.destination, maxEDUsPerTransaction)
+	if err != nil {
+		log.WithError(err).Errorf("failed to get next transaction EDUs for %q", oq.destination)
+		return false, storageError{err}
+	}
+
+	// If there was nothing in the database then our pending counts
+	// were out of date, so refresh them and don't bother sending.
+	if len(pduNIDs) == 0 && len(eduNIDs) == 0 {
+		oq.refreshPendingCounts()
+		return false, nil
+	}
+
+	client, ok := oq.clients[origin]
+	if !ok {
+		// The origin isn't hosted here any more, e.g. because a virtual
+		// host was removed from the config, so send from the default
+		// origin instead.
+		origin, client = oq.origin, oq.clients[oq.origin]
+	}
+
 	t := gomatrixserverlib.Transaction{
 		PDUs: []json.RawMessage{},
 		EDUs: []gomatrixserverlib.EDU{},
 	}
 	now := gomatrixserverlib.AsTimestamp(time.Now())
 	t.TransactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%d-%d", now, sentCounter))
-	t.Origin = oq.origin
+	t.Origin = origin
 	t.Destination = oq.destination
 	t.OriginServerTS = now
 	t.PreviousIDs = oq.lastTransactionIDs
@@ -281,13 +363,11 @@ func (oq *destinationQueue) nextTransaction(
 
 	oq.lastTransactionIDs = []gomatrixserverlib.TransactionID{t.TransactionID}
 
-	for _, pdu := range pendingPDUs {
-		// Append the JSON of the event, since this is a json.RawMessage type in the
-		// gomatrixserverlib.Transaction struct
-		t.PDUs = append(t.PDUs, (*pdu).JSON())
-	}
+	// The PDUs are already the JSON of the event, since this is a
+	// json.RawMessage type in the gomatrixserverlib.Transaction struct
+	t.PDUs = append(t.PDUs, pdus...)
 
-	for _, edu := range pendingEDUs {
+	for _, edu := range edus {
 		t.EDUs = append(t.EDUs, *edu)
 	}
 
@@ -296,11 +376,12 @@ func (oq *destinationQueue) nextTransaction(
 	// TODO: we should check for 500-ish fails vs 400-ish here,
 	// since we shouldn't queue things indefinitely in response
 	// to a 400-ish error
-	_, err := oq.client.SendTransaction(context.TODO(), t)
+	_, err = client.SendTransaction(context.TODO(), t)
 	switch e := err.(type) {
 	case nil:
 		// No error was returned so the transaction looks to have
 		// been successfully sent.
+		oq.cleanPendingItems(ctx, pduNIDs, eduNIDs)
 		return true, nil
 	case gomatrix.HTTPError:
 		// We received a HTTP error back. In this instance we only
@@ -308,6 +389,7 @@ func (oq *destinationQueue) nextTransaction(
 		if e.Code >= 400 && e.Code <= 499 {
 			// We tried but the remote side has sent back a client error.
 			// It's no use retrying because it will happen again.
+			oq.cleanPendingItems(ctx, pduNIDs, eduNIDs)
 			return true, nil
 		}
 		// Otherwise, report that we failed to send the transaction
@@ -322,13 +404,57 @@ func (oq *destinationQueue) nextTransaction(
 	}
 }
 
-// nextInvite takes pending invite events from the queue and sends
-// them. Returns true if a transaction was sent or false otherwise.
-func (oq *destinationQueue) nextInvites(
-	pendingInvites []*gomatrixserverlib.InviteV2Request,
-) (int, error) {
+// cleanPendingItems removes the PDUs and EDUs that were included in a
+// transaction from the database and updates the pending counts.
+func (oq *destinationQueue) cleanPendingItems(
+	ctx context.Context, pduNIDs, eduNIDs []int64,
+) {
+	if len(pduNIDs) > 0 {
+		if err := oq.db.CleanPDUs(ctx, oq.destination, pduNIDs); err != nil {
+			log.WithError(err).Errorf("failed to clean PDUs for %q", oq.destination)
+		}
+		oq.pendingPDUs.Sub(int64(len(pduNIDs)))
+	}
+	if len(eduNIDs) > 0 {
+		if err := oq.db.CleanEDUs(ctx, oq.destination, eduNIDs); err != nil {
+			log.WithError(err).Errorf("failed to clean EDUs for %q", oq.destination)
+		}
+		oq.pendingEDUs.Sub(int64(len(eduNIDs)))
+	}
+	if oq.pendingPDUs.Load() < 0 || oq.pendingEDUs.Load() < 0 {
+		oq.refreshPendingCounts()
+	}
+}
+
+// nextInvites takes the newest invites queued in the database and sends
+// them, removing the ones that are done with from the database. Returns
+// how many invites were done with, stopping at the first one that should
+// be retried.
+func (oq *destinationQueue) nextInvites() (int, error) {
+	ctx := context.TODO()
+	nids, invites, gerr := oq.db.GetNextInvites(ctx, oq.destination, maxInvitesPerBatch)
+	if gerr != nil {
+		log.WithError(gerr).Errorf("failed to get next invites for %q", oq.destination)
+		return 0, storageError{gerr}
+	}
+
+	// If there was nothing in the database then our pending counts
+	// were out of date, so refresh them and don't bother sending.
+	if len(nids) == 0 {
+		oq.refreshPendingCounts()
+		return 0, nil
+	}
+
 	done := 0
-	for _, inviteReq := range pendingInvites {
+	defer func() {
+		oq.cleanInvites(ctx, nids[:done])
+	}()
+	for _, inviteReq := range invites {
+		if inviteReq == nil {
+			// The invite couldn't be parsed, so it will never send.
+			done++
+			continue
+		}
 		ev, roomVersion := inviteReq.Event(), inviteReq.RoomVersion()
 
 		log.WithFields(log.Fields{
@@ -337,7 +463,14 @@ func (oq *destinationQueue) nextInvites(
 			"destination":  oq.destination,
 		}).Info("sending invite")
 
-		inviteRes, err := oq.client.SendInviteV2(
+		// Send the invite from the server that created it, if that's
+		// one of ours, so that the request is signed with the right key.
+		client, ok := oq.clients[ev.Origin()]
+		if !ok {
+			client = oq.clients[oq.origin]
+		}
+
+		inviteRes, err := client.SendInviteV2(
 			context.TODO(),
 			oq.destination,
 			*inviteReq,
@@ -386,3 +519,18 @@ func (oq *destinationQueue) nextInvites(
 
 	return done, nil
 }
+
+// cleanInvites removes the invites that are done with from the database
+// and updates the pending count.
+func (oq *destinationQueue) cleanInvites(ctx context.Context, nids []int64) {
+	if len(nids) == 0 {
+		return
+	}
+	if err := oq.db.CleanInvites(ctx, oq.destination, nids); err != nil {
+		log.WithError(err).Errorf("failed to clean invites for %q", oq.destination)
+	}
+	oq.pendingInvites.Sub(int64(len(nids)))
+	if oq.pendingInvites.Load() < 0 {
+		oq.refreshPendingCounts()
+	}
+}
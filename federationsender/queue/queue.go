@@ -15,10 +15,14 @@
 package queue
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -28,34 +32,55 @@ import (
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
+	db          storage.Database
 	rsProducer  *producers.RoomserverProducer
 	origin      gomatrixserverlib.ServerName
-	client      *gomatrixserverlib.FederationClient
+	clients     map[gomatrixserverlib.ServerName]*gomatrixserverlib.FederationClient
 	statistics  *types.Statistics
+	shard       types.Shard
 	queuesMutex sync.Mutex // protects the below
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
 }
 
-// NewOutgoingQueues makes a new OutgoingQueues
+// NewOutgoingQueues makes a new OutgoingQueues. The client is used to send
+// requests from the origin, and the virtualHosts clients are used to send
+// requests from any other local server names. Any destinations owned by
+// the shard that still have PDUs or EDUs queued in the database, e.g. from
+// before a restart, will have their queues started again.
 func NewOutgoingQueues(
+	db storage.Database,
 	origin gomatrixserverlib.ServerName,
 	client *gomatrixserverlib.FederationClient,
+	virtualHosts map[gomatrixserverlib.ServerName]*gomatrixserverlib.FederationClient,
 	rsProducer *producers.RoomserverProducer,
 	statistics *types.Statistics,
+	shard types.Shard,
 ) *OutgoingQueues {
-	return &OutgoingQueues{
+	clients := map[gomatrixserverlib.ServerName]*gomatrixserverlib.FederationClient{
+		origin: client,
+	}
+	for serverName, vhostClient := range virtualHosts {
+		clients[serverName] = vhostClient
+	}
+	queues := &OutgoingQueues{
+		db:         db,
 		rsProducer: rsProducer,
 		origin:     origin,
-		client:     client,
+		clients:    clients,
 		statistics: statistics,
+		shard:      shard,
 		queues:     map[gomatrixserverlib.ServerName]*destinationQueue{},
 	}
-}
-
-func (oqs *OutgoingQueues) getQueueIfExists(destination gomatrixserverlib.ServerName) *destinationQueue {
-	oqs.queuesMutex.Lock()
-	defer oqs.queuesMutex.Unlock()
-	return oqs.queues[destination]
+	// Look up which servers we have pending items for and then rehydrate
+	// those queues.
+	serverNames, err := db.GetPendingServerNames(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Failed to get server names with pending items")
+	}
+	for _, serverName := range shard.Filter(serverNames) {
+		queues.getQueue(serverName).wakeQueueIfNeeded()
+	}
+	return queues
 }
 
 func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *destinationQueue {
@@ -64,16 +89,18 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 	oq := oqs.queues[destination]
 	if oq == nil {
 		oq = &destinationQueue{
-			rsProducer:      oqs.rsProducer,
-			origin:          oqs.origin,
-			destination:     destination,
-			client:          oqs.client,
-			statistics:      oqs.statistics.ForServer(destination),
-			incomingPDUs:    make(chan *gomatrixserverlib.HeaderedEvent, 128),
-			incomingEDUs:    make(chan *gomatrixserverlib.EDU, 128),
-			incomingInvites: make(chan *gomatrixserverlib.InviteV2Request, 128),
-			retryServerCh:   make(chan bool),
+			db:            oqs.db,
+			rsProducer:    oqs.rsProducer,
+			origin:        oqs.origin,
+			destination:   destination,
+			clients:       oqs.clients,
+			statistics:    oqs.statistics.ForServer(destination),
+			notifyPDUs:    make(chan bool, 1),
+			notifyEDUs:    make(chan bool, 1),
+			notifyInvites: make(chan bool, 1),
+			retryServerCh: make(chan bool),
 		}
+		oq.refreshPendingCounts()
 		oqs.queues[destination] = oq
 	}
 	return oq
@@ -84,23 +111,33 @@ func (oqs *OutgoingQueues) SendEvent(
 	ev *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName,
 	destinations []gomatrixserverlib.ServerName,
 ) error {
-	if origin != oqs.origin {
-		// TODO: Support virtual hosting; gh issue #577.
+	if _, ok := oqs.clients[origin]; !ok {
 		return fmt.Errorf(
-			"sendevent: unexpected server to send as: got %q expected %q",
-			origin, oqs.origin,
+			"sendevent: unexpected server to send as: got %q which is not a local server name",
+			origin,
 		)
 	}
 
-	// Remove our own server from the list of destinations.
-	destinations = filterAndDedupeDests(oqs.origin, destinations)
+	// Remove our own server names from the list of destinations.
+	destinations = oqs.filterAndDedupeDests(destinations)
+
+	if len(destinations) == 0 {
+		return nil
+	}
 
 	log.WithFields(log.Fields{
 		"destinations": destinations, "event": ev.EventID(),
 	}).Info("Sending event")
 
+	// Store the event JSON once and queue it for every destination in
+	// the same database transaction, so that it survives restarts and
+	// isn't duplicated, before waking up any of the queues.
+	if err := oqs.db.QueuePDU(context.TODO(), origin, destinations, string(ev.JSON())); err != nil {
+		return fmt.Errorf("sendevent: oqs.db.QueuePDU: %w", err)
+	}
+
 	for _, destination := range destinations {
-		oqs.getQueue(destination).sendEvent(ev)
+		oqs.getQueue(destination).sendEvent()
 	}
 
 	return nil
@@ -133,7 +170,18 @@ func (oqs *OutgoingQueues) SendInvite(
 		"server_name": destination,
 	}).Info("Sending invite")
 
-	oqs.getQueue(destination).sendInvite(inviteReq)
+	inviteJSON, err := json.Marshal(inviteReq)
+	if err != nil {
+		return fmt.Errorf("sendinvite: json.Marshal: %w", err)
+	}
+
+	// Store the invite so that it isn't lost if we restart or if the
+	// destination is blacklisted, like SendEvent.
+	if err = oqs.db.QueueInvite(context.TODO(), destination, string(inviteJSON)); err != nil {
+		return fmt.Errorf("sendinvite: oqs.db.QueueInvite: %w", err)
+	}
+
+	oqs.getQueue(destination).sendInvite()
 
 	return nil
 }
@@ -143,42 +191,68 @@ func (oqs *OutgoingQueues) SendEDU(
 	e *gomatrixserverlib.EDU, origin gomatrixserverlib.ServerName,
 	destinations []gomatrixserverlib.ServerName,
 ) error {
-	if origin != oqs.origin {
-		// TODO: Support virtual hosting; gh issue #577.
+	if _, ok := oqs.clients[origin]; !ok {
 		return fmt.Errorf(
-			"sendevent: unexpected server to send as: got %q expected %q",
-			origin, oqs.origin,
+			"sendedu: unexpected server to send as: got %q which is not a local server name",
+			origin,
 		)
 	}
 
-	// Remove our own server from the list of destinations.
-	destinations = filterAndDedupeDests(oqs.origin, destinations)
+	// Remove our own server names from the list of destinations.
+	destinations = oqs.filterAndDedupeDests(destinations)
 
-	if len(destinations) > 0 {
-		log.WithFields(log.Fields{
-			"destinations": destinations, "edu_type": e.Type,
-		}).Info("Sending EDU event")
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"destinations": destinations, "edu_type": e.Type,
+	}).Info("Sending EDU event")
+
+	ephemeralJSON, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("sendedu: json.Marshal: %w", err)
+	}
+
+	// Store the EDU JSON once and queue it for every destination in
+	// the same database transaction, like SendEvent.
+	expiresAt := eduExpiry(e.Type, time.Now())
+	if err = oqs.db.QueueEDU(context.TODO(), origin, destinations, e.Type, string(ephemeralJSON), expiresAt); err != nil {
+		return fmt.Errorf("sendedu: oqs.db.QueueEDU: %w", err)
 	}
 
 	for _, destination := range destinations {
-		oqs.getQueue(destination).sendEDU(e)
+		oqs.getQueue(destination).sendEDU()
 	}
 
 	return nil
 }
 
 // RetryServer attempts to resend events to the given server if we had given up.
+// If the server was blacklisted then its backoff and blacklist state are reset,
+// since hearing from it suggests that it has come back.
 func (oqs *OutgoingQueues) RetryServer(srv gomatrixserverlib.ServerName) {
-	q := oqs.getQueueIfExists(srv)
-	if q == nil {
+	stats := oqs.statistics.ForServer(srv)
+	owned := oqs.shard.Owns(srv)
+	if !owned {
+		// The shard that owns the destination is the one that updates its
+		// state, so what we have in memory may be out of date. The owner
+		// picks up the reset from the database.
+		stats.Refresh()
+	}
+	if stats.Blacklisted() {
+		stats.Reset()
+	}
+	// Only the shard that owns the destination sends anything to it.
+	if !owned {
 		return
 	}
-	q.retry()
+	oqs.getQueue(srv).retry()
 }
 
-// filterAndDedupeDests removes our own server from the list of destinations
+// filterAndDedupeDests removes our own server names from the list of destinations
 // and deduplicates any servers in the list that may appear more than once.
-func filterAndDedupeDests(origin gomatrixserverlib.ServerName, destinations []gomatrixserverlib.ServerName) (
+func (oqs *OutgoingQueues) filterAndDedupeDests(destinations []gomatrixserverlib.ServerName) (
 	result []gomatrixserverlib.ServerName,
 ) {
 	strs := make([]string, len(destinations))
@@ -186,7 +260,7 @@ func filterAndDedupeDests(origin gomatrixserverlib.ServerName, destinations []go
 		strs[i] = string(d)
 	}
 	for _, destination := range util.UniqueStrings(strs) {
-		if gomatrixserverlib.ServerName(destination) == origin {
+		if _, ok := oqs.clients[gomatrixserverlib.ServerName(destination)]; ok {
 			continue
 		}
 		result = append(result, gomatrixserverlib.ServerName(destination))
@@ -16,13 +16,33 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
 	internal.PartitionStorer
 	UpdateRoom(ctx context.Context, roomID, oldEventID, newEventID string, addHosts []types.JoinedHost, removeHosts []string) (joinedHosts []types.JoinedHost, err error)
 	GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
+	QueuePDU(ctx context.Context, origin gomatrixserverlib.ServerName, destinations []gomatrixserverlib.ServerName, js string) error
+	QueueEDU(ctx context.Context, origin gomatrixserverlib.ServerName, destinations []gomatrixserverlib.ServerName, eduType string, js string, expiresAt gomatrixserverlib.Timestamp) error
+	QueueInvite(ctx context.Context, serverName gomatrixserverlib.ServerName, js string) error
+	GetNextTransactionOrigin(ctx context.Context, serverName gomatrixserverlib.ServerName) (gomatrixserverlib.ServerName, error)
+	GetNextTransactionPDUs(ctx context.Context, origin, serverName gomatrixserverlib.ServerName, limit int) (jsonNIDs []int64, pdus []json.RawMessage, err error)
+	GetNextTransactionEDUs(ctx context.Context, origin, serverName gomatrixserverlib.ServerName, limit int) (jsonNIDs []int64, edus []*gomatrixserverlib.EDU, err error)
+	GetNextInvites(ctx context.Context, serverName gomatrixserverlib.ServerName, limit int) (jsonNIDs []int64, invites []*gomatrixserverlib.InviteV2Request, err error)
+	CleanPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, jsonNIDs []int64) error
+	CleanEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, jsonNIDs []int64) error
+	CleanInvites(ctx context.Context, serverName gomatrixserverlib.ServerName, jsonNIDs []int64) error
+	CleanExpiredEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, now gomatrixserverlib.Timestamp) (int64, error)
+	GetPendingPDUCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
+	GetPendingEDUCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
+	GetPendingInviteCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
+	GetPendingServerNames(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
+	GetDestinationStatus(ctx context.Context, serverName gomatrixserverlib.ServerName) (*types.DestinationStatus, error)
+	GetAllDestinationStatuses(ctx context.Context) ([]types.DestinationStatus, error)
+	UpdateDestinationStatus(ctx context.Context, status *types.DestinationStatus) error
 }
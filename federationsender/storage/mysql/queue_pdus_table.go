@@ -0,0 +1,210 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queuePDUsSchema = `
+-- The queue_pdus table stores the PDUs that are waiting to be sent to
+-- each remote server. The PDUs are sent in json_nid order, which is the
+-- order in which they were queued.
+CREATE TABLE IF NOT EXISTS federationsender_queue_pdus (
+    -- The local server name that the PDU is sent from.
+    origin TEXT NOT NULL,
+    -- The destination server that the PDU is queued for.
+    server_name TEXT NOT NULL,
+    -- The JSON NID from the federationsender_queue_json table.
+    json_nid BIGINT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS federationsender_queue_pdus_json_nid_idx
+    ON federationsender_queue_pdus (json_nid, server_name);
+`
+
+const insertQueuePDUSQL = "" +
+	"INSERT INTO federationsender_queue_pdus (origin, server_name, json_nid)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteQueuePDUsSQL = "" +
+	"DELETE FROM federationsender_queue_pdus WHERE server_name = $1 AND json_nid = $2"
+
+const selectQueuePDUsSQL = "" +
+	"SELECT json_nid FROM federationsender_queue_pdus" +
+	" WHERE server_name = $1 AND origin = $2" +
+	" ORDER BY json_nid ASC" +
+	" LIMIT $3"
+
+const selectQueuePDUNextOriginSQL = "" +
+	"SELECT origin FROM federationsender_queue_pdus" +
+	" WHERE server_name = $1" +
+	" ORDER BY json_nid ASC" +
+	" LIMIT 1"
+
+const selectQueuePDUReferenceJSONCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_pdus" +
+	" WHERE json_nid = $1"
+
+const selectQueuePDUsCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_pdus" +
+	" WHERE server_name = $1"
+
+const selectQueuePDUServerNamesSQL = "" +
+	"SELECT DISTINCT server_name FROM federationsender_queue_pdus"
+
+type queuePDUsStatements struct {
+	insertQueuePDUStmt                   *sql.Stmt
+	deleteQueuePDUsStmt                  *sql.Stmt
+	selectQueuePDUsStmt                  *sql.Stmt
+	selectQueuePDUNextOriginStmt         *sql.Stmt
+	selectQueuePDUReferenceJSONCountStmt *sql.Stmt
+	selectQueuePDUsCountStmt             *sql.Stmt
+	selectQueuePDUServerNamesStmt        *sql.Stmt
+}
+
+func (s *queuePDUsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queuePDUsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueuePDUStmt, err = db.Prepare(insertQueuePDUSQL); err != nil {
+		return
+	}
+	if s.deleteQueuePDUsStmt, err = db.Prepare(deleteQueuePDUsSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUsStmt, err = db.Prepare(selectQueuePDUsSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUNextOriginStmt, err = db.Prepare(selectQueuePDUNextOriginSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUReferenceJSONCountStmt, err = db.Prepare(selectQueuePDUReferenceJSONCountSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUsCountStmt, err = db.Prepare(selectQueuePDUsCountSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUServerNamesStmt, err = db.Prepare(selectQueuePDUServerNamesSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queuePDUsStatements) insertQueuePDU(
+	ctx context.Context,
+	txn *sql.Tx,
+	origin, serverName gomatrixserverlib.ServerName,
+	nid int64,
+) error {
+	stmt := internal.TxStmt(txn, s.insertQueuePDUStmt)
+	_, err := stmt.ExecContext(ctx, origin, serverName, nid)
+	return err
+}
+
+func (s *queuePDUsStatements) deleteQueuePDUs(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	jsonNIDs []int64,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteQueuePDUsStmt)
+	for _, jsonNID := range jsonNIDs {
+		if _, err := stmt.ExecContext(ctx, serverName, jsonNID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectQueuePDUNextOrigin returns the origin of the oldest PDU queued
+// for the server, or an empty string if there are none.
+func (s *queuePDUsStatements) selectQueuePDUNextOrigin(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerName, error) {
+	var origin gomatrixserverlib.ServerName
+	stmt := internal.TxStmt(txn, s.selectQueuePDUNextOriginStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&origin)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return origin, err
+}
+
+func (s *queuePDUsStatements) selectQueuePDUs(
+	ctx context.Context, txn *sql.Tx,
+	origin, serverName gomatrixserverlib.ServerName,
+	limit int,
+) ([]int64, error) {
+	stmt := internal.TxStmt(txn, s.selectQueuePDUsStmt)
+	rows, err := stmt.QueryContext(ctx, serverName, origin, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueuePDUs: rows.close() failed")
+	var result []int64
+	for rows.Next() {
+		var nid int64
+		if err = rows.Scan(&nid); err != nil {
+			return nil, err
+		}
+		result = append(result, nid)
+	}
+	return result, rows.Err()
+}
+
+func (s *queuePDUsStatements) selectQueuePDUReferenceJSONCount(
+	ctx context.Context, txn *sql.Tx, jsonNID int64,
+) (int64, error) {
+	var count int64
+	stmt := internal.TxStmt(txn, s.selectQueuePDUReferenceJSONCountStmt)
+	err := stmt.QueryRowContext(ctx, jsonNID).Scan(&count)
+	return count, err
+}
+
+func (s *queuePDUsStatements) selectQueuePDUCount(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (int64, error) {
+	var count int64
+	stmt := internal.TxStmt(txn, s.selectQueuePDUsCountStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&count)
+	return count, err
+}
+
+func (s *queuePDUsStatements) selectQueuePDUServerNames(
+	ctx context.Context, txn *sql.Tx,
+) ([]gomatrixserverlib.ServerName, error) {
+	stmt := internal.TxStmt(txn, s.selectQueuePDUServerNamesStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueuePDUServerNames: rows.close() failed")
+	var result []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, serverName)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queueEDUsSchema = `
+-- The queue_edus table stores the EDUs that are waiting to be sent to
+-- each remote server. The EDUs are sent in json_nid order, which is the
+-- order in which they were queued.
+CREATE TABLE IF NOT EXISTS federationsender_queue_edus (
+    -- The type of the EDU.
+    edu_type TEXT NOT NULL,
+    -- The local server name that the EDU is sent from.
+    origin TEXT NOT NULL,
+    -- The destination server that the EDU is queued for.
+    server_name TEXT NOT NULL,
+    -- The JSON NID from the federationsender_queue_json table.
+    json_nid BIGINT NOT NULL,
+    -- The time after which the EDU is no longer worth sending, as a
+    -- millisecond timestamp, or 0 if the EDU never expires.
+    expires_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS federationsender_queue_edus_json_nid_idx
+    ON federationsender_queue_edus (json_nid, server_name);
+`
+
+const insertQueueEDUSQL = "" +
+	"INSERT INTO federationsender_queue_edus (edu_type, origin, server_name, json_nid, expires_at)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteQueueEDUsSQL = "" +
+	"DELETE FROM federationsender_queue_edus WHERE server_name = $1 AND json_nid = ANY($2)"
+
+const selectQueueEDUsSQL = "" +
+	"SELECT json_nid FROM federationsender_queue_edus" +
+	" WHERE server_name = $1 AND origin = $2" +
+	" ORDER BY json_nid ASC" +
+	" LIMIT $3"
+
+const selectExpiredQueueEDUsSQL = "" +
+	"SELECT json_nid FROM federationsender_queue_edus" +
+	" WHERE server_name = $1 AND expires_at != 0 AND expires_at <= $2"
+
+const selectQueueEDUNextOriginSQL = "" +
+	"SELECT origin FROM federationsender_queue_edus" +
+	" WHERE server_name = $1" +
+	" ORDER BY json_nid ASC" +
+	" LIMIT 1"
+
+const selectQueueEDUReferenceJSONCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_edus" +
+	" WHERE json_nid = $1"
+
+const selectQueueEDUsCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_edus" +
+	" WHERE server_name = $1"
+
+const selectQueueEDUServerNamesSQL = "" +
+	"SELECT DISTINCT server_name FROM federationsender_queue_edus"
+
+type queueEDUsStatements struct {
+	insertQueueEDUStmt                   *sql.Stmt
+	deleteQueueEDUsStmt                  *sql.Stmt
+	selectQueueEDUsStmt                  *sql.Stmt
+	selectExpiredQueueEDUsStmt           *sql.Stmt
+	selectQueueEDUNextOriginStmt         *sql.Stmt
+	selectQueueEDUReferenceJSONCountStmt *sql.Stmt
+	selectQueueEDUsCountStmt             *sql.Stmt
+	selectQueueEDUServerNamesStmt        *sql.Stmt
+}
+
+func (s *queueEDUsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queueEDUsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueueEDUStmt, err = db.Prepare(insertQueueEDUSQL); err != nil {
+		return
+	}
+	if s.deleteQueueEDUsStmt, err = db.Prepare(deleteQueueEDUsSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUsStmt, err = db.Prepare(selectQueueEDUsSQL); err != nil {
+		return
+	}
+	if s.selectExpiredQueueEDUsStmt, err = db.Prepare(selectExpiredQueueEDUsSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUNextOriginStmt, err = db.Prepare(selectQueueEDUNextOriginSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUReferenceJSONCountStmt, err = db.Prepare(selectQueueEDUReferenceJSONCountSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUsCountStmt, err = db.Prepare(selectQueueEDUsCountSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUServerNamesStmt, err = db.Prepare(selectQueueEDUServerNamesSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queueEDUsStatements) insertQueueEDU(
+	ctx context.Context,
+	txn *sql.Tx,
+	eduType string,
+	origin, serverName gomatrixserverlib.ServerName,
+	nid int64,
+	expiresAt gomatrixserverlib.Timestamp,
+) error {
+	stmt := internal.TxStmt(txn, s.insertQueueEDUStmt)
+	_, err := stmt.ExecContext(ctx, eduType, origin, serverName, nid, expiresAt)
+	return err
+}
+
+func (s *queueEDUsStatements) deleteQueueEDUs(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	jsonNIDs []int64,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteQueueEDUsStmt)
+	_, err := stmt.ExecContext(ctx, serverName, pq.Int64Array(jsonNIDs))
+	return err
+}
+
+// selectExpiredQueueEDUs returns the JSON NIDs of the EDUs queued for
+// the server that expired at or before the given time.
+func (s *queueEDUsStatements) selectExpiredQueueEDUs(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	now gomatrixserverlib.Timestamp,
+) ([]int64, error) {
+	stmt := internal.TxStmt(txn, s.selectExpiredQueueEDUsStmt)
+	rows, err := stmt.QueryContext(ctx, serverName, now)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectExpiredQueueEDUs: rows.close() failed")
+	var result []int64
+	for rows.Next() {
+		var nid int64
+		if err = rows.Scan(&nid); err != nil {
+			return nil, err
+		}
+		result = append(result, nid)
+	}
+	return result, rows.Err()
+}
+
+// selectQueueEDUNextOrigin returns the origin of the oldest EDU queued
+// for the server, or an empty string if there are none.
+func (s *queueEDUsStatements) selectQueueEDUNextOrigin(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerName, error) {
+	var origin gomatrixserverlib.ServerName
+	stmt := internal.TxStmt(txn, s.selectQueueEDUNextOriginStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&origin)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return origin, err
+}
+
+func (s *queueEDUsStatements) selectQueueEDUs(
+	ctx context.Context, txn *sql.Tx,
+	origin, serverName gomatrixserverlib.ServerName,
+	limit int,
+) ([]int64, error) {
+	stmt := internal.TxStmt(txn, s.selectQueueEDUsStmt)
+	rows, err := stmt.QueryContext(ctx, serverName, origin, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueueEDUs: rows.close() failed")
+	var result []int64
+	for rows.Next() {
+		var nid int64
+		if err = rows.Scan(&nid); err != nil {
+			return nil, err
+		}
+		result = append(result, nid)
+	}
+	return result, rows.Err()
+}
+
+func (s *queueEDUsStatements) selectQueueEDUReferenceJSONCount(
+	ctx context.Context, txn *sql.Tx, jsonNID int64,
+) (int64, error) {
+	var count int64
+	stmt := internal.TxStmt(txn, s.selectQueueEDUReferenceJSONCountStmt)
+	err := stmt.QueryRowContext(ctx, jsonNID).Scan(&count)
+	return count, err
+}
+
+func (s *queueEDUsStatements) selectQueueEDUCount(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (int64, error) {
+	var count int64
+	stmt := internal.TxStmt(txn, s.selectQueueEDUsCountStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&count)
+	return count, err
+}
+
+func (s *queueEDUsStatements) selectQueueEDUServerNames(
+	ctx context.Context, txn *sql.Tx,
+) ([]gomatrixserverlib.ServerName, error) {
+	stmt := internal.TxStmt(txn, s.selectQueueEDUServerNamesStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueueEDUServerNames: rows.close() failed")
+	var result []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, serverName)
+	}
+	return result, rows.Err()
+}
@@ -18,16 +18,24 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // Database stores information needed by the federation sender
 type Database struct {
 	joinedHostsStatements
+	joinedHostsDeltasStatements
 	roomStatements
+	queueJSONStatements
+	queuePDUsStatements
+	queueEDUsStatements
+	queueInvitesStatements
+	destinationsStatements
 	internal.PartitionOffsetStatements
 	db *sql.DB
 }
@@ -56,6 +64,30 @@ func (d *Database) prepare() error {
 		return err
 	}
 
+	if err = d.joinedHostsDeltasStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queueJSONStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queuePDUsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queueEDUsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queueInvitesStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.destinationsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
 	return d.PartitionOffsetStatements.Prepare(d.db, "federationsender")
 }
 
@@ -63,7 +95,10 @@ func (d *Database) prepare() error {
 // hosts were before the update, or nil if this was a duplicate message.
 // This is called when we receive a message from kafka, so we pass in
 // oldEventID and newEventID to check that we haven't missed any messages or
-// this isn't a duplicate message.
+// this isn't a duplicate message. If the update was already applied, e.g.
+// by another federation sender shard sharing the database, then the joined
+// hosts are left alone and what they were before the update is worked out
+// from the stored deltas instead.
 func (d *Database) UpdateRoom(
 	ctx context.Context,
 	roomID, oldEventID, newEventID string,
@@ -71,14 +106,35 @@ func (d *Database) UpdateRoom(
 	removeHosts []string,
 ) (joinedHosts []types.JoinedHost, err error) {
 	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		err = d.insertRoom(ctx, txn, roomID)
-		if err != nil {
-			return err
+		if ierr := d.insertRoom(ctx, txn, roomID); ierr != nil {
+			return ierr
 		}
 
-		lastSentEventID, err := d.selectRoomForUpdate(ctx, txn, roomID)
-		if err != nil {
-			return err
+		lastSentEventID, serr := d.selectRoomForUpdate(ctx, txn, roomID)
+		if serr != nil {
+			return serr
+		}
+
+		position, applied, serr := d.selectJoinedHostsDeltaPosition(ctx, txn, roomID, newEventID)
+		if serr != nil {
+			return serr
+		}
+		if applied {
+			// Rewind the current joined hosts to before the event by undoing
+			// the deltas of the event and of every event after it.
+			current, qerr := d.selectJoinedHostsWithTx(ctx, txn, roomID)
+			if qerr != nil {
+				return qerr
+			}
+			deltas, qerr := d.selectJoinedHostsDeltasFrom(ctx, txn, roomID, position)
+			if qerr != nil {
+				return qerr
+			}
+			for _, delta := range deltas {
+				current = delta.Undo(current)
+			}
+			joinedHosts = current
+			return nil
 		}
 
 		if lastSentEventID == newEventID {
@@ -94,20 +150,45 @@ func (d *Database) UpdateRoom(
 			}
 		}
 
-		joinedHosts, err = d.selectJoinedHostsWithTx(ctx, txn, roomID)
-		if err != nil {
-			return err
+		current, serr := d.selectJoinedHostsWithTx(ctx, txn, roomID)
+		if serr != nil {
+			return serr
+		}
+
+		delta := types.JoinedHostsDelta{Added: addHosts}
+		removing := make(map[string]bool, len(removeHosts))
+		for _, eventID := range removeHosts {
+			removing[eventID] = true
+		}
+		for _, host := range current {
+			if removing[host.MemberEventID] {
+				delta.Removed = append(delta.Removed, host)
+			}
 		}
 
 		for _, add := range addHosts {
-			err = d.insertJoinedHosts(ctx, txn, roomID, add.MemberEventID, add.ServerName)
-			if err != nil {
-				return err
+			if ierr := d.insertJoinedHosts(ctx, txn, roomID, add.MemberEventID, add.ServerName); ierr != nil {
+				return ierr
 			}
 		}
-		if err = d.deleteJoinedHosts(ctx, txn, removeHosts); err != nil {
-			return err
+		if derr := d.deleteJoinedHosts(ctx, txn, removeHosts); derr != nil {
+			return derr
+		}
+
+		// Record the delta so that any other shards can work out what the
+		// joined hosts were before the event, and forget the oldest ones.
+		if position, serr = d.selectMaxJoinedHostsDeltaPosition(ctx, txn, roomID); serr != nil {
+			return serr
 		}
+		position++
+		if ierr := d.insertJoinedHostsDelta(ctx, txn, roomID, newEventID, position, delta); ierr != nil {
+			return ierr
+		}
+		if derr := d.deleteJoinedHostsDeltasUpTo(ctx, txn, roomID, position-joinedHostsDeltaHistory); derr != nil {
+			return derr
+		}
+
+		joinedHosts = current
 		return d.updateRoom(ctx, txn, roomID, newEventID)
 	})
 	return
@@ -121,3 +202,369 @@ func (d *Database) GetJoinedHosts(
 ) ([]types.JoinedHost, error) {
 	return d.selectJoinedHosts(ctx, roomID)
 }
+
+// QueuePDU stores the PDU JSON and queues it for sending from the given
+// local origin to each of the given destinations. This happens in a single
+// transaction, so that the JSON can't be cleaned up by one destination
+// before it has been queued for all of the others.
+func (d *Database) QueuePDU(
+	ctx context.Context,
+	origin gomatrixserverlib.ServerName,
+	destinations []gomatrixserverlib.ServerName,
+	js string,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		nid, err := d.insertQueueJSON(ctx, txn, js)
+		if err != nil {
+			return err
+		}
+		for _, serverName := range destinations {
+			if err = d.insertQueuePDU(ctx, txn, origin, serverName, nid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// QueueEDU stores the EDU JSON and queues it for sending from the given
+// local origin to each of the given destinations in a single transaction,
+// like QueuePDU.
+func (d *Database) QueueEDU(
+	ctx context.Context,
+	origin gomatrixserverlib.ServerName,
+	destinations []gomatrixserverlib.ServerName,
+	eduType string,
+	js string,
+	expiresAt gomatrixserverlib.Timestamp,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		nid, err := d.insertQueueJSON(ctx, txn, js)
+		if err != nil {
+			return err
+		}
+		for _, serverName := range destinations {
+			if err = d.insertQueueEDU(ctx, txn, eduType, origin, serverName, nid, expiresAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// QueueInvite stores the invite request JSON and queues it for sending
+// to the given destination.
+func (d *Database) QueueInvite(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	js string,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		nid, err := d.insertQueueJSON(ctx, txn, js)
+		if err != nil {
+			return err
+		}
+		return d.insertQueueInvite(ctx, txn, serverName, nid)
+	})
+}
+
+// GetNextTransactionOrigin returns the local origin that the next
+// transaction to the given destination should be sent from. This is the
+// origin of the oldest queued PDU, or of the oldest queued EDU if there
+// are no PDUs. It returns an empty string if nothing is queued.
+func (d *Database) GetNextTransactionOrigin(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerName, error) {
+	origin, err := d.selectQueuePDUNextOrigin(ctx, nil, serverName)
+	if err != nil || origin != "" {
+		return origin, err
+	}
+	return d.selectQueueEDUNextOrigin(ctx, nil, serverName)
+}
+
+// GetNextTransactionPDUs retrieves up to limit of the oldest PDUs that
+// are queued for sending from the given origin to the given destination,
+// in the order that they were queued. The returned NIDs should be passed
+// to CleanPDUs once the PDUs have been sent.
+func (d *Database) GetNextTransactionPDUs(
+	ctx context.Context,
+	origin, serverName gomatrixserverlib.ServerName,
+	limit int,
+) (jsonNIDs []int64, pdus []json.RawMessage, err error) {
+	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		nids, serr := d.selectQueuePDUs(ctx, txn, origin, serverName, limit)
+		if serr != nil {
+			return serr
+		}
+		blobs, serr := d.selectQueueJSON(ctx, txn, nids)
+		if serr != nil {
+			return serr
+		}
+		jsonNIDs = nids
+		for _, nid := range nids {
+			if blob, ok := blobs[nid]; ok {
+				pdus = append(pdus, json.RawMessage(blob))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// GetNextTransactionEDUs retrieves up to limit of the oldest EDUs that
+// are queued for sending from the given origin to the given destination,
+// in the order that they were queued. The returned NIDs should be passed
+// to CleanEDUs once the EDUs have been sent.
+func (d *Database) GetNextTransactionEDUs(
+	ctx context.Context,
+	origin, serverName gomatrixserverlib.ServerName,
+	limit int,
+) (jsonNIDs []int64, edus []*gomatrixserverlib.EDU, err error) {
+	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		nids, serr := d.selectQueueEDUs(ctx, txn, origin, serverName, limit)
+		if serr != nil {
+			return serr
+		}
+		blobs, serr := d.selectQueueJSON(ctx, txn, nids)
+		if serr != nil {
+			return serr
+		}
+		jsonNIDs = nids
+		for _, nid := range nids {
+			blob, ok := blobs[nid]
+			if !ok {
+				continue
+			}
+			var edu gomatrixserverlib.EDU
+			if uerr := json.Unmarshal(blob, &edu); uerr != nil {
+				continue
+			}
+			edus = append(edus, &edu)
+		}
+		return nil
+	})
+	return
+}
+
+// GetNextInvites retrieves up to limit of the newest invite requests that
+// are queued for sending to the given destination. The returned NIDs
+// should be passed to CleanInvites once the invites have been sent.
+// Invites that can no longer be parsed are returned as nil.
+func (d *Database) GetNextInvites(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	limit int,
+) (jsonNIDs []int64, invites []*gomatrixserverlib.InviteV2Request, err error) {
+	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		nids, serr := d.selectQueueInvites(ctx, txn, serverName, limit)
+		if serr != nil {
+			return serr
+		}
+		blobs, serr := d.selectQueueJSON(ctx, txn, nids)
+		if serr != nil {
+			return serr
+		}
+		jsonNIDs = nids
+		invites = make([]*gomatrixserverlib.InviteV2Request, len(nids))
+		for i, nid := range nids {
+			blob, ok := blobs[nid]
+			if !ok {
+				continue
+			}
+			var invite gomatrixserverlib.InviteV2Request
+			if uerr := json.Unmarshal(blob, &invite); uerr != nil {
+				continue
+			}
+			invites[i] = &invite
+		}
+		return nil
+	})
+	return
+}
+
+// CleanPDUs removes the PDUs with the given NIDs from the queue for the
+// given destination. Any JSON that is no longer queued for any destination
+// is deleted.
+func (d *Database) CleanPDUs(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	jsonNIDs []int64,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteQueuePDUs(ctx, txn, serverName, jsonNIDs); err != nil {
+			return err
+		}
+		var deleteNIDs []int64
+		for _, nid := range jsonNIDs {
+			count, err := d.selectQueuePDUReferenceJSONCount(ctx, txn, nid)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				deleteNIDs = append(deleteNIDs, nid)
+			}
+		}
+		if len(deleteNIDs) == 0 {
+			return nil
+		}
+		return d.deleteQueueJSON(ctx, txn, deleteNIDs)
+	})
+}
+
+// CleanEDUs removes the EDUs with the given NIDs from the queue for the
+// given destination. Any JSON that is no longer queued for any destination
+// is deleted.
+func (d *Database) CleanEDUs(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	jsonNIDs []int64,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteQueueEDUs(ctx, txn, serverName, jsonNIDs); err != nil {
+			return err
+		}
+		var deleteNIDs []int64
+		for _, nid := range jsonNIDs {
+			count, err := d.selectQueueEDUReferenceJSONCount(ctx, txn, nid)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				deleteNIDs = append(deleteNIDs, nid)
+			}
+		}
+		if len(deleteNIDs) == 0 {
+			return nil
+		}
+		return d.deleteQueueJSON(ctx, txn, deleteNIDs)
+	})
+}
+
+// CleanInvites removes the invites with the given NIDs from the queue for
+// the given destination, and deletes their JSON.
+func (d *Database) CleanInvites(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	jsonNIDs []int64,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteQueueInvites(ctx, txn, serverName, jsonNIDs); err != nil {
+			return err
+		}
+		var deleteNIDs []int64
+		for _, nid := range jsonNIDs {
+			count, err := d.selectQueueInviteReferenceJSONCount(ctx, txn, nid)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				deleteNIDs = append(deleteNIDs, nid)
+			}
+		}
+		if len(deleteNIDs) == 0 {
+			return nil
+		}
+		return d.deleteQueueJSON(ctx, txn, deleteNIDs)
+	})
+}
+
+// CleanExpiredEDUs removes the EDUs queued for the given destination
+// that expired at or before the given time, returning how many EDUs were
+// removed. Any JSON that is no longer queued for any destination is
+// deleted.
+func (d *Database) CleanExpiredEDUs(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	now gomatrixserverlib.Timestamp,
+) (int64, error) {
+	jsonNIDs, err := d.selectExpiredQueueEDUs(ctx, nil, serverName, now)
+	if err != nil || len(jsonNIDs) == 0 {
+		return 0, err
+	}
+	if err = d.CleanEDUs(ctx, serverName, jsonNIDs); err != nil {
+		return 0, err
+	}
+	return int64(len(jsonNIDs)), nil
+}
+
+// GetPendingPDUCount returns the number of PDUs waiting to be sent to
+// the given destination.
+func (d *Database) GetPendingPDUCount(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (int64, error) {
+	return d.selectQueuePDUCount(ctx, nil, serverName)
+}
+
+// GetPendingEDUCount returns the number of EDUs waiting to be sent to
+// the given destination.
+func (d *Database) GetPendingEDUCount(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (int64, error) {
+	return d.selectQueueEDUCount(ctx, nil, serverName)
+}
+
+// GetPendingInviteCount returns the number of invites waiting to be sent
+// to the given destination.
+func (d *Database) GetPendingInviteCount(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (int64, error) {
+	return d.selectQueueInviteCount(ctx, nil, serverName)
+}
+
+// GetPendingServerNames returns the destinations that have PDUs, EDUs or
+// invites waiting to be sent to them.
+func (d *Database) GetPendingServerNames(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	pduServerNames, err := d.selectQueuePDUServerNames(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	eduServerNames, err := d.selectQueueEDUServerNames(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	inviteServerNames, err := d.selectQueueInviteServerNames(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[gomatrixserverlib.ServerName]bool{}
+	var result []gomatrixserverlib.ServerName
+	for _, serverName := range append(append(pduServerNames, eduServerNames...), inviteServerNames...) {
+		if !seen[serverName] {
+			seen[serverName] = true
+			result = append(result, serverName)
+		}
+	}
+	return result, nil
+}
+
+// GetDestinationStatus returns the stored backoff and blacklist state
+// of the given server, or nil if nothing has been stored for it.
+func (d *Database) GetDestinationStatus(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (*types.DestinationStatus, error) {
+	return d.selectDestination(ctx, nil, serverName)
+}
+
+// GetAllDestinationStatuses returns the stored backoff and blacklist
+// state of all servers, ordered by server name.
+func (d *Database) GetAllDestinationStatuses(
+	ctx context.Context,
+) ([]types.DestinationStatus, error) {
+	return d.selectAllDestinations(ctx, nil)
+}
+
+// UpdateDestinationStatus stores the backoff and blacklist state of a
+// server.
+func (d *Database) UpdateDestinationStatus(
+	ctx context.Context,
+	status *types.DestinationStatus,
+) error {
+	return d.upsertDestination(ctx, nil, status)
+}
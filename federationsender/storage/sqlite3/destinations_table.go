@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const destinationsSchema = `
+-- The destinations table stores the backoff and blacklist state of the
+-- remote servers that we send federation traffic to, so that it isn't
+-- lost when the federation sender restarts.
+CREATE TABLE IF NOT EXISTS federationsender_destinations (
+    -- The remote server name.
+    server_name TEXT PRIMARY KEY,
+    -- How many consecutive times we have failed to contact the server.
+    failure_count BIGINT NOT NULL DEFAULT 0,
+    -- The timestamp in milliseconds before which we won't try to contact
+    -- the server again, or 0 if we aren't backing off.
+    backoff_until BIGINT NOT NULL DEFAULT 0,
+    -- Whether we have given up on the server altogether.
+    blacklisted BOOLEAN NOT NULL DEFAULT FALSE
+);
+`
+
+const upsertDestinationSQL = "" +
+	"INSERT INTO federationsender_destinations (server_name, failure_count, backoff_until, blacklisted)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (server_name)" +
+	" DO UPDATE SET failure_count = $2, backoff_until = $3, blacklisted = $4"
+
+const selectDestinationSQL = "" +
+	"SELECT server_name, failure_count, backoff_until, blacklisted FROM federationsender_destinations" +
+	" WHERE server_name = $1"
+
+const selectAllDestinationsSQL = "" +
+	"SELECT server_name, failure_count, backoff_until, blacklisted FROM federationsender_destinations" +
+	" ORDER BY server_name ASC"
+
+type destinationsStatements struct {
+	upsertDestinationStmt     *sql.Stmt
+	selectDestinationStmt     *sql.Stmt
+	selectAllDestinationsStmt *sql.Stmt
+}
+
+func (s *destinationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(destinationsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertDestinationStmt, err = db.Prepare(upsertDestinationSQL); err != nil {
+		return
+	}
+	if s.selectDestinationStmt, err = db.Prepare(selectDestinationSQL); err != nil {
+		return
+	}
+	if s.selectAllDestinationsStmt, err = db.Prepare(selectAllDestinationsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *destinationsStatements) upsertDestination(
+	ctx context.Context, txn *sql.Tx, status *types.DestinationStatus,
+) error {
+	var backoffUntil gomatrixserverlib.Timestamp
+	if !status.BackoffUntil.IsZero() {
+		backoffUntil = gomatrixserverlib.AsTimestamp(status.BackoffUntil)
+	}
+	stmt := internal.TxStmt(txn, s.upsertDestinationStmt)
+	_, err := stmt.ExecContext(
+		ctx, status.ServerName, status.FailCount, backoffUntil, status.Blacklisted,
+	)
+	return err
+}
+
+// selectDestination returns the stored status of the server, or nil
+// if there isn't one.
+func (s *destinationsStatements) selectDestination(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (*types.DestinationStatus, error) {
+	stmt := internal.TxStmt(txn, s.selectDestinationStmt)
+	status, err := destinationFromRow(stmt.QueryRowContext(ctx, serverName))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return status, err
+}
+
+func (s *destinationsStatements) selectAllDestinations(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.DestinationStatus, error) {
+	stmt := internal.TxStmt(txn, s.selectAllDestinationsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAllDestinations: rows.close() failed")
+	var result []types.DestinationStatus
+	for rows.Next() {
+		status, serr := destinationFromRow(rows)
+		if serr != nil {
+			return nil, serr
+		}
+		result = append(result, *status)
+	}
+	return result, rows.Err()
+}
+
+func destinationFromRow(row interface{ Scan(...interface{}) error }) (*types.DestinationStatus, error) {
+	var status types.DestinationStatus
+	var backoffUntil gomatrixserverlib.Timestamp
+	if err := row.Scan(
+		&status.ServerName, &status.FailCount, &backoffUntil, &status.Blacklisted,
+	); err != nil {
+		return nil, err
+	}
+	if backoffUntil > 0 {
+		status.BackoffUntil = backoffUntil.Time()
+	}
+	return &status, nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal"
+)
+
+const joinedHostsDeltasSchema = `
+-- The joined_hosts_deltas table stores the change that each recent room
+-- event made to the joined hosts of its room. When several federation
+-- sender shards share the database, the first shard to see an event
+-- updates the joined hosts, and the other shards use the deltas to work
+-- out what the joined hosts were before the event.
+CREATE TABLE IF NOT EXISTS federationsender_joined_hosts_deltas (
+    -- The string ID of the room.
+    room_id TEXT NOT NULL,
+    -- The event ID of the room event.
+    event_id TEXT NOT NULL,
+    -- The position of the event in the room, counting from 1.
+    position BIGINT NOT NULL,
+    -- The JSON encoded types.JoinedHostsDelta for the event.
+    delta_json TEXT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS federationsender_joined_hosts_deltas_event_id_idx
+    ON federationsender_joined_hosts_deltas (room_id, event_id);
+
+CREATE INDEX IF NOT EXISTS federationsender_joined_hosts_deltas_position_idx
+    ON federationsender_joined_hosts_deltas (room_id, position);
+`
+
+// joinedHostsDeltaHistory is how many of the most recent deltas are kept
+// for each room. A shard which falls further behind the others than this
+// will fail to update the room with a types.EventIDMismatchError.
+const joinedHostsDeltaHistory = 1000
+
+const insertJoinedHostsDeltaSQL = "" +
+	"INSERT INTO federationsender_joined_hosts_deltas (room_id, event_id, position, delta_json)" +
+	" VALUES ($1, $2, $3, $4)"
+
+const selectJoinedHostsDeltaPositionSQL = "" +
+	"SELECT position FROM federationsender_joined_hosts_deltas" +
+	" WHERE room_id = $1 AND event_id = $2"
+
+const selectMaxJoinedHostsDeltaPositionSQL = "" +
+	"SELECT COALESCE(MAX(position), 0) FROM federationsender_joined_hosts_deltas" +
+	" WHERE room_id = $1"
+
+const selectJoinedHostsDeltasFromSQL = "" +
+	"SELECT delta_json FROM federationsender_joined_hosts_deltas" +
+	" WHERE room_id = $1 AND position >= $2" +
+	" ORDER BY position DESC"
+
+const deleteJoinedHostsDeltasUpToSQL = "" +
+	"DELETE FROM federationsender_joined_hosts_deltas" +
+	" WHERE room_id = $1 AND position <= $2"
+
+type joinedHostsDeltasStatements struct {
+	insertJoinedHostsDeltaStmt            *sql.Stmt
+	selectJoinedHostsDeltaPositionStmt    *sql.Stmt
+	selectMaxJoinedHostsDeltaPositionStmt *sql.Stmt
+	selectJoinedHostsDeltasFromStmt       *sql.Stmt
+	deleteJoinedHostsDeltasUpToStmt       *sql.Stmt
+}
+
+func (s *joinedHostsDeltasStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(joinedHostsDeltasSchema)
+	if err != nil {
+		return
+	}
+	if s.insertJoinedHostsDeltaStmt, err = db.Prepare(insertJoinedHostsDeltaSQL); err != nil {
+		return
+	}
+	if s.selectJoinedHostsDeltaPositionStmt, err = db.Prepare(selectJoinedHostsDeltaPositionSQL); err != nil {
+		return
+	}
+	if s.selectMaxJoinedHostsDeltaPositionStmt, err = db.Prepare(selectMaxJoinedHostsDeltaPositionSQL); err != nil {
+		return
+	}
+	if s.selectJoinedHostsDeltasFromStmt, err = db.Prepare(selectJoinedHostsDeltasFromSQL); err != nil {
+		return
+	}
+	if s.deleteJoinedHostsDeltasUpToStmt, err = db.Prepare(deleteJoinedHostsDeltasUpToSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *joinedHostsDeltasStatements) insertJoinedHostsDelta(
+	ctx context.Context, txn *sql.Tx,
+	roomID, eventID string, position int64,
+	delta types.JoinedHostsDelta,
+) error {
+	deltaJSON, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	stmt := internal.TxStmt(txn, s.insertJoinedHostsDeltaStmt)
+	_, err = stmt.ExecContext(ctx, roomID, eventID, position, string(deltaJSON))
+	return err
+}
+
+// selectJoinedHostsDeltaPosition returns the position of the event in the
+// room, or false if there is no delta stored for the event.
+func (s *joinedHostsDeltasStatements) selectJoinedHostsDeltaPosition(
+	ctx context.Context, txn *sql.Tx, roomID, eventID string,
+) (int64, bool, error) {
+	var position int64
+	stmt := internal.TxStmt(txn, s.selectJoinedHostsDeltaPositionStmt)
+	err := stmt.QueryRowContext(ctx, roomID, eventID).Scan(&position)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return position, err == nil, err
+}
+
+func (s *joinedHostsDeltasStatements) selectMaxJoinedHostsDeltaPosition(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (int64, error) {
+	var position int64
+	stmt := internal.TxStmt(txn, s.selectMaxJoinedHostsDeltaPositionStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(&position)
+	return position, err
+}
+
+// selectJoinedHostsDeltasFrom returns the deltas for the events in the room
+// from the given position onwards, newest first.
+func (s *joinedHostsDeltasStatements) selectJoinedHostsDeltasFrom(
+	ctx context.Context, txn *sql.Tx, roomID string, position int64,
+) ([]types.JoinedHostsDelta, error) {
+	stmt := internal.TxStmt(txn, s.selectJoinedHostsDeltasFromStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, position)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectJoinedHostsDeltasFrom: rows.close() failed")
+	var result []types.JoinedHostsDelta
+	for rows.Next() {
+		var deltaJSON string
+		if err = rows.Scan(&deltaJSON); err != nil {
+			return nil, err
+		}
+		var delta types.JoinedHostsDelta
+		if err = json.Unmarshal([]byte(deltaJSON), &delta); err != nil {
+			return nil, err
+		}
+		result = append(result, delta)
+	}
+	return result, rows.Err()
+}
+
+func (s *joinedHostsDeltasStatements) deleteJoinedHostsDeltasUpTo(
+	ctx context.Context, txn *sql.Tx, roomID string, position int64,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteJoinedHostsDeltasUpToStmt)
+	_, err := stmt.ExecContext(ctx, roomID, position)
+	return err
+}
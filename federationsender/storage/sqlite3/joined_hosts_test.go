@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+)
+
+func serverNamesOf(joinedHosts []types.JoinedHost) []string {
+	result := []string{}
+	for _, host := range joinedHosts {
+		result = append(result, string(host.ServerName))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestUpdateRoomSharedBetweenShards(t *testing.T) {
+	ctx := context.Background()
+	db := mustCreateDatabase(t)
+	roomID := "!room:localhost"
+
+	updates := []struct {
+		oldEventID, newEventID string
+		add                    []types.JoinedHost
+		remove                 []string
+		before                 []string
+	}{
+		{"", "$create", nil, nil, []string{}},
+		{"$create", "$join_a", []types.JoinedHost{{MemberEventID: "$join_a", ServerName: "a.example.com"}}, nil, []string{}},
+		{"$join_a", "$join_b", []types.JoinedHost{{MemberEventID: "$join_b", ServerName: "b.example.com"}}, nil, []string{"a.example.com"}},
+		{"$join_b", "$leave_a", nil, []string{"$join_a"}, []string{"a.example.com", "b.example.com"}},
+	}
+
+	// The first shard applies every update to the shared joined hosts.
+	for _, update := range updates {
+		joinedHosts, err := db.UpdateRoom(ctx, roomID, update.oldEventID, update.newEventID, update.add, update.remove)
+		if err != nil {
+			t.Fatalf("UpdateRoom(%s): %s", update.newEventID, err)
+		}
+		if got := serverNamesOf(joinedHosts); len(update.before) > 0 && !equalStrings(got, update.before) {
+			t.Errorf("UpdateRoom(%s): expected joined hosts %v, got %v", update.newEventID, update.before, got)
+		}
+	}
+
+	// A second shard which is behind sees the joined hosts as they were
+	// before each event, without changing the current joined hosts.
+	for _, update := range updates {
+		joinedHosts, err := db.UpdateRoom(ctx, roomID, update.oldEventID, update.newEventID, update.add, update.remove)
+		if err != nil {
+			t.Fatalf("UpdateRoom(%s) on second shard: %s", update.newEventID, err)
+		}
+		if got := serverNamesOf(joinedHosts); !equalStrings(got, update.before) {
+			t.Errorf("UpdateRoom(%s) on second shard: expected joined hosts %v, got %v", update.newEventID, update.before, got)
+		}
+	}
+
+	current, err := db.GetJoinedHosts(ctx, roomID)
+	if err != nil {
+		t.Fatalf("GetJoinedHosts: %s", err)
+	}
+	if got := serverNamesOf(current); !equalStrings(got, []string{"b.example.com"}) {
+		t.Errorf("expected current joined hosts [b.example.com], got %v", got)
+	}
+
+	// An event that doesn't follow on from the last one is still an error.
+	if _, err = db.UpdateRoom(ctx, roomID, "$join_a", "$other", nil, nil); err == nil {
+		t.Errorf("expected an error for an event that doesn't follow the last one")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queueInvitesSchema = `
+-- The queue_invites table stores the invite requests that are waiting to
+-- be sent to each remote server. Unlike PDUs, invites aren't sent in
+-- transactions, so the newest invites are sent first and an invite that
+-- keeps failing doesn't hold up the ones after it.
+CREATE TABLE IF NOT EXISTS federationsender_queue_invites (
+    -- The destination server that the invite is queued for.
+    server_name TEXT NOT NULL,
+    -- The JSON NID from the federationsender_queue_json table.
+    json_nid BIGINT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS federationsender_queue_invites_json_nid_idx
+    ON federationsender_queue_invites (json_nid, server_name);
+`
+
+const insertQueueInviteSQL = "" +
+	"INSERT INTO federationsender_queue_invites (server_name, json_nid)" +
+	" VALUES ($1, $2)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteQueueInvitesSQL = "" +
+	"DELETE FROM federationsender_queue_invites WHERE server_name = $1 AND json_nid = $2"
+
+const selectQueueInvitesSQL = "" +
+	"SELECT json_nid FROM federationsender_queue_invites" +
+	" WHERE server_name = $1" +
+	" ORDER BY json_nid DESC" +
+	" LIMIT $2"
+
+const selectQueueInviteReferenceJSONCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_invites" +
+	" WHERE json_nid = $1"
+
+const selectQueueInvitesCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_invites" +
+	" WHERE server_name = $1"
+
+const selectQueueInviteServerNamesSQL = "" +
+	"SELECT DISTINCT server_name FROM federationsender_queue_invites"
+
+type queueInvitesStatements struct {
+	insertQueueInviteStmt                   *sql.Stmt
+	deleteQueueInvitesStmt                  *sql.Stmt
+	selectQueueInvitesStmt                  *sql.Stmt
+	selectQueueInviteReferenceJSONCountStmt *sql.Stmt
+	selectQueueInvitesCountStmt             *sql.Stmt
+	selectQueueInviteServerNamesStmt        *sql.Stmt
+}
+
+func (s *queueInvitesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queueInvitesSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueueInviteStmt, err = db.Prepare(insertQueueInviteSQL); err != nil {
+		return
+	}
+	if s.deleteQueueInvitesStmt, err = db.Prepare(deleteQueueInvitesSQL); err != nil {
+		return
+	}
+	if s.selectQueueInvitesStmt, err = db.Prepare(selectQueueInvitesSQL); err != nil {
+		return
+	}
+	if s.selectQueueInviteReferenceJSONCountStmt, err = db.Prepare(selectQueueInviteReferenceJSONCountSQL); err != nil {
+		return
+	}
+	if s.selectQueueInvitesCountStmt, err = db.Prepare(selectQueueInvitesCountSQL); err != nil {
+		return
+	}
+	if s.selectQueueInviteServerNamesStmt, err = db.Prepare(selectQueueInviteServerNamesSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queueInvitesStatements) insertQueueInvite(
+	ctx context.Context,
+	txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	nid int64,
+) error {
+	stmt := internal.TxStmt(txn, s.insertQueueInviteStmt)
+	_, err := stmt.ExecContext(ctx, serverName, nid)
+	return err
+}
+
+func (s *queueInvitesStatements) deleteQueueInvites(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	jsonNIDs []int64,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteQueueInvitesStmt)
+	for _, jsonNID := range jsonNIDs {
+		if _, err := stmt.ExecContext(ctx, serverName, jsonNID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *queueInvitesStatements) selectQueueInvites(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	limit int,
+) ([]int64, error) {
+	stmt := internal.TxStmt(txn, s.selectQueueInvitesStmt)
+	rows, err := stmt.QueryContext(ctx, serverName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueueInvites: rows.close() failed")
+	var result []int64
+	for rows.Next() {
+		var nid int64
+		if err = rows.Scan(&nid); err != nil {
+			return nil, err
+		}
+		result = append(result, nid)
+	}
+	return result, rows.Err()
+}
+
+func (s *queueInvitesStatements) selectQueueInviteReferenceJSONCount(
+	ctx context.Context, txn *sql.Tx, jsonNID int64,
+) (int64, error) {
+	var count int64
+	stmt := internal.TxStmt(txn, s.selectQueueInviteReferenceJSONCountStmt)
+	err := stmt.QueryRowContext(ctx, jsonNID).Scan(&count)
+	return count, err
+}
+
+func (s *queueInvitesStatements) selectQueueInviteCount(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (int64, error) {
+	var count int64
+	stmt := internal.TxStmt(txn, s.selectQueueInvitesCountStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&count)
+	return count, err
+}
+
+func (s *queueInvitesStatements) selectQueueInviteServerNames(
+	ctx context.Context, txn *sql.Tx,
+) ([]gomatrixserverlib.ServerName, error) {
+	stmt := internal.TxStmt(txn, s.selectQueueInviteServerNamesStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueueInviteServerNames: rows.close() failed")
+	var result []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, serverName)
+	}
+	return result, rows.Err()
+}
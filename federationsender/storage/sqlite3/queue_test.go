@@ -0,0 +1,316 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateDatabase(t *testing.T) *Database {
+	db, err := NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	return db
+}
+
+func TestQueuePDUsSurviveUntilCleaned(t *testing.T) {
+	ctx := context.Background()
+	db := mustCreateDatabase(t)
+	origin := gomatrixserverlib.ServerName("localhost")
+	destinations := []gomatrixserverlib.ServerName{"a.example.com", "b.example.com"}
+
+	// Queue some PDUs for both destinations.
+	for i := 0; i < 5; i++ {
+		if err := db.QueuePDU(ctx, origin, destinations, fmt.Sprintf(`{"event_id":"$%d"}`, i)); err != nil {
+			t.Fatalf("QueuePDU: %s", err)
+		}
+	}
+
+	serverNames, err := db.GetPendingServerNames(ctx)
+	if err != nil {
+		t.Fatalf("GetPendingServerNames: %s", err)
+	}
+	if len(serverNames) != len(destinations) {
+		t.Fatalf("expected %d pending server names, got %v", len(destinations), serverNames)
+	}
+
+	// The PDUs should come back oldest first, limited in size.
+	nids, pdus, err := db.GetNextTransactionPDUs(ctx, origin, destinations[0], 3)
+	if err != nil {
+		t.Fatalf("GetNextTransactionPDUs: %s", err)
+	}
+	if len(nids) != 3 || len(pdus) != 3 {
+		t.Fatalf("expected 3 PDUs, got %d NIDs and %d PDUs", len(nids), len(pdus))
+	}
+	for i, pdu := range pdus {
+		var ev struct {
+			EventID string `json:"event_id"`
+		}
+		if err = json.Unmarshal(pdu, &ev); err != nil {
+			t.Fatalf("json.Unmarshal: %s", err)
+		}
+		if want := fmt.Sprintf("$%d", i); ev.EventID != want {
+			t.Errorf("PDU %d: expected event ID %q, got %q", i, want, ev.EventID)
+		}
+	}
+
+	// Cleaning the PDUs for one destination must not affect the other.
+	if err = db.CleanPDUs(ctx, destinations[0], nids); err != nil {
+		t.Fatalf("CleanPDUs: %s", err)
+	}
+	if count, _ := db.GetPendingPDUCount(ctx, destinations[0]); count != 2 {
+		t.Errorf("expected 2 pending PDUs for %q, got %d", destinations[0], count)
+	}
+	if count, _ := db.GetPendingPDUCount(ctx, destinations[1]); count != 5 {
+		t.Errorf("expected 5 pending PDUs for %q, got %d", destinations[1], count)
+	}
+	blobs, err := db.selectQueueJSON(ctx, nil, nids)
+	if err != nil {
+		t.Fatalf("selectQueueJSON: %s", err)
+	}
+	if len(blobs) != len(nids) {
+		t.Errorf("expected JSON still referenced by %q to be kept", destinations[1])
+	}
+
+	// Once no destination references the JSON any more it is deleted.
+	if err = db.CleanPDUs(ctx, destinations[1], nids); err != nil {
+		t.Fatalf("CleanPDUs: %s", err)
+	}
+	blobs, err = db.selectQueueJSON(ctx, nil, nids)
+	if err != nil {
+		t.Fatalf("selectQueueJSON: %s", err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("expected unreferenced JSON to be deleted, %d remain", len(blobs))
+	}
+}
+
+func TestQueueEDUs(t *testing.T) {
+	ctx := context.Background()
+	db := mustCreateDatabase(t)
+	origin := gomatrixserverlib.ServerName("localhost")
+	destination := gomatrixserverlib.ServerName("a.example.com")
+
+	edu := gomatrixserverlib.EDU{
+		Type:    gomatrixserverlib.MTyping,
+		Origin:  "localhost",
+		Content: gomatrixserverlib.RawJSON(`{"typing":true}`),
+	}
+	eduJSON, err := json.Marshal(edu)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	if err = db.QueueEDU(ctx, origin, []gomatrixserverlib.ServerName{destination}, edu.Type, string(eduJSON), 0); err != nil {
+		t.Fatalf("QueueEDU: %s", err)
+	}
+
+	nids, edus, err := db.GetNextTransactionEDUs(ctx, origin, destination, 10)
+	if err != nil {
+		t.Fatalf("GetNextTransactionEDUs: %s", err)
+	}
+	if len(nids) != 1 || len(edus) != 1 {
+		t.Fatalf("expected 1 EDU, got %d NIDs and %d EDUs", len(nids), len(edus))
+	}
+	if edus[0].Type != edu.Type || string(edus[0].Content) != string(edu.Content) {
+		t.Errorf("expected EDU %+v, got %+v", edu, *edus[0])
+	}
+
+	if err = db.CleanEDUs(ctx, destination, nids); err != nil {
+		t.Fatalf("CleanEDUs: %s", err)
+	}
+	if count, _ := db.GetPendingEDUCount(ctx, destination); count != 0 {
+		t.Errorf("expected no pending EDUs, got %d", count)
+	}
+	serverNames, err := db.GetPendingServerNames(ctx)
+	if err != nil {
+		t.Fatalf("GetPendingServerNames: %s", err)
+	}
+	if len(serverNames) != 0 {
+		t.Errorf("expected no pending server names, got %v", serverNames)
+	}
+}
+
+func TestQueueTransactionsAreSplitByOrigin(t *testing.T) {
+	ctx := context.Background()
+	db := mustCreateDatabase(t)
+	destination := gomatrixserverlib.ServerName("a.example.com")
+	origins := []gomatrixserverlib.ServerName{"example.org", "example.net", "example.org"}
+
+	for i, origin := range origins {
+		if err := db.QueuePDU(ctx, origin, []gomatrixserverlib.ServerName{destination}, fmt.Sprintf(`{"event_id":"$%d"}`, i)); err != nil {
+			t.Fatalf("QueuePDU: %s", err)
+		}
+	}
+
+	// The oldest PDU decides which origin the next transaction is sent
+	// from, and only PDUs from that origin are included in it.
+	for _, want := range []struct {
+		origin gomatrixserverlib.ServerName
+		count  int
+	}{
+		{"example.org", 2},
+		{"example.net", 1},
+	} {
+		origin, err := db.GetNextTransactionOrigin(ctx, destination)
+		if err != nil {
+			t.Fatalf("GetNextTransactionOrigin: %s", err)
+		}
+		if origin != want.origin {
+			t.Fatalf("expected next origin %q, got %q", want.origin, origin)
+		}
+		nids, _, err := db.GetNextTransactionPDUs(ctx, origin, destination, 10)
+		if err != nil {
+			t.Fatalf("GetNextTransactionPDUs: %s", err)
+		}
+		if len(nids) != want.count {
+			t.Fatalf("expected %d PDUs from %q, got %d", want.count, origin, len(nids))
+		}
+		if err = db.CleanPDUs(ctx, destination, nids); err != nil {
+			t.Fatalf("CleanPDUs: %s", err)
+		}
+	}
+
+	origin, err := db.GetNextTransactionOrigin(ctx, destination)
+	if err != nil {
+		t.Fatalf("GetNextTransactionOrigin: %s", err)
+	}
+	if origin != "" {
+		t.Errorf("expected no next origin, got %q", origin)
+	}
+}
+
+func TestQueueExpiredEDUsAreCleaned(t *testing.T) {
+	ctx := context.Background()
+	db := mustCreateDatabase(t)
+	origin := gomatrixserverlib.ServerName("localhost")
+	destination := gomatrixserverlib.ServerName("a.example.com")
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+
+	// Queue an expired typing notification, a typing notification that
+	// hasn't expired yet and a device list update that never expires.
+	for _, queued := range []struct {
+		eduType   string
+		expiresAt gomatrixserverlib.Timestamp
+	}{
+		{gomatrixserverlib.MTyping, now - 1000},
+		{gomatrixserverlib.MTyping, now + 60000},
+		{"m.device_list_update", 0},
+	} {
+		if err := db.QueueEDU(
+			ctx, origin, []gomatrixserverlib.ServerName{destination}, queued.eduType,
+			fmt.Sprintf(`{"edu_type":%q,"content":{}}`, queued.eduType), queued.expiresAt,
+		); err != nil {
+			t.Fatalf("QueueEDU: %s", err)
+		}
+	}
+
+	cleaned, err := db.CleanExpiredEDUs(ctx, destination, now)
+	if err != nil {
+		t.Fatalf("CleanExpiredEDUs: %s", err)
+	}
+	if cleaned != 1 {
+		t.Errorf("expected 1 expired EDU to be cleaned, got %d", cleaned)
+	}
+
+	_, edus, err := db.GetNextTransactionEDUs(ctx, origin, destination, 10)
+	if err != nil {
+		t.Fatalf("GetNextTransactionEDUs: %s", err)
+	}
+	if len(edus) != 2 {
+		t.Fatalf("expected 2 EDUs to remain, got %d", len(edus))
+	}
+	if edus[0].Type != gomatrixserverlib.MTyping || edus[1].Type != "m.device_list_update" {
+		t.Errorf("unexpected EDUs remaining: %s, %s", edus[0].Type, edus[1].Type)
+	}
+}
+
+func mustCreateInviteJSON(t *testing.T, privateKey ed25519.PrivateKey, invitee string) string {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@alice:localhost",
+		RoomID:   "!room:localhost",
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &invitee,
+	}
+	if err := builder.SetContent(map[string]string{"membership": gomatrixserverlib.Invite}); err != nil {
+		t.Fatalf("SetContent: %s", err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", privateKey, gomatrixserverlib.RoomVersionV5)
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV5)
+	inviteReq, err := gomatrixserverlib.NewInviteV2Request(&headered, nil)
+	if err != nil {
+		t.Fatalf("NewInviteV2Request: %s", err)
+	}
+	js, err := json.Marshal(inviteReq)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	return string(js)
+}
+
+func TestQueueInvites(t *testing.T) {
+	ctx := context.Background()
+	db := mustCreateDatabase(t)
+	destination := gomatrixserverlib.ServerName("a.example.com")
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %s", err)
+	}
+
+	invitees := []string{"@bob:a.example.com", "@charlie:a.example.com", "@dave:a.example.com"}
+	for _, invitee := range invitees {
+		if err = db.QueueInvite(ctx, destination, mustCreateInviteJSON(t, privateKey, invitee)); err != nil {
+			t.Fatalf("QueueInvite: %s", err)
+		}
+	}
+	if serverNames, _ := db.GetPendingServerNames(ctx); len(serverNames) != 1 || serverNames[0] != destination {
+		t.Fatalf("expected %q to have pending invites, got %v", destination, serverNames)
+	}
+
+	// The invites should come back newest first, limited in size.
+	nids, invites, err := db.GetNextInvites(ctx, destination, 2)
+	if err != nil {
+		t.Fatalf("GetNextInvites: %s", err)
+	}
+	if len(nids) != 2 || len(invites) != 2 {
+		t.Fatalf("expected 2 invites, got %d NIDs and %d invites", len(nids), len(invites))
+	}
+	for i, invite := range invites {
+		want := invitees[len(invitees)-1-i]
+		if invite == nil {
+			t.Fatalf("invite %d: failed to parse", i)
+		}
+		if ev := invite.Event(); *ev.StateKey() != want {
+			t.Errorf("invite %d: expected invite for %q, got %q", i, want, *ev.StateKey())
+		}
+	}
+
+	if err = db.CleanInvites(ctx, destination, nids); err != nil {
+		t.Fatalf("CleanInvites: %s", err)
+	}
+	if count, _ := db.GetPendingInviteCount(ctx, destination); count != 1 {
+		t.Errorf("expected 1 pending invite after cleaning, got %d", count)
+	}
+}
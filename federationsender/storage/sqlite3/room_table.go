@@ -40,7 +40,7 @@ const selectRoomForUpdateSQL = "" +
 	"SELECT last_event_id FROM federationsender_rooms WHERE room_id = $1"
 
 const updateRoomSQL = "" +
-	"UPDATE federationsender_rooms SET last_event_id = $2 WHERE room_id = $1"
+	"UPDATE federationsender_rooms SET last_event_id = $1 WHERE room_id = $2"
 
 type roomStatements struct {
 	insertRoomStmt          *sql.Stmt
@@ -96,6 +96,6 @@ func (s *roomStatements) updateRoom(
 	ctx context.Context, txn *sql.Tx, roomID, lastEventID string,
 ) error {
 	stmt := internal.TxStmt(txn, s.updateRoomStmt)
-	_, err := stmt.ExecContext(ctx, roomID, lastEventID)
+	_, err := stmt.ExecContext(ctx, lastEventID, roomID)
 	return err
 }
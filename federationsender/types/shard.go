@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A Shard identifies one of several federation sender instances which
+// share the outbound federation traffic between them. Each destination
+// server is owned by exactly one shard, chosen by hashing its name, and
+// only that shard sends anything to it.
+type Shard struct {
+	// Which of the instances this is, from 0 to Count-1.
+	Index int
+	// The number of instances. 0 or 1 means that there is only one
+	// instance, which owns every destination.
+	Count int
+}
+
+// Owns returns true if this shard is responsible for sending to the
+// given destination.
+func (s Shard) Owns(serverName gomatrixserverlib.ServerName) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(serverName))
+	return int(h.Sum32()%uint32(s.Count)) == s.Index
+}
+
+// Filter returns the destinations that this shard is responsible for.
+func (s Shard) Filter(serverNames []gomatrixserverlib.ServerName) []gomatrixserverlib.ServerName {
+	if s.Count <= 1 {
+		return serverNames
+	}
+	var result []gomatrixserverlib.ServerName
+	for _, serverName := range serverNames {
+		if s.Owns(serverName) {
+			result = append(result, serverName)
+		}
+	}
+	return result
+}
+
+// Topic returns the name that this shard records its progress through
+// the given Kafka topic under. Every shard consumes every topic in full,
+// so they each need their own partition offsets in the shared database.
+// The first shard keeps using the plain topic name, so that a server
+// which starts sharding carries on from where it was.
+func (s Shard) Topic(topic string) string {
+	if s.Index == 0 {
+		return topic
+	}
+	return fmt.Sprintf("%s/shard-%d", topic, s.Index)
+}
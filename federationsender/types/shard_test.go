@@ -0,0 +1,68 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestShardOwnsEachDestinationOnce(t *testing.T) {
+	const count = 4
+	owned := make([]int, count)
+	for i := 0; i < 1000; i++ {
+		serverName := gomatrixserverlib.ServerName(fmt.Sprintf("server%d.example.com", i))
+		owners := 0
+		for index := 0; index < count; index++ {
+			if (Shard{Index: index, Count: count}).Owns(serverName) {
+				owners++
+				owned[index]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("expected %q to be owned by 1 shard, got %d", serverName, owners)
+		}
+	}
+	for index, n := range owned {
+		if n == 0 {
+			t.Errorf("expected shard %d to own some destinations", index)
+		}
+	}
+}
+
+func TestShardFilter(t *testing.T) {
+	serverNames := []gomatrixserverlib.ServerName{"a.example.com", "b.example.com", "c.example.com"}
+	if got := (Shard{}).Filter(serverNames); len(got) != len(serverNames) {
+		t.Errorf("expected a single shard to own every destination, got %v", got)
+	}
+	total := 0
+	for index := 0; index < 2; index++ {
+		total += len(Shard{Index: index, Count: 2}.Filter(serverNames))
+	}
+	if total != len(serverNames) {
+		t.Errorf("expected the shards to own %d destinations between them, got %d", len(serverNames), total)
+	}
+}
+
+func TestShardTopic(t *testing.T) {
+	if got := (Shard{Index: 0, Count: 3}).Topic("topic"); got != "topic" {
+		t.Errorf("expected the first shard to use the plain topic name, got %q", got)
+	}
+	if got := (Shard{Index: 2, Count: 3}).Topic("topic"); got == "topic" {
+		t.Errorf("expected other shards to use their own topic name, got %q", got)
+	}
+}
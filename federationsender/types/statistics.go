@@ -1,11 +1,13 @@
 package types
 
 import (
+	"context"
 	"math"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 	"go.uber.org/atomic"
 )
 
@@ -16,34 +18,59 @@ const (
 	FailuresUntilBlacklist = 16 // 16 equates to roughly 18 hours.
 )
 
+// How often should we re-read the stored state of a host which is
+// blacklisted or backed off? Another instance may have reset it, e.g.
+// because it heard from the host, and only the shard which owns the
+// host sends anything to it.
+var statusRefreshInterval = time.Second * 30
+
+// StatisticsStorage is used to persist the backoff and blacklist state
+// of remote federated hosts, so that it survives restarts.
+type StatisticsStorage interface {
+	// GetDestinationStatus returns the stored status for the server, or
+	// nil if nothing has been stored for it yet.
+	GetDestinationStatus(ctx context.Context, serverName gomatrixserverlib.ServerName) (*DestinationStatus, error)
+	UpdateDestinationStatus(ctx context.Context, status *DestinationStatus) error
+}
+
 // Statistics contains information about all of the remote federated
 // hosts that we have interacted with. It is basically a threadsafe
 // wrapper.
 type Statistics struct {
+	// DB is used to persist the backoff and blacklist state. It may be
+	// nil, in which case the state is only held in memory.
+	DB      StatisticsStorage
 	servers map[gomatrixserverlib.ServerName]*ServerStatistics
 	mutex   sync.RWMutex
 }
 
 // ForServer returns server statistics for the given server name. If it
-// does not exist, it will create empty statistics and return those.
+// does not exist, it will create statistics, restoring any previously
+// stored state from the database, and return those.
 func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerStatistics {
-	// If the map hasn't been initialised yet then do that.
-	if s.servers == nil {
-		s.mutex.Lock()
-		s.servers = make(map[gomatrixserverlib.ServerName]*ServerStatistics)
-		s.mutex.Unlock()
-	}
 	// Look up if we have statistics for this server already.
 	s.mutex.RLock()
 	server, found := s.servers[serverName]
 	s.mutex.RUnlock()
+	if found {
+		return server
+	}
 	// If we don't, then make one.
-	if !found {
-		s.mutex.Lock()
-		server = &ServerStatistics{}
-		s.servers[serverName] = server
-		s.mutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server, found = s.servers[serverName]; found {
+		return server
+	}
+	// If the map hasn't been initialised yet then do that.
+	if s.servers == nil {
+		s.servers = make(map[gomatrixserverlib.ServerName]*ServerStatistics)
+	}
+	server = &ServerStatistics{
+		statistics: s,
+		serverName: serverName,
 	}
+	server.refresh()
+	s.servers[serverName] = server
 	return server
 }
 
@@ -52,10 +79,13 @@ func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerS
 // many times we failed etc. It also manages the backoff time and black-
 // listing a remote host if it remains uncooperative.
 type ServerStatistics struct {
-	blacklisted    atomic.Bool   // is the remote side dead?
-	backoffUntil   atomic.Value  // time.Time to wait until before sending requests
-	failCounter    atomic.Uint32 // how many times have we failed?
-	successCounter atomic.Uint32 // how many times have we succeeded?
+	statistics     *Statistics                  // the statistics that this belongs to
+	serverName     gomatrixserverlib.ServerName // the remote server name
+	blacklisted    atomic.Bool                  // is the remote side dead?
+	backoffUntil   atomic.Value                 // time.Time to wait until before sending requests
+	failCounter    atomic.Uint32                // how many times have we failed?
+	successCounter atomic.Uint32                // how many times have we succeeded?
+	lastRefresh    atomic.Value                 // time.Time that the stored state was last read
 }
 
 // Success updates the server statistics with a new successful
@@ -64,8 +94,13 @@ type ServerStatistics struct {
 // we will unblacklist it.
 func (s *ServerStatistics) Success() {
 	s.successCounter.Add(1)
-	s.failCounter.Store(0)
-	s.blacklisted.Store(false)
+	hadFailures := s.failCounter.Swap(0) > 0
+	wasBlacklisted := s.blacklisted.Swap(false)
+	// Only write to the database if something has actually changed,
+	// otherwise we would be doing it for every single transaction.
+	if hadFailures || wasBlacklisted {
+		s.persist()
+	}
 }
 
 // Failure marks a failure and works out when to backoff until. It
@@ -83,6 +118,7 @@ func (s *ServerStatistics) Failure() bool {
 		// now. Mark the host as blacklisted and tell the caller to
 		// give up.
 		s.blacklisted.Store(true)
+		s.persist()
 		return true
 	}
 
@@ -94,12 +130,80 @@ func (s *ServerStatistics) Failure() bool {
 	s.backoffUntil.Store(
 		time.Now().Add(backoffSeconds),
 	)
+	s.persist()
 	return false
 }
 
+// Reset clears the failure counter, backoff and blacklist state, so that
+// we will try to contact the remote server again straight away.
+func (s *ServerStatistics) Reset() {
+	s.failCounter.Store(0)
+	s.blacklisted.Store(false)
+	s.backoffUntil.Store(time.Time{})
+	s.persist()
+}
+
+// Status returns the current backoff and blacklist state of the server.
+func (s *ServerStatistics) Status() *DestinationStatus {
+	status := &DestinationStatus{
+		ServerName:  s.serverName,
+		FailCount:   s.failCounter.Load(),
+		Blacklisted: s.blacklisted.Load(),
+	}
+	if b, ok := s.backoffUntil.Load().(time.Time); ok {
+		status.BackoffUntil = b
+	}
+	return status
+}
+
+// Refresh re-reads the backoff and blacklist state from the database, at
+// most once every statusRefreshInterval. It is used when another instance
+// may have changed the state since we last read it.
+func (s *ServerStatistics) Refresh() {
+	if last, ok := s.lastRefresh.Load().(time.Time); ok && time.Since(last) < statusRefreshInterval {
+		return
+	}
+	s.refresh()
+}
+
+// refresh reads the backoff and blacklist state from the database, if
+// there is one and anything has been stored for the server.
+func (s *ServerStatistics) refresh() {
+	if s.statistics == nil || s.statistics.DB == nil {
+		return
+	}
+	s.lastRefresh.Store(time.Now())
+	status, err := s.statistics.DB.GetDestinationStatus(context.TODO(), s.serverName)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get stored statistics for %q", s.serverName)
+		return
+	}
+	if status == nil {
+		return
+	}
+	s.failCounter.Store(status.FailCount)
+	s.blacklisted.Store(status.Blacklisted)
+	s.backoffUntil.Store(status.BackoffUntil)
+}
+
+// persist stores the current backoff and blacklist state in the
+// database, if there is one.
+func (s *ServerStatistics) persist() {
+	if s.statistics == nil || s.statistics.DB == nil {
+		return
+	}
+	if err := s.statistics.DB.UpdateDestinationStatus(context.TODO(), s.Status()); err != nil {
+		logrus.WithError(err).Errorf("Failed to store statistics for %q", s.serverName)
+	}
+}
+
 // BackoffDuration returns both a bool stating whether to wait,
 // and then if true, a duration to wait for.
 func (s *ServerStatistics) BackoffDuration() (bool, time.Duration) {
+	if b, ok := s.backoffUntil.Load().(time.Time); ok && b.After(time.Now()) {
+		// Another instance may have reset the backoff.
+		s.Refresh()
+	}
 	backoff, until := false, time.Second
 	if b, ok := s.backoffUntil.Load().(time.Time); ok {
 		if b.After(time.Now()) {
@@ -112,6 +216,10 @@ func (s *ServerStatistics) BackoffDuration() (bool, time.Duration) {
 // Blacklisted returns true if the server is blacklisted and false
 // otherwise.
 func (s *ServerStatistics) Blacklisted() bool {
+	if s.blacklisted.Load() {
+		// Another instance may have reset the blacklist.
+		s.Refresh()
+	}
 	return s.blacklisted.Load()
 }
 
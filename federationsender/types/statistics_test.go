@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type testStatisticsStorage struct {
+	mutex    sync.Mutex
+	statuses map[gomatrixserverlib.ServerName]DestinationStatus
+}
+
+func (t *testStatisticsStorage) GetDestinationStatus(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (*DestinationStatus, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	status, ok := t.statuses[serverName]
+	if !ok {
+		return nil, nil
+	}
+	return &status, nil
+}
+
+func (t *testStatisticsStorage) UpdateDestinationStatus(
+	ctx context.Context, status *DestinationStatus,
+) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.statuses[status.ServerName] = *status
+	return nil
+}
+
+func TestStatisticsArePersisted(t *testing.T) {
+	db := &testStatisticsStorage{
+		statuses: map[gomatrixserverlib.ServerName]DestinationStatus{},
+	}
+	serverName := gomatrixserverlib.ServerName("dead.example.com")
+
+	// Fail until the server gets blacklisted.
+	stats := &Statistics{DB: db}
+	for i := 1; i < FailuresUntilBlacklist; i++ {
+		if stats.ForServer(serverName).Failure() {
+			t.Fatalf("server blacklisted after only %d failures", i)
+		}
+	}
+	if backoff, _ := stats.ForServer(serverName).BackoffDuration(); !backoff {
+		t.Fatalf("expected to be backing off")
+	}
+	if !stats.ForServer(serverName).Failure() {
+		t.Fatalf("expected server to be blacklisted")
+	}
+
+	// A new set of statistics, e.g. after a restart, should pick up
+	// the stored state.
+	restarted := &Statistics{DB: db}
+	server := restarted.ForServer(serverName)
+	if !server.Blacklisted() {
+		t.Errorf("expected blacklist to survive restart")
+	}
+	if got := server.Status().FailCount; got != FailuresUntilBlacklist {
+		t.Errorf("expected fail count %d after restart, got %d", FailuresUntilBlacklist, got)
+	}
+
+	// Resetting the server should clear everything, including in the
+	// database.
+	server.Reset()
+	if backoff, _ := server.BackoffDuration(); backoff {
+		t.Errorf("expected backoff to be cleared by reset")
+	}
+	stored, _ := db.GetDestinationStatus(context.Background(), serverName)
+	if stored == nil || stored.Blacklisted || stored.FailCount != 0 || !stored.BackoffUntil.IsZero() {
+		t.Errorf("expected stored state to be reset, got %+v", stored)
+	}
+}
+
+func TestStatisticsSuccessOnlyPersistsChanges(t *testing.T) {
+	db := &testStatisticsStorage{
+		statuses: map[gomatrixserverlib.ServerName]DestinationStatus{},
+	}
+	serverName := gomatrixserverlib.ServerName("alive.example.com")
+
+	stats := &Statistics{DB: db}
+	stats.ForServer(serverName).Success()
+	if len(db.statuses) != 0 {
+		t.Errorf("expected nothing to be stored for a healthy server")
+	}
+
+	stats.ForServer(serverName).Failure()
+	stats.ForServer(serverName).Success()
+	if stored := db.statuses[serverName]; stored.FailCount != 0 {
+		t.Errorf("expected success to reset the stored fail count, got %d", stored.FailCount)
+	}
+}
+
+func TestStatisticsPickUpResetFromAnotherInstance(t *testing.T) {
+	db := &testStatisticsStorage{
+		statuses: map[gomatrixserverlib.ServerName]DestinationStatus{},
+	}
+	serverName := gomatrixserverlib.ServerName("dead.example.com")
+
+	// The instance that owns the server blacklists it, after another
+	// instance has already read its state.
+	owner, other := &Statistics{DB: db}, &Statistics{DB: db}
+	otherServer := other.ForServer(serverName)
+	for i := 0; i < FailuresUntilBlacklist; i++ {
+		owner.ForServer(serverName).Failure()
+	}
+	if !owner.ForServer(serverName).Blacklisted() {
+		t.Fatalf("expected server to be blacklisted")
+	}
+
+	// The other instance hears from the server and resets it.
+	defer func(interval time.Duration) { statusRefreshInterval = interval }(statusRefreshInterval)
+	statusRefreshInterval = 0
+	otherServer.Refresh()
+	if !otherServer.Blacklisted() {
+		t.Fatalf("expected the other instance to see the blacklist after refreshing")
+	}
+	otherServer.Reset()
+
+	if owner.ForServer(serverName).Blacklisted() {
+		t.Errorf("expected the owner to pick up the reset blacklist")
+	}
+	if backoff, _ := owner.ForServer(serverName).BackoffDuration(); backoff {
+		t.Errorf("expected the owner to pick up the reset backoff")
+	}
+}
+
+func TestStatisticsRefreshIsRateLimited(t *testing.T) {
+	db := &testStatisticsStorage{
+		statuses: map[gomatrixserverlib.ServerName]DestinationStatus{},
+	}
+	serverName := gomatrixserverlib.ServerName("dead.example.com")
+
+	stats := &Statistics{DB: db}
+	for i := 0; i < FailuresUntilBlacklist; i++ {
+		stats.ForServer(serverName).Failure()
+	}
+	db.statuses[serverName] = DestinationStatus{ServerName: serverName}
+	if !stats.ForServer(serverName).Blacklisted() {
+		t.Errorf("expected the stored state not to be re-read straight away")
+	}
+}
@@ -16,6 +16,7 @@ package types
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -28,8 +29,46 @@ type JoinedHost struct {
 	ServerName gomatrixserverlib.ServerName
 }
 
+// A JoinedHostsDelta is the change that a single room event made to the
+// joined hosts of its room.
+type JoinedHostsDelta struct {
+	// The joined hosts that the event added.
+	Added []JoinedHost `json:"added"`
+	// The joined hosts that the event removed.
+	Removed []JoinedHost `json:"removed"`
+}
+
+// Undo takes the joined hosts after the delta was applied and returns the
+// joined hosts before it was applied.
+func (d JoinedHostsDelta) Undo(joinedHosts []JoinedHost) []JoinedHost {
+	added := make(map[string]bool, len(d.Added))
+	for _, host := range d.Added {
+		added[host.MemberEventID] = true
+	}
+	result := make([]JoinedHost, 0, len(joinedHosts)+len(d.Removed))
+	for _, host := range joinedHosts {
+		if !added[host.MemberEventID] {
+			result = append(result, host)
+		}
+	}
+	return append(result, d.Removed...)
+}
+
 type ServerNames []gomatrixserverlib.ServerName
 
+// A DestinationStatus is the backoff and blacklist state of a remote
+// server that we send federation traffic to.
+type DestinationStatus struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// How many consecutive times we have failed to contact the server.
+	FailCount uint32 `json:"failure_count"`
+	// The time before which we won't try to contact the server again.
+	// This is the zero time if we aren't backing off.
+	BackoffUntil time.Time `json:"backoff_until"`
+	// Whether we have given up on the server altogether.
+	Blacklisted bool `json:"blacklisted"`
+}
+
 func (s ServerNames) Len() int           { return len(s) }
 func (s ServerNames) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s ServerNames) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acls
+
+import (
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MRoomServerACL is the event type of server ACL events.
+const MRoomServerACL = "m.room.server_acl"
+
+// ServerACLContent is the event content for https://matrix.org/docs/spec/client_server/r0.6.1#m-room-server-acl
+type ServerACLContent struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	AllowIPLiterals *bool    `json:"allow_ip_literals,omitempty"`
+}
+
+// ServerACL is a parsed m.room.server_acl event, which can be used to decide
+// whether a server is allowed to take part in a room.
+type ServerACL struct {
+	allowed         []*regexp.Regexp
+	denied          []*regexp.Regexp
+	allowIPLiterals bool
+}
+
+// NewServerACL parses the content of an m.room.server_acl event.
+func NewServerACL(content []byte) (*ServerACL, error) {
+	var c ServerACLContent
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, err
+	}
+	acl := &ServerACL{
+		allowIPLiterals: c.AllowIPLiterals == nil || *c.AllowIPLiterals,
+	}
+	for _, glob := range c.Allow {
+		re, err := compileGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		acl.allowed = append(acl.allowed, re)
+	}
+	for _, glob := range c.Deny {
+		re, err := compileGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		acl.denied = append(acl.denied, re)
+	}
+	return acl, nil
+}
+
+// IsServerBanned returns true if the server isn't allowed to take part in the
+// room. A nil ServerACL means that the room has no ACL, so nobody is banned.
+func (acl *ServerACL) IsServerBanned(serverName gomatrixserverlib.ServerName) bool {
+	if acl == nil {
+		return false
+	}
+	// ACLs are matched against the server name without the port.
+	host := string(serverName)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !acl.allowIPLiterals && isIPLiteral(host) {
+		return true
+	}
+	for _, re := range acl.denied {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	for _, re := range acl.allowed {
+		if re.MatchString(host) {
+			return false
+		}
+	}
+	// Servers which don't match any allow rule are banned.
+	return true
+}
+
+// isIPLiteral returns true if the host is an IPv4 address or a bracketed or
+// bare IPv6 address.
+func isIPLiteral(host string) bool {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.ParseIP(host) != nil
+}
+
+// compileGlob turns a glob where '*' matches any number of characters and
+// '?' matches a single character into a case-insensitive regular expression
+// which matches the whole server name.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("(?i)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
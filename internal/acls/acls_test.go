@@ -0,0 +1,74 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acls
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestServerACL(t *testing.T) {
+	acl, err := NewServerACL([]byte(`{
+		"allow": ["*"],
+		"deny": ["evil.com", "*.evil.com", "bad?.org"],
+		"allow_ip_literals": false
+	}`))
+	if err != nil {
+		t.Fatalf("NewServerACL failed: %s", err)
+	}
+	for serverName, wantBanned := range map[gomatrixserverlib.ServerName]bool{
+		"matrix.org":        false,
+		"matrix.org:8448":   false,
+		"evil.com":          true,
+		"EVIL.com:8448":     true,
+		"sub.evil.com":      true,
+		"notevil.com":       false,
+		"bad1.org":          true,
+		"bad12.org":         false,
+		"1.2.3.4":           true,
+		"1.2.3.4:8448":      true,
+		"[::1]:8448":        true,
+		"[2001:db8::1]":     true,
+		"evil.com.good.net": false,
+	} {
+		if banned := acl.IsServerBanned(serverName); banned != wantBanned {
+			t.Errorf("%s: wanted banned %v, got %v", serverName, wantBanned, banned)
+		}
+	}
+}
+
+func TestServerACLAllowList(t *testing.T) {
+	acl, err := NewServerACL([]byte(`{"allow": ["*.example.com"]}`))
+	if err != nil {
+		t.Fatalf("NewServerACL failed: %s", err)
+	}
+	for serverName, wantBanned := range map[gomatrixserverlib.ServerName]bool{
+		"a.example.com": false,
+		"example.com":   true,
+		"1.2.3.4":       true,
+		"matrix.org":    true,
+	} {
+		if banned := acl.IsServerBanned(serverName); banned != wantBanned {
+			t.Errorf("%s: wanted banned %v, got %v", serverName, wantBanned, banned)
+		}
+	}
+
+	// A room without an ACL doesn't ban anyone.
+	var noACL *ServerACL
+	if noACL.IsServerBanned("matrix.org") {
+		t.Errorf("wanted no servers to be banned without an ACL")
+	}
+}
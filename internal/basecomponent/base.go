@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/federationclient"
 	"github.com/matrix-org/dendrite/internal/httpapis"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -47,6 +48,7 @@ import (
 	serverKeyAPI "github.com/matrix-org/dendrite/serverkeyapi/api"
 	skinthttp "github.com/matrix-org/dendrite/serverkeyapi/inthttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
 
 	_ "net/http/pprof"
 )
@@ -69,6 +71,9 @@ type BaseDendrite struct {
 	Caches         *caching.Caches
 	KafkaConsumer  sarama.Consumer
 	KafkaProducer  sarama.SyncProducer
+
+	federationTransport *federationclient.Transport
+	federationBackoff   *federationclient.FederationSenderBackoff
 }
 
 const HTTPServerTimeout = time.Minute * 5
@@ -193,7 +198,7 @@ func (b *BaseDendrite) ServerKeyAPIClient() serverKeyAPI.ServerKeyInternalAPI {
 // CreateDeviceDB creates a new instance of the device database. Should only be
 // called once per component.
 func (b *BaseDendrite) CreateDeviceDB() devices.Database {
-	db, err := devices.NewDatabase(string(b.Cfg.Database.Device), b.Cfg.DbProperties(), b.Cfg.Matrix.ServerName)
+	db, err := devices.NewDatabase(string(b.Cfg.Database.Device), b.Cfg.DbProperties())
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to devices db")
 	}
@@ -204,7 +209,7 @@ func (b *BaseDendrite) CreateDeviceDB() devices.Database {
 // CreateAccountsDB creates a new instance of the accounts database. Should only
 // be called once per component.
 func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
-	db, err := accounts.NewDatabase(string(b.Cfg.Database.Account), b.Cfg.DbProperties(), b.Cfg.Matrix.ServerName)
+	db, err := accounts.NewDatabase(string(b.Cfg.Database.Account), b.Cfg.DbProperties(), b.Cfg.LocalServerNames())
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to accounts db")
 	}
@@ -215,11 +220,40 @@ func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
 // CreateFederationClient creates a new federation client. Should only be called
 // once per component.
 func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationClient {
-	return gomatrixserverlib.NewFederationClient(
+	return b.CreateFederationClientFor(
 		b.Cfg.Matrix.ServerName, b.Cfg.Matrix.KeyID, b.Cfg.Matrix.PrivateKey,
 	)
 }
 
+// CreateFederationClientFor creates a new federation client which signs its
+// requests as the given server name, e.g. for a virtual host. All federation
+// clients created by the component share the same per-destination limits.
+func (b *BaseDendrite) CreateFederationClientFor(
+	serverName gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID,
+	privateKey ed25519.PrivateKey,
+) *gomatrixserverlib.FederationClient {
+	if b.federationTransport == nil {
+		b.federationBackoff = federationclient.NewFederationSenderBackoff()
+		// The federation sender handles its own backoff. Other components
+		// running separately can ask it about its backoff state straight
+		// away, whereas the monolith has to call SetFederationSenderAPI.
+		if b.UseHTTPAPIs && b.componentName != "FederationSender" {
+			b.federationBackoff.SetFederationSenderAPI(b.FederationSenderHTTPClient())
+		}
+		b.federationTransport = federationclient.NewTransport(b.Cfg, nil, b.federationBackoff)
+	}
+	return federationclient.New(serverName, keyID, privateKey, b.federationTransport)
+}
+
+// SetFederationSenderAPI sets the federation sender API that the federation
+// clients consult, so that they don't make requests to destinations that the
+// federation sender is backing off from.
+func (b *BaseDendrite) SetFederationSenderAPI(fsAPI federationSenderAPI.FederationSenderInternalAPI) {
+	if b.federationBackoff != nil {
+		b.federationBackoff.SetFederationSenderAPI(fsAPI)
+	}
+}
+
 // SetupAndServeHTTP sets up the HTTP server to serve endpoints registered on
 // ApiMux under /api/ and adds a prometheus handler under /metrics.
 func (b *BaseDendrite) SetupAndServeHTTP(bindaddr string, listenaddr string) {
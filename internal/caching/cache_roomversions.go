@@ -13,6 +13,7 @@ const (
 type RoomVersionCache interface {
 	GetRoomVersion(roomID string) (roomVersion gomatrixserverlib.RoomVersion, ok bool)
 	StoreRoomVersion(roomID string, roomVersion gomatrixserverlib.RoomVersion)
+	EvictRoomVersion(roomID string)
 }
 
 func (c Caches) GetRoomVersion(roomID string) (gomatrixserverlib.RoomVersion, bool) {
@@ -28,3 +29,7 @@ func (c Caches) GetRoomVersion(roomID string) (gomatrixserverlib.RoomVersion, bo
 func (c Caches) StoreRoomVersion(roomID string, roomVersion gomatrixserverlib.RoomVersion) {
 	c.RoomVersions.Set(roomID, roomVersion)
 }
+
+func (c Caches) EvictRoomVersion(roomID string) {
+	c.RoomVersions.Unset(roomID)
+}
@@ -0,0 +1,37 @@
+package caching
+
+import "github.com/matrix-org/dendrite/internal/acls"
+
+const (
+	ServerACLCacheName       = "server_acls"
+	ServerACLCacheMaxEntries = 1024
+	ServerACLCacheMutable    = true
+)
+
+// ServerACLCache contains the subset of functions needed for
+// a server ACL cache.
+type ServerACLCache interface {
+	// GetServerACL returns the parsed ACL for the room. A nil ACL with ok set
+	// means that the room is known not to have an ACL.
+	GetServerACL(roomID string) (acl *acls.ServerACL, ok bool)
+	StoreServerACL(roomID string, acl *acls.ServerACL)
+	EvictServerACL(roomID string)
+}
+
+func (c Caches) GetServerACL(roomID string) (*acls.ServerACL, bool) {
+	val, found := c.ServerACLs.Get(roomID)
+	if found && val != nil {
+		if acl, ok := val.(*acls.ServerACL); ok {
+			return acl, true
+		}
+	}
+	return nil, false
+}
+
+func (c Caches) StoreServerACL(roomID string, acl *acls.ServerACL) {
+	c.ServerACLs.Set(roomID, acl)
+}
+
+func (c Caches) EvictServerACL(roomID string) {
+	c.ServerACLs.Unset(roomID)
+}
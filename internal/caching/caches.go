@@ -6,10 +6,19 @@ package caching
 type Caches struct {
 	RoomVersions Cache // implements RoomVersionCache
 	ServerKeys   Cache // implements ServerKeyCache
+	ServerACLs   Cache // implements ServerACLCache
+}
+
+// RoomServerCaches contains the subset of functions needed for
+// the roomserver's caches.
+type RoomServerCaches interface {
+	RoomVersionCache
+	ServerACLCache
 }
 
 // Cache is the interface that an implementation must satisfy.
 type Cache interface {
 	Get(key string) (value interface{}, ok bool)
 	Set(key string, value interface{})
+	Unset(key string)
 }
@@ -25,9 +25,18 @@ func NewInMemoryLRUCache() (*Caches, error) {
 	if err != nil {
 		return nil, err
 	}
+	serverACLs, err := NewInMemoryLRUCachePartition(
+		ServerACLCacheName,
+		ServerACLCacheMutable,
+		ServerACLCacheMaxEntries,
+	)
+	if err != nil {
+		return nil, err
+	}
 	return &Caches{
 		RoomVersions: roomVersions,
 		ServerKeys:   serverKeys,
+		ServerACLs:   serverACLs,
 	}, nil
 }
 
@@ -71,3 +80,7 @@ func (c *InMemoryLRUCachePartition) Set(key string, value interface{}) {
 func (c *InMemoryLRUCachePartition) Get(key string) (value interface{}, ok bool) {
 	return c.lru.Get(key)
 }
+
+func (c *InMemoryLRUCachePartition) Unset(key string) {
+	c.lru.Remove(key)
+}
@@ -62,6 +62,10 @@ type Dendrite struct {
 		// An arbitrary string used to uniquely identify the PrivateKey. Must start with the
 		// prefix "ed25519:".
 		KeyID gomatrixserverlib.KeyID `yaml:"-"`
+		// Additional server names that are hosted by this deployment, each
+		// with its own signing key. Requests and events for these server
+		// names are signed with their own key rather than PrivateKey.
+		VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
 		// List of paths to X509 certificates used by the external federation listeners.
 		// These are used to calculate the TLS fingerprints to publish for this server.
 		// Other matrix servers talking to this server will expect the x509 certificate
@@ -102,6 +106,9 @@ type Dendrite struct {
 		// Perspective keyservers, to use as a backup when direct key fetch
 		// requests don't succeed
 		KeyPerspectives KeyPerspectives `yaml:"key_perspectives"`
+		// The local users who may use the server admin API, such as to
+		// shut down rooms.
+		AdminUserIDs []string `yaml:"admin_user_ids"`
 	} `yaml:"matrix"`
 
 	// The configuration specific to the media repostitory.
@@ -122,6 +129,95 @@ type Dendrite struct {
 		ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
 	} `yaml:"media"`
 
+	// The configuration for purging old room history.
+	Retention struct {
+		// Set to true to periodically purge events which are older than the
+		// retention policy of their room.
+		Enabled bool `yaml:"enabled"`
+		// The shortest lifetime that a room's m.room.retention policy can set.
+		// Shorter lifetimes are increased to this value. 0 means no minimum.
+		MinLifetime time.Duration `yaml:"min_lifetime"`
+		// The longest lifetime that a room's m.room.retention policy can set.
+		// Longer lifetimes are reduced to this value. This is also the lifetime
+		// of events in rooms which don't have a policy. 0 means no maximum.
+		MaxLifetime time.Duration `yaml:"max_lifetime"`
+		// How often to look for events to purge.
+		PurgeInterval time.Duration `yaml:"purge_interval"`
+	} `yaml:"retention"`
+
+	// The configuration for keeping down the number of forward extremities in
+	// rooms, which otherwise makes every new event slow to process.
+	ForwardExtremities struct {
+		// Send a dummy event to merge the forward extremities of a room when
+		// it has more than this many. 0 means never.
+		DummyEventThreshold int `yaml:"dummy_event_threshold"`
+		// Drop forward extremities which were sent more than stale_age before
+		// the newest forward extremity of the room and which are more than
+		// stale_depth events behind it. 0 means never.
+		StaleAge   time.Duration `yaml:"stale_age"`
+		StaleDepth int64         `yaml:"stale_depth"`
+	} `yaml:"forward_extremities"`
+
+	// The configuration for running several federation sender instances
+	// which share the outbound federation traffic between them.
+	FederationSender struct {
+		// The number of federation sender instances. Each destination server
+		// is handled by exactly one instance, chosen by hashing its name.
+		ShardCount int `yaml:"shard_count"`
+		// Which of the instances this is, from 0 to shard_count-1.
+		ShardIndex int `yaml:"shard_index"`
+	} `yaml:"federation_sender"`
+
+	// The configuration for processing inbound federation transactions.
+	FederationAPI struct {
+		// The maximum number of rooms whose inbound events are processed at
+		// once. The events for each room are always processed in order.
+		MaxConcurrentRooms int `yaml:"max_concurrent_rooms"`
+		// The maximum number of inbound events which can be waiting to be
+		// processed. Transactions are rejected, and so retried later by the
+		// sending server, while this many are waiting.
+		MaxQueuedEvents int `yaml:"max_queued_events"`
+	} `yaml:"federation_api"`
+
+	// The configuration for the client used to make outbound federation
+	// requests to other servers.
+	FederationClient struct {
+		// The maximum number of requests that may be in flight to a single
+		// destination server at once. Further requests wait for a free slot.
+		MaxConcurrentRequestsPerDestination int `yaml:"max_concurrent_requests_per_destination"`
+		// How long requests of each class may take, including any time spent
+		// waiting for a free slot and any retries.
+		Timeouts struct {
+			// Transactions, joins, leaves and invites.
+			Send time.Duration `yaml:"send"`
+			// Requests for room state, auth chains and missing events.
+			State time.Duration `yaml:"state"`
+			// Backfill requests.
+			Backfill time.Duration `yaml:"backfill"`
+			// Everything else, e.g. key, directory and profile queries.
+			Query time.Duration `yaml:"query"`
+		} `yaml:"timeouts"`
+		// How many times a failed GET request is retried, or 0 to never retry.
+		MaxGETRetries int `yaml:"max_get_retries"`
+	} `yaml:"federation_client"`
+
+	// The configuration for server notices, which let the server
+	// administrators send messages to users in a room of their own.
+	ServerNotices struct {
+		// Set to true to enable server notices.
+		Enabled bool `yaml:"enabled"`
+		// The localpart of the system user which sends the notices. Its
+		// account is created when the first notice is sent.
+		LocalPart string `yaml:"local_part"`
+		// The display name and avatar URL of the system user.
+		DisplayName string `yaml:"display_name"`
+		AvatarURL   string `yaml:"avatar_url"`
+		// The name of the room that the notices are sent to.
+		RoomName string `yaml:"room_name"`
+		// The local users who may send server notices with the admin API.
+		AdminUserIDs []string `yaml:"admin_user_ids"`
+	} `yaml:"server_notices"`
+
 	// The configuration to use for Prometheus metrics
 	Metrics struct {
 		// Whether or not the metrics are enabled
@@ -182,6 +278,10 @@ type Dendrite struct {
 		// The FederationSender database stores information used by the FederationSender
 		// It is only accessed by the FederationSender.
 		FederationSender DataSource `yaml:"federation_sender"`
+		// The FederationAPI database stores our responses to inbound transactions
+		// so that retried transactions aren't processed twice.
+		// It is only accessed by the FederationAPI.
+		FederationAPI DataSource `yaml:"federation_api"`
 		// The AppServices database stores information used by the AppService component.
 		// It is only accessed by the AppService component.
 		AppService DataSource `yaml:"appservice"`
@@ -190,6 +290,10 @@ type Dendrite struct {
 		PublicRoomsAPI DataSource `yaml:"public_rooms_api"`
 		// The Naffka database is used internally by the naffka library, if used.
 		Naffka DataSource `yaml:"naffka,omitempty"`
+		// Whether to compress the JSON of new events in the RoomServer database.
+		// Events which were stored before this was changed stay as they are
+		// until they are rewritten with the compress-room-events command.
+		CompressRoomServerEvents bool `yaml:"compress_room_server_events"`
 		// Maximum open connections to the DB (0 = use default, negative means unlimited)
 		MaxOpenConns int `yaml:"max_open_conns"`
 		// Maximum idle connections to the DB (0 = use default, negative means unlimited)
@@ -325,6 +429,21 @@ type KeyPerspectives []struct {
 	} `yaml:"keys"`
 }
 
+// A VirtualHost is an additional server name hosted by this deployment.
+type VirtualHost struct {
+	// The name of the virtual host, e.g. 'example.org'.
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+	// Path to the private key which will be used to sign requests and
+	// events for this server name.
+	PrivateKeyPath Path `yaml:"private_key"`
+	// The private key which will be used to sign requests and events for
+	// this server name.
+	PrivateKey ed25519.PrivateKey `yaml:"-"`
+	// An arbitrary string used to uniquely identify the PrivateKey. Must
+	// start with the prefix "ed25519:".
+	KeyID gomatrixserverlib.KeyID `yaml:"-"`
+}
+
 // A Path on the filesystem.
 type Path string
 
@@ -414,6 +533,19 @@ func loadConfig(
 		return nil, err
 	}
 
+	for i := range config.Matrix.VirtualHosts {
+		vhost := &config.Matrix.VirtualHosts[i]
+		vhostKeyPath := absPath(basePath, vhost.PrivateKeyPath)
+		var vhostKeyData []byte
+		vhostKeyData, err = readFile(vhostKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if vhost.KeyID, vhost.PrivateKey, err = readKeyPEM(vhostKeyPath, vhostKeyData); err != nil {
+			return nil, err
+		}
+	}
+
 	for _, certPath := range config.Matrix.FederationCertificatePaths {
 		absCertPath := absPath(basePath, certPath)
 		var pemData []byte
@@ -485,6 +617,54 @@ func (config *Dendrite) SetDefaults() {
 		config.Media.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	}
 
+	if config.Retention.PurgeInterval == 0 {
+		config.Retention.PurgeInterval = time.Hour
+	}
+
+	if config.FederationSender.ShardCount == 0 {
+		config.FederationSender.ShardCount = 1
+	}
+
+	if config.FederationAPI.MaxConcurrentRooms == 0 {
+		config.FederationAPI.MaxConcurrentRooms = 10
+	}
+
+	if config.FederationAPI.MaxQueuedEvents == 0 {
+		config.FederationAPI.MaxQueuedEvents = 10000
+	}
+
+	if config.FederationClient.MaxConcurrentRequestsPerDestination == 0 {
+		config.FederationClient.MaxConcurrentRequestsPerDestination = 10
+	}
+
+	if config.FederationClient.Timeouts.Send == 0 {
+		config.FederationClient.Timeouts.Send = 2 * time.Minute
+	}
+
+	if config.FederationClient.Timeouts.State == 0 {
+		config.FederationClient.Timeouts.State = 2 * time.Minute
+	}
+
+	if config.FederationClient.Timeouts.Backfill == 0 {
+		config.FederationClient.Timeouts.Backfill = time.Minute
+	}
+
+	if config.FederationClient.Timeouts.Query == 0 {
+		config.FederationClient.Timeouts.Query = 30 * time.Second
+	}
+
+	if config.ServerNotices.LocalPart == "" {
+		config.ServerNotices.LocalPart = "notices"
+	}
+
+	if config.ServerNotices.DisplayName == "" {
+		config.ServerNotices.DisplayName = "Server Notices"
+	}
+
+	if config.ServerNotices.RoomName == "" {
+		config.ServerNotices.RoomName = "Server Notices"
+	}
+
 	if config.Database.MaxIdleConns == 0 {
 		config.Database.MaxIdleConns = 2
 	}
@@ -559,6 +739,62 @@ func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 		checkNotEmpty(configErrs, "matrix.recaptcha_private_key", string(config.Matrix.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_siteverify_api", string(config.Matrix.RecaptchaSiteVerifyAPI))
 	}
+	seen := map[gomatrixserverlib.ServerName]bool{config.Matrix.ServerName: true}
+	for _, vhost := range config.Matrix.VirtualHosts {
+		checkNotEmpty(configErrs, "matrix.virtual_hosts.server_name", string(vhost.ServerName))
+		checkNotEmpty(configErrs, "matrix.virtual_hosts.private_key", string(vhost.PrivateKeyPath))
+		if seen[vhost.ServerName] {
+			configErrs.Add(fmt.Sprintf("duplicate server name %q in config key %q", vhost.ServerName, "matrix.virtual_hosts"))
+		}
+		seen[vhost.ServerName] = true
+	}
+	for _, userID := range config.Matrix.AdminUserIDs {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || !config.IsLocalServerName(domain) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q is not a local user ID", "matrix.admin_user_ids", userID))
+		}
+	}
+}
+
+// IsLocalServerName returns true if the server name is either the main
+// server name of this deployment or one of its virtual hosts.
+func (config *Dendrite) IsLocalServerName(serverName gomatrixserverlib.ServerName) bool {
+	_, _, ok := config.SigningIdentityFor(serverName)
+	return ok
+}
+
+// IsAccountServerName returns true if the accounts, devices and profiles of
+// users on the server name are stored by this deployment. They are stored
+// per server name, so this is true for the main server name and for each of
+// the virtual hosts.
+func (config *Dendrite) IsAccountServerName(serverName gomatrixserverlib.ServerName) bool {
+	return config.IsLocalServerName(serverName)
+}
+
+// LocalServerNames returns the main server name followed by the server
+// names of any virtual hosts.
+func (config *Dendrite) LocalServerNames() []gomatrixserverlib.ServerName {
+	serverNames := []gomatrixserverlib.ServerName{config.Matrix.ServerName}
+	for _, vhost := range config.Matrix.VirtualHosts {
+		serverNames = append(serverNames, vhost.ServerName)
+	}
+	return serverNames
+}
+
+// SigningIdentityFor returns the key ID and private key which should be
+// used to sign requests and events for the given local server name. It
+// returns false if the server name isn't hosted by this deployment.
+func (config *Dendrite) SigningIdentityFor(
+	serverName gomatrixserverlib.ServerName,
+) (gomatrixserverlib.KeyID, ed25519.PrivateKey, bool) {
+	if serverName == config.Matrix.ServerName {
+		return config.Matrix.KeyID, config.Matrix.PrivateKey, true
+	}
+	for _, vhost := range config.Matrix.VirtualHosts {
+		if serverName == vhost.ServerName {
+			return vhost.KeyID, vhost.PrivateKey, true
+		}
+	}
+	return "", nil, false
 }
 
 // checkMedia verifies the parameters media.* are valid.
@@ -573,6 +809,69 @@ func (config *Dendrite) checkMedia(configErrs *configErrors) {
 	}
 }
 
+// checkForwardExtremities verifies the parameters forward_extremities.* are valid.
+func (config *Dendrite) checkForwardExtremities(configErrs *configErrors) {
+	checkPositive(configErrs, "forward_extremities.dummy_event_threshold", int64(config.ForwardExtremities.DummyEventThreshold))
+	checkPositive(configErrs, "forward_extremities.stale_age", int64(config.ForwardExtremities.StaleAge))
+	checkPositive(configErrs, "forward_extremities.stale_depth", config.ForwardExtremities.StaleDepth)
+}
+
+// checkFederationSender verifies the parameters federation_sender.* are valid.
+func (config *Dendrite) checkFederationSender(configErrs *configErrors) {
+	checkPositive(configErrs, "federation_sender.shard_index", int64(config.FederationSender.ShardIndex))
+	if config.FederationSender.ShardCount < 1 {
+		configErrs.Add(fmt.Sprintf(
+			"invalid value for config key %q: %d", "federation_sender.shard_count", config.FederationSender.ShardCount,
+		))
+	} else if config.FederationSender.ShardIndex >= config.FederationSender.ShardCount {
+		configErrs.Add(fmt.Sprintf(
+			"config key %q must be less than %q", "federation_sender.shard_index", "federation_sender.shard_count",
+		))
+	}
+}
+
+// checkFederationAPI verifies the parameters federation_api.* are valid.
+func (config *Dendrite) checkFederationAPI(configErrs *configErrors) {
+	checkPositive(configErrs, "federation_api.max_concurrent_rooms", int64(config.FederationAPI.MaxConcurrentRooms))
+	checkPositive(configErrs, "federation_api.max_queued_events", int64(config.FederationAPI.MaxQueuedEvents))
+}
+
+// checkFederationClient verifies the parameters federation_client.* are valid.
+func (config *Dendrite) checkFederationClient(configErrs *configErrors) {
+	checkPositive(configErrs, "federation_client.max_concurrent_requests_per_destination", int64(config.FederationClient.MaxConcurrentRequestsPerDestination))
+	checkPositive(configErrs, "federation_client.timeouts.send", int64(config.FederationClient.Timeouts.Send))
+	checkPositive(configErrs, "federation_client.timeouts.state", int64(config.FederationClient.Timeouts.State))
+	checkPositive(configErrs, "federation_client.timeouts.backfill", int64(config.FederationClient.Timeouts.Backfill))
+	checkPositive(configErrs, "federation_client.timeouts.query", int64(config.FederationClient.Timeouts.Query))
+	checkPositive(configErrs, "federation_client.max_get_retries", int64(config.FederationClient.MaxGETRetries))
+}
+
+// checkServerNotices verifies the parameters server_notices.* are valid.
+func (config *Dendrite) checkServerNotices(configErrs *configErrors) {
+	if !config.ServerNotices.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "server_notices.local_part", config.ServerNotices.LocalPart)
+	for _, userID := range config.ServerNotices.AdminUserIDs {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || !config.IsLocalServerName(domain) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q is not a local user ID", "server_notices.admin_user_ids", userID))
+		}
+	}
+}
+
+// checkRetention verifies the parameters retention.* are valid.
+func (config *Dendrite) checkRetention(configErrs *configErrors) {
+	checkPositive(configErrs, "retention.min_lifetime", int64(config.Retention.MinLifetime))
+	checkPositive(configErrs, "retention.max_lifetime", int64(config.Retention.MaxLifetime))
+	checkPositive(configErrs, "retention.purge_interval", int64(config.Retention.PurgeInterval))
+	if config.Retention.MaxLifetime > 0 && config.Retention.MinLifetime > config.Retention.MaxLifetime {
+		configErrs.Add(fmt.Sprintf(
+			"invalid value for config key %q: must not be less than %q",
+			"retention.max_lifetime", "retention.min_lifetime",
+		))
+	}
+}
+
 // checkKafka verifies the parameters kafka.* and the related
 // database.naffka are valid.
 func (config *Dendrite) checkKafka(configErrs *configErrors, monolithic bool) {
@@ -602,6 +901,7 @@ func (config *Dendrite) checkDatabase(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "database.media_api", string(config.Database.MediaAPI))
 	checkNotEmpty(configErrs, "database.sync_api", string(config.Database.SyncAPI))
 	checkNotEmpty(configErrs, "database.room_server", string(config.Database.RoomServer))
+	checkNotEmpty(configErrs, "database.federation_api", string(config.Database.FederationAPI))
 }
 
 // checkListen verifies the parameters listen.* are valid.
@@ -638,6 +938,12 @@ func (config *Dendrite) check(monolithic bool) error {
 	config.checkMatrix(&configErrs)
 	config.checkMedia(&configErrs)
 	config.checkTurn(&configErrs)
+	config.checkRetention(&configErrs)
+	config.checkForwardExtremities(&configErrs)
+	config.checkFederationSender(&configErrs)
+	config.checkFederationAPI(&configErrs)
+	config.checkFederationClient(&configErrs)
+	config.checkServerNotices(&configErrs)
 	config.checkKafka(&configErrs, monolithic)
 	config.checkDatabase(&configErrs)
 	config.checkLogging(&configErrs)
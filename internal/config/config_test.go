@@ -16,7 +16,10 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
@@ -32,6 +35,71 @@ func TestLoadConfigRelative(t *testing.T) {
 	}
 }
 
+func TestLoadConfigVirtualHosts(t *testing.T) {
+	vhostConfig := strings.Replace(testConfig, "  federation_certificates: [tls_cert.pem]\n", `  federation_certificates: [tls_cert.pem]
+  virtual_hosts:
+    - server_name: example.org
+      private_key: example_org_key.pem
+`, 1)
+	cfg, err := loadConfig("/my/config/dir", []byte(vhostConfig),
+		mockReadFile{
+			"/my/config/dir/matrix_key.pem":      testKey,
+			"/my/config/dir/example_org_key.pem": testKey,
+			"/my/config/dir/tls_cert.pem":        testCert,
+		}.readFile,
+		false,
+	)
+	if err != nil {
+		t.Fatal("failed to load config:", err)
+	}
+	for _, serverName := range []gomatrixserverlib.ServerName{"localhost", "example.org"} {
+		if !cfg.IsLocalServerName(serverName) {
+			t.Errorf("expected %q to be a local server name", serverName)
+		}
+		if keyID, privateKey, ok := cfg.SigningIdentityFor(serverName); !ok || keyID == "" || privateKey == nil {
+			t.Errorf("expected a signing identity for %q", serverName)
+		}
+	}
+	if cfg.IsLocalServerName("example.com") {
+		t.Errorf("expected %q not to be a local server name", "example.com")
+	}
+
+	duplicateConfig := strings.Replace(vhostConfig, "server_name: example.org", "server_name: localhost", 1)
+	if _, err = loadConfig("/my/config/dir", []byte(duplicateConfig),
+		mockReadFile{
+			"/my/config/dir/matrix_key.pem":      testKey,
+			"/my/config/dir/example_org_key.pem": testKey,
+			"/my/config/dir/tls_cert.pem":        testCert,
+		}.readFile,
+		false,
+	); err == nil {
+		t.Errorf("expected duplicate virtual host server name to be rejected")
+	}
+}
+
+func TestLoadConfigServerNotices(t *testing.T) {
+	noticesConfig := testConfig + `server_notices:
+  enabled: true
+  admin_user_ids: ["@admin:localhost"]
+`
+	files := mockReadFile{
+		"/my/config/dir/matrix_key.pem": testKey,
+		"/my/config/dir/tls_cert.pem":   testCert,
+	}.readFile
+	cfg, err := loadConfig("/my/config/dir", []byte(noticesConfig), files, false)
+	if err != nil {
+		t.Fatal("failed to load config:", err)
+	}
+	if cfg.ServerNotices.LocalPart != "notices" {
+		t.Errorf("expected default local part %q, got %q", "notices", cfg.ServerNotices.LocalPart)
+	}
+
+	remoteAdminConfig := strings.Replace(noticesConfig, "@admin:localhost", "@admin:example.com", 1)
+	if _, err = loadConfig("/my/config/dir", []byte(remoteAdminConfig), files, false); err == nil {
+		t.Errorf("expected a remote server notices admin to be rejected")
+	}
+}
+
 const testConfig = `
 version: 0
 matrix:
@@ -54,6 +122,7 @@ database:
   server_key: "postgresql:///server_keys"
   sync_api: "postgresql:///syn_api"
   room_server: "postgresql:///room_server"
+  federation_api: "postgresql:///federation_api"
   appservice: "postgresql:///appservice"
 listen:
   room_server: "localhost:7770"
@@ -51,9 +51,14 @@ func BuildEvent(
 		return nil, err
 	}
 
+	// Events sent by users on virtual hosts are signed by that server name.
+	origin := cfg.Matrix.ServerName
+	if _, domain, serr := gomatrixserverlib.SplitID('@', builder.Sender); serr == nil && cfg.IsLocalServerName(domain) {
+		origin = domain
+	}
+	keyID, privateKey, _ := cfg.SigningIdentityFor(origin)
 	event, err := builder.Build(
-		evTime, cfg.Matrix.ServerName, cfg.Matrix.KeyID,
-		cfg.Matrix.PrivateKey, queryRes.RoomVersion,
+		evTime, origin, keyID, privateKey, queryRes.RoomVersion,
 	)
 	if err != nil {
 		return nil, err
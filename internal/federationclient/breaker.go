@@ -0,0 +1,124 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// How long the backoff state of a destination is cached for before the
+// federation sender is asked again. This keeps the breaker from adding an
+// internal API request to every outbound federation request.
+const backoffCacheTTL = 5 * time.Second
+
+// The number of cached destinations above which expired entries are pruned.
+const backoffCacheMaxSize = 1000
+
+// BackoffChecker decides whether requests to a destination should be
+// refused without being attempted.
+type BackoffChecker interface {
+	IsBackingOff(ctx context.Context, serverName gomatrixserverlib.ServerName) bool
+}
+
+// FederationSenderBackoff is a BackoffChecker which refuses requests to
+// destinations that the federation sender is backing off from or has
+// blacklisted. Until the federation sender API is set, or if it can't be
+// queried, all requests are allowed.
+type FederationSenderBackoff struct {
+	mutex sync.Mutex // protects the below
+	api   fsAPI.FederationSenderInternalAPI
+	cache map[gomatrixserverlib.ServerName]cachedStatus
+}
+
+type cachedStatus struct {
+	status    types.DestinationStatus
+	fetchedAt time.Time
+}
+
+// NewFederationSenderBackoff creates a new FederationSenderBackoff.
+func NewFederationSenderBackoff() *FederationSenderBackoff {
+	return &FederationSenderBackoff{
+		cache: make(map[gomatrixserverlib.ServerName]cachedStatus),
+	}
+}
+
+// SetFederationSenderAPI sets the federation sender API to consult. It
+// is separate from the constructor because the federation client is
+// created before the federation sender in the monolith.
+func (b *FederationSenderBackoff) SetFederationSenderAPI(api fsAPI.FederationSenderInternalAPI) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.api = api
+	b.cache = make(map[gomatrixserverlib.ServerName]cachedStatus)
+}
+
+// IsBackingOff implements BackoffChecker.
+func (b *FederationSenderBackoff) IsBackingOff(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) bool {
+	now := time.Now()
+	b.mutex.Lock()
+	api := b.api
+	cached, ok := b.cache[serverName]
+	b.mutex.Unlock()
+	if api == nil {
+		return false
+	}
+
+	if !ok || now.Sub(cached.fetchedAt) > backoffCacheTTL {
+		var res fsAPI.QueryDestinationStatusResponse
+		err := api.QueryDestinationStatus(ctx, &fsAPI.QueryDestinationStatusRequest{
+			ServerNames: []gomatrixserverlib.ServerName{serverName},
+		}, &res)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Warn("Failed to query destination backoff state")
+			return false
+		}
+		cached = cachedStatus{
+			status:    types.DestinationStatus{ServerName: serverName},
+			fetchedAt: now,
+		}
+		for _, status := range res.Destinations {
+			if status.ServerName == serverName {
+				cached.status = status
+			}
+		}
+		b.store(cached)
+	}
+
+	// The backoff is compared against the current time rather than being
+	// cached as a boolean, so that a cached backoff ends when it should.
+	return cached.status.Blacklisted || cached.status.BackoffUntil.After(now)
+}
+
+func (b *FederationSenderBackoff) store(cached cachedStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.cache) >= backoffCacheMaxSize {
+		for serverName, entry := range b.cache {
+			if cached.fetchedAt.Sub(entry.fetchedAt) > backoffCacheTTL {
+				delete(b.cache, serverName)
+			}
+		}
+	}
+	b.cache[cached.status.ServerName] = cached
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import "strings"
+
+// RequestClass groups federation requests that should have the same timeout.
+type RequestClass string
+
+const (
+	// RequestClassSend is for transactions, joins, leaves and invites.
+	RequestClassSend RequestClass = "send"
+	// RequestClassState is for room state, auth chains and missing events.
+	RequestClassState RequestClass = "state"
+	// RequestClassBackfill is for backfill requests.
+	RequestClassBackfill RequestClass = "backfill"
+	// RequestClassQuery is for everything else.
+	RequestClassQuery RequestClass = "query"
+)
+
+// The endpoints that belong to each class other than RequestClassQuery.
+var endpointClasses = map[string]RequestClass{
+	"send":               RequestClassSend,
+	"send_join":          RequestClassSend,
+	"send_leave":         RequestClassSend,
+	"invite":             RequestClassSend,
+	"state":              RequestClassState,
+	"state_ids":          RequestClassState,
+	"event":              RequestClassState,
+	"event_auth":         RequestClassState,
+	"get_missing_events": RequestClassState,
+	"backfill":           RequestClassBackfill,
+}
+
+// The endpoints that are attempted even while the destination is backing
+// off. Our key requests are needed to verify inbound requests from the
+// destination, which is how we find out that it has come back, and the
+// join and leave handshakes are made for a user who is waiting on them.
+var breakerExemptEndpoints = map[string]bool{
+	"key/server": true,
+	"key/query":  true,
+	"make_join":  true,
+	"send_join":  true,
+	"make_leave": true,
+	"send_leave": true,
+}
+
+// classify returns the class of a request for the given URL path.
+func classify(path string) RequestClass {
+	if class, ok := endpointClasses[endpointName(path)]; ok {
+		return class
+	}
+	return RequestClassQuery
+}
+
+// endpointName returns the name of the federation API endpoint for the URL
+// path without any of the path parameters, so that it is suitable for use
+// as a metric label. For example, "/_matrix/federation/v1/send/123" gives
+// "send" and "/_matrix/federation/v1/query/directory" gives "query/directory".
+func endpointName(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "_matrix" {
+		return "unknown"
+	}
+	switch {
+	case parts[1] == "key":
+		return "key/" + parts[3]
+	case parts[1] == "federation" && parts[3] == "query" && len(parts) > 4:
+		return "query/" + parts[4]
+	case parts[1] == "federation":
+		return parts[3]
+	}
+	return "unknown"
+}
@@ -0,0 +1,293 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package federationclient wraps the gomatrixserverlib federation client
+// so that outbound federation requests from every component share the same
+// per-destination limits, timeouts, retries, metrics and circuit breaker.
+package federationclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The base delay before retrying a failed GET request. It doubles with
+// every attempt and is jittered so that retries don't arrive in lockstep.
+const retryBaseDelay = 500 * time.Millisecond
+
+// ErrCircuitOpen is returned for requests that aren't attempted because
+// the federation sender is backing off from the destination.
+var ErrCircuitOpen = errors.New("federationclient: destination is backing off")
+
+// New creates a federation client for the given server name which sends
+// its requests through the transport. The transport may be shared by
+// several clients, e.g. for virtual hosts, so that they share its limits.
+func New(
+	serverName gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID,
+	privateKey ed25519.PrivateKey, transport *Transport,
+) *gomatrixserverlib.FederationClient {
+	fc := gomatrixserverlib.NewFederationClient(serverName, keyID, privateKey)
+	// The transport enforces the timeouts, since they depend on the class
+	// of the request.
+	fc.Client = *gomatrixserverlib.NewClientWithTimeout(0, transport)
+	return fc
+}
+
+// Transport is a http.RoundTripper for matrix:// federation URLs.
+type Transport struct {
+	next       http.RoundTripper
+	breaker    BackoffChecker
+	timeouts   map[RequestClass]time.Duration
+	maxRetries int
+	maxPerDest int
+	slotsMutex sync.Mutex // protects slots
+	slots      map[gomatrixserverlib.ServerName]chan struct{}
+}
+
+// NewTransport creates a new Transport from the federation_client config.
+// Requests are sent using next, or by resolving the destination server name
+// as described in the specification if next is nil. If breaker is not nil
+// then it is consulted before making any request other than a send request,
+// since the federation sender handles the backoff for those itself, or a
+// key, join or leave request.
+func NewTransport(
+	cfg *config.Dendrite, next http.RoundTripper, breaker BackoffChecker,
+) *Transport {
+	if next == nil {
+		next = newResolvingTripper()
+	}
+	timeouts := cfg.FederationClient.Timeouts
+	return &Transport{
+		next:    next,
+		breaker: breaker,
+		timeouts: map[RequestClass]time.Duration{
+			RequestClassSend:     timeouts.Send,
+			RequestClassState:    timeouts.State,
+			RequestClassBackfill: timeouts.Backfill,
+			RequestClassQuery:    timeouts.Query,
+		},
+		maxRetries: cfg.FederationClient.MaxGETRetries,
+		maxPerDest: cfg.FederationClient.MaxConcurrentRequestsPerDestination,
+		slots:      make(map[gomatrixserverlib.ServerName]chan struct{}),
+	}
+}
+
+// RoundTrip implements http.RoundTripper. The timeout for the request
+// keeps running until the response body is closed.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	destination := gomatrixserverlib.ServerName(req.URL.Host)
+	class := classify(req.URL.Path)
+	endpoint := endpointName(req.URL.Path)
+
+	if class != RequestClassSend && !breakerExemptEndpoints[endpoint] &&
+		t.breaker != nil && t.breaker.IsBackingOff(req.Context(), destination) {
+		requestCounter.WithLabelValues(string(destination), endpoint, "circuit_open").Inc()
+		return nil, ErrCircuitOpen
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := t.timeouts[class]; timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+
+	attempts := 1
+	if req.Method == http.MethodGet {
+		attempts += t.maxRetries
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryDelay(attempt)):
+			case <-ctx.Done():
+				cancel()
+				return nil, ctx.Err()
+			}
+		}
+		resp, err := t.roundTripOnce(ctx, req, destination, endpoint)
+		if attempt+1 < attempts && ctx.Err() == nil && shouldRetry(resp, err) {
+			if resp != nil {
+				resp.Body.Close() // nolint: errcheck
+			}
+			util.GetLogger(ctx).WithField("destination", destination).Infof(
+				"Retrying federation request (attempt %d of %d)", attempt+2, attempts,
+			)
+			continue
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &closeNotifier{ReadCloser: resp.Body, onClose: cancel}
+		return resp, nil
+	}
+}
+
+// roundTripOnce makes a single attempt at the request once there is a free
+// slot for the destination. The slot is held until the body is closed.
+func (t *Transport) roundTripOnce(
+	ctx context.Context, req *http.Request,
+	destination gomatrixserverlib.ServerName, endpoint string,
+) (*http.Response, error) {
+	release := func() {}
+	if slots := t.slotsFor(destination); slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			requestCounter.WithLabelValues(string(destination), endpoint, "timeout").Inc()
+			return nil, ctx.Err()
+		}
+		release = func() { <-slots }
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req.Clone(ctx))
+	requestDuration.WithLabelValues(string(destination), endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		release()
+		code := "error"
+		if ctx.Err() != nil {
+			code = "timeout"
+		}
+		requestCounter.WithLabelValues(string(destination), endpoint, code).Inc()
+		return nil, err
+	}
+	requestCounter.WithLabelValues(string(destination), endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	resp.Body = &closeNotifier{ReadCloser: resp.Body, onClose: release}
+	return resp, nil
+}
+
+// slotsFor returns the semaphore limiting the requests in flight to the
+// destination, creating it if needed, or nil if there is no limit.
+func (t *Transport) slotsFor(destination gomatrixserverlib.ServerName) chan struct{} {
+	if t.maxPerDest <= 0 {
+		return nil
+	}
+	t.slotsMutex.Lock()
+	defer t.slotsMutex.Unlock()
+	slots, ok := t.slots[destination]
+	if !ok {
+		slots = make(chan struct{}, t.maxPerDest)
+		t.slots[destination] = slots
+	}
+	return slots
+}
+
+// shouldRetry returns whether a failed attempt is worth retrying. Requests
+// that the remote server rejected outright are not, since they would be
+// rejected again.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// retryDelay returns how long to wait before the given attempt, which is
+// a random duration between half and all of the exponential backoff.
+func retryDelay(attempt int) time.Duration {
+	backoff := retryBaseDelay << uint(attempt-1)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// closeNotifier calls onClose once when the body is first closed.
+type closeNotifier struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (c *closeNotifier) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+// resolvingTripper sends requests for matrix:// URLs to the addresses that
+// the server name resolves to. It is equivalent to the round tripper that
+// gomatrixserverlib uses by default, which isn't exported.
+type resolvingTripper struct {
+	// transports maps a TLS server name to the transport for it, since the
+	// TLS server name can't be set on a per-connection basis.
+	transports      map[string]http.RoundTripper
+	transportsMutex sync.Mutex
+}
+
+func newResolvingTripper() *resolvingTripper {
+	return &resolvingTripper{
+		transports: make(map[string]http.RoundTripper),
+	}
+}
+
+func (r *resolvingTripper) getTransport(tlsServerName string) http.RoundTripper {
+	r.transportsMutex.Lock()
+	defer r.transportsMutex.Unlock()
+	transport, ok := r.transports[tlsServerName]
+	if !ok {
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName: tlsServerName,
+				// TODO: Remove this when we enforce MSC1711.
+				InsecureSkipVerify: true, // nolint: gosec
+			},
+		}
+		r.transports[tlsServerName] = transport
+	}
+	return transport
+}
+
+func (r *resolvingTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverName := gomatrixserverlib.ServerName(req.URL.Host)
+	results, err := gomatrixserverlib.ResolveServer(serverName)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no address found for matrix host %v", serverName)
+	}
+
+	// TODO: respect the priority and weight fields from the SRV record
+	for _, result := range results {
+		resolved := req.Clone(req.Context())
+		resolved.URL.Scheme = "https"
+		resolved.URL.Host = result.Destination
+		resolved.Host = string(result.Host)
+		var resp *http.Response
+		resp, err = r.getTransport(result.TLSServerName).RoundTrip(resolved)
+		if err == nil {
+			return resp, nil
+		}
+		util.GetLogger(req.Context()).Warnf(
+			"Error sending request to %s: %v", resolved.URL.String(), err,
+		)
+	}
+
+	// just return the most recent error
+	return nil, err
+}
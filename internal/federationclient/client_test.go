@@ -0,0 +1,400 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"go.uber.org/atomic"
+	"golang.org/x/crypto/ed25519"
+)
+
+// roundTripFunc lets a function stand in for the resolving round tripper.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type backoffFunc func(serverName gomatrixserverlib.ServerName) bool
+
+func (f backoffFunc) IsBackingOff(_ context.Context, serverName gomatrixserverlib.ServerName) bool {
+	return f(serverName)
+}
+
+func respond(req *http.Request, code int) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}
+}
+
+func testConfig() *config.Dendrite {
+	cfg := &config.Dendrite{}
+	cfg.SetDefaults()
+	return cfg
+}
+
+func mustDo(t *testing.T, client *http.Client, method, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %s", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err)
+	}
+	return resp
+}
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		endpoint string
+		class    RequestClass
+	}{
+		{"/_matrix/federation/v1/send/1234", "send", RequestClassSend},
+		{"/_matrix/federation/v2/send_join/!a:b/$c", "send_join", RequestClassSend},
+		{"/_matrix/federation/v2/invite/!a:b/$c", "invite", RequestClassSend},
+		{"/_matrix/federation/v1/state_ids/!a:b", "state_ids", RequestClassState},
+		{"/_matrix/federation/v1/get_missing_events/!a:b", "get_missing_events", RequestClassState},
+		{"/_matrix/federation/v1/backfill/!a:b", "backfill", RequestClassBackfill},
+		{"/_matrix/federation/v1/make_join/!a:b/@c:d", "make_join", RequestClassQuery},
+		{"/_matrix/federation/v1/query/directory", "query/directory", RequestClassQuery},
+		{"/_matrix/key/v2/server/abc", "key/server", RequestClassQuery},
+		{"/something/else", "unknown", RequestClassQuery},
+	} {
+		if endpoint := endpointName(tc.path); endpoint != tc.endpoint {
+			t.Errorf("%s: expected endpoint %q, got %q", tc.path, tc.endpoint, endpoint)
+		}
+		if class := classify(tc.path); class != tc.class {
+			t.Errorf("%s: expected class %q, got %q", tc.path, tc.class, class)
+		}
+	}
+}
+
+func TestConcurrencyIsLimitedPerDestination(t *testing.T) {
+	cfg := testConfig()
+	cfg.FederationClient.MaxConcurrentRequestsPerDestination = 2
+
+	var mutex sync.Mutex
+	inFlight := map[string]int{}
+	maxInFlight := map[string]int{}
+	unblock := make(chan struct{})
+	transport := NewTransport(cfg, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		inFlight[req.URL.Host]++
+		if inFlight[req.URL.Host] > maxInFlight[req.URL.Host] {
+			maxInFlight[req.URL.Host] = inFlight[req.URL.Host]
+		}
+		mutex.Unlock()
+		<-unblock
+		mutex.Lock()
+		inFlight[req.URL.Host]--
+		mutex.Unlock()
+		return respond(req, http.StatusOK), nil
+	}), nil)
+	client := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := mustDo(t, client, "GET", "matrix://a.example.com/_matrix/federation/v1/version")
+			resp.Body.Close() // nolint: errcheck
+		}()
+	}
+
+	// A different destination isn't held up by the busy one.
+	done := make(chan struct{})
+	go func() {
+		resp := mustDo(t, client, "GET", "matrix://b.example.com/_matrix/federation/v1/version")
+		resp.Body.Close() // nolint: errcheck
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	<-done
+	wg.Wait()
+
+	if maxInFlight["a.example.com"] != 2 {
+		t.Errorf("expected at most 2 requests in flight to a.example.com, got %d", maxInFlight["a.example.com"])
+	}
+	if maxInFlight["b.example.com"] != 1 {
+		t.Errorf("expected 1 request in flight to b.example.com, got %d", maxInFlight["b.example.com"])
+	}
+}
+
+func TestOnlyGETRequestsAreRetried(t *testing.T) {
+	cfg := testConfig()
+	cfg.FederationClient.MaxGETRetries = 2
+
+	attempts := 0
+	transport := NewTransport(cfg, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return respond(req, http.StatusBadGateway), nil
+		}
+		return respond(req, http.StatusOK), nil
+	}), nil)
+	client := &http.Client{Transport: transport}
+
+	resp := mustDo(t, client, "GET", "matrix://a.example.com/_matrix/federation/v1/state_ids/!a:b")
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK || attempts != 2 {
+		t.Errorf("expected GET to succeed on attempt 2, got %d on attempt %d", resp.StatusCode, attempts)
+	}
+
+	attempts = 0
+	resp = mustDo(t, client, "PUT", "matrix://a.example.com/_matrix/federation/v1/send/1")
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusBadGateway || attempts != 1 {
+		t.Errorf("expected PUT to fail after 1 attempt, got %d after %d", resp.StatusCode, attempts)
+	}
+}
+
+func TestRequestClassTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.FederationClient.Timeouts.Query = 50 * time.Millisecond
+
+	transport := NewTransport(cfg, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}), nil)
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequest("POST", "matrix://a.example.com/_matrix/federation/v1/user/keys/query", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %s", err)
+	}
+	if _, err = client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request to time out, got %v", err)
+	}
+}
+
+func TestCircuitBreakerSkipsSendRequests(t *testing.T) {
+	attempts := 0
+	transport := NewTransport(testConfig(), roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return respond(req, http.StatusOK), nil
+	}), backoffFunc(func(serverName gomatrixserverlib.ServerName) bool {
+		return serverName == "down.example.com"
+	}))
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequest("GET", "matrix://down.example.com/_matrix/federation/v1/backfill/!a:b", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %s", err)
+	}
+	if _, err = client.Do(req); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if attempts != 0 {
+		t.Errorf("expected no attempts while backing off, got %d", attempts)
+	}
+
+	// The federation sender decides for itself when to send transactions.
+	resp := mustDo(t, client, "PUT", "matrix://down.example.com/_matrix/federation/v1/send/1")
+	resp.Body.Close() // nolint: errcheck
+	if attempts != 1 {
+		t.Errorf("expected the transaction to be attempted, got %d attempts", attempts)
+	}
+
+	// Key requests and the join and leave handshakes are always attempted.
+	for _, path := range []string{
+		"/_matrix/key/v2/server",
+		"/_matrix/key/v2/query",
+		"/_matrix/federation/v1/make_join/!a:b/@c:d",
+		"/_matrix/federation/v1/make_leave/!a:b/@c:d",
+	} {
+		before := attempts
+		resp = mustDo(t, client, "GET", "matrix://down.example.com"+path)
+		resp.Body.Close() // nolint: errcheck
+		if attempts != before+1 {
+			t.Errorf("%s: expected the request to be attempted while backing off", path)
+		}
+	}
+}
+
+// memoryKeyDatabase is a gomatrixserverlib.KeyDatabase that doesn't start
+// with any keys.
+type memoryKeyDatabase struct {
+	mutex sync.Mutex
+	keys  map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+}
+
+func (d *memoryKeyDatabase) FetcherName() string {
+	return "memoryKeyDatabase"
+}
+
+func (d *memoryKeyDatabase) FetchKeys(
+	_ context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if key, ok := d.keys[req]; ok {
+			results[req] = key
+		}
+	}
+	return results, nil
+}
+
+func (d *memoryKeyDatabase) StoreKeys(
+	_ context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for req, key := range results {
+		d.keys[req] = key
+	}
+	return nil
+}
+
+// aliveFederationSender is a federation sender that lifts the blacklist
+// when it is told that a server is alive.
+type aliveFederationSender struct {
+	fsAPI.FederationSenderInternalAPI
+	blacklisted *atomic.Bool
+	alive       chan gomatrixserverlib.ServerName
+}
+
+func (f *aliveFederationSender) PerformServersAlive(
+	_ context.Context, req *fsAPI.PerformServersAliveRequest, _ *fsAPI.PerformServersAliveResponse,
+) error {
+	f.blacklisted.Store(false)
+	for _, serverName := range req.Servers {
+		f.alive <- serverName
+	}
+	return nil
+}
+
+func TestBlacklistedServerRecoversThroughInboundRequest(t *testing.T) {
+	const remote = gomatrixserverlib.ServerName("down.example.com")
+	const remoteKeyID = gomatrixserverlib.KeyID("ed25519:auto")
+	remotePublic, remotePrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %s", err)
+	}
+	_, localPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %s", err)
+	}
+	keys := gomatrixserverlib.ServerKeyFields{
+		ServerName:   remote,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		VerifyKeys: map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+			remoteKeyID: {Key: gomatrixserverlib.Base64Bytes(remotePublic)},
+		},
+	}
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	if keysJSON, err = gomatrixserverlib.SignJSON(string(remote), remoteKeyID, remotePrivate, keysJSON); err != nil {
+		t.Fatalf("gomatrixserverlib.SignJSON: %s", err)
+	}
+
+	// The remote server is blacklisted and its keys aren't cached.
+	blacklisted := atomic.NewBool(true)
+	backfills := atomic.NewInt32(0)
+	cfg := testConfig()
+	cfg.Matrix.ServerName = "localhost"
+	transport := NewTransport(cfg, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasPrefix(req.URL.Path, "/_matrix/key/v2/server") {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader(string(keysJSON))),
+				Request:    req,
+			}, nil
+		}
+		backfills.Inc()
+		return respond(req, http.StatusOK), nil
+	}), backoffFunc(func(serverName gomatrixserverlib.ServerName) bool {
+		return serverName == remote && blacklisted.Load()
+	}))
+	client := New(cfg.Matrix.ServerName, "ed25519:test", localPrivate, transport)
+	keyRing := gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{
+			&gomatrixserverlib.DirectKeyFetcher{Client: client.Client},
+		},
+		KeyDatabase: &memoryKeyDatabase{
+			keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{},
+		},
+	}
+	fsender := &aliveFederationSender{
+		blacklisted: blacklisted,
+		alive:       make(chan gomatrixserverlib.ServerName, 1),
+	}
+	handled := atomic.NewBool(false)
+	handler := internal.MakeFedAPI(
+		"test", cfg, keyRing, &internal.FederationWakeups{FsAPI: fsender},
+		func(*http.Request, *gomatrixserverlib.FederationRequest, map[string]string) util.JSONResponse {
+			handled.Store(true)
+			return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+		},
+	)
+
+	// An inbound request from the remote server can still be verified,
+	// since fetching its keys isn't refused by the breaker.
+	fedReq := gomatrixserverlib.NewFederationRequest("GET", cfg.Matrix.ServerName, "/_matrix/federation/v1/version")
+	if err = fedReq.Sign(remote, remoteKeyID, remotePrivate); err != nil {
+		t.Fatalf("fedReq.Sign: %s", err)
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		t.Fatalf("fedReq.HTTPRequest: %s", err)
+	}
+	req.Body = http.NoBody
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !handled.Load() {
+		t.Fatalf("expected the inbound request to be handled, got HTTP %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Hearing from the remote server wakes it up, which lifts the blacklist,
+	// so requests to it are attempted again.
+	select {
+	case serverName := <-fsender.alive:
+		if serverName != remote {
+			t.Fatalf("expected %q to be woken up, got %q", remote, serverName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %q to be woken up", remote)
+	}
+	resp := mustDo(t, &http.Client{Transport: transport}, "GET", "matrix://down.example.com/_matrix/federation/v1/backfill/!a:b")
+	resp.Body.Close() // nolint: errcheck
+	if backfills.Load() != 1 {
+		t.Errorf("expected the backfill to be attempted after recovering, got %d attempts", backfills.Load())
+	}
+}
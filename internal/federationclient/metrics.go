@@ -0,0 +1,52 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var requestCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationclient",
+		Name:      "requests_total",
+		Help:      "Total number of outbound federation requests",
+	},
+	// Takes three labels:
+	//   destination:
+	//      The server name that the request was sent to.
+	//   endpoint:
+	//      The federation API endpoint, as returned by endpointName.
+	//   code:
+	//      The HTTP status code of the response, or one of:
+	//    error -> The request failed before a response was received.
+	//    timeout -> The request timed out before a response was received.
+	//    circuit_open -> The request wasn't sent because the destination is backing off.
+	[]string{"destination", "endpoint", "code"},
+)
+
+var requestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationclient",
+		Name:      "request_duration_seconds",
+		Help:      "How long outbound federation requests take to receive response headers",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	},
+	[]string{"destination", "endpoint"},
+)
+
+func init() {
+	prometheus.MustRegister(requestCounter, requestDuration)
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
@@ -169,16 +170,18 @@ func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 }
 
 // MakeFedAPI makes an http.Handler that checks matrix federation authentication.
+// The request is verified as being addressed to whichever of our server names
+// it was sent to, so that virtual hosts are supported.
 func MakeFedAPI(
 	metricsName string,
-	serverName gomatrixserverlib.ServerName,
+	cfg *config.Dendrite,
 	keyRing gomatrixserverlib.KeyRing,
 	wakeup *FederationWakeups,
 	f func(*http.Request, *gomatrixserverlib.FederationRequest, map[string]string) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
 		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
-			req, time.Now(), serverName, keyRing,
+			req, time.Now(), LocalServerNameForRequest(cfg, req), keyRing,
 		)
 		if fedReq == nil {
 			return errResp
@@ -194,6 +197,41 @@ func MakeFedAPI(
 	return MakeExternalAPI(metricsName, h)
 }
 
+// LocalServerNameForRequest works out which of our server names a federation
+// request was sent to. The "destination" parameter of the X-Matrix
+// Authorization header is used if the remote server sent one, otherwise the
+// Host header is used. If neither names one of our virtual hosts then the
+// main server name is returned.
+func LocalServerNameForRequest(cfg *config.Dendrite, req *http.Request) gomatrixserverlib.ServerName {
+	candidates := []string{xMatrixDestination(req.Header.Get("Authorization")), req.Host}
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		candidates = append(candidates, host)
+	}
+	for _, candidate := range candidates {
+		serverName := gomatrixserverlib.ServerName(candidate)
+		if candidate != "" && cfg.IsLocalServerName(serverName) {
+			return serverName
+		}
+	}
+	return cfg.Matrix.ServerName
+}
+
+// xMatrixDestination returns the "destination" parameter of an X-Matrix
+// Authorization header, or an empty string if there isn't one.
+func xMatrixDestination(header string) string {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || parts[0] != "X-Matrix" {
+		return ""
+	}
+	for _, data := range strings.Split(parts[1], ",") {
+		pair := strings.SplitN(data, "=", 2)
+		if len(pair) == 2 && strings.TrimSpace(pair[0]) == "destination" {
+			return strings.Trim(pair[1], "\"")
+		}
+	}
+	return ""
+}
+
 type FederationWakeups struct {
 	FsAPI   federationsenderAPI.FederationSenderInternalAPI
 	origins sync.Map
@@ -4,6 +4,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -93,3 +96,39 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalServerNameForRequest(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.VirtualHosts = []config.VirtualHost{{ServerName: "example.org"}}
+
+	tests := []struct {
+		name   string
+		host   string
+		header string
+		want   gomatrixserverlib.ServerName
+	}{
+		{name: "main host", host: "localhost", want: "localhost"},
+		{name: "virtual host", host: "example.org", want: "example.org"},
+		{name: "virtual host with port", host: "example.org:8448", want: "example.org"},
+		{name: "unknown host", host: "example.com", want: "localhost"},
+		{
+			name:   "x-matrix destination",
+			host:   "localhost",
+			header: `X-Matrix origin=remote.org,key="ed25519:1",sig="abc",destination="example.org"`,
+			want:   "example.org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if got := LocalServerNameForRequest(cfg, req); got != tt.want {
+				t.Errorf("LocalServerNameForRequest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
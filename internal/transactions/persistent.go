@@ -0,0 +1,101 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transactions
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// DefaultRetention is how long a PersistentCache keeps entries in storage
+// by default. It is long enough to cover a remote server retrying a
+// transaction after backing off from us for a while.
+const DefaultRetention time.Duration = 24 * time.Hour
+
+// Storage stores transaction responses for a PersistentCache.
+type Storage interface {
+	// InsertTransaction stores the response for the (scope, txnID) tuple,
+	// unless there is already one stored for it.
+	InsertTransaction(ctx context.Context, scope, txnID string, res *util.JSONResponse, addedAt time.Time) error
+	// SelectTransaction returns the response stored for the (scope, txnID)
+	// tuple, or nil if there isn't one.
+	SelectTransaction(ctx context.Context, scope, txnID string) (*util.JSONResponse, error)
+	// DeleteTransactionsBefore deletes the responses added before the time.
+	DeleteTransactionsBefore(ctx context.Context, before time.Time) error
+}
+
+// PersistentCache is a Cache which also keeps its entries in storage, so
+// that they survive restarts and can be shared by several instances. The
+// scope takes the place of the access token, e.g. the origin server for
+// federation transactions.
+// Entries are evicted from storage once they are older than the retention.
+type PersistentCache struct {
+	cache     *Cache
+	storage   Storage
+	retention time.Duration
+}
+
+// NewPersistentCache creates a new PersistentCache which keeps entries in
+// the storage for the retention period, and starts cleaning up old entries.
+func NewPersistentCache(storage Storage, retention time.Duration) *PersistentCache {
+	c := PersistentCache{
+		cache:     New(),
+		storage:   storage,
+		retention: retention,
+	}
+	go persistentCacheCleanService(&c)
+	return &c
+}
+
+// FetchTransaction looks up an entry for the (scope, txnID) tuple, first in
+// memory and then in storage.
+// Returns (JSON response, true) if txnID is found, else the returned bool is false.
+func (c *PersistentCache) FetchTransaction(
+	ctx context.Context, scope, txnID string,
+) (*util.JSONResponse, bool, error) {
+	if res, ok := c.cache.FetchTransaction(scope, txnID); ok {
+		return res, true, nil
+	}
+	res, err := c.storage.SelectTransaction(ctx, scope, txnID)
+	if err != nil || res == nil {
+		return nil, false, err
+	}
+	c.cache.AddTransaction(scope, txnID, res)
+	return res, true, nil
+}
+
+// AddTransaction adds an entry for the (scope, txnID) tuple to memory and
+// to storage.
+func (c *PersistentCache) AddTransaction(
+	ctx context.Context, scope, txnID string, res *util.JSONResponse,
+) error {
+	if err := c.storage.InsertTransaction(ctx, scope, txnID, res, time.Now()); err != nil {
+		return err
+	}
+	c.cache.AddTransaction(scope, txnID, res)
+	return nil
+}
+
+// persistentCacheCleanService is responsible for deleting entries from storage
+// once they are older than the retention.
+func persistentCacheCleanService(c *PersistentCache) {
+	ticker := time.NewTicker(c.cache.cleanupPeriod).C
+	for range ticker {
+		before := time.Now().Add(-c.retention)
+		if err := c.storage.DeleteTransactionsBefore(context.Background(), before); err != nil {
+			util.GetLogger(context.Background()).WithError(err).Error("Failed to delete old transactions")
+		}
+	}
+}
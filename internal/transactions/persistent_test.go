@@ -0,0 +1,82 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transactions
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// fakeStorage is an in-memory Storage.
+type fakeStorage struct {
+	sync.Mutex
+	responses map[CacheKey]*util.JSONResponse
+	selects   int
+}
+
+func (s *fakeStorage) InsertTransaction(
+	ctx context.Context, scope, txnID string, res *util.JSONResponse, addedAt time.Time,
+) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.responses[CacheKey{scope, txnID}]; !ok {
+		s.responses[CacheKey{scope, txnID}] = res
+	}
+	return nil
+}
+
+func (s *fakeStorage) SelectTransaction(ctx context.Context, scope, txnID string) (*util.JSONResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.selects++
+	return s.responses[CacheKey{scope, txnID}], nil
+}
+
+func (s *fakeStorage) DeleteTransactionsBefore(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+// TestPersistentCacheSurvivesRestart checks that entries are still found by
+// a new PersistentCache using the same storage.
+func TestPersistentCacheSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	storage := &fakeStorage{responses: make(map[CacheKey]*util.JSONResponse)}
+	if err := NewPersistentCache(storage, DefaultRetention).AddTransaction(ctx, fakeAccessToken, fakeTxnID, fakeResponse); err != nil {
+		t.Fatalf("AddTransaction: %s", err)
+	}
+
+	cache := NewPersistentCache(storage, DefaultRetention)
+	for i := 0; i < 2; i++ {
+		res, ok, err := cache.FetchTransaction(ctx, fakeAccessToken, fakeTxnID)
+		if err != nil {
+			t.Fatalf("FetchTransaction: %s", err)
+		}
+		if !ok {
+			t.Fatalf("failed to retrieve entry for (%s, %s)", fakeAccessToken, fakeTxnID)
+		} else if res.JSON != fakeResponse.JSON {
+			t.Errorf("Fetched response incorrect. Expected: %v got: %v", fakeResponse.JSON, res.JSON)
+		}
+	}
+	// The second fetch should have been answered from memory.
+	if storage.selects != 1 {
+		t.Errorf("expected storage to be queried once, got %d", storage.selects)
+	}
+
+	if _, ok, _ := cache.FetchTransaction(ctx, fakeAccessToken2, fakeTxnID); ok {
+		t.Errorf("entry for (%s, %s) leaked into another scope", fakeAccessToken, fakeTxnID)
+	}
+}
@@ -71,6 +71,13 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return nil
 	}
 
+	if output.Type == api.OutputTypeRoomShutdown {
+		// Rooms which have been shut down shouldn't be advertised any more.
+		roomID := output.RoomShutdown.RoomID
+		log.WithField("room_id", roomID).Info("removing shut down room from the room directory")
+		return s.db.SetRoomVisibility(context.TODO(), false, roomID)
+	}
+
 	if output.Type != api.OutputTypeNewRoomEvent {
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -30,6 +30,21 @@ type RoomserverInternalAPI interface {
 		res *PerformLeaveResponse,
 	) error
 
+	// Delete the history of a room before a point in the room's event graph.
+	PerformPurgeHistory(
+		ctx context.Context,
+		req *PerformPurgeHistoryRequest,
+		res *PerformPurgeHistoryResponse,
+	) error
+
+	// Make the local users leave a room, remove its local aliases and
+	// optionally block the room and delete it from the database.
+	PerformRoomShutdown(
+		ctx context.Context,
+		req *PerformRoomShutdownRequest,
+		res *PerformRoomShutdownResponse,
+	) error
+
 	// Query the latest events and state for a room from the room server.
 	QueryLatestEventsAndState(
 		ctx context.Context,
@@ -116,6 +131,20 @@ type RoomserverInternalAPI interface {
 		response *QueryRoomVersionForRoomResponse,
 	) error
 
+	// Asks whether a room has been blocked by an admin.
+	QueryRoomBlocked(
+		ctx context.Context,
+		request *QueryRoomBlockedRequest,
+		response *QueryRoomBlockedResponse,
+	) error
+
+	// Asks which servers are denied by the server ACL of a room.
+	QueryServerBannedFromRoom(
+		ctx context.Context,
+		request *QueryServerBannedFromRoomRequest,
+		response *QueryServerBannedFromRoomResponse,
+	) error
+
 	// Set a room alias
 	SetRoomAlias(
 		ctx context.Context,
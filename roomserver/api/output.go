@@ -28,6 +28,10 @@ const (
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypePurgeHistory indicates that the event is an OutputPurgeHistory
+	OutputTypePurgeHistory OutputType = "purge_history"
+	// OutputTypeRoomShutdown indicates that the event is an OutputRoomShutdown
+	OutputTypeRoomShutdown OutputType = "room_shutdown"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -41,6 +45,10 @@ type OutputEvent struct {
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
+	// The content of event with type OutputTypePurgeHistory
+	PurgeHistory *OutputPurgeHistory `json:"purge_history,omitempty"`
+	// The content of event with type OutputTypeRoomShutdown
+	RoomShutdown *OutputRoomShutdown `json:"room_shutdown,omitempty"`
 }
 
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
@@ -138,3 +146,24 @@ type OutputRetireInviteEvent struct {
 	// "leave" or "ban".
 	Membership string
 }
+
+// An OutputPurgeHistory is written when the roomserver has purged events from
+// the history of a room. Consumers should delete their own copies of the
+// events. The events of a single purge may be split over several of these.
+type OutputPurgeHistory struct {
+	// The ID of the room whose history was purged.
+	RoomID string `json:"room_id"`
+	// The IDs of the events which were purged.
+	EventIDs []string `json:"event_ids"`
+	// A purge can be split across several messages. Final is set on the last
+	// one, so that consumers can do any per-purge work once.
+	Final bool `json:"final"`
+}
+
+// An OutputRoomShutdown is written when an admin shuts down a room. The local
+// users will already have left the room, so consumers should stop advertising
+// it, e.g. in the public room directory.
+type OutputRoomShutdown struct {
+	// The ID of the room which was shut down.
+	RoomID string `json:"room_id"`
+}
@@ -22,3 +22,40 @@ type PerformLeaveRequest struct {
 
 type PerformLeaveResponse struct {
 }
+
+type PerformPurgeHistoryRequest struct {
+	RoomID string `json:"room_id"`
+	// The non-state events in the room which are topologically before this
+	// event are purged. The event itself is kept.
+	BeforeEventID string `json:"before_event_id"`
+}
+
+type PerformPurgeHistoryResponse struct {
+	// The number of events which were purged.
+	PurgedEvents int `json:"purged_events"`
+}
+
+type PerformRoomShutdownRequest struct {
+	RoomID string `json:"room_id"`
+	// The local user performing the shutdown. Local aliases are removed on
+	// behalf of this user, and the replacement room is created by them.
+	UserID string `json:"user_id"`
+	// If set then a replacement room with this name is created and the local
+	// members of the shut down room are moved into it.
+	NewRoomName string `json:"new_room_name"`
+	// The message to send into the replacement room, if one is created.
+	Message string `json:"message"`
+	// Stop local users and remote servers from joining the room again.
+	Block bool `json:"block"`
+	// Delete everything that we know about the room from the database.
+	Purge bool `json:"purge"`
+}
+
+type PerformRoomShutdownResponse struct {
+	// The local users who were made to leave the room.
+	KickedUsers []string `json:"kicked_users"`
+	// The local aliases which were removed from the room.
+	LocalAliases []string `json:"local_aliases"`
+	// The room ID of the replacement room, if one was created.
+	NewRoomID string `json:"new_room_id,omitempty"`
+}
@@ -100,6 +100,13 @@ type QueryEventsByIDResponse struct {
 	// the entire request.
 	// This list will be in an arbitrary order.
 	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
+	// The IDs of the events in Events which were rejected because they
+	// failed the auth checks against their auth events.
+	RejectedEventIDs []string `json:"rejected_event_ids,omitempty"`
+	// The IDs of the events in Events which were soft-failed because they
+	// failed the auth checks against the current state of the room when
+	// they were received.
+	SoftFailedEventIDs []string `json:"soft_failed_event_ids,omitempty"`
 }
 
 // QueryMembershipForUserRequest is a request to QueryMembership
@@ -267,3 +274,28 @@ type QueryRoomVersionForRoomRequest struct {
 type QueryRoomVersionForRoomResponse struct {
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 }
+
+// QueryRoomBlockedRequest asks whether a room has been blocked.
+type QueryRoomBlockedRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryRoomBlockedResponse is a response to QueryRoomBlockedRequest
+type QueryRoomBlockedResponse struct {
+	// True if local users may not join the room and remote servers may not
+	// join it through us.
+	Blocked bool `json:"blocked"`
+}
+
+// QueryServerBannedFromRoomRequest asks which of the servers are banned from
+// the room by the server ACL in the current state of the room.
+type QueryServerBannedFromRoomRequest struct {
+	RoomID      string                         `json:"room_id"`
+	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+// QueryServerBannedFromRoomResponse is a response to QueryServerBannedFromRoomRequest
+type QueryServerBannedFromRoomResponse struct {
+	// The servers from the request which are not allowed to take part in the room.
+	BannedServers []gomatrixserverlib.ServerName `json:"banned_servers"`
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -167,8 +168,16 @@ func (r *RoomserverInternalAPI) RemoveRoomAlias(
 
 	// Send an updated m.room.aliases event
 	// At this point we've already committed the alias to the database so we
-	// shouldn't cancel this request.
+	// shouldn't cancel this request. Only users on the alias's server name can
+	// update its m.room.aliases event.
 	// TODO: Ensure that we send unsent events when if server restarts.
+	_, aliasDomain, err := gomatrixserverlib.SplitID('#', request.Alias)
+	if err != nil {
+		return err
+	}
+	if _, userDomain, uerr := gomatrixserverlib.SplitID('@', request.UserID); uerr != nil || userDomain != aliasDomain {
+		return nil
+	}
 	return r.sendUpdatedAliasesEvent(context.TODO(), request.UserID, roomID)
 }
 
@@ -177,11 +186,20 @@ type roomAliasesContent struct {
 }
 
 // Build the updated m.room.aliases event to send to the room after addition or
-// removal of an alias
+// removal of an alias. Each local server name has its own m.room.aliases event
+// listing its aliases, which only its users can send.
 func (r *RoomserverInternalAPI) sendUpdatedAliasesEvent(
 	ctx context.Context, userID string, roomID string,
 ) error {
-	serverName := string(r.Cfg.Matrix.ServerName)
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	serverName := string(domain)
+	keyID, privateKey, ok := r.Cfg.SigningIdentityFor(domain)
+	if !ok {
+		return fmt.Errorf("user %q does not belong to this homeserver", userID)
+	}
 
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -192,10 +210,16 @@ func (r *RoomserverInternalAPI) sendUpdatedAliasesEvent(
 
 	// Retrieve the updated list of aliases, marhal it and set it as the
 	// event's content
-	aliases, err := r.DB.GetAliasesForRoomID(ctx, roomID)
+	allAliases, err := r.DB.GetAliasesForRoomID(ctx, roomID)
 	if err != nil {
 		return err
 	}
+	aliases := []string{}
+	for _, alias := range allAliases {
+		if _, aliasDomain, aerr := gomatrixserverlib.SplitID('#', alias); aerr == nil && aliasDomain == domain {
+			aliases = append(aliases, alias)
+		}
+	}
 	content := roomAliasesContent{Aliases: aliases}
 	rawContent, err := json.Marshal(content)
 	if err != nil {
@@ -247,8 +271,7 @@ func (r *RoomserverInternalAPI) sendUpdatedAliasesEvent(
 	// Build the event
 	now := time.Now()
 	event, err := builder.Build(
-		now, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
-		r.Cfg.Matrix.PrivateKey, roomVersion,
+		now, domain, keyID, privateKey, roomVersion,
 	)
 	if err != nil {
 		return err
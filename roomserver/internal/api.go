@@ -16,11 +16,13 @@ type RoomserverInternalAPI struct {
 	DB                   storage.Database
 	Cfg                  *config.Dendrite
 	Producer             sarama.SyncProducer
-	Cache                caching.RoomVersionCache
+	Cache                caching.RoomServerCaches
 	ServerName           gomatrixserverlib.ServerName
 	KeyRing              gomatrixserverlib.JSONVerifier
 	FedClient            *gomatrixserverlib.FederationClient
 	OutputRoomEventTopic string     // Kafka topic for new output room events
 	mutex                sync.Mutex // Protects calls to processRoomEvent
 	fsAPI                fsAPI.FederationSenderInternalAPI
+	backfillStats        backfillServerStats // Protected by its own mutex
+	dummyEventRooms      sync.Map            // Rooms that dummy events are being sent to
 }
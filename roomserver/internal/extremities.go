@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// MDummyEvent is the type of the events that are sent to merge the forward
+// extremities of a room. They don't do anything else.
+const MDummyEvent = "org.matrix.dummy_event"
+
+var forwardExtremities = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "forward_extremities",
+		Help:      "The number of forward extremities in a room after a new event is processed",
+		Buckets:   []float64{1, 2, 3, 5, 7, 10, 15, 20, 50, 100, 200, 500},
+	},
+)
+
+func init() {
+	prometheus.MustRegister(forwardExtremities)
+}
+
+// pruneStaleExtremities removes the stale forward extremities from the latest
+// events. A forward extremity is stale if it was sent more than staleAge before
+// the newest forward extremity and it is more than staleDepth events behind
+// the deepest one. This happens when a server goes away part way through a
+// fork of the room, and without pruning the extremity would stay around for
+// ever, making every new event in the room resolve state across the fork.
+// The event being processed is never pruned.
+func (u *latestEventsUpdater) pruneStaleExtremities() error {
+	cfg := u.api.Cfg.ForwardExtremities
+	if cfg.StaleAge <= 0 || cfg.StaleDepth <= 0 || len(u.latest) < 2 {
+		return nil
+	}
+	eventNIDs := make([]types.EventNID, len(u.latest))
+	for i := range u.latest {
+		eventNIDs[i] = u.latest[i].EventNID
+	}
+	events, err := u.api.DB.Events(u.ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("u.api.DB.Events: %w", err)
+	}
+	eventMap := make(map[types.EventNID]gomatrixserverlib.Event, len(events))
+	for _, event := range events {
+		eventMap[event.EventNID] = event.Event
+	}
+	pruned := pruneStaleExtremities(u.latest, eventMap, u.stateAtEvent.EventNID, cfg.StaleAge, cfg.StaleDepth)
+	if len(pruned) < len(u.latest) {
+		logrus.WithFields(logrus.Fields{
+			"room_id": u.event.RoomID(),
+			"before":  len(u.latest),
+			"after":   len(pruned),
+		}).Info("Pruned stale forward extremities")
+	}
+	u.latest = pruned
+	return nil
+}
+
+func pruneStaleExtremities(
+	latest []types.StateAtEventAndReference,
+	events map[types.EventNID]gomatrixserverlib.Event,
+	keepEventNID types.EventNID,
+	staleAge time.Duration, staleDepth int64,
+) []types.StateAtEventAndReference {
+	var newestTS gomatrixserverlib.Timestamp
+	var maxDepth int64
+	for _, event := range events {
+		if event.OriginServerTS() > newestTS {
+			newestTS = event.OriginServerTS()
+		}
+		if event.Depth() > maxDepth {
+			maxDepth = event.Depth()
+		}
+	}
+	staleBefore := newestTS.Time().Add(-staleAge)
+	result := make([]types.StateAtEventAndReference, 0, len(latest))
+	for _, l := range latest {
+		event, ok := events[l.EventNID]
+		if ok && l.EventNID != keepEventNID &&
+			event.OriginServerTS().Time().Before(staleBefore) &&
+			event.Depth() < maxDepth-staleDepth {
+			continue
+		}
+		result = append(result, l)
+	}
+	return result
+}
+
+// updateForwardExtremities records the number of forward extremities in the
+// room, as stored in its latest events, and starts sending a dummy event into
+// the room to merge them if there are too many of them.
+func (r *RoomserverInternalAPI) updateForwardExtremities(ctx context.Context, roomNID types.RoomNID, roomID string) {
+	latestEvents, _, _, err := r.DB.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Error("Failed to count forward extremities")
+		return
+	}
+	count := len(latestEvents)
+	forwardExtremities.Observe(float64(count))
+	threshold := r.Cfg.ForwardExtremities.DummyEventThreshold
+	if threshold <= 0 || count <= threshold {
+		return
+	}
+	// The dummy event has to be sent without holding the input lock, which
+	// is held while this is called, so send it in the background. Only send
+	// one at a time for each room, as the extremities would just pile up
+	// again otherwise.
+	if _, sending := r.dummyEventRooms.LoadOrStore(roomID, true); sending {
+		return
+	}
+	go func() {
+		defer r.dummyEventRooms.Delete(roomID)
+		if serr := r.sendDummyEvent(context.Background(), roomID); serr != nil {
+			logrus.WithError(serr).WithField("room_id", roomID).Error("Failed to send dummy event to merge forward extremities")
+		}
+	}()
+}
+
+// sendDummyEvent sends a dummy event into the room from one of the local users
+// who are joined to it and are allowed to send it. The dummy event references
+// the forward extremities of the room as its prev_events, which merges them
+// into one.
+func (r *RoomserverInternalAPI) sendDummyEvent(ctx context.Context, roomID string) error {
+	sender, err := r.dummyEventSender(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if sender == "" {
+		// Only the servers with users in the room can send the dummy event.
+		logrus.WithField("room_id", roomID).Debug("No local users in room who can send dummy event")
+		return nil
+	}
+
+	eb := gomatrixserverlib.EventBuilder{
+		Type:   MDummyEvent,
+		Sender: sender,
+		RoomID: roomID,
+	}
+	if err = eb.SetContent(map[string]interface{}{}); err != nil {
+		return fmt.Errorf("eb.SetContent: %w", err)
+	}
+	buildRes := api.QueryLatestEventsAndStateResponse{}
+	event, err := internal.BuildEvent(ctx, &eb, r.Cfg, time.Now(), r, &buildRes)
+	if err != nil {
+		return fmt.Errorf("internal.BuildEvent: %w", err)
+	}
+
+	inputReq := api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event.Headered(buildRes.RoomVersion),
+				AuthEventIDs: event.AuthEventIDs(),
+				SendAsServer: string(event.Origin()),
+			},
+		},
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	if err = r.InputRoomEvents(ctx, &inputReq, &inputRes); err != nil {
+		return fmt.Errorf("r.InputRoomEvents: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":     roomID,
+		"event_id":    event.EventID(),
+		"prev_events": len(event.PrevEventIDs()),
+	}).Info("Sent dummy event to merge forward extremities")
+	return nil
+}
+
+// dummyEventSender returns a local user who is joined to the room and whose
+// power level allows them to send a dummy event, or "" if there isn't one.
+func (r *RoomserverInternalAPI) dummyEventSender(ctx context.Context, roomID string) (string, error) {
+	roomNID, err := r.DB.RoomNID(ctx, roomID)
+	if err != nil {
+		return "", fmt.Errorf("r.DB.RoomNID: %w", err)
+	}
+	if roomNID == 0 {
+		return "", nil
+	}
+	eventNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomNID, true, true)
+	if err != nil {
+		return "", fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	memberEvents, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return "", fmt.Errorf("r.DB.Events: %w", err)
+	}
+
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+		},
+	}
+	stateRes := api.QueryLatestEventsAndStateResponse{}
+	if err = r.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return "", fmt.Errorf("r.QueryLatestEventsAndState: %w", err)
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range stateRes.StateEvents {
+		if err = authEvents.AddEvent(&stateRes.StateEvents[i].Event); err != nil {
+			return "", fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+	}
+	var creator string
+	if createEvent, _ := authEvents.Create(); createEvent != nil {
+		creator = createEvent.Sender()
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, creator)
+	if err != nil {
+		return "", fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromAuthEvents: %w", err)
+	}
+
+	required := powerLevels.EventLevel(MDummyEvent, false)
+	for _, event := range memberEvents {
+		if event.StateKey() != nil && powerLevels.UserLevel(*event.StateKey()) >= required {
+			return *event.StateKey(), nil
+		}
+	}
+	return "", nil
+}
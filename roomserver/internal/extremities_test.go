@@ -0,0 +1,209 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPruneStaleExtremities(t *testing.T) {
+	now := time.Now()
+	build := func(depth int64, ts time.Time) gomatrixserverlib.Event {
+		t.Helper()
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:     "@alice:localhost",
+			RoomID:     testRoomID,
+			Type:       "m.room.message",
+			Depth:      depth,
+			PrevEvents: []gomatrixserverlib.EventReference{},
+			AuthEvents: []gomatrixserverlib.EventReference{},
+		}
+		if err := builder.SetContent(map[string]interface{}{"body": "hello"}); err != nil {
+			t.Fatalf("SetContent failed: %s", err)
+		}
+		ev, err := builder.Build(ts, "localhost", "ed25519:test", testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("Build failed: %s", err)
+		}
+		return ev
+	}
+
+	events := map[types.EventNID]gomatrixserverlib.Event{
+		// The newest and deepest extremity.
+		1: build(1000, now),
+		// Old, but not far enough behind.
+		2: build(950, now.Add(-48*time.Hour)),
+		// Far behind, but recent.
+		3: build(10, now.Add(-time.Hour)),
+		// Old and far behind, so stale.
+		4: build(10, now.Add(-48*time.Hour)),
+		// Old and far behind, but it's the event being processed.
+		5: build(5, now.Add(-72*time.Hour)),
+	}
+	var latest []types.StateAtEventAndReference
+	for _, eventNID := range []types.EventNID{1, 2, 3, 4, 5} {
+		event := events[eventNID]
+		latest = append(latest, types.StateAtEventAndReference{
+			StateAtEvent:   types.StateAtEvent{StateEntry: types.StateEntry{EventNID: eventNID}},
+			EventReference: event.EventReference(),
+		})
+	}
+
+	pruned := pruneStaleExtremities(latest, events, 5, 24*time.Hour, 100)
+	var got []types.EventNID
+	for _, l := range pruned {
+		got = append(got, l.EventNID)
+	}
+	want := []types.EventNID{1, 2, 3, 5}
+	if len(got) != len(want) {
+		t.Fatalf("wanted extremities %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("wanted extremities %v, got %v", want, got)
+		}
+	}
+}
+
+func TestDummyEventMergesForwardExtremities(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = testPrivateKey
+	cfg.ForwardExtremities.DummyEventThreshold = 2
+	r := &RoomserverInternalAPI{
+		DB:         db,
+		Cfg:        cfg,
+		Producer:   &testProducer{},
+		Cache:      newTestCaches(),
+		ServerName: cfg.Matrix.ServerName,
+	}
+
+	// Alice creates the room and Bob joins it. Alice then hands over the room
+	// to Bob, leaving herself unable to send dummy events.
+	alice, bob := "@alice:localhost", "@bob:localhost"
+	roomID, err := r.createShutdownRoom(ctx, &api.PerformRoomShutdownRequest{UserID: alice})
+	if err != nil {
+		t.Fatalf("createShutdownRoom failed: %s", err)
+	}
+	if err = r.PerformJoin(ctx, &api.PerformJoinRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        bob,
+	}, &api.PerformJoinResponse{}); err != nil {
+		t.Fatalf("PerformJoin failed: %s", err)
+	}
+	powerLevels := internal.InitialPowerLevelsContent(bob)
+	powerLevels.Events[MDummyEvent] = 50
+	mustSendLocalEvent(t, r, &gomatrixserverlib.EventBuilder{
+		Sender:   alice,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomPowerLevels,
+		StateKey: new(string),
+		Content:  mustMarshalJSON(t, powerLevels),
+	})
+
+	// Three events which all reference the same prev_events fork the room
+	// into three forward extremities, which is over the threshold.
+	var forks []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 3; i++ {
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:  bob,
+			RoomID:  roomID,
+			Type:    "m.room.message",
+			Content: mustMarshalJSON(t, map[string]interface{}{"body": fmt.Sprintf("fork %d", i)}),
+		}
+		buildRes := api.QueryLatestEventsAndStateResponse{}
+		event, berr := internal.BuildEvent(ctx, &eb, r.Cfg, time.Now(), r, &buildRes)
+		if berr != nil {
+			t.Fatalf("BuildEvent failed: %s", berr)
+		}
+		forks = append(forks, event.Headered(buildRes.RoomVersion))
+	}
+	for i, fork := range forks {
+		if err = r.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+			InputRoomEvents: []api.InputRoomEvent{{
+				Kind:         api.KindNew,
+				Event:        fork,
+				AuthEventIDs: fork.AuthEventIDs(),
+			}},
+		}, &api.InputRoomEventsResponse{}); err != nil {
+			t.Fatalf("InputRoomEvents failed: %s", err)
+		}
+		// The dummy event is only sent once the threshold is passed.
+		_, sending := r.dummyEventRooms.Load(roomID)
+		if wantSending := i == len(forks)-1; sending != wantSending {
+			t.Fatalf("after %d forks: wanted sending dummy event %v, got %v", i+1, wantSending, sending)
+		}
+	}
+
+	// Wait for the dummy event to be sent.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, sending := r.dummyEventRooms.Load(roomID); !sending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the dummy event to be sent")
+		}
+	}
+
+	// The dummy event was sent by Bob and merged the forks into one.
+	roomNID, err := db.RoomNID(ctx, roomID)
+	if err != nil {
+		t.Fatalf("RoomNID failed: %s", err)
+	}
+	latest, _, _, err := db.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("LatestEventIDs failed: %s", err)
+	}
+	if len(latest) != 1 {
+		t.Fatalf("wanted the forward extremities to be merged into one, got %d", len(latest))
+	}
+	events, err := db.EventsFromIDs(ctx, []string{latest[0].EventID})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("EventsFromIDs failed: %v", err)
+	}
+	dummy := events[0]
+	if dummy.Type() != MDummyEvent || dummy.Sender() != bob {
+		t.Fatalf("wanted a dummy event from %q, got a %q event from %q", bob, dummy.Type(), dummy.Sender())
+	}
+	if len(dummy.PrevEventIDs()) != len(forks) {
+		t.Fatalf("wanted the dummy event to reference %d forks, got %v", len(forks), dummy.PrevEventIDs())
+	}
+}
+
+func mustMarshalJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	return data
+}
@@ -18,13 +18,23 @@ import (
 	"context"
 	"sort"
 
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// A rejectedError is returned by checkAuthEvents when the event isn't
+// allowed by its auth events, as opposed to when the auth events couldn't
+// be loaded from the database.
+type rejectedError string
+
+func (e rejectedError) Error() string { return string(e) }
+
 // checkAuthEvents checks that the event passes authentication checks
-// Returns the numeric IDs for the auth events.
+// Returns the numeric IDs for the auth events. If the event fails the checks
+// then the numeric IDs are returned along with a rejectedError, so that the
+// event can still be stored as rejected.
 func checkAuthEvents(
 	ctx context.Context,
 	db storage.Database,
@@ -38,6 +48,22 @@ func checkAuthEvents(
 	}
 	// TODO: check for duplicate state keys here.
 
+	result := make([]types.EventNID, len(authStateEntries))
+	for i := range authStateEntries {
+		result[i] = authStateEntries[i].EventNID
+	}
+
+	// An event which is authorised by a rejected event is also rejected.
+	statuses, err := db.EventStatuses(ctx, result)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if status.Rejected {
+			return result, rejectedError("auth event was rejected")
+		}
+	}
+
 	// Work out which of the state events we actually need.
 	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event.Unwrap()})
 
@@ -49,17 +75,36 @@ func checkAuthEvents(
 
 	// Check if the event is allowed.
 	if err = gomatrixserverlib.Allowed(event.Event, &authEvents); err != nil {
-		return nil, err
+		return result, rejectedError(err.Error())
 	}
 
-	// Return the numeric IDs for the auth events.
-	result := make([]types.EventNID, len(authStateEntries))
-	for i := range authStateEntries {
-		result[i] = authStateEntries[i].EventNID
-	}
 	return result, nil
 }
 
+// checkAllowedByCurrentState checks whether the event passes authentication
+// checks against the current state of the room. Events which don't are
+// soft-failed. Only the state needed to authenticate the event is loaded.
+func checkAllowedByCurrentState(
+	ctx context.Context,
+	db storage.Database,
+	event gomatrixserverlib.Event,
+	currentStateSnapshotNID types.StateSnapshotNID,
+) (bool, error) {
+	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event})
+	currentState, err := state.NewStateResolution(db).LoadStateAtSnapshotForStringTuples(
+		ctx, currentStateSnapshotNID, stateNeeded.Tuples(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	authEvents, err := loadAuthEvents(ctx, db, stateNeeded, currentState)
+	if err != nil {
+		return false, err
+	}
+	return gomatrixserverlib.Allowed(event, &authEvents) == nil, nil
+}
+
 type authEvents struct {
 	stateKeyNIDMap map[string]types.EventStateKeyNID
 	state          stateEntryMap
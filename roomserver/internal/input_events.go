@@ -46,8 +46,11 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 
 	// Check that the event passes authentication checks and work out
 	// the numeric IDs for the auth events.
+	// If the event fails the checks then it is still stored, but as rejected.
 	authEventNIDs, err := checkAuthEvents(ctx, r.DB, headered, input.AuthEventIDs)
-	if err != nil {
+	var rejectionErr rejectedError
+	isRejected := errors.As(err, &rejectionErr)
+	if err != nil && !isRejected {
 		logrus.WithError(err).WithField("event_id", event.EventID()).WithField("auth_event_ids", input.AuthEventIDs).Error("processRoomEvent.checkAuthEvents failed for event")
 		return
 	}
@@ -65,11 +68,21 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 	}
 
 	// Store the event.
-	roomNID, stateAtEvent, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs)
+	roomNID, stateAtEvent, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs, isRejected)
 	if err != nil {
 		return
 	}
 
+	// Rejected events never become part of the room state or the forward
+	// extremities, so there is nothing more to do with them.
+	if isRejected {
+		logrus.WithError(rejectionErr).WithFields(logrus.Fields{
+			"event_id":       event.EventID(),
+			"auth_event_ids": input.AuthEventIDs,
+		}).Error("processRoomEvent.checkAuthEvents failed for event, stored as rejected")
+		return event.EventID(), rejectionErr
+	}
+
 	// For outliers we can stop after we've stored the event itself as it
 	// doesn't have any associated state to store and we don't need to
 	// notify anyone about it.
@@ -91,6 +104,11 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 		}
 	}
 
+	// If the event is allowed by the state before it but not by the current
+	// state of the room then it is soft-failed. Events that we've been given
+	// the state for aren't checked, as the state came with them.
+	checkSoftFail := input.Kind == api.KindNew && !input.HasState
+
 	if err = r.updateLatestEvents(
 		ctx,                 // context
 		roomNID,             // room NID to update
@@ -98,6 +116,7 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 		event,               // event
 		input.SendAsServer,  // send as server
 		input.TransactionID, // transaction ID
+		checkSoftFail,       // check soft-fail
 	); err != nil {
 		return
 	}
@@ -169,7 +188,7 @@ func (r *RoomserverInternalAPI) processInviteEvent(
 	}).Info("processing invite event")
 
 	_, domain, _ := gomatrixserverlib.SplitID('@', targetUserID)
-	isTargetLocalUser := domain == r.Cfg.Matrix.ServerName
+	isTargetLocalUser := r.Cfg.IsLocalServerName(domain)
 
 	updater, err := r.DB.MembershipUpdater(ctx, roomID, targetUserID, isTargetLocalUser, input.RoomVersion)
 	if err != nil {
@@ -265,23 +284,22 @@ func localInviteLoopback(
 	if input.Event.StateKey() == nil {
 		return nil, errors.New("no state key on invite event")
 	}
-	ourServerName := string(ow.Cfg.Matrix.ServerName)
 	_, theirServerName, err := gomatrixserverlib.SplitID('@', *input.Event.StateKey())
 	if err != nil {
 		return nil, err
 	}
-	// Check if the invite originated locally and is destined locally.
-	if input.Event.Origin() == ow.Cfg.Matrix.ServerName && string(theirServerName) == ourServerName {
+	// Check if the invite originated locally and is destined locally, in
+	// which case we sign it as the invitee's server.
+	keyID, privateKey, isLocalTarget := ow.Cfg.SigningIdentityFor(theirServerName)
+	if ow.Cfg.IsLocalServerName(input.Event.Origin()) && isLocalTarget {
 		rsEvent := input.Event.Sign(
-			ourServerName,
-			ow.Cfg.Matrix.KeyID,
-			ow.Cfg.Matrix.PrivateKey,
+			string(theirServerName), keyID, privateKey,
 		).Headered(input.RoomVersion)
 		ire = &api.InputRoomEvent{
 			Kind:          api.KindNew,
 			Event:         rsEvent,
 			AuthEventIDs:  rsEvent.AuthEventIDs(),
-			SendAsServer:  ourServerName,
+			SendAsServer:  string(input.Event.Origin()),
 			TransactionID: nil,
 		}
 	}
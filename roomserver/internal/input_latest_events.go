@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 // updateLatestEvents updates the list of latest events for this room in the database and writes the
@@ -52,19 +53,12 @@ func (r *RoomserverInternalAPI) updateLatestEvents(
 	event gomatrixserverlib.Event,
 	sendAsServer string,
 	transactionID *api.TransactionID,
+	checkSoftFail bool,
 ) (err error) {
 	updater, err := r.DB.GetLatestEventsForUpdate(ctx, roomNID)
 	if err != nil {
 		return
 	}
-	succeeded := false
-	defer func() {
-		txerr := internal.EndTransaction(updater, &succeeded)
-		if err == nil && txerr != nil {
-			err = txerr
-		}
-	}()
-
 	u := latestEventsUpdater{
 		ctx:           ctx,
 		api:           r,
@@ -74,7 +68,23 @@ func (r *RoomserverInternalAPI) updateLatestEvents(
 		event:         event,
 		sendAsServer:  sendAsServer,
 		transactionID: transactionID,
+		checkSoftFail: checkSoftFail,
 	}
+	succeeded := false
+	defer func() {
+		txerr := internal.EndTransaction(updater, &succeeded)
+		if err == nil && txerr != nil {
+			err = txerr
+		}
+		// The new current state has to be committed before the server ACL
+		// can be reloaded from it.
+		if err == nil && u.serverACLChanged {
+			r.refreshServerACL(ctx, event.RoomID())
+		}
+		if err == nil && u.latestUpdated {
+			r.updateForwardExtremities(ctx, roomNID, event.RoomID())
+		}
+	}()
 
 	if err = u.doUpdateLatestEvents(); err != nil {
 		return err
@@ -98,6 +108,8 @@ type latestEventsUpdater struct {
 	transactionID *api.TransactionID
 	// Which server to send this event as.
 	sendAsServer string
+	// Whether to soft-fail the event if it isn't allowed by the current state.
+	checkSoftFail bool
 	// The eventID of the event that was processed before this one.
 	lastEventIDSent string
 	// The latest events in the room after processing this event.
@@ -113,6 +125,10 @@ type latestEventsUpdater struct {
 	// The snapshots of current state before and after processing this event
 	oldStateNID types.StateSnapshotNID
 	newStateNID types.StateSnapshotNID
+	// Whether the server ACL in the current state was changed by this event
+	serverACLChanged bool
+	// Whether the latest events in the room were updated by this event
+	latestUpdated bool
 }
 
 func (u *latestEventsUpdater) doUpdateLatestEvents() error {
@@ -140,6 +156,19 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 		return nil
 	}
 
+	// Soft-failed events are kept, but they don't become forward extremities
+	// and aren't sent to clients.
+	if softFailed, serr := u.isSoftFailed(); serr != nil {
+		return serr
+	} else if softFailed {
+		logrus.WithFields(logrus.Fields{
+			"event_id": u.event.EventID(),
+			"type":     u.event.Type(),
+			"room":     u.event.RoomID(),
+		}).Warn("Soft-failed event which isn't allowed by the current room state")
+		return u.updater.MarkEventAsSoftFailed(u.stateAtEvent.EventNID)
+	}
+
 	// Update the roomserver_previous_events table with references. This
 	// is effectively tracking the structure of the DAG.
 	if err = u.updater.StorePreviousEvents(u.stateAtEvent.EventNID, prevEvents); err != nil {
@@ -167,6 +196,11 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 			StateAtEvent:   u.stateAtEvent,
 		},
 	)
+	if !u.stateAtEvent.Overwrite {
+		if err = u.pruneStaleExtremities(); err != nil {
+			return err
+		}
+	}
 
 	// Now that we know what the latest events are, it's time to get the
 	// latest state.
@@ -202,10 +236,26 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	if err = u.updater.SetLatestEvents(u.roomNID, u.latest, u.stateAtEvent.EventNID, u.newStateNID); err != nil {
 		return err
 	}
+	u.latestUpdated = true
 
 	return u.updater.MarkEventAsSent(u.stateAtEvent.EventNID)
 }
 
+// isSoftFailed returns true if the event isn't allowed by the current state of
+// the room. This is checked while we hold the lock on the latest events, so
+// that the current state can't change before we're done. Events can't be
+// soft-failed if we don't have any current state for the room yet.
+func (u *latestEventsUpdater) isSoftFailed() (bool, error) {
+	if !u.checkSoftFail || u.oldStateNID == 0 {
+		return false, nil
+	}
+	allowed, err := checkAllowedByCurrentState(u.ctx, u.api.DB, u.event, u.oldStateNID)
+	if err != nil {
+		return false, err
+	}
+	return !allowed, nil
+}
+
 func (u *latestEventsUpdater) latestState() error {
 	var err error
 	roomState := state.NewStateResolution(u.api.DB)
@@ -244,6 +294,10 @@ func (u *latestEventsUpdater) latestState() error {
 	if err != nil {
 		return err
 	}
+	u.serverACLChanged, err = u.api.stateChangesServerACL(u.ctx, u.removed, u.added)
+	if err != nil {
+		return err
+	}
 
 	// Also work out the state before the event removes and the event
 	// adds.
@@ -135,7 +135,7 @@ func (r *RoomserverInternalAPI) isLocalTarget(event *gomatrixserverlib.Event) bo
 	isTargetLocalUser := false
 	if statekey := event.StateKey(); statekey != nil {
 		_, domain, _ := gomatrixserverlib.SplitID('@', *statekey)
-		isTargetLocalUser = domain == r.Cfg.Matrix.ServerName
+		isTargetLocalUser = r.Cfg.IsLocalServerName(domain)
 	}
 	return isTargetLocalUser
 }
@@ -0,0 +1,215 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testRoomID = "!rejected:localhost"
+
+var (
+	_, testPrivateKey, _ = ed25519.GenerateKey(nil)
+	testDepth            int64
+)
+
+func mustBuildEvent(
+	t *testing.T, sender, eventType string, stateKey *string,
+	content interface{}, authEvents []gomatrixserverlib.Event,
+) gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	testDepth++
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     testRoomID,
+		Type:       eventType,
+		StateKey:   stateKey,
+		Depth:      testDepth,
+		PrevEvents: []gomatrixserverlib.EventReference{},
+	}
+	authRefs := []gomatrixserverlib.EventReference{}
+	for _, ev := range authEvents {
+		authRefs = append(authRefs, ev.EventReference())
+	}
+	builder.AuthEvents = authRefs
+	if err := builder.SetContent(content); err != nil {
+		t.Fatalf("SetContent failed: %s", err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", testPrivateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV4)
+}
+
+func mustStoreEvent(
+	t *testing.T, db storage.Database, ev gomatrixserverlib.HeaderedEvent,
+	authEventNIDs []types.EventNID, isRejected bool,
+) types.EventNID {
+	t.Helper()
+	_, stateAtEvent, err := db.StoreEvent(context.Background(), ev.Unwrap(), nil, authEventNIDs, isRejected)
+	if err != nil {
+		t.Fatalf("StoreEvent failed: %s", err)
+	}
+	return stateAtEvent.EventNID
+}
+
+func TestCheckAuthEventsRejected(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+
+	alice, bob := "@alice:localhost", "@bob:localhost"
+	emptyKey := ""
+	create := mustBuildEvent(t, alice, "m.room.create", &emptyKey, map[string]interface{}{
+		"creator":      alice,
+		"room_version": "4",
+	}, nil)
+	createNID := mustStoreEvent(t, db, create, nil, false)
+	join := mustBuildEvent(t, alice, "m.room.member", &alice, map[string]interface{}{
+		"membership": "join",
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	joinNID := mustStoreEvent(t, db, join, []types.EventNID{createNID}, false)
+
+	// A message from alice is allowed by her join.
+	message := mustBuildEvent(t, alice, "m.room.message", nil, map[string]interface{}{
+		"body": "hello",
+	}, []gomatrixserverlib.Event{create.Unwrap(), join.Unwrap()})
+	if _, err = checkAuthEvents(ctx, db, message, []string{create.EventID(), join.EventID()}); err != nil {
+		t.Fatalf("checkAuthEvents failed for allowed event: %s", err)
+	}
+
+	// Bob isn't in the room so his join on alice's behalf is rejected, but
+	// the auth event NIDs are still returned so that it can be stored.
+	forgedJoin := mustBuildEvent(t, bob, "m.room.member", &alice, map[string]interface{}{
+		"membership": "join",
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	authEventNIDs, err := checkAuthEvents(ctx, db, forgedJoin, []string{create.EventID()})
+	var rejectionErr rejectedError
+	if !errors.As(err, &rejectionErr) {
+		t.Fatalf("wanted a rejectedError, got %v", err)
+	}
+	if len(authEventNIDs) != 1 || authEventNIDs[0] != createNID {
+		t.Fatalf("wanted auth event NIDs [%d], got %v", createNID, authEventNIDs)
+	}
+	forgedJoinNID := mustStoreEvent(t, db, forgedJoin, authEventNIDs, true)
+
+	statuses, err := db.EventStatuses(ctx, []types.EventNID{joinNID, forgedJoinNID})
+	if err != nil {
+		t.Fatalf("EventStatuses failed: %s", err)
+	}
+	if statuses[joinNID].Rejected || !statuses[forgedJoinNID].Rejected {
+		t.Fatalf("wrong rejected statuses: %+v", statuses)
+	}
+
+	// An event which is authorised by a rejected event is also rejected,
+	// even if it would otherwise be allowed.
+	forgedMessage := mustBuildEvent(t, alice, "m.room.message", nil, map[string]interface{}{
+		"body": "hello",
+	}, []gomatrixserverlib.Event{create.Unwrap(), forgedJoin.Unwrap()})
+	_, err = checkAuthEvents(ctx, db, forgedMessage, []string{create.EventID(), forgedJoin.EventID()})
+	if !errors.As(err, &rejectionErr) {
+		t.Fatalf("wanted a rejectedError, got %v", err)
+	}
+}
+
+func TestCheckAllowedByCurrentState(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+
+	alice, bob := "@alice:localhost", "@bob:localhost"
+	emptyKey := ""
+	create := mustBuildEvent(t, alice, "m.room.create", &emptyKey, map[string]interface{}{
+		"creator":      alice,
+		"room_version": "4",
+	}, nil)
+	createNID := mustStoreEvent(t, db, create, nil, false)
+	aliceJoin := mustBuildEvent(t, alice, "m.room.member", &alice, map[string]interface{}{
+		"membership": "join",
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	aliceJoinNID := mustStoreEvent(t, db, aliceJoin, []types.EventNID{createNID}, false)
+	bobJoin := mustBuildEvent(t, bob, "m.room.member", &bob, map[string]interface{}{
+		"membership": "join",
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	bobJoinNID := mustStoreEvent(t, db, bobJoin, []types.EventNID{createNID}, false)
+	bobLeave := mustBuildEvent(t, bob, "m.room.member", &bob, map[string]interface{}{
+		"membership": "leave",
+	}, []gomatrixserverlib.Event{create.Unwrap(), bobJoin.Unwrap()})
+	bobLeaveNID := mustStoreEvent(t, db, bobLeave, []types.EventNID{createNID, bobJoinNID}, false)
+
+	entry := func(eventTypeNID types.EventTypeNID, stateKey string, eventNID types.EventNID) types.StateEntry {
+		stateKeyNIDs, err := db.EventStateKeyNIDs(ctx, []string{stateKey})
+		if err != nil {
+			t.Fatalf("EventStateKeyNIDs failed: %s", err)
+		}
+		return types.StateEntry{
+			StateKeyTuple: types.StateKeyTuple{
+				EventTypeNID:     eventTypeNID,
+				EventStateKeyNID: stateKeyNIDs[stateKey],
+			},
+			EventNID: eventNID,
+		}
+	}
+	createEntry := entry(types.MRoomCreateNID, "", createNID)
+	aliceEntry := entry(types.MRoomMemberNID, alice, aliceJoinNID)
+	joinedState, err := db.AddState(ctx, 1, nil, []types.StateEntry{
+		createEntry, aliceEntry, entry(types.MRoomMemberNID, bob, bobJoinNID),
+	})
+	if err != nil {
+		t.Fatalf("AddState failed: %s", err)
+	}
+	leftState, err := db.AddState(ctx, 1, nil, []types.StateEntry{
+		createEntry, aliceEntry, entry(types.MRoomMemberNID, bob, bobLeaveNID),
+	})
+	if err != nil {
+		t.Fatalf("AddState failed: %s", err)
+	}
+
+	// Bob's message is allowed while he is joined, but would be soft-failed
+	// once he has left the room.
+	message := mustBuildEvent(t, bob, "m.room.message", nil, map[string]interface{}{
+		"body": "hello",
+	}, []gomatrixserverlib.Event{create.Unwrap(), bobJoin.Unwrap()})
+	for _, tc := range []struct {
+		name        string
+		stateNID    types.StateSnapshotNID
+		wantAllowed bool
+	}{
+		{"joined", joinedState, true},
+		{"left", leftState, false},
+	} {
+		allowed, err := checkAllowedByCurrentState(ctx, db, message.Unwrap(), tc.stateNID)
+		if err != nil {
+			t.Fatalf("%s: checkAllowedByCurrentState failed: %s", tc.name, err)
+		}
+		if allowed != tc.wantAllowed {
+			t.Errorf("%s: wanted allowed %v, got %v", tc.name, tc.wantAllowed, allowed)
+		}
+	}
+}
@@ -23,7 +23,7 @@ func (r *RoomserverInternalAPI) PerformJoin(
 	if err != nil {
 		return fmt.Errorf("Supplied user ID %q in incorrect format", req.UserID)
 	}
-	if domain != r.Cfg.Matrix.ServerName {
+	if !r.Cfg.IsLocalServerName(domain) {
 		return fmt.Errorf("User %q does not belong to this homeserver", req.UserID)
 	}
 	if strings.HasPrefix(req.RoomIDOrAlias, "!") {
@@ -50,7 +50,7 @@ func (r *RoomserverInternalAPI) performJoinRoomByAlias(
 	// Check if this alias matches our own server configuration. If it
 	// doesn't then we'll need to try a federated join.
 	var roomID string
-	if domain != r.Cfg.Matrix.ServerName {
+	if !r.Cfg.IsLocalServerName(domain) {
 		// The alias isn't owned by us, so we will need to try joining using
 		// a remote server.
 		dirReq := fsAPI.PerformDirectoryLookupRequest{
@@ -96,6 +96,15 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 	// return the right room ID.
 	res.RoomID = req.RoomIDOrAlias
 
+	// Don't let anyone join a room which has been shut down by an admin.
+	blocked, err := r.DB.IsRoomBlocked(ctx, req.RoomIDOrAlias)
+	if err != nil {
+		return fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+	}
+	if blocked {
+		return fmt.Errorf("Room %q has been blocked by an admin", req.RoomIDOrAlias)
+	}
+
 	// Get the domain part of the room ID.
 	_, domain, err := gomatrixserverlib.SplitID('!', req.RoomIDOrAlias)
 	if err != nil {
@@ -143,7 +152,7 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 		// Check that the domain isn't ours. If it's local then we don't
 		// need to do anything as our own copy of the room state will be
 		// up-to-date.
-		if inviterDomain != r.Cfg.Matrix.ServerName {
+		if !r.Cfg.IsLocalServerName(inviterDomain) {
 			// Add the server of the person who invited us to the server list,
 			// as they should be a fairly good bet.
 			req.ServerNames = append(req.ServerNames, inviterDomain)
@@ -192,7 +201,7 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 						Kind:         api.KindNew,
 						Event:        event.Headered(buildRes.RoomVersion),
 						AuthEventIDs: event.AuthEventIDs(),
-						SendAsServer: string(r.Cfg.Matrix.ServerName),
+						SendAsServer: string(event.Origin()),
 					},
 				},
 			}
@@ -206,7 +215,7 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 		// The room doesn't exist. First of all check if the room is a local
 		// room. If it is then there's nothing more to do - the room just
 		// hasn't been created yet.
-		if domain == r.Cfg.Matrix.ServerName {
+		if r.Cfg.IsLocalServerName(domain) {
 			return fmt.Errorf("Room ID %q does not exist", req.RoomIDOrAlias)
 		}
 
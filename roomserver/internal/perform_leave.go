@@ -22,7 +22,7 @@ func (r *RoomserverInternalAPI) PerformLeave(
 	if err != nil {
 		return fmt.Errorf("Supplied user ID %q in incorrect format", req.UserID)
 	}
-	if domain != r.Cfg.Matrix.ServerName {
+	if !r.Cfg.IsLocalServerName(domain) {
 		return fmt.Errorf("User %q does not belong to this homeserver", req.UserID)
 	}
 	if strings.HasPrefix(req.RoomID, "!") {
@@ -36,11 +36,15 @@ func (r *RoomserverInternalAPI) performLeaveRoomByID(
 	req *api.PerformLeaveRequest,
 	res *api.PerformLeaveResponse, // nolint:unparam
 ) error {
-	// If there's an invite outstanding for the room then respond to
-	// that.
+	// If there's an invite outstanding for the room from a remote user
+	// then respond to that. Invites from our own users are rejected
+	// with a leave event below, as we are already in the room.
 	isInvitePending, senderUser, err := r.isInvitePending(ctx, req.RoomID, req.UserID)
 	if err == nil && isInvitePending {
-		return r.performRejectInvite(ctx, req, res, senderUser)
+		_, senderDomain, serr := gomatrixserverlib.SplitID('@', senderUser)
+		if serr != nil || !r.Cfg.IsLocalServerName(senderDomain) {
+			return r.performRejectInvite(ctx, req, res, senderUser)
+		}
 	}
 
 	// There's no invite pending, so first of all we want to find out
@@ -70,10 +74,8 @@ func (r *RoomserverInternalAPI) performLeaveRoomByID(
 	if err != nil {
 		return fmt.Errorf("Error getting membership: %w", err)
 	}
-	if membership != gomatrixserverlib.Join {
-		// TODO: should be able to handle "invite" in this case too, if
-		// it's a case of kicking or banning or such
-		return fmt.Errorf("User %q is not joined to the room (membership is %q)", req.UserID, membership)
+	if membership != gomatrixserverlib.Join && membership != gomatrixserverlib.Invite {
+		return fmt.Errorf("User %q is not joined to or invited to the room (membership is %q)", req.UserID, membership)
 	}
 
 	// Prepare the template for the leave event.
@@ -92,8 +94,8 @@ func (r *RoomserverInternalAPI) performLeaveRoomByID(
 		return fmt.Errorf("eb.SetUnsigned: %w", err)
 	}
 
-	// We know that the user is in the room at this point so let's build
-	// a leave event.
+	// We know that the user is in or invited to the room at this point
+	// so let's build a leave event.
 	// TODO: Check what happens if the room exists on the server
 	// but everyone has since left. I suspect it does the wrong thing.
 	buildRes := api.QueryLatestEventsAndStateResponse{}
@@ -118,7 +120,7 @@ func (r *RoomserverInternalAPI) performLeaveRoomByID(
 				Kind:         api.KindNew,
 				Event:        event.Headered(buildRes.RoomVersion),
 				AuthEventIDs: event.AuthEventIDs(),
-				SendAsServer: string(r.Cfg.Matrix.ServerName),
+				SendAsServer: string(event.Origin()),
 			},
 		},
 	}
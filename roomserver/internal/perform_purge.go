@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/sirupsen/logrus"
+)
+
+// purgeOutputBatchSize is the maximum number of event IDs that are sent in a
+// single OutputPurgeHistory, to keep the output log messages a sensible size.
+const purgeOutputBatchSize = 1000
+
+// PerformPurgeHistory implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformPurgeHistory(
+	ctx context.Context,
+	req *api.PerformPurgeHistoryRequest,
+	res *api.PerformPurgeHistoryResponse,
+) error {
+	roomNID, err := r.DB.RoomNID(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomNID: %w", err)
+	}
+	if roomNID == 0 {
+		return fmt.Errorf("Room %q does not exist", req.RoomID)
+	}
+	events, err := r.DB.EventsFromIDs(ctx, []string{req.BeforeEventID})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	if len(events) == 0 || events[0].RoomID() != req.RoomID {
+		return fmt.Errorf("Event %q does not exist in room %q", req.BeforeEventID, req.RoomID)
+	}
+
+	res.PurgedEvents, err = r.purgeHistoryBeforeDepth(ctx, req.RoomID, roomNID, events[0].Depth())
+	return err
+}
+
+// purgeHistoryBeforeDepth purges the non-state events in the room with a depth
+// lower than beforeDepth and tells the downstream components about them.
+// Returns the number of events which were purged.
+func (r *RoomserverInternalAPI) purgeHistoryBeforeDepth(
+	ctx context.Context, roomID string, roomNID types.RoomNID, beforeDepth int64,
+) (int, error) {
+	purgedEventIDs, err := r.DB.PurgeHistory(ctx, roomNID, beforeDepth)
+	// Some events may have been purged even if there was an error, so always
+	// tell the downstream components about the ones which were.
+	if werr := r.writePurgedEvents(roomID, purgedEventIDs); werr != nil {
+		return len(purgedEventIDs), werr
+	}
+	if err != nil {
+		return len(purgedEventIDs), fmt.Errorf("r.DB.PurgeHistory: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"room_id":      roomID,
+		"before_depth": beforeDepth,
+		"purged":       len(purgedEventIDs),
+	}).Info("Purged room history")
+	return len(purgedEventIDs), nil
+}
+
+// writePurgedEvents tells the downstream components that the given events
+// have been deleted from the room, so that they can delete them too.
+func (r *RoomserverInternalAPI) writePurgedEvents(roomID string, eventIDs []string) error {
+	var updates []api.OutputEvent
+	for i := 0; i < len(eventIDs); i += purgeOutputBatchSize {
+		end := i + purgeOutputBatchSize
+		if end > len(eventIDs) {
+			end = len(eventIDs)
+		}
+		updates = append(updates, api.OutputEvent{
+			Type: api.OutputTypePurgeHistory,
+			PurgeHistory: &api.OutputPurgeHistory{
+				RoomID:   roomID,
+				EventIDs: eventIDs[i:end],
+				Final:    end == len(eventIDs),
+			},
+		})
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := r.WriteOutputEvents(roomID, updates); err != nil {
+		return fmt.Errorf("r.WriteOutputEvents: %w", err)
+	}
+	return nil
+}
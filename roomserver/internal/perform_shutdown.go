@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// PerformRoomShutdown implements api.RoomserverInternalAPI
+// nolint:gocyclo
+func (r *RoomserverInternalAPI) PerformRoomShutdown(
+	ctx context.Context,
+	req *api.PerformRoomShutdownRequest,
+	res *api.PerformRoomShutdownResponse,
+) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return fmt.Errorf("Supplied user ID %q in incorrect format", req.UserID)
+	}
+	if domain != r.Cfg.Matrix.ServerName {
+		return fmt.Errorf("User %q does not belong to this homeserver", req.UserID)
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id": req.RoomID,
+		"user_id": req.UserID,
+	})
+
+	// Block the room first so that nobody can join it while the local users
+	// are being made to leave. It is fine to block a room that we don't know
+	// about yet, so that we never will.
+	if req.Block {
+		if err = r.DB.BlockRoom(ctx, req.RoomID, req.UserID); err != nil {
+			return fmt.Errorf("r.DB.BlockRoom: %w", err)
+		}
+	}
+	roomNID, err := r.DB.RoomNID(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomNID: %w", err)
+	}
+	if roomNID == 0 {
+		if req.Block {
+			return nil
+		}
+		return fmt.Errorf("Room %q does not exist", req.RoomID)
+	}
+
+	// Find out who the local members of the room are before anything else
+	// changes. Invited users are made to leave too, so that they can't
+	// accept their invites afterwards. The membership table doesn't know
+	// the invite events, so the members are taken from the current state.
+	stateReq := api.QueryLatestEventsAndStateRequest{RoomID: req.RoomID}
+	stateRes := api.QueryLatestEventsAndStateResponse{}
+	if err = r.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return fmt.Errorf("r.QueryLatestEventsAndState: %w", err)
+	}
+	var memberEvents []gomatrixserverlib.HeaderedEvent
+	for _, event := range stateRes.StateEvents {
+		if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+			continue
+		}
+		_, memberDomain, merr := gomatrixserverlib.SplitID('@', *event.StateKey())
+		if merr != nil || !r.Cfg.IsLocalServerName(memberDomain) {
+			continue
+		}
+		memberEvents = append(memberEvents, event)
+	}
+
+	if req.NewRoomName != "" {
+		res.NewRoomID, err = r.createShutdownRoom(ctx, req)
+		if err != nil {
+			return fmt.Errorf("r.createShutdownRoom: %w", err)
+		}
+	}
+
+	// Remove the local aliases, so that the room can't be found through them.
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetAliasesForRoomID: %w", err)
+	}
+	for _, alias := range aliases {
+		_, aliasDomain, aerr := gomatrixserverlib.SplitID('#', alias)
+		if aerr != nil || !r.Cfg.IsLocalServerName(aliasDomain) {
+			continue
+		}
+		aliasReq := api.RemoveRoomAliasRequest{
+			UserID: req.UserID,
+			Alias:  alias,
+		}
+		aliasRes := api.RemoveRoomAliasResponse{}
+		if aerr = r.RemoveRoomAlias(ctx, &aliasReq, &aliasRes); aerr != nil {
+			// The alias is removed from the database before the updated
+			// m.room.aliases event is sent, which will fail if the user
+			// isn't in the room, so carry on regardless.
+			logger.WithError(aerr).WithField("alias", alias).Warn("Failed to send updated aliases after removing alias")
+		}
+		res.LocalAliases = append(res.LocalAliases, alias)
+	}
+
+	// Make the local users leave, and move them into the replacement room.
+	for _, event := range memberEvents {
+		membership, merr := event.Membership()
+		if merr != nil {
+			continue
+		}
+		if membership != gomatrixserverlib.Join && membership != gomatrixserverlib.Invite {
+			continue
+		}
+		userID := *event.StateKey()
+		leaveReq := api.PerformLeaveRequest{
+			RoomID: req.RoomID,
+			UserID: userID,
+		}
+		leaveRes := api.PerformLeaveResponse{}
+		if err = r.PerformLeave(ctx, &leaveReq, &leaveRes); err != nil {
+			logger.WithError(err).WithField("target_user_id", userID).Error("Failed to make user leave room")
+			continue
+		}
+		res.KickedUsers = append(res.KickedUsers, userID)
+
+		if res.NewRoomID != "" && membership == gomatrixserverlib.Join && userID != req.UserID {
+			joinReq := api.PerformJoinRequest{
+				RoomIDOrAlias: res.NewRoomID,
+				UserID:        userID,
+			}
+			joinRes := api.PerformJoinResponse{}
+			if err = r.PerformJoin(ctx, &joinReq, &joinRes); err != nil {
+				logger.WithError(err).WithField("target_user_id", userID).Error("Failed to join user to replacement room")
+			}
+		}
+	}
+
+	if err = r.WriteOutputEvents(req.RoomID, []api.OutputEvent{
+		{
+			Type:         api.OutputTypeRoomShutdown,
+			RoomShutdown: &api.OutputRoomShutdown{RoomID: req.RoomID},
+		},
+	}); err != nil {
+		return fmt.Errorf("r.WriteOutputEvents: %w", err)
+	}
+
+	if req.Purge {
+		deletedEventIDs, derr := r.DB.DeleteRoom(ctx, req.RoomID, roomNID)
+		if derr != nil {
+			return fmt.Errorf("r.DB.DeleteRoom: %w", derr)
+		}
+		if r.Cache != nil {
+			r.Cache.EvictRoomVersion(req.RoomID)
+			r.Cache.EvictServerACL(req.RoomID)
+		}
+		if err = r.writePurgedEvents(req.RoomID, deletedEventIDs); err != nil {
+			return err
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"kicked_users": len(res.KickedUsers),
+		"new_room_id":  res.NewRoomID,
+		"blocked":      req.Block,
+		"purged":       req.Purge,
+	}).Info("Shut down room")
+	return nil
+}
+
+// fledglingEvent is an event in the replacement room which hasn't been built yet.
+type fledglingEvent struct {
+	Type     string
+	StateKey *string
+	Content  interface{}
+}
+
+// createShutdownRoom creates the room that the local members of a room which
+// is being shut down are moved into. The room is public so that they can be
+// joined to it, but they can't send anything into it.
+func (r *RoomserverInternalAPI) createShutdownRoom(
+	ctx context.Context, req *api.PerformRoomShutdownRequest,
+) (string, error) {
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
+	roomVersion := version.DefaultRoomVersion()
+
+	powerLevels := internal.InitialPowerLevelsContent(req.UserID)
+	powerLevels.UsersDefault = -10
+	fledglingEvents := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, new(string), map[string]interface{}{
+			"creator":      req.UserID,
+			"room_version": roomVersion,
+		}},
+		{gomatrixserverlib.MRoomMember, &req.UserID, gomatrixserverlib.MemberContent{
+			Membership: gomatrixserverlib.Join,
+		}},
+		{gomatrixserverlib.MRoomPowerLevels, new(string), powerLevels},
+		{gomatrixserverlib.MRoomJoinRules, new(string), gomatrixserverlib.JoinRuleContent{
+			JoinRule: gomatrixserverlib.Public,
+		}},
+		{gomatrixserverlib.MRoomHistoryVisibility, new(string), internal.HistoryVisibilityContent{
+			HistoryVisibility: "shared",
+		}},
+		{gomatrixserverlib.MRoomName, new(string), internal.NameContent{Name: req.NewRoomName}},
+	}
+	if req.Message != "" {
+		fledglingEvents = append(fledglingEvents, fledglingEvent{"m.room.message", nil, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    req.Message,
+		}})
+	}
+
+	var inputEvents []api.InputRoomEvent
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	now := time.Now()
+	for i, fledgling := range fledglingEvents {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:     req.UserID,
+			RoomID:     roomID,
+			Type:       fledgling.Type,
+			StateKey:   fledgling.StateKey,
+			Depth:      int64(i + 1),
+			PrevEvents: []gomatrixserverlib.EventReference{},
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{
+				inputEvents[i-1].Event.EventReference(),
+			}
+		}
+		if err := builder.SetContent(fledgling.Content); err != nil {
+			return "", fmt.Errorf("builder.SetContent: %w", err)
+		}
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return "", fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		}
+		if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(&authEvents); err != nil {
+			return "", fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+		}
+		event, err := builder.Build(
+			now, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
+			r.Cfg.Matrix.PrivateKey, roomVersion,
+		)
+		if err != nil {
+			return "", fmt.Errorf("builder.Build: %w", err)
+		}
+		if err = gomatrixserverlib.Allowed(event, &authEvents); err != nil {
+			return "", fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+		}
+		if err = authEvents.AddEvent(&event); err != nil {
+			return "", fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+		inputEvents = append(inputEvents, api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        event.Headered(roomVersion),
+			AuthEventIDs: event.AuthEventIDs(),
+			SendAsServer: string(r.Cfg.Matrix.ServerName),
+		})
+	}
+
+	inputReq := api.InputRoomEventsRequest{InputRoomEvents: inputEvents}
+	inputRes := api.InputRoomEventsResponse{}
+	if err := r.InputRoomEvents(ctx, &inputReq, &inputRes); err != nil {
+		return "", fmt.Errorf("r.InputRoomEvents: %w", err)
+	}
+	return roomID, nil
+}
@@ -0,0 +1,315 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestBlockedRoomCannotBeJoined(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	r := &RoomserverInternalAPI{DB: db, Cfg: cfg}
+
+	// We don't know about the room at all, but it can still be blocked so
+	// that we never will.
+	roomID := "!abuse:remote"
+	if err = r.PerformRoomShutdown(ctx, &api.PerformRoomShutdownRequest{
+		RoomID: roomID,
+		UserID: "@admin:localhost",
+		Block:  true,
+	}, &api.PerformRoomShutdownResponse{}); err != nil {
+		t.Fatalf("PerformRoomShutdown failed: %s", err)
+	}
+
+	blockedRes := api.QueryRoomBlockedResponse{}
+	if err = r.QueryRoomBlocked(ctx, &api.QueryRoomBlockedRequest{RoomID: roomID}, &blockedRes); err != nil {
+		t.Fatalf("QueryRoomBlocked failed: %s", err)
+	}
+	if !blockedRes.Blocked {
+		t.Fatalf("wanted room to be blocked")
+	}
+
+	err = r.PerformJoin(ctx, &api.PerformJoinRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        "@alice:localhost",
+	}, &api.PerformJoinResponse{})
+	if err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Fatalf("wanted join to be refused because the room is blocked, got %v", err)
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+
+	alice := "@alice:localhost"
+	emptyKey := ""
+	create := mustBuildEvent(t, alice, "m.room.create", &emptyKey, map[string]interface{}{
+		"creator":      alice,
+		"room_version": "4",
+	}, nil)
+	createNID := mustStoreEvent(t, db, create, nil, false)
+	join := mustBuildEvent(t, alice, "m.room.member", &alice, map[string]interface{}{
+		"membership": "join",
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	joinNID := mustStoreEvent(t, db, join, []types.EventNID{createNID}, false)
+	message := mustBuildEvent(t, alice, "m.room.message", nil, map[string]interface{}{
+		"body": "hello",
+	}, []gomatrixserverlib.Event{create.Unwrap(), join.Unwrap()})
+	mustStoreEvent(t, db, message, []types.EventNID{createNID, joinNID}, false)
+
+	roomNID, err := db.RoomNID(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("RoomNID failed: %s", err)
+	}
+	stateKeyNIDs, err := db.EventStateKeyNIDs(ctx, []string{"", alice})
+	if err != nil {
+		t.Fatalf("EventStateKeyNIDs failed: %s", err)
+	}
+	if _, err = db.AddState(ctx, roomNID, nil, []types.StateEntry{
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomCreateNID, EventStateKeyNID: stateKeyNIDs[""]}, EventNID: createNID},
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomMemberNID, EventStateKeyNID: stateKeyNIDs[alice]}, EventNID: joinNID},
+	}); err != nil {
+		t.Fatalf("AddState failed: %s", err)
+	}
+
+	deleted, err := db.DeleteRoom(ctx, testRoomID, roomNID)
+	if err != nil {
+		t.Fatalf("DeleteRoom failed: %s", err)
+	}
+	if len(deleted) != 3 {
+		t.Fatalf("wanted 3 deleted events, got %v", deleted)
+	}
+	remaining, err := db.EventsFromIDs(ctx, []string{create.EventID(), join.EventID(), message.EventID()})
+	if err != nil {
+		t.Fatalf("EventsFromIDs failed: %s", err)
+	}
+	if len(remaining) != 0 {
+		t.Fatalf("wanted all events to be deleted, got %d", len(remaining))
+	}
+	if roomNID, err = db.RoomNID(ctx, testRoomID); err != nil {
+		t.Fatalf("RoomNID failed: %s", err)
+	}
+	if roomNID != 0 {
+		t.Fatalf("wanted room to be deleted, got room NID %d", roomNID)
+	}
+}
+
+// testProducer is a sarama.SyncProducer which discards the output events.
+type testProducer struct{}
+
+func (p *testProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, nil
+}
+
+func (p *testProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	return nil
+}
+
+func (p *testProducer) Close() error {
+	return nil
+}
+
+func mustSendLocalEvent(t *testing.T, r *RoomserverInternalAPI, eb *gomatrixserverlib.EventBuilder) {
+	t.Helper()
+	ctx := context.Background()
+	buildRes := api.QueryLatestEventsAndStateResponse{}
+	event, err := internal.BuildEvent(ctx, eb, r.Cfg, time.Now(), r, &buildRes)
+	if err != nil {
+		t.Fatalf("BuildEvent failed: %s", err)
+	}
+	if err = r.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{
+			Kind:         api.KindNew,
+			Event:        event.Headered(buildRes.RoomVersion),
+			AuthEventIDs: event.AuthEventIDs(),
+		}},
+	}, &api.InputRoomEventsResponse{}); err != nil {
+		t.Fatalf("InputRoomEvents failed: %s", err)
+	}
+}
+
+func mustGetMembership(t *testing.T, r *RoomserverInternalAPI, roomID, userID string) string {
+	t.Helper()
+	res := api.QueryLatestEventsAndStateResponse{}
+	if err := r.QueryLatestEventsAndState(context.Background(), &api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+		},
+	}, &res); err != nil {
+		t.Fatalf("QueryLatestEventsAndState failed: %s", err)
+	}
+	if len(res.StateEvents) == 0 {
+		return ""
+	}
+	membership, err := res.StateEvents[0].Membership()
+	if err != nil {
+		t.Fatalf("Membership failed: %s", err)
+	}
+	return membership
+}
+
+func TestShutdownRoom(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = testPrivateKey
+	r := &RoomserverInternalAPI{
+		DB:         db,
+		Cfg:        cfg,
+		Producer:   &testProducer{},
+		Cache:      newTestCaches(),
+		ServerName: cfg.Matrix.ServerName,
+	}
+
+	// Alice creates a public room, which Bob joins and Charlie is invited
+	// to. The room has a local alias and an alias on a remote server.
+	alice, bob, charlie := "@alice:localhost", "@bob:localhost", "@charlie:localhost"
+	roomID, err := r.createShutdownRoom(ctx, &api.PerformRoomShutdownRequest{
+		UserID:      alice,
+		NewRoomName: "Abuse",
+	})
+	if err != nil {
+		t.Fatalf("createShutdownRoom failed: %s", err)
+	}
+	if err = r.PerformJoin(ctx, &api.PerformJoinRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        bob,
+	}, &api.PerformJoinResponse{}); err != nil {
+		t.Fatalf("PerformJoin failed: %s", err)
+	}
+	invite := gomatrixserverlib.EventBuilder{
+		Sender:   alice,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &charlie,
+	}
+	if err = invite.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Invite}); err != nil {
+		t.Fatalf("SetContent failed: %s", err)
+	}
+	mustSendLocalEvent(t, r, &invite)
+	if err = r.SetRoomAlias(ctx, &api.SetRoomAliasRequest{
+		UserID: alice,
+		RoomID: roomID,
+		Alias:  "#abuse:localhost",
+	}, &api.SetRoomAliasResponse{}); err != nil {
+		t.Fatalf("SetRoomAlias failed: %s", err)
+	}
+	if err = db.SetRoomAlias(ctx, "#abuse:remote", roomID, "@mallory:remote"); err != nil {
+		t.Fatalf("db.SetRoomAlias failed: %s", err)
+	}
+
+	res := api.PerformRoomShutdownResponse{}
+	if err = r.PerformRoomShutdown(ctx, &api.PerformRoomShutdownRequest{
+		RoomID:      roomID,
+		UserID:      "@admin:localhost",
+		NewRoomName: "Shut down",
+		Block:       true,
+	}, &res); err != nil {
+		t.Fatalf("PerformRoomShutdown failed: %s", err)
+	}
+
+	// Everyone who was joined or invited is made to leave.
+	kicked := map[string]bool{}
+	for _, userID := range res.KickedUsers {
+		kicked[userID] = true
+	}
+	for _, userID := range []string{alice, bob, charlie} {
+		if !kicked[userID] {
+			t.Errorf("wanted %q to be kicked, got %v", userID, res.KickedUsers)
+		}
+		if membership := mustGetMembership(t, r, roomID, userID); membership != gomatrixserverlib.Leave {
+			t.Errorf("wanted %q to have left the room, got membership %q", userID, membership)
+		}
+	}
+
+	// Only the local alias is reported, and both are gone from the directory.
+	if len(res.LocalAliases) != 1 || res.LocalAliases[0] != "#abuse:localhost" {
+		t.Errorf("wanted the local alias to be removed, got %v", res.LocalAliases)
+	}
+	aliasRes := api.GetRoomIDForAliasResponse{}
+	if err = r.GetRoomIDForAlias(ctx, &api.GetRoomIDForAliasRequest{Alias: "#abuse:localhost"}, &aliasRes); err != nil {
+		t.Fatalf("GetRoomIDForAlias failed: %s", err)
+	}
+	if aliasRes.RoomID != "" {
+		t.Errorf("wanted the local alias to be removed, but it points at %q", aliasRes.RoomID)
+	}
+
+	// The joined users are moved into the replacement room, but the invited
+	// user isn't.
+	if res.NewRoomID == "" {
+		t.Fatalf("wanted a replacement room to be created")
+	}
+	for userID, want := range map[string]string{
+		"@admin:localhost": gomatrixserverlib.Join,
+		alice:              gomatrixserverlib.Join,
+		bob:                gomatrixserverlib.Join,
+		charlie:            "",
+	} {
+		if membership := mustGetMembership(t, r, res.NewRoomID, userID); membership != want {
+			t.Errorf("wanted %q to have membership %q in the replacement room, got %q", userID, want, membership)
+		}
+	}
+
+	// Purging the room deletes it along with the remote alias, and forgets
+	// the cached room version.
+	r.Cache.StoreRoomVersion(roomID, gomatrixserverlib.RoomVersionV4)
+	if err = r.PerformRoomShutdown(ctx, &api.PerformRoomShutdownRequest{
+		RoomID: roomID,
+		UserID: "@admin:localhost",
+		Purge:  true,
+	}, &api.PerformRoomShutdownResponse{}); err != nil {
+		t.Fatalf("PerformRoomShutdown failed: %s", err)
+	}
+	if roomNID, rerr := db.RoomNID(ctx, roomID); rerr != nil || roomNID != 0 {
+		t.Errorf("wanted the room to be deleted, got room NID %d (%v)", roomNID, rerr)
+	}
+	aliases, err := db.GetAliasesForRoomID(ctx, roomID)
+	if err != nil {
+		t.Fatalf("GetAliasesForRoomID failed: %s", err)
+	}
+	if len(aliases) != 0 {
+		t.Errorf("wanted all aliases to be deleted, got %v", aliases)
+	}
+	if _, ok := r.Cache.GetRoomVersion(roomID); ok {
+		t.Errorf("wanted the room version to be evicted from the cache")
+	}
+}
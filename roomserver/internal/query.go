@@ -170,6 +170,11 @@ func (r *RoomserverInternalAPI) QueryEventsByID(
 		return err
 	}
 
+	statuses, err := r.DB.EventStatuses(ctx, eventNIDs)
+	if err != nil {
+		return err
+	}
+
 	for _, event := range events {
 		roomVersion, verr := r.DB.GetRoomVersionForRoom(ctx, event.RoomID())
 		if verr != nil {
@@ -177,6 +182,14 @@ func (r *RoomserverInternalAPI) QueryEventsByID(
 		}
 
 		response.Events = append(response.Events, event.Headered(roomVersion))
+
+		status := statuses[eventNIDMap[event.EventID()]]
+		if status.Rejected {
+			response.RejectedEventIDs = append(response.RejectedEventIDs, event.EventID())
+		}
+		if status.SoftFailed {
+			response.SoftFailedEventIDs = append(response.SoftFailedEventIDs, event.EventID())
+		}
 	}
 
 	return nil
@@ -484,7 +497,7 @@ func (r *RoomserverInternalAPI) QueryBackfill(
 	// if we are requesting the backfill then we need to do a federation hit
 	// TODO: we could be more sensible and fetch as many events we already have then request the rest
 	//       which is what the syncapi does already.
-	if request.ServerName == r.ServerName {
+	if r.Cfg.IsLocalServerName(request.ServerName) {
 		return r.backfillViaFederation(ctx, request, response)
 	}
 	// someone else is requesting the backfill, try to service their request.
@@ -528,7 +541,7 @@ func (r *RoomserverInternalAPI) backfillViaFederation(ctx context.Context, req *
 	if err != nil {
 		return fmt.Errorf("backfillViaFederation: unknown room version for room %s : %w", req.RoomID, err)
 	}
-	requester := newBackfillRequester(r.DB, r.FedClient, r.ServerName, req.BackwardsExtremities)
+	requester := newBackfillRequester(r.DB, r.FedClient, r.fsAPI, &r.backfillStats, r.ServerName, req.BackwardsExtremities)
 	// Request 100 items regardless of what the query asks for.
 	// We don't want to go much higher than this.
 	// We can't honour exactly the limit as some sytests rely on requesting more for tests to pass
@@ -914,7 +927,7 @@ func persistEvents(ctx context.Context, db storage.Database, events []gomatrixse
 			i++
 		}
 		var stateAtEvent types.StateAtEvent
-		roomNID, stateAtEvent, err = db.StoreEvent(ctx, ev.Unwrap(), nil, authNids)
+		roomNID, stateAtEvent, err = db.StoreEvent(ctx, ev.Unwrap(), nil, authNids, false)
 		if err != nil {
 			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to persist event")
 			continue
@@ -964,3 +977,13 @@ func (r *RoomserverInternalAPI) QueryRoomVersionForRoom(
 	r.Cache.StoreRoomVersion(request.RoomID, response.RoomVersion)
 	return nil
 }
+
+// QueryRoomBlocked implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryRoomBlocked(
+	ctx context.Context,
+	request *api.QueryRoomBlockedRequest,
+	response *api.QueryRoomBlockedResponse,
+) (err error) {
+	response.Blocked, err = r.DB.IsRoomBlocked(ctx, request.RoomID)
+	return
+}
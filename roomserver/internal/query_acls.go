@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/acls"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// QueryServerBannedFromRoom implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *api.QueryServerBannedFromRoomRequest,
+	response *api.QueryServerBannedFromRoomResponse,
+) error {
+	acl, err := r.serverACLForRoom(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	for _, serverName := range request.ServerNames {
+		if acl.IsServerBanned(serverName) {
+			response.BannedServers = append(response.BannedServers, serverName)
+		}
+	}
+	return nil
+}
+
+// serverACLForRoom returns the server ACL in the current state of the room,
+// or nil if the room doesn't have one.
+func (r *RoomserverInternalAPI) serverACLForRoom(
+	ctx context.Context, roomID string,
+) (*acls.ServerACL, error) {
+	if acl, ok := r.Cache.GetServerACL(roomID); ok {
+		return acl, nil
+	}
+	acl, known, err := r.loadServerACL(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	// Don't remember anything about rooms that we don't know about yet, as
+	// we might join them later.
+	if known {
+		r.Cache.StoreServerACL(roomID, acl)
+	}
+	return acl, nil
+}
+
+// refreshServerACL replaces the cached server ACL for the room with the one in
+// the current state of the room. This is called when the current state of the
+// room changes the ACL.
+func (r *RoomserverInternalAPI) refreshServerACL(ctx context.Context, roomID string) {
+	acl, known, err := r.loadServerACL(ctx, roomID)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Error("Failed to refresh server ACL")
+		return
+	}
+	if known {
+		r.Cache.StoreServerACL(roomID, acl)
+	}
+}
+
+// loadServerACL parses the server ACL in the current state of the room. Also
+// returns whether we know about the room at all.
+func (r *RoomserverInternalAPI) loadServerACL(
+	ctx context.Context, roomID string,
+) (*acls.ServerACL, bool, error) {
+	roomNID, err := r.DB.RoomNID(ctx, roomID)
+	if err != nil {
+		return nil, false, fmt.Errorf("r.DB.RoomNID: %w", err)
+	}
+	if roomNID == 0 {
+		return nil, false, nil
+	}
+	_, currentStateSnapshotNID, _, err := r.DB.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		return nil, false, fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	if currentStateSnapshotNID == 0 {
+		return nil, false, nil
+	}
+	entries, err := state.NewStateResolution(r.DB).LoadStateAtSnapshotForStringTuples(
+		ctx, currentStateSnapshotNID,
+		[]gomatrixserverlib.StateKeyTuple{{EventType: acls.MRoomServerACL, StateKey: ""}},
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("LoadStateAtSnapshotForStringTuples: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, true, nil
+	}
+	events, err := r.DB.Events(ctx, []types.EventNID{entries[0].EventNID})
+	if err != nil {
+		return nil, false, fmt.Errorf("r.DB.Events: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, true, nil
+	}
+	acl, err := acls.NewServerACL(events[0].Content())
+	if err != nil {
+		// An ACL that we can't parse is treated the same as no ACL, as
+		// otherwise a broken ACL would cut the room off from federation.
+		logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to parse server ACL")
+		return nil, true, nil
+	}
+	return acl, true, nil
+}
+
+// stateChangesServerACL returns true if any of the state entries are for the
+// room's server ACL.
+func (r *RoomserverInternalAPI) stateChangesServerACL(
+	ctx context.Context, entryLists ...[]types.StateEntry,
+) (bool, error) {
+	eventTypeNIDs, err := r.DB.EventTypeNIDs(ctx, []string{acls.MRoomServerACL})
+	if err != nil {
+		return false, err
+	}
+	aclTypeNID, ok := eventTypeNIDs[acls.MRoomServerACL]
+	if !ok {
+		// We've never seen a server ACL in any room.
+		return false, nil
+	}
+	for _, entries := range entryLists {
+		for _, entry := range entries {
+			if entry.EventTypeNID == aclTypeNID && entry.EventStateKeyNID == types.EmptyStateKeyNID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
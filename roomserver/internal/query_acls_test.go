@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/acls"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// testCaches is an in-memory implementation of caching.RoomServerCaches.
+type testCaches struct {
+	roomVersions map[string]gomatrixserverlib.RoomVersion
+	serverACLs   map[string]*acls.ServerACL
+}
+
+func newTestCaches() *testCaches {
+	return &testCaches{
+		roomVersions: make(map[string]gomatrixserverlib.RoomVersion),
+		serverACLs:   make(map[string]*acls.ServerACL),
+	}
+}
+
+func (c *testCaches) GetRoomVersion(roomID string) (gomatrixserverlib.RoomVersion, bool) {
+	v, ok := c.roomVersions[roomID]
+	return v, ok
+}
+
+func (c *testCaches) StoreRoomVersion(roomID string, roomVersion gomatrixserverlib.RoomVersion) {
+	c.roomVersions[roomID] = roomVersion
+}
+
+func (c *testCaches) EvictRoomVersion(roomID string) {
+	delete(c.roomVersions, roomID)
+}
+
+func (c *testCaches) GetServerACL(roomID string) (*acls.ServerACL, bool) {
+	acl, ok := c.serverACLs[roomID]
+	return acl, ok
+}
+
+func (c *testCaches) StoreServerACL(roomID string, acl *acls.ServerACL) {
+	c.serverACLs[roomID] = acl
+}
+
+func (c *testCaches) EvictServerACL(roomID string) {
+	delete(c.serverACLs, roomID)
+}
+
+func TestQueryServerBannedFromRoom(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+	r := &RoomserverInternalAPI{DB: db, Cache: newTestCaches()}
+
+	queryBanned := func() []gomatrixserverlib.ServerName {
+		t.Helper()
+		res := api.QueryServerBannedFromRoomResponse{}
+		if err = r.QueryServerBannedFromRoom(ctx, &api.QueryServerBannedFromRoomRequest{
+			RoomID:      testRoomID,
+			ServerNames: []gomatrixserverlib.ServerName{"good.example.com", "evil.example.com", "1.2.3.4:8448"},
+		}, &res); err != nil {
+			t.Fatalf("QueryServerBannedFromRoom failed: %s", err)
+		}
+		return res.BannedServers
+	}
+
+	// Nobody is banned from a room that we don't know about.
+	if banned := queryBanned(); len(banned) != 0 {
+		t.Fatalf("wanted no banned servers for unknown room, got %v", banned)
+	}
+
+	alice := "@alice:localhost"
+	emptyKey := ""
+	create := mustBuildEvent(t, alice, "m.room.create", &emptyKey, map[string]interface{}{
+		"creator":      alice,
+		"room_version": "4",
+	}, nil)
+	createNID := mustStoreEvent(t, db, create, nil, false)
+	acl := mustBuildEvent(t, alice, acls.MRoomServerACL, &emptyKey, map[string]interface{}{
+		"allow":             []string{"*"},
+		"deny":              []string{"evil.example.com"},
+		"allow_ip_literals": false,
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	aclNID := mustStoreEvent(t, db, acl, []types.EventNID{createNID}, false)
+
+	roomNID, err := db.RoomNID(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("RoomNID failed: %s", err)
+	}
+	eventTypeNIDs, err := db.EventTypeNIDs(ctx, []string{acls.MRoomServerACL})
+	if err != nil {
+		t.Fatalf("EventTypeNIDs failed: %s", err)
+	}
+	added := []types.StateEntry{
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomCreateNID, EventStateKeyNID: types.EmptyStateKeyNID}, EventNID: createNID},
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: eventTypeNIDs[acls.MRoomServerACL], EventStateKeyNID: types.EmptyStateKeyNID}, EventNID: aclNID},
+	}
+	snapshotNID, err := db.AddState(ctx, roomNID, nil, added)
+	if err != nil {
+		t.Fatalf("AddState failed: %s", err)
+	}
+	updater, err := db.GetLatestEventsForUpdate(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("GetLatestEventsForUpdate failed: %s", err)
+	}
+	latest := []types.StateAtEventAndReference{{
+		StateAtEvent:   types.StateAtEvent{BeforeStateSnapshotNID: snapshotNID, StateEntry: added[1]},
+		EventReference: acl.EventReference(),
+	}}
+	if err = updater.SetLatestEvents(roomNID, latest, aclNID, snapshotNID); err != nil {
+		t.Fatalf("SetLatestEvents failed: %s", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	// The room wasn't cached while we didn't know about it, so the ACL is
+	// picked up straight away.
+	banned := queryBanned()
+	if len(banned) != 2 || banned[0] != "evil.example.com" || banned[1] != "1.2.3.4:8448" {
+		t.Fatalf("wanted evil.example.com and the IP literal to be banned, got %v", banned)
+	}
+
+	changed, err := r.stateChangesServerACL(ctx, added)
+	if err != nil {
+		t.Fatalf("stateChangesServerACL failed: %s", err)
+	}
+	if !changed {
+		t.Fatalf("wanted the state change to be detected as an ACL change")
+	}
+	changed, err = r.stateChangesServerACL(ctx, added[:1])
+	if err != nil {
+		t.Fatalf("stateChangesServerACL failed: %s", err)
+	}
+	if changed {
+		t.Fatalf("wanted the create event not to be detected as an ACL change")
+	}
+}
@@ -2,7 +2,11 @@ package internal
 
 import (
 	"context"
+	"sort"
+	"sync"
+	"time"
 
+	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -11,10 +15,69 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// backfillServerStats keeps track of how each server responded the last time
+// that we asked it to backfill, so that servers which are known to work are
+// asked first and servers which are known to be broken are asked last.
+type backfillServerStats struct {
+	sync.Mutex
+	lastSuccess map[gomatrixserverlib.ServerName]time.Time
+	lastFailure map[gomatrixserverlib.ServerName]time.Time
+}
+
+func (s *backfillServerStats) success(server gomatrixserverlib.ServerName) {
+	s.Lock()
+	defer s.Unlock()
+	if s.lastSuccess == nil {
+		s.lastSuccess = make(map[gomatrixserverlib.ServerName]time.Time)
+	}
+	s.lastSuccess[server] = time.Now()
+	delete(s.lastFailure, server)
+}
+
+func (s *backfillServerStats) failure(server gomatrixserverlib.ServerName) {
+	s.Lock()
+	defer s.Unlock()
+	if s.lastFailure == nil {
+		s.lastFailure = make(map[gomatrixserverlib.ServerName]time.Time)
+	}
+	s.lastFailure[server] = time.Now()
+	delete(s.lastSuccess, server)
+}
+
+// sort orders the servers so that servers which last succeeded come first,
+// most recent success first, followed by servers that we haven't asked yet,
+// followed by servers which last failed, least recent failure first.
+func (s *backfillServerStats) sort(servers []gomatrixserverlib.ServerName) {
+	s.Lock()
+	defer s.Unlock()
+	rank := func(server gomatrixserverlib.ServerName) (int, time.Time) {
+		if t, ok := s.lastSuccess[server]; ok {
+			return 0, t
+		}
+		if t, ok := s.lastFailure[server]; ok {
+			return 2, t
+		}
+		return 1, time.Time{}
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		ri, ti := rank(servers[i])
+		rj, tj := rank(servers[j])
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == 0 {
+			return ti.After(tj)
+		}
+		return ti.Before(tj)
+	})
+}
+
 // backfillRequester implements gomatrixserverlib.BackfillRequester
 type backfillRequester struct {
 	db         storage.Database
 	fedClient  *gomatrixserverlib.FederationClient
+	fsAPI      fsAPI.FederationSenderInternalAPI
+	stats      *backfillServerStats
 	thisServer gomatrixserverlib.ServerName
 	bwExtrems  map[string][]string
 
@@ -24,10 +87,15 @@ type backfillRequester struct {
 	eventIDMap              map[string]gomatrixserverlib.Event
 }
 
-func newBackfillRequester(db storage.Database, fedClient *gomatrixserverlib.FederationClient, thisServer gomatrixserverlib.ServerName, bwExtrems map[string][]string) *backfillRequester {
+func newBackfillRequester(
+	db storage.Database, fedClient *gomatrixserverlib.FederationClient, fsAPI fsAPI.FederationSenderInternalAPI,
+	stats *backfillServerStats, thisServer gomatrixserverlib.ServerName, bwExtrems map[string][]string,
+) *backfillRequester {
 	return &backfillRequester{
 		db:                      db,
 		fedClient:               fedClient,
+		fsAPI:                   fsAPI,
+		stats:                   stats,
 		thisServer:              thisServer,
 		eventIDToBeforeStateIDs: make(map[string][]string),
 		eventIDMap:              make(map[string]gomatrixserverlib.Event),
@@ -218,6 +286,21 @@ FindSuccessor:
 	for _, event := range memberEvents {
 		serverSet[event.Origin()] = true
 	}
+
+	// Servers which are in the room now may also have the events, and are
+	// more likely to be online than servers which were in the room then.
+	if b.fsAPI != nil {
+		var joinedRes fsAPI.QueryJoinedHostServerNamesInRoomResponse
+		if err = b.fsAPI.QueryJoinedHostServerNamesInRoom(ctx, &fsAPI.QueryJoinedHostServerNamesInRoomRequest{
+			RoomID: roomID,
+		}, &joinedRes); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Warn("ServersAtEvent: failed to get joined hosts in room")
+		}
+		for _, server := range joinedRes.ServerNames {
+			serverSet[server] = true
+		}
+	}
+
 	var servers []gomatrixserverlib.ServerName
 	for server := range serverSet {
 		if server == b.thisServer {
@@ -225,6 +308,7 @@ FindSuccessor:
 		}
 		servers = append(servers, server)
 	}
+	b.stats.sort(servers)
 	b.servers = servers
 	return servers
 }
@@ -235,6 +319,11 @@ func (b *backfillRequester) Backfill(ctx context.Context, server gomatrixserverl
 	fromEventIDs []string, limit int) (*gomatrixserverlib.Transaction, error) {
 
 	tx, err := b.fedClient.Backfill(ctx, server, roomID, limit, fromEventIDs)
+	if err != nil {
+		b.stats.failure(server)
+	} else {
+		b.stats.success(server)
+	}
 	return &tx, err
 }
 
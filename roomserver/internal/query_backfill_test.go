@@ -0,0 +1,55 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestBackfillServerStatsSort(t *testing.T) {
+	var stats backfillServerStats
+	stats.failure("broken.old")
+	stats.success("working.old")
+	stats.failure("broken.new")
+	stats.success("working.new")
+	// Make sure that the timestamps differ.
+	now := time.Now()
+	stats.lastFailure["broken.old"] = now.Add(-2 * time.Minute)
+	stats.lastFailure["broken.new"] = now.Add(-time.Minute)
+	stats.lastSuccess["working.old"] = now.Add(-2 * time.Minute)
+	stats.lastSuccess["working.new"] = now.Add(-time.Minute)
+
+	servers := []gomatrixserverlib.ServerName{
+		"broken.new", "unknown", "working.old", "broken.old", "working.new",
+	}
+	stats.sort(servers)
+	want := []gomatrixserverlib.ServerName{
+		"working.new", "working.old", "unknown", "broken.old", "broken.new",
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got %v want %v", servers, want)
+	}
+
+	// A server which starts working again should move to the front.
+	stats.success("broken.new")
+	stats.sort(servers)
+	if servers[0] != "broken.new" {
+		t.Fatalf("got %v want broken.new first", servers)
+	}
+}
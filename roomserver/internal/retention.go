@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// The number of events that are looked at in one go when looking for the
+// newest event that has outlived the retention policy of a room.
+const retentionPageSize = 100
+
+// retentionPolicy is the content of an m.room.retention event.
+// The lifetimes are in milliseconds.
+type retentionPolicy struct {
+	MinLifetime *int64 `json:"min_lifetime,omitempty"`
+	MaxLifetime *int64 `json:"max_lifetime,omitempty"`
+}
+
+// StartRetentionPurger starts a goroutine which periodically purges the
+// events which have outlived the retention policy of their room.
+func (r *RoomserverInternalAPI) StartRetentionPurger() {
+	go func() {
+		for {
+			if err := r.purgeExpiredHistory(context.Background(), time.Now()); err != nil {
+				logrus.WithError(err).Error("Failed to purge expired room history")
+			}
+			time.Sleep(r.Cfg.Retention.PurgeInterval)
+		}
+	}()
+}
+
+// purgeExpiredHistory purges the events in every room which are older than the
+// maximum lifetime for the room at the given time.
+func (r *RoomserverInternalAPI) purgeExpiredHistory(ctx context.Context, now time.Time) error {
+	roomIDs, err := r.DB.RoomIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomIDs: %w", err)
+	}
+	for _, roomID := range roomIDs {
+		if err = r.purgeExpiredRoomHistory(ctx, roomID, now); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to purge expired room history")
+		}
+	}
+	return nil
+}
+
+func (r *RoomserverInternalAPI) purgeExpiredRoomHistory(ctx context.Context, roomID string, now time.Time) error {
+	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, roomID)
+	if err != nil || roomNID == 0 {
+		return err
+	}
+	_, currentStateSnapshotNID, _, err := r.DB.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	policy, err := r.roomRetentionPolicy(ctx, currentStateSnapshotNID)
+	if err != nil {
+		return err
+	}
+	lifetime := effectiveMaxLifetime(
+		policy, r.Cfg.Retention.MinLifetime, r.Cfg.Retention.MaxLifetime,
+	)
+	if lifetime == 0 {
+		return nil
+	}
+
+	beforeDepth, err := r.expiredHistoryDepth(ctx, roomNID, now.Add(-lifetime))
+	if err != nil || beforeDepth == 0 {
+		return err
+	}
+	_, err = r.purgeHistoryBeforeDepth(ctx, roomID, roomNID, beforeDepth)
+	return err
+}
+
+// roomRetentionPolicy returns the m.room.retention policy in the state
+// snapshot, or nil if there isn't one.
+func (r *RoomserverInternalAPI) roomRetentionPolicy(
+	ctx context.Context, stateNID types.StateSnapshotNID,
+) (*retentionPolicy, error) {
+	entries, err := state.NewStateResolution(r.DB).LoadStateAtSnapshotForStringTuples(
+		ctx, stateNID, []gomatrixserverlib.StateKeyTuple{{EventType: "m.room.retention", StateKey: ""}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("LoadStateAtSnapshotForStringTuples: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	events, err := r.DB.Events(ctx, []types.EventNID{entries[0].EventNID})
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.Events: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	var policy retentionPolicy
+	if err = json.Unmarshal(events[0].Content(), &policy); err != nil {
+		// An invalid policy is treated the same as no policy.
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+// effectiveMaxLifetime works out how long events in a room should be kept for,
+// given the room's retention policy and the server's limits. Returns 0 if the
+// events should be kept forever.
+func effectiveMaxLifetime(policy *retentionPolicy, minLifetime, maxLifetime time.Duration) time.Duration {
+	if policy == nil || policy.MaxLifetime == nil {
+		return maxLifetime
+	}
+	lifetime := time.Duration(*policy.MaxLifetime) * time.Millisecond
+	if policy.MinLifetime != nil {
+		// The room wants events kept for at least this long.
+		if roomMin := time.Duration(*policy.MinLifetime) * time.Millisecond; lifetime < roomMin {
+			lifetime = roomMin
+		}
+	}
+	if lifetime < minLifetime {
+		lifetime = minLifetime
+	}
+	if maxLifetime > 0 && lifetime > maxLifetime {
+		lifetime = maxLifetime
+	}
+	return lifetime
+}
+
+// expiredHistoryDepth works out the depth before which the events in the room
+// were all sent before the cutoff, by walking through the room's history in
+// topological order until it finds an event that was sent after the cutoff.
+// Returns 0 if no events need to be purged.
+func (r *RoomserverInternalAPI) expiredHistoryDepth(
+	ctx context.Context, roomNID types.RoomNID, cutoff time.Time,
+) (int64, error) {
+	var afterDepth, beforeDepth int64
+	var afterEventNID types.EventNID
+	for {
+		eventNIDs, err := r.DB.MessageEventNIDsByDepth(ctx, roomNID, afterDepth, afterEventNID, retentionPageSize)
+		if err != nil {
+			return 0, fmt.Errorf("r.DB.MessageEventNIDsByDepth: %w", err)
+		}
+		if len(eventNIDs) == 0 {
+			return beforeDepth, nil
+		}
+		events, err := r.DB.Events(ctx, eventNIDs)
+		if err != nil {
+			return 0, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		eventsByNID := make(map[types.EventNID]types.Event, len(events))
+		for _, event := range events {
+			eventsByNID[event.EventNID] = event
+		}
+		progressed := false
+		for _, eventNID := range eventNIDs {
+			event, ok := eventsByNID[eventNID]
+			if !ok {
+				continue
+			}
+			progressed = true
+			if !event.OriginServerTS().Time().Before(cutoff) {
+				if beforeDepth == 0 {
+					return 0, nil
+				}
+				return event.Depth(), nil
+			}
+			// Everything up to and including this event has expired.
+			beforeDepth = event.Depth() + 1
+			afterDepth, afterEventNID = event.Depth(), eventNID
+		}
+		if !progressed || len(eventNIDs) < retentionPageSize {
+			return beforeDepth, nil
+		}
+	}
+}
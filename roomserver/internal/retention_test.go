@@ -0,0 +1,219 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestEffectiveMaxLifetime(t *testing.T) {
+	ms := func(d time.Duration) *int64 {
+		v := int64(d / time.Millisecond)
+		return &v
+	}
+	day := 24 * time.Hour
+	for _, tc := range []struct {
+		name       string
+		policy     *retentionPolicy
+		min, max   time.Duration
+		wantResult time.Duration
+	}{
+		{"no policy, no limits", nil, 0, 0, 0},
+		{"no policy, server max", nil, 0, 30 * day, 30 * day},
+		{"room max", &retentionPolicy{MaxLifetime: ms(7 * day)}, 0, 0, 7 * day},
+		{"room max below room min", &retentionPolicy{MinLifetime: ms(3 * day), MaxLifetime: ms(day)}, 0, 0, 3 * day},
+		{"room max below server min", &retentionPolicy{MaxLifetime: ms(day)}, 2 * day, 0, 2 * day},
+		{"room max above server max", &retentionPolicy{MaxLifetime: ms(60 * day)}, 0, 30 * day, 30 * day},
+		{"room min only", &retentionPolicy{MinLifetime: ms(day)}, 0, 30 * day, 30 * day},
+	} {
+		if got := effectiveMaxLifetime(tc.policy, tc.min, tc.max); got != tc.wantResult {
+			t.Errorf("%s: wanted %s, got %s", tc.name, tc.wantResult, got)
+		}
+	}
+}
+
+func TestPurgeHistory(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+	r := &RoomserverInternalAPI{DB: db}
+
+	alice := "@alice:localhost"
+	emptyKey := ""
+	create := mustBuildEvent(t, alice, "m.room.create", &emptyKey, map[string]interface{}{
+		"creator":      alice,
+		"room_version": "4",
+	}, nil)
+	createNID := mustStoreEvent(t, db, create, nil, false)
+	join := mustBuildEvent(t, alice, "m.room.member", &alice, map[string]interface{}{
+		"membership": "join",
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	joinNID := mustStoreEvent(t, db, join, []types.EventNID{createNID}, false)
+	authEvents := []gomatrixserverlib.Event{create.Unwrap(), join.Unwrap()}
+	authEventNIDs := []types.EventNID{createNID, joinNID}
+
+	var messages []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 4; i++ {
+		message := mustBuildEvent(t, alice, "m.room.message", nil, map[string]interface{}{
+			"body": "hello",
+		}, authEvents)
+		mustStoreEvent(t, db, message, authEventNIDs, false)
+		messages = append(messages, message)
+	}
+	roomNID, err := db.RoomNID(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("RoomNID failed: %s", err)
+	}
+
+	// Everything was sent before the cutoff, so all of the history up to and
+	// including the newest message has expired.
+	beforeDepth, err := r.expiredHistoryDepth(ctx, roomNID, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("expiredHistoryDepth failed: %s", err)
+	}
+	if want := messages[3].Depth() + 1; beforeDepth != want {
+		t.Fatalf("wanted expired depth %d, got %d", want, beforeDepth)
+	}
+	// Nothing was sent before the cutoff.
+	beforeDepth, err = r.expiredHistoryDepth(ctx, roomNID, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("expiredHistoryDepth failed: %s", err)
+	}
+	if beforeDepth != 0 {
+		t.Fatalf("wanted expired depth 0, got %d", beforeDepth)
+	}
+
+	purged, err := db.PurgeHistory(ctx, roomNID, messages[2].Depth())
+	if err != nil {
+		t.Fatalf("PurgeHistory failed: %s", err)
+	}
+	if len(purged) != 2 || purged[0] != messages[0].EventID() || purged[1] != messages[1].EventID() {
+		t.Fatalf("wanted the first two messages to be purged, got %v", purged)
+	}
+
+	// The state events and the newer messages must still be there.
+	remaining, err := db.EventsFromIDs(ctx, []string{
+		create.EventID(), join.EventID(), messages[2].EventID(), messages[3].EventID(),
+	})
+	if err != nil {
+		t.Fatalf("EventsFromIDs failed: %s", err)
+	}
+	if len(remaining) != 4 {
+		t.Fatalf("wanted 4 remaining events, got %d", len(remaining))
+	}
+	gone, err := db.EventsFromIDs(ctx, []string{messages[0].EventID(), messages[1].EventID()})
+	if err != nil {
+		t.Fatalf("EventsFromIDs failed: %s", err)
+	}
+	if len(gone) != 0 {
+		t.Fatalf("wanted purged events to be gone, got %d", len(gone))
+	}
+
+	// The purged events must still be known, as the later messages refer to
+	// them, but they mustn't be purged again.
+	eventNIDs, err := db.EventNIDs(ctx, []string{messages[0].EventID(), messages[1].EventID()})
+	if err != nil {
+		t.Fatalf("EventNIDs failed: %s", err)
+	}
+	if len(eventNIDs) != 2 {
+		t.Fatalf("wanted the purged events to be kept in the events table, got %d", len(eventNIDs))
+	}
+	purged, err = db.PurgeHistory(ctx, roomNID, messages[2].Depth())
+	if err != nil {
+		t.Fatalf("PurgeHistory failed: %s", err)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("wanted nothing to be purged again, got %v", purged)
+	}
+}
+
+func TestExpiredHistoryDepthAfterLargePurge(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+	r := &RoomserverInternalAPI{DB: db}
+
+	alice := "@alice:localhost"
+	emptyKey := ""
+	create := mustBuildEvent(t, alice, "m.room.create", &emptyKey, map[string]interface{}{
+		"creator":      alice,
+		"room_version": "4",
+	}, nil)
+	createNID := mustStoreEvent(t, db, create, nil, false)
+	join := mustBuildEvent(t, alice, "m.room.member", &alice, map[string]interface{}{
+		"membership": "join",
+	}, []gomatrixserverlib.Event{create.Unwrap()})
+	joinNID := mustStoreEvent(t, db, join, []types.EventNID{createNID}, false)
+	authEvents := []gomatrixserverlib.Event{create.Unwrap(), join.Unwrap()}
+	authEventNIDs := []types.EventNID{createNID, joinNID}
+
+	// There are more expired messages than fit in a page.
+	var messages []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < retentionPageSize+10; i++ {
+		message := mustBuildEvent(t, alice, "m.room.message", nil, map[string]interface{}{
+			"body": "hello",
+		}, authEvents)
+		mustStoreEvent(t, db, message, authEventNIDs, false)
+		messages = append(messages, message)
+	}
+	roomNID, err := db.RoomNID(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("RoomNID failed: %s", err)
+	}
+
+	// The first pass only gets as far as the first page of messages, e.g.
+	// because the rest hadn't expired yet.
+	purged, err := db.PurgeHistory(ctx, roomNID, messages[retentionPageSize].Depth())
+	if err != nil {
+		t.Fatalf("PurgeHistory failed: %s", err)
+	}
+	if len(purged) != retentionPageSize {
+		t.Fatalf("wanted %d messages to be purged, got %d", retentionPageSize, len(purged))
+	}
+
+	// The second pass skips over the purged messages to find the rest.
+	cutoff := time.Now().Add(time.Hour)
+	beforeDepth, err := r.expiredHistoryDepth(ctx, roomNID, cutoff)
+	if err != nil {
+		t.Fatalf("expiredHistoryDepth failed: %s", err)
+	}
+	if want := messages[len(messages)-1].Depth() + 1; beforeDepth != want {
+		t.Fatalf("wanted expired depth %d, got %d", want, beforeDepth)
+	}
+	if purged, err = db.PurgeHistory(ctx, roomNID, beforeDepth); err != nil {
+		t.Fatalf("PurgeHistory failed: %s", err)
+	}
+	if len(purged) != 10 {
+		t.Fatalf("wanted the remaining 10 messages to be purged, got %d", len(purged))
+	}
+
+	// Once everything is purged there is nothing left to do.
+	if beforeDepth, err = r.expiredHistoryDepth(ctx, roomNID, cutoff); err != nil {
+		t.Fatalf("expiredHistoryDepth failed: %s", err)
+	}
+	if beforeDepth != 0 {
+		t.Fatalf("wanted expired depth 0, got %d", beforeDepth)
+	}
+}
@@ -24,8 +24,10 @@ const (
 	RoomserverInputRoomEventsPath = "/roomserver/inputRoomEvents"
 
 	// Perform operations
-	RoomserverPerformJoinPath  = "/roomserver/performJoin"
-	RoomserverPerformLeavePath = "/roomserver/performLeave"
+	RoomserverPerformJoinPath         = "/roomserver/performJoin"
+	RoomserverPerformLeavePath        = "/roomserver/performLeave"
+	RoomserverPerformPurgeHistoryPath = "/roomserver/performPurgeHistory"
+	RoomserverPerformRoomShutdownPath = "/roomserver/performRoomShutdown"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -40,6 +42,8 @@ const (
 	RoomserverQueryBackfillPath                = "/roomserver/queryBackfill"
 	RoomserverQueryRoomVersionCapabilitiesPath = "/roomserver/queryRoomVersionCapabilities"
 	RoomserverQueryRoomVersionForRoomPath      = "/roomserver/queryRoomVersionForRoom"
+	RoomserverQueryRoomBlockedPath             = "/roomserver/queryRoomBlocked"
+	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -171,6 +175,30 @@ func (h *httpRoomserverInternalAPI) PerformLeave(
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpRoomserverInternalAPI) PerformPurgeHistory(
+	ctx context.Context,
+	request *api.PerformPurgeHistoryRequest,
+	response *api.PerformPurgeHistoryResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPurgeHistory")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformPurgeHistoryPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) PerformRoomShutdown(
+	ctx context.Context,
+	request *api.PerformRoomShutdownRequest,
+	response *api.PerformRoomShutdownResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformRoomShutdown")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformRoomShutdownPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryLatestEventsAndState implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryLatestEventsAndState(
 	ctx context.Context,
@@ -335,3 +363,29 @@ func (h *httpRoomserverInternalAPI) QueryRoomVersionForRoom(
 	}
 	return err
 }
+
+// QueryRoomBlocked implements RoomServerQueryAPI
+func (h *httpRoomserverInternalAPI) QueryRoomBlocked(
+	ctx context.Context,
+	request *api.QueryRoomBlockedRequest,
+	response *api.QueryRoomBlockedResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomBlocked")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomBlockedPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryServerBannedFromRoom implements RoomServerQueryAPI
+func (h *httpRoomserverInternalAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *api.QueryServerBannedFromRoomRequest,
+	response *api.QueryServerBannedFromRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerBannedFromRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryServerBannedFromRoomPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
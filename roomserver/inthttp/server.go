@@ -52,6 +52,32 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverPerformPurgeHistoryPath,
+		internal.MakeInternalAPI("performPurgeHistory", func(req *http.Request) util.JSONResponse {
+			var request api.PerformPurgeHistoryRequest
+			var response api.PerformPurgeHistoryResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformPurgeHistory(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformRoomShutdownPath,
+		internal.MakeInternalAPI("performRoomShutdown", func(req *http.Request) util.JSONResponse {
+			var request api.PerformRoomShutdownRequest
+			var response api.PerformRoomShutdownResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformRoomShutdown(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverQueryLatestEventsAndStatePath,
 		internal.MakeInternalAPI("queryLatestEventsAndState", func(req *http.Request) util.JSONResponse {
@@ -220,6 +246,34 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(
+		RoomserverQueryRoomBlockedPath,
+		internal.MakeInternalAPI("QueryRoomBlocked", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomBlockedRequest
+			var response api.QueryRoomBlockedResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRoomBlocked(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		RoomserverQueryServerBannedFromRoomPath,
+		internal.MakeInternalAPI("QueryServerBannedFromRoom", func(req *http.Request) util.JSONResponse {
+			var request api.QueryServerBannedFromRoomRequest
+			var response api.QueryServerBannedFromRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryServerBannedFromRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverSetRoomAliasPath,
 		internal.MakeInternalAPI("setRoomAlias", func(req *http.Request) util.JSONResponse {
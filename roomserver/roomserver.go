@@ -38,6 +38,7 @@ func SetupRoomServerComponent(
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
+	roomserverDB.SetCompressEventJSON(base.Cfg.Database.CompressRoomServerEvents)
 
 	internalAPI := &internal.RoomserverInternalAPI{
 		DB:                   roomserverDB,
@@ -52,5 +53,9 @@ func SetupRoomServerComponent(
 
 	inthttp.AddRoutes(internalAPI, base.InternalAPIMux)
 
+	if base.Cfg.Retention.Enabled {
+		internalAPI.StartRetentionPurger()
+	}
+
 	return internalAPI
 }
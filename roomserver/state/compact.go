@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// CompactionStats describes the work done by CompactStateSnapshots.
+type CompactionStats struct {
+	// The number of rooms which were looked at.
+	Rooms int
+	// The number of state snapshots which were looked at.
+	Snapshots int
+	// The number of state snapshots which were rewritten as deltas.
+	RewrittenSnapshots int
+	// The number of state blocks which were deleted because no state
+	// snapshot refers to them any more.
+	DeletedBlocks int
+}
+
+// CompactStateSnapshots rewrites the state snapshots of every room so that
+// each one is encoded as a delta against the snapshot before it in the same
+// room, wherever that takes fewer state entries than the existing encoding.
+// State blocks which are no longer needed by any snapshot are deleted.
+// This must only be run while the roomserver is stopped, as it assumes that
+// no new snapshots are being created.
+func (v StateResolution) CompactStateSnapshots(ctx context.Context) (stats CompactionStats, err error) {
+	roomNIDs, err := v.db.StateSnapshotRoomNIDs(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("v.db.StateSnapshotRoomNIDs: %w", err)
+	}
+
+	// Blocks can be shared between snapshots, so only delete the blocks that
+	// we've replaced once we know that nothing refers to them.
+	replaced := make(map[types.StateBlockNID]bool)
+	referenced := make(map[types.StateBlockNID]bool)
+	for _, roomNID := range roomNIDs {
+		stats.Rooms++
+		if err = v.compactRoomStateSnapshots(ctx, roomNID, replaced, referenced, &stats); err != nil {
+			return stats, fmt.Errorf("compacting room NID %d: %w", roomNID, err)
+		}
+	}
+
+	var unused []types.StateBlockNID
+	for stateBlockNID := range replaced {
+		if !referenced[stateBlockNID] {
+			unused = append(unused, stateBlockNID)
+		}
+	}
+	if len(unused) > 0 {
+		if err = v.db.DeleteStateBlocks(ctx, unused); err != nil {
+			return stats, fmt.Errorf("v.db.DeleteStateBlocks: %w", err)
+		}
+	}
+	stats.DeletedBlocks = len(unused)
+	return stats, nil
+}
+
+func (v StateResolution) compactRoomStateSnapshots(
+	ctx context.Context, roomNID types.RoomNID,
+	replaced, referenced map[types.StateBlockNID]bool,
+	stats *CompactionStats,
+) error {
+	snapshots, err := v.db.RoomStateBlockNIDs(ctx, roomNID)
+	if err != nil {
+		return err
+	}
+
+	var prevBlockNIDs []types.StateBlockNID
+	var prevState []types.StateEntry
+	for _, snapshot := range snapshots {
+		stats.Snapshots++
+		if len(snapshot.StateBlockNIDs) == 0 {
+			// The state is empty so there's nothing to compact.
+			prevBlockNIDs, prevState = nil, nil
+			continue
+		}
+		stateEntryLists, err := v.db.StateEntries(ctx, uniqueStateBlockNIDs(
+			append([]types.StateBlockNID{}, snapshot.StateBlockNIDs...),
+		))
+		if err != nil {
+			return err
+		}
+		stateEntriesMap := stateEntryListMap(stateEntryLists)
+		state := combineStateBlocks(snapshot.StateBlockNIDs, stateEntriesMap)
+
+		// Work out how many entries this snapshot costs us on top of the
+		// snapshot before it.
+		inPrev := make(map[types.StateBlockNID]bool, len(prevBlockNIDs))
+		for _, stateBlockNID := range prevBlockNIDs {
+			inPrev[stateBlockNID] = true
+		}
+		ownEntries := 0
+		for _, stateBlockNID := range snapshot.StateBlockNIDs {
+			if !inPrev[stateBlockNID] {
+				entries, _ := stateEntriesMap.lookup(stateBlockNID)
+				ownEntries += len(entries)
+			}
+		}
+
+		stateBlockNIDs := snapshot.StateBlockNIDs
+		if prevState != nil && len(prevBlockNIDs) < maxStateBlockNIDs {
+			if delta, ok := stateDeltaAgainst(prevState, state); ok && len(delta) < ownEntries {
+				stateBlockNIDs, err = v.db.RewriteState(ctx, snapshot.StateSnapshotNID, prevBlockNIDs, delta)
+				if err != nil {
+					return err
+				}
+				for _, stateBlockNID := range snapshot.StateBlockNIDs {
+					replaced[stateBlockNID] = true
+				}
+				stats.RewrittenSnapshots++
+			}
+		}
+		for _, stateBlockNID := range stateBlockNIDs {
+			referenced[stateBlockNID] = true
+		}
+		prevBlockNIDs, prevState = stateBlockNIDs, state
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+func TestCompactStateSnapshots(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+
+	// Store the full state for every snapshot, changing one entry each time.
+	var states [][]types.StateEntry
+	var stateNIDs []types.StateSnapshotNID
+	state := []types.StateEntry{
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 1},
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 2, EventStateKeyNID: 1}, EventNID: 2},
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 3, EventStateKeyNID: 1}, EventNID: 3},
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 4, EventStateKeyNID: 1}, EventNID: 4},
+	}
+	for i := 0; i < 4; i++ {
+		state = append([]types.StateEntry{}, state...)
+		state[i].EventNID += 10
+		stateNID, err := db.AddState(ctx, 1, nil, state)
+		if err != nil {
+			t.Fatalf("AddState failed: %s", err)
+		}
+		states = append(states, state)
+		stateNIDs = append(stateNIDs, stateNID)
+	}
+
+	v := NewStateResolution(db)
+	stats, err := v.CompactStateSnapshots(ctx)
+	if err != nil {
+		t.Fatalf("CompactStateSnapshots failed: %s", err)
+	}
+	want := CompactionStats{Rooms: 1, Snapshots: 4, RewrittenSnapshots: 3, DeletedBlocks: 3}
+	if stats != want {
+		t.Errorf("Wanted stats %+v, got %+v", want, stats)
+	}
+
+	// The snapshots should still represent the same state.
+	for i, stateNID := range stateNIDs {
+		got, err := v.LoadStateAtSnapshot(ctx, stateNID)
+		if err != nil {
+			t.Fatalf("LoadStateAtSnapshot failed: %s", err)
+		}
+		if len(got) != len(states[i]) {
+			t.Fatalf("Snapshot %d: wanted %v, got %v", i, states[i], got)
+		}
+		for j := range got {
+			if got[j] != states[i][j] {
+				t.Fatalf("Snapshot %d: wanted %v, got %v", i, states[i], got)
+			}
+		}
+	}
+
+	// Running it again shouldn't find anything else to do.
+	stats, err = v.CompactStateSnapshots(ctx)
+	if err != nil {
+		t.Fatalf("CompactStateSnapshots failed: %s", err)
+	}
+	want = CompactionStats{Rooms: 1, Snapshots: 4}
+	if stats != want {
+		t.Errorf("Wanted stats %+v, got %+v", want, stats)
+	}
+}
@@ -57,12 +57,18 @@ func (v StateResolution) LoadStateAtSnapshot(
 	if err != nil {
 		return nil, err
 	}
-	stateEntriesMap := stateEntryListMap(stateEntryLists)
+	return combineStateBlocks(stateBlockNIDList.StateBlockNIDs, stateEntryListMap(stateEntryLists)), nil
+}
 
-	// Combine all the state entries for this snapshot.
-	// The order of state block NIDs in the list tells us the order to combine them in.
+// combineStateBlocks combines the state entries in the given blocks into the
+// full state of a snapshot. The order of state block NIDs in the list tells us
+// the order to combine them in.
+// Returns a list of state entries sorted by state key.
+func combineStateBlocks(
+	stateBlockNIDs []types.StateBlockNID, stateEntriesMap stateEntryListMap,
+) []types.StateEntry {
 	var fullState []types.StateEntry
-	for _, stateBlockNID := range stateBlockNIDList.StateBlockNIDs {
+	for _, stateBlockNID := range stateBlockNIDs {
 		entries, ok := stateEntriesMap.lookup(stateBlockNID)
 		if !ok {
 			// This should only get hit if the database is corrupt.
@@ -76,8 +82,7 @@ func (v StateResolution) LoadStateAtSnapshot(
 	// remains later in the list than the older entries for the same state key.
 	sort.Stable(stateEntryByStateKeySorter(fullState))
 	// Unique returns the last entry and hence the most recent entry for each state key.
-	fullState = fullState[:util.Unique(stateEntryByStateKeySorter(fullState))]
-	return fullState, nil
+	return fullState[:util.Unique(stateEntryByStateKeySorter(fullState))]
 }
 
 // LoadStateAtEvent loads the full state of a room before a particular event.
@@ -392,29 +397,69 @@ func (v StateResolution) loadStateAfterEventsForNumericTuples(
 	}
 
 	// Slow path for more that one event.
-	// Load the entire state so that we can do conflict resolution if we need to.
-	// TODO: The are some optimistations we could do here:
-	//    1) We only need to do conflict resolution if there is a conflict in the
-	//       requested tuples so we might try loading just those tuples and then
-	//       checking for conflicts.
-	//    2) When there is a conflict we still only need to load the state
-	//       needed to do conflict resolution which would save us having to load
-	//       the full state.
-
-	// TODO: Add metrics for this as it could take a long time for big rooms
-	// with large conflicts.
-	fullState, _, _, err := v.calculateStateAfterManyEvents(ctx, roomVersion, prevStates)
+	// We only need to do conflict resolution if there is a conflict in the
+	// requested tuples, so start by loading just those tuples and checking
+	// for conflicts.
+	startTime := time.Now()
+	combined, err := v.loadCombinedStateAfterEventsForNumericTuples(ctx, prevStates, stateKeyTuples)
+	if err != nil {
+		observeStateResolution(roomVersion, "_load_partial_state", startTime, 0)
+		return nil, err
+	}
+	if len(findDuplicateStateKeys(combined)) == 0 {
+		observeStateResolution(roomVersion, "partial_state_no_conflicts", startTime, 0)
+		return combined, nil
+	}
+
+	// There is a conflict, but we still only need the state needed to resolve
+	// it rather than the full state. The state needed to authenticate the
+	// conflicted events may itself be conflicted, so keep adding the tuples
+	// needed for auth until there aren't any more.
+	authTuples := append([]types.StateKeyTuple{
+		{EventTypeNID: types.MRoomCreateNID, EventStateKeyNID: types.EmptyStateKeyNID},
+		{EventTypeNID: types.MRoomPowerLevelsNID, EventStateKeyNID: types.EmptyStateKeyNID},
+		{EventTypeNID: types.MRoomJoinRulesNID, EventStateKeyNID: types.EmptyStateKeyNID},
+	}, stateKeyTuples...)
+	var conflicts []types.StateEntry
+	for {
+		combined, err = v.loadCombinedStateAfterEventsForNumericTuples(ctx, prevStates, authTuples)
+		if err != nil {
+			observeStateResolution(roomVersion, "_load_partial_state", startTime, 0)
+			return nil, err
+		}
+		conflicts = findDuplicateStateKeys(combined)
+		var moreTuples []types.StateKeyTuple
+		moreTuples, err = v.stateKeyTuplesNeededForConflicts(ctx, conflicts, authTuples)
+		if err != nil {
+			observeStateResolution(roomVersion, "_load_auth_tuples", startTime, len(conflicts))
+			return nil, err
+		}
+		if len(moreTuples) == 0 {
+			break
+		}
+		authTuples = append(authTuples, moreTuples...)
+	}
+
+	var notConflicted []types.StateEntry
+	for _, entry := range combined {
+		if _, ok := stateEntryMap(conflicts).lookup(entry.StateKeyTuple); !ok {
+			notConflicted = append(notConflicted, entry)
+		}
+	}
+	resolved, err := v.resolveConflicts(ctx, roomVersion, notConflicted, conflicts)
 	if err != nil {
+		observeStateResolution(roomVersion, "_resolve_conflicts", startTime, len(conflicts))
 		return nil, err
 	}
+	observeStateResolution(roomVersion, "partial_state_with_conflicts", startTime, len(conflicts))
 
-	// Sort the full state so we can use it as a map.
-	sort.Sort(stateEntrySorter(fullState))
+	// Sort the resolved state so we can use it as a map.
+	sort.Sort(stateEntrySorter(resolved))
 
-	// Filter the full state down to the required tuples.
+	// Filter the resolved state down to the required tuples.
 	var result []types.StateEntry
 	for _, tuple := range stateKeyTuples {
-		eventNID, ok := stateEntryMap(fullState).lookup(tuple)
+		eventNID, ok := stateEntryMap(resolved).lookup(tuple)
 		if ok {
 			result = append(result, types.StateEntry{
 				StateKeyTuple: tuple,
@@ -426,6 +471,154 @@ func (v StateResolution) loadStateAfterEventsForNumericTuples(
 	return result, nil
 }
 
+// loadCombinedStateAfterEventsForNumericTuples is like LoadCombinedStateAfterEvents
+// but only loads the state for the given tuples. The result is sorted and has
+// no duplicate entries, but may have more than one entry for a tuple if the
+// state after the events differs.
+func (v StateResolution) loadCombinedStateAfterEventsForNumericTuples(
+	ctx context.Context, prevStates []types.StateAtEvent,
+	stateKeyTuples []types.StateKeyTuple,
+) ([]types.StateEntry, error) {
+	stateNIDs := make([]types.StateSnapshotNID, len(prevStates))
+	for i, state := range prevStates {
+		stateNIDs[i] = state.BeforeStateSnapshotNID
+	}
+	stateBlockNIDLists, err := v.db.StateBlockNIDs(ctx, uniqueStateSnapshotNIDs(stateNIDs))
+	if err != nil {
+		return nil, err
+	}
+	var stateBlockNIDs []types.StateBlockNID
+	for _, list := range stateBlockNIDLists {
+		stateBlockNIDs = append(stateBlockNIDs, list.StateBlockNIDs...)
+	}
+	stateEntryLists, err := v.db.StateEntriesForTuples(
+		ctx, uniqueStateBlockNIDs(stateBlockNIDs), stateKeyTuples,
+	)
+	if err != nil {
+		return nil, err
+	}
+	stateBlockNIDsMap := stateBlockNIDListMap(stateBlockNIDLists)
+	stateEntriesMap := stateEntryListMap(stateEntryLists)
+	wanted := make(map[types.StateKeyTuple]bool, len(stateKeyTuples))
+	for _, tuple := range stateKeyTuples {
+		wanted[tuple] = true
+	}
+
+	var combined []types.StateEntry
+	for _, prevState := range prevStates {
+		stateBlockNIDs, ok := stateBlockNIDsMap.lookup(prevState.BeforeStateSnapshotNID)
+		if !ok {
+			// This should only get hit if the database is corrupt.
+			// It should be impossible for an event to reference a NID that doesn't exist
+			panic(fmt.Errorf("Corrupt DB: Missing state snapshot numeric ID %d", prevState.BeforeStateSnapshotNID))
+		}
+		var state []types.StateEntry
+		for _, stateBlockNID := range stateBlockNIDs {
+			// If the block is missing from the map it means that none of its
+			// entries matched a requested tuple, so it can be safely skipped.
+			entries, _ := stateEntriesMap.lookup(stateBlockNID)
+			for _, entry := range entries {
+				if wanted[entry.StateKeyTuple] {
+					state = append(state, entry)
+				}
+			}
+		}
+		if prevState.IsStateEvent() && wanted[prevState.StateKeyTuple] {
+			// If the prev event was a state event then add an entry for the event itself
+			// so that we get the state after the event rather than the state before.
+			state = append(state, prevState.StateEntry)
+		}
+		// Stable sort so that the most recent entry for each state key stays
+		// remains later in the list than the older entries for the same state key.
+		sort.Stable(stateEntryByStateKeySorter(state))
+		// Unique returns the last entry and hence the most recent entry for each state key.
+		state = state[:util.Unique(stateEntryByStateKeySorter(state))]
+		combined = append(combined, state...)
+	}
+	return combined[:util.SortAndUnique(stateEntrySorter(combined))], nil
+}
+
+// stateKeyTuplesNeededForConflicts works out which state key tuples are needed
+// to authenticate the conflicted events, returning the ones that aren't in
+// the given list of tuples already.
+func (v StateResolution) stateKeyTuplesNeededForConflicts(
+	ctx context.Context, conflicts []types.StateEntry, have []types.StateKeyTuple,
+) ([]types.StateKeyTuple, error) {
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+	conflictedEvents, _, err := v.loadStateEvents(ctx, conflicts)
+	if err != nil {
+		return nil, err
+	}
+	needed := gomatrixserverlib.StateNeededForAuth(conflictedEvents)
+	var neededStateKeys []string
+	neededStateKeys = append(neededStateKeys, needed.Member...)
+	neededStateKeys = append(neededStateKeys, needed.ThirdPartyInvite...)
+	stateKeyNIDMap, err := v.db.EventStateKeyNIDs(ctx, neededStateKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	haveTuples := make(map[types.StateKeyTuple]bool, len(have))
+	for _, tuple := range have {
+		haveTuples[tuple] = true
+	}
+	var result []types.StateKeyTuple
+	for _, tuple := range v.stateKeyTuplesNeeded(stateKeyNIDMap, needed) {
+		if !haveTuples[tuple] {
+			haveTuples[tuple] = true
+			result = append(result, tuple)
+		}
+	}
+	return result, nil
+}
+
+var stateResolutionDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resolution_duration_seconds",
+		Help:      "How long it takes to resolve the state after a list of events",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+	},
+	// Takes two labels:
+	//   room_version:
+	//      The version of the room that the state was resolved for.
+	//   algorithm:
+	//      The algorithm used to resolve the state or the step it failed on if it failed,
+	//      as for calculateStateDurations, or one of:
+	//    partial_state_no_conflicts -> Only the requested tuples were loaded and they weren't conflicted.
+	//    partial_state_with_conflicts -> Only the requested tuples and the tuples needed to authenticate
+	//                                    the conflicted events were loaded and then resolved.
+	//    _load_partial_state -> Failed to load the state for the requested tuples.
+	//    _load_auth_tuples -> Failed to work out which tuples are needed for auth.
+	[]string{"room_version", "algorithm"},
+)
+
+var stateResolutionConflictLength = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resolution_conflict_length",
+		Help:      "The number of conflicted state entries when resolving the state after a list of events",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	},
+	[]string{"room_version", "algorithm"},
+)
+
+func observeStateResolution(
+	roomVersion gomatrixserverlib.RoomVersion, algorithm string,
+	startTime time.Time, conflictLength int,
+) {
+	stateResolutionDuration.WithLabelValues(string(roomVersion), algorithm).Observe(
+		time.Since(startTime).Seconds(),
+	)
+	stateResolutionConflictLength.WithLabelValues(string(roomVersion), algorithm).Observe(
+		float64(conflictLength),
+	)
+}
+
 var calculateStateDurations = prometheus.NewSummaryVec(
 	prometheus.SummaryOpts{
 		Namespace: "dendrite",
@@ -518,6 +711,7 @@ func init() {
 	prometheus.MustRegister(
 		calculateStateDurations, calculateStatePrevEventLength,
 		calculateStateFullStateLength, calculateStateConflictLength,
+		stateResolutionDuration, stateResolutionConflictLength,
 	)
 }
 
@@ -617,20 +811,118 @@ func (v StateResolution) calculateAndStoreStateAfterManyEvents(
 		return metrics.stop(0, err)
 	}
 
+	startTime := time.Now()
 	state, algorithm, conflictLength, err :=
 		v.calculateStateAfterManyEvents(ctx, roomVersion, prevStates)
+	observeStateResolution(roomVersion, algorithm, startTime, conflictLength)
 	metrics.algorithm = algorithm
 	if err != nil {
 		return metrics.stop(0, err)
 	}
 
-	// TODO: Check if we can encode the new state as a delta against the
-	// previous state.
 	metrics.conflictLength = conflictLength
 	metrics.fullStateLength = len(state)
+
+	// Check if we can encode the new state as a delta against one of the
+	// previous states, which saves storing the full state all over again.
+	baseNID, baseBlockNIDs, delta, err := v.closestStateSnapshot(ctx, prevStates, state)
+	if err != nil {
+		metrics.algorithm = "_load_closest_snapshot"
+		return metrics.stop(0, err)
+	}
+	if baseNID != 0 {
+		if len(delta) == 0 {
+			// The resolved state is exactly the same as the previous state.
+			return metrics.stop(baseNID, nil)
+		}
+		return metrics.stop(v.db.AddState(ctx, roomNID, baseBlockNIDs, delta))
+	}
 	return metrics.stop(v.db.AddState(ctx, roomNID, nil, state))
 }
 
+// closestStateSnapshot finds the snapshot of the state before one of the prev
+// events which needs the fewest state entries to be added to it to encode the
+// given state as a delta. Returns the NID and state block NIDs of that snapshot
+// along with the entries to add, or a zero NID if none of the snapshots are a
+// good base for a delta, e.g. because there are too many blocks already or
+// because the delta would be as big as the full state.
+func (v StateResolution) closestStateSnapshot(
+	ctx context.Context, prevStates []types.StateAtEvent, state []types.StateEntry,
+) (types.StateSnapshotNID, []types.StateBlockNID, []types.StateEntry, error) {
+	var stateNIDs []types.StateSnapshotNID
+	for _, prevState := range prevStates {
+		if prevState.BeforeStateSnapshotNID != 0 {
+			stateNIDs = append(stateNIDs, prevState.BeforeStateSnapshotNID)
+		}
+	}
+	if len(stateNIDs) == 0 {
+		return 0, nil, nil, nil
+	}
+	stateBlockNIDLists, err := v.db.StateBlockNIDs(ctx, uniqueStateSnapshotNIDs(stateNIDs))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	var stateBlockNIDs []types.StateBlockNID
+	for _, list := range stateBlockNIDLists {
+		if len(list.StateBlockNIDs) < maxStateBlockNIDs {
+			stateBlockNIDs = append(stateBlockNIDs, list.StateBlockNIDs...)
+		}
+	}
+	if len(stateBlockNIDs) == 0 {
+		return 0, nil, nil, nil
+	}
+	stateEntryLists, err := v.db.StateEntries(ctx, uniqueStateBlockNIDs(stateBlockNIDs))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	stateEntriesMap := stateEntryListMap(stateEntryLists)
+
+	var bestNID types.StateSnapshotNID
+	var bestBlockNIDs []types.StateBlockNID
+	var bestDelta []types.StateEntry
+	for _, list := range stateBlockNIDLists {
+		if len(list.StateBlockNIDs) >= maxStateBlockNIDs {
+			continue
+		}
+		base := combineStateBlocks(list.StateBlockNIDs, stateEntriesMap)
+		delta, ok := stateDeltaAgainst(base, state)
+		if !ok || len(delta) >= len(state) {
+			continue
+		}
+		if bestNID == 0 || len(delta) < len(bestDelta) {
+			bestNID, bestBlockNIDs, bestDelta = list.StateSnapshotNID, list.StateBlockNIDs, delta
+		}
+	}
+	return bestNID, bestBlockNIDs, bestDelta, nil
+}
+
+// stateDeltaAgainst returns the entries in state which aren't in base, either
+// because they are for a new state key or because they replace the entry for a
+// state key. Returns false if state can't be encoded as a delta against base,
+// which is the case if base has state keys that state doesn't have, since a
+// delta can only add or replace entries.
+func stateDeltaAgainst(base, state []types.StateEntry) ([]types.StateEntry, bool) {
+	baseEventNIDs := make(map[types.StateKeyTuple]types.EventNID, len(base))
+	for _, entry := range base {
+		baseEventNIDs[entry.StateKeyTuple] = entry.EventNID
+	}
+	var delta []types.StateEntry
+	matched := 0
+	for _, entry := range state {
+		eventNID, ok := baseEventNIDs[entry.StateKeyTuple]
+		if ok {
+			matched++
+		}
+		if !ok || eventNID != entry.EventNID {
+			delta = append(delta, entry)
+		}
+	}
+	if matched != len(baseEventNIDs) {
+		return nil, false
+	}
+	return delta, true
+}
+
 func (v StateResolution) calculateStateAfterManyEvents(
 	ctx context.Context, roomVersion gomatrixserverlib.RoomVersion,
 	prevStates []types.StateAtEvent,
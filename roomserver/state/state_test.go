@@ -17,8 +17,10 @@
 package state
 
 import (
+	"context"
 	"testing"
 
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
@@ -56,3 +58,126 @@ func TestFindDuplicateStateKeys(t *testing.T) {
 		}
 	}
 }
+
+func TestStateDeltaAgainst(t *testing.T) {
+	base := []types.StateEntry{
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 1},
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 2, EventStateKeyNID: 1}, EventNID: 2},
+	}
+	testCases := []struct {
+		State  []types.StateEntry
+		Want   []types.StateEntry
+		WantOK bool
+	}{{
+		// The same state needs an empty delta.
+		State:  base,
+		Want:   nil,
+		WantOK: true,
+	}, {
+		// Replaced and added entries are in the delta.
+		State: []types.StateEntry{
+			{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 1},
+			{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 2, EventStateKeyNID: 1}, EventNID: 3},
+			{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 3, EventStateKeyNID: 1}, EventNID: 4},
+		},
+		Want: []types.StateEntry{
+			{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 2, EventStateKeyNID: 1}, EventNID: 3},
+			{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 3, EventStateKeyNID: 1}, EventNID: 4},
+		},
+		WantOK: true,
+	}, {
+		// A delta can't remove entries.
+		State: []types.StateEntry{
+			{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 1},
+		},
+		Want:   nil,
+		WantOK: false,
+	}}
+
+	for _, test := range testCases {
+		got, ok := stateDeltaAgainst(base, test.State)
+		if ok != test.WantOK {
+			t.Fatalf("Wanted ok=%v, got ok=%v", test.WantOK, ok)
+		}
+		if len(got) != len(test.Want) {
+			t.Fatalf("Wanted %v, got %v", test.Want, got)
+		}
+		for i := range got {
+			if got[i] != test.Want[i] {
+				t.Fatalf("Wanted %v, got %v", test.Want, got)
+			}
+		}
+	}
+}
+
+func TestLoadCombinedStateAfterEventsForNumericTuples(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.Open("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.Open failed: %s", err)
+	}
+	name := types.StateKeyTuple{EventTypeNID: 10, EventStateKeyNID: 1}
+	topic := types.StateKeyTuple{EventTypeNID: 11, EventStateKeyNID: 1}
+	avatar := types.StateKeyTuple{EventTypeNID: 12, EventStateKeyNID: 1}
+	stateA, err := db.AddState(ctx, 1, nil, []types.StateEntry{
+		{StateKeyTuple: name, EventNID: 1},
+		{StateKeyTuple: topic, EventNID: 2},
+	})
+	if err != nil {
+		t.Fatalf("AddState failed: %s", err)
+	}
+	stateB, err := db.AddState(ctx, 1, nil, []types.StateEntry{
+		{StateKeyTuple: name, EventNID: 1},
+		{StateKeyTuple: topic, EventNID: 3},
+	})
+	if err != nil {
+		t.Fatalf("AddState failed: %s", err)
+	}
+	prevStates := []types.StateAtEvent{
+		{BeforeStateSnapshotNID: stateA},
+		{
+			// A state event which changes the avatar, so it should be in
+			// the state after the event.
+			BeforeStateSnapshotNID: stateB,
+			StateEntry:             types.StateEntry{StateKeyTuple: avatar, EventNID: 4},
+		},
+	}
+
+	testCases := []struct {
+		Tuples []types.StateKeyTuple
+		Want   []types.StateEntry
+	}{{
+		// The name is the same after both events so isn't conflicted.
+		Tuples: []types.StateKeyTuple{name},
+		Want:   []types.StateEntry{{StateKeyTuple: name, EventNID: 1}},
+	}, {
+		// The topic differs so both entries are returned.
+		Tuples: []types.StateKeyTuple{topic},
+		Want: []types.StateEntry{
+			{StateKeyTuple: topic, EventNID: 2},
+			{StateKeyTuple: topic, EventNID: 3},
+		},
+	}, {
+		Tuples: []types.StateKeyTuple{name, avatar},
+		Want: []types.StateEntry{
+			{StateKeyTuple: name, EventNID: 1},
+			{StateKeyTuple: avatar, EventNID: 4},
+		},
+	}}
+
+	v := NewStateResolution(db)
+	for _, test := range testCases {
+		got, err := v.loadCombinedStateAfterEventsForNumericTuples(ctx, prevStates, test.Tuples)
+		if err != nil {
+			t.Fatalf("loadCombinedStateAfterEventsForNumericTuples failed: %s", err)
+		}
+		if len(got) != len(test.Want) {
+			t.Fatalf("Wanted %v, got %v", test.Want, got)
+		}
+		for i := range got {
+			if got[i] != test.Want[i] {
+				t.Fatalf("Wanted %v, got %v", test.Want, got)
+			}
+		}
+	}
+}
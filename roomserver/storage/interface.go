@@ -44,6 +44,24 @@ type Database interface {
 	// Look up the numeric state data IDs for each numeric state snapshot ID
 	// The returned slice is sorted by numeric state snapshot ID.
 	StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error)
+	// Look up the NIDs of all the rooms which have state snapshots.
+	StateSnapshotRoomNIDs(ctx context.Context) ([]types.RoomNID, error)
+	// Look up the numeric state data IDs for every state snapshot of a room.
+	// The returned slice is sorted by numeric state snapshot ID.
+	RoomStateBlockNIDs(ctx context.Context, roomNID types.RoomNID) ([]types.StateBlockNIDList, error)
+	// Replace the numeric state data IDs of a state snapshot, adding a new block for the
+	// given state entries to the end of the list if there are any. This must not change
+	// the state that the snapshot represents, as snapshots are otherwise immutable.
+	// Returns the new list of numeric state data IDs for the snapshot.
+	RewriteState(
+		ctx context.Context,
+		stateNID types.StateSnapshotNID,
+		stateBlockNIDs []types.StateBlockNID,
+		state []types.StateEntry,
+	) ([]types.StateBlockNID, error)
+	// Delete the state data for each numeric state data ID. The caller must make sure that
+	// no state snapshot refers to them any more.
+	DeleteStateBlocks(ctx context.Context, stateBlockNIDs []types.StateBlockNID) error
 	// Look up the state data for each numeric state data ID
 	// The returned slice is sorted by numeric state data ID.
 	StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error)
@@ -63,8 +81,38 @@ type Database interface {
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Look up a room version from the room NID.
 	GetRoomVersionForRoomNID(ctx context.Context, roomNID types.RoomNID) (gomatrixserverlib.RoomVersion, error)
-	// Stores a matrix room event in the database
-	StoreEvent(ctx context.Context, event gomatrixserverlib.Event, txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID) (types.RoomNID, types.StateAtEvent, error)
+	// Stores a matrix room event in the database. If isRejected is true then the event
+	// failed the auth checks against its auth events and is stored as rejected.
+	StoreEvent(ctx context.Context, event gomatrixserverlib.Event, txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected bool) (types.RoomNID, types.StateAtEvent, error)
+	// Look up whether each of a list of events was rejected or soft-failed.
+	// Events which aren't in the database are omitted from the map.
+	EventStatuses(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]types.EventStatus, error)
+	// Purge the non-state events in a room with a depth lower than beforeDepth, other than the
+	// latest events in the room. State events are kept so that the state snapshots of later
+	// events can still be loaded. The JSON of purged events is deleted, but they are kept in
+	// the events table so that the events after them can still refer to them.
+	// Returns the IDs of the events that were purged.
+	PurgeHistory(ctx context.Context, roomNID types.RoomNID, beforeDepth int64) ([]string, error)
+	// Look up up to limit non-state events in a room which come after the given depth and numeric
+	// event ID and haven't been purged, sorted by depth and then by numeric event ID. This is used to page through the
+	// history of a room in topological order.
+	MessageEventNIDsByDepth(ctx context.Context, roomNID types.RoomNID, afterDepth int64, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// Look up the IDs of all of the rooms that the roomserver knows about.
+	RoomIDs(ctx context.Context) ([]string, error)
+	// Delete everything that the roomserver knows about a room in a single transaction, including
+	// its events, state, memberships, invites and aliases. The room's blocked status is left alone.
+	// Returns the IDs of the events that were deleted.
+	DeleteRoom(ctx context.Context, roomID string, roomNID types.RoomNID) ([]string, error)
+	// Block a room so that local users can't join it and remote servers can't join it through us.
+	BlockRoom(ctx context.Context, roomID, blockedBy string) error
+	// Look up whether a room has been blocked.
+	IsRoomBlocked(ctx context.Context, roomID string) (bool, error)
+	// Set whether the JSON of new events should be compressed when it is stored. Events are
+	// always readable whether they were stored compressed or not.
+	SetCompressEventJSON(compress bool)
+	// Rewrite the stored JSON of every event so that it is compressed, or so that it isn't
+	// if compress is false, in batches of batchSize events.
+	RecompressEventJSON(ctx context.Context, compress bool, batchSize int) (types.EventJSONRecompressionStats, error)
 	// Look up the state entries for a list of string event IDs
 	// Returns an error if the there is an error talking to the database
 	// Returns a types.MissingEventError if the event IDs aren't in the database.
@@ -77,11 +77,15 @@ const updateInviteRetiredSQL = "" +
 const selectInvitesAboutToRetireSQL = "" +
 	"SELECT invite_event_id FROM roomserver_invites WHERE room_nid = $1 AND target_nid = $2 AND NOT retired"
 
+const deleteInvitesForRoomSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
 type inviteStatements struct {
 	insertInviteEventStmt               *sql.Stmt
 	selectInviteActiveForUserInRoomStmt *sql.Stmt
 	updateInviteRetiredStmt             *sql.Stmt
 	selectInvitesAboutToRetireStmt      *sql.Stmt
+	deleteInvitesForRoomStmt            *sql.Stmt
 }
 
 func NewMysqlInvitesTable(db *sql.DB) (tables.Invites, error) {
@@ -96,6 +100,7 @@ func NewMysqlInvitesTable(db *sql.DB) (tables.Invites, error) {
 		{&s.selectInviteActiveForUserInRoomStmt, selectInviteActiveForUserInRoomSQL},
 		{&s.updateInviteRetiredStmt, updateInviteRetiredSQL},
 		{&s.selectInvitesAboutToRetireStmt, selectInvitesAboutToRetireSQL},
+		{&s.deleteInvitesForRoomStmt, deleteInvitesForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -164,3 +169,10 @@ func (s *inviteStatements) SelectInviteActiveForUserInRoom(
 	}
 	return result, rows.Err()
 }
+
+func (s *inviteStatements) DeleteInvitesForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	_, err := internal.TxStmt(txn, s.deleteInvitesForRoomStmt).ExecContext(ctx, int64(roomNID))
+	return err
+}
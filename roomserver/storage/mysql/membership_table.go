@@ -98,6 +98,9 @@ const updateMembershipSQL = "" +
 	"UPDATE roomserver_membership SET sender_nid = $3, membership_nid = $4, event_nid = $5" +
 	" WHERE room_nid = $1 AND target_nid = $2"
 
+const deleteMembershipsForRoomSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
 type membershipStatements struct {
 	insertMembershipStmt                            *sql.Stmt
 	selectMembershipForUpdateStmt                   *sql.Stmt
@@ -107,6 +110,7 @@ type membershipStatements struct {
 	selectMembershipsFromRoomStmt                   *sql.Stmt
 	selectLocalMembershipsFromRoomStmt              *sql.Stmt
 	updateMembershipStmt                            *sql.Stmt
+	deleteMembershipsForRoomStmt                    *sql.Stmt
 }
 
 func NewMysqlMembershipTable(db *sql.DB) (tables.Membership, error) {
@@ -125,6 +129,7 @@ func NewMysqlMembershipTable(db *sql.DB) (tables.Membership, error) {
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
 		{&s.selectLocalMembershipsFromRoomStmt, selectLocalMembershipsFromRoomSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
+		{&s.deleteMembershipsForRoomStmt, deleteMembershipsForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -221,3 +226,10 @@ func (s *membershipStatements) UpdateMembership(
 	)
 	return err
 }
+
+func (s *membershipStatements) DeleteMembershipsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	_, err := internal.TxStmt(txn, s.deleteMembershipsForRoomStmt).ExecContext(ctx, int64(roomNID))
+	return err
+}
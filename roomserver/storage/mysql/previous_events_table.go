@@ -18,6 +18,7 @@ package mysql
 import (
 	"context"
 	"database/sql"
+	"strings"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
@@ -60,6 +61,11 @@ const selectPreviousEventExistsSQL = "" +
 	"SELECT 1 FROM roomserver_previous_events" +
 	" WHERE previous_event_id = $1 AND previous_reference_sha256 = $2"
 
+// Delete the entries for the given previous events, which is done when the
+// room that they belong to is deleted.
+const bulkDeletePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN ($1)"
+
 type previousEventStatements struct {
 	insertPreviousEventStmt       *sql.Stmt
 	selectPreviousEventExistsStmt *sql.Stmt
@@ -101,3 +107,19 @@ func (s *previousEventStatements) SelectPreviousEventExists(
 	stmt := internal.TxStmt(txn, s.selectPreviousEventExistsStmt)
 	return stmt.QueryRowContext(ctx, eventID, eventReferenceSHA256).Scan(&ok)
 }
+
+func (s *previousEventStatements) BulkDeletePreviousEvents(
+	ctx context.Context, txn *sql.Tx, previousEventIDs []string,
+) error {
+	iPreviousEventIDs := make([]interface{}, len(previousEventIDs))
+	for k, v := range previousEventIDs {
+		iPreviousEventIDs[k] = v
+	}
+	deleteOrig := strings.Replace(bulkDeletePreviousEventsSQL, "($1)", internal.QueryVariadic(len(iPreviousEventIDs)), 1)
+	deleteStmt, err := txn.Prepare(deleteOrig)
+	if err != nil {
+		return err
+	}
+	_, err = deleteStmt.ExecContext(ctx, iPreviousEventIDs...)
+	return err
+}
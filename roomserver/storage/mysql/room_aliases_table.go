@@ -53,12 +53,16 @@ const selectCreatorIDFromAliasSQL = "" +
 const deleteRoomAliasSQL = "" +
 	"DELETE FROM roomserver_room_aliases WHERE alias = $1"
 
+const deleteRoomAliasesForRoomIDSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
 type roomAliasesStatements struct {
 	insertRoomAliasStmt          *sql.Stmt
 	selectRoomIDFromAliasStmt    *sql.Stmt
 	selectAliasesFromRoomIDStmt  *sql.Stmt
 	selectCreatorIDFromAliasStmt *sql.Stmt
 	deleteRoomAliasStmt          *sql.Stmt
+	deleteRoomAliasesForRoomStmt *sql.Stmt
 }
 
 func NewMysqlRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
@@ -73,6 +77,7 @@ func NewMysqlRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
 		{&s.selectAliasesFromRoomIDStmt, selectAliasesFromRoomIDSQL},
 		{&s.selectCreatorIDFromAliasStmt, selectCreatorIDFromAliasSQL},
 		{&s.deleteRoomAliasStmt, deleteRoomAliasSQL},
+		{&s.deleteRoomAliasesForRoomStmt, deleteRoomAliasesForRoomIDSQL},
 	}.Prepare(db)
 }
 
@@ -130,3 +135,11 @@ func (s *roomAliasesStatements) DeleteRoomAlias(
 	_, err = s.deleteRoomAliasStmt.ExecContext(ctx, alias)
 	return
 }
+
+func (s *roomAliasesStatements) DeleteRoomAliasesForRoomID(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	stmt := internal.TxStmt(txn, s.deleteRoomAliasesForRoomStmt)
+	_, err = stmt.ExecContext(ctx, roomID)
+	return
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const blockedRoomsSchema = `
+-- Stores the rooms which local users are not allowed to join, and which
+-- remote servers are not allowed to join through us.
+CREATE TABLE IF NOT EXISTS roomserver_blocked_rooms (
+    -- The room ID of the blocked room. This is stored as a string rather than
+    -- a room NID so that the block survives the room being deleted.
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- The user ID of the admin who blocked the room
+    blocked_by TEXT NOT NULL,
+    -- When the room was blocked
+    blocked_ts BIGINT NOT NULL
+);
+`
+
+const insertBlockedRoomSQL = "" +
+	"INSERT INTO roomserver_blocked_rooms (room_id, blocked_by, blocked_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectRoomBlockedSQL = "" +
+	"SELECT 1 FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+type blockedRoomsStatements struct {
+	insertBlockedRoomStmt *sql.Stmt
+	selectRoomBlockedStmt *sql.Stmt
+}
+
+func NewPostgresBlockedRoomsTable(db *sql.DB) (tables.BlockedRooms, error) {
+	s := &blockedRoomsStatements{}
+	_, err := db.Exec(blockedRoomsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertBlockedRoomStmt, insertBlockedRoomSQL},
+		{&s.selectRoomBlockedStmt, selectRoomBlockedSQL},
+	}.Prepare(db)
+}
+
+func (s *blockedRoomsStatements) InsertBlockedRoom(
+	ctx context.Context, roomID, blockedBy string,
+) error {
+	_, err := s.insertBlockedRoomStmt.ExecContext(
+		ctx, roomID, blockedBy, gomatrixserverlib.AsTimestamp(time.Now()),
+	)
+	return err
+}
+
+func (s *blockedRoomsStatements) SelectRoomBlocked(
+	ctx context.Context, roomID string,
+) (bool, error) {
+	var exists int
+	err := s.selectRoomBlockedStmt.QueryRowContext(ctx, roomID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
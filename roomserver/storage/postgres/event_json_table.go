@@ -32,15 +32,25 @@ const eventJSONSchema = `
 CREATE TABLE IF NOT EXISTS roomserver_event_json (
     -- Local numeric ID for the event.
     event_nid BIGINT NOT NULL PRIMARY KEY,
-    -- The JSON for the event.
-    -- Stored as TEXT because this should be valid UTF-8.
+    -- The JSON for the event, which may be compressed.
+    -- Stored as BYTEA because compressed events aren't valid UTF-8.
     -- Not stored as a JSONB because we always just pull the entire event
     -- so there is no point in postgres parsing it.
     -- Not stored as JSON because we already validate the JSON in the server
     -- so there is no point in postgres validating it.
-    -- TODO: Should we be compressing the events with Snappy or DEFLATE?
-    event_json TEXT NOT NULL
+    event_json BYTEA NOT NULL
 );
+
+-- Older databases stored the event JSON as TEXT, which can't hold compressed
+-- events.
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_name = 'roomserver_event_json' AND column_name = 'event_json') = 'text' THEN
+        ALTER TABLE roomserver_event_json
+            ALTER COLUMN event_json TYPE BYTEA USING convert_to(event_json, 'UTF8');
+    END IF;
+END $$;
 `
 
 const insertEventJSONSQL = "" +
@@ -55,9 +65,23 @@ const bulkSelectEventJSONSQL = "" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+const bulkDeleteEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY($1)"
+
+const selectEventJSONAfterSQL = "" +
+	"SELECT event_nid, event_json FROM roomserver_event_json" +
+	" WHERE event_nid > $1" +
+	" ORDER BY event_nid ASC LIMIT $2"
+
+const updateEventJSONSQL = "" +
+	"UPDATE roomserver_event_json SET event_json = $2 WHERE event_nid = $1"
+
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	insertEventJSONStmt      *sql.Stmt
+	bulkSelectEventJSONStmt  *sql.Stmt
+	bulkDeleteEventJSONStmt  *sql.Stmt
+	selectEventJSONAfterStmt *sql.Stmt
+	updateEventJSONStmt      *sql.Stmt
 }
 
 func NewPostgresEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
@@ -69,6 +93,9 @@ func NewPostgresEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.bulkDeleteEventJSONStmt, bulkDeleteEventJSONSQL},
+		{&s.selectEventJSONAfterStmt, selectEventJSONAfterSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -104,3 +131,41 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], rows.Err()
 }
+
+func (s *eventJSONStatements) BulkDeleteEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	stmt := internal.TxStmt(txn, s.bulkDeleteEventJSONStmt)
+	_, err := stmt.ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
+
+func (s *eventJSONStatements) SelectEventJSONAfter(
+	ctx context.Context, txn *sql.Tx, afterEventNID types.EventNID, limit int,
+) ([]tables.EventJSONPair, error) {
+	stmt := internal.TxStmt(txn, s.selectEventJSONAfterStmt)
+	rows, err := stmt.QueryContext(ctx, int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventJSONAfter: rows.close() failed")
+	var results []tables.EventJSONPair
+	for rows.Next() {
+		var result tables.EventJSONPair
+		var eventNID int64
+		if err = rows.Scan(&eventNID, &result.EventJSON); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) UpdateEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	stmt := internal.TxStmt(txn, s.updateEventJSONStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID), eventJSON)
+	return err
+}
@@ -64,13 +64,31 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     -- Needed for setting reference hashes when sending new events.
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
-    auth_event_nids BIGINT[] NOT NULL
+    auth_event_nids BIGINT[] NOT NULL,
+    -- Whether the event failed the auth checks against its auth events.
+    -- Rejected events are never part of the room state or the forward
+    -- extremities of the room.
+    is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the event passed the auth checks against the state before it
+    -- but failed them against the current state of the room. Soft-failed
+    -- events are not added to the forward extremities or sent to clients.
+    is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the event has been purged from the room history. The JSON of
+    -- purged events is deleted, but the row is kept because the events after
+    -- it still refer to it through their prev_events and auth events.
+    is_purged BOOLEAN NOT NULL DEFAULT FALSE
 );
+
+-- Older databases don't have the columns for rejected, soft-failed and purged
+-- events.
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS is_rejected BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS is_purged BOOLEAN NOT NULL DEFAULT FALSE;
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
 	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -118,9 +136,37 @@ const bulkSelectEventNIDSQL = "" +
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid = ANY($1)"
 
+const updateEventSoftFailedSQL = "" +
+	"UPDATE roomserver_events SET is_soft_failed = TRUE WHERE event_nid = $1"
+
+const bulkSelectEventStatusSQL = "" +
+	"SELECT event_nid, is_rejected, is_soft_failed FROM roomserver_events WHERE event_nid = ANY($1)"
+
+// Select the non-state events in a room which are topologically before a point.
+const selectPurgeableEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND depth < $2 AND event_state_key_nid = 0" +
+	" AND is_purged = FALSE"
+
+// Page through the non-state events in a room in topological order.
+const selectMessageEventNIDsByDepthSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND event_state_key_nid = 0 AND is_purged = FALSE" +
+	" AND (depth > $2 OR (depth = $2 AND event_nid > $3))" +
+	" ORDER BY depth ASC, event_nid ASC LIMIT $4"
+
+const bulkUpdateEventsPurgedSQL = "" +
+	"UPDATE roomserver_events SET is_purged = TRUE WHERE event_nid = ANY($1)"
+
+const bulkDeleteEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid = ANY($1)"
+
 const selectRoomNIDForEventNIDSQL = "" +
 	"SELECT room_nid FROM roomserver_events WHERE event_nid = $1"
 
+const selectEventIDsForRoomSQL = "" +
+	"SELECT event_nid, event_id FROM roomserver_events WHERE room_nid = $1"
+
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
 	selectEventStmt                        *sql.Stmt
@@ -135,7 +181,14 @@ type eventStatements struct {
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
+	updateEventSoftFailedStmt              *sql.Stmt
+	bulkSelectEventStatusStmt              *sql.Stmt
+	selectPurgeableEventNIDsStmt           *sql.Stmt
+	selectMessageEventNIDsByDepthStmt      *sql.Stmt
+	bulkUpdateEventsPurgedStmt             *sql.Stmt
+	bulkDeleteEventsStmt                   *sql.Stmt
 	selectRoomNIDForEventNIDStmt           *sql.Stmt
+	selectEventIDsForRoomStmt              *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -159,7 +212,14 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
+		{&s.updateEventSoftFailedStmt, updateEventSoftFailedSQL},
+		{&s.bulkSelectEventStatusStmt, bulkSelectEventStatusSQL},
+		{&s.selectPurgeableEventNIDsStmt, selectPurgeableEventNIDsSQL},
+		{&s.selectMessageEventNIDsByDepthStmt, selectMessageEventNIDsByDepthSQL},
+		{&s.bulkUpdateEventsPurgedStmt, bulkUpdateEventsPurgedSQL},
+		{&s.bulkDeleteEventsStmt, bulkDeleteEventsSQL},
 		{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
+		{&s.selectEventIDsForRoomStmt, selectEventIDsForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -173,12 +233,13 @@ func (s *eventStatements) InsertEvent(
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	isRejected bool,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
 	err := s.insertEventStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -426,6 +487,94 @@ func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx,
 	return result, nil
 }
 
+func (s *eventStatements) UpdateEventSoftFailed(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) error {
+	stmt := internal.TxStmt(txn, s.updateEventSoftFailedStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
+
+// bulkSelectEventStatus returns whether each of the events was rejected or soft-failed.
+// Events which aren't in the database are omitted from the map.
+func (s *eventStatements) BulkSelectEventStatus(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]types.EventStatus, error) {
+	rows, err := s.bulkSelectEventStatusStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectEventStatus: rows.close() failed")
+	results := make(map[types.EventNID]types.EventStatus, len(eventNIDs))
+	for rows.Next() {
+		var eventNID int64
+		var status types.EventStatus
+		if err = rows.Scan(&eventNID, &status.Rejected, &status.SoftFailed); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = status
+	}
+	return results, rows.Err()
+}
+
+func (s *eventStatements) SelectPurgeableEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, beforeDepth int64,
+) ([]types.EventNID, error) {
+	stmt := internal.TxStmt(txn, s.selectPurgeableEventNIDsStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID), beforeDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPurgeableEventNIDs: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectMessageEventNIDsByDepth(
+	ctx context.Context, roomNID types.RoomNID,
+	afterDepth int64, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectMessageEventNIDsByDepthStmt.QueryContext(
+		ctx, int64(roomNID), afterDepth, int64(afterEventNID), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMessageEventNIDsByDepth: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) BulkUpdateEventsPurged(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	stmt := internal.TxStmt(txn, s.bulkUpdateEventsPurgedStmt)
+	_, err := stmt.ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
+
+func (s *eventStatements) BulkDeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	stmt := internal.TxStmt(txn, s.bulkDeleteEventsStmt)
+	_, err := stmt.ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
+
 func (s *eventStatements) SelectRoomNIDForEventNID(
 	ctx context.Context, eventNID types.EventNID,
 ) (roomNID types.RoomNID, err error) {
@@ -440,3 +589,24 @@ func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	}
 	return nids
 }
+
+func (s *eventStatements) SelectEventIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (map[types.EventNID]string, error) {
+	stmt := internal.TxStmt(txn, s.selectEventIDsForRoomStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventIDsForRoom: rows.close() failed")
+	results := make(map[types.EventNID]string)
+	for rows.Next() {
+		var eventNID int64
+		var eventID string
+		if err = rows.Scan(&eventNID, &eventID); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = eventID
+	}
+	return results, rows.Err()
+}
@@ -75,10 +75,14 @@ const updateInviteRetiredSQL = "" +
 	" WHERE room_nid = $1 AND target_nid = $2 AND NOT retired" +
 	" RETURNING invite_event_id"
 
+const deleteInvitesForRoomSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
 type inviteStatements struct {
 	insertInviteEventStmt               *sql.Stmt
 	selectInviteActiveForUserInRoomStmt *sql.Stmt
 	updateInviteRetiredStmt             *sql.Stmt
+	deleteInvitesForRoomStmt            *sql.Stmt
 }
 
 func NewPostgresInvitesTable(db *sql.DB) (tables.Invites, error) {
@@ -92,6 +96,7 @@ func NewPostgresInvitesTable(db *sql.DB) (tables.Invites, error) {
 		{&s.insertInviteEventStmt, insertInviteEventSQL},
 		{&s.selectInviteActiveForUserInRoomStmt, selectInviteActiveForUserInRoomSQL},
 		{&s.updateInviteRetiredStmt, updateInviteRetiredSQL},
+		{&s.deleteInvitesForRoomStmt, deleteInvitesForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -158,3 +163,10 @@ func (s *inviteStatements) SelectInviteActiveForUserInRoom(
 	}
 	return result, rows.Err()
 }
+
+func (s *inviteStatements) DeleteInvitesForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	_, err := internal.TxStmt(txn, s.deleteInvitesForRoomStmt).ExecContext(ctx, int64(roomNID))
+	return err
+}
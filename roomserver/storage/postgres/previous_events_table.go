@@ -19,6 +19,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -60,9 +61,15 @@ const selectPreviousEventExistsSQL = "" +
 	"SELECT 1 FROM roomserver_previous_events" +
 	" WHERE previous_event_id = $1 AND previous_reference_sha256 = $2"
 
+// Delete the entries for the given previous events, which is done when the
+// room that they belong to is deleted.
+const bulkDeletePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id = ANY($1)"
+
 type previousEventStatements struct {
 	insertPreviousEventStmt       *sql.Stmt
 	selectPreviousEventExistsStmt *sql.Stmt
+	bulkDeletePreviousEventsStmt  *sql.Stmt
 }
 
 func NewPostgresPreviousEventsTable(db *sql.DB) (tables.PreviousEvents, error) {
@@ -75,6 +82,7 @@ func NewPostgresPreviousEventsTable(db *sql.DB) (tables.PreviousEvents, error) {
 	return s, shared.StatementList{
 		{&s.insertPreviousEventStmt, insertPreviousEventSQL},
 		{&s.selectPreviousEventExistsStmt, selectPreviousEventExistsSQL},
+		{&s.bulkDeletePreviousEventsStmt, bulkDeletePreviousEventsSQL},
 	}.Prepare(db)
 }
 
@@ -101,3 +109,11 @@ func (s *previousEventStatements) SelectPreviousEventExists(
 	stmt := internal.TxStmt(txn, s.selectPreviousEventExistsStmt)
 	return stmt.QueryRowContext(ctx, eventID, eventReferenceSHA256).Scan(&ok)
 }
+
+func (s *previousEventStatements) BulkDeletePreviousEvents(
+	ctx context.Context, txn *sql.Tx, previousEventIDs []string,
+) error {
+	stmt := internal.TxStmt(txn, s.bulkDeletePreviousEventsStmt)
+	_, err := stmt.ExecContext(ctx, pq.StringArray(previousEventIDs))
+	return err
+}
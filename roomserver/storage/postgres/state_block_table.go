@@ -82,11 +82,15 @@ const bulkSelectFilteredStateBlockEntriesSQL = "" +
 	" AND event_type_nid = ANY($2) AND event_state_key_nid = ANY($3)" +
 	" ORDER BY state_block_nid, event_type_nid, event_state_key_nid"
 
+const bulkDeleteStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = ANY($1)"
+
 type stateBlockStatements struct {
 	insertStateDataStmt                     *sql.Stmt
 	selectNextStateBlockNIDStmt             *sql.Stmt
 	bulkSelectStateBlockEntriesStmt         *sql.Stmt
 	bulkSelectFilteredStateBlockEntriesStmt *sql.Stmt
+	bulkDeleteStateBlocksStmt               *sql.Stmt
 }
 
 func NewPostgresStateBlockTable(db *sql.DB) (tables.StateBlock, error) {
@@ -101,6 +105,7 @@ func NewPostgresStateBlockTable(db *sql.DB) (tables.StateBlock, error) {
 		{&s.selectNextStateBlockNIDStmt, selectNextStateBlockNIDSQL},
 		{&s.bulkSelectStateBlockEntriesStmt, bulkSelectStateBlockEntriesSQL},
 		{&s.bulkSelectFilteredStateBlockEntriesStmt, bulkSelectFilteredStateBlockEntriesSQL},
+		{&s.bulkDeleteStateBlocksStmt, bulkDeleteStateBlocksSQL},
 	}.Prepare(db)
 }
 
@@ -252,6 +257,13 @@ func (s *stateBlockStatements) BulkSelectFilteredStateBlockEntries(
 	return results, rows.Err()
 }
 
+func (s *stateBlockStatements) BulkDeleteStateBlocks(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs []types.StateBlockNID,
+) error {
+	_, err := internal.TxStmt(txn, s.bulkDeleteStateBlocksStmt).ExecContext(ctx, stateBlockNIDsAsArray(stateBlockNIDs))
+	return err
+}
+
 func stateBlockNIDsAsArray(stateBlockNIDs []types.StateBlockNID) pq.Int64Array {
 	nids := make([]int64, len(stateBlockNIDs))
 	for i := range stateBlockNIDs {
@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -61,9 +62,26 @@ const bulkSelectStateBlockNIDsSQL = "" +
 	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
 	" WHERE state_snapshot_nid = ANY($1) ORDER BY state_snapshot_nid ASC"
 
+const selectStateSnapshotRoomNIDsSQL = "" +
+	"SELECT DISTINCT room_nid FROM roomserver_state_snapshots ORDER BY room_nid ASC"
+
+const selectStateBlockNIDsForRoomSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE room_nid = $1 ORDER BY state_snapshot_nid ASC"
+
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_block_nids = $2 WHERE state_snapshot_nid = $1"
+
+const deleteStateSnapshotsForRoomSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
 type stateSnapshotStatements struct {
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
+	insertStateStmt                 *sql.Stmt
+	bulkSelectStateBlockNIDsStmt    *sql.Stmt
+	selectStateSnapshotRoomNIDsStmt *sql.Stmt
+	selectStateBlockNIDsForRoomStmt *sql.Stmt
+	updateStateBlockNIDsStmt        *sql.Stmt
+	deleteStateSnapshotsForRoomStmt *sql.Stmt
 }
 
 func NewPostgresStateSnapshotTable(db *sql.DB) (tables.StateSnapshot, error) {
@@ -76,6 +94,10 @@ func NewPostgresStateSnapshotTable(db *sql.DB) (tables.StateSnapshot, error) {
 	return s, shared.StatementList{
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
+		{&s.selectStateSnapshotRoomNIDsStmt, selectStateSnapshotRoomNIDsSQL},
+		{&s.selectStateBlockNIDsForRoomStmt, selectStateBlockNIDsForRoomSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
+		{&s.deleteStateSnapshotsForRoomStmt, deleteStateSnapshotsForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -123,3 +145,65 @@ func (s *stateSnapshotStatements) BulkSelectStateBlockNIDs(
 	}
 	return results, nil
 }
+
+func (s *stateSnapshotStatements) SelectStateSnapshotRoomNIDs(
+	ctx context.Context,
+) ([]types.RoomNID, error) {
+	rows, err := s.selectStateSnapshotRoomNIDsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateSnapshotRoomNIDs: rows.close() failed")
+	var roomNIDs []types.RoomNID
+	for rows.Next() {
+		var roomNID types.RoomNID
+		if err = rows.Scan(&roomNID); err != nil {
+			return nil, err
+		}
+		roomNIDs = append(roomNIDs, roomNID)
+	}
+	return roomNIDs, rows.Err()
+}
+
+func (s *stateSnapshotStatements) SelectStateBlockNIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.StateBlockNIDList, error) {
+	stmt := internal.TxStmt(txn, s.selectStateBlockNIDsForRoomStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateBlockNIDsForRoom: rows.close() failed")
+	var results []types.StateBlockNIDList
+	for rows.Next() {
+		var result types.StateBlockNIDList
+		var stateBlockNIDs pq.Int64Array
+		if err = rows.Scan(&result.StateSnapshotNID, &stateBlockNIDs); err != nil {
+			return nil, err
+		}
+		result.StateBlockNIDs = make([]types.StateBlockNID, len(stateBlockNIDs))
+		for k := range stateBlockNIDs {
+			result.StateBlockNIDs[k] = types.StateBlockNID(stateBlockNIDs[k])
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID,
+) error {
+	nids := make([]int64, len(stateBlockNIDs))
+	for i := range stateBlockNIDs {
+		nids[i] = int64(stateBlockNIDs[i])
+	}
+	_, err := internal.TxStmt(txn, s.updateStateBlockNIDsStmt).ExecContext(ctx, int64(stateNID), pq.Int64Array(nids))
+	return err
+}
+
+func (s *stateSnapshotStatements) DeleteStateSnapshotsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	_, err := internal.TxStmt(txn, s.deleteStateSnapshotsForRoomStmt).ExecContext(ctx, int64(roomNID))
+	return err
+}
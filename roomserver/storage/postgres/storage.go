@@ -88,6 +88,10 @@ func Open(dataSourceName string, dbProperties internal.DbProperties) (*Database,
 	if err != nil {
 		return nil, err
 	}
+	blockedRooms, err := NewPostgresBlockedRoomsTable(db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  db,
 		EventTypesTable:     eventTypes,
@@ -102,6 +106,7 @@ func Open(dataSourceName string, dbProperties internal.DbProperties) (*Database,
 		RoomAliasesTable:    roomAliases,
 		InvitesTable:        invites,
 		MembershipTable:     membership,
+		BlockedRoomsTable:   blockedRooms,
 	}
 	return &d, nil
 }
@@ -0,0 +1,96 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// Event JSON which has been compressed is stored with a one byte prefix which
+// says how it was compressed, so that the format can be changed later without
+// having to rewrite existing rows. Event JSON which hasn't been compressed is
+// stored as it is, which means that rows written before compression existed
+// are still readable. Event JSON is always an object, so it always starts with
+// '{' and can't be confused with any of the prefixes.
+const (
+	// eventJSONFormatSnappy is followed by snappy compressed event JSON.
+	eventJSONFormatSnappy byte = 0x01
+)
+
+// encodeEventJSON returns event JSON in the form that it should be stored in
+// the event JSON table.
+func encodeEventJSON(eventJSON []byte, compress bool) []byte {
+	if !compress {
+		return eventJSON
+	}
+	encoded := make([]byte, 1+snappy.MaxEncodedLen(len(eventJSON)))
+	encoded[0] = eventJSONFormatSnappy
+	return encoded[:1+len(snappy.Encode(encoded[1:], eventJSON))]
+}
+
+// decodeEventJSON returns the event JSON from a row of the event JSON table,
+// whichever form it was stored in.
+func decodeEventJSON(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return stored, nil
+	}
+	switch stored[0] {
+	case eventJSONFormatSnappy:
+		eventJSON, err := snappy.Decode(nil, stored[1:])
+		if err != nil {
+			return nil, fmt.Errorf("snappy.Decode: %w", err)
+		}
+		return eventJSON, nil
+	default:
+		return stored, nil
+	}
+}
+
+// RecompressEventJSON rewrites the stored JSON of every event in the database so that
+// it is compressed, or so that it isn't if compress is false. The events are rewritten
+// in batches of batchSize events, each in its own transaction, so the work that has
+// been done is kept if this is interrupted and it can be run again to finish off.
+func (d *Database) RecompressEventJSON(
+	ctx context.Context, compress bool, batchSize int,
+) (stats types.EventJSONRecompressionStats, err error) {
+	if batchSize <= 0 {
+		return stats, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	var afterEventNID types.EventNID
+	for {
+		var batchLen int
+		err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+			batch, serr := d.EventJSONTable.SelectEventJSONAfter(ctx, txn, afterEventNID, batchSize)
+			if serr != nil {
+				return fmt.Errorf("d.EventJSONTable.SelectEventJSONAfter: %w", serr)
+			}
+			batchLen = len(batch)
+			for _, pair := range batch {
+				afterEventNID = pair.EventNID
+				eventJSON, derr := decodeEventJSON(pair.EventJSON)
+				if derr != nil {
+					return fmt.Errorf("decodeEventJSON for event NID %d: %w", pair.EventNID, derr)
+				}
+				encoded := encodeEventJSON(eventJSON, compress)
+				stats.Events++
+				stats.BytesBefore += int64(len(pair.EventJSON))
+				stats.BytesAfter += int64(len(encoded))
+				if string(encoded) == string(pair.EventJSON) {
+					continue
+				}
+				if uerr := d.EventJSONTable.UpdateEventJSON(ctx, txn, pair.EventNID, encoded); uerr != nil {
+					return fmt.Errorf("d.EventJSONTable.UpdateEventJSON: %w", uerr)
+				}
+				stats.Rewritten++
+			}
+			return nil
+		})
+		if err != nil || batchLen < batchSize {
+			return stats, err
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package shared
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEventJSONEncoding(t *testing.T) {
+	eventJSON := []byte(`{"content":{"body":"hello hello hello hello"},"room_id":"!room:localhost","type":"m.room.message"}`)
+
+	// Uncompressed event JSON is stored as it is, which is also how rows
+	// written before compression existed look.
+	if stored := encodeEventJSON(eventJSON, false); !bytes.Equal(stored, eventJSON) {
+		t.Fatalf("wanted uncompressed event JSON to be stored as it is, got %q", stored)
+	}
+	decoded, err := decodeEventJSON(eventJSON)
+	if err != nil {
+		t.Fatalf("decodeEventJSON failed: %s", err)
+	}
+	if !bytes.Equal(decoded, eventJSON) {
+		t.Fatalf("wanted %q, got %q", eventJSON, decoded)
+	}
+
+	stored := encodeEventJSON(eventJSON, true)
+	if stored[0] != eventJSONFormatSnappy {
+		t.Fatalf("wanted compressed event JSON to start with the snappy prefix, got %x", stored[0])
+	}
+	if len(stored) >= len(eventJSON) {
+		t.Fatalf("wanted compressed event JSON to be smaller, got %d bytes from %d", len(stored), len(eventJSON))
+	}
+	decoded, err = decodeEventJSON(stored)
+	if err != nil {
+		t.Fatalf("decodeEventJSON failed: %s", err)
+	}
+	if !bytes.Equal(decoded, eventJSON) {
+		t.Fatalf("wanted %q, got %q", eventJSON, decoded)
+	}
+
+	if _, err = decodeEventJSON([]byte{eventJSONFormatSnappy, 0xff, 0xff}); err == nil {
+		t.Fatalf("wanted an error decoding corrupt compressed event JSON")
+	}
+}
@@ -115,6 +115,11 @@ func (u *roomRecentEventsUpdater) MarkEventAsSent(eventNID types.EventNID) error
 	return u.d.EventsTable.UpdateEventSentToOutput(u.ctx, u.txn, eventNID)
 }
 
+// MarkEventAsSoftFailed implements types.RoomRecentEventsUpdater
+func (u *roomRecentEventsUpdater) MarkEventAsSoftFailed(eventNID types.EventNID) error {
+	return u.d.EventsTable.UpdateEventSoftFailed(u.ctx, u.txn, eventNID)
+}
+
 func (u *roomRecentEventsUpdater) MembershipUpdater(targetUserNID types.EventStateKeyNID, targetLocal bool) (types.MembershipUpdater, error) {
 	return u.d.membershipUpdaterTxn(u.ctx, u.txn, u.roomNID, targetUserNID, targetLocal)
 }
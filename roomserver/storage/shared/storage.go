@@ -26,6 +26,13 @@ type Database struct {
 	PrevEventsTable     tables.PreviousEvents
 	InvitesTable        tables.Invites
 	MembershipTable     tables.Membership
+	BlockedRoomsTable   tables.BlockedRooms
+	// Whether to compress event JSON when storing new events.
+	CompressEventJSON bool
+}
+
+func (d *Database) SetCompressEventJSON(compress bool) {
+	d.CompressEventJSON = compress
 }
 
 func (d *Database) EventTypeNIDs(
@@ -86,12 +93,230 @@ func (d *Database) AddState(
 	return
 }
 
+func (d *Database) StateSnapshotRoomNIDs(
+	ctx context.Context,
+) ([]types.RoomNID, error) {
+	return d.StateSnapshotTable.SelectStateSnapshotRoomNIDs(ctx)
+}
+
+func (d *Database) RoomStateBlockNIDs(
+	ctx context.Context, roomNID types.RoomNID,
+) ([]types.StateBlockNIDList, error) {
+	return d.StateSnapshotTable.SelectStateBlockNIDsForRoom(ctx, nil, roomNID)
+}
+
+func (d *Database) RewriteState(
+	ctx context.Context,
+	stateNID types.StateSnapshotNID,
+	stateBlockNIDs []types.StateBlockNID,
+	state []types.StateEntry,
+) (newStateBlockNIDs []types.StateBlockNID, err error) {
+	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		newStateBlockNIDs = stateBlockNIDs[:len(stateBlockNIDs):len(stateBlockNIDs)]
+		if len(state) > 0 {
+			stateBlockNID, err := d.StateBlockTable.BulkInsertStateData(ctx, txn, state)
+			if err != nil {
+				return err
+			}
+			newStateBlockNIDs = append(newStateBlockNIDs, stateBlockNID)
+		}
+		return d.StateSnapshotTable.UpdateStateBlockNIDs(ctx, txn, stateNID, newStateBlockNIDs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (d *Database) DeleteStateBlocks(
+	ctx context.Context, stateBlockNIDs []types.StateBlockNID,
+) error {
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		return d.StateBlockTable.BulkDeleteStateBlocks(ctx, txn, stateBlockNIDs)
+	})
+}
+
 func (d *Database) EventNIDs(
 	ctx context.Context, eventIDs []string,
 ) (map[string]types.EventNID, error) {
 	return d.EventsTable.BulkSelectEventNID(ctx, eventIDs)
 }
 
+func (d *Database) EventStatuses(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]types.EventStatus, error) {
+	return d.EventsTable.BulkSelectEventStatus(ctx, eventNIDs)
+}
+
+// purgeBatchSize is the number of events deleted in each transaction by
+// PurgeHistory, which keeps both the transactions and the number of query
+// parameters small.
+const purgeBatchSize = 500
+
+func (d *Database) PurgeHistory(
+	ctx context.Context, roomNID types.RoomNID, beforeDepth int64,
+) ([]string, error) {
+	candidateNIDs, err := d.EventsTable.SelectPurgeableEventNIDs(ctx, nil, roomNID, beforeDepth)
+	if err != nil {
+		return nil, err
+	}
+	// Never purge the forward extremities of the room, as new events will
+	// refer to them.
+	latestNIDs, _, err := d.RoomsTable.SelectLatestEventNIDs(ctx, nil, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	isLatest := make(map[types.EventNID]bool, len(latestNIDs))
+	for _, eventNID := range latestNIDs {
+		isLatest[eventNID] = true
+	}
+	eventNIDs := make([]types.EventNID, 0, len(candidateNIDs))
+	for _, eventNID := range candidateNIDs {
+		if !isLatest[eventNID] {
+			eventNIDs = append(eventNIDs, eventNID)
+		}
+	}
+
+	return d.purgeEvents(ctx, eventNIDs)
+}
+
+// purgeEvents deletes the JSON of the given events in batches of
+// purgeBatchSize and marks them as purged. The rows in the events table are
+// kept, as the events after them still refer to them through their
+// prev_events and auth events. Returns the IDs of the events that were
+// purged, which may be some of them even if an error is returned.
+func (d *Database) purgeEvents(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]string, error) {
+	var purgedEventIDs []string
+	for len(eventNIDs) > 0 {
+		batch := eventNIDs
+		if len(batch) > purgeBatchSize {
+			batch = batch[:purgeBatchSize]
+		}
+		eventNIDs = eventNIDs[len(batch):]
+		eventIDs, err := d.EventsTable.BulkSelectEventID(ctx, batch)
+		if err != nil {
+			return purgedEventIDs, err
+		}
+		err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+			if err = d.EventJSONTable.BulkDeleteEventJSON(ctx, txn, batch); err != nil {
+				return err
+			}
+			return d.EventsTable.BulkUpdateEventsPurged(ctx, txn, batch)
+		})
+		if err != nil {
+			return purgedEventIDs, err
+		}
+		for _, eventNID := range batch {
+			purgedEventIDs = append(purgedEventIDs, eventIDs[eventNID])
+		}
+	}
+	return purgedEventIDs, nil
+}
+
+func (d *Database) MessageEventNIDsByDepth(
+	ctx context.Context, roomNID types.RoomNID,
+	afterDepth int64, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectMessageEventNIDsByDepth(ctx, roomNID, afterDepth, afterEventNID, limit)
+}
+
+func (d *Database) RoomIDs(ctx context.Context) ([]string, error) {
+	return d.RoomsTable.SelectRoomIDs(ctx)
+}
+
+// DeleteRoom deletes the room and everything that belongs to it in a single
+// transaction, so that a failure leaves the room intact. The events are
+// deleted in batches of purgeBatchSize to keep the number of query
+// parameters small. Returns the IDs of the events that were deleted.
+func (d *Database) DeleteRoom(
+	ctx context.Context, roomID string, roomNID types.RoomNID,
+) ([]string, error) {
+	var deletedEventIDs []string
+	err := internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		eventIDs, err := d.EventsTable.SelectEventIDsForRoom(ctx, txn, roomNID)
+		if err != nil {
+			return err
+		}
+		eventNIDs := make([]types.EventNID, 0, len(eventIDs))
+		for eventNID := range eventIDs {
+			eventNIDs = append(eventNIDs, eventNID)
+		}
+		for len(eventNIDs) > 0 {
+			batch := eventNIDs
+			if len(batch) > purgeBatchSize {
+				batch = batch[:purgeBatchSize]
+			}
+			eventNIDs = eventNIDs[len(batch):]
+			batchEventIDs := make([]string, len(batch))
+			for i, eventNID := range batch {
+				batchEventIDs[i] = eventIDs[eventNID]
+			}
+			if err = d.EventJSONTable.BulkDeleteEventJSON(ctx, txn, batch); err != nil {
+				return err
+			}
+			if err = d.EventsTable.BulkDeleteEvents(ctx, txn, batch); err != nil {
+				return err
+			}
+			// Events only ever refer to earlier events in the same room, so
+			// nothing else can be referencing these.
+			if err = d.PrevEventsTable.BulkDeletePreviousEvents(ctx, txn, batchEventIDs); err != nil {
+				return err
+			}
+			deletedEventIDs = append(deletedEventIDs, batchEventIDs...)
+		}
+		stateBlockNIDLists, err := d.StateSnapshotTable.SelectStateBlockNIDsForRoom(ctx, txn, roomNID)
+		if err != nil {
+			return err
+		}
+		seen := make(map[types.StateBlockNID]bool)
+		var stateBlockNIDs []types.StateBlockNID
+		for _, list := range stateBlockNIDLists {
+			for _, stateBlockNID := range list.StateBlockNIDs {
+				if !seen[stateBlockNID] {
+					seen[stateBlockNID] = true
+					stateBlockNIDs = append(stateBlockNIDs, stateBlockNID)
+				}
+			}
+		}
+		if len(stateBlockNIDs) > 0 {
+			if err = d.StateBlockTable.BulkDeleteStateBlocks(ctx, txn, stateBlockNIDs); err != nil {
+				return err
+			}
+		}
+		if err = d.StateSnapshotTable.DeleteStateSnapshotsForRoom(ctx, txn, roomNID); err != nil {
+			return err
+		}
+		if err = d.InvitesTable.DeleteInvitesForRoom(ctx, txn, roomNID); err != nil {
+			return err
+		}
+		if err = d.MembershipTable.DeleteMembershipsForRoom(ctx, txn, roomNID); err != nil {
+			return err
+		}
+		if err = d.RoomAliasesTable.DeleteRoomAliasesForRoomID(ctx, txn, roomID); err != nil {
+			return err
+		}
+		return d.RoomsTable.DeleteRoom(ctx, txn, roomNID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deletedEventIDs, nil
+}
+
+func (d *Database) BlockRoom(
+	ctx context.Context, roomID, blockedBy string,
+) error {
+	return d.BlockedRoomsTable.InsertBlockedRoom(ctx, roomID, blockedBy)
+}
+
+func (d *Database) IsRoomBlocked(
+	ctx context.Context, roomID string,
+) (bool, error) {
+	return d.BlockedRoomsTable.SelectRoomBlocked(ctx, roomID)
+}
+
 func (d *Database) SetState(
 	ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID,
 ) error {
@@ -290,8 +515,13 @@ func (d *Database) Events(
 		if err != nil {
 			return nil, err
 		}
+		var rawJSON []byte
+		rawJSON, err = decodeEventJSON(eventJSON.EventJSON)
+		if err != nil {
+			return nil, err
+		}
 		result.Event, err = gomatrixserverlib.NewEventFromTrustedJSON(
-			eventJSON.EventJSON, false, roomVersion,
+			rawJSON, false, roomVersion,
 		)
 		if err != nil {
 			return nil, err
@@ -327,6 +557,7 @@ func (d *Database) GetLatestEventsForUpdate(
 func (d *Database) StoreEvent(
 	ctx context.Context, event gomatrixserverlib.Event,
 	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID,
+	isRejected bool,
 ) (types.RoomNID, types.StateAtEvent, error) {
 	var (
 		roomNID          types.RoomNID
@@ -388,6 +619,7 @@ func (d *Database) StoreEvent(
 			event.EventReference().EventSHA256,
 			authEventNIDs,
 			event.Depth(),
+			isRejected,
 		); err != nil {
 			if err == sql.ErrNoRows {
 				// We've already inserted the event so select the numeric event ID
@@ -398,7 +630,7 @@ func (d *Database) StoreEvent(
 			}
 		}
 
-		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
+		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, encodeEventJSON(event.JSON(), d.CompressEventJSON)); err != nil {
 			return err
 		}
 
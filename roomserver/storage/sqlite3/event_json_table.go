@@ -26,6 +26,8 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
+// Compressed event JSON is stored as a BLOB, which SQLite allows despite
+// the TEXT column type.
 const eventJSONSchema = `
   CREATE TABLE IF NOT EXISTS roomserver_event_json (
     event_nid INTEGER NOT NULL PRIMARY KEY,
@@ -47,10 +49,23 @@ const bulkSelectEventJSONSQL = `
 	  ORDER BY event_nid ASC
 `
 
+const bulkDeleteEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid IN ($1)"
+
+const selectEventJSONAfterSQL = "" +
+	"SELECT event_nid, event_json FROM roomserver_event_json" +
+	" WHERE event_nid > $1" +
+	" ORDER BY event_nid ASC LIMIT $2"
+
+const updateEventJSONSQL = "" +
+	"UPDATE roomserver_event_json SET event_json = $1 WHERE event_nid = $2"
+
 type eventJSONStatements struct {
-	db                      *sql.DB
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	db                       *sql.DB
+	insertEventJSONStmt      *sql.Stmt
+	bulkSelectEventJSONStmt  *sql.Stmt
+	selectEventJSONAfterStmt *sql.Stmt
+	updateEventJSONStmt      *sql.Stmt
 }
 
 func NewSqliteEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
@@ -63,6 +78,8 @@ func NewSqliteEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectEventJSONAfterStmt, selectEventJSONAfterSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -104,3 +121,49 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], nil
 }
+
+func (s *eventJSONStatements) BulkDeleteEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = v
+	}
+	deleteOrig := strings.Replace(bulkDeleteEventJSONSQL, "($1)", internal.QueryVariadic(len(iEventNIDs)), 1)
+	deleteStmt, err := txn.Prepare(deleteOrig)
+	if err != nil {
+		return err
+	}
+	_, err = deleteStmt.ExecContext(ctx, iEventNIDs...)
+	return err
+}
+
+func (s *eventJSONStatements) SelectEventJSONAfter(
+	ctx context.Context, txn *sql.Tx, afterEventNID types.EventNID, limit int,
+) ([]tables.EventJSONPair, error) {
+	stmt := internal.TxStmt(txn, s.selectEventJSONAfterStmt)
+	rows, err := stmt.QueryContext(ctx, int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventJSONAfter: rows.close() failed")
+	var results []tables.EventJSONPair
+	for rows.Next() {
+		var result tables.EventJSONPair
+		var eventNID int64
+		if err = rows.Scan(&eventNID, &result.EventJSON); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) UpdateEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	stmt := internal.TxStmt(txn, s.updateEventJSONStmt)
+	_, err := stmt.ExecContext(ctx, eventJSON, int64(eventNID))
+	return err
+}
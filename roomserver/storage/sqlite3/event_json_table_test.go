@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var _, testPrivateKey, _ = ed25519.GenerateKey(nil)
+
+func mustStoreTestEvent(
+	tb testing.TB, db *Database, eventType string, stateKey *string,
+	depth int64, content interface{},
+) gomatrixserverlib.Event {
+	tb.Helper()
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     "@alice:localhost",
+		RoomID:     "!compression:localhost",
+		Type:       eventType,
+		StateKey:   stateKey,
+		Depth:      depth,
+		PrevEvents: []gomatrixserverlib.EventReference{},
+		AuthEvents: []gomatrixserverlib.EventReference{},
+	}
+	if err := builder.SetContent(content); err != nil {
+		tb.Fatalf("SetContent failed: %s", err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", testPrivateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		tb.Fatalf("Build failed: %s", err)
+	}
+	if _, _, err = db.StoreEvent(context.Background(), ev, nil, nil, false); err != nil {
+		tb.Fatalf("StoreEvent failed: %s", err)
+	}
+	return ev
+}
+
+// storeTestMessages stores count message events in a room and returns their
+// event IDs. The room is created first if it doesn't exist yet.
+func storeTestMessages(tb testing.TB, db *Database, count int) []string {
+	tb.Helper()
+	roomNID, err := db.RoomNID(context.Background(), "!compression:localhost")
+	if err != nil {
+		tb.Fatalf("RoomNID failed: %s", err)
+	}
+	if roomNID == 0 {
+		emptyKey := ""
+		mustStoreTestEvent(tb, db, gomatrixserverlib.MRoomCreate, &emptyKey, 1, map[string]interface{}{
+			"creator":      "@alice:localhost",
+			"room_version": "4",
+		})
+	}
+	eventIDs := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		ev := mustStoreTestEvent(tb, db, "m.room.message", nil, int64(i+2), map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    fmt.Sprintf("message %d: %s", i, strings.Repeat("lorem ipsum dolor sit amet ", 20)),
+		})
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	return eventIDs
+}
+
+func mustOpen(tb testing.TB) *Database {
+	tb.Helper()
+	db, err := Open("file::memory:")
+	if err != nil {
+		tb.Fatalf("Open failed: %s", err)
+	}
+	return db
+}
+
+func TestRecompressEventJSON(t *testing.T) {
+	ctx := context.Background()
+	db := mustOpen(t)
+
+	// Store some events uncompressed and some compressed, as would happen
+	// if compression was turned on part way through.
+	eventIDs := storeTestMessages(t, db, 5)
+	db.SetCompressEventJSON(true)
+	eventIDs = append(eventIDs, storeTestMessages(t, db, 5)...)
+
+	stats, err := db.RecompressEventJSON(ctx, true, 3)
+	if err != nil {
+		t.Fatalf("RecompressEventJSON failed: %s", err)
+	}
+	if stats.Events != 11 || stats.Rewritten != 6 {
+		t.Fatalf("wanted 11 events with 6 rewritten, got %+v", stats)
+	}
+	if stats.BytesAfter >= stats.BytesBefore {
+		t.Fatalf("wanted compression to save space, got %+v", stats)
+	}
+
+	events, err := db.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatalf("EventsFromIDs failed: %s", err)
+	}
+	if len(events) != len(eventIDs) {
+		t.Fatalf("wanted %d events, got %d", len(eventIDs), len(events))
+	}
+
+	// Everything can be decompressed again too.
+	undone, err := db.RecompressEventJSON(ctx, false, 100)
+	if err != nil {
+		t.Fatalf("RecompressEventJSON failed: %s", err)
+	}
+	if undone.Rewritten != 11 || undone.BytesAfter <= undone.BytesBefore {
+		t.Fatalf("wanted all 11 events to be decompressed, got %+v", undone)
+	}
+	events, err = db.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatalf("EventsFromIDs failed: %s", err)
+	}
+	if len(events) != len(eventIDs) {
+		t.Fatalf("wanted %d events, got %d", len(eventIDs), len(events))
+	}
+}
+
+func benchmarkEventsFromIDs(b *testing.B, compress bool) {
+	ctx := context.Background()
+	db := mustOpen(b)
+	db.SetCompressEventJSON(compress)
+	eventIDs := storeTestMessages(b, db, 100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.EventsFromIDs(ctx, eventIDs); err != nil {
+			b.Fatalf("EventsFromIDs failed: %s", err)
+		}
+	}
+}
+
+func BenchmarkEventsFromIDsUncompressed(b *testing.B) {
+	benchmarkEventsFromIDs(b, false)
+}
+
+func BenchmarkEventsFromIDsCompressed(b *testing.B) {
+	benchmarkEventsFromIDs(b, true)
+}
@@ -40,13 +40,31 @@ const eventsSchema = `
     depth INTEGER NOT NULL,
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
-    auth_event_nids TEXT NOT NULL DEFAULT '[]'
+    auth_event_nids TEXT NOT NULL DEFAULT '[]',
+    is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+    is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE,
+    is_purged BOOLEAN NOT NULL DEFAULT FALSE
   );
 `
 
+// Older databases don't have the columns for rejected, soft-failed and purged
+// events.
+// SQLite doesn't support ADD COLUMN IF NOT EXISTS, so check for them first.
+var eventsMigrations = []struct {
+	column     string
+	definition string
+}{
+	{"is_rejected", "is_rejected BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"is_soft_failed", "is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"is_purged", "is_purged BOOLEAN NOT NULL DEFAULT FALSE"},
+}
+
+const selectEventsColumnExistsSQL = "" +
+	"SELECT COUNT(*) FROM pragma_table_info('roomserver_events') WHERE name = $1"
+
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	  ON CONFLICT DO NOTHING;
 `
 
@@ -93,9 +111,37 @@ const bulkSelectEventNIDSQL = "" +
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid IN ($1)"
 
+const updateEventSoftFailedSQL = "" +
+	"UPDATE roomserver_events SET is_soft_failed = TRUE WHERE event_nid = $1"
+
+const bulkSelectEventStatusSQL = "" +
+	"SELECT event_nid, is_rejected, is_soft_failed FROM roomserver_events WHERE event_nid IN ($1)"
+
+// Select the non-state events in a room which are topologically before a point.
+const selectPurgeableEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND depth < $2 AND event_state_key_nid = 0" +
+	" AND is_purged = FALSE"
+
+// Page through the non-state events in a room in topological order.
+const selectMessageEventNIDsByDepthSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND event_state_key_nid = 0 AND is_purged = FALSE" +
+	" AND (depth > $2 OR (depth = $2 AND event_nid > $3))" +
+	" ORDER BY depth ASC, event_nid ASC LIMIT $4"
+
+const bulkUpdateEventsPurgedSQL = "" +
+	"UPDATE roomserver_events SET is_purged = TRUE WHERE event_nid IN ($1)"
+
+const bulkDeleteEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid IN ($1)"
+
 const selectRoomNIDForEventNIDSQL = "" +
 	"SELECT room_nid FROM roomserver_events WHERE event_nid = $1"
 
+const selectEventIDsForRoomSQL = "" +
+	"SELECT event_nid, event_id FROM roomserver_events WHERE room_nid = $1"
+
 type eventStatements struct {
 	db                                     *sql.DB
 	insertEventStmt                        *sql.Stmt
@@ -110,7 +156,11 @@ type eventStatements struct {
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
+	updateEventSoftFailedStmt              *sql.Stmt
+	selectPurgeableEventNIDsStmt           *sql.Stmt
+	selectMessageEventNIDsByDepthStmt      *sql.Stmt
 	selectRoomNIDForEventNIDStmt           *sql.Stmt
+	selectEventIDsForRoomStmt              *sql.Stmt
 }
 
 func NewSqliteEventsTable(db *sql.DB) (tables.Events, error) {
@@ -120,6 +170,9 @@ func NewSqliteEventsTable(db *sql.DB) (tables.Events, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = migrateEventsTable(db); err != nil {
+		return nil, err
+	}
 
 	return s, shared.StatementList{
 		{&s.insertEventStmt, insertEventSQL},
@@ -134,10 +187,30 @@ func NewSqliteEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
+		{&s.updateEventSoftFailedStmt, updateEventSoftFailedSQL},
+		{&s.selectPurgeableEventNIDsStmt, selectPurgeableEventNIDsSQL},
+		{&s.selectMessageEventNIDsByDepthStmt, selectMessageEventNIDsByDepthSQL},
 		{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
+		{&s.selectEventIDsForRoomStmt, selectEventIDsForRoomSQL},
 	}.Prepare(db)
 }
 
+func migrateEventsTable(db *sql.DB) error {
+	for _, m := range eventsMigrations {
+		var count int
+		if err := db.QueryRow(selectEventsColumnExistsSQL, m.column).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE roomserver_events ADD COLUMN " + m.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *eventStatements) InsertEvent(
 	ctx context.Context,
 	txn *sql.Tx,
@@ -148,12 +221,13 @@ func (s *eventStatements) InsertEvent(
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	isRejected bool,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	insertStmt := internal.TxStmt(txn, s.insertEventStmt)
 	result, err := insertStmt.ExecContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected,
 	)
 	if err != nil {
 		return 0, 0, err
@@ -469,6 +543,122 @@ func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx,
 	return result, nil
 }
 
+func (s *eventStatements) UpdateEventSoftFailed(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) error {
+	stmt := internal.TxStmt(txn, s.updateEventSoftFailedStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
+
+// bulkSelectEventStatus returns whether each of the events was rejected or soft-failed.
+// Events which aren't in the database are omitted from the map.
+func (s *eventStatements) BulkSelectEventStatus(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]types.EventStatus, error) {
+	///////////////
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = v
+	}
+	selectOrig := strings.Replace(bulkSelectEventStatusSQL, "($1)", internal.QueryVariadic(len(iEventNIDs)), 1)
+	selectStmt, err := s.db.Prepare(selectOrig)
+	if err != nil {
+		return nil, err
+	}
+	///////////////
+
+	rows, err := selectStmt.QueryContext(ctx, iEventNIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectEventStatus: rows.close() failed")
+	results := make(map[types.EventNID]types.EventStatus, len(eventNIDs))
+	for rows.Next() {
+		var eventNID int64
+		var status types.EventStatus
+		if err = rows.Scan(&eventNID, &status.Rejected, &status.SoftFailed); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = status
+	}
+	return results, rows.Err()
+}
+
+func (s *eventStatements) SelectPurgeableEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, beforeDepth int64,
+) ([]types.EventNID, error) {
+	stmt := internal.TxStmt(txn, s.selectPurgeableEventNIDsStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID), beforeDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPurgeableEventNIDs: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectMessageEventNIDsByDepth(
+	ctx context.Context, roomNID types.RoomNID,
+	afterDepth int64, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectMessageEventNIDsByDepthStmt.QueryContext(
+		ctx, int64(roomNID), afterDepth, int64(afterEventNID), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMessageEventNIDsByDepth: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) BulkUpdateEventsPurged(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = v
+	}
+	updateOrig := strings.Replace(bulkUpdateEventsPurgedSQL, "($1)", internal.QueryVariadic(len(iEventNIDs)), 1)
+	updateStmt, err := txn.Prepare(updateOrig)
+	if err != nil {
+		return err
+	}
+	_, err = updateStmt.ExecContext(ctx, iEventNIDs...)
+	return err
+}
+
+func (s *eventStatements) BulkDeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = v
+	}
+	deleteOrig := strings.Replace(bulkDeleteEventsSQL, "($1)", internal.QueryVariadic(len(iEventNIDs)), 1)
+	deleteStmt, err := txn.Prepare(deleteOrig)
+	if err != nil {
+		return err
+	}
+	_, err = deleteStmt.ExecContext(ctx, iEventNIDs...)
+	return err
+}
+
 func (s *eventStatements) SelectRoomNIDForEventNID(
 	ctx context.Context, eventNID types.EventNID,
 ) (roomNID types.RoomNID, err error) {
@@ -480,3 +670,24 @@ func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
 }
+
+func (s *eventStatements) SelectEventIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (map[types.EventNID]string, error) {
+	stmt := internal.TxStmt(txn, s.selectEventIDsForRoomStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventIDsForRoom: rows.close() failed")
+	results := make(map[types.EventNID]string)
+	for rows.Next() {
+		var eventNID int64
+		var eventID string
+		if err = rows.Scan(&eventNID, &eventID); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = eventID
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal"
+)
+
+// The events table from before rejected, soft-failed and purged events were
+// stored.
+const oldEventsSchema = `
+  CREATE TABLE roomserver_events (
+    event_nid INTEGER PRIMARY KEY AUTOINCREMENT,
+    room_nid INTEGER NOT NULL,
+    event_type_nid INTEGER NOT NULL,
+    event_state_key_nid INTEGER NOT NULL,
+    sent_to_output BOOLEAN NOT NULL DEFAULT FALSE,
+    state_snapshot_nid INTEGER NOT NULL DEFAULT 0,
+    depth INTEGER NOT NULL,
+    event_id TEXT NOT NULL UNIQUE,
+    reference_sha256 BLOB NOT NULL,
+    auth_event_nids TEXT NOT NULL DEFAULT '[]'
+  );
+  INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, depth, event_id, reference_sha256)
+    VALUES (1, 1, 1, 1, '$old:localhost', x'00');
+`
+
+func TestEventsTableMigratesOldDatabases(t *testing.T) {
+	db, err := sql.Open(internal.SQLiteDriverName(), "file::memory:")
+	if err != nil {
+		t.Fatalf("sql.Open failed: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	// Every connection to an in-memory database gets its own database.
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(oldEventsSchema); err != nil {
+		t.Fatalf("failed to create old events table: %s", err)
+	}
+
+	// Opening the table twice checks that the migration can be run again.
+	for i := 0; i < 2; i++ {
+		if _, err = NewSqliteEventsTable(db); err != nil {
+			t.Fatalf("NewSqliteEventsTable failed: %s", err)
+		}
+	}
+
+	var isRejected, isSoftFailed, isPurged bool
+	if err = db.QueryRow(
+		"SELECT is_rejected, is_soft_failed, is_purged FROM roomserver_events WHERE event_id = '$old:localhost'",
+	).Scan(&isRejected, &isSoftFailed, &isPurged); err != nil {
+		t.Fatalf("failed to select migrated columns: %s", err)
+	}
+	if isRejected || isSoftFailed || isPurged {
+		t.Errorf("expected existing events to be neither rejected, soft-failed nor purged")
+	}
+}
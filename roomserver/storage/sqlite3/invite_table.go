@@ -61,11 +61,15 @@ const selectInvitesAboutToRetireSQL = `
 SELECT invite_event_id FROM roomserver_invites WHERE room_nid = $1 AND target_nid = $2 AND NOT retired
 `
 
+const deleteInvitesForRoomSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
 type inviteStatements struct {
 	insertInviteEventStmt               *sql.Stmt
 	selectInviteActiveForUserInRoomStmt *sql.Stmt
 	updateInviteRetiredStmt             *sql.Stmt
 	selectInvitesAboutToRetireStmt      *sql.Stmt
+	deleteInvitesForRoomStmt            *sql.Stmt
 }
 
 func NewSqliteInvitesTable(db *sql.DB) (tables.Invites, error) {
@@ -80,6 +84,7 @@ func NewSqliteInvitesTable(db *sql.DB) (tables.Invites, error) {
 		{&s.selectInviteActiveForUserInRoomStmt, selectInviteActiveForUserInRoomSQL},
 		{&s.updateInviteRetiredStmt, updateInviteRetiredSQL},
 		{&s.selectInvitesAboutToRetireStmt, selectInvitesAboutToRetireSQL},
+		{&s.deleteInvitesForRoomStmt, deleteInvitesForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -150,3 +155,10 @@ func (s *inviteStatements) SelectInviteActiveForUserInRoom(
 	}
 	return result, nil
 }
+
+func (s *inviteStatements) DeleteInvitesForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	_, err := internal.TxStmt(txn, s.deleteInvitesForRoomStmt).ExecContext(ctx, int64(roomNID))
+	return err
+}
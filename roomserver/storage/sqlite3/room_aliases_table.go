@@ -54,12 +54,17 @@ const deleteRoomAliasSQL = `
 	DELETE FROM roomserver_room_aliases WHERE alias = $1
 `
 
+const deleteRoomAliasesForRoomIDSQL = `
+	DELETE FROM roomserver_room_aliases WHERE room_id = $1
+`
+
 type roomAliasesStatements struct {
 	insertRoomAliasStmt          *sql.Stmt
 	selectRoomIDFromAliasStmt    *sql.Stmt
 	selectAliasesFromRoomIDStmt  *sql.Stmt
 	selectCreatorIDFromAliasStmt *sql.Stmt
 	deleteRoomAliasStmt          *sql.Stmt
+	deleteRoomAliasesForRoomStmt *sql.Stmt
 }
 
 func NewSqliteRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
@@ -74,6 +79,7 @@ func NewSqliteRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
 		{&s.selectAliasesFromRoomIDStmt, selectAliasesFromRoomIDSQL},
 		{&s.selectCreatorIDFromAliasStmt, selectCreatorIDFromAliasSQL},
 		{&s.deleteRoomAliasStmt, deleteRoomAliasSQL},
+		{&s.deleteRoomAliasesForRoomStmt, deleteRoomAliasesForRoomIDSQL},
 	}.Prepare(db)
 }
 
@@ -133,3 +139,11 @@ func (s *roomAliasesStatements) DeleteRoomAlias(
 	_, err = s.deleteRoomAliasStmt.ExecContext(ctx, alias)
 	return
 }
+
+func (s *roomAliasesStatements) DeleteRoomAliasesForRoomID(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	stmt := internal.TxStmt(txn, s.deleteRoomAliasesForRoomStmt)
+	_, err = stmt.ExecContext(ctx, roomID)
+	return
+}
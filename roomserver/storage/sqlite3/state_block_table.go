@@ -71,6 +71,9 @@ const bulkSelectFilteredStateBlockEntriesSQL = "" +
 	" AND event_type_nid IN ($2) AND event_state_key_nid IN ($3)" +
 	" ORDER BY state_block_nid, event_type_nid, event_state_key_nid"
 
+const bulkDeleteStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid IN ($1)"
+
 type stateBlockStatements struct {
 	db                                      *sql.DB
 	insertStateDataStmt                     *sql.Stmt
@@ -294,3 +297,20 @@ type int64Sorter []int64
 func (s int64Sorter) Len() int           { return len(s) }
 func (s int64Sorter) Less(i, j int) bool { return s[i] < s[j] }
 func (s int64Sorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (s *stateBlockStatements) BulkDeleteStateBlocks(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs []types.StateBlockNID,
+) error {
+	nids := make([]interface{}, len(stateBlockNIDs))
+	for k, v := range stateBlockNIDs {
+		nids[k] = v
+	}
+	deleteOrig := strings.Replace(bulkDeleteStateBlocksSQL, "($1)", internal.QueryVariadic(len(nids)), 1)
+	deleteStmt, err := txn.Prepare(deleteOrig)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, deleteStmt, "bulkDeleteStateBlocks: stmt.close() failed")
+	_, err = deleteStmt.ExecContext(ctx, nids...)
+	return err
+}
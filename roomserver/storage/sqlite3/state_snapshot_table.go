@@ -47,10 +47,27 @@ const bulkSelectStateBlockNIDsSQL = "" +
 	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
 	" WHERE state_snapshot_nid IN ($1) ORDER BY state_snapshot_nid ASC"
 
+const selectStateSnapshotRoomNIDsSQL = "" +
+	"SELECT DISTINCT room_nid FROM roomserver_state_snapshots ORDER BY room_nid ASC"
+
+const selectStateBlockNIDsForRoomSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE room_nid = $1 ORDER BY state_snapshot_nid ASC"
+
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_block_nids = $1 WHERE state_snapshot_nid = $2"
+
+const deleteStateSnapshotsForRoomSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
 type stateSnapshotStatements struct {
-	db                           *sql.DB
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
+	db                              *sql.DB
+	insertStateStmt                 *sql.Stmt
+	bulkSelectStateBlockNIDsStmt    *sql.Stmt
+	selectStateSnapshotRoomNIDsStmt *sql.Stmt
+	selectStateBlockNIDsForRoomStmt *sql.Stmt
+	updateStateBlockNIDsStmt        *sql.Stmt
+	deleteStateSnapshotsForRoomStmt *sql.Stmt
 }
 
 func NewSqliteStateSnapshotTable(db *sql.DB) (tables.StateSnapshot, error) {
@@ -64,6 +81,10 @@ func NewSqliteStateSnapshotTable(db *sql.DB) (tables.StateSnapshot, error) {
 	return s, shared.StatementList{
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
+		{&s.selectStateSnapshotRoomNIDsStmt, selectStateSnapshotRoomNIDsSQL},
+		{&s.selectStateBlockNIDsForRoomStmt, selectStateBlockNIDsForRoomSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
+		{&s.deleteStateSnapshotsForRoomStmt, deleteStateSnapshotsForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -120,3 +141,64 @@ func (s *stateSnapshotStatements) BulkSelectStateBlockNIDs(
 	}
 	return results, nil
 }
+
+func (s *stateSnapshotStatements) SelectStateSnapshotRoomNIDs(
+	ctx context.Context,
+) ([]types.RoomNID, error) {
+	rows, err := s.selectStateSnapshotRoomNIDsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateSnapshotRoomNIDs: rows.close() failed")
+	var roomNIDs []types.RoomNID
+	for rows.Next() {
+		var roomNID types.RoomNID
+		if err = rows.Scan(&roomNID); err != nil {
+			return nil, err
+		}
+		roomNIDs = append(roomNIDs, roomNID)
+	}
+	return roomNIDs, rows.Err()
+}
+
+func (s *stateSnapshotStatements) SelectStateBlockNIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.StateBlockNIDList, error) {
+	stmt := internal.TxStmt(txn, s.selectStateBlockNIDsForRoomStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateBlockNIDsForRoom: rows.close() failed")
+	var results []types.StateBlockNIDList
+	for rows.Next() {
+		var result types.StateBlockNIDList
+		var stateBlockNIDsJSON string
+		if err = rows.Scan(&result.StateSnapshotNID, &stateBlockNIDsJSON); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &result.StateBlockNIDs); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID,
+) error {
+	stateBlockNIDsJSON, err := json.Marshal(stateBlockNIDs)
+	if err != nil {
+		return err
+	}
+	_, err = internal.TxStmt(txn, s.updateStateBlockNIDsStmt).ExecContext(ctx, string(stateBlockNIDsJSON), int64(stateNID))
+	return err
+}
+
+func (s *stateSnapshotStatements) DeleteStateSnapshotsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	_, err := internal.TxStmt(txn, s.deleteStateSnapshotsForRoomStmt).ExecContext(ctx, int64(roomNID))
+	return err
+}
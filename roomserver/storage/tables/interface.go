@@ -16,6 +16,11 @@ type EventJSONPair struct {
 type EventJSON interface {
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
 	BulkSelectEventJSON(ctx context.Context, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	BulkDeleteEventJSON(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
+	// SelectEventJSONAfter returns up to limit events with a numeric event ID
+	// greater than afterEventNID, in numeric event ID order.
+	SelectEventJSONAfter(ctx context.Context, txn *sql.Tx, afterEventNID types.EventNID, limit int) ([]EventJSONPair, error)
+	UpdateEventJSON(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
 }
 
 type EventTypes interface {
@@ -32,7 +37,7 @@ type EventStateKeys interface {
 }
 
 type Events interface {
-	InsertEvent(c context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string, referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64) (types.EventNID, types.StateSnapshotNID, error)
+	InsertEvent(c context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string, referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected bool) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	// bulkSelectStateEventByID lookups a list of state events by event ID.
 	// If any of the requested events are missing from the database it returns a types.MissingEventError
@@ -54,6 +59,23 @@ type Events interface {
 	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDForEventNID(ctx context.Context, eventNID types.EventNID) (roomNID types.RoomNID, err error)
+	UpdateEventSoftFailed(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
+	// BulkSelectEventStatus returns whether each event was rejected or soft-failed.
+	// If an event NID is not in the database then it is omitted from the map.
+	BulkSelectEventStatus(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]types.EventStatus, error)
+	// SelectPurgeableEventNIDs returns the non-state events in the room with a depth lower than beforeDepth
+	// which haven't been purged already.
+	SelectPurgeableEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, beforeDepth int64) ([]types.EventNID, error)
+	// SelectMessageEventNIDsByDepth returns up to limit non-state events in the room which come after the
+	// given depth and event NID and haven't been purged, sorted by depth and then by event NID.
+	SelectMessageEventNIDsByDepth(ctx context.Context, roomNID types.RoomNID, afterDepth int64, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// BulkUpdateEventsPurged marks the events as purged. The rows are kept so that the events which
+	// refer to them through their prev_events and auth events can still find them.
+	BulkUpdateEventsPurged(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
+	BulkDeleteEvents(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
+	// SelectEventIDsForRoom returns the IDs of all of the events in the room,
+	// including state events, keyed by their numeric IDs.
+	SelectEventIDsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (map[types.EventNID]string, error)
 }
 
 type Rooms interface {
@@ -64,6 +86,8 @@ type Rooms interface {
 	UpdateLatestEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID, lastEventSentNID types.EventNID, stateSnapshotNID types.StateSnapshotNID) error
 	SelectRoomVersionForRoomID(ctx context.Context, txn *sql.Tx, roomID string) (gomatrixserverlib.RoomVersion, error)
 	SelectRoomVersionForRoomNID(ctx context.Context, roomNID types.RoomNID) (gomatrixserverlib.RoomVersion, error)
+	SelectRoomIDs(ctx context.Context) ([]string, error)
+	DeleteRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) error
 }
 
 type Transactions interface {
@@ -74,12 +98,19 @@ type Transactions interface {
 type StateSnapshot interface {
 	InsertState(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID) (stateNID types.StateSnapshotNID, err error)
 	BulkSelectStateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error)
+	// SelectStateSnapshotRoomNIDs returns the NIDs of all the rooms which have state snapshots.
+	SelectStateSnapshotRoomNIDs(ctx context.Context) ([]types.RoomNID, error)
+	// SelectStateBlockNIDsForRoom returns the state block NIDs of every state snapshot in the room, sorted by state snapshot NID.
+	SelectStateBlockNIDsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) ([]types.StateBlockNIDList, error)
+	UpdateStateBlockNIDs(ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID) error
+	DeleteStateSnapshotsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) error
 }
 
 type StateBlock interface {
 	BulkInsertStateData(ctx context.Context, txn *sql.Tx, entries []types.StateEntry) (types.StateBlockNID, error)
 	BulkSelectStateBlockEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error)
 	BulkSelectFilteredStateBlockEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple) ([]types.StateEntryList, error)
+	BulkDeleteStateBlocks(ctx context.Context, txn *sql.Tx, stateBlockNIDs []types.StateBlockNID) error
 }
 
 type RoomAliases interface {
@@ -88,6 +119,8 @@ type RoomAliases interface {
 	SelectAliasesFromRoomID(ctx context.Context, roomID string) ([]string, error)
 	SelectCreatorIDFromAlias(ctx context.Context, alias string) (creatorID string, err error)
 	DeleteRoomAlias(ctx context.Context, alias string) (err error)
+	// DeleteRoomAliasesForRoomID deletes every alias of the room, including those on remote servers.
+	DeleteRoomAliasesForRoomID(ctx context.Context, txn *sql.Tx, roomID string) (err error)
 }
 
 type PreviousEvents interface {
@@ -95,6 +128,7 @@ type PreviousEvents interface {
 	// Check if the event reference exists
 	// Returns sql.ErrNoRows if the event reference doesn't exist.
 	SelectPreviousEventExists(ctx context.Context, txn *sql.Tx, eventID string, eventReferenceSHA256 []byte) error
+	BulkDeletePreviousEvents(ctx context.Context, txn *sql.Tx, previousEventIDs []string) error
 }
 
 type Invites interface {
@@ -102,6 +136,7 @@ type Invites interface {
 	UpdateInviteRetired(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) ([]string, error)
 	// SelectInviteActiveForUserInRoom returns a list of sender state key NIDs
 	SelectInviteActiveForUserInRoom(ctx context.Context, targetUserNID types.EventStateKeyNID, roomNID types.RoomNID) ([]types.EventStateKeyNID, error)
+	DeleteInvitesForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) error
 }
 
 type MembershipState int64
@@ -119,4 +154,10 @@ type Membership interface {
 	SelectMembershipsFromRoom(ctx context.Context, roomNID types.RoomNID, localOnly bool) (eventNIDs []types.EventNID, err error)
 	SelectMembershipsFromRoomAndMembership(ctx context.Context, roomNID types.RoomNID, membership MembershipState, localOnly bool) (eventNIDs []types.EventNID, err error)
 	UpdateMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership MembershipState, eventNID types.EventNID) error
+	DeleteMembershipsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) error
+}
+
+type BlockedRooms interface {
+	InsertBlockedRoom(ctx context.Context, roomID, blockedBy string) error
+	SelectRoomBlocked(ctx context.Context, roomID string) (bool, error)
 }
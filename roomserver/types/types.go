@@ -106,6 +106,16 @@ type Event struct {
 	gomatrixserverlib.Event
 }
 
+// EventStatus records the outcome of the auth checks for an event.
+type EventStatus struct {
+	// The event failed the auth checks against its auth events.
+	Rejected bool
+	// The event passed the auth checks against the state before it but
+	// failed them against the current state of the room at the time that
+	// it was received.
+	SoftFailed bool
+}
+
 const (
 	// MRoomCreateNID is the numeric ID for the "m.room.create" event type.
 	MRoomCreateNID = 1
@@ -170,6 +180,9 @@ type RoomRecentEventsUpdater interface {
 	HasEventBeenSent(eventNID EventNID) (bool, error)
 	// Mark the event as having been sent to the output logs.
 	MarkEventAsSent(eventNID EventNID) error
+	// Mark the event as soft-failed, i.e. it passed the auth checks against the
+	// state before it but failed them against the current state of the room.
+	MarkEventAsSoftFailed(eventNID EventNID) error
 	// Build a membership updater for the target user in this room.
 	// It will share the same transaction as this updater.
 	MembershipUpdater(targetUserNID EventStateKeyNID, isTargetLocalUser bool) (MembershipUpdater, error)
@@ -207,3 +220,15 @@ type MembershipUpdater interface {
 type MissingEventError string
 
 func (e MissingEventError) Error() string { return string(e) }
+
+// EventJSONRecompressionStats describes the work done when rewriting the
+// stored JSON of events.
+type EventJSONRecompressionStats struct {
+	// The number of events that were looked at.
+	Events int
+	// The number of events whose stored JSON was rewritten.
+	Rewritten int
+	// The total size of the stored JSON of the events before and after.
+	BytesBefore int64
+	BytesAfter  int64
+}
@@ -1,8 +1,10 @@
 package serverkeyapi
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/base64"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/basecomponent"
 	"github.com/matrix-org/dendrite/serverkeyapi/api"
@@ -29,6 +31,26 @@ func SetupServerKeyAPIComponent(
 		logrus.WithError(err).Panicf("failed to connect to server key database")
 	}
 
+	// Store the keys of our virtual hosts too, so that we don't end up
+	// making HTTP requests to ourselves to find them.
+	for _, vhost := range base.Cfg.Matrix.VirtualHosts {
+		err = innerDB.StoreKeys(
+			context.Background(),
+			map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+				{ServerName: vhost.ServerName, KeyID: vhost.KeyID}: {
+					VerifyKey: gomatrixserverlib.VerifyKey{
+						Key: gomatrixserverlib.Base64Bytes(vhost.PrivateKey.Public().(ed25519.PublicKey)),
+					},
+					ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(100 * 365 * 24 * time.Hour)),
+					ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				},
+			},
+		)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to store keys for virtual host %q", vhost.ServerName)
+		}
+	}
+
 	serverKeyDB, err := cache.NewKeyDatabase(innerDB, base.Caches)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to set up caching wrapper for server key database")
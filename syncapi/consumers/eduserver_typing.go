@@ -15,6 +15,7 @@
 package consumers
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/Shopify/sarama"
@@ -65,7 +66,7 @@ func (s *OutputTypingEventConsumer) Start() error {
 	s.db.SetTypingTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
 		s.notifier.OnNewEvent(
 			nil, roomID, nil,
-			types.NewStreamToken(0, types.StreamPosition(latestSyncPosition)),
+			types.StreamingToken{TypingPosition: types.StreamPosition(latestSyncPosition)},
 		)
 	})
 
@@ -87,13 +88,19 @@ func (s *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 	}).Debug("received data from EDU server")
 
 	var typingPos types.StreamPosition
+	var err error
 	typingEvent := output.Event
 	if typingEvent.Typing {
-		typingPos = s.db.AddTypingUser(typingEvent.UserID, typingEvent.RoomID, output.ExpireTime)
+		typingPos, err = s.db.AddTypingUser(context.TODO(), typingEvent.UserID, typingEvent.RoomID, output.ExpireTime)
 	} else {
-		typingPos = s.db.RemoveTypingUser(typingEvent.UserID, typingEvent.RoomID)
+		typingPos, err = s.db.RemoveTypingUser(context.TODO(), typingEvent.UserID, typingEvent.RoomID)
+	}
+	if err != nil {
+		// The typing cache has still been updated, so carry on and notify
+		// anyone who is syncing.
+		log.WithError(err).Warn("failed to persist typing notification")
 	}
 
-	s.notifier.OnNewEvent(nil, output.Event.RoomID, nil, types.NewStreamToken(0, typingPos))
+	s.notifier.OnNewEvent(nil, output.Event.RoomID, nil, types.StreamingToken{TypingPosition: typingPos})
 	return nil
 }
@@ -87,6 +87,8 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onNewInviteEvent(context.TODO(), *output.NewInviteEvent)
 	case api.OutputTypeRetireInviteEvent:
 		return s.onRetireInviteEvent(context.TODO(), *output.RetireInviteEvent)
+	case api.OutputTypePurgeHistory:
+		return s.onPurgeHistory(context.TODO(), *output.PurgeHistory)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -146,7 +148,7 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}).Panicf("roomserver output log: write event failure")
 		return nil
 	}
-	s.notifier.OnNewEvent(&ev, "", nil, types.NewStreamToken(pduPos, 0))
+	s.notifier.OnNewEvent(&ev, "", nil, types.StreamingToken{PDUPosition: pduPos})
 
 	return nil
 }
@@ -164,7 +166,7 @@ func (s *OutputRoomEventConsumer) onNewInviteEvent(
 		}).Panicf("roomserver output log: write invite failure")
 		return nil
 	}
-	s.notifier.OnNewEvent(&msg.Event, "", nil, types.NewStreamToken(pduPos, 0))
+	s.notifier.OnNewEvent(&msg.Event, "", nil, types.StreamingToken{InvitePosition: pduPos})
 	return nil
 }
 
@@ -185,6 +187,37 @@ func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 	return nil
 }
 
+// onPurgeHistory deletes the purged events from the sync API database. Once
+// the final batch of a purge has been handled, the sync snapshots of the users
+// in the room are invalidated, since they may still refer to purged events.
+func (s *OutputRoomEventConsumer) onPurgeHistory(
+	ctx context.Context, msg api.OutputPurgeHistory,
+) error {
+	err := s.db.PurgeEvents(ctx, msg.EventIDs)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: purge history failure")
+		return nil
+	}
+	if !msg.Final {
+		return nil
+	}
+	joinedUsers, err := s.db.AllJoinedUsersInRooms(ctx)
+	if err != nil {
+		log.WithError(err).Error("roomserver output log: failed to get joined users")
+		return nil
+	}
+	for _, userID := range joinedUsers[msg.RoomID] {
+		if err = s.db.InvalidateSyncSnapshots(ctx, userID); err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("roomserver output log: failed to invalidate sync snapshots")
+		}
+	}
+	return nil
+}
+
 // lookupStateEvents looks up the state events that are added by a new event.
 func (s *OutputRoomEventConsumer) lookupStateEvents(
 	addsStateEventIDs []string, event gomatrixserverlib.HeaderedEvent,
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
@@ -29,6 +30,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 type messagesReq struct {
@@ -48,7 +50,7 @@ type messagesReq struct {
 
 type messagesResp struct {
 	Start string                          `json:"start"`
-	End   string                          `json:"end"`
+	End   string                          `json:"end,omitempty"`
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
 }
 
@@ -167,15 +169,33 @@ func OnIncomingMessagesRequest(
 		"return_end":   end.String(),
 	}).Info("Responding")
 
+	res := messagesResp{
+		Chunk: clientEvents,
+		Start: start.String(),
+		End:   end.String(),
+	}
+	// There are no events before the create event, so leave out the end token
+	// to tell the client to stop paginating.
+	if backwardOrdering && containsCreateEvent(clientEvents) {
+		res.End = ""
+	}
+
 	// Respond with the events.
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: messagesResp{
-			Chunk: clientEvents,
-			Start: start.String(),
-			End:   end.String(),
-		},
+		JSON: res,
+	}
+}
+
+// containsCreateEvent returns true if the events include the create event of
+// the room.
+func containsCreateEvent(events []gomatrixserverlib.ClientEvent) bool {
+	for _, ev := range events {
+		if ev.Type == gomatrixserverlib.MRoomCreate && ev.StateKey != nil && *ev.StateKey == "" {
+			return true
+		}
 	}
+	return false
 }
 
 // retrieveEvents retrieve events from the local database for a request on
@@ -369,14 +389,42 @@ func (e eventsByDepth) Less(i, j int) bool {
 // homeserver in the room.
 // See: https://matrix.org/docs/spec/server_server/latest#get-matrix-federation-v1-backfill-roomid
 // It also stores the PDUs retrieved from the remote homeserver's response to
-// the database.
-// Returns with an empty string if the remote homeserver didn't return with any
-// event, or if there is no remote homeserver to contact.
+// the database. Parallel requests to backfill the same gap in the room share
+// a single request to the roomserver.
+// Returns with an empty slice if the remote homeservers didn't return any new
+// events, e.g. because we've reached the create event of the room, or if
+// there is no remote homeserver to contact.
 // Returns an error if there was an issue with retrieving the list of servers in
 // the room or sending the request.
 func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]string, limit int) ([]gomatrixserverlib.HeaderedEvent, error) {
+	result, err, _ := backfillRequests.Do(backfillKey(roomID, backwardsExtremities), func() (interface{}, error) {
+		return r.backfillViaRoomserver(roomID, backwardsExtremities, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	events := result.([]gomatrixserverlib.HeaderedEvent)
+
+	// we may have got more than the requested limit so resize now
+	if len(events) > limit {
+		// last `limit` events
+		events = events[len(events)-limit:]
+	}
+
+	return events, nil
+}
+
+// backfillViaRoomserver asks the roomserver to backfill the room from the given
+// backwards extremities, which will ask other servers in the room and persist
+// the events that pass auth checks. The events that we didn't already know
+// about are then stored in the sync API database, which also updates the
+// backwards extremities of the room.
+func (r *messagesReq) backfillViaRoomserver(roomID string, backwardsExtremities map[string][]string, limit int) ([]gomatrixserverlib.HeaderedEvent, error) {
+	// The result may be shared with other requests, so don't tie it to the
+	// lifetime of this request.
+	ctx := context.Background()
 	var res api.QueryBackfillResponse
-	err := r.rsAPI.QueryBackfill(context.Background(), &api.QueryBackfillRequest{
+	err := r.rsAPI.QueryBackfill(ctx, &api.QueryBackfillRequest{
 		RoomID:               roomID,
 		BackwardsExtremities: backwardsExtremities,
 		Limit:                limit,
@@ -385,7 +433,31 @@ func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]
 	if err != nil {
 		return nil, fmt.Errorf("QueryBackfill failed: %w", err)
 	}
-	util.GetLogger(r.ctx).WithField("new_events", len(res.Events)).Info("Storing new events from backfill")
+
+	// Remote servers may send us events that we already have, e.g. if they
+	// don't have anything earlier, so only keep the ones that are new to us.
+	eventIDs := make([]string, len(res.Events))
+	for i := range res.Events {
+		eventIDs[i] = res.Events[i].EventID()
+	}
+	knownEvents, err := r.db.Events(ctx, eventIDs)
+	if err != nil {
+		return nil, fmt.Errorf("r.db.Events: %w", err)
+	}
+	known := make(map[string]bool, len(knownEvents))
+	for _, ev := range knownEvents {
+		known[ev.EventID()] = true
+	}
+	events := make([]gomatrixserverlib.HeaderedEvent, 0, len(res.Events))
+	for _, ev := range res.Events {
+		if !known[ev.EventID()] {
+			events = append(events, ev)
+		}
+	}
+	util.GetLogger(r.ctx).WithFields(logrus.Fields{
+		"new_events":   len(events),
+		"known_events": len(res.Events) - len(events),
+	}).Info("Storing new events from backfill")
 
 	// TODO: we should only be inserting events into the database from the roomserver's kafka output stream.
 	// Currently, this can race with live events for the room and cause problems. It's also just a bit unclear
@@ -395,14 +467,17 @@ func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]
 	// will skip over events that have the same depth but different stream positions due to the query which is:
 	//  - anything less than the depth OR
 	//  - anything with the same depth and a lower stream position.
-	sort.Sort(eventsByDepth(res.Events))
+	sort.Sort(eventsByDepth(events))
 
 	// Store the events in the database, while marking them as unfit to show
-	// up in responses to sync requests.
-	for i := range res.Events {
+	// up in responses to sync requests. Writing the events removes them from
+	// the room's backwards extremities, and adds any of their prev_events that
+	// we don't have yet, so once we've stored the create event there will be
+	// nothing left to backfill.
+	for i := range events {
 		_, err = r.db.WriteEvent(
-			r.ctx,
-			&res.Events[i],
+			ctx,
+			&events[i],
 			[]gomatrixserverlib.HeaderedEvent{},
 			[]string{},
 			[]string{},
@@ -411,18 +486,31 @@ func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]
 		if err != nil {
 			return nil, err
 		}
-	}
-
-	// we may have got more than the requested limit so resize now
-	events := res.Events
-	if len(events) > limit {
-		// last `limit` events
-		events = events[len(events)-limit:]
+		if events[i].Type() == gomatrixserverlib.MRoomCreate && events[i].StateKeyEquals("") {
+			util.GetLogger(r.ctx).WithField("room_id", roomID).Info("Backfilled to the beginning of the room")
+		}
 	}
 
 	return events, nil
 }
 
+// backfillRequests de-duplicates backfill requests across /messages requests,
+// so that only one backfill is in progress for a given gap in a room at a time.
+// Requests for the same gap which arrive while the backfill is in progress
+// wait for it to finish and share its result.
+var backfillRequests singleflight.Group
+
+// backfillKey returns a key which identifies the gap that we're backfilling,
+// based on the room ID and the backwards extremities of the room.
+func backfillKey(roomID string, backwardsExtremities map[string][]string) string {
+	eventIDs := make([]string, 0, len(backwardsExtremities))
+	for eventID := range backwardsExtremities {
+		eventIDs = append(eventIDs, eventID)
+	}
+	sort.Strings(eventIDs)
+	return roomID + "|" + strings.Join(eventIDs, "|")
+}
+
 // setToDefault returns the default value for the "to" query parameter of a
 // request to /messages if not provided. It defaults to either the earliest
 // topological position (if we're going backward) or to the latest one (if we're
@@ -0,0 +1,170 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	testServerName  = gomatrixserverlib.ServerName("localhost")
+	testRoomID      = "!room:localhost"
+	testUserID      = "@alice:localhost"
+	testRoomVersion = gomatrixserverlib.RoomVersionV4
+	testPrivateKey  = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+)
+
+// backfillRoomserverAPI answers backfill requests with the given events.
+type backfillRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	events []gomatrixserverlib.HeaderedEvent
+	err    error
+	calls  int
+}
+
+func (r *backfillRoomserverAPI) QueryBackfill(
+	ctx context.Context,
+	req *api.QueryBackfillRequest,
+	res *api.QueryBackfillResponse,
+) error {
+	r.calls++
+	res.Events = r.events
+	return r.err
+}
+
+// testRoom returns the events of a room, starting with its create event and
+// followed by the given number of messages.
+func testRoom(t *testing.T, messages int) []gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	stateKey := ""
+	builders := []gomatrixserverlib.EventBuilder{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &stateKey, Content: []byte(fmt.Sprintf(`{"creator":%q}`, testUserID))},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &testUserID, Content: []byte(`{"membership":"join"}`)},
+	}
+	for i := 0; i < messages; i++ {
+		builders = append(builders, gomatrixserverlib.EventBuilder{
+			Type: "m.room.message", Content: []byte(fmt.Sprintf(`{"body":"%d"}`, i)),
+		})
+	}
+	events := make([]gomatrixserverlib.HeaderedEvent, len(builders))
+	for i := range builders {
+		b := builders[i]
+		b.Sender = testUserID
+		b.RoomID = testRoomID
+		b.Depth = int64(i + 1)
+		if i > 0 {
+			b.PrevEvents = []string{events[i-1].EventID()}
+		}
+		ev, err := b.Build(time.Now(), testServerName, "ed25519:test", testPrivateKey, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		events[i] = ev.Headered(testRoomVersion)
+	}
+	return events
+}
+
+func mustCreateDatabase(t *testing.T, events []gomatrixserverlib.HeaderedEvent) storage.Database {
+	t.Helper()
+	db, err := sqlite3.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("sqlite3.NewDatabase failed: %s", err)
+	}
+	for i := range events {
+		if _, err = db.WriteEvent(context.Background(), &events[i], nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+	return db
+}
+
+func getMessages(t *testing.T, db storage.Database, rsAPI api.RoomserverInternalAPI, limit int) (int, *messagesResp) {
+	t.Helper()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testServerName
+	from, err := db.MaxTopologicalPosition(context.Background(), testRoomID)
+	if err != nil {
+		t.Fatalf("MaxTopologicalPosition failed: %s", err)
+	}
+	// The from position is exclusive, so start just after the latest event.
+	from.Positions[0]++
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/messages?dir=b&limit=%d&from=%s", limit, from.String()), nil)
+	res := OnIncomingMessagesRequest(req, db, testRoomID, nil, rsAPI, cfg)
+	if res.Code != http.StatusOK {
+		return res.Code, nil
+	}
+	msgs := res.JSON.(messagesResp)
+	return res.Code, &msgs
+}
+
+func TestMessagesEndOfRoom(t *testing.T) {
+	events := testRoom(t, 3)
+	db := mustCreateDatabase(t, events)
+
+	// Paginating part of the way doesn't reach the create event, so the
+	// client is given a token to carry on from.
+	_, res := getMessages(t, db, nil, 2)
+	if len(res.Chunk) != 2 || res.End == "" {
+		t.Fatalf("wanted 2 events and an end token, got %d events and end token %q", len(res.Chunk), res.End)
+	}
+
+	// Reaching the create event means there is nothing left to paginate.
+	_, res = getMessages(t, db, nil, 10)
+	if len(res.Chunk) != len(events) {
+		t.Fatalf("wanted %d events, got %d", len(events), len(res.Chunk))
+	}
+	if res.End != "" {
+		t.Fatalf("wanted no end token once the create event is reached, got %q", res.End)
+	}
+}
+
+func TestMessagesBackfillToEndOfRoom(t *testing.T) {
+	events := testRoom(t, 3)
+	latest := len(events) - 1
+
+	// We only have the latest event, so the rest of the room needs to be
+	// backfilled.
+	rsAPI := &backfillRoomserverAPI{err: errors.New("backfill failed")}
+	db := mustCreateDatabase(t, events[latest:])
+	if code, _ := getMessages(t, db, rsAPI, 10); code != http.StatusInternalServerError {
+		t.Fatalf("wanted HTTP 500 when the backfill fails, got %d", code)
+	}
+
+	// A failed backfill isn't remembered, so the next request tries again.
+	rsAPI.events, rsAPI.err = events[:latest], nil
+	_, res := getMessages(t, db, rsAPI, 10)
+	if rsAPI.calls != 2 {
+		t.Fatalf("wanted the backfill to be retried, got %d backfill requests", rsAPI.calls)
+	}
+	if len(res.Chunk) != len(events) {
+		t.Fatalf("wanted %d events, got %d", len(events), len(res.Chunk))
+	}
+	if res.End != "" {
+		t.Fatalf("wanted no end token once the create event is backfilled, got %q", res.End)
+	}
+}
@@ -31,6 +31,7 @@ import (
 )
 
 const pathPrefixR0 = "/client/r0"
+const pathPrefixUnstable = "/client/unstable"
 
 // Setup configures the given mux with sync-server listeners
 //
@@ -44,6 +45,7 @@ func Setup(
 	cfg *config.Dendrite,
 ) {
 	r0mux := publicAPIMux.PathPrefix(pathPrefixR0).Subrouter()
+	unstableMux := publicAPIMux.PathPrefix(pathPrefixUnstable).Subrouter()
 
 	authData := auth.Data{
 		AccountDB:   nil,
@@ -56,6 +58,11 @@ func Setup(
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	// Sliding sync, as described in MSC3575.
+	unstableMux.Handle("/org.matrix.msc3575/sync", internal.MakeAuthAPI("sliding_sync", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return srp.OnIncomingSlidingSyncRequest(req, device)
+	})).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/rooms/{roomID}/messages", internal.MakeAuthAPI("room_messages", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		vars, err := internal.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
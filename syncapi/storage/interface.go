@@ -41,6 +41,9 @@ type Database interface {
 	// Returns an error if there was a problem inserting this event.
 	WriteEvent(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, addStateEvents []gomatrixserverlib.HeaderedEvent,
 		addStateEventIDs []string, removeStateEventIDs []string, transactionID *api.TransactionID, excludeFromSync bool) (types.StreamPosition, error)
+	// PurgeEvents deletes the events with the given IDs, which have been purged from the room history by the roomserver.
+	// Returns an error if there was a problem deleting the events.
+	PurgeEvents(ctx context.Context, eventIDs []string) error
 	// GetStateEvent returns the Matrix state event of a given type for a given room with a given state key
 	// If no event could be found, returns nil
 	// If there was an issue during the retrieval, returns an error
@@ -61,6 +64,25 @@ type Database interface {
 	// CompleteSync returns a complete /sync API response for the given user. A response object
 	// must be provided for CompleteSync to populate - it will not create one.
 	CompleteSync(ctx context.Context, res *types.Response, device authtypes.Device, numRecentEventsPerRoom int) (*types.Response, error)
+	// JoinedRoomsLatestPositions returns the PDU stream position of the latest event in each
+	// room that the given user is currently joined to, keyed by room ID. This is used to sort
+	// rooms by recency without having to load the timeline of every room.
+	JoinedRoomsLatestPositions(ctx context.Context, userID string) (map[string]types.StreamPosition, error)
+	// RecentEventsForSync returns up to `limit` of the most recent events in a room within the
+	// given range which are not excluded from sync, in chronological order. It also returns a
+	// topology token which can be used to paginate backwards from the earliest returned event,
+	// and whether or not there were more events in the range than the limit allowed.
+	RecentEventsForSync(ctx context.Context, device *authtypes.Device, roomID string, r types.Range, limit int) (events []gomatrixserverlib.HeaderedEvent, prevBatch types.TopologyToken, limited bool, err error)
+	// StoreSyncSnapshot stores a complete sync response for the given device, replacing any
+	// existing snapshot. The response must not include any account data, to-device messages
+	// or other data that isn't derived from the sync stream position in res.NextBatch.
+	StoreSyncSnapshot(ctx context.Context, device authtypes.Device, filter string, res *types.Response) error
+	// SyncSnapshot returns the stored complete sync response for the given device, along with
+	// the sync position that it was calculated at. Returns nil if there is no snapshot for the
+	// device or if it was calculated with a different filter.
+	SyncSnapshot(ctx context.Context, device authtypes.Device, filter string) (*types.Response, *types.StreamingToken, error)
+	// InvalidateSyncSnapshots deletes the stored sync snapshots for all of the user's devices.
+	InvalidateSyncSnapshots(ctx context.Context, userID string) error
 	// GetAccountDataInRange returns all account data for a given user inserted or
 	// updated between two given positions
 	// Returns a map following the format data[roomID] = []dataTypes
@@ -84,12 +106,17 @@ type Database interface {
 	// SetTypingTimeoutCallback sets a callback function that is called right after
 	// a user is removed from the typing user list due to timeout.
 	SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn)
-	// AddTypingUser adds a typing user to the typing cache.
+	// AddTypingUser adds a typing user to the typing cache and persists it.
 	// Returns the newly calculated sync position for typing notifications.
-	AddTypingUser(userID, roomID string, expireTime *time.Time) types.StreamPosition
-	// RemoveTypingUser removes a typing user from the typing cache.
+	AddTypingUser(ctx context.Context, userID, roomID string, expireTime *time.Time) (types.StreamPosition, error)
+	// RemoveTypingUser removes a typing user from the typing cache and persists it.
 	// Returns the newly calculated sync position for typing notifications.
-	RemoveTypingUser(userID, roomID string) types.StreamPosition
+	RemoveTypingUser(ctx context.Context, userID, roomID string) (types.StreamPosition, error)
+	// RestoreTypingNotifications loads the persisted typing notifications into the typing cache.
+	RestoreTypingNotifications(ctx context.Context) error
+	// PruneTypingNotifications deletes the persisted typing notifications of users who are
+	// no longer typing.
+	PruneTypingNotifications(ctx context.Context) error
 	// GetEventsInStreamingRange retrieves all of the events on a given ordering using the given extremities and limit.
 	GetEventsInStreamingRange(ctx context.Context, from, to *types.StreamingToken, roomID string, limit int, backwardOrdering bool) (events []types.StreamEvent, err error)
 	// GetEventsInTopologicalRange retrieves all of the events on a given ordering using the given extremities and limit.
@@ -106,26 +133,18 @@ type Database interface {
 	StreamEventsToEvents(device *authtypes.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent
 	// SyncStreamPosition returns the latest position in the sync stream. Returns 0 if there are no events yet.
 	SyncStreamPosition(ctx context.Context) (types.StreamPosition, error)
-	// AddSendToDevice increases the EDU position in the cache and returns the stream position.
-	AddSendToDevice() types.StreamPosition
-	// SendToDeviceUpdatesForSync returns a list of send-to-device updates. It returns three lists:
-	// - "events": a list of send-to-device events that should be included in the sync
-	// - "changes": a list of send-to-device events that should be updated in the database by
-	//      CleanSendToDeviceUpdates
-	// - "deletions": a list of send-to-device events which have been confirmed as sent and
-	//      can be deleted altogether by CleanSendToDeviceUpdates
-	// The token supplied should be the current requested sync token, e.g. from the "since"
-	// parameter.
-	SendToDeviceUpdatesForSync(ctx context.Context, userID, deviceID string, token types.StreamingToken) (events []types.SendToDeviceEvent, changes []types.SendToDeviceNID, deletions []types.SendToDeviceNID, err error)
+	// SendToDeviceUpdatesForSync returns the send-to-device updates for the device with
+	// positions in the range (from, to] of the send-to-device stream, oldest first. The
+	// same updates are returned again until CleanSendToDeviceUpdates deletes them.
+	SendToDeviceUpdatesForSync(ctx context.Context, userID, deviceID string, from, to types.StreamPosition) (events []types.SendToDeviceEvent, err error)
 	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device.
-	StoreNewSendForDeviceMessage(ctx context.Context, streamPos types.StreamPosition, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
-	// CleanSendToDeviceUpdates will update or remove any send-to-device updates based on the
-	// result to a previous call to SendDeviceUpdatesForSync. This is separate as it allows
-	// SendToDeviceUpdatesForSync to be called multiple times if needed (e.g. before and after
-	// starting to wait for an incremental sync with timeout).
-	// The token supplied should be the current requested sync token, e.g. from the "since"
-	// parameter.
-	CleanSendToDeviceUpdates(ctx context.Context, toUpdate, toDelete []types.SendToDeviceNID, token types.StreamingToken) (err error)
-	// SendToDeviceUpdatesWaiting returns true if there are send-to-device updates waiting to be sent.
-	SendToDeviceUpdatesWaiting(ctx context.Context, userID, deviceID string) (bool, error)
+	// Returns the position of the event in the send-to-device stream.
+	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
+	// CleanSendToDeviceUpdates deletes the send-to-device updates for the device with
+	// positions up to and including the given position. This should be the position of
+	// the "since" parameter of a sync, which acknowledges that the client received them.
+	CleanSendToDeviceUpdates(ctx context.Context, userID, deviceID string, before types.StreamPosition) (err error)
+	// SendToDeviceUpdatesWaiting returns true if there are send-to-device updates after the
+	// given position waiting to be sent.
+	SendToDeviceUpdatesWaiting(ctx context.Context, userID, deviceID string, from types.StreamPosition) (bool, error)
 }
@@ -71,6 +71,13 @@ const deleteRoomStateByEventIDSQL = "" +
 const selectRoomIDsWithMembershipSQL = "" +
 	"SELECT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
 
+const selectRoomLatestPositionsWithMembershipSQL = "" +
+	"SELECT s.room_id, MAX(e.id) FROM syncapi_current_room_state s" +
+	" INNER JOIN syncapi_output_room_events e ON e.room_id = s.room_id" +
+	" WHERE s.type = 'm.room.member' AND s.state_key = $1 AND s.membership = $2" +
+	" AND e.exclude_from_sync = FALSE" +
+	" GROUP BY s.room_id"
+
 const selectCurrentStateSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1" +
 	" AND ( $2 IS NULL OR     sender  = ANY($2)  )" +
@@ -99,6 +106,7 @@ type currentRoomStateStatements struct {
 	upsertRoomStateStmt             *sql.Stmt
 	deleteRoomStateByEventIDStmt    *sql.Stmt
 	selectRoomIDsWithMembershipStmt *sql.Stmt
+	selectRoomLatestPositionsStmt   *sql.Stmt
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
 	selectEventsWithEventIDsStmt    *sql.Stmt
@@ -122,6 +130,9 @@ func NewMysqlCurrentRoomStateTable(db *sql.DB, streamID *streamIDStatements) (ta
 	if s.selectRoomIDsWithMembershipStmt, err = db.Prepare(selectRoomIDsWithMembershipSQL); err != nil {
 		return nil, err
 	}
+	if s.selectRoomLatestPositionsStmt, err = db.Prepare(selectRoomLatestPositionsWithMembershipSQL); err != nil {
+		return nil, err
+	}
 	if s.selectCurrentStateStmt, err = db.Prepare(selectCurrentStateSQL); err != nil {
 		return nil, err
 	}
@@ -186,6 +197,34 @@ func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	return result, rows.Err()
 }
 
+// SelectRoomLatestPositionsWithMembership returns the stream position of the latest
+// event in each room which has the given user in the given membership state, keyed
+// by room ID.
+func (s *currentRoomStateStatements) SelectRoomLatestPositionsWithMembership(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+	membership string, // nolint: unparam
+) (map[string]types.StreamPosition, error) {
+	stmt := internal.TxStmt(txn, s.selectRoomLatestPositionsStmt)
+	rows, err := stmt.QueryContext(ctx, userID, membership)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomLatestPositionsWithMembership: rows.close() failed")
+
+	result := make(map[string]types.StreamPosition)
+	for rows.Next() {
+		var roomID string
+		var pos types.StreamPosition
+		if err := rows.Scan(&roomID, &pos); err != nil {
+			return nil, err
+		}
+		result[roomID] = pos
+	}
+	return result, rows.Err()
+}
+
 // SelectCurrentState returns all the current state events for the given room.
 func (s *currentRoomStateStatements) SelectCurrentState(
 	ctx context.Context, txn *sql.Tx, roomID string,
@@ -101,6 +101,16 @@ const selectStateInRangeSQL = "" +
 	" ORDER BY id ASC" +
 	" LIMIT $8"
 
+const selectStateChangesInRangeSQL = "" +
+	"SELECT id, add_state_ids, remove_state_ids" +
+	" FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
+	" AND (add_state_ids IS NOT NULL OR remove_state_ids IS NOT NULL)" +
+	" ORDER BY id ASC"
+
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = $1"
+
 type outputRoomEventsStatements struct {
 	streamIDStatements            *streamIDStatements
 	insertEventStmt               *sql.Stmt
@@ -110,6 +120,8 @@ type outputRoomEventsStatements struct {
 	selectRecentEventsForSyncStmt *sql.Stmt
 	selectEarlyEventsStmt         *sql.Stmt
 	selectStateInRangeStmt        *sql.Stmt
+	selectStateChangesInRangeStmt *sql.Stmt
+	deleteEventsStmt              *sql.Stmt
 }
 
 func NewMysqlEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Events, error) {
@@ -141,6 +153,12 @@ func NewMysqlEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Event
 	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
 		return nil, err
 	}
+	if s.selectStateChangesInRangeStmt, err = db.Prepare(selectStateChangesInRangeSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteEventsStmt, err = db.Prepare(deleteEventsSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -225,6 +243,39 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 	return stateNeeded, eventIDToEvent, rows.Err()
 }
 
+// SelectStateChangesInRange returns the state event IDs which were added to and
+// removed from the current state of the room by each event between the two
+// given PDU stream positions, exclusive of oldPos, inclusive of newPos, in
+// stream order.
+func (s *outputRoomEventsStatements) SelectStateChangesInRange(
+	ctx context.Context, txn *sql.Tx, roomID string, r types.Range,
+) ([]types.StateChange, error) {
+	stmt := internal.TxStmt(txn, s.selectStateChangesInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, r.Low(), r.High())
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateChangesInRange: rows.close() failed")
+
+	var changes []types.StateChange
+	for rows.Next() {
+		var (
+			change     types.StateChange
+			addIDsJSON string
+			delIDsJSON string
+		)
+		if err = rows.Scan(&change.StreamPosition, &addIDsJSON, &delIDsJSON); err != nil {
+			return nil, err
+		}
+		change.AddStateIDs, change.RemoveStateIDs, err = unmarshalStateIDs(addIDsJSON, delIDsJSON)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
 // MaxID returns the ID of the last inserted event in this table. 'txn' is optional. If it is not supplied,
 // then this function should only ever be used at startup, as it will race with inserting events if it is
 // done afterwards. If there are no inserted events, 0 is returned.
@@ -431,3 +482,15 @@ func unmarshalStateIDs(addIDsJSON, delIDsJSON string) (addIDs []string, delIDs [
 	}
 	return
 }
+
+func (s *outputRoomEventsStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteEventsStmt)
+	for _, eventID := range eventIDs {
+		if _, err := stmt.ExecContext(ctx, eventID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
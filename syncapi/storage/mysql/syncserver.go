@@ -16,6 +16,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -74,6 +75,14 @@ func NewDatabase(dbDataSourceName string, dbProperties internal.DbProperties) (*
 	if err != nil {
 		return nil, err
 	}
+	syncSnapshots, err := NewMysqlSyncSnapshotsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	typing, err := NewMysqlTypingTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -85,6 +94,11 @@ func NewDatabase(dbDataSourceName string, dbProperties internal.DbProperties) (*
 		SendToDevice:        sendToDevice,
 		SendToDeviceWriter:  internal.NewTransactionWriter(),
 		EDUCache:            cache.New(),
+		SyncSnapshots:       syncSnapshots,
+		Typing:              typing,
+	}
+	if err = d.Database.RestoreTypingNotifications(context.Background()); err != nil {
+		return nil, err
 	}
 	return &d, nil
 }
@@ -16,6 +16,7 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -73,6 +74,14 @@ func NewDatabase(dbDataSourceName string, dbProperties internal.DbProperties) (*
 	if err != nil {
 		return nil, err
 	}
+	syncSnapshots, err := NewPostgresSyncSnapshotsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	typing, err := NewPostgresTypingTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -84,6 +93,11 @@ func NewDatabase(dbDataSourceName string, dbProperties internal.DbProperties) (*
 		SendToDevice:        sendToDevice,
 		SendToDeviceWriter:  internal.NewTransactionWriter(),
 		EDUCache:            cache.New(),
+		SyncSnapshots:       syncSnapshots,
+		Typing:              typing,
+	}
+	if err = d.Database.RestoreTypingNotifications(context.Background()); err != nil {
+		return nil, err
 	}
 	return &d, nil
 }
@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const typingSchema = `
+-- Stores the typing state of each user in each room, so that typing
+-- notifications survive a restart of the sync API.
+CREATE TABLE IF NOT EXISTS syncapi_typing (
+	-- The typing stream position at which the user last started or stopped typing.
+	id BIGINT NOT NULL,
+	-- The room ID that the user is typing in.
+	room_id TEXT NOT NULL,
+	-- The user ID that is typing.
+	user_id TEXT NOT NULL,
+	-- The time at which the user will stop typing, in milliseconds since the
+	-- epoch, or 0 if the user has stopped typing.
+	expires_at BIGINT NOT NULL,
+	CONSTRAINT syncapi_typing_unique UNIQUE (room_id, user_id)
+);
+`
+
+// Only replace rows with later stream positions, in case the typing timeout
+// for a user races with them starting to type again.
+const upsertTypingSQL = "" +
+	"INSERT INTO syncapi_typing (id, room_id, user_id, expires_at)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_typing_unique" +
+	" DO UPDATE SET id = $1, expires_at = $4" +
+	" WHERE syncapi_typing.id < $1"
+
+const selectTypingSQL = "" +
+	"SELECT id, room_id, user_id, expires_at FROM syncapi_typing"
+
+// Users who stopped typing have an expiry time of 0, so they are deleted too.
+// Keep the latest row so that the typing stream position survives a restart.
+const deleteStaleTypingSQL = "" +
+	"DELETE FROM syncapi_typing WHERE expires_at < $1" +
+	" AND id < (SELECT MAX(id) FROM syncapi_typing)"
+
+type typingStatements struct {
+	upsertTypingStmt      *sql.Stmt
+	selectTypingStmt      *sql.Stmt
+	deleteStaleTypingStmt *sql.Stmt
+}
+
+func NewPostgresTypingTable(db *sql.DB) (tables.Typing, error) {
+	s := &typingStatements{}
+	_, err := db.Exec(typingSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertTypingStmt, err = db.Prepare(upsertTypingSQL); err != nil {
+		return nil, err
+	}
+	if s.selectTypingStmt, err = db.Prepare(selectTypingSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteStaleTypingStmt, err = db.Prepare(deleteStaleTypingSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *typingStatements) UpsertTypingUser(
+	ctx context.Context, txn *sql.Tx,
+	roomID, userID string, expiresAt gomatrixserverlib.Timestamp, pos types.StreamPosition,
+) (err error) {
+	stmt := internal.TxStmt(txn, s.upsertTypingStmt)
+	_, err = stmt.ExecContext(ctx, pos, roomID, userID, expiresAt)
+	return
+}
+
+func (s *typingStatements) SelectTypingNotifications(
+	ctx context.Context, txn *sql.Tx,
+) (notifications []types.TypingNotification, err error) {
+	rows, err := internal.TxStmt(txn, s.selectTypingStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectTypingNotifications: rows.close() failed")
+
+	for rows.Next() {
+		var n types.TypingNotification
+		if err = rows.Scan(&n.StreamPosition, &n.RoomID, &n.UserID, &n.ExpiresAt); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (s *typingStatements) DeleteStaleTypingNotifications(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = internal.TxStmt(txn, s.deleteStaleTypingStmt).ExecContext(ctx, before)
+	return
+}
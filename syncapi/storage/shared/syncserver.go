@@ -44,6 +44,8 @@ type Database struct {
 	SendToDevice        tables.SendToDevice
 	SendToDeviceWriter  *internal.TransactionWriter
 	EDUCache            *cache.EDUCache
+	SyncSnapshots       tables.SyncSnapshots
+	Typing              tables.Typing
 }
 
 // Events lookups a list of event by their event ID.
@@ -71,8 +73,8 @@ func (d *Database) GetEventsInStreamingRange(
 	backwardOrdering bool,
 ) (events []types.StreamEvent, err error) {
 	r := types.Range{
-		From:      from.PDUPosition(),
-		To:        to.PDUPosition(),
+		From:      from.PDUPosition,
+		To:        to.PDUPosition,
 		Backwards: backwardOrdering,
 	}
 	if backwardOrdering {
@@ -94,23 +96,77 @@ func (d *Database) GetEventsInStreamingRange(
 }
 
 func (d *Database) AddTypingUser(
-	userID, roomID string, expireTime *time.Time,
-) types.StreamPosition {
-	return types.StreamPosition(d.EDUCache.AddTypingUser(userID, roomID, expireTime))
+	ctx context.Context, userID, roomID string, expireTime *time.Time,
+) (types.StreamPosition, error) {
+	pos := types.StreamPosition(d.EDUCache.AddTypingUser(userID, roomID, expireTime))
+	expiresAt := gomatrixserverlib.AsTimestamp(time.Now().Add(cache.DefaultTypingTimeout))
+	if expireTime != nil {
+		expiresAt = gomatrixserverlib.AsTimestamp(*expireTime)
+	}
+	return pos, d.Typing.UpsertTypingUser(ctx, nil, roomID, userID, expiresAt, pos)
 }
 
 func (d *Database) RemoveTypingUser(
-	userID, roomID string,
-) types.StreamPosition {
-	return types.StreamPosition(d.EDUCache.RemoveUser(userID, roomID))
+	ctx context.Context, userID, roomID string,
+) (types.StreamPosition, error) {
+	pos := types.StreamPosition(d.EDUCache.RemoveUser(userID, roomID))
+	return pos, d.Typing.UpsertTypingUser(ctx, nil, roomID, userID, 0, pos)
 }
 
-func (d *Database) AddSendToDevice() types.StreamPosition {
-	return types.StreamPosition(d.EDUCache.AddSendToDeviceMessage())
+// SetTypingTimeoutCallback sets a callback function that is called right after
+// a user is removed from the typing user list due to timeout. The removal is
+// persisted before the callback is called.
+func (d *Database) SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn) {
+	d.EDUCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		if err := d.Typing.UpsertTypingUser(
+			context.Background(), nil, roomID, userID, 0, types.StreamPosition(latestSyncPosition),
+		); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"user_id": userID,
+				"room_id": roomID,
+			}).Warn("Failed to persist typing timeout")
+		}
+		fn(userID, roomID, latestSyncPosition)
+	})
 }
 
-func (d *Database) SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn) {
-	d.EDUCache.SetTimeoutCallback(fn)
+// RestoreTypingNotifications loads the persisted typing state into the EDU
+// cache, so that typing notifications and positions in the typing stream
+// survive a restart of the sync API.
+func (d *Database) RestoreTypingNotifications(ctx context.Context) error {
+	if err := d.PruneTypingNotifications(ctx); err != nil {
+		return err
+	}
+	notifications, err := d.Typing.SelectTypingNotifications(ctx, nil)
+	if err != nil {
+		return err
+	}
+	positions := make(map[string]int64)
+	typingUsers := make(map[string]map[string]time.Time)
+	for _, n := range notifications {
+		if int64(n.StreamPosition) > positions[n.RoomID] {
+			positions[n.RoomID] = int64(n.StreamPosition)
+		}
+		if typingUsers[n.RoomID] == nil {
+			typingUsers[n.RoomID] = make(map[string]time.Time)
+		}
+		if n.ExpiresAt != 0 {
+			typingUsers[n.RoomID][n.UserID] = n.ExpiresAt.Time()
+		}
+	}
+	for roomID, pos := range positions {
+		d.EDUCache.RestoreRoom(roomID, pos, typingUsers[roomID])
+	}
+	return nil
+}
+
+// PruneTypingNotifications deletes the persisted typing notifications of users
+// who stopped typing or whose typing has expired. They aren't needed to restore
+// the EDU cache, as the position of the typing stream is kept by the latest one.
+func (d *Database) PruneTypingNotifications(ctx context.Context) error {
+	return d.Typing.DeleteStaleTypingNotifications(
+		ctx, nil, gomatrixserverlib.AsTimestamp(time.Now()),
+	)
 }
 
 func (d *Database) AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error) {
@@ -170,7 +226,15 @@ func (d *Database) AddInviteEvent(
 ) (sp types.StreamPosition, err error) {
 	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
 		sp, err = d.Invites.InsertInviteEvent(ctx, txn, inviteEvent)
-		return err
+		if err != nil {
+			return err
+		}
+		// The invited user has a new room in their sync, so any snapshots that
+		// they have are no longer complete.
+		if stateKey := inviteEvent.StateKey(); stateKey != nil {
+			return d.SyncSnapshots.DeleteSyncSnapshotsForUser(ctx, txn, *stateKey)
+		}
+		return nil
 	})
 	return
 }
@@ -268,6 +332,15 @@ func (d *Database) handleBackwardExtremities(ctx context.Context, txn *sql.Tx, e
 	return nil
 }
 
+func (d *Database) PurgeEvents(ctx context.Context, eventIDs []string) error {
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if err := d.Topology.DeleteTopologyForEvents(ctx, txn, eventIDs); err != nil {
+			return err
+		}
+		return d.OutputEvents.DeleteEvents(ctx, txn, eventIDs)
+	})
+}
+
 func (d *Database) WriteEvent(
 	ctx context.Context,
 	ev *gomatrixserverlib.HeaderedEvent,
@@ -329,6 +402,11 @@ func (d *Database) updateRoomState(
 				return err
 			}
 			membership = &value
+			// The set of rooms that this user is in has changed, so any sync
+			// snapshots that they have are no longer correct.
+			if err := d.SyncSnapshots.DeleteSyncSnapshotsForUser(ctx, txn, *event.StateKey()); err != nil {
+				return err
+			}
 		}
 
 		if err := d.CurrentRoomState.UpsertRoomState(ctx, txn, event, membership, pduPosition); err != nil {
@@ -424,17 +502,21 @@ func (d *Database) syncPositionTx(
 	if err != nil {
 		return sp, err
 	}
-	if maxAccountDataID > maxEventID {
-		maxEventID = maxAccountDataID
-	}
 	maxInviteID, err := d.Invites.SelectMaxInviteID(ctx, txn)
 	if err != nil {
 		return sp, err
 	}
-	if maxInviteID > maxEventID {
-		maxEventID = maxInviteID
+	maxSendToDeviceID, err := d.SendToDevice.SelectMaxSendToDeviceMessageID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp = types.StreamingToken{
+		PDUPosition:          types.StreamPosition(maxEventID),
+		TypingPosition:       types.StreamPosition(d.EDUCache.GetLatestSyncPosition()),
+		SendToDevicePosition: types.StreamPosition(maxSendToDeviceID),
+		InvitePosition:       types.StreamPosition(maxInviteID),
+		AccountDataPosition:  types.StreamPosition(maxAccountDataID),
 	}
-	sp = types.NewStreamToken(types.StreamPosition(maxEventID), types.StreamPosition(d.EDUCache.GetLatestSyncPosition()))
 	return
 }
 
@@ -487,11 +569,6 @@ func (d *Database) addPDUDeltaToResponse(
 		}
 	}
 
-	// TODO: This should be done in getStateDeltas
-	if err = d.addInvitesToResponse(ctx, txn, device.UserID, r, res); err != nil {
-		return nil, err
-	}
-
 	succeeded = true
 	return joinedRoomIDs, nil
 }
@@ -508,7 +585,7 @@ func (d *Database) addTypingDeltaToResponse(
 	var err error
 	for _, roomID := range joinedRoomIDs {
 		if typingUsers, updated := d.EDUCache.GetTypingUsersIfUpdatedAfter(
-			roomID, int64(since.EDUPosition()),
+			roomID, int64(since.TypingPosition),
 		); updated {
 			ev := gomatrixserverlib.ClientEvent{
 				Type: gomatrixserverlib.MTyping,
@@ -538,7 +615,7 @@ func (d *Database) addEDUDeltaToResponse(
 	res *types.Response,
 ) (err error) {
 
-	if fromPos.EDUPosition() != toPos.EDUPosition() {
+	if fromPos.TypingPosition != toPos.TypingPosition {
 		err = d.addTypingDeltaToResponse(
 			fromPos, joinedRoomIDs, res,
 		)
@@ -559,10 +636,10 @@ func (d *Database) IncrementalSync(
 
 	var joinedRoomIDs []string
 	var err error
-	if fromPos.PDUPosition() != toPos.PDUPosition() || wantFullState {
+	if fromPos.PDUPosition != toPos.PDUPosition || wantFullState {
 		r := types.Range{
-			From: fromPos.PDUPosition(),
-			To:   toPos.PDUPosition(),
+			From: fromPos.PDUPosition,
+			To:   toPos.PDUPosition,
 		}
 		joinedRoomIDs, err = d.addPDUDeltaToResponse(
 			ctx, device, r, numRecentEventsPerRoom, wantFullState, res,
@@ -576,6 +653,16 @@ func (d *Database) IncrementalSync(
 		return nil, err
 	}
 
+	if fromPos.InvitePosition != toPos.InvitePosition || wantFullState {
+		r := types.Range{
+			From: fromPos.InvitePosition,
+			To:   toPos.InvitePosition,
+		}
+		if err = d.addInvitesToResponse(ctx, nil, device.UserID, r, res); err != nil {
+			return nil, err
+		}
+	}
+
 	err = d.addEDUDeltaToResponse(
 		fromPos, toPos, joinedRoomIDs, res,
 	)
@@ -621,7 +708,7 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 	}
 	r := types.Range{
 		From: 0,
-		To:   toPos.PDUPosition(),
+		To:   toPos.PDUPosition,
 	}
 
 	res.NextBatch = toPos.String()
@@ -677,7 +764,11 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 		res.Rooms.Join[roomID] = *jr
 	}
 
-	if err = d.addInvitesToResponse(ctx, txn, userID, r, res); err != nil {
+	inviteRange := types.Range{
+		From: 0,
+		To:   toPos.InvitePosition,
+	}
+	if err = d.addInvitesToResponse(ctx, txn, userID, inviteRange, res); err != nil {
 		return
 	}
 
@@ -685,6 +776,36 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 	return //res, toPos, joinedRoomIDs, err
 }
 
+func (d *Database) JoinedRoomsLatestPositions(
+	ctx context.Context, userID string,
+) (map[string]types.StreamPosition, error) {
+	return d.CurrentRoomState.SelectRoomLatestPositionsWithMembership(ctx, nil, userID, gomatrixserverlib.Join)
+}
+
+func (d *Database) RecentEventsForSync(
+	ctx context.Context, device *authtypes.Device,
+	roomID string, r types.Range, limit int,
+) (events []gomatrixserverlib.HeaderedEvent, prevBatch types.TopologyToken, limited bool, err error) {
+	// Ask for one more event than the limit so that we know whether or not
+	// the timeline has been truncated.
+	recentStreamEvents, err := d.OutputEvents.SelectRecentEvents(
+		ctx, nil, roomID, r, limit+1, true, true,
+	)
+	if err != nil {
+		return
+	}
+	if len(recentStreamEvents) > limit {
+		limited = true
+		recentStreamEvents = recentStreamEvents[len(recentStreamEvents)-limit:]
+	}
+	prevBatch, err = d.getBackwardTopologyPos(ctx, nil, recentStreamEvents)
+	if err != nil {
+		return
+	}
+	events = d.StreamEventsToEvents(device, recentStreamEvents)
+	return
+}
+
 func (d *Database) CompleteSync(
 	ctx context.Context, res *types.Response,
 	device authtypes.Device, numRecentEventsPerRoom int,
@@ -698,7 +819,7 @@ func (d *Database) CompleteSync(
 
 	// Use a zero value SyncPosition for fromPos so all EDU states are added.
 	err = d.addEDUDeltaToResponse(
-		types.NewStreamToken(0, 0), toPos, joinedRoomIDs, res,
+		types.StreamingToken{}, toPos, joinedRoomIDs, res,
 	)
 	if err != nil {
 		return nil, err
@@ -707,6 +828,50 @@ func (d *Database) CompleteSync(
 	return res, nil
 }
 
+func (d *Database) StoreSyncSnapshot(
+	ctx context.Context, device authtypes.Device,
+	filter string, res *types.Response,
+) error {
+	responseJSON, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		return d.SyncSnapshots.UpsertSyncSnapshot(
+			ctx, txn, device.UserID, device.ID, filter, res.NextBatch, responseJSON,
+		)
+	})
+}
+
+func (d *Database) SyncSnapshot(
+	ctx context.Context, device authtypes.Device, filter string,
+) (*types.Response, *types.StreamingToken, error) {
+	snapshotFilter, syncToken, responseJSON, err := d.SyncSnapshots.SelectSyncSnapshot(ctx, nil, device.UserID, device.ID)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if snapshotFilter != filter {
+		return nil, nil, nil
+	}
+	token, err := types.NewStreamTokenFromString(syncToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := types.NewResponse()
+	if err = json.Unmarshal(responseJSON, res); err != nil {
+		return nil, nil, err
+	}
+	return res, &token, nil
+}
+
+func (d *Database) InvalidateSyncSnapshots(ctx context.Context, userID string) error {
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		return d.SyncSnapshots.DeleteSyncSnapshotsForUser(ctx, txn, userID)
+	})
+}
+
 var txReadOnlySnapshot = sql.TxOptions{
 	// Set the isolation level so that we see a snapshot of the database.
 	// In PostgreSQL / MySQL / MariaDB repeatable read transactions will see a snapshot taken
@@ -775,13 +940,31 @@ func (d *Database) addRoomDeltaToResponse(
 		// This is all "okay" assuming history_visibility == "shared" which it is by default.
 		r.To = delta.membershipPos
 	}
+	// Ask for one more event than the limit so that we know whether or not
+	// there is a gap between the position the client has already received
+	// and the start of the timeline.
 	recentStreamEvents, err := d.OutputEvents.SelectRecentEvents(
 		ctx, txn, delta.roomID, r,
-		numRecentEventsPerRoom, true, true,
+		numRecentEventsPerRoom+1, true, true,
 	)
 	if err != nil {
 		return err
 	}
+	limited := false
+	if len(recentStreamEvents) > numRecentEventsPerRoom {
+		limited = true
+		recentStreamEvents = recentStreamEvents[len(recentStreamEvents)-numRecentEventsPerRoom:]
+	}
+	if (limited || delta.fullState) && len(recentStreamEvents) > 0 {
+		// The state events that we have are the ones as of the end of the timeline,
+		// but the client needs the state as of the start of it in order to fill the gap.
+		delta.stateEvents, err = d.stateBeforeTimeline(
+			ctx, device, txn, delta.roomID, r.From, recentStreamEvents[0].StreamPosition-1, delta.fullState,
+		)
+		if err != nil {
+			return err
+		}
+	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
 	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
 	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
@@ -795,7 +978,7 @@ func (d *Database) addRoomDeltaToResponse(
 
 		jr.Timeline.PrevBatch = prevBatch.String()
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Join[delta.roomID] = *jr
 	case gomatrixserverlib.Leave:
@@ -806,7 +989,7 @@ func (d *Database) addRoomDeltaToResponse(
 		lr := types.NewLeaveResponse()
 		lr.Timeline.PrevBatch = prevBatch.String()
 		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		lr.Timeline.Limited = limited
 		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Leave[delta.roomID] = *lr
 	}
@@ -814,6 +997,112 @@ func (d *Database) addRoomDeltaToResponse(
 	return nil
 }
 
+// stateBeforeTimeline returns the state of the room as of the given position
+// just before the start of the timeline. The state is calculated by rolling back
+// the state changes made by every event after that position from the current
+// state of the room. If fullState is false then only the state events which
+// have changed since fromPos, i.e. since the position which the client has
+// already received, are returned.
+func (d *Database) stateBeforeTimeline(
+	ctx context.Context, device *authtypes.Device, txn *sql.Tx,
+	roomID string, fromPos, timelineStart types.StreamPosition, fullState bool,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
+	currentState, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &stateFilter)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := d.OutputEvents.SelectMaxEventID(ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	if fullState {
+		fromPos = timelineStart
+	}
+	changes, err := d.OutputEvents.SelectStateChangesInRange(
+		ctx, txn, roomID, types.Range{From: fromPos, To: types.StreamPosition(latest)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(map[string]bool, len(currentState))
+	for _, ev := range currentState {
+		state[ev.EventID()] = true
+	}
+	var stateAtTimelineStart map[string]bool
+	for i := len(changes) - 1; i >= 0; i-- {
+		if stateAtTimelineStart == nil && changes[i].StreamPosition <= timelineStart {
+			stateAtTimelineStart = copyEventIDSet(state)
+		}
+		for _, id := range changes[i].AddStateIDs {
+			delete(state, id)
+		}
+		for _, id := range changes[i].RemoveStateIDs {
+			state[id] = true
+		}
+	}
+	if stateAtTimelineStart == nil {
+		stateAtTimelineStart = copyEventIDSet(state)
+	}
+
+	// By now state contains the state of the room at fromPos, which the client
+	// already knows about.
+	var wantedIDs []string
+	for id := range stateAtTimelineStart {
+		if fullState || !state[id] {
+			wantedIDs = append(wantedIDs, id)
+		}
+	}
+
+	eventsByID := make(map[string]gomatrixserverlib.HeaderedEvent, len(currentState))
+	for _, ev := range currentState {
+		eventsByID[ev.EventID()] = ev
+	}
+	var missingIDs []string
+	for _, id := range wantedIDs {
+		if _, ok := eventsByID[id]; !ok {
+			missingIDs = append(missingIDs, id)
+		}
+	}
+	if len(missingIDs) > 0 {
+		// State events which have since been replaced aren't in the current
+		// state, but they should be in the events table.
+		var missing []types.StreamEvent
+		missing, err = d.OutputEvents.SelectEvents(ctx, txn, missingIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range d.StreamEventsToEvents(device, missing) {
+			eventsByID[ev.EventID()] = ev
+		}
+	}
+
+	result := make([]gomatrixserverlib.HeaderedEvent, 0, len(wantedIDs))
+	for _, id := range wantedIDs {
+		ev, ok := eventsByID[id]
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"room_id":  roomID,
+				"event_id": id,
+			}).Warn("stateBeforeTimeline: missing state event")
+			continue
+		}
+		result = append(result, ev)
+	}
+	return result, nil
+}
+
+func copyEventIDSet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for id, ok := range set {
+		if ok {
+			c[id] = true
+		}
+	}
+	return c
+}
+
 // fetchStateEvents converts the set of event IDs into a set of events. It will fetch any which are missing from the database.
 // Returns a map of room ID to list of events.
 func (d *Database) fetchStateEvents(
@@ -929,6 +1218,7 @@ func (d *Database) getStateDeltas(
 		return nil, nil, err
 	}
 
+	newlyJoined := make(map[string]bool)
 	for roomID, stateStreamEvents := range state {
 		for _, ev := range stateStreamEvents {
 			// TODO: Currently this will incorrectly add rooms which were ALREADY joined but they sent another no-op join event.
@@ -945,6 +1235,7 @@ func (d *Database) getStateDeltas(
 						return nil, nil, err
 					}
 					state[roomID] = s
+					newlyJoined[roomID] = true
 					continue // we'll add this room in when we do joined rooms
 				}
 
@@ -969,6 +1260,7 @@ func (d *Database) getStateDeltas(
 			membership:  gomatrixserverlib.Join,
 			stateEvents: d.StreamEventsToEvents(device, state[joinedRoomID]),
 			roomID:      joinedRoomID,
+			fullState:   newlyJoined[joinedRoomID],
 		})
 	}
 
@@ -1002,6 +1294,7 @@ func (d *Database) getStateDeltasForFullStateSync(
 			membership:  gomatrixserverlib.Join,
 			stateEvents: d.StreamEventsToEvents(device, s),
 			roomID:      joinedRoomID,
+			fullState:   true,
 		})
 	}
 
@@ -1051,9 +1344,9 @@ func (d *Database) currentStateStreamEventsForRoom(
 }
 
 func (d *Database) SendToDeviceUpdatesWaiting(
-	ctx context.Context, userID, deviceID string,
+	ctx context.Context, userID, deviceID string, from types.StreamPosition,
 ) (bool, error) {
-	count, err := d.SendToDevice.CountSendToDeviceMessages(ctx, nil, userID, deviceID)
+	count, err := d.SendToDevice.CountSendToDeviceMessages(ctx, nil, userID, deviceID, from)
 	if err != nil {
 		return false, err
 	}
@@ -1063,100 +1356,58 @@ func (d *Database) SendToDeviceUpdatesWaiting(
 func (d *Database) AddSendToDeviceEvent(
 	ctx context.Context, txn *sql.Tx,
 	userID, deviceID, content string,
-) error {
+) (types.StreamPosition, error) {
 	return d.SendToDevice.InsertSendToDeviceMessage(
 		ctx, txn, userID, deviceID, content,
 	)
 }
 
 func (d *Database) StoreNewSendForDeviceMessage(
-	ctx context.Context, streamPos types.StreamPosition, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent,
-) (types.StreamPosition, error) {
+	ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent,
+) (streamPos types.StreamPosition, err error) {
 	j, err := json.Marshal(event)
 	if err != nil {
-		return streamPos, err
+		return 0, err
 	}
 	// Delegate the database write task to the SendToDeviceWriter. It'll guarantee
 	// that we don't lock the table for writes in more than one place.
 	err = d.SendToDeviceWriter.Do(d.DB, func(txn *sql.Tx) error {
-		return d.AddSendToDeviceEvent(
+		streamPos, err = d.AddSendToDeviceEvent(
 			ctx, txn, userID, deviceID, string(j),
 		)
+		return err
 	})
-	if err != nil {
-		return streamPos, err
-	}
-	return streamPos, nil
+	return
 }
 
 func (d *Database) SendToDeviceUpdatesForSync(
 	ctx context.Context,
 	userID, deviceID string,
-	token types.StreamingToken,
-) ([]types.SendToDeviceEvent, []types.SendToDeviceNID, []types.SendToDeviceNID, error) {
-	// First of all, get our send-to-device updates for this user.
-	events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, nil, userID, deviceID)
+	from, to types.StreamPosition,
+) ([]types.SendToDeviceEvent, error) {
+	events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, nil, userID, deviceID, from, to)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("d.SendToDevice.SelectSendToDeviceMessages: %w", err)
-	}
-
-	// If there's nothing to do then stop here.
-	if len(events) == 0 {
-		return nil, nil, nil, nil
-	}
-
-	// Work out whether we need to update any of the database entries.
-	toReturn := []types.SendToDeviceEvent{}
-	toUpdate := []types.SendToDeviceNID{}
-	toDelete := []types.SendToDeviceNID{}
-	for _, event := range events {
-		if event.SentByToken == nil {
-			// If the event has no sent-by token yet then we haven't attempted to send
-			// it. Record the current requested sync token in the database.
-			toUpdate = append(toUpdate, event.ID)
-			toReturn = append(toReturn, event)
-			event.SentByToken = &token
-		} else if token.IsAfter(*event.SentByToken) {
-			// The event had a sync token, therefore we've sent it before. The current
-			// sync token is now after the stored one so we can assume that the client
-			// successfully completed the previous sync (it would re-request it otherwise)
-			// so we can remove the entry from the database.
-			toDelete = append(toDelete, event.ID)
-		} else {
-			// It looks like the sync is being re-requested, maybe it timed out or
-			// failed. Re-send any that should have been acknowledged by now.
-			toReturn = append(toReturn, event)
-		}
+		return nil, fmt.Errorf("d.SendToDevice.SelectSendToDeviceMessages: %w", err)
 	}
-
-	return toReturn, toUpdate, toDelete, nil
+	return events, nil
 }
 
 func (d *Database) CleanSendToDeviceUpdates(
 	ctx context.Context,
-	toUpdate, toDelete []types.SendToDeviceNID,
-	token types.StreamingToken,
+	userID, deviceID string,
+	before types.StreamPosition,
 ) (err error) {
-	if len(toUpdate) == 0 && len(toDelete) == 0 {
+	if before == 0 {
 		return nil
 	}
-	// If we need to write to the database then we'll ask the SendToDeviceWriter to
-	// do that for us. It'll guarantee that we don't lock the table for writes in
-	// more than one place.
-	err = d.SendToDeviceWriter.Do(d.DB, func(txn *sql.Tx) error {
-		// Delete any send-to-device messages marked for deletion.
-		if e := d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, toDelete); e != nil {
+	// Ask the SendToDeviceWriter to do the deletion for us. It'll guarantee
+	// that we don't lock the table for writes in more than one place.
+	return d.SendToDeviceWriter.Do(d.DB, func(txn *sql.Tx) error {
+		if e := d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, deviceID, before); e != nil {
 			return fmt.Errorf("d.SendToDevice.DeleteSendToDeviceMessages: %w", e)
 		}
-
-		// Now update any outstanding send-to-device messages with the new sync token.
-		if e := d.SendToDevice.UpdateSentSendToDeviceMessages(ctx, txn, token.String(), toUpdate); e != nil {
-			return fmt.Errorf("d.SendToDevice.UpdateSentSendToDeviceMessages: %w", err)
-		}
-
 		return nil
 	})
-	return
 }
 
 // There may be some overlap where events in stateEvents are already in recentEvents, so filter
@@ -1204,4 +1455,7 @@ type stateDelta struct {
 	// The PDU stream position of the latest membership event for this user, if applicable.
 	// Can be 0 if there is no membership event in this delta.
 	membershipPos types.StreamPosition
+	// Whether stateEvents is the full state of the room rather than the state
+	// which has changed since the position which the client has received.
+	fullState bool
 }
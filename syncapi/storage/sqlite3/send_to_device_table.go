@@ -18,7 +18,6 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"strings"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
@@ -28,52 +27,70 @@ import (
 const sendToDeviceSchema = `
 -- Stores send-to-device messages.
 CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
-	-- The ID that uniquely identifies this message.
+	-- The ID that uniquely identifies this message. This is also its
+	-- position in the send-to-device stream.
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	-- The user ID to send the message to.
 	user_id TEXT NOT NULL,
 	-- The device ID to send the message to.
 	device_id TEXT NOT NULL,
 	-- The event content JSON.
-	content TEXT NOT NULL,
-	-- The token that was supplied to the /sync at the time that this
-	-- message was included in a sync response, or NULL if we haven't
-	-- included it in a /sync response yet.
-	sent_by_token TEXT
+	content TEXT NOT NULL
 );
+
+-- Stores the highest ID ever given to a send-to-device message. Unlike
+-- MAX(id), this doesn't go backwards when messages are deleted.
+CREATE TABLE IF NOT EXISTS syncapi_send_to_device_position (
+	-- There is only ever one row.
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	max_id BIGINT NOT NULL
+);
+
+-- Start from the autoincrement sequence, which is never behind any ID that
+-- was given out before this table existed.
+INSERT OR IGNORE INTO syncapi_send_to_device_position (id, max_id)
+	SELECT 1, COALESCE(MAX(seq), 0) FROM sqlite_sequence
+	WHERE name = 'syncapi_send_to_device';
+`
+
+const nextSendToDeviceMessageIDSQL = `
+	UPDATE syncapi_send_to_device_position SET max_id = max_id + 1
 `
 
 const insertSendToDeviceMessageSQL = `
-	INSERT INTO syncapi_send_to_device (user_id, device_id, content)
-	  VALUES ($1, $2, $3)
+	INSERT INTO syncapi_send_to_device (id, user_id, device_id, content)
+	  VALUES ($1, $2, $3, $4)
+`
+
+const selectMaxSendToDeviceMessageIDSQL = `
+	SELECT max_id FROM syncapi_send_to_device_position
 `
 
 const countSendToDeviceMessagesSQL = `
 	SELECT COUNT(*)
 	  FROM syncapi_send_to_device
-	  WHERE user_id = $1 AND device_id = $2
+	  WHERE user_id = $1 AND device_id = $2 AND id > $3
 `
 
 const selectSendToDeviceMessagesSQL = `
-	SELECT id, user_id, device_id, content, sent_by_token
+	SELECT id, user_id, device_id, content
 	  FROM syncapi_send_to_device
-	  WHERE user_id = $1 AND device_id = $2
-	  ORDER BY id DESC
-`
-
-const updateSentSendToDeviceMessagesSQL = `
-	UPDATE syncapi_send_to_device SET sent_by_token = $1
-	  WHERE id IN ($2)
+	  WHERE user_id = $1 AND device_id = $2 AND id > $3 AND id <= $4
+	  ORDER BY id ASC
 `
 
 const deleteSendToDeviceMessagesSQL = `
-	DELETE FROM syncapi_send_to_device WHERE id IN ($1)
+	DELETE FROM syncapi_send_to_device
+	  WHERE user_id = $1 AND device_id = $2 AND id <= $3
 `
 
 type sendToDeviceStatements struct {
-	insertSendToDeviceMessageStmt  *sql.Stmt
-	selectSendToDeviceMessagesStmt *sql.Stmt
-	countSendToDeviceMessagesStmt  *sql.Stmt
+	nextSendToDeviceMessageIDStmt      *sql.Stmt
+	insertSendToDeviceMessageStmt      *sql.Stmt
+	selectMaxSendToDeviceMessageIDStmt *sql.Stmt
+	countSendToDeviceMessagesStmt      *sql.Stmt
+	selectSendToDeviceMessagesStmt     *sql.Stmt
+	deleteSendToDeviceMessagesStmt     *sql.Stmt
 }
 
 func NewSqliteSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
@@ -82,29 +99,53 @@ func NewSqliteSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 	if err != nil {
 		return nil, err
 	}
-	if s.countSendToDeviceMessagesStmt, err = db.Prepare(countSendToDeviceMessagesSQL); err != nil {
+	if s.nextSendToDeviceMessageIDStmt, err = db.Prepare(nextSendToDeviceMessageIDSQL); err != nil {
 		return nil, err
 	}
 	if s.insertSendToDeviceMessageStmt, err = db.Prepare(insertSendToDeviceMessageSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMaxSendToDeviceMessageIDStmt, err = db.Prepare(selectMaxSendToDeviceMessageIDSQL); err != nil {
+		return nil, err
+	}
+	if s.countSendToDeviceMessagesStmt, err = db.Prepare(countSendToDeviceMessagesSQL); err != nil {
+		return nil, err
+	}
 	if s.selectSendToDeviceMessagesStmt, err = db.Prepare(selectSendToDeviceMessagesSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
 func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
 	ctx context.Context, txn *sql.Tx, userID, deviceID, content string,
-) (err error) {
-	_, err = internal.TxStmt(txn, s.insertSendToDeviceMessageStmt).ExecContext(ctx, userID, deviceID, content)
+) (pos types.StreamPosition, err error) {
+	if _, err = internal.TxStmt(txn, s.nextSendToDeviceMessageIDStmt).ExecContext(ctx); err != nil {
+		return
+	}
+	err = internal.TxStmt(txn, s.selectMaxSendToDeviceMessageIDStmt).QueryRowContext(ctx).Scan(&pos)
+	if err != nil {
+		return
+	}
+	_, err = internal.TxStmt(txn, s.insertSendToDeviceMessageStmt).ExecContext(ctx, pos, userID, deviceID, content)
+	return
+}
+
+func (s *sendToDeviceStatements) SelectMaxSendToDeviceMessageID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	stmt := internal.TxStmt(txn, s.selectMaxSendToDeviceMessageIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&id)
 	return
 }
 
 func (s *sendToDeviceStatements) CountSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition,
 ) (count int, err error) {
-	row := internal.TxStmt(txn, s.countSendToDeviceMessagesStmt).QueryRowContext(ctx, userID, deviceID)
+	row := internal.TxStmt(txn, s.countSendToDeviceMessagesStmt).QueryRowContext(ctx, userID, deviceID, from)
 	if err = row.Scan(&count); err != nil {
 		return
 	}
@@ -112,19 +153,18 @@ func (s *sendToDeviceStatements) CountSendToDeviceMessages(
 }
 
 func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, from, to types.StreamPosition,
 ) (events []types.SendToDeviceEvent, err error) {
-	rows, err := internal.TxStmt(txn, s.selectSendToDeviceMessagesStmt).QueryContext(ctx, userID, deviceID)
+	rows, err := internal.TxStmt(txn, s.selectSendToDeviceMessagesStmt).QueryContext(ctx, userID, deviceID, from, to)
 	if err != nil {
 		return
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "SelectSendToDeviceMessages: rows.close() failed")
 
 	for rows.Next() {
-		var id types.SendToDeviceNID
+		var id types.StreamPosition
 		var userID, deviceID, content string
-		var sentByToken *string
-		if err = rows.Scan(&id, &userID, &deviceID, &content, &sentByToken); err != nil {
+		if err = rows.Scan(&id, &userID, &deviceID, &content); err != nil {
 			return
 		}
 		event := types.SendToDeviceEvent{
@@ -135,38 +175,15 @@ func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
 		if err = json.Unmarshal([]byte(content), &event.SendToDeviceEvent); err != nil {
 			return
 		}
-		if sentByToken != nil {
-			if token, err := types.NewStreamTokenFromString(*sentByToken); err == nil {
-				event.SentByToken = &token
-			}
-		}
 		events = append(events, event)
 	}
 
 	return events, rows.Err()
 }
 
-func (s *sendToDeviceStatements) UpdateSentSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, token string, nids []types.SendToDeviceNID,
-) (err error) {
-	query := strings.Replace(updateSentSendToDeviceMessagesSQL, "($2)", internal.QueryVariadic(1+len(nids)), 1)
-	params := make([]interface{}, 1+len(nids))
-	params[0] = token
-	for k, v := range nids {
-		params[k+1] = v
-	}
-	_, err = txn.ExecContext(ctx, query, params...)
-	return
-}
-
 func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, nids []types.SendToDeviceNID,
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, pos types.StreamPosition,
 ) (err error) {
-	query := strings.Replace(deleteSendToDeviceMessagesSQL, "($1)", internal.QueryVariadic(len(nids)), 1)
-	params := make([]interface{}, 1+len(nids))
-	for k, v := range nids {
-		params[k] = v
-	}
-	_, err = txn.ExecContext(ctx, query, params...)
+	_, err = internal.TxStmt(txn, s.deleteSendToDeviceMessagesStmt).ExecContext(ctx, userID, deviceID, pos)
 	return
 }
@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+const syncSnapshotsSchema = `
+-- Stores a recent complete sync response for each device, so that token-less
+-- syncs can be served from the snapshot plus an incremental sync.
+CREATE TABLE IF NOT EXISTS syncapi_sync_snapshots (
+	-- The user ID that the snapshot belongs to.
+	user_id TEXT NOT NULL,
+	-- The device ID that the snapshot belongs to.
+	device_id TEXT NOT NULL,
+	-- The filter that the snapshot was calculated with.
+	sync_filter TEXT NOT NULL,
+	-- The sync token that the snapshot was calculated at.
+	sync_token TEXT NOT NULL,
+	-- The JSON-encoded sync response.
+	response_json TEXT NOT NULL,
+	UNIQUE (user_id, device_id)
+);
+`
+
+const upsertSyncSnapshotSQL = "" +
+	"INSERT INTO syncapi_sync_snapshots (user_id, device_id, sync_filter, sync_token, response_json)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, device_id)" +
+	" DO UPDATE SET sync_filter = $3, sync_token = $4, response_json = $5"
+
+const selectSyncSnapshotSQL = "" +
+	"SELECT sync_filter, sync_token, response_json FROM syncapi_sync_snapshots" +
+	" WHERE user_id = $1 AND device_id = $2"
+
+const deleteSyncSnapshotsForUserSQL = "" +
+	"DELETE FROM syncapi_sync_snapshots WHERE user_id = $1"
+
+type syncSnapshotsStatements struct {
+	upsertSyncSnapshotStmt         *sql.Stmt
+	selectSyncSnapshotStmt         *sql.Stmt
+	deleteSyncSnapshotsForUserStmt *sql.Stmt
+}
+
+func NewSqliteSyncSnapshotsTable(db *sql.DB) (tables.SyncSnapshots, error) {
+	s := &syncSnapshotsStatements{}
+	_, err := db.Exec(syncSnapshotsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertSyncSnapshotStmt, err = db.Prepare(upsertSyncSnapshotSQL); err != nil {
+		return nil, err
+	}
+	if s.selectSyncSnapshotStmt, err = db.Prepare(selectSyncSnapshotSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSyncSnapshotsForUserStmt, err = db.Prepare(deleteSyncSnapshotsForUserSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syncSnapshotsStatements) UpsertSyncSnapshot(
+	ctx context.Context, txn *sql.Tx,
+	userID, deviceID, filter, syncToken string, responseJSON []byte,
+) (err error) {
+	stmt := internal.TxStmt(txn, s.upsertSyncSnapshotStmt)
+	_, err = stmt.ExecContext(ctx, userID, deviceID, filter, syncToken, string(responseJSON))
+	return
+}
+
+func (s *syncSnapshotsStatements) SelectSyncSnapshot(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) (filter, syncToken string, responseJSON []byte, err error) {
+	stmt := internal.TxStmt(txn, s.selectSyncSnapshotStmt)
+	err = stmt.QueryRowContext(ctx, userID, deviceID).Scan(&filter, &syncToken, &responseJSON)
+	return
+}
+
+func (s *syncSnapshotsStatements) DeleteSyncSnapshotsForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (err error) {
+	stmt := internal.TxStmt(txn, s.deleteSyncSnapshotsForUserStmt)
+	_, err = stmt.ExecContext(ctx, userID)
+	return
+}
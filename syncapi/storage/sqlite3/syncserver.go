@@ -16,6 +16,7 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -89,6 +90,14 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	syncSnapshots, err := NewSqliteSyncSnapshotsTable(d.db)
+	if err != nil {
+		return err
+	}
+	typing, err := NewSqliteTypingTable(d.db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -100,6 +109,11 @@ func (d *SyncServerDatasource) prepare() (err error) {
 		SendToDevice:        sendToDevice,
 		SendToDeviceWriter:  internal.NewTransactionWriter(),
 		EDUCache:            cache.New(),
+		SyncSnapshots:       syncSnapshots,
+		Typing:              typing,
+	}
+	if err = d.Database.RestoreTypingNotifications(context.Background()); err != nil {
+		return err
 	}
 	return nil
 }
@@ -5,6 +5,9 @@ import (
 	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -125,6 +128,32 @@ func MustWriteEvents(t *testing.T, db storage.Database, events []gomatrixserverl
 	return
 }
 
+// MustWriteStateReplacingEvents is like MustWriteEvents but state events replace any previous state event
+// with the same type and state key which was written by it.
+func MustWriteStateReplacingEvents(t *testing.T, db storage.Database, events []gomatrixserverlib.HeaderedEvent) (positions []types.StreamPosition) {
+	current := make(map[string]string)
+	for _, ev := range events {
+		var addStateEvents []gomatrixserverlib.HeaderedEvent
+		var addStateEventIDs []string
+		var removeStateEventIDs []string
+		if ev.StateKey() != nil {
+			key := ev.Type() + "|" + *ev.StateKey()
+			if prev, ok := current[key]; ok {
+				removeStateEventIDs = append(removeStateEventIDs, prev)
+			}
+			current[key] = ev.EventID()
+			addStateEvents = append(addStateEvents, ev)
+			addStateEventIDs = append(addStateEventIDs, ev.EventID())
+		}
+		pos, err := db.WriteEvent(ctx, &ev, addStateEvents, addStateEventIDs, removeStateEventIDs, nil, false)
+		if err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		positions = append(positions, pos)
+	}
+	return
+}
+
 func TestWriteEvents(t *testing.T) {
 	t.Parallel()
 	db := MustCreateDatabase(t)
@@ -155,9 +184,9 @@ func TestSyncResponse(t *testing.T) {
 		{
 			Name: "IncrementalSync penultimate",
 			DoSync: func() (*types.Response, error) {
-				from := types.NewStreamToken( // pretend we are at the penultimate event
-					positions[len(positions)-2], types.StreamPosition(0),
-				)
+				from := types.StreamingToken{ // pretend we are at the penultimate event
+					PDUPosition: positions[len(positions)-2],
+				}
 				res := types.NewResponse()
 				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
 			},
@@ -168,9 +197,9 @@ func TestSyncResponse(t *testing.T) {
 		{
 			Name: "IncrementalSync limited",
 			DoSync: func() (*types.Response, error) {
-				from := types.NewStreamToken( // pretend we are 10 events behind
-					positions[len(positions)-11], types.StreamPosition(0),
-				)
+				from := types.StreamingToken{ // pretend we are 10 events behind
+					PDUPosition: positions[len(positions)-11],
+				}
 				res := types.NewResponse()
 				// limit is set to 5
 				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
@@ -212,7 +241,7 @@ func TestSyncResponse(t *testing.T) {
 			if err != nil {
 				st.Fatalf("failed to do sync: %s", err)
 			}
-			next := types.NewStreamToken(latest.PDUPosition(), latest.EDUPosition())
+			next := latest
 			if res.NextBatch != next.String() {
 				st.Errorf("NextBatch got %s want %s", res.NextBatch, next.String())
 			}
@@ -226,6 +255,130 @@ func TestSyncResponse(t *testing.T) {
 	}
 }
 
+// The purpose of this test is to check that a limited incremental sync returns the state at the start
+// of the timeline, rather than the state at the end of it, when there is a lot of state churn in the gap.
+func TestIncrementalSyncLimitedWithStateChurn(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// Change the topic and the name of the room lots of times, then send some
+	// messages and finally change the topic once more.
+	var churn []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 15; i++ {
+		for _, evType := range []string{"m.room.topic", "m.room.name"} {
+			churn = append(churn, MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+				Content:  []byte(fmt.Sprintf(`{"topic":"Topic %d","name":"Name %d"}`, i, i)),
+				Type:     evType,
+				StateKey: &emptyStateKey,
+				Sender:   testUserIDA,
+				Depth:    int64(len(events) + 1),
+			}))
+			events = append(events, churn[len(churn)-1])
+		}
+	}
+	for i := 0; i < 4; i++ {
+		events = append(events, MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Message C %d"}`, i+1)),
+			Type:    "m.room.message",
+			Sender:  testUserIDA,
+			Depth:   int64(len(events) + 1),
+		}))
+		churn = append(churn, events[len(events)-1])
+	}
+	events = append(events, MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"topic":"Final topic"}`),
+		Type:     "m.room.topic",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	}))
+	churn = append(churn, events[len(events)-1])
+	positions := MustWriteStateReplacingEvents(t, db, churn)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// The last topic and name changes before the timeline.
+	lastTopic, lastName := churn[28], churn[29]
+	timeline := churn[len(churn)-5:]
+
+	testCases := []struct {
+		Name          string
+		From          types.StreamingToken
+		FullState     bool
+		WantLimited   bool
+		WantTimeline  []gomatrixserverlib.HeaderedEvent
+		WantStateIDs  []string
+		WantPrevBatch bool
+	}{
+		{
+			Name:          "limited",
+			From:          from,
+			WantLimited:   true,
+			WantTimeline:  timeline,
+			WantStateIDs:  []string{lastTopic.EventID(), lastName.EventID()},
+			WantPrevBatch: true,
+		},
+		{
+			Name:          "limited full state",
+			From:          from,
+			FullState:     true,
+			WantLimited:   true,
+			WantTimeline:  timeline,
+			WantStateIDs:  []string{state[0].EventID(), state[1].EventID(), state[2].EventID(), lastTopic.EventID(), lastName.EventID()},
+			WantPrevBatch: true,
+		},
+		{
+			Name:         "not limited",
+			From:         types.StreamingToken{PDUPosition: positions[len(positions)-3]},
+			WantTimeline: churn[len(churn)-2:],
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(st *testing.T) {
+			res, err := db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, tc.From, latest, 5, tc.FullState)
+			if err != nil {
+				st.Fatalf("failed to do sync: %s", err)
+			}
+			roomRes, ok := res.Rooms.Join[testRoomID]
+			if !ok {
+				st.Fatalf("IncrementalSync response missing room %s - response: %+v", testRoomID, res)
+			}
+			if roomRes.Timeline.Limited != tc.WantLimited {
+				st.Errorf("limited: got %v want %v", roomRes.Timeline.Limited, tc.WantLimited)
+			}
+			assertEventsEqual(st, "timeline for "+testRoomID, false, roomRes.Timeline.Events, tc.WantTimeline)
+			gotStateIDs := make(map[string]bool)
+			for _, ev := range roomRes.State.Events {
+				gotStateIDs[ev.EventID] = true
+			}
+			if len(gotStateIDs) != len(tc.WantStateIDs) {
+				st.Errorf("state: got %d events want %d", len(gotStateIDs), len(tc.WantStateIDs))
+			}
+			for _, id := range tc.WantStateIDs {
+				if !gotStateIDs[id] {
+					st.Errorf("state: missing event %s", id)
+				}
+			}
+			if tc.WantPrevBatch {
+				// The client should be able to fill the gap from the prev_batch.
+				want := topologyTokenBefore(st, db, tc.WantTimeline[0].EventID())
+				if roomRes.Timeline.PrevBatch != want.String() {
+					st.Errorf("prev_batch: got %s want %s", roomRes.Timeline.PrevBatch, want.String())
+				}
+			}
+		})
+	}
+}
+
 func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	t.Parallel()
 	db := MustCreateDatabase(t)
@@ -235,9 +388,9 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
-	from := types.NewStreamToken(
-		positions[len(positions)-2], types.StreamPosition(0),
-	)
+	from := types.StreamingToken{
+		PDUPosition: positions[len(positions)-2],
+	}
 
 	res := types.NewResponse()
 	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
@@ -281,7 +434,7 @@ func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
 	// head towards the beginning of time
-	to := types.NewStreamToken(0, 0)
+	to := types.StreamingToken{}
 
 	// backpaginate 5 messages starting at the latest position.
 	paginatedEvents, err := db.GetEventsInStreamingRange(ctx, &latest, &to, testRoomID, 5, true)
@@ -524,20 +677,86 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 
 	// At this point there should be no messages. We haven't sent anything
 	// yet.
-	events, updates, deletions, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, 0))
+	events, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", 0, 100)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 0 || len(updates) != 0 || len(deletions) != 0 {
+	if len(events) != 0 {
 		t.Fatal("first call should have no updates")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, 0))
+
+	// Try sending some messages.
+	var streamPos types.StreamPosition
+	for i := 0; i < 2; i++ {
+		streamPos, err = db.StoreNewSendForDeviceMessage(ctx, "alice", "one", gomatrixserverlib.SendToDeviceEvent{
+			Sender:  "bob",
+			Type:    "m.type",
+			Content: json.RawMessage("{}"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pos, err := db.SyncPosition(ctx)
 	if err != nil {
-		return
+		t.Fatal(err)
+	}
+	if pos.SendToDevicePosition != streamPos {
+		t.Fatalf("expected send-to-device position %d, got %d", streamPos, pos.SendToDevicePosition)
+	}
+
+	// At this point we should get both messages, oldest first.
+	events, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", 0, streamPos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID >= events[1].ID || events[1].ID != streamPos {
+		t.Fatalf("second call should have two updates in order, got %+v", events)
+	}
+
+	// The client failing to /sync and retrying with the same position should
+	// get the same messages again.
+	if err = db.CleanSendToDeviceUpdates(ctx, "alice", "one", 0); err != nil {
+		t.Fatal(err)
+	}
+	events, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", 0, streamPos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatal("third call should have two updates still")
+	}
+
+	// Syncing from the position of the first message should delete it and
+	// only return the second one.
+	first := events[0].ID
+	if err = db.CleanSendToDeviceUpdates(ctx, "alice", "one", first); err != nil {
+		t.Fatal(err)
+	}
+	events, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", 0, streamPos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != streamPos {
+		t.Fatalf("fourth call should have one update, got %+v", events)
 	}
 
-	// Try sending a message.
-	streamPos, err := db.StoreNewSendForDeviceMessage(ctx, types.StreamPosition(0), "alice", "one", gomatrixserverlib.SendToDeviceEvent{
+	// Once both are acknowledged there should be nothing left, but the
+	// position of the stream must not go backwards.
+	if err = db.CleanSendToDeviceUpdates(ctx, "alice", "one", streamPos); err != nil {
+		t.Fatal(err)
+	}
+	if waiting, werr := db.SendToDeviceUpdatesWaiting(ctx, "alice", "one", 0); werr != nil || waiting {
+		t.Fatalf("expected no updates waiting, got %v (err %v)", waiting, werr)
+	}
+	pos, err = db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos.SendToDevicePosition != streamPos {
+		t.Fatalf("send-to-device position went backwards: got %d want %d", pos.SendToDevicePosition, streamPos)
+	}
+	nextPos, err := db.StoreNewSendForDeviceMessage(ctx, "alice", "one", gomatrixserverlib.SendToDeviceEvent{
 		Sender:  "bob",
 		Type:    "m.type",
 		Content: json.RawMessage("{}"),
@@ -545,59 +764,138 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if nextPos <= streamPos {
+		t.Fatalf("send-to-device position reused: got %d after %d", nextPos, streamPos)
+	}
+}
 
-	// At this point we should get exactly one message. We're sending the sync position
-	// that we were given from the update and the send-to-device update will be updated
-	// in the database to reflect that this was the sync position we sent the message at.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos))
+func TestTypingNotificationsSurviveRestart(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "syncapi_typing")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 1 || len(updates) != 1 || len(deletions) != 0 {
-		t.Fatal("second call should have one update")
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dataSource := "file:" + filepath.Join(dir, "syncapi.db")
+
+	db, err := sqlite3.NewDatabase(dataSource)
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	expireTime := time.Now().Add(time.Minute)
+	if _, err = db.AddTypingUser(ctx, testUserIDA, testRoomID, &expireTime); err != nil {
+		t.Fatalf("AddTypingUser failed: %s", err)
+	}
+	if _, err = db.AddTypingUser(ctx, testUserIDB, testRoomID, &expireTime); err != nil {
+		t.Fatalf("AddTypingUser failed: %s", err)
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, streamPos))
+	if _, err = db.RemoveTypingUser(ctx, testUserIDB, testRoomID); err != nil {
+		t.Fatalf("RemoveTypingUser failed: %s", err)
+	}
+	before, err := db.SyncPosition(ctx)
 	if err != nil {
-		return
+		t.Fatalf("SyncPosition failed: %s", err)
 	}
 
-	// At this point we should still have one message because we haven't progressed the
-	// sync position yet. This is equivalent to the client failing to /sync and retrying
-	// with the same position.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos))
+	// Opening the database again should restore the typing state.
+	db, err = sqlite3.NewDatabase(dataSource)
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	after, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("SyncPosition failed: %s", err)
+	}
+	if after != before {
+		t.Fatalf("sync position changed across restart: got %s want %s", after.String(), before.String())
+	}
+	res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, 5)
 	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	ephemeral := res.Rooms.Join[testRoomID].Ephemeral.Events
+	if len(ephemeral) != 1 || ephemeral[0].Type != gomatrixserverlib.MTyping {
+		t.Fatalf("expected a typing notification, got %+v", ephemeral)
+	}
+	var content struct {
+		UserIDs []string `json:"user_ids"`
+	}
+	if err = json.Unmarshal(ephemeral[0].Content, &content); err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 1 || len(updates) != 0 || len(deletions) != 0 {
-		t.Fatal("third call should have one update still")
+	if len(content.UserIDs) != 1 || content.UserIDs[0] != testUserIDA {
+		t.Fatalf("typing users: got %v want [%s]", content.UserIDs, testUserIDA)
+	}
+}
+
+func TestSyncSnapshots(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events[:len(events)-1])
+	snapshotFilter := `{"room":{"timeline":{"limit":5}}}`
+
+	// There shouldn't be a snapshot to begin with.
+	snapshot, _, err := db.SyncSnapshot(ctx, testUserDeviceA, snapshotFilter)
+	if err != nil {
+		t.Fatalf("SyncSnapshot failed: %s", err)
+	}
+	if snapshot != nil {
+		t.Fatalf("expected no snapshot, got one")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, streamPos))
+
+	res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, 5)
 	if err != nil {
-		return
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	if err = db.StoreSyncSnapshot(ctx, testUserDeviceA, snapshotFilter, res); err != nil {
+		t.Fatalf("StoreSyncSnapshot failed: %s", err)
 	}
 
-	// At this point we should now have no updates, because we've progressed the sync
-	// position. Therefore the update from before will not be sent again.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos+1))
+	// A snapshot calculated with a different filter shouldn't be returned.
+	snapshot, _, err = db.SyncSnapshot(ctx, testUserDeviceA, `{"room":{"timeline":{"limit":5,"types":["m.room.message"]}}}`)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("SyncSnapshot failed: %s", err)
 	}
-	if len(events) != 0 || len(updates) != 0 || len(deletions) != 1 {
-		t.Fatal("fourth call should have no updates")
+	if snapshot != nil {
+		t.Fatalf("expected no snapshot for a different filter, got one")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, streamPos+1))
+
+	snapshot, pos, err := db.SyncSnapshot(ctx, testUserDeviceA, snapshotFilter)
 	if err != nil {
-		return
+		t.Fatalf("SyncSnapshot failed: %s", err)
+	}
+	if snapshot == nil {
+		t.Fatalf("expected a snapshot, got none")
+	}
+	if pos.String() != res.NextBatch {
+		t.Errorf("snapshot position: got %s want %s", pos.String(), res.NextBatch)
+	}
+	if len(snapshot.Rooms.Join[testRoomID].Timeline.Events) != 5 {
+		t.Errorf("snapshot timeline: got %d events want 5", len(snapshot.Rooms.Join[testRoomID].Timeline.Events))
 	}
 
-	// At this point we should still have no updates, because no new updates have been
-	// sent.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos+2))
+	// Non-membership events shouldn't invalidate the snapshot, but membership
+	// events for the user should.
+	MustWriteEvents(t, db, events[len(events)-1:])
+	if snapshot, _, err = db.SyncSnapshot(ctx, testUserDeviceA, snapshotFilter); err != nil || snapshot == nil {
+		t.Fatalf("expected a snapshot after a message event, got %v (err %v)", snapshot, err)
+	}
+	leave := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"leave"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	})
+	_, err = db.WriteEvent(ctx, &leave, []gomatrixserverlib.HeaderedEvent{leave}, []string{leave.EventID()}, []string{events[1].EventID()}, nil, false)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("WriteEvent failed: %s", err)
 	}
-	if len(events) != 0 || len(updates) != 0 || len(deletions) != 0 {
-		t.Fatal("fifth call should have no updates")
+	if snapshot, _, err = db.SyncSnapshot(ctx, testUserDeviceA, snapshotFilter); err != nil || snapshot != nil {
+		t.Fatalf("expected no snapshot after a membership change, got %v (err %v)", snapshot, err)
 	}
 }
 
@@ -40,6 +40,8 @@ type Invites interface {
 
 type Events interface {
 	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, stateFilter *gomatrixserverlib.StateFilter) (map[string]map[string]bool, map[string]types.StreamEvent, error)
+	// SelectStateChangesInRange returns the state changes made by each event in the room between the two stream positions, in stream order.
+	SelectStateChangesInRange(ctx context.Context, txn *sql.Tx, roomID string, r types.Range) ([]types.StateChange, error)
 	SelectMaxEventID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 	InsertEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, addState, removeState []string, transactionID *api.TransactionID, excludeFromSync bool) (streamPos types.StreamPosition, err error)
 	// SelectRecentEvents returns events between the two stream positions: exclusive of low and inclusive of high.
@@ -49,6 +51,8 @@ type Events interface {
 	// SelectEarlyEvents returns the earliest events in the given room.
 	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
+	// DeleteEvents deletes the events with the given IDs, e.g. because they have been purged by the roomserver.
+	DeleteEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) error
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -66,6 +70,8 @@ type Topology interface {
 	SelectPositionInTopology(ctx context.Context, txn *sql.Tx, eventID string) (depth, spos types.StreamPosition, err error)
 	// SelectMaxPositionInTopology returns the event which has the highest depth, and if there are multiple, the event with the highest stream position.
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
+	// DeleteTopologyForEvents removes the given events from the topology of their rooms.
+	DeleteTopologyForEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) error
 }
 
 type CurrentRoomState interface {
@@ -77,6 +83,9 @@ type CurrentRoomState interface {
 	SelectCurrentState(ctx context.Context, txn *sql.Tx, roomID string, stateFilter *gomatrixserverlib.StateFilter) ([]gomatrixserverlib.HeaderedEvent, error)
 	// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
+	// SelectRoomLatestPositionsWithMembership returns the stream position of the latest event in each room
+	// which has the given user in the given membership state, keyed by room ID.
+	SelectRoomLatestPositionsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) (map[string]types.StreamPosition, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context) (map[string][]string, error)
 }
@@ -113,23 +122,61 @@ type BackwardsExtremities interface {
 // clients. Each message gets inserted into this table at the point that we
 // receive it from the EDU server.
 //
-// We're supposed to try and do our best to deliver send-to-device messages
-// once, but the only way that we can really guarantee that they have been
-// delivered is if the client successfully requests the next sync as given
-// in the next_batch. Each time the device syncs, we will request all of the
-// updates that either haven't been sent yet, along with all updates that we
-// *have* sent but we haven't confirmed to have been received yet. If it's the
-// first time we're sending a given update then we update the table to say
-// what the "since" parameter was when we tried to send it.
+// Each message is given the next position in the send-to-device stream. A
+// sync returns the messages for the device between the "since" position and
+// the current position. The only way that we can really guarantee that they
+// have been delivered is if the client successfully requests the next sync
+// as given in the next_batch, so the messages up to the "since" position of
+// a sync are deleted from the table at that point. If the sync is repeated
+// with the same "since" position, the same messages are sent again.
 //
-// When the client syncs again, if their "since" parameter is *later* than
-// the recorded one, we drop the entry from the DB as it's "sent". If the
-// sync parameter isn't later then we will keep including the updates in the
-// sync response, as the client is seemingly trying to repeat the same /sync.
+// The highest position ever given to a message is persisted separately from
+// the messages themselves, so that the position of the stream never goes
+// backwards when messages are deleted.
 type SendToDevice interface {
-	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (err error)
-	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string) (events []types.SendToDeviceEvent, err error)
-	UpdateSentSendToDeviceMessages(ctx context.Context, txn *sql.Tx, token string, nids []types.SendToDeviceNID) (err error)
-	DeleteSendToDeviceMessages(ctx context.Context, txn *sql.Tx, nids []types.SendToDeviceNID) (err error)
-	CountSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string) (count int, err error)
+	// InsertSendToDeviceMessage stores a new send-to-device message and returns its ID, which
+	// is also its position in the send-to-device stream.
+	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (pos types.StreamPosition, err error)
+	// SelectMaxSendToDeviceMessageID returns the highest position ever given to a message,
+	// which is the current position of the send-to-device stream.
+	SelectMaxSendToDeviceMessageID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectSendToDeviceMessages returns the messages for the device with positions in the
+	// range (from, to], oldest first.
+	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, from, to types.StreamPosition) (events []types.SendToDeviceEvent, err error)
+	// DeleteSendToDeviceMessages deletes the messages for the device with positions up to and
+	// including the given position.
+	DeleteSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, pos types.StreamPosition) (err error)
+	// CountSendToDeviceMessages returns the number of messages for the device with positions
+	// after the given position.
+	CountSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition) (count int, err error)
+}
+
+// Typing stores the typing state of each user in each room. Typing notifications are
+// served from the EDU cache, but are persisted here so that the cache can be restored
+// after a restart.
+type Typing interface {
+	// UpsertTypingUser records that the user started typing in the room at the given stream
+	// position, or stopped typing if expiresAt is 0. Rows at later stream positions are
+	// never replaced.
+	UpsertTypingUser(ctx context.Context, txn *sql.Tx, roomID, userID string, expiresAt gomatrixserverlib.Timestamp, pos types.StreamPosition) (err error)
+	// SelectTypingNotifications returns the typing state of every user in every room.
+	SelectTypingNotifications(ctx context.Context, txn *sql.Tx) ([]types.TypingNotification, error)
+	// DeleteStaleTypingNotifications deletes the rows of users who stopped typing, or whose
+	// typing expired, before the given time. The row with the highest stream position is
+	// always kept so that the position of the typing stream can be restored.
+	DeleteStaleTypingNotifications(ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp) (err error)
+}
+
+// SyncSnapshots stores a recent complete sync response for each device. When
+// the device next performs a sync without a since token, we can serve it from
+// the snapshot plus an incremental sync from the snapshot's sync token, rather
+// than having to build the complete sync from scratch for every joined room.
+//
+// Snapshots are deleted whenever the membership of the user changes, since the
+// set of rooms in the snapshot would no longer be correct.
+type SyncSnapshots interface {
+	UpsertSyncSnapshot(ctx context.Context, txn *sql.Tx, userID, deviceID, filter, syncToken string, responseJSON []byte) (err error)
+	// SelectSyncSnapshot returns the snapshot for the given device. Returns sql.ErrNoRows if there is no snapshot.
+	SelectSyncSnapshot(ctx context.Context, txn *sql.Tx, userID, deviceID string) (filter, syncToken string, responseJSON []byte, err error)
+	DeleteSyncSnapshotsForUser(ctx context.Context, txn *sql.Tx, userID string) (err error)
 }
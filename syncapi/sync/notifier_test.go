@@ -33,11 +33,11 @@ var (
 	randomMessageEvent  gomatrixserverlib.HeaderedEvent
 	aliceInviteBobEvent gomatrixserverlib.HeaderedEvent
 	bobLeaveEvent       gomatrixserverlib.HeaderedEvent
-	syncPositionVeryOld = types.NewStreamToken(5, 0)
-	syncPositionBefore  = types.NewStreamToken(11, 0)
-	syncPositionAfter   = types.NewStreamToken(12, 0)
-	syncPositionNewEDU  = types.NewStreamToken(syncPositionAfter.PDUPosition(), 1)
-	syncPositionAfter2  = types.NewStreamToken(13, 0)
+	syncPositionVeryOld = types.StreamingToken{PDUPosition: 5}
+	syncPositionBefore  = types.StreamingToken{PDUPosition: 11}
+	syncPositionAfter   = types.StreamingToken{PDUPosition: 12}
+	syncPositionNewEDU  = types.StreamingToken{PDUPosition: syncPositionAfter.PDUPosition, TypingPosition: 1}
+	syncPositionAfter2  = types.StreamingToken{PDUPosition: 13}
 )
 
 var (
@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -44,6 +45,7 @@ type syncRequest struct {
 	ctx           context.Context
 	device        authtypes.Device
 	limit         int
+	filter        string // the filter that the response is calculated with, in canonical form
 	timeout       time.Duration
 	since         *types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
@@ -73,6 +75,11 @@ func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, e
 		if err == nil && f.Room.Timeline.Limit != nil {
 			timelineLimit = *f.Room.Timeline.Limit
 		}
+		// Equivalent filters should be treated the same regardless of how
+		// they are formatted.
+		if canonical, cerr := gomatrixserverlib.CanonicalJSON([]byte(filterQuery)); cerr == nil {
+			filterQuery = string(canonical)
+		}
 	}
 	// TODO: Additional query params: set_presence, filter
 	return &syncRequest{
@@ -82,6 +89,7 @@ func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, e
 		since:         since,
 		wantFullState: wantFullState,
 		limit:         timelineLimit,
+		filter:        filterQuery,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
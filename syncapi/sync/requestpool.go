@@ -33,14 +33,15 @@ import (
 
 // RequestPool manages HTTP long-poll connections for /sync
 type RequestPool struct {
-	db        storage.Database
-	accountDB accounts.Database
-	notifier  *Notifier
+	db           storage.Database
+	accountDB    accounts.Database
+	notifier     *Notifier
+	slidingConns *slidingSyncConnections
 }
 
 // NewRequestPool makes a new RequestPool
 func NewRequestPool(db storage.Database, n *Notifier, adb accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+	return &RequestPool{db, adb, n, newSlidingSyncConnections()}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -139,20 +140,22 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.StreamingToken) (res *types.Response, err error) {
 	res = types.NewResponse()
 
-	since := types.NewStreamToken(0, 0)
+	since := types.StreamingToken{}
 	if req.since != nil {
 		since = *req.since
 	}
 
-	// See if we have any new tasks to do for the send-to-device messaging.
-	events, updates, deletions, err := rp.db.SendToDeviceUpdatesForSync(req.ctx, req.device.UserID, req.device.ID, since)
+	// The client has received the send-to-device messages up to the since
+	// position, otherwise it wouldn't be syncing from there, so they can be
+	// deleted.
+	err = rp.db.CleanSendToDeviceUpdates(req.ctx, req.device.UserID, req.device.ID, since.SendToDevicePosition)
 	if err != nil {
 		return nil, err
 	}
 
 	// TODO: handle ignored users
 	if req.since == nil {
-		res, err = rp.db.CompleteSync(req.ctx, res, req.device, req.limit)
+		res, err = rp.completeSyncForUser(req, latestPos)
 	} else {
 		res, err = rp.db.IncrementalSync(req.ctx, res, req.device, *req.since, latestPos, req.limit, req.wantFullState)
 	}
@@ -161,33 +164,25 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 	}
 
 	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
-	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition(), &accountDataFilter)
+	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.AccountDataPosition, &accountDataFilter)
 	if err != nil {
 		return
 	}
 
-	// Before we return the sync response, make sure that we take action on
-	// any send-to-device database updates or deletions that we need to do.
-	// Then add the updates into the sync response.
-	if len(updates) > 0 || len(deletions) > 0 {
-		// Handle the updates and deletions in the database.
-		err = rp.db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, since)
-		if err != nil {
-			return
-		}
+	// Include the send-to-device messages up to the position in next_batch,
+	// so that the client isn't sent them again once it syncs from it.
+	nextBatch, err := types.NewStreamTokenFromString(res.NextBatch)
+	if err != nil {
+		return
 	}
-	if len(events) > 0 {
-		// Add the updates into the sync response.
-		for _, event := range events {
-			res.ToDevice.Events = append(res.ToDevice.Events, event.SendToDeviceEvent)
-		}
-
-		// Get the next_batch from the sync response and increase the
-		// EDU counter.
-		if pos, perr := types.NewStreamTokenFromString(res.NextBatch); perr == nil {
-			pos.Positions[1]++
-			res.NextBatch = pos.String()
-		}
+	events, err := rp.db.SendToDeviceUpdatesForSync(
+		req.ctx, req.device.UserID, req.device.ID, since.SendToDevicePosition, nextBatch.SendToDevicePosition,
+	)
+	if err != nil {
+		return
+	}
+	for _, event := range events {
+		res.ToDevice.Events = append(res.ToDevice.Events, event.SendToDeviceEvent)
 	}
 
 	return
@@ -197,12 +192,7 @@ func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
 	accountDataFilter *gomatrixserverlib.EventFilter,
 ) (*types.Response, error) {
-	// TODO: Account data doesn't have a sync position of its own, meaning that
-	// account data might be sent multiple time to the client if multiple account
-	// data keys were set between two message. This isn't a huge issue since the
-	// duplicate data doesn't represent a huge quantity of data, but an optimisation
-	// here would be making sure each data is sent only once to the client.
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return nil, err
 	}
@@ -212,7 +202,7 @@ func (rp *RequestPool) appendAccountData(
 		// already been sent. Instead, we send the whole batch.
 		var global []gomatrixserverlib.ClientEvent
 		var rooms map[string][]gomatrixserverlib.ClientEvent
-		global, rooms, err = rp.accountDB.GetAccountData(req.ctx, localpart)
+		global, rooms, err = rp.accountDB.GetAccountData(req.ctx, localpart, serverName)
 		if err != nil {
 			return nil, err
 		}
@@ -229,14 +219,11 @@ func (rp *RequestPool) appendAccountData(
 	}
 
 	r := types.Range{
-		From: req.since.PDUPosition(),
+		From: req.since.AccountDataPosition,
 		To:   currentPos,
 	}
-	// If both positions are the same, it means that the data was saved after the
-	// latest room event. In that case, we need to decrement the old position as
-	// results are exclusive of Low.
 	if r.Low() == r.High() {
-		r.From--
+		return data, nil
 	}
 
 	// Sync is not initial, get all account data since the latest sync
@@ -257,7 +244,7 @@ func (rp *RequestPool) appendAccountData(
 		// Request the missing data from the database
 		for _, dataType := range dataTypes {
 			event, err := rp.accountDB.GetAccountDataByType(
-				req.ctx, localpart, roomID, dataType,
+				req.ctx, localpart, serverName, roomID, dataType,
 			)
 			if err != nil {
 				return nil, err
@@ -285,6 +272,8 @@ func (rp *RequestPool) shouldReturnImmediately(syncReq *syncRequest) bool {
 	if syncReq.since == nil || syncReq.timeout == 0 || syncReq.wantFullState {
 		return true
 	}
-	waiting, werr := rp.db.SendToDeviceUpdatesWaiting(context.TODO(), syncReq.device.UserID, syncReq.device.ID)
+	waiting, werr := rp.db.SendToDeviceUpdatesWaiting(
+		context.TODO(), syncReq.device.UserID, syncReq.device.ID, syncReq.since.SendToDevicePosition,
+	)
 	return werr == nil && waiting
 }
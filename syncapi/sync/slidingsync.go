@@ -0,0 +1,549 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// slidingSyncConnectionTimeout is how long a sliding sync connection is kept
+// around after its last request. After that the client will have to start
+// again without a pos.
+const slidingSyncConnectionTimeout = 30 * time.Minute
+
+// maxSlidingSyncConnsPerDevice is the number of sliding sync connections that
+// a single device can have. Opening any more expires the least recently used.
+const maxSlidingSyncConnsPerDevice = 10
+
+// maxSlidingSyncConnIDLength is the longest conn_id that a client can choose.
+const maxSlidingSyncConnIDLength = 64
+
+// slidingSyncState is everything that we have told the client on a given
+// connection as of a given pos. The next response on the connection is
+// calculated as a delta against it.
+type slidingSyncState struct {
+	// The sync position that this state was calculated at.
+	token types.StreamingToken
+	// The lists and subscriptions that the client asked for.
+	lists         []types.SlidingList
+	subscriptions map[string]types.SlidingRoomSubscription
+	// The room IDs sent for each range of each list, and the list counts.
+	listRooms  [][][]string
+	listCounts []int
+	// The PDU position up to which we have sent the timeline of each room.
+	rooms map[string]types.StreamPosition
+}
+
+// slidingSyncConn tracks the states of a single sliding sync connection.
+type slidingSyncConn struct {
+	// Serialises requests on the same connection.
+	lock sync.Mutex
+	// Protected by the slidingSyncConnections lock rather than the one above,
+	// so that connections can be expired while a request is waiting on them.
+	lastUsed time.Time
+	nextPos  int64
+	// A map of pos => state. We only need to keep the state for the pos in
+	// the client's last request and the one that we responded with, because
+	// a client always uses the most recent pos that it has received, or the
+	// same pos again if it didn't receive the response.
+	states map[int64]*slidingSyncState
+}
+
+// stateAt returns the state for the given pos, or nil if it is unknown or has
+// expired. As the client has received this pos, the states for all the other
+// ones are forgotten: older ones won't be used again and newer ones were never
+// received by the client.
+func (c *slidingSyncConn) stateAt(pos int64) *slidingSyncState {
+	state := c.states[pos]
+	for p := range c.states {
+		if p != pos {
+			delete(c.states, p)
+		}
+	}
+	return state
+}
+
+// slidingSyncConnections holds all of the sliding sync connections that are
+// currently active, keyed on user ID and device ID and then on connection ID.
+type slidingSyncConnections struct {
+	lock            sync.Mutex
+	devices         map[string]map[string]*slidingSyncConn
+	lastCleanUpTime time.Time
+}
+
+func newSlidingSyncConnections() *slidingSyncConnections {
+	return &slidingSyncConnections{
+		devices:         make(map[string]map[string]*slidingSyncConn),
+		lastCleanUpTime: time.Now(),
+	}
+}
+
+// get returns the connection for the given device and connection ID, creating
+// it if it doesn't exist yet. Stale connections are cleaned up now and again,
+// and a device that opens too many connections loses its least recently used.
+func (c *slidingSyncConnections) get(userID, deviceID, connID string) *slidingSyncConn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if c.lastCleanUpTime.Add(time.Minute).Before(now) {
+		c.lastCleanUpTime = now
+		for deviceKey, conns := range c.devices {
+			for id, conn := range conns {
+				if conn.lastUsed.Add(slidingSyncConnectionTimeout).Before(now) {
+					delete(conns, id)
+				}
+			}
+			if len(conns) == 0 {
+				delete(c.devices, deviceKey)
+			}
+		}
+	}
+
+	deviceKey := userID + "|" + deviceID
+	conns, ok := c.devices[deviceKey]
+	if !ok {
+		conns = make(map[string]*slidingSyncConn)
+		c.devices[deviceKey] = conns
+	}
+	conn, ok := conns[connID]
+	if !ok {
+		if len(conns) >= maxSlidingSyncConnsPerDevice {
+			var oldestID string
+			var oldest *slidingSyncConn
+			for id, candidate := range conns {
+				if oldest == nil || candidate.lastUsed.Before(oldest.lastUsed) {
+					oldestID, oldest = id, candidate
+				}
+			}
+			delete(conns, oldestID)
+		}
+		conn = &slidingSyncConn{
+			states: make(map[int64]*slidingSyncState),
+		}
+		conns[connID] = conn
+	}
+	conn.lastUsed = now
+	return conn
+}
+
+// OnIncomingSlidingSyncRequest is called when a client makes a sliding sync
+// request. Like OnIncomingSyncRequest, this function MUST be called in a
+// dedicated goroutine for this request, as it will block until a response is
+// ready or the request times out.
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	var body types.SlidingSyncRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	for _, list := range body.Lists {
+		for _, r := range list.Ranges {
+			if r[0] < 0 || r[1] < r[0] {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("ranges must be of the form [start, end] with start <= end"),
+				}
+			}
+		}
+	}
+
+	query := req.URL.Query()
+	connID := query.Get("conn_id")
+	if len(connID) > maxSlidingSyncConnIDLength {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("conn_id is too long"),
+		}
+	}
+	timeout := getTimeout(query.Get("timeout"))
+	conn := rp.slidingConns.get(device.UserID, device.ID, connID)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	// Work out which state the client is calculating a delta against. No pos
+	// means that the client is starting from scratch.
+	var prevState *slidingSyncState
+	var prevPos int64
+	if posStr := query.Get("pos"); posStr != "" {
+		var err error
+		prevPos, err = strconv.ParseInt(posStr, 10, 64)
+		if err == nil {
+			prevState = conn.stateAt(prevPos)
+		}
+		if prevState == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.UnknownPos("Unknown or expired pos, start a new connection"),
+			}
+		}
+	} else {
+		conn.states = make(map[int64]*slidingSyncState)
+	}
+
+	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
+		"user_id":   device.UserID,
+		"device_id": device.ID,
+		"pos":       prevPos,
+		"timeout":   timeout,
+	})
+
+	currPos := rp.notifier.CurrentPosition()
+	res, newState, err := rp.currentSlidingSyncForUser(req.Context(), device, &body, prevState, currPos)
+	if err != nil {
+		logger.WithError(err).Error("rp.currentSlidingSyncForUser failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// If there is nothing new to tell the client then we wait for the notifier
+	// to tell us that something *may* have happened, in the same way as /sync.
+	if prevState != nil && timeout > 0 && !hasSlidingUpdates(res, prevState) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		userStreamListener := rp.notifier.GetListener(syncRequest{
+			ctx:    req.Context(),
+			device: *device,
+		})
+		defer userStreamListener.Close()
+
+		sincePos := prevState.token
+		for !hasSlidingUpdates(res, prevState) {
+			select {
+			case <-userStreamListener.GetNotifyChannel(sincePos):
+				currPos = userStreamListener.GetSyncPosition()
+				sincePos = currPos
+			case <-timer.C:
+				timeout = 0
+			case <-req.Context().Done():
+				// The client has gone away, so there is nobody to respond to.
+				// Don't store the new state as the client will never see it.
+				logger.Debug("request cancelled")
+				return util.JSONResponse{
+					Code: http.StatusOK,
+					JSON: struct{}{},
+				}
+			}
+			if timeout == 0 {
+				break
+			}
+			res, newState, err = rp.currentSlidingSyncForUser(req.Context(), device, &body, prevState, currPos)
+			if err != nil {
+				logger.WithError(err).Error("rp.currentSlidingSyncForUser failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+	}
+
+	conn.nextPos++
+	conn.states[conn.nextPos] = newState
+	res.Pos = strconv.FormatInt(conn.nextPos, 10)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// currentSlidingSyncForUser calculates the delta between prevState, which may be
+// nil if the client is starting from scratch, and the current sync position. It
+// returns the response and the new state, which the caller should store.
+// nolint:gocyclo
+func (rp *RequestPool) currentSlidingSyncForUser(
+	ctx context.Context, device *authtypes.Device,
+	req *types.SlidingSyncRequest, prevState *slidingSyncState,
+	currPos types.StreamingToken,
+) (*types.SlidingSyncResponse, *slidingSyncState, error) {
+	res := types.NewSlidingSyncResponse()
+	state := &slidingSyncState{
+		token:         currPos,
+		lists:         req.Lists,
+		subscriptions: make(map[string]types.SlidingRoomSubscription),
+		rooms:         make(map[string]types.StreamPosition),
+	}
+	if prevState != nil {
+		if state.lists == nil {
+			state.lists = prevState.lists
+		}
+		for roomID, sub := range prevState.subscriptions {
+			state.subscriptions[roomID] = sub
+		}
+	}
+	for roomID, sub := range req.RoomSubscriptions {
+		state.subscriptions[roomID] = sub
+	}
+	for _, roomID := range req.UnsubscribeRooms {
+		delete(state.subscriptions, roomID)
+	}
+
+	latest, err := rp.db.JoinedRoomsLatestPositions(ctx, device.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Work out which rooms are visible to the client and what it wants to
+	// see of each of them.
+	visible := make(map[string]types.SlidingRoomSubscription)
+	addVisible := func(roomID string, sub types.SlidingRoomSubscription) {
+		existing, ok := visible[roomID]
+		if !ok {
+			// Copy the required state so that merging in other subscriptions
+			// below doesn't write into the client's request or stored state.
+			sub.RequiredState = append([][2]string(nil), sub.RequiredState...)
+			visible[roomID] = sub
+			return
+		}
+		if sub.TimelineLimit > existing.TimelineLimit {
+			existing.TimelineLimit = sub.TimelineLimit
+		}
+		existing.RequiredState = append(existing.RequiredState, sub.RequiredState...)
+		visible[roomID] = existing
+	}
+
+	state.listRooms = make([][][]string, len(state.lists))
+	state.listCounts = make([]int, len(state.lists))
+	for i, list := range state.lists {
+		sorted := sortRooms(latest, list.Sort)
+		listRes := types.SlidingListResponse{
+			Count: len(sorted),
+			Ops:   []types.SlidingListOp{},
+		}
+		state.listCounts[i] = len(sorted)
+		state.listRooms[i] = make([][]string, len(list.Ranges))
+
+		var prevRanges [][]string
+		if prevState != nil && i < len(prevState.listRooms) {
+			prevRanges = prevState.listRooms[i]
+		}
+		for j, r := range list.Ranges {
+			var roomIDs []string
+			if r[0] < len(sorted) {
+				// Clamp before adding one, as the end of the range may be as
+				// large as the client likes.
+				end := len(sorted)
+				if r[1] < end {
+					end = r[1] + 1
+				}
+				roomIDs = sorted[r[0]:end]
+			}
+			state.listRooms[i][j] = roomIDs
+			for _, roomID := range roomIDs {
+				addVisible(roomID, list.SlidingRoomSubscription)
+			}
+			if j < len(prevRanges) && equalRoomIDs(prevRanges[j], roomIDs) {
+				continue
+			}
+			if len(roomIDs) == 0 {
+				listRes.Ops = append(listRes.Ops, types.SlidingListOp{
+					Op:    types.SlidingOpInvalidate,
+					Range: r,
+				})
+				continue
+			}
+			listRes.Ops = append(listRes.Ops, types.SlidingListOp{
+				Op:      types.SlidingOpSync,
+				Range:   [2]int{r[0], r[0] + len(roomIDs) - 1},
+				RoomIDs: roomIDs,
+			})
+		}
+		res.Lists = append(res.Lists, listRes)
+	}
+	for roomID, sub := range state.subscriptions {
+		if _, ok := latest[roomID]; ok {
+			addVisible(roomID, sub)
+		}
+	}
+
+	// Now work out the room data. Rooms that we haven't sent before get their
+	// required state and the most recent part of their timeline, rooms that
+	// we have sent before only get the new events since then.
+	for roomID, sub := range visible {
+		var sincePos types.StreamPosition
+		var sent bool
+		if prevState != nil {
+			sincePos, sent = prevState.rooms[roomID]
+		}
+		state.rooms[roomID] = currPos.PDUPosition
+		if sent && latest[roomID] <= sincePos {
+			// Nothing new has happened in this room.
+			state.rooms[roomID] = sincePos
+			continue
+		}
+		roomRes, err := rp.slidingRoomData(ctx, device, roomID, sub, sincePos, currPos, !sent)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sent && len(roomRes.Timeline) == 0 {
+			state.rooms[roomID] = sincePos
+			continue
+		}
+		res.Rooms[roomID] = *roomRes
+	}
+
+	return res, state, nil
+}
+
+// slidingRoomData returns the room data for a single room. If initial is true
+// then the required state is included and the timeline is taken from the start
+// of the stream, otherwise only timeline events after sincePos are returned.
+func (rp *RequestPool) slidingRoomData(
+	ctx context.Context, device *authtypes.Device,
+	roomID string, sub types.SlidingRoomSubscription,
+	sincePos types.StreamPosition, currPos types.StreamingToken,
+	initial bool,
+) (*types.SlidingRoomResponse, error) {
+	roomRes := &types.SlidingRoomResponse{
+		RequiredState: []gomatrixserverlib.ClientEvent{},
+		Timeline:      []gomatrixserverlib.ClientEvent{},
+		Initial:       initial,
+	}
+	r := types.Range{
+		From: sincePos,
+		To:   currPos.PDUPosition,
+	}
+	if initial {
+		r.From = 0
+	}
+	if sub.TimelineLimit > 0 {
+		events, prevBatch, limited, err := rp.db.RecentEventsForSync(ctx, device, roomID, r, sub.TimelineLimit)
+		if err != nil {
+			return nil, err
+		}
+		roomRes.Timeline = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatSync)
+		roomRes.Limited = limited
+		if len(events) > 0 {
+			roomRes.PrevBatch = prevBatch.String()
+		}
+	}
+	if !initial {
+		return roomRes, nil
+	}
+
+	if nameEvent, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomName, ""); err != nil {
+		return nil, err
+	} else if nameEvent != nil {
+		var content struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(nameEvent.Content(), &content); err == nil {
+			roomRes.Name = content.Name
+		}
+	}
+
+	if len(sub.RequiredState) == 0 {
+		return roomRes, nil
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	for _, tuple := range sub.RequiredState {
+		if tuple[0] == "*" {
+			stateFilter.Types = nil
+			break
+		}
+		stateFilter.Types = append(stateFilter.Types, tuple[0])
+	}
+	stateEvents, err := rp.db.GetStateEventsForRoom(ctx, roomID, &stateFilter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stateEvents {
+		if requiredStateMatches(sub.RequiredState, &stateEvents[i]) {
+			roomRes.RequiredState = append(
+				roomRes.RequiredState,
+				gomatrixserverlib.HeaderedToClientEvent(stateEvents[i], gomatrixserverlib.FormatSync),
+			)
+		}
+	}
+	return roomRes, nil
+}
+
+// hasSlidingUpdates returns true if the response contains anything which the
+// client doesn't already know as of prevState, including changes to list counts.
+func hasSlidingUpdates(res *types.SlidingSyncResponse, prevState *slidingSyncState) bool {
+	if !res.IsEmpty() {
+		return true
+	}
+	for i := range res.Lists {
+		if i >= len(prevState.listCounts) || prevState.listCounts[i] != res.Lists[i].Count {
+			return true
+		}
+	}
+	return false
+}
+
+// sortRooms returns the room IDs from the map of room ID to latest position,
+// sorted by the first supported ordering. Rooms are sorted by recency if no
+// supported ordering is given.
+func sortRooms(latest map[string]types.StreamPosition, orderings []string) []string {
+	sorted := make([]string, 0, len(latest))
+	for roomID := range latest {
+		sorted = append(sorted, roomID)
+	}
+	byName := false
+	for _, ordering := range orderings {
+		if ordering == types.SlidingSortByName {
+			byName = true
+			break
+		}
+		if ordering == types.SlidingSortByRecency {
+			break
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if !byName && latest[sorted[i]] != latest[sorted[j]] {
+			return latest[sorted[i]] > latest[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// requiredStateMatches returns true if the state event matches any of the
+// [event type, state key] tuples, either of which may be a "*" wildcard.
+func requiredStateMatches(required [][2]string, ev *gomatrixserverlib.HeaderedEvent) bool {
+	for _, tuple := range required {
+		if tuple[0] != "*" && tuple[0] != ev.Type() {
+			continue
+		}
+		if tuple[1] != "*" && !ev.StateKeyEquals(tuple[1]) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func equalRoomIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// slidingTestDatabase implements just enough of storage.Database to calculate
+// sliding sync list operations. Calling anything else will panic.
+type slidingTestDatabase struct {
+	storage.Database
+	latest map[string]types.StreamPosition
+}
+
+func (d *slidingTestDatabase) JoinedRoomsLatestPositions(
+	ctx context.Context, userID string,
+) (map[string]types.StreamPosition, error) {
+	return d.latest, nil
+}
+
+func (d *slidingTestDatabase) GetStateEvent(
+	ctx context.Context, roomID, evType, stateKey string,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	return nil, nil
+}
+
+func (d *slidingTestDatabase) GetStateEventsForRoom(
+	ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	return nil, nil
+}
+
+// slidingSyncTest runs successive sliding sync requests against the same
+// connection, calculating each response as a delta against the last one.
+type slidingSyncTest struct {
+	t      *testing.T
+	rp     *RequestPool
+	db     *slidingTestDatabase
+	pos    types.StreamPosition
+	state  *slidingSyncState
+	device authtypes.Device
+}
+
+func newSlidingSyncTest(t *testing.T, latest map[string]types.StreamPosition) *slidingSyncTest {
+	db := &slidingTestDatabase{latest: latest}
+	return &slidingSyncTest{
+		t:      t,
+		rp:     &RequestPool{db: db},
+		db:     db,
+		device: authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"},
+	}
+}
+
+func (st *slidingSyncTest) sync(req *types.SlidingSyncRequest) *types.SlidingSyncResponse {
+	st.pos++
+	res, state, err := st.rp.currentSlidingSyncForUser(
+		context.Background(), &st.device, req, st.state,
+		types.StreamingToken{PDUPosition: st.pos},
+	)
+	if err != nil {
+		st.t.Fatalf("currentSlidingSyncForUser: %s", err)
+	}
+	st.state = state
+	return res
+}
+
+func mustEqualOps(t *testing.T, res *types.SlidingSyncResponse, want ...types.SlidingListOp) {
+	t.Helper()
+	if len(res.Lists) != 1 {
+		t.Fatalf("expected 1 list, got %d", len(res.Lists))
+	}
+	if len(want) == 0 {
+		want = []types.SlidingListOp{}
+	}
+	if !reflect.DeepEqual(res.Lists[0].Ops, want) {
+		t.Fatalf("got ops %+v want %+v", res.Lists[0].Ops, want)
+	}
+}
+
+func TestSortRooms(t *testing.T) {
+	latest := map[string]types.StreamPosition{
+		"!a:localhost": 2,
+		"!b:localhost": 7,
+		"!c:localhost": 7,
+		"!d:localhost": 1,
+	}
+	byRecency := []string{"!b:localhost", "!c:localhost", "!a:localhost", "!d:localhost"}
+	byName := []string{"!a:localhost", "!b:localhost", "!c:localhost", "!d:localhost"}
+	tests := []struct {
+		orderings []string
+		want      []string
+	}{
+		{nil, byRecency},
+		{[]string{types.SlidingSortByRecency}, byRecency},
+		{[]string{types.SlidingSortByName}, byName},
+		{[]string{"by_unknown", types.SlidingSortByRecency, types.SlidingSortByName}, byRecency},
+		{[]string{"by_unknown", types.SlidingSortByName}, byName},
+	}
+	for _, test := range tests {
+		got := sortRooms(latest, test.orderings)
+		if !equalRoomIDs(got, test.want) {
+			t.Errorf("sortRooms(%v): got %v want %v", test.orderings, got, test.want)
+		}
+	}
+}
+
+func TestHasSlidingUpdates(t *testing.T) {
+	prevState := &slidingSyncState{
+		listCounts: []int{5},
+	}
+
+	res := types.NewSlidingSyncResponse()
+	res.Lists = append(res.Lists, types.SlidingListResponse{Count: 5, Ops: []types.SlidingListOp{}})
+	if hasSlidingUpdates(res, prevState) {
+		t.Errorf("expected no updates when nothing changed")
+	}
+
+	res.Lists[0].Count = 6
+	if !hasSlidingUpdates(res, prevState) {
+		t.Errorf("expected updates when the list count changed")
+	}
+
+	res.Lists[0].Count = 5
+	res.Rooms["!a:localhost"] = types.SlidingRoomResponse{}
+	if !hasSlidingUpdates(res, prevState) {
+		t.Errorf("expected updates when a room changed")
+	}
+}
+
+func TestSlidingSyncRangeMoves(t *testing.T) {
+	st := newSlidingSyncTest(t, map[string]types.StreamPosition{
+		"!a:localhost": 4, "!b:localhost": 3, "!c:localhost": 2, "!d:localhost": 1,
+	})
+	list := func(r [2]int) *types.SlidingSyncRequest {
+		return &types.SlidingSyncRequest{Lists: []types.SlidingList{{Ranges: [][2]int{r}}}}
+	}
+
+	res := st.sync(list([2]int{0, 1}))
+	mustEqualOps(t, res, types.SlidingListOp{
+		Op: types.SlidingOpSync, Range: [2]int{0, 1}, RoomIDs: []string{"!a:localhost", "!b:localhost"},
+	})
+	if res.Lists[0].Count != 4 {
+		t.Errorf("expected a count of 4, got %d", res.Lists[0].Count)
+	}
+	if len(res.Rooms) != 2 {
+		t.Errorf("expected 2 rooms, got %d", len(res.Rooms))
+	}
+
+	// Repeating the same range tells the client nothing new.
+	res = st.sync(list([2]int{0, 1}))
+	mustEqualOps(t, res)
+	if len(res.Rooms) != 0 {
+		t.Errorf("expected no rooms, got %d", len(res.Rooms))
+	}
+
+	// Moving the range sends the rooms that are now inside it.
+	res = st.sync(list([2]int{2, 3}))
+	mustEqualOps(t, res, types.SlidingListOp{
+		Op: types.SlidingOpSync, Range: [2]int{2, 3}, RoomIDs: []string{"!c:localhost", "!d:localhost"},
+	})
+	if _, ok := res.Rooms["!c:localhost"]; !ok {
+		t.Errorf("expected room data for a room that moved into the range")
+	}
+
+	// A range past the end of the list is invalidated, and a huge range is
+	// clamped to the end of the list.
+	res = st.sync(list([2]int{10, 12}))
+	mustEqualOps(t, res, types.SlidingListOp{Op: types.SlidingOpInvalidate, Range: [2]int{10, 12}})
+	res = st.sync(list([2]int{2, math.MaxInt64}))
+	mustEqualOps(t, res, types.SlidingListOp{
+		Op: types.SlidingOpSync, Range: [2]int{2, 3}, RoomIDs: []string{"!c:localhost", "!d:localhost"},
+	})
+}
+
+func TestSlidingSyncInsertsAndDeletes(t *testing.T) {
+	st := newSlidingSyncTest(t, map[string]types.StreamPosition{
+		"!a:localhost": 2, "!b:localhost": 1,
+	})
+	req := &types.SlidingSyncRequest{Lists: []types.SlidingList{{Ranges: [][2]int{{0, 9}}}}}
+
+	res := st.sync(req)
+	mustEqualOps(t, res, types.SlidingListOp{
+		Op: types.SlidingOpSync, Range: [2]int{0, 1}, RoomIDs: []string{"!a:localhost", "!b:localhost"},
+	})
+
+	// Joining a room inserts it at the top of the list.
+	st.db.latest["!c:localhost"] = 3
+	res = st.sync(&types.SlidingSyncRequest{})
+	mustEqualOps(t, res, types.SlidingListOp{
+		Op: types.SlidingOpSync, Range: [2]int{0, 2}, RoomIDs: []string{"!c:localhost", "!a:localhost", "!b:localhost"},
+	})
+	if res.Lists[0].Count != 3 {
+		t.Errorf("expected a count of 3, got %d", res.Lists[0].Count)
+	}
+	if room, ok := res.Rooms["!c:localhost"]; !ok || !room.Initial {
+		t.Errorf("expected initial room data for the inserted room")
+	}
+
+	// Leaving rooms deletes them from the list.
+	delete(st.db.latest, "!a:localhost")
+	res = st.sync(&types.SlidingSyncRequest{})
+	mustEqualOps(t, res, types.SlidingListOp{
+		Op: types.SlidingOpSync, Range: [2]int{0, 1}, RoomIDs: []string{"!c:localhost", "!b:localhost"},
+	})
+	delete(st.db.latest, "!b:localhost")
+	delete(st.db.latest, "!c:localhost")
+	res = st.sync(&types.SlidingSyncRequest{})
+	mustEqualOps(t, res, types.SlidingListOp{Op: types.SlidingOpInvalidate, Range: [2]int{0, 9}})
+	if res.Lists[0].Count != 0 {
+		t.Errorf("expected a count of 0, got %d", res.Lists[0].Count)
+	}
+}
+
+func TestSlidingSyncDoesNotModifyRequiredState(t *testing.T) {
+	st := newSlidingSyncTest(t, map[string]types.StreamPosition{"!a:localhost": 1})
+	// Leave spare capacity in the list's required state, so that appending
+	// the room subscription's required state to it would overwrite this.
+	listRequiredState := [][2]string{{"m.room.topic", ""}, {"untouched", ""}}
+	req := &types.SlidingSyncRequest{
+		Lists: []types.SlidingList{{
+			SlidingRoomSubscription: types.SlidingRoomSubscription{
+				RequiredState: listRequiredState[:1],
+			},
+			Ranges: [][2]int{{0, 0}},
+		}},
+		RoomSubscriptions: map[string]types.SlidingRoomSubscription{
+			"!a:localhost": {RequiredState: [][2]string{{"m.room.name", ""}}},
+		},
+	}
+	st.sync(req)
+	if listRequiredState[1][0] != "untouched" {
+		t.Errorf("required state of the list was modified: %v", listRequiredState)
+	}
+}
+
+func TestSlidingSyncConnectionsPerDevice(t *testing.T) {
+	conns := newSlidingSyncConnections()
+	first := conns.get("@alice:localhost", "ALICE", "conn0")
+	first.lastUsed = first.lastUsed.Add(-time.Minute)
+	for i := 1; i <= maxSlidingSyncConnsPerDevice; i++ {
+		conns.get("@alice:localhost", "ALICE", fmt.Sprintf("conn%d", i))
+	}
+	if n := len(conns.devices["@alice:localhost|ALICE"]); n != maxSlidingSyncConnsPerDevice {
+		t.Fatalf("expected %d connections, got %d", maxSlidingSyncConnsPerDevice, n)
+	}
+	if conns.get("@alice:localhost", "ALICE", "conn0") == first {
+		t.Errorf("expected the least recently used connection to be expired")
+	}
+	// Other devices have their own connections.
+	conns.get("@alice:localhost", "OTHER", "conn0")
+	if n := len(conns.devices["@alice:localhost|ALICE"]); n != maxSlidingSyncConnsPerDevice {
+		t.Errorf("expected %d connections, got %d", maxSlidingSyncConnsPerDevice, n)
+	}
+}
+
+func TestSlidingSyncConnForgetsOtherStates(t *testing.T) {
+	conn := &slidingSyncConn{states: make(map[int64]*slidingSyncState)}
+	for pos := int64(1); pos <= 4; pos++ {
+		conn.states[pos] = &slidingSyncState{}
+	}
+	// The client retries with pos 2, so it never received the responses for
+	// pos 3 and 4 and won't go back to pos 1.
+	want := conn.states[2]
+	if got := conn.stateAt(2); got != want {
+		t.Fatalf("expected the state for pos 2, got %+v", got)
+	}
+	if len(conn.states) != 1 || conn.states[2] != want {
+		t.Errorf("expected only the state for pos 2 to be kept, got %+v", conn.states)
+	}
+	if got := conn.stateAt(5); got != nil {
+		t.Errorf("expected no state for an unknown pos, got %+v", got)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// completeSyncForUser returns a complete sync response for the device in the
+// request. If the device has a snapshot of a previous complete sync then the
+// response is built from the snapshot plus an incremental sync from the position
+// of the snapshot, which is much cheaper than building it from scratch for
+// users who are in lots of rooms. Either way, the result is stored as the new
+// snapshot for the device.
+func (rp *RequestPool) completeSyncForUser(
+	req syncRequest, latestPos types.StreamingToken,
+) (*types.Response, error) {
+	var res *types.Response
+	snapshot, snapshotPos, err := rp.db.SyncSnapshot(req.ctx, req.device, req.filter)
+	if err != nil {
+		req.log.WithError(err).Warn("Failed to retrieve sync snapshot, falling back to complete sync")
+	} else if fromPos, ok := snapshotFromPosition(snapshot, snapshotPos, latestPos); ok {
+		delta, derr := rp.db.IncrementalSync(req.ctx, types.NewResponse(), req.device, fromPos, latestPos, req.limit, false)
+		if derr != nil {
+			return nil, derr
+		}
+		merged, merr := rp.mergeSnapshotWithDelta(req, snapshot, delta)
+		if merr != nil {
+			return nil, merr
+		} else if merged {
+			res = snapshot
+		}
+	}
+
+	if res == nil {
+		res, err = rp.db.CompleteSync(req.ctx, types.NewResponse(), req.device, req.limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = rp.db.StoreSyncSnapshot(req.ctx, req.device, req.filter, snapshotOf(res)); err != nil {
+		req.log.WithError(err).Warn("Failed to store sync snapshot")
+	}
+	return res, nil
+}
+
+// snapshotFromPosition returns the position to perform an incremental sync
+// from in order to bring the snapshot up to date. Returns false if there is no
+// snapshot or if it is ahead of the latest position in any stream, e.g. because
+// the database was restored from a backup, in which case it can't be used.
+func snapshotFromPosition(
+	snapshot *types.Response, snapshotPos *types.StreamingToken, latestPos types.StreamingToken,
+) (types.StreamingToken, bool) {
+	if snapshot == nil {
+		return types.StreamingToken{}, false
+	}
+	// Ephemeral events aren't stored in the snapshot, so start the typing
+	// stream from zero so that they are all included.
+	fromPos := *snapshotPos
+	fromPos.TypingPosition = 0
+	if fromPos.IsAfter(latestPos) {
+		return types.StreamingToken{}, false
+	}
+	return fromPos, true
+}
+
+// snapshotOf returns a copy of the response which is suitable for storing as
+// a snapshot. Ephemeral events are left out because they aren't tied to the
+// PDU stream position of the snapshot.
+func snapshotOf(res *types.Response) *types.Response {
+	snapshot := types.NewResponse()
+	snapshot.NextBatch = res.NextBatch
+	for roomID, jr := range res.Rooms.Join {
+		jr.Ephemeral.Events = []gomatrixserverlib.ClientEvent{}
+		snapshot.Rooms.Join[roomID] = jr
+	}
+	for roomID, ir := range res.Rooms.Invite {
+		snapshot.Rooms.Invite[roomID] = ir
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		snapshot.Rooms.Leave[roomID] = lr
+	}
+	return snapshot
+}
+
+// mergeSnapshotWithDelta updates the snapshot in place with the incremental
+// sync response in delta, so that the snapshot becomes a complete sync response
+// as of the next batch of the delta. Returns false if the delta can't be applied
+// to the snapshot, e.g. because the user's memberships have changed, in which
+// case the snapshot should be discarded.
+func (rp *RequestPool) mergeSnapshotWithDelta(
+	req syncRequest, snapshot, delta *types.Response,
+) (bool, error) {
+	if len(delta.Rooms.Invite) > 0 || len(delta.Rooms.Leave) > 0 {
+		return false, nil
+	}
+	unchanged, err := pduPositionUnchanged(snapshot, delta)
+	if err != nil {
+		return false, err
+	} else if unchanged {
+		return mergeEphemeralWithDelta(snapshot, delta), nil
+	}
+	// The incremental sync includes every room that the user is currently
+	// joined to, so the rooms should match exactly.
+	if len(delta.Rooms.Join) != len(snapshot.Rooms.Join) {
+		return false, nil
+	}
+	for roomID, djr := range delta.Rooms.Join {
+		sjr, ok := snapshot.Rooms.Join[roomID]
+		if !ok {
+			return false, nil
+		}
+		if djr.Timeline.Limited {
+			// There is a gap between the snapshot's timeline and the new
+			// timeline, so start again from the new timeline. The state at the
+			// start of it is the snapshot's state with the state changes in
+			// the gap applied on top.
+			state := mergeStateEvents(sjr.State.Events, sjr.Timeline.Events)
+			state = mergeStateEvents(state, djr.State.Events)
+			sjr.State.Events = removeStateEventsInTimeline(state, djr.Timeline.Events)
+			sjr.Timeline = djr.Timeline
+			sjr.Timeline.Limited = true
+		} else if len(djr.Timeline.Events) > 0 {
+			timeline := append(sjr.Timeline.Events, djr.Timeline.Events...)
+			sjr.State.Events = mergeStateEvents(sjr.State.Events, djr.State.Events)
+			if len(timeline) > req.limit {
+				// Drop the oldest events from the timeline so that it doesn't
+				// grow every time the snapshot is used. The dropped state events
+				// become part of the state at the start of the timeline.
+				dropped := timeline[:len(timeline)-req.limit]
+				timeline = timeline[len(timeline)-req.limit:]
+				sjr.State.Events = mergeStateEvents(sjr.State.Events, dropped)
+				sjr.State.Events = removeStateEventsInTimeline(sjr.State.Events, timeline)
+				prevBatch, perr := rp.db.EventPositionInTopology(req.ctx, timeline[0].EventID)
+				if perr != nil {
+					return false, perr
+				}
+				prevBatch.Decrement()
+				sjr.Timeline.PrevBatch = prevBatch.String()
+				sjr.Timeline.Limited = true
+			}
+			sjr.Timeline.Events = timeline
+		}
+		sjr.Ephemeral = djr.Ephemeral
+		snapshot.Rooms.Join[roomID] = sjr
+	}
+	snapshot.NextBatch = delta.NextBatch
+	return true, nil
+}
+
+// pduPositionUnchanged returns true if there are no new PDUs since the
+// snapshot. In that case the incremental sync only includes the rooms which
+// have new ephemeral events, rather than every room the user is joined to.
+func pduPositionUnchanged(snapshot, delta *types.Response) (bool, error) {
+	snapshotPos, err := types.NewStreamTokenFromString(snapshot.NextBatch)
+	if err != nil {
+		return false, err
+	}
+	deltaPos, err := types.NewStreamTokenFromString(delta.NextBatch)
+	if err != nil {
+		return false, err
+	}
+	return snapshotPos.PDUPosition == deltaPos.PDUPosition, nil
+}
+
+// mergeEphemeralWithDelta updates the snapshot in place with the ephemeral
+// events in delta, for when the rooms themselves haven't changed. Returns false
+// if the delta includes a room that isn't in the snapshot.
+func mergeEphemeralWithDelta(snapshot, delta *types.Response) bool {
+	for roomID, djr := range delta.Rooms.Join {
+		sjr, ok := snapshot.Rooms.Join[roomID]
+		if !ok {
+			return false
+		}
+		sjr.Ephemeral = djr.Ephemeral
+		snapshot.Rooms.Join[roomID] = sjr
+	}
+	snapshot.NextBatch = delta.NextBatch
+	return true
+}
+
+// mergeStateEvents returns the state events in base, with any state events in
+// updates replacing those with the same type and state key.
+func mergeStateEvents(base, updates []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+	type stateKeyTuple struct {
+		eventType string
+		stateKey  string
+	}
+	indices := make(map[stateKeyTuple]int, len(base))
+	merged := make([]gomatrixserverlib.ClientEvent, 0, len(base))
+	for _, events := range [][]gomatrixserverlib.ClientEvent{base, updates} {
+		for _, ev := range events {
+			if ev.StateKey == nil {
+				continue
+			}
+			tuple := stateKeyTuple{ev.Type, *ev.StateKey}
+			if i, ok := indices[tuple]; ok {
+				merged[i] = ev
+				continue
+			}
+			indices[tuple] = len(merged)
+			merged = append(merged, ev)
+		}
+	}
+	return merged
+}
+
+// removeStateEventsInTimeline returns the state events which don't appear in
+// the timeline, as clients should only see them in the timeline.
+func removeStateEventsInTimeline(state, timeline []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+	inTimeline := make(map[string]bool, len(timeline))
+	for _, ev := range timeline {
+		inTimeline[ev.EventID] = true
+	}
+	result := make([]gomatrixserverlib.ClientEvent, 0, len(state))
+	for _, ev := range state {
+		if !inTimeline[ev.EventID] {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
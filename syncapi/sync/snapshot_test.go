@@ -0,0 +1,406 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const snapshotTestRoomID = "!room:localhost"
+
+// snapshotTestDatabase implements just enough of storage.Database to serve
+// complete syncs from a snapshot. Calling anything else will panic.
+type snapshotTestDatabase struct {
+	storage.Database
+	snapshot       *types.Response
+	snapshotPos    types.StreamingToken
+	snapshotFilter string
+	delta          *types.Response
+	deltaFrom      *types.StreamingToken
+	complete       *types.Response
+	completeSyncs  int
+	positions      map[string]types.TopologyToken
+}
+
+func (d *snapshotTestDatabase) SyncSnapshot(
+	ctx context.Context, device authtypes.Device, filter string,
+) (*types.Response, *types.StreamingToken, error) {
+	if d.snapshot == nil || d.snapshotFilter != filter {
+		return nil, nil, nil
+	}
+	pos := d.snapshotPos
+	return d.snapshot, &pos, nil
+}
+
+func (d *snapshotTestDatabase) StoreSyncSnapshot(
+	ctx context.Context, device authtypes.Device, filter string, res *types.Response,
+) error {
+	pos, err := types.NewStreamTokenFromString(res.NextBatch)
+	if err != nil {
+		return err
+	}
+	d.snapshot, d.snapshotPos, d.snapshotFilter = res, pos, filter
+	return nil
+}
+
+func (d *snapshotTestDatabase) IncrementalSync(
+	ctx context.Context, res *types.Response, device authtypes.Device,
+	fromPos, toPos types.StreamingToken, numRecentEventsPerRoom int, wantFullState bool,
+) (*types.Response, error) {
+	d.deltaFrom = &fromPos
+	return d.delta, nil
+}
+
+func (d *snapshotTestDatabase) CompleteSync(
+	ctx context.Context, res *types.Response, device authtypes.Device, numRecentEventsPerRoom int,
+) (*types.Response, error) {
+	d.completeSyncs++
+	return d.complete, nil
+}
+
+func (d *snapshotTestDatabase) EventPositionInTopology(
+	ctx context.Context, eventID string,
+) (types.TopologyToken, error) {
+	return d.positions[eventID], nil
+}
+
+func snapshotTestEvent(eventID, eventType string, stateKey *string) gomatrixserverlib.ClientEvent {
+	return gomatrixserverlib.ClientEvent{
+		EventID:  eventID,
+		Type:     eventType,
+		StateKey: stateKey,
+		RoomID:   snapshotTestRoomID,
+	}
+}
+
+func snapshotTestMessage(eventID string) gomatrixserverlib.ClientEvent {
+	return snapshotTestEvent(eventID, "m.room.message", nil)
+}
+
+func snapshotTestState(eventID, eventType string) gomatrixserverlib.ClientEvent {
+	stateKey := ""
+	return snapshotTestEvent(eventID, eventType, &stateKey)
+}
+
+// snapshotTestResponse returns a response for a single joined room with the
+// given state and timeline.
+func snapshotTestResponse(pos types.StreamingToken, state, timeline []gomatrixserverlib.ClientEvent, limited bool) *types.Response {
+	res := types.NewResponse()
+	res.NextBatch = pos.String()
+	jr := types.NewJoinResponse()
+	jr.State.Events = state
+	jr.Timeline.Events = timeline
+	jr.Timeline.Limited = limited
+	res.Rooms.Join[snapshotTestRoomID] = *jr
+	return res
+}
+
+func eventIDs(events []gomatrixserverlib.ClientEvent) []string {
+	ids := make([]string, 0, len(events))
+	for _, ev := range events {
+		ids = append(ids, ev.EventID)
+	}
+	return ids
+}
+
+func newSnapshotTestRequest(t *testing.T, filter string) syncRequest {
+	t.Helper()
+	httpReq := httptest.NewRequest("GET", "/sync?filter="+url.QueryEscape(filter), nil)
+	req, err := newSyncRequest(httpReq, authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"})
+	if err != nil {
+		t.Fatalf("newSyncRequest failed: %s", err)
+	}
+	req.ctx = context.Background()
+	req.log = util.GetLogger(req.ctx)
+	return *req
+}
+
+func TestCompleteSyncForUser(t *testing.T) {
+	snapshotPos := types.StreamingToken{PDUPosition: 5, TypingPosition: 3}
+	latestPos := types.StreamingToken{PDUPosition: 7, TypingPosition: 4}
+	complete := snapshotTestResponse(latestPos, nil, []gomatrixserverlib.ClientEvent{snapshotTestMessage("$complete")}, false)
+	filter := `{"room":{"timeline":{"limit":10}}}`
+
+	for _, tc := range []struct {
+		name         string
+		snapshotPos  types.StreamingToken
+		filter       string
+		delta        *types.Response
+		wantSnapshot bool
+	}{
+		{
+			name:         "snapshot is used",
+			snapshotPos:  snapshotPos,
+			filter:       filter,
+			delta:        snapshotTestResponse(latestPos, nil, []gomatrixserverlib.ClientEvent{snapshotTestMessage("$new")}, false),
+			wantSnapshot: true,
+		},
+		{
+			name:         "equivalent filter",
+			snapshotPos:  snapshotPos,
+			filter:       `{ "room": { "timeline": { "limit": 10 } } }`,
+			delta:        snapshotTestResponse(latestPos, nil, []gomatrixserverlib.ClientEvent{snapshotTestMessage("$new")}, false),
+			wantSnapshot: true,
+		},
+		{
+			name:        "different filter with the same timeline limit",
+			snapshotPos: snapshotPos,
+			filter:      `{"room":{"timeline":{"limit":10,"types":["m.room.message"]}}}`,
+		},
+		{
+			name:        "snapshot ahead of the latest position",
+			snapshotPos: types.StreamingToken{PDUPosition: 8},
+			filter:      filter,
+		},
+		{
+			name:        "snapshot ahead of the latest position in another stream",
+			snapshotPos: types.StreamingToken{PDUPosition: 5, SendToDevicePosition: 2},
+			filter:      filter,
+		},
+		{
+			name:        "room left after the snapshot",
+			snapshotPos: snapshotPos,
+			filter:      filter,
+			delta: func() *types.Response {
+				res := types.NewResponse()
+				res.NextBatch = latestPos.String()
+				res.Rooms.Leave[snapshotTestRoomID] = *types.NewLeaveResponse()
+				return res
+			}(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := &snapshotTestDatabase{
+				snapshot:       snapshotTestResponse(tc.snapshotPos, nil, []gomatrixserverlib.ClientEvent{snapshotTestMessage("$old")}, false),
+				snapshotPos:    tc.snapshotPos,
+				snapshotFilter: newSnapshotTestRequest(t, filter).filter,
+				delta:          tc.delta,
+				complete:       complete,
+			}
+			rp := &RequestPool{db: db}
+			res, err := rp.completeSyncForUser(newSnapshotTestRequest(t, tc.filter), latestPos)
+			if err != nil {
+				t.Fatalf("completeSyncForUser failed: %s", err)
+			}
+
+			if tc.wantSnapshot {
+				if db.completeSyncs != 0 {
+					t.Fatalf("wanted the response to be built from the snapshot, got a complete sync")
+				}
+				// Ephemeral events aren't in the snapshot, so all of them are
+				// needed from the incremental sync.
+				if wantFrom := (types.StreamingToken{PDUPosition: 5}); *db.deltaFrom != wantFrom {
+					t.Errorf("wanted an incremental sync from %v, got %v", wantFrom, *db.deltaFrom)
+				}
+				timeline := eventIDs(res.Rooms.Join[snapshotTestRoomID].Timeline.Events)
+				if want := []string{"$old", "$new"}; !reflect.DeepEqual(timeline, want) {
+					t.Errorf("wanted timeline %v, got %v", want, timeline)
+				}
+			} else if db.completeSyncs != 1 {
+				t.Fatalf("wanted a complete sync, got %d", db.completeSyncs)
+			} else if res != complete {
+				t.Fatalf("wanted the complete sync response, got %+v", res)
+			}
+
+			// Either way the response becomes the new snapshot.
+			if db.snapshotPos != latestPos {
+				t.Errorf("wanted the snapshot to be stored at %v, got %v", latestPos, db.snapshotPos)
+			}
+			if db.snapshotFilter != newSnapshotTestRequest(t, tc.filter).filter {
+				t.Errorf("wanted the snapshot to be stored with the request's filter, got %q", db.snapshotFilter)
+			}
+		})
+	}
+}
+
+func TestMergeSnapshotWithDeltaLimited(t *testing.T) {
+	rp := &RequestPool{db: &snapshotTestDatabase{}}
+	req := newSnapshotTestRequest(t, `{"room":{"timeline":{"limit":10}}}`)
+	snapshot := snapshotTestResponse(
+		types.StreamingToken{PDUPosition: 5},
+		[]gomatrixserverlib.ClientEvent{snapshotTestState("$create", "m.room.create"), snapshotTestState("$name1", "m.room.name")},
+		[]gomatrixserverlib.ClientEvent{snapshotTestMessage("$m1"), snapshotTestState("$name2", "m.room.name")},
+		false,
+	)
+	// There is a gap after the snapshot, in which the topic is set. It is
+	// changed again in the new timeline, so the state at the start of the new
+	// timeline has the old topic.
+	delta := snapshotTestResponse(
+		types.StreamingToken{PDUPosition: 50},
+		[]gomatrixserverlib.ClientEvent{snapshotTestState("$topic1", "m.room.topic")},
+		[]gomatrixserverlib.ClientEvent{snapshotTestMessage("$m2"), snapshotTestState("$topic2", "m.room.topic")},
+		true,
+	)
+	merged, err := rp.mergeSnapshotWithDelta(req, snapshot, delta)
+	if err != nil {
+		t.Fatalf("mergeSnapshotWithDelta failed: %s", err)
+	}
+	if !merged {
+		t.Fatalf("wanted the delta to be merged into the snapshot")
+	}
+
+	jr := snapshot.Rooms.Join[snapshotTestRoomID]
+	if !jr.Timeline.Limited {
+		t.Errorf("wanted the timeline to be limited")
+	}
+	if timeline, want := eventIDs(jr.Timeline.Events), []string{"$m2", "$topic2"}; !reflect.DeepEqual(timeline, want) {
+		t.Errorf("wanted timeline %v, got %v", want, timeline)
+	}
+	if state, want := eventIDs(jr.State.Events), []string{"$create", "$name2", "$topic1"}; !reflect.DeepEqual(state, want) {
+		t.Errorf("wanted state %v, got %v", want, state)
+	}
+	if snapshot.NextBatch != delta.NextBatch {
+		t.Errorf("wanted next batch %q, got %q", delta.NextBatch, snapshot.NextBatch)
+	}
+}
+
+func TestMergeSnapshotWithDeltaTrimsTimeline(t *testing.T) {
+	rp := &RequestPool{db: &snapshotTestDatabase{
+		positions: map[string]types.TopologyToken{
+			"$m2": types.NewTopologyToken(4, 4),
+		},
+	}}
+	req := newSnapshotTestRequest(t, `{"room":{"timeline":{"limit":3}}}`)
+	snapshot := snapshotTestResponse(
+		types.StreamingToken{PDUPosition: 5},
+		[]gomatrixserverlib.ClientEvent{snapshotTestState("$create", "m.room.create")},
+		[]gomatrixserverlib.ClientEvent{snapshotTestState("$name1", "m.room.name"), snapshotTestMessage("$m2")},
+		false,
+	)
+	delta := snapshotTestResponse(
+		types.StreamingToken{PDUPosition: 7},
+		nil,
+		[]gomatrixserverlib.ClientEvent{snapshotTestMessage("$m3"), snapshotTestMessage("$m4")},
+		false,
+	)
+	merged, err := rp.mergeSnapshotWithDelta(req, snapshot, delta)
+	if err != nil {
+		t.Fatalf("mergeSnapshotWithDelta failed: %s", err)
+	}
+	if !merged {
+		t.Fatalf("wanted the delta to be merged into the snapshot")
+	}
+
+	// The oldest event falls out of the timeline and into the state.
+	jr := snapshot.Rooms.Join[snapshotTestRoomID]
+	if timeline, want := eventIDs(jr.Timeline.Events), []string{"$m2", "$m3", "$m4"}; !reflect.DeepEqual(timeline, want) {
+		t.Errorf("wanted timeline %v, got %v", want, timeline)
+	}
+	if state, want := eventIDs(jr.State.Events), []string{"$create", "$name1"}; !reflect.DeepEqual(state, want) {
+		t.Errorf("wanted state %v, got %v", want, state)
+	}
+	if !jr.Timeline.Limited {
+		t.Errorf("wanted the timeline to be limited")
+	}
+	prevBatch := types.NewTopologyToken(4, 4)
+	prevBatch.Decrement()
+	if jr.Timeline.PrevBatch != prevBatch.String() {
+		t.Errorf("wanted prev batch %q, got %q", prevBatch.String(), jr.Timeline.PrevBatch)
+	}
+}
+
+func TestMergeSnapshotWithDeltaRoomsChanged(t *testing.T) {
+	rp := &RequestPool{db: &snapshotTestDatabase{}}
+	req := newSnapshotTestRequest(t, "")
+	newSnapshot := func() *types.Response {
+		return snapshotTestResponse(types.StreamingToken{PDUPosition: 5}, nil, []gomatrixserverlib.ClientEvent{snapshotTestMessage("$m1")}, false)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		delta func(res *types.Response)
+	}{
+		{"left", func(res *types.Response) {
+			delete(res.Rooms.Join, snapshotTestRoomID)
+			res.Rooms.Leave[snapshotTestRoomID] = *types.NewLeaveResponse()
+		}},
+		{"invited", func(res *types.Response) {
+			res.Rooms.Invite["!other:localhost"] = types.InviteResponse{}
+		}},
+		{"joined", func(res *types.Response) {
+			res.Rooms.Join["!other:localhost"] = *types.NewJoinResponse()
+		}},
+		{"replaced", func(res *types.Response) {
+			delete(res.Rooms.Join, snapshotTestRoomID)
+			res.Rooms.Join["!other:localhost"] = *types.NewJoinResponse()
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			delta := snapshotTestResponse(types.StreamingToken{PDUPosition: 7}, nil, nil, false)
+			tc.delta(delta)
+			merged, err := rp.mergeSnapshotWithDelta(req, newSnapshot(), delta)
+			if err != nil {
+				t.Fatalf("mergeSnapshotWithDelta failed: %s", err)
+			}
+			if merged {
+				t.Fatalf("wanted the snapshot to be discarded")
+			}
+		})
+	}
+}
+
+func TestMergeSnapshotWithDeltaPDUPositionUnchanged(t *testing.T) {
+	rp := &RequestPool{db: &snapshotTestDatabase{}}
+	req := newSnapshotTestRequest(t, "")
+	snapshot := snapshotTestResponse(
+		types.StreamingToken{PDUPosition: 5},
+		[]gomatrixserverlib.ClientEvent{snapshotTestState("$create", "m.room.create")},
+		[]gomatrixserverlib.ClientEvent{snapshotTestMessage("$m1")},
+		false,
+	)
+	snapshot.Rooms.Join["!other:localhost"] = *types.NewJoinResponse()
+
+	// Only the typing position has moved on, so the incremental sync only
+	// includes the room that has someone typing in it.
+	delta := types.NewResponse()
+	delta.NextBatch = types.StreamingToken{PDUPosition: 5, TypingPosition: 3}.String()
+	djr := types.NewJoinResponse()
+	djr.Ephemeral.Events = []gomatrixserverlib.ClientEvent{{Type: "m.typing", RoomID: snapshotTestRoomID}}
+	delta.Rooms.Join[snapshotTestRoomID] = *djr
+
+	merged, err := rp.mergeSnapshotWithDelta(req, snapshot, delta)
+	if err != nil {
+		t.Fatalf("mergeSnapshotWithDelta failed: %s", err)
+	}
+	if !merged {
+		t.Fatalf("wanted the delta to be merged into the snapshot")
+	}
+	if len(snapshot.Rooms.Join) != 2 {
+		t.Fatalf("wanted 2 joined rooms, got %d", len(snapshot.Rooms.Join))
+	}
+	jr := snapshot.Rooms.Join[snapshotTestRoomID]
+	if timeline, want := eventIDs(jr.Timeline.Events), []string{"$m1"}; !reflect.DeepEqual(timeline, want) {
+		t.Errorf("wanted timeline %v, got %v", want, timeline)
+	}
+	if state, want := eventIDs(jr.State.Events), []string{"$create"}; !reflect.DeepEqual(state, want) {
+		t.Errorf("wanted state %v, got %v", want, state)
+	}
+	if len(jr.Ephemeral.Events) != 1 || jr.Ephemeral.Events[0].Type != "m.typing" {
+		t.Errorf("wanted the typing event in the ephemeral events, got %v", jr.Ephemeral.Events)
+	}
+	if snapshot.NextBatch != delta.NextBatch {
+		t.Errorf("wanted next batch %q, got %q", delta.NextBatch, snapshot.NextBatch)
+	}
+}
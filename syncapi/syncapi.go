@@ -16,6 +16,7 @@ package syncapi
 
 import (
 	"context"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -32,6 +33,10 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/sync"
 )
 
+// typingPruneInterval is how often the persisted typing notifications of users
+// who are no longer typing are deleted.
+const typingPruneInterval = time.Hour
+
 // SetupSyncAPIComponent sets up and registers HTTP handlers for the SyncAPI
 // component.
 func SetupSyncAPIComponent(
@@ -88,5 +93,17 @@ func SetupSyncAPIComponent(
 		logrus.WithError(err).Panicf("failed to start send-to-device consumer")
 	}
 
+	go pruneTypingNotifications(syncDB)
+
 	routing.Setup(base.PublicAPIMux, requestPool, syncDB, deviceDB, federation, rsAPI, cfg)
 }
+
+func pruneTypingNotifications(syncDB storage.Database) {
+	ticker := time.NewTicker(typingPruneInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := syncDB.PruneTypingNotifications(context.Background()); err != nil {
+			logrus.WithError(err).Warn("Failed to prune typing notifications")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// SlidingSortByRecency sorts rooms so that the room with the most recent
+	// event comes first.
+	SlidingSortByRecency = "by_recency"
+	// SlidingSortByName sorts rooms alphabetically by their room ID. Dendrite
+	// doesn't calculate room names server-side yet.
+	SlidingSortByName = "by_name"
+
+	// SlidingOpSync replaces the room IDs in the given range of a list.
+	SlidingOpSync = "SYNC"
+	// SlidingOpInvalidate tells the client to forget about the room IDs in
+	// the given range of a list.
+	SlidingOpInvalidate = "INVALIDATE"
+)
+
+// SlidingRoomSubscription describes how much of a room the client wants to
+// see, either because the room falls within the range of a list or because
+// the client has subscribed to it explicitly.
+type SlidingRoomSubscription struct {
+	// RequiredState is a list of [event type, state key] tuples. Either value
+	// may be "*" to match anything.
+	RequiredState [][2]string `json:"required_state"`
+	// TimelineLimit is the maximum number of timeline events to return for
+	// the room.
+	TimelineLimit int `json:"timeline_limit"`
+}
+
+// SlidingList is a sorted list of the rooms that the user is joined to, of
+// which the client only wants to see the rooms inside the given ranges.
+type SlidingList struct {
+	SlidingRoomSubscription
+	// Ranges are inclusive [start, end] index pairs into the sorted list.
+	Ranges [][2]int `json:"ranges"`
+	// Sort is the ordering to apply to the list. Only the first supported
+	// ordering is used.
+	Sort []string `json:"sort"`
+}
+
+// SlidingSyncRequest is the body of a sliding sync request.
+type SlidingSyncRequest struct {
+	// Lists replaces the lists from the previous request. If omitted then
+	// the lists from the previous request on the same connection are reused.
+	Lists []SlidingList `json:"lists"`
+	// RoomSubscriptions adds explicit subscriptions to rooms, regardless of
+	// whether they appear in a list. Subscriptions persist for the lifetime
+	// of the connection until they are removed with UnsubscribeRooms.
+	RoomSubscriptions map[string]SlidingRoomSubscription `json:"room_subscriptions"`
+	// UnsubscribeRooms removes explicit subscriptions to rooms.
+	UnsubscribeRooms []string `json:"unsubscribe_rooms"`
+}
+
+// SlidingListOp is a single operation which the client must apply to its
+// local copy of a list.
+type SlidingListOp struct {
+	Op      string   `json:"op"`
+	Range   [2]int   `json:"range"`
+	RoomIDs []string `json:"room_ids,omitempty"`
+}
+
+// SlidingListResponse describes the changes to a list since the last
+// response on the same connection.
+type SlidingListResponse struct {
+	Count int             `json:"count"`
+	Ops   []SlidingListOp `json:"ops"`
+}
+
+// SlidingRoomResponse contains the data for a single room. If Initial is set
+// then the client should replace everything it knows about the room,
+// otherwise the timeline should be appended to what it already has.
+type SlidingRoomResponse struct {
+	Name          string                          `json:"name,omitempty"`
+	RequiredState []gomatrixserverlib.ClientEvent `json:"required_state"`
+	Timeline      []gomatrixserverlib.ClientEvent `json:"timeline"`
+	Limited       bool                            `json:"limited"`
+	PrevBatch     string                          `json:"prev_batch,omitempty"`
+	Initial       bool                            `json:"initial,omitempty"`
+}
+
+// SlidingSyncResponse represents a sliding sync API response.
+type SlidingSyncResponse struct {
+	Pos   string                         `json:"pos"`
+	Lists []SlidingListResponse          `json:"lists"`
+	Rooms map[string]SlidingRoomResponse `json:"rooms"`
+}
+
+// NewSlidingSyncResponse creates an empty response with initialised maps.
+func NewSlidingSyncResponse() *SlidingSyncResponse {
+	return &SlidingSyncResponse{
+		Lists: []SlidingListResponse{},
+		Rooms: make(map[string]SlidingRoomResponse),
+	}
+}
+
+// IsEmpty returns true if the response contains no list operations or room
+// updates, i.e. there is nothing new to tell the client.
+func (r *SlidingSyncResponse) IsEmpty() bool {
+	if len(r.Rooms) > 0 {
+		return false
+	}
+	for _, list := range r.Lists {
+		if len(list.Ops) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -47,6 +47,14 @@ type StreamEvent struct {
 	ExcludeFromSync bool
 }
 
+// StateChange is the set of state event IDs which an event added to and
+// removed from the current state of its room.
+type StateChange struct {
+	StreamPosition StreamPosition
+	AddStateIDs    []string
+	RemoveStateIDs []string
+}
+
 // Range represents a range between two stream positions.
 type Range struct {
 	// From is the position the client has already received.
@@ -88,21 +96,53 @@ const (
 	SyncTokenTypeTopology SyncTokenType = "t"
 )
 
+// StreamingToken represents a position in each of the streams that make up
+// a /sync response. Each stream is queried independently, so that a change
+// in one stream doesn't require the others to be recalculated. The receipt
+// and device list positions are reserved for those streams and are always
+// zero for now.
 type StreamingToken struct {
-	syncToken
+	PDUPosition          StreamPosition
+	TypingPosition       StreamPosition
+	ReceiptPosition      StreamPosition
+	SendToDevicePosition StreamPosition
+	InvitePosition       StreamPosition
+	AccountDataPosition  StreamPosition
+	DeviceListPosition   StreamPosition
+}
+
+// positions returns the positions in the token in the order that they
+// appear in the string form of the token.
+func (t *StreamingToken) positions() []StreamPosition {
+	return []StreamPosition{
+		t.PDUPosition, t.TypingPosition, t.ReceiptPosition, t.SendToDevicePosition,
+		t.InvitePosition, t.AccountDataPosition, t.DeviceListPosition,
+	}
 }
 
-func (t *StreamingToken) PDUPosition() StreamPosition {
-	return t.Positions[0]
+// positionPointers returns pointers to the positions in the token in the
+// same order as positions.
+func (t *StreamingToken) positionPointers() []*StreamPosition {
+	return []*StreamPosition{
+		&t.PDUPosition, &t.TypingPosition, &t.ReceiptPosition, &t.SendToDevicePosition,
+		&t.InvitePosition, &t.AccountDataPosition, &t.DeviceListPosition,
+	}
 }
-func (t *StreamingToken) EDUPosition() StreamPosition {
-	return t.Positions[1]
+
+func (t StreamingToken) String() string {
+	positions := t.positions()
+	posStr := make([]string, len(positions))
+	for i := range positions {
+		posStr[i] = strconv.FormatInt(int64(positions[i]), 10)
+	}
+	return fmt.Sprintf("%s%s", SyncTokenTypeStream, strings.Join(posStr, "_"))
 }
 
 // IsAfter returns true if ANY position in this token is greater than `other`.
 func (t *StreamingToken) IsAfter(other StreamingToken) bool {
-	for i := range other.Positions {
-		if t.Positions[i] > other.Positions[i] {
+	theirs := other.positions()
+	for i, pos := range t.positions() {
+		if pos > theirs[i] {
 			return true
 		}
 	}
@@ -113,14 +153,13 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 // If the latter StreamingToken contains a field that is not 0, it is considered an update,
 // and its value will replace the corresponding value in the StreamingToken on which WithUpdates is called.
 func (t *StreamingToken) WithUpdates(other StreamingToken) (ret StreamingToken) {
-	ret.Type = t.Type
-	ret.Positions = make([]StreamPosition, len(t.Positions))
-	for i := range t.Positions {
-		ret.Positions[i] = t.Positions[i]
-		if other.Positions[i] == 0 {
+	ret = *t
+	updates := other.positions()
+	for i, pos := range ret.positionPointers() {
+		if updates[i] == 0 {
 			continue
 		}
-		ret.Positions[i] = other.Positions[i]
+		*pos = updates[i]
 	}
 	return ret
 }
@@ -136,7 +175,7 @@ func (t *TopologyToken) PDUPosition() StreamPosition {
 	return t.Positions[1]
 }
 func (t *TopologyToken) StreamToken() StreamingToken {
-	return NewStreamToken(t.PDUPosition(), 0)
+	return StreamingToken{PDUPosition: t.PDUPosition()}
 }
 func (t *TopologyToken) String() string {
 	return t.syncToken.String()
@@ -229,15 +268,12 @@ func NewTopologyTokenFromString(tok string) (token TopologyToken, err error) {
 	}, nil
 }
 
-// NewStreamToken creates a new sync token for /sync
-func NewStreamToken(pduPos, eduPos StreamPosition) StreamingToken {
-	return StreamingToken{
-		syncToken: syncToken{
-			Type:      SyncTokenTypeStream,
-			Positions: []StreamPosition{pduPos, eduPos},
-		},
-	}
-}
+// NewStreamTokenFromString parses a sync token for /sync. Tokens contain a
+// position for each stream, but tokens from older versions of Dendrite only
+// contain a PDU position and a single EDU position. The EDU position was an
+// in-memory counter that doesn't match the typing or send-to-device streams,
+// so for those tokens both of them start again from zero. The PDU position is
+// used for invites and account data, which previously shared the PDU stream.
 func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	t, err := newSyncTokenFromString(tok)
 	if err != nil {
@@ -247,13 +283,21 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 		err = fmt.Errorf("token %s is not a streaming token", tok)
 		return
 	}
-	if len(t.Positions) != 2 {
-		err = fmt.Errorf("token %s wrong number of values, got %d want 2", tok, len(t.Positions))
-		return
+	switch positions := token.positionPointers(); len(t.Positions) {
+	case 2:
+		token = StreamingToken{
+			PDUPosition:         t.Positions[0],
+			InvitePosition:      t.Positions[0],
+			AccountDataPosition: t.Positions[0],
+		}
+	case len(positions):
+		for i := range positions {
+			*positions[i] = t.Positions[i]
+		}
+	default:
+		err = fmt.Errorf("token %s wrong number of values, got %d want %d", tok, len(t.Positions), len(positions))
 	}
-	return StreamingToken{
-		syncToken: *t,
-	}, nil
+	return
 }
 
 // syncToken represents a syncapi token, used for interactions with
@@ -397,12 +441,23 @@ func NewLeaveResponse() *LeaveResponse {
 	return &res
 }
 
-type SendToDeviceNID int
-
+// SendToDeviceEvent is a send-to-device message waiting to be delivered to a
+// device. Its ID is also its position in the send-to-device stream.
 type SendToDeviceEvent struct {
 	gomatrixserverlib.SendToDeviceEvent
-	ID          SendToDeviceNID
-	UserID      string
-	DeviceID    string
-	SentByToken *StreamingToken
+	ID       StreamPosition
+	UserID   string
+	DeviceID string
+}
+
+// TypingNotification is the persisted typing state of a user in a room.
+type TypingNotification struct {
+	RoomID string
+	UserID string
+	// ExpiresAt is the time at which the user will stop typing, or 0 if the
+	// user has stopped typing.
+	ExpiresAt gomatrixserverlib.Timestamp
+	// StreamPosition is the typing stream position at which the user last
+	// started or stopped typing.
+	StreamPosition StreamPosition
 }
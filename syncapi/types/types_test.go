@@ -4,8 +4,8 @@ import "testing"
 
 func TestNewSyncTokenFromString(t *testing.T) {
 	shouldPass := map[string]syncToken{
-		"s4_0": NewStreamToken(4, 0).syncToken,
-		"s3_1": NewStreamToken(3, 1).syncToken,
+		"s4_0": {Type: SyncTokenTypeStream, Positions: []StreamPosition{4, 0}},
+		"s3_1": {Type: SyncTokenTypeStream, Positions: []StreamPosition{3, 1}},
 		"t3_1": NewTopologyToken(3, 1).syncToken,
 	}
 
@@ -36,3 +36,46 @@ func TestNewSyncTokenFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestNewStreamTokenFromString(t *testing.T) {
+	shouldPass := map[string]StreamingToken{
+		"s1_2_3_4_5_6_7": {
+			PDUPosition: 1, TypingPosition: 2, ReceiptPosition: 3, SendToDevicePosition: 4,
+			InvitePosition: 5, AccountDataPosition: 6, DeviceListPosition: 7,
+		},
+		"s0_0_0_0_0_0_0": {},
+		// Tokens from before the streams were split up. The EDU position
+		// doesn't mean anything to the typing or send-to-device streams.
+		"s4_2": {
+			PDUPosition: 4, InvitePosition: 4, AccountDataPosition: 4,
+		},
+	}
+
+	shouldFail := []string{
+		"s4",
+		"s1_2_3",
+		"s1_2_3_4_5",
+		"s1_2_3_4_5_6_7_8",
+		"t3_1",
+	}
+
+	for test, expected := range shouldPass {
+		result, err := NewStreamTokenFromString(test)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if result != expected {
+			t.Errorf("%s expected %v but got %v", test, expected.String(), result.String())
+		}
+		if roundTrip, err := NewStreamTokenFromString(result.String()); err != nil || roundTrip != result {
+			t.Errorf("%s didn't survive a round trip: got %v (err %v)", test, roundTrip.String(), err)
+		}
+	}
+
+	for _, test := range shouldFail {
+		if _, err := NewStreamTokenFromString(test); err == nil {
+			t.Errorf("input '%v' should have errored but didn't", test)
+		}
+	}
+}